@@ -0,0 +1,402 @@
+// packetctl is a command line client for packetd. It talks to the local
+// API over the restd unix socket so it can be used over SSH when the web
+// UI is unavailable.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/untangle/packetd/services/restd/client"
+)
+
+const usageText = `Usage: packetctl [options] <command> [arguments]
+
+Commands:
+  status [name]                  show a status page (default system)
+  sessions                       list the current sessions
+  settings get [path]            show the settings at a slash separated path
+  settings secrets [path]        show the settings with the secrets decrypted
+  settings set <path> <json>     replace the settings at a path with a JSON value
+  template render <file>         render and validate a settings template request file
+  template apply <file> [confirm]
+                                 render and commit a settings template request file
+  log <source> [level]           show or change the log level for a source
+  capture start <file>           start a traffic capture to a file
+  capture stop                   stop the traffic capture
+  capture status                 show the capture and playback state
+  playback                       show the playback position and last record state
+  playback pause|resume          pause or resume the playback
+  playback step [count]          play one or count records of a paused playback
+  playback speed <percent>       change the playback speed
+  diagnostics                    show the runtime and pipeline diagnostics
+  trace                          show the dispatch trace of the traced packets
+  trace start <json>             trace a ctid or the sessions matching a filter
+  trace stop                     stop the dispatch trace
+  faults                         show the injected faults
+  faults set <json>              inject a delay or errors at a fault point
+  faults clear                   remove all of the injected faults
+  whatif <json>                  show the rules and policy that match a session descriptor
+  queue                          show which zones are inspected and their queues
+  queue enable <zone> [start[-end]]
+                                 inspect a zone, optionally on its own queues
+  queue disable <zone>           bypass new sessions from a zone
+  queue reset <zone>             return a zone to its configured state
+  timeouts                       show the conntrack timeouts
+  timeouts set <protocol|application> <name> <seconds>
+                                 change a conntrack timeout until restart
+  timeouts reset <protocol|application> <name>
+                                 return a conntrack timeout to its configured value
+  certs                          list the cached server certificates
+  certs flush [server:port]      remove one or all cached certificates
+  callbacks                      show the callback counters by queue and interface
+  callbacks reset                clear the callback counters
+  blocklist [address]            list the blocked addresses or show one block
+  blocklist add <address> [ttl] [reason]
+                                 block an address or network for ttl seconds
+  blocklist update <address> <ttl> [reason]
+                                 change the expiration and reason of a block
+  blocklist remove <address>     remove the block for an address
+  version                        show the packetctl version
+
+Options:
+`
+
+func main() {
+	socketPtr := flag.String("socket", client.SocketFile, "the packetd API unix socket")
+	timeoutPtr := flag.Int("timeout", 30, "the request timeout in seconds")
+	rawPtr := flag.Bool("raw", false, "print the response without formatting")
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usageText)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if args[0] == "version" {
+		fmt.Printf("packetctl version %s\n", Version)
+		return
+	}
+
+	api := client.NewClient(*socketPtr, time.Duration(*timeoutPtr)*time.Second)
+
+	result, err := runCommand(api, args)
+	if result != nil {
+		printResult(result, *rawPtr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "packetctl: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// runCommand runs the argumented command and returns the API response
+func runCommand(api *client.Client, args []string) ([]byte, error) {
+	switch args[0] {
+	case "status":
+		name := "system"
+		if len(args) > 1 {
+			name = args[1]
+		}
+		return api.GetStatus(name)
+
+	case "sessions":
+		return api.GetStatus("sessions")
+
+	case "settings":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("settings requires get, secrets, or set")
+		}
+		switch args[1] {
+		case "get", "secrets":
+			var path string
+			if len(args) > 2 {
+				path = args[2]
+			}
+			if args[1] == "secrets" {
+				return api.GetSecretSettings(splitPath(path))
+			}
+			return api.GetSettings(splitPath(path))
+		case "set":
+			if len(args) != 4 {
+				return nil, fmt.Errorf("settings set requires a path and a JSON value")
+			}
+			return api.SetSettings(splitPath(args[2]), []byte(args[3]))
+		}
+		return nil, fmt.Errorf("unknown settings command: %s", args[1])
+
+	case "template":
+		if len(args) < 3 {
+			return nil, fmt.Errorf("template requires render or apply and a file")
+		}
+		request, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			return nil, err
+		}
+		switch args[1] {
+		case "render":
+			return api.RenderTemplate(request)
+		case "apply":
+			confirm := 300
+			if len(args) > 3 {
+				confirm, err = strconv.Atoi(args[3])
+				if err != nil || confirm < 0 {
+					return nil, fmt.Errorf("invalid confirm seconds: %s", args[3])
+				}
+			}
+			return api.ApplyTemplate(request, confirm)
+		}
+		return nil, fmt.Errorf("unknown template command: %s", args[1])
+
+	case "log":
+		if len(args) == 2 {
+			return api.GetLogLevel(args[1])
+		}
+		if len(args) == 3 {
+			return api.SetLogLevel(args[1], args[2])
+		}
+		return nil, fmt.Errorf("log requires a source and an optional level")
+
+	case "capture":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("capture requires start, stop, or status")
+		}
+		switch args[1] {
+		case "start":
+			if len(args) != 3 {
+				return nil, fmt.Errorf("capture start requires a file name")
+			}
+			return api.StartCapture(args[2])
+		case "stop":
+			return api.StopCapture()
+		case "status":
+			return api.GetCaptureStatus()
+		}
+		return nil, fmt.Errorf("unknown capture command: %s", args[1])
+
+	case "playback":
+		if len(args) == 1 {
+			return api.GetPlaybackState()
+		}
+		switch args[1] {
+		case "pause":
+			return api.PausePlayback()
+		case "resume":
+			return api.ResumePlayback()
+		case "step":
+			count := 1
+			if len(args) > 2 {
+				value, err := strconv.Atoi(args[2])
+				if err != nil {
+					return nil, fmt.Errorf("invalid step count: %s", args[2])
+				}
+				count = value
+			}
+			return api.StepPlayback(count)
+		case "speed":
+			if len(args) != 3 {
+				return nil, fmt.Errorf("playback speed requires a percentage")
+			}
+			speed, err := strconv.Atoi(args[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid playback speed: %s", args[2])
+			}
+			return api.SetPlaybackSpeed(speed)
+		}
+		return nil, fmt.Errorf("unknown playback command: %s", args[1])
+
+	case "diagnostics":
+		return api.GetDiagnostics()
+
+	case "trace":
+		if len(args) == 1 {
+			return api.GetTrace()
+		}
+		switch args[1] {
+		case "start":
+			if len(args) != 3 {
+				return nil, fmt.Errorf("trace start requires the JSON trace options")
+			}
+			return api.StartTrace([]byte(args[2]))
+		case "stop":
+			return api.StopTrace()
+		}
+		return nil, fmt.Errorf("unknown trace command: %s", args[1])
+
+	case "faults":
+		if len(args) == 1 {
+			return api.GetFaults()
+		}
+		switch args[1] {
+		case "set":
+			if len(args) != 3 {
+				return nil, fmt.Errorf("faults set requires the JSON fault")
+			}
+			return api.SetFault([]byte(args[2]))
+		case "clear":
+			return api.ClearFaults()
+		}
+		return nil, fmt.Errorf("unknown faults command: %s", args[1])
+
+	case "whatif":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("whatif requires a JSON session descriptor")
+		}
+		return api.WhatIf([]byte(args[1]))
+
+	case "queue":
+		if len(args) == 1 {
+			return api.GetQueueZones()
+		}
+		if len(args) < 3 {
+			return nil, fmt.Errorf("queue %s requires a zone", args[1])
+		}
+		switch args[1] {
+		case "enable":
+			var first, last int
+			if len(args) > 3 {
+				var err error
+				first, last, err = parseQueueRange(args[3])
+				if err != nil {
+					return nil, err
+				}
+			}
+			return api.SetQueueZone(args[2], true, first, last)
+		case "disable":
+			return api.SetQueueZone(args[2], false, 0, 0)
+		case "reset":
+			return api.ClearQueueZone(args[2])
+		}
+		return nil, fmt.Errorf("unknown queue command: %s", args[1])
+
+	case "timeouts":
+		if len(args) == 1 {
+			return api.GetTimeouts()
+		}
+		switch args[1] {
+		case "set":
+			if len(args) != 5 {
+				return nil, fmt.Errorf("timeouts set requires a type, name, and seconds")
+			}
+			seconds, err := strconv.Atoi(args[4])
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout: %s", args[4])
+			}
+			return api.SetTimeout(args[2], args[3], seconds)
+		case "reset":
+			if len(args) != 4 {
+				return nil, fmt.Errorf("timeouts reset requires a type and name")
+			}
+			return api.ClearTimeout(args[2], args[3])
+		}
+		return nil, fmt.Errorf("unknown timeouts command: %s", args[1])
+
+	case "certs":
+		if len(args) == 1 {
+			return api.GetCertificates()
+		}
+		if args[1] != "flush" {
+			return nil, fmt.Errorf("unknown certs command: %s", args[1])
+		}
+		var key string
+		if len(args) > 2 {
+			key = args[2]
+		}
+		return api.FlushCertificates(key)
+
+	case "callbacks":
+		if len(args) == 1 {
+			return api.GetCallbackStats()
+		}
+		if args[1] != "reset" {
+			return nil, fmt.Errorf("unknown callbacks command: %s", args[1])
+		}
+		return api.ResetCallbackStats()
+
+	case "blocklist":
+		if len(args) == 1 {
+			return api.GetBlocklist("")
+		}
+		switch args[1] {
+		case "add", "update":
+			if len(args) < 3 || (args[1] == "update" && len(args) < 4) {
+				return nil, fmt.Errorf("missing blocklist arguments")
+			}
+			var ttl int64
+			var reason string
+			if len(args) > 3 {
+				var err error
+				ttl, err = strconv.ParseInt(args[3], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid ttl: %s", args[3])
+				}
+				reason = strings.Join(args[4:], " ")
+			}
+			if args[1] == "add" {
+				return api.AddBlock(args[2], reason, ttl)
+			}
+			return api.UpdateBlock(args[2], reason, ttl)
+		case "remove":
+			if len(args) < 3 {
+				return nil, fmt.Errorf("missing blocklist address")
+			}
+			return api.RemoveBlock(args[2])
+		}
+		return api.GetBlocklist(args[1])
+	}
+
+	return nil, fmt.Errorf("unknown command: %s", args[0])
+}
+
+// splitPath splits a slash separated settings path into segments
+func splitPath(path string) []string {
+	var segments []string
+	for _, item := range strings.Split(path, "/") {
+		if item != "" {
+			segments = append(segments, item)
+		}
+	}
+	return segments
+}
+
+// parseQueueRange parses a queue number or a start-end range of queue numbers
+func parseQueueRange(text string) (int, int, error) {
+	parts := strings.SplitN(text, "-", 2)
+	first, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid queue range: %s", text)
+	}
+	if len(parts) == 1 {
+		return first, first, nil
+	}
+	last, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid queue range: %s", text)
+	}
+	return first, last, nil
+}
+
+// printResult prints the API response, indenting it if it is JSON
+func printResult(result []byte, raw bool) {
+	var buffer bytes.Buffer
+
+	if !raw && json.Indent(&buffer, result, "", "  ") == nil {
+		fmt.Println(buffer.String())
+		return
+	}
+
+	fmt.Println(strings.TrimSpace(string(result)))
+}
@@ -0,0 +1,4 @@
+package main
+
+// Version is completed by the build system
+var Version = "undefined"
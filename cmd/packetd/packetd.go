@@ -14,39 +14,88 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/c9s/goprocinfo/linux"
-	"github.com/untangle/packetd/plugins/certfetch"
-	"github.com/untangle/packetd/plugins/certsniff"
+	_ "github.com/untangle/packetd/plugins/anomaly"
+	_ "github.com/untangle/packetd/plugins/bridge"
+	_ "github.com/untangle/packetd/plugins/certfetch"
+	_ "github.com/untangle/packetd/plugins/certsniff"
 	"github.com/untangle/packetd/plugins/classify"
-	"github.com/untangle/packetd/plugins/dns"
-	"github.com/untangle/packetd/plugins/example"
-	"github.com/untangle/packetd/plugins/geoip"
-	"github.com/untangle/packetd/plugins/predicttraffic"
-	"github.com/untangle/packetd/plugins/reporter"
-	"github.com/untangle/packetd/plugins/revdns"
-	"github.com/untangle/packetd/plugins/sni"
-	"github.com/untangle/packetd/plugins/stats"
+	_ "github.com/untangle/packetd/plugins/conntimeout"
+	_ "github.com/untangle/packetd/plugins/dhcp"
+	_ "github.com/untangle/packetd/plugins/dns"
+	_ "github.com/untangle/packetd/plugins/dscp"
+	_ "github.com/untangle/packetd/plugins/example"
+	_ "github.com/untangle/packetd/plugins/geoip"
+	_ "github.com/untangle/packetd/plugins/memwatch"
+	_ "github.com/untangle/packetd/plugins/portscan"
+	_ "github.com/untangle/packetd/plugins/predicttraffic"
+	_ "github.com/untangle/packetd/plugins/ratelimit"
+	_ "github.com/untangle/packetd/plugins/reporter"
+	_ "github.com/untangle/packetd/plugins/revdns"
+	_ "github.com/untangle/packetd/plugins/rules"
+	_ "github.com/untangle/packetd/plugins/sni"
+	_ "github.com/untangle/packetd/plugins/stats"
+	_ "github.com/untangle/packetd/plugins/trafficmatrix"
+	_ "github.com/untangle/packetd/plugins/usage"
+	_ "github.com/untangle/packetd/plugins/vpn"
+	_ "github.com/untangle/packetd/plugins/wanfailover"
+	"github.com/untangle/packetd/services/blocklist"
 	"github.com/untangle/packetd/services/certcache"
 	"github.com/untangle/packetd/services/certmanager"
+	"github.com/untangle/packetd/services/clock"
+	"github.com/untangle/packetd/services/cloud"
+	"github.com/untangle/packetd/services/crashreport"
 	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/discovery"
 	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/faults"
+	"github.com/untangle/packetd/services/hasync"
+	"github.com/untangle/packetd/services/inventory"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/msgbus"
+	"github.com/untangle/packetd/services/neighbors"
+	"github.com/untangle/packetd/services/nftqueue"
 	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/patterns"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/policy"
 	"github.com/untangle/packetd/services/predicttrafficsvc"
+	"github.com/untangle/packetd/services/prefixes"
+	"github.com/untangle/packetd/services/preflight"
+	"github.com/untangle/packetd/services/profiler"
+	"github.com/untangle/packetd/services/profiles"
+	"github.com/untangle/packetd/services/qos"
 	"github.com/untangle/packetd/services/reports"
 	"github.com/untangle/packetd/services/restd"
+	"github.com/untangle/packetd/services/rulestats"
+	"github.com/untangle/packetd/services/schedule"
+	"github.com/untangle/packetd/services/servicemgr"
 	"github.com/untangle/packetd/services/settings"
+	"github.com/untangle/packetd/services/supervisor"
+	"github.com/untangle/packetd/services/tarpit"
+	"github.com/untangle/packetd/services/tuning"
+	"github.com/untangle/packetd/services/wwan"
+	"github.com/untangle/packetd/services/zones"
 )
 
 const rulesScript = "packetd_rules"
 
+// the defaults used when the counter persistence settings are missing
+const defaultCounterFile = "/etc/config/counters.json"
+const defaultCounterSaveSeconds = 300
+
 var localFlag bool
+var warehouseFile string
+var simulateFile string
+var simulateSpeed int
+var benchmarkSessions int
+var benchmarkPackets int
 var cpuCount = getConcurrencyFactor()
 var queueStart = 2000
 var conntrackIntervalSeconds = 10
@@ -69,10 +118,13 @@ func main() {
 	logger.Startup()
 	parseArguments()
 
-	// Start services
+	handleSignals()
+
+	// Start services and plugins
 	startServices()
 
-	handleSignals()
+	// Check the system before the kernel callbacks bind the queues
+	runStartupChecks()
 
 	// for i := 0; i < 5; i++ {
 	// 	go func() {
@@ -82,17 +134,26 @@ func main() {
 	// 	}()
 	// }
 
-	// Start the plugins
-	logger.Info("Starting plugins...\n")
-	startPlugins()
-
-	// Start the callbacks AFTER all services and plugins are initialized
-	logger.Info("Starting kernel callbacks...\n")
-	kernel.StartCallbacks(cpuCount, conntrackIntervalSeconds)
+	if benchmarkSessions != 0 {
+		go runBenchmark()
+	} else if len(simulateFile) != 0 {
+		go func() {
+			err := dispatch.SimulateFile(simulateFile, simulateSpeed)
+			if err != nil {
+				logger.Err("Failed to simulate traffic from %s: %v\n", simulateFile, err)
+				return
+			}
+			logger.Notice("Finished simulating traffic from %s\n", simulateFile)
+		}()
+	} else {
+		// Start the callbacks AFTER all services and plugins are initialized
+		logger.Info("Starting kernel callbacks...\n")
+		kernel.StartCallbacks(cpuCount, conntrackIntervalSeconds)
 
-	// Insert netfilter rules
-	logger.Info("Inserting netfilter rules...\n")
-	insertRules()
+		// Insert netfilter rules
+		logger.Info("Inserting netfilter rules...\n")
+		insertRules()
+	}
 
 	// If the local flag is set we start a goroutine to watch for console input.
 	// This can be used to quickly/easily tell the application to terminate when
@@ -111,11 +172,18 @@ func main() {
 	}
 
 	if kernel.GetWarehouseFlag() == 'P' {
-		dispatch.HandleWarehousePlayback()
+		err = dispatch.HandleWarehousePlayback(warehouseFile)
+		if err != nil {
+			logger.Err("Failed to playback %s: %v\n", warehouseFile, err)
+		}
 	}
 
 	if kernel.GetWarehouseFlag() == 'C' {
-		kernel.StartWarehouseCapture()
+		err = dispatch.StartWarehouseCapture(warehouseFile)
+		if err != nil {
+			logger.Err("Failed to capture to %s: %v\n", warehouseFile, err)
+			kernel.SetWarehouseFlag('I')
+		}
 	}
 
 	// Wait until the shutdown flag is set
@@ -132,25 +200,28 @@ func main() {
 	logger.Info("Shutdown initiated...\n")
 
 	if kernel.GetWarehouseFlag() == 'C' {
-		kernel.CloseWarehouseCapture()
+		dispatch.CloseWarehouseCapture()
 	}
 
 	// Remove netfilter rules
-	logger.Info("Removing netfilter rules...\n")
-	removeRules()
+	if len(simulateFile) == 0 && benchmarkSessions == 0 {
+		logger.Info("Removing netfilter rules...\n")
+		removeRules()
+	}
 
 	// Stop kernel callbacks
 	logger.Info("Removing kernel callbacks...\n")
 	kernel.StopCallbacks()
 
-	// Stop all plugins
-	logger.Info("Stopping plugins...\n")
-	stopPlugins()
-
-	// Stop services
+	// Stop plugins and services
 	logger.Info("Stopping services...\n")
 
 	stopServices()
+
+	// a non-zero exit status tells the init system to start a new packetd
+	if supervisor.IsRestartRequested() {
+		os.Exit(1)
+	}
 }
 
 func printVersion() {
@@ -174,6 +245,9 @@ func parseArguments() {
 	noConntrackPtr := flag.Bool("no-conntrack", false, "disable the conntrack callback hook")
 	noNetloggerPtr := flag.Bool("no-netlogger", false, "disable the netlogger callback hook")
 	noCloudPtr := flag.Bool("no-cloud", false, "disable all cloud services")
+	simulatePtr := flag.String("simulate", "", "process traffic only from specified warehouse or pcap file")
+	benchmarkPtr := flag.Int("benchmark", 0, "run a benchmark with the specified number of sessions and exit")
+	benchmarkPacketsPtr := flag.Int("benchmark-packets", 10, "number of packets per benchmark session")
 
 	flag.Parse()
 
@@ -201,12 +275,12 @@ func parseArguments() {
 	}
 
 	if len(*playbackFilePtr) != 0 {
-		kernel.SetWarehouseFile(*playbackFilePtr)
+		warehouseFile = *playbackFilePtr
 		kernel.SetWarehouseFlag('P')
 	}
 
 	if len(*captureFilePtr) != 0 {
-		kernel.SetWarehouseFile(*captureFilePtr)
+		warehouseFile = *captureFilePtr
 		kernel.SetWarehouseFlag('C')
 	}
 
@@ -246,27 +320,107 @@ func parseArguments() {
 		kernel.FlagNoCloud = true
 		logger.Alert("!!!!! The no-cloud flag was passed on the command line !!!!!\n")
 	}
+
+	// simulation mode doesn't use any of the kernel hooks since all of the
+	// traffic comes from the file, so we also leave the netfilter rules alone
+	if len(*simulatePtr) != 0 {
+		simulateFile = *simulatePtr
+		simulateSpeed = *playSpeedPtr
+		kernel.FlagNoNfqueue = true
+		kernel.FlagNoConntrack = true
+		kernel.FlagNoNetlogger = true
+		logger.Alert("!!!!! Simulating traffic from %s - Live traffic will be ignored !!!!!\n", simulateFile)
+	}
+
+	if *benchmarkPtr > 0 {
+		benchmarkSessions = *benchmarkPtr
+		benchmarkPackets = *benchmarkPacketsPtr
+		kernel.FlagNoNfqueue = true
+		kernel.FlagNoConntrack = true
+		kernel.FlagNoNetlogger = true
+		logger.Alert("!!!!! Running benchmark - Live traffic will be ignored !!!!!\n")
+	}
 }
 
-// startServices starts all the services
+// runBenchmark runs the benchmark, logs the results, and shuts down
+func runBenchmark() {
+	result, err := dispatch.RunBenchmark(benchmarkSessions, benchmarkPackets)
+	if err != nil {
+		logger.Err("Failed to run benchmark: %v\n", err)
+	} else {
+		logger.Notice("Benchmark sessions:%d packets:%d workers:%d elapsed:%.3f\n", result.Sessions, result.Packets, result.Workers, result.ElapsedSeconds)
+		logger.Notice("Benchmark sessions/sec:%.1f packets/sec:%.1f\n", result.SessionsPerSecond, result.PacketsPerSecond)
+		for name, item := range result.NfqueueLatency {
+			logger.Notice("Benchmark nfqueue   %-20s calls:%-8d avg:%.3fms max:%.3fms\n", name, item.Calls, item.AverageMs, item.MaxMs)
+		}
+		for name, item := range result.ConntrackLatency {
+			logger.Notice("Benchmark conntrack %-20s calls:%-8d avg:%.3fms max:%.3fms\n", name, item.Calls, item.AverageMs, item.MaxMs)
+		}
+	}
+	kernel.SetShutdownFlag()
+}
+
+// startServices registers all the services with the service manager and
+// starts them in dependency order. The plugins are started as a service
+// so they come up after everything they use, with restd last.
 func startServices() {
 	logger.Info("Starting services...\n")
 
 	printVersion()
 	loadRequirements()
 
-	kernel.Startup()
-	dispatch.Startup(conntrackIntervalSeconds)
-	settings.Startup()
-	reports.Startup()
-	dict.Startup()
-	restd.Startup()
-	certcache.Startup()
-	overseer.Startup()
-	certmanager.Startup()
-
-	if !kernel.FlagNoCloud {
-		predicttrafficsvc.Startup()
+	// the logger is started first in main so argument parsing can log
+	servicemgr.Register(servicemgr.Service{Name: "settings", Startup: wrapStartup(settings.Startup), Shutdown: settings.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "logger", Depends: []string{"settings"}, Shutdown: logger.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "kernel", Depends: []string{"logger"}, Startup: kernel.Startup, Shutdown: kernel.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "eventbus", Depends: []string{"settings", "logger"}, Startup: wrapStartup(eventbus.Startup), Shutdown: eventbus.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "zones", Depends: []string{"settings", "logger"}, Startup: wrapStartup(zones.Startup), Shutdown: zones.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "nftqueue", Depends: []string{"settings", "kernel", "zones"}, Startup: wrapStartup(nftqueue.Startup), Shutdown: nftqueue.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "schedule", Depends: []string{"settings", "logger"}, Startup: wrapStartup(schedule.Startup), Shutdown: schedule.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "policy", Depends: []string{"settings", "logger"}, After: []string{"schedule"}, Startup: wrapStartup(policy.Startup), Shutdown: policy.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "dispatch", Depends: []string{"kernel"}, After: []string{"zones", "policy", "reports"}, Startup: wrapStartup(func() { dispatch.Startup(conntrackIntervalSeconds) }), Shutdown: dispatch.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "tuning", Depends: []string{"settings", "logger"}, Startup: wrapStartup(tuning.Startup), Shutdown: tuning.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "faults", Depends: []string{"settings", "logger"}, Startup: wrapStartup(faults.Startup), Shutdown: faults.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "reports", Depends: []string{"settings", "kernel"}, Startup: reports.Startup, Shutdown: reports.Shutdown, Timeout: 60 * time.Second})
+	servicemgr.Register(servicemgr.Service{Name: "dict", Depends: []string{"logger"}, Startup: wrapStartup(dict.Startup), Shutdown: dict.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "inventory", Depends: []string{"dict"}, Startup: wrapStartup(inventory.Startup), Shutdown: inventory.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "profiles", Depends: []string{"settings", "policy", "inventory"}, Startup: wrapStartup(profiles.Startup), Shutdown: profiles.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "discovery", Depends: []string{"settings", "inventory"}, Startup: wrapStartup(discovery.Startup), Shutdown: discovery.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "certcache", Depends: []string{"settings", "dispatch", "dict", "reports"}, Startup: wrapStartup(certcache.Startup), Shutdown: certcache.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "crashreport", Depends: []string{"settings", "logger"}, Startup: wrapStartup(crashreport.Startup), Shutdown: crashreport.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "supervisor", Depends: []string{"settings", "kernel"}, Startup: wrapStartup(supervisor.Startup), Shutdown: supervisor.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "profiler", Depends: []string{"settings", "logger"}, Startup: wrapStartup(profiler.Startup), Shutdown: profiler.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "overseer", Depends: []string{"settings", "logger"}, Startup: wrapStartup(startOverseer), Shutdown: overseer.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "patterns", Depends: []string{"settings", "dispatch"}, Startup: wrapStartup(patterns.Startup), Shutdown: patterns.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "certmanager", Depends: []string{"settings"}, Startup: wrapStartup(certmanager.Startup), Shutdown: certmanager.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "predicttrafficsvc", Depends: []string{"logger"}, Startup: wrapStartup(predicttrafficsvc.Startup), Shutdown: predicttrafficsvc.Shutdown, Disabled: kernel.FlagNoCloud})
+	servicemgr.Register(servicemgr.Service{Name: "blocklist", Depends: []string{"settings", "eventbus"}, Startup: wrapStartup(blocklist.Startup), Shutdown: blocklist.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "tarpit", Depends: []string{"settings", "zones", "reports"}, Startup: wrapStartup(tarpit.Startup), Shutdown: tarpit.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "rulestats", Depends: []string{"settings", "reports"}, Startup: wrapStartup(rulestats.Startup), Shutdown: rulestats.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "msgbus", Depends: []string{"settings", "eventbus"}, Startup: wrapStartup(msgbus.Startup), Shutdown: msgbus.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "qos", Depends: []string{"settings"}, Startup: wrapStartup(qos.Startup), Shutdown: qos.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "clock", Depends: []string{"settings", "reports", "eventbus"}, Startup: wrapStartup(clock.Startup), Shutdown: clock.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "prefixes", Depends: []string{"settings", "reports", "eventbus"}, Startup: wrapStartup(prefixes.Startup), Shutdown: prefixes.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "neighbors", Depends: []string{"settings", "reports", "eventbus"}, Startup: wrapStartup(neighbors.Startup), Shutdown: neighbors.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "wwan", Depends: []string{"settings", "reports"}, Startup: wrapStartup(wwan.Startup), Shutdown: wwan.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "hasync", Depends: []string{"settings", "dispatch", "dict", "inventory"}, Startup: wrapStartup(hasync.Startup), Shutdown: hasync.Shutdown})
+	servicemgr.Register(servicemgr.Service{Name: "cloud", Depends: []string{"settings", "dispatch", "reports"}, Startup: wrapStartup(cloud.Startup), Shutdown: cloud.Shutdown, Disabled: kernel.FlagNoCloud})
+
+	// the plugins need the core services but can run without the optional ones
+	servicemgr.Register(servicemgr.Service{
+		Name:     "plugins",
+		Depends:  []string{"dispatch", "reports", "dict"},
+		After:    []string{"tuning", "inventory", "discovery", "certcache", "overseer", "patterns", "certmanager", "predicttrafficsvc"},
+		Startup:  wrapStartup(pluginsdk.StartPlugins),
+		Shutdown: pluginsdk.StopPlugins,
+		Timeout:  60 * time.Second,
+	})
+
+	// restd only needs the settings so it can report a partial startup
+	servicemgr.Register(servicemgr.Service{Name: "restd", Depends: []string{"settings", "logger"}, After: []string{"plugins"}, Startup: restd.Startup, Shutdown: restd.Shutdown, Retries: 2})
+
+	if !servicemgr.StartServices() {
+		logger.Err("Some services failed to start - see /api/status/system for details\n")
 	}
 }
 
@@ -274,19 +428,7 @@ func startServices() {
 func stopServices() {
 	c := make(chan bool)
 	go func() {
-		if !kernel.FlagNoCloud {
-			predicttrafficsvc.Shutdown()
-		}
-		overseer.Shutdown()
-		certmanager.Shutdown()
-		certcache.Shutdown()
-		restd.Shutdown()
-		dict.Shutdown()
-		reports.Shutdown()
-		settings.Shutdown()
-		dispatch.Shutdown()
-		kernel.Shutdown()
-		logger.Shutdown()
+		servicemgr.StopServices()
 		c <- true
 	}()
 
@@ -299,80 +441,57 @@ func stopServices() {
 	}
 }
 
-// startPlugins starts all the plugins (in parallel)
-func startPlugins() {
-	var wg sync.WaitGroup
-
-	// Start Plugins
-	startups := []func(){
-		example.PluginStartup,
-		classify.PluginStartup,
-		geoip.PluginStartup,
-		certfetch.PluginStartup,
-		certsniff.PluginStartup,
-		dns.PluginStartup,
-		revdns.PluginStartup,
-		sni.PluginStartup,
-		stats.PluginStartup,
-		reporter.PluginStartup}
-	if !kernel.FlagNoCloud {
-		startups = append(startups, predicttraffic.PluginStartup)
-	}
-	for _, f := range startups {
-		wg.Add(1)
-		go func(f func()) {
-			f()
-			wg.Done()
-		}(f)
-	}
-
-	wg.Wait()
+// wrapStartup adapts a service startup function that doesn't return an
+// error for the service manager
+func wrapStartup(startup func()) func() error {
+	return func() error {
+		startup()
+		return nil
+	}
 }
 
-// stopPlugins stops all the plugins (in parallel)
-func stopPlugins() {
-	var wg sync.WaitGroup
-
-	shutdowns := []func(){
-		example.PluginShutdown,
-		classify.PluginShutdown,
-		geoip.PluginShutdown,
-		certfetch.PluginShutdown,
-		certsniff.PluginShutdown,
-		dns.PluginShutdown,
-		revdns.PluginShutdown,
-		sni.PluginShutdown,
-		stats.PluginShutdown,
-		reporter.PluginShutdown}
-	if !kernel.FlagNoCloud {
-		shutdowns = append(shutdowns, predicttraffic.PluginShutdown)
-	}
-	for _, f := range shutdowns {
-		wg.Add(1)
-		go func(f func()) {
-			f()
-			wg.Done()
-		}(f)
-	}
-
-	wg.Wait()
+// startOverseer starts the overseer and restores the saved counters. The
+// overseer can't read the settings itself since the logger uses it.
+func startOverseer() {
+	overseer.Startup()
+	loadCounterPersistence()
 }
 
-// signalPlugins signals all plugins with a handler (in parallel)
-func signalPlugins(message syscall.Signal) {
-	var wg sync.WaitGroup
+// loadCounterPersistence passes the counter persistence settings to the overseer
+func loadCounterPersistence() {
+	config := overseer.PersistConfig{File: defaultCounterFile, IntervalSeconds: defaultCounterSaveSeconds}
+
+	persistJSON, err := settings.GetCurrentSettings([]string{"overseer", "persist"})
+	if persistJSON != nil && err == nil {
+		item, ok := persistJSON.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid counter persistence settings: %T\n", persistJSON)
+		} else {
+			if value, ok := item["file"].(string); ok && value != "" {
+				config.File = value
+			}
+			if value, ok := item["intervalSeconds"].(float64); ok && value >= 0 {
+				config.IntervalSeconds = int(value)
+			}
+			list, _ := item["counters"].([]interface{})
+			for _, entry := range list {
+				if name, ok := entry.(string); ok && name != "" {
+					config.Counters = append(config.Counters, name)
+				}
+			}
+		}
+	}
 
-	targets := []func(syscall.Signal){
-		stats.PluginSignal}
-	for _, f := range targets {
-		wg.Add(1)
-		go func(f func(syscall.Signal)) {
-			f(message)
-			wg.Done()
-		}(f)
+	restored, err := overseer.SetPersistence(config)
+	if err != nil {
+		logger.Warn("Unable to restore the counters from %s: %v\n", config.File, err)
 	}
+	logger.Info("Loaded counter persistence file:%s counters:%v interval:%d restored:%d\n", config.File, config.Counters, config.IntervalSeconds, restored)
+}
 
-	wg.Wait()
+// signalPlugins signals all the registered plugins (in parallel)
+func signalPlugins(message syscall.Signal) {
+	pluginsdk.SignalPlugins(message)
 }
 
 // Add signal handlers
@@ -406,6 +525,33 @@ func handleSignals() {
 		for {
 			sig := <-hupch
 			logger.Info("Recived signal [%v]. Calling handlers\n", sig)
+			tuning.Reload()
+			faults.Reload()
+			zones.Reload()
+			nftqueue.Reload()
+			eventbus.Reload()
+			schedule.Reload()
+			// this also reloads the policy with the rules from the profiles
+			profiles.Reload()
+			dispatch.Reload()
+			reports.Reload()
+			patterns.Reload()
+			certcache.Reload()
+			cloud.Reload()
+			msgbus.Reload()
+			rulestats.Reload()
+			blocklist.Reload()
+			tarpit.Reload()
+			supervisor.Reload()
+			profiler.Reload()
+			crashreport.Reload()
+			hasync.Reload()
+			wwan.Reload()
+			clock.Reload()
+			prefixes.Reload()
+			neighbors.Reload()
+			qos.Reload()
+			loadCounterPersistence()
 			signalPlugins(syscall.SIGHUP)
 		}
 	}()
@@ -416,18 +562,14 @@ func insertRules() {
 	if kernel.FlagNoNfqueue {
 		return
 	}
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	script, err := getRulesScript()
 	if err != nil {
 		logger.Err("Error determining directory: %s\n", err.Error())
 		return
 	}
-	home, ok := os.LookupEnv("PACKETD_HOME")
-	if ok && home != "" {
-		dir = home
-	}
 	qmin := strconv.Itoa(queueStart)
 	qmax := strconv.Itoa(queueStart + cpuCount - 1)
-	output, err := exec.Command(dir+"/"+rulesScript, "INSERT", qmin, qmax).CombinedOutput()
+	output, err := exec.Command(script, "INSERT", qmin, qmax).CombinedOutput()
 	if err != nil {
 		logger.Warn("Error running %v INSERT %v %v: %v\n", rulesScript, qmin, qmax, err.Error())
 		kernel.SetShutdownFlag()
@@ -437,21 +579,18 @@ func insertRules() {
 				logger.Info("%s\n", line)
 			}
 		}
+		nftqueue.Activate()
 	}
 }
 
 // remove the netfilter queue rules for packetd
 func removeRules() {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	script, err := getRulesScript()
 	if err != nil {
 		logger.Err("Error determining directory: %s\n", err.Error())
 		return
 	}
-	home, ok := os.LookupEnv("PACKETD_HOME")
-	if ok && home != "" {
-		dir = home
-	}
-	output, err := exec.Command(dir+"/"+rulesScript, "REMOVE").CombinedOutput()
+	output, err := exec.Command(script, "REMOVE").CombinedOutput()
 	if err != nil {
 		logger.Err("Error running %v REMOVE: %v\n", err.Error())
 	} else {
@@ -463,6 +602,20 @@ func removeRules() {
 	}
 }
 
+// getRulesScript returns the path of the netfilter rules script, which is
+// next to the packetd binary unless PACKETD_HOME is set
+func getRulesScript() (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		return "", err
+	}
+	home, ok := os.LookupEnv("PACKETD_HOME")
+	if ok && home != "" {
+		dir = home
+	}
+	return dir + "/" + rulesScript, nil
+}
+
 // prints some basic stats about packetd
 func printStats() {
 	var mem runtime.MemStats
@@ -474,6 +627,9 @@ func printStats() {
 	logger.Info("Memory HeapSys: %d kB\n", (mem.HeapSys / 1024))
 
 	logger.Info("Reports EventsLogged: %d\n", atomic.LoadUint64(&reports.EventsLogged))
+	logger.Info("Reports EventsFiltered: %d\n", atomic.LoadUint64(&reports.EventsFiltered))
+	logger.Info("Reports EventsSuppressed: %d\n", atomic.LoadUint64(&reports.EventsSuppressed))
+	logger.Info("Reports EventsCollapsed: %d\n", atomic.LoadUint64(&reports.EventsCollapsed))
 	stats, err := getProcStats()
 	if err == nil {
 		for _, line := range strings.Split(stats, "\n") {
@@ -514,22 +670,89 @@ func getProcStats() (string, error) {
 	return interesting, nil
 }
 
-// load all packetd requirements
+// load all packetd requirements. Anything that fails here is reported by
+// the startup checks.
 func loadRequirements() {
 	err := exec.Command("modprobe", "nf_conntrack").Run()
 	if err != nil {
-		logger.Err("Failed to modprobe nf_conntrack: %s", err.Error())
+		logger.Debug("Failed to modprobe nf_conntrack: %s\n", err.Error())
 	}
 	err = ioutil.WriteFile("/proc/sys/net/netfilter/nf_conntrack_acct", []byte("1"), 0644)
 	if err != nil {
-		logger.Err("Failed to enable nf_conntrack_acct %s", err.Error())
+		logger.Debug("Failed to enable nf_conntrack_acct %s\n", err.Error())
 	}
 	err = ioutil.WriteFile("/proc/sys/net/netfilter/nf_conntrack_timestamp", []byte("1"), 0644)
 	if err != nil {
-		logger.Err("Failed to enable nf_conntrack_timestamp %s", err.Error())
+		logger.Debug("Failed to enable nf_conntrack_timestamp %s\n", err.Error())
 	}
 }
 
+// runStartupChecks checks the external things packetd needs and keeps the
+// results for /api/status/health. The checks for the kernel hooks and the
+// rules are skipped when they are disabled on the command line.
+func runStartupChecks() {
+	var checks []preflight.Check
+
+	checks = append(checks, preflight.Check{
+		Name:   "conntrack_module",
+		Run:    preflight.Exists("/proc/sys/net/netfilter/nf_conntrack_acct"),
+		Action: "load the nf_conntrack kernel module with modprobe nf_conntrack",
+	})
+	checks = append(checks, preflight.Check{
+		Name:   "conntrack_acct",
+		Run:    preflight.FileValue("/proc/sys/net/netfilter/nf_conntrack_acct", "1"),
+		Action: "enable conntrack accounting with sysctl net.netfilter.nf_conntrack_acct=1",
+	})
+	checks = append(checks, preflight.Check{
+		Name:   "conntrack_timestamp",
+		Run:    preflight.FileValue("/proc/sys/net/netfilter/nf_conntrack_timestamp", "1"),
+		Action: "enable conntrack timestamps with sysctl net.netfilter.nf_conntrack_timestamp=1",
+	})
+	checks = append(checks, preflight.Check{
+		Name:   "nft_binary",
+		Run:    preflight.Binary("nft"),
+		Action: "install the nftables package so nft is in the path",
+	})
+
+	if !kernel.FlagNoNfqueue {
+		script, err := getRulesScript()
+		if err != nil {
+			script = rulesScript
+		}
+		checks = append(checks, preflight.Check{
+			Name:   "rules_script",
+			Run:    preflight.Executable(script),
+			Action: "install " + rulesScript + " next to the packetd binary or set PACKETD_HOME to its directory",
+		})
+		checks = append(checks, preflight.Check{
+			Name:   "nfqueue_numbers",
+			Run:    preflight.QueuesFree(queueStart, cpuCount),
+			Action: fmt.Sprintf("stop the other process bound to queues %d-%d", queueStart, queueStart+cpuCount-1),
+		})
+	}
+
+	if !dict.IsDisabled() {
+		checks = append(checks, preflight.Check{
+			Name:   "dict_module",
+			Run:    dict.CheckModule,
+			Action: "load the nft_dict kernel module with modprobe nft_dict or start packetd with -disable-dict",
+		})
+	}
+
+	checks = append(checks, preflight.Check{
+		Name:   "reports_database",
+		Run:    preflight.Writable(filepath.Dir(reports.GetDatabaseFilename())),
+		Action: "make " + filepath.Dir(reports.GetDatabaseFilename()) + " writable so the reports database can be created",
+	})
+	checks = append(checks, preflight.Check{
+		Name:   "reports_integrity",
+		Run:    reports.CheckIntegrity,
+		Action: "check the storage of " + filepath.Dir(reports.GetDatabaseFilename()) + ", the damaged reports database is kept with the .corrupt suffix",
+	})
+
+	preflight.Run(checks)
+}
+
 // getConcurrencyFactor returns the number of CPUs
 // or 4 if any error occurs in determining the number
 func getConcurrencyFactor() int {
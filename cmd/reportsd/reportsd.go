@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// reportsd serves the reports queries from the database packetd writes. The
+// database is opened read only so a heavy query runs in this process without
+// holding up the event logging in packetd.
+
+var listenAddress string
+var engine *gin.Engine
+var shutdownChannel = make(chan bool, 1)
+
+func main() {
+	logger.Startup()
+	parseArguments()
+	handleSignals()
+
+	// packetd creates the database so wait for it to exist
+	for {
+		err := reports.StartupReader()
+		if err == nil {
+			break
+		}
+		logger.Warn("Unable to open the reports database: %v\n", err)
+		select {
+		case <-shutdownChannel:
+			logger.Shutdown()
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+
+	startupRestDaemon()
+
+	<-shutdownChannel
+
+	logger.Info("Stopping services...\n")
+	stopServices()
+}
+
+func printVersion() {
+	logger.Info("Untangle Reports Daemon Version %s\n", Version)
+}
+
+// parseArguments parses the command line arguments
+func parseArguments() {
+	listenPtr := flag.String("listen", "127.0.0.1:8486", "host:port to serve the queries on")
+	versionPtr := flag.Bool("version", false, "version")
+
+	flag.Parse()
+
+	if *versionPtr {
+		printVersion()
+		os.Exit(0)
+	}
+
+	listenAddress = *listenPtr
+}
+
+// startupRestDaemon starts the engine serving the reports queries. It has no
+// authentication so it only listens on localhost by default.
+func startupRestDaemon() {
+	gin.DisableConsoleColor()
+	gin.DefaultWriter = logger.NewLogWriter()
+	engine = gin.Default()
+
+	api := engine.Group("/api")
+	api.POST("/reports/create_query", reportsCreateQuery)
+	api.GET("/reports/get_data/:query_id", reportsGetData)
+	api.POST("/reports/close_query/:query_id", reportsCloseQuery)
+	api.GET("/reports/slow_queries", reportsSlowQueries)
+
+	go func() {
+		err := engine.Run(listenAddress)
+		if err != nil {
+			logger.Err("Unable to serve on %s: %v\n", listenAddress, err)
+			shutdownChannel <- true
+		}
+	}()
+
+	printVersion()
+	logger.Info("The reports engine has been started on %s\n", listenAddress)
+}
+
+// stopServices stops all the services
+func stopServices() {
+	c := make(chan bool)
+	go func() {
+		reports.ShutdownReader()
+		logger.Shutdown()
+		c <- true
+	}()
+
+	select {
+	case <-c:
+	case <-time.After(10 * time.Second):
+		// can't use logger as it may be stopped
+		fmt.Printf("ERROR: Failed to properly shutdown services\n")
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// Add signal handlers
+func handleSignals() {
+	// Add SIGINT & SIGTERM handler (exit)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		logger.Warn("Received signal [%v]. Shutting down\n", sig)
+		shutdownChannel <- true
+	}()
+}
+
+func reportsCreateQuery(c *gin.Context) {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	q, err := reports.CreateQuery(string(body))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	str := fmt.Sprintf("%v", q.ID)
+	logger.Debug("CreateQuery(%s)\n", str)
+	c.String(http.StatusOK, str)
+}
+
+func reportsGetData(c *gin.Context) {
+	queryID, err := strconv.ParseUint(c.Param("query_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	str, err := reports.GetData(queryID)
+	if err != nil {
+		// the UI expects the errors with a 200 the same as packetd sends them
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.String(http.StatusOK, str)
+}
+
+func reportsCloseQuery(c *gin.Context) {
+	queryID, err := strconv.ParseUint(c.Param("query_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	str, err := reports.CloseQuery(queryID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.String(http.StatusOK, str)
+}
+
+func reportsSlowQueries(c *gin.Context) {
+	c.JSON(http.StatusOK, reports.GetSlowQueries())
+}
@@ -0,0 +1,316 @@
+// Package anomaly provides the "anomaly" plugin
+// The anomaly plugin adds up the bytes and the sessions of every local device
+// and every application and writes the totals to the hourly traffic_hourly
+// rollup table. When an hour is over the totals of that hour are compared to
+// a baseline learned from the same hour of the week in the previous weeks of
+// the rollup, and the hours that deviate from the baseline by more than the
+// configured number of standard deviations are logged as anomaly events.
+package anomaly
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/inventory"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const pluginName = "anomaly"
+const rollupLogIntervalSec = 60
+
+// The kinds of traffic the baselines are learned for
+const (
+	KindDevice      = "device"
+	KindApplication = "application"
+)
+
+// the defaults used when the anomaly settings are missing
+const defaultWeeks = 4
+const defaultMinimumWeeks = 2
+const defaultThreshold = 3.0
+const defaultMinimumBytes = 10 * 1024 * 1024
+const defaultMinimumSessions = 50
+
+// anomalyConfig holds the anomaly settings
+type anomalyConfig struct {
+	enabled         bool
+	weeks           int
+	minimumWeeks    int
+	threshold       float64
+	minimumBytes    float64
+	minimumSessions float64
+}
+
+// rollupHolder is used to accumulate the traffic of a device or application
+type rollupHolder struct {
+	address  net.IP
+	bytes    uint64
+	sessions uint64
+}
+
+var deviceTable map[string]*rollupHolder
+var applicationTable map[string]*rollupHolder
+var rollupMutex sync.Mutex
+var shutdownChannel = make(chan bool)
+
+// init registers the plugin with the plugin registry and the tables with the
+// reports schema registry. The hourly traffic has one row per device or
+// application per hour and is updated in place by upsert events.
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "traffic_hourly",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "kind", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "name", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "bytes", Type: "int8"},
+			{Name: "sessions", Type: "int8"},
+		},
+		Unique:      []string{"time_stamp", "kind", "name"},
+		TrimPercent: .1,
+	})
+
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "anomaly_events",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "kind", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "name", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "metric", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "value", Type: "real"},
+			{Name: "expected", Type: "real"},
+			{Name: "deviation", Type: "real"},
+			{Name: "score", Type: "real"},
+		},
+		TrimPercent: .1,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: 2, ConntrackFunc: PluginConntrackHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	deviceTable = make(map[string]*rollupHolder)
+	applicationTable = make(map[string]*rollupHolder)
+	go anomalyTask()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of anomalyTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown anomalyTask\n")
+	}
+
+	// write whatever we collected since the last interval
+	logRollup(time.Now().Truncate(time.Hour))
+}
+
+// PluginConntrackHandler receives conntrack events and adds the sessions and
+// the bytes to the totals of the client device and the application. The
+// application isn't known when the session starts, so the session is counted
+// for the application on the first update after it was classified.
+func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
+	if message != 'N' && message != 'U' {
+		return
+	}
+
+	entry.Guardian.RLock()
+	session := entry.Session
+	address := entry.ClientSideTuple.ClientAddress
+	bytes := entry.ClientBytesDiff + entry.ServerBytesDiff
+	entry.Guardian.RUnlock()
+
+	if address == nil {
+		return
+	}
+
+	var application string
+	var counted bool
+	if message == 'U' && session != nil {
+		application, _ = session.GetAttachment("application_name").(string)
+		if application != "" && session.GetAttachment("anomaly_counted") == nil {
+			session.PutAttachment("anomaly_counted", true)
+			counted = true
+		}
+	}
+
+	key := address.String()
+
+	rollupMutex.Lock()
+	defer rollupMutex.Unlock()
+
+	holder := deviceTable[key]
+	if holder == nil {
+		holder = &rollupHolder{address: address}
+		deviceTable[key] = holder
+	}
+	holder.bytes += bytes
+	if message == 'N' {
+		holder.sessions++
+	}
+
+	if application == "" {
+		return
+	}
+
+	holder = applicationTable[application]
+	if holder == nil {
+		holder = &rollupHolder{}
+		applicationTable[application] = holder
+	}
+	holder.bytes += bytes
+	if counted {
+		holder.sessions++
+	}
+}
+
+// anomalyTask periodically writes the totals to the rollup table and checks
+// each hour against the baselines when it is over. The check waits for the
+// interval after the last totals of the hour were written so they are in the
+// database.
+func anomalyTask() {
+	var pending time.Time
+	current := time.Now().Truncate(time.Hour)
+
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(time.Second * time.Duration(rollupLogIntervalSec)):
+			logRollup(current)
+			if !pending.IsZero() {
+				if config := loadSettings(); config.enabled {
+					checkHour(pending, config)
+				}
+				pending = time.Time{}
+			}
+			if hour := time.Now().Truncate(time.Hour); !hour.Equal(current) {
+				pending = current
+				current = hour
+			}
+		}
+	}
+}
+
+// logRollup adds the accumulated totals to the rows of the argumented hour in
+// the rollup table. Traffic from clients that aren't local devices is only
+// counted for the application.
+func logRollup(hour time.Time) {
+	rollupMutex.Lock()
+	devices := deviceTable
+	applications := applicationTable
+	deviceTable = make(map[string]*rollupHolder)
+	applicationTable = make(map[string]*rollupHolder)
+	rollupMutex.Unlock()
+
+	// the traffic of the addresses of a device is added up by MAC address
+	byMac := make(map[string]*rollupHolder)
+	for _, holder := range devices {
+		var mac string
+		if device := inventory.FindDeviceByAddress(holder.address); device != nil {
+			mac = device.MacAddress
+		} else if hwaddr := inventory.LookupMacAddress(holder.address); hwaddr != nil {
+			mac = hwaddr.String()
+		} else {
+			continue
+		}
+		total := byMac[mac]
+		if total == nil {
+			total = &rollupHolder{}
+			byMac[mac] = total
+		}
+		total.bytes += holder.bytes
+		total.sessions += holder.sessions
+	}
+
+	for kind, table := range map[string]map[string]*rollupHolder{KindDevice: byMac, KindApplication: applications} {
+		for name, holder := range table {
+			if holder.bytes == 0 && holder.sessions == 0 {
+				continue
+			}
+
+			columns := map[string]interface{}{
+				"time_stamp": hour,
+				"kind":       kind,
+				"name":       name,
+			}
+
+			modifiedColumns := map[string]interface{}{
+				"bytes":    holder.bytes,
+				"sessions": holder.sessions,
+			}
+
+			reports.LogEvent(reports.CreateEvent("traffic_hourly", "traffic_hourly", 3, columns, modifiedColumns))
+		}
+	}
+}
+
+// loadSettings reads the anomaly settings
+func loadSettings() anomalyConfig {
+	config := anomalyConfig{
+		enabled:         true,
+		weeks:           defaultWeeks,
+		minimumWeeks:    defaultMinimumWeeks,
+		threshold:       defaultThreshold,
+		minimumBytes:    defaultMinimumBytes,
+		minimumSessions: defaultMinimumSessions,
+	}
+
+	anomalyJSON, err := settings.GetCurrentSettings([]string{"anomaly"})
+	if anomalyJSON == nil || err != nil {
+		return config
+	}
+
+	item, ok := anomalyJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid anomaly settings: %T\n", anomalyJSON)
+		return config
+	}
+
+	if value, ok := item["enabled"].(bool); ok {
+		config.enabled = value
+	}
+	if value, ok := item["weeks"].(float64); ok && value >= 1 {
+		config.weeks = int(value)
+	}
+	if value, ok := item["minimumWeeks"].(float64); ok && value >= 1 {
+		config.minimumWeeks = int(value)
+	}
+	if value, ok := item["threshold"].(float64); ok && value > 0 {
+		config.threshold = value
+	}
+	if value, ok := item["minimumBytes"].(float64); ok && value >= 0 {
+		config.minimumBytes = value
+	}
+	if value, ok := item["minimumSessions"].(float64); ok && value >= 0 {
+		config.minimumSessions = value
+	}
+	if config.minimumWeeks > config.weeks {
+		config.minimumWeeks = config.weeks
+	}
+
+	return config
+}
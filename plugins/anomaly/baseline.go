@@ -0,0 +1,203 @@
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// The metrics the baselines are learned for
+const (
+	MetricBytes    = "bytes"
+	MetricSessions = "sessions"
+)
+
+// the deviation is never less than this part of the baseline so traffic that
+// was the same every week doesn't make every small change an anomaly
+const minimumDeviation = 0.1
+
+// Score holds how far the traffic of a device or application in an hour was
+// from the baseline for the same hour of the week
+type Score struct {
+	Kind      string  `json:"kind"`
+	Name      string  `json:"name"`
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Expected  float64 `json:"expected"`
+	Deviation float64 `json:"deviation"`
+	Score     float64 `json:"score"`
+	Anomalous bool    `json:"anomalous"`
+}
+
+// Status holds the scores of the last hour that was checked
+type Status struct {
+	Hour   time.Time `json:"hour"`
+	Weeks  int       `json:"weeks"`
+	Scores []Score   `json:"scores"`
+}
+
+var status = Status{Scores: []Score{}}
+var statusLocker sync.Mutex
+
+// GetStatus returns the scores of the last hour that was checked, with the
+// largest deviations first
+func GetStatus() Status {
+	statusLocker.Lock()
+	defer statusLocker.Unlock()
+
+	result := status
+	result.Scores = append([]Score{}, status.Scores...)
+	return result
+}
+
+// sample holds the rollup rows of a device or application by hour
+type sample struct {
+	kind  string
+	name  string
+	hours map[int64]reports.HourlyTraffic
+}
+
+// checkHour compares the traffic of the argumented hour to the same hour of
+// the week in the previous weeks, and logs the anomalies
+func checkHour(hour time.Time, config anomalyConfig) {
+	hours := []time.Time{hour}
+	for week := 1; week <= config.weeks; week++ {
+		hours = append(hours, hour.Add(-time.Duration(week)*7*24*time.Hour))
+	}
+
+	rows, err := reports.GetHourlyTraffic(hours)
+	if err != nil {
+		logger.Warn("Unable to read the hourly traffic: %v\n", err)
+		return
+	}
+
+	// the weeks packetd wasn't running have no rows and aren't part of the
+	// baseline, while a device or application that had no traffic in a week
+	// that has rows counts as zero for that week
+	present := make(map[int64]bool)
+	samples := make(map[string]*sample)
+	for _, row := range rows {
+		msec := row.Time.UnixNano() / 1e6
+		if !row.Time.Equal(hour) {
+			present[msec] = true
+		}
+		key := row.Kind + "|" + row.Name
+		item := samples[key]
+		if item == nil {
+			item = &sample{kind: row.Kind, name: row.Name, hours: make(map[int64]reports.HourlyTraffic)}
+			samples[key] = item
+		}
+		item.hours[msec] = row
+	}
+
+	if len(present) < config.minimumWeeks {
+		logger.Debug("Not enough weeks of traffic for the baselines: %d\n", len(present))
+		setStatus(Status{Hour: hour, Weeks: len(present), Scores: []Score{}})
+		return
+	}
+
+	scores := []Score{}
+	current := hour.UnixNano() / 1e6
+	for _, item := range samples {
+		for _, metric := range []string{MetricBytes, MetricSessions} {
+			var history []float64
+			for msec := range present {
+				history = append(history, getMetric(item.hours[msec], metric))
+			}
+			score := getScore(getMetric(item.hours[current], metric), history, config.threshold, getMinimum(metric, config))
+			score.Kind, score.Name, score.Metric = item.kind, item.name, metric
+			scores = append(scores, score)
+		}
+	}
+
+	sort.Slice(scores, func(i, j int) bool { return math.Abs(scores[i].Score) > math.Abs(scores[j].Score) })
+	setStatus(Status{Hour: hour, Weeks: len(present), Scores: scores})
+
+	count := 0
+	for _, score := range scores {
+		if score.Anomalous {
+			logAnomaly(hour, score)
+			count++
+		}
+	}
+	logger.Info("Checked the traffic baselines for %v weeks:%d scores:%d anomalies:%d\n", hour, len(present), len(scores), count)
+}
+
+// getScore returns how many deviations the value is from the mean of the
+// history. The value is anomalous when the score passes the threshold and it
+// is more than the minimum away from the mean.
+func getScore(value float64, history []float64, threshold float64, minimum float64) Score {
+	var mean, variance float64
+	for _, entry := range history {
+		mean += entry
+	}
+	mean /= float64(len(history))
+	for _, entry := range history {
+		variance += (entry - mean) * (entry - mean)
+	}
+	variance /= float64(len(history))
+
+	deviation := math.Max(math.Sqrt(variance), math.Max(mean*minimumDeviation, 1))
+	score := Score{Value: value, Expected: mean, Deviation: deviation}
+	score.Score = (value - mean) / deviation
+	score.Anomalous = math.Abs(score.Score) >= threshold && math.Abs(value-mean) >= minimum
+	return score
+}
+
+// getMetric returns a metric of a rollup row
+func getMetric(row reports.HourlyTraffic, metric string) float64 {
+	if metric == MetricSessions {
+		return float64(row.Sessions)
+	}
+	return float64(row.Bytes)
+}
+
+// getMinimum returns the smallest change of a metric that is an anomaly
+func getMinimum(metric string, config anomalyConfig) float64 {
+	if metric == MetricSessions {
+		return config.minimumSessions
+	}
+	return config.minimumBytes
+}
+
+// setStatus replaces the scores of the last hour
+func setStatus(fresh Status) {
+	statusLocker.Lock()
+	status = fresh
+	statusLocker.Unlock()
+}
+
+// logAnomaly logs an anomaly event and publishes an alert for it
+func logAnomaly(hour time.Time, score Score) {
+	overseer.AddCounter("anomaly_detected", 1)
+
+	columns := map[string]interface{}{
+		"time_stamp": hour,
+		"kind":       score.Kind,
+		"name":       score.Name,
+		"metric":     score.Metric,
+		"value":      score.Value,
+		"expected":   score.Expected,
+		"deviation":  score.Deviation,
+		"score":      score.Score,
+	}
+	reports.LogEvent(reports.CreateEvent("anomaly_event", "anomaly_events", 1, columns, nil))
+
+	eventbus.PublishAlert("anomaly", fmt.Sprintf("Unusual %s for %s %s: %.0f instead of %.0f", score.Metric, score.Kind, score.Name, score.Value, score.Expected), map[string]interface{}{
+		"hour":      hour,
+		"kind":      score.Kind,
+		"name":      score.Name,
+		"metric":    score.Metric,
+		"value":     score.Value,
+		"expected":  score.Expected,
+		"deviation": score.Deviation,
+		"score":     score.Score,
+	})
+}
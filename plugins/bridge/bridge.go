@@ -0,0 +1,497 @@
+// Package bridge provides the "bridge" plugin
+// The bridge plugin lets analyzers run as separate processes so a crash or a
+// memory problem in the analyzer can't take down packetd. Each external plugin
+// listens on a unix socket and receives packet metadata as newline delimited
+// JSON requests, answering each with a verdict and optional session fields.
+// The packets are never held waiting for an answer. The request is queued and
+// the packet accepted right away, and the fields and the release from the
+// answer are applied to the session when it arrives. When an external plugin
+// is slow, missing, or crashes, the sessions it was watching are released so
+// traffic is never held up waiting for it.
+package bridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const pluginName = "bridge"
+const reconnectDelay = 5 * time.Second
+
+// the limits on the requests waiting to be sent or answered
+const sendQueueSize = 1024
+const maxPendingRequests = 4096
+const minExpireInterval = 100 * time.Millisecond
+
+// PacketRequest is the message sent to an external plugin for each packet
+type PacketRequest struct {
+	ID             uint64 `json:"id"`
+	ConntrackID    uint32 `json:"ctid"`
+	SessionID      int64  `json:"sessionId"`
+	NewSession     bool   `json:"newSession"`
+	PacketCount    uint64 `json:"packetCount"`
+	Family         int    `json:"family"`
+	Protocol       uint8  `json:"protocol"`
+	ClientAddress  string `json:"clientAddress"`
+	ClientPort     uint16 `json:"clientPort"`
+	ServerAddress  string `json:"serverAddress"`
+	ServerPort     uint16 `json:"serverPort"`
+	ClientToServer bool   `json:"clientToServer"`
+	Length         int    `json:"length"`
+	Payload        []byte `json:"payload,omitempty"`
+}
+
+// PacketResponse is the message returned by an external plugin for each request
+type PacketResponse struct {
+	ID      uint64            `json:"id"`
+	Release bool              `json:"release"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// pendingRequest is a request sent to an external plugin waiting for the answer
+type pendingRequest struct {
+	session *dispatch.Session
+	ctid    uint32
+	sent    time.Time
+}
+
+// externalPlugin holds the configuration and connection for a single external plugin
+type externalPlugin struct {
+	name           string
+	socket         string
+	command        []string
+	priority       int
+	timeout        time.Duration
+	includePayload bool
+
+	connMutex sync.Mutex
+	conn      net.Conn
+	sendQueue chan []byte
+
+	pendingMutex sync.Mutex
+	pending      map[uint64]*pendingRequest
+
+	process *exec.Cmd
+}
+
+var externalList []*externalPlugin
+var requestID uint64
+var shutdownFlag int32
+var taskWaiter sync.WaitGroup
+
+// init registers the plugin with the plugin registry. The subscriptions
+// depend on the settings so they are inserted in PluginStartup.
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		HealthFunc:   PluginHealth,
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+
+	atomic.StoreInt32(&shutdownFlag, 0)
+	externalList = loadExternalPlugins()
+
+	for _, item := range externalList {
+		if len(item.command) != 0 {
+			taskWaiter.Add(1)
+			go item.processTask()
+		}
+		taskWaiter.Add(1)
+		go item.connectTask()
+		dispatch.InsertNfqueueSubscription(pluginName+"_"+item.name, item.priority, item.nfqueueHandler)
+	}
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	atomic.StoreInt32(&shutdownFlag, 1)
+
+	for _, item := range externalList {
+		item.disconnect()
+		item.connMutex.Lock()
+		if item.process != nil && item.process.Process != nil {
+			item.process.Process.Kill()
+		}
+		item.connMutex.Unlock()
+	}
+
+	done := make(chan bool)
+	go func() {
+		taskWaiter.Wait()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		logger.Info("Successful shutdown of bridge tasks\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown bridge tasks\n")
+	}
+}
+
+// PluginHealth returns an error if any of the external plugins are not connected
+func PluginHealth() error {
+	var missing []string
+
+	for _, item := range externalList {
+		item.connMutex.Lock()
+		if item.conn == nil {
+			missing = append(missing, item.name)
+		}
+		item.connMutex.Unlock()
+	}
+
+	if len(missing) != 0 {
+		return errors.New("Not connected: " + strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// nfqueueHandler queues the packet details for the external plugin and
+// accepts the packet without waiting for the answer. The session is released
+// if the request can't be queued.
+func (item *externalPlugin) nfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	if mess.Session == nil {
+		return result
+	}
+
+	request := PacketRequest{
+		ID:             atomic.AddUint64(&requestID, 1),
+		ConntrackID:    ctid,
+		SessionID:      mess.Session.GetSessionID(),
+		NewSession:     newSession,
+		PacketCount:    mess.Session.GetPacketCount(),
+		Family:         mess.Family,
+		Protocol:       mess.MsgTuple.Protocol,
+		ClientAddress:  mess.MsgTuple.ClientAddress.String(),
+		ClientPort:     mess.MsgTuple.ClientPort,
+		ServerAddress:  mess.MsgTuple.ServerAddress.String(),
+		ServerPort:     mess.MsgTuple.ServerPort,
+		ClientToServer: mess.ClientToServer,
+		Length:         mess.Length,
+	}
+
+	if item.includePayload {
+		request.Payload = mess.Payload
+	}
+
+	err := item.send(request, mess.Session)
+	if err != nil {
+		logger.Debug("%OC|External plugin %s failed: %v\n", "bridge_exchange_failed", 100, item.name, err)
+		overseer.AddCounter("bridge_"+item.name+"_failed", 1)
+		return result
+	}
+
+	result.SessionRelease = false
+	return result
+}
+
+// send queues a request for the writer and adds it to the pending requests.
+// It never blocks, returning an error if the request can't be queued.
+func (item *externalPlugin) send(request PacketRequest, session *dispatch.Session) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	item.connMutex.Lock()
+	queue := item.sendQueue
+	item.connMutex.Unlock()
+	if queue == nil {
+		return errors.New("not connected")
+	}
+
+	item.pendingMutex.Lock()
+	if len(item.pending) >= maxPendingRequests {
+		item.pendingMutex.Unlock()
+		return errors.New("too many pending requests")
+	}
+	item.pending[request.ID] = &pendingRequest{session: session, ctid: request.ConntrackID, sent: time.Now()}
+	item.pendingMutex.Unlock()
+
+	select {
+	case queue <- data:
+		return nil
+	default:
+		item.takePending(request.ID)
+		return errors.New("send queue full")
+	}
+}
+
+// takePending removes and returns a pending request or nil if the id is unknown
+func (item *externalPlugin) takePending(id uint64) *pendingRequest {
+	item.pendingMutex.Lock()
+	defer item.pendingMutex.Unlock()
+
+	pending := item.pending[id]
+	delete(item.pending, id)
+	return pending
+}
+
+// releasePending releases the session of a request that won't be answered
+func (item *externalPlugin) releasePending(pending *pendingRequest) {
+	dispatch.ReleaseSession(pending.session, pluginName+"_"+item.name)
+}
+
+// writeTask writes the queued requests to the connection until it is closed
+func (item *externalPlugin) writeTask(conn net.Conn, queue chan []byte, done chan bool) {
+	writer := bufio.NewWriter(conn)
+
+	for {
+		select {
+		case <-done:
+			return
+		case data := <-queue:
+			conn.SetWriteDeadline(time.Now().Add(item.timeout))
+			writer.Write(data)
+			writer.WriteByte('\n')
+			// write everything that is waiting before the flush
+			for len(queue) != 0 {
+				writer.Write(<-queue)
+				writer.WriteByte('\n')
+			}
+			if err := writer.Flush(); err != nil {
+				logger.Debug("Unable to write to external plugin %s: %v\n", item.name, err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// expireTask releases the sessions of the requests that were not answered
+// within the timeout until the connection is closed
+func (item *externalPlugin) expireTask(done chan bool) {
+	interval := item.timeout
+	if interval < minExpireInterval {
+		interval = minExpireInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			var expired []*pendingRequest
+			item.pendingMutex.Lock()
+			for id, pending := range item.pending {
+				if now.Sub(pending.sent) > item.timeout {
+					expired = append(expired, pending)
+					delete(item.pending, id)
+				}
+			}
+			item.pendingMutex.Unlock()
+
+			for _, pending := range expired {
+				item.releasePending(pending)
+			}
+			if len(expired) != 0 {
+				logger.Debug("%OC|External plugin %s timed out on %d requests\n", "bridge_exchange_timeout", 100, item.name, len(expired))
+				overseer.AddCounter("bridge_"+item.name+"_timeout", uint64(len(expired)))
+			}
+		}
+	}
+}
+
+// connectTask keeps the connection to the external plugin open until shutdown
+func (item *externalPlugin) connectTask() {
+	defer taskWaiter.Done()
+
+	for atomic.LoadInt32(&shutdownFlag) == 0 {
+		conn, err := net.DialTimeout("unix", item.socket, item.timeout+time.Second)
+		if err != nil {
+			logger.Debug("Unable to connect to external plugin %s: %v\n", item.name, err)
+			time.Sleep(reconnectDelay)
+			continue
+		}
+
+		logger.Info("Connected to external plugin %s at %s\n", item.name, item.socket)
+		queue := make(chan []byte, sendQueueSize)
+		done := make(chan bool)
+		item.connMutex.Lock()
+		item.conn = conn
+		item.sendQueue = queue
+		item.connMutex.Unlock()
+
+		go item.writeTask(conn, queue, done)
+		go item.expireTask(done)
+		item.readResponses(conn)
+		item.disconnect()
+		close(done)
+		item.releaseAll()
+
+		if atomic.LoadInt32(&shutdownFlag) == 0 {
+			logger.Warn("Lost connection to external plugin %s\n", item.name)
+			time.Sleep(reconnectDelay)
+		}
+	}
+}
+
+// readResponses reads the responses from the connection and applies each to
+// the session of the request. A response with an id that isn't pending, which
+// is an unknown id, a duplicate, or a request that already timed out, is
+// dropped.
+func (item *externalPlugin) readResponses(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 65536), 1048576)
+
+	for scanner.Scan() {
+		var response PacketResponse
+		err := json.Unmarshal(scanner.Bytes(), &response)
+		if err != nil {
+			logger.Warn("Invalid response from external plugin %s: %v\n", item.name, err)
+			continue
+		}
+
+		pending := item.takePending(response.ID)
+		if pending == nil {
+			overseer.AddCounter("bridge_"+item.name+"_unknown", 1)
+			continue
+		}
+
+		for field, value := range response.Fields {
+			pending.session.PutAttachment(field, value)
+			dict.AddSessionEntry(pending.ctid, field, value)
+		}
+		if response.Release {
+			item.releasePending(pending)
+		}
+	}
+}
+
+// releaseAll releases the sessions of all the pending requests after the
+// connection is lost
+func (item *externalPlugin) releaseAll() {
+	item.pendingMutex.Lock()
+	list := item.pending
+	item.pending = make(map[uint64]*pendingRequest)
+	item.pendingMutex.Unlock()
+
+	for _, pending := range list {
+		item.releasePending(pending)
+	}
+}
+
+// disconnect closes the connection to the external plugin
+func (item *externalPlugin) disconnect() {
+	item.connMutex.Lock()
+	if item.conn != nil {
+		item.conn.Close()
+		item.conn = nil
+		item.sendQueue = nil
+	}
+	item.connMutex.Unlock()
+}
+
+// processTask runs the external plugin process and restarts it if it exits
+func (item *externalPlugin) processTask() {
+	defer taskWaiter.Done()
+
+	for atomic.LoadInt32(&shutdownFlag) == 0 {
+		process := exec.Command(item.command[0], item.command[1:]...)
+
+		item.connMutex.Lock()
+		item.process = process
+		item.connMutex.Unlock()
+
+		logger.Info("Starting external plugin %s: %v\n", item.name, item.command)
+		err := process.Start()
+		if err == nil {
+			err = process.Wait()
+		}
+
+		if atomic.LoadInt32(&shutdownFlag) != 0 {
+			return
+		}
+
+		logger.Warn("External plugin %s exited: %v\n", item.name, err)
+		overseer.AddCounter("bridge_"+item.name+"_restart", 1)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// loadExternalPlugins loads the external plugin configuration from the settings
+func loadExternalPlugins() []*externalPlugin {
+	var list []*externalPlugin
+
+	pluginsJSON, err := settings.GetCurrentSettings([]string{"plugins", "external"})
+	if pluginsJSON == nil || err != nil {
+		logger.Info("No external plugins configured\n")
+		return list
+	}
+
+	pluginSlice, ok := pluginsJSON.([]interface{})
+	if !ok {
+		logger.Warn("Invalid external plugin settings: %T\n", pluginsJSON)
+		return list
+	}
+
+	for _, value := range pluginSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if enabled, found := item["enabled"].(bool); found && !enabled {
+			continue
+		}
+
+		name, _ := item["name"].(string)
+		socket, _ := item["socket"].(string)
+		if name == "" || socket == "" {
+			logger.Warn("Ignoring external plugin without name or socket: %v\n", item)
+			continue
+		}
+
+		external := &externalPlugin{name: name, socket: socket, priority: 2, timeout: 50 * time.Millisecond, pending: make(map[uint64]*pendingRequest)}
+
+		if value, ok := item["priority"].(float64); ok {
+			external.priority = int(value)
+		}
+		if value, ok := item["timeout"].(float64); ok && value > 0 {
+			external.timeout = time.Duration(value) * time.Millisecond
+		}
+		if value, ok := item["includePayload"].(bool); ok {
+			external.includePayload = value
+		}
+		if value, ok := item["command"].([]interface{}); ok {
+			for _, arg := range value {
+				if text, ok := arg.(string); ok {
+					external.command = append(external.command, text)
+				}
+			}
+		}
+
+		logger.Info("Loaded external plugin %s socket:%s priority:%d timeout:%v\n", name, socket, external.priority, external.timeout)
+		list = append(list, external)
+	}
+
+	return list
+}
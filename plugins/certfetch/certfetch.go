@@ -5,22 +5,37 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/untangle/packetd/services/certcache"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
 )
 
 const pluginName = "certfetch"
-const fetchTimeout = 10 * time.Second
 
 var localMutex sync.Mutex
 
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.CertfetchPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.CertfetchPriority, PluginNfqueueHandler)
+	loadConfig()
 }
 
 // PluginShutdown function called when the daemon is shutting down.
@@ -28,6 +43,14 @@ func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
 }
 
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadConfig()
+	}
+}
+
 // PluginNfqueueHandler is called to handle nfqueue packet data. We only
 // look at TCP traffic with port 443 as destination. When detected, we load
 // the server certificate from the cache or fetch it from the server and
@@ -61,6 +84,25 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		localMutex.Unlock()
 		logger.Debug("Loading certificate for %s ctid:%d\n", findkey, ctid)
 	} else {
+		current := getConfig()
+
+		// never probe the excluded destinations
+		if current.isExcluded(mess.MsgTuple.ServerAddress, mess.MsgTuple.ServerPort) {
+			localMutex.Unlock()
+			logger.Debug("Not fetching certificate for excluded %s ctid:%d\n", findkey, ctid)
+			overseer.AddCounter("certfetch_excluded", 1)
+			return result
+		}
+
+		// skip the fetch when too many are running so we don't open bursts of
+		// connections, and don't cache anything so a later session can try again
+		if !current.acquire() {
+			localMutex.Unlock()
+			logger.Info("%OC|Too many certificate fetches running for %s ctid:%d\n", "certfetch_limited", 10, findkey, ctid)
+			return result
+		}
+		defer current.release()
+
 		logger.Debug("Fetching certificate for %s ctid:%d\n", findkey, ctid)
 
 		holder = new(certcache.CertificateHolder)
@@ -72,7 +114,7 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 			InsecureSkipVerify: true,
 		}
 		dialer := &net.Dialer{
-			Timeout: fetchTimeout,
+			Timeout: current.timeout,
 		}
 
 		if mess.IP6Layer != nil {
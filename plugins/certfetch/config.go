@@ -0,0 +1,188 @@
+package certfetch
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the certfetch settings are missing
+const defaultMaxConcurrent = 4
+const defaultTimeoutSeconds = 10
+
+// exclusion is a destination that must never be probed. A nil network
+// matches any address and a zero port matches any port.
+type exclusion struct {
+	network *net.IPNet
+	port    uint16
+}
+
+// fetchConfig holds the certfetch settings. The slots channel limits the
+// number of fetches running at the same time, and a fetch gives its slot back
+// to the channel it was taken from so a reload doesn't upset the count.
+type fetchConfig struct {
+	timeout    time.Duration
+	exclusions []exclusion
+	slots      chan struct{}
+}
+
+var currentConfig *fetchConfig
+var configLocker sync.RWMutex
+
+// loadConfig loads the concurrency limit, timeout, and exclusions from the settings
+func loadConfig() {
+	maxConcurrent := defaultMaxConcurrent
+	fresh := &fetchConfig{timeout: defaultTimeoutSeconds * time.Second}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"plugins", "certfetch"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			if value, ok := item["maxConcurrent"].(float64); ok && value > 0 {
+				maxConcurrent = int(value)
+			}
+			if value, ok := item["timeoutSeconds"].(float64); ok && value > 0 {
+				fresh.timeout = time.Duration(value * float64(time.Second))
+			}
+			for _, problem := range compileExclusions(fresh, item["exclude"]) {
+				logger.Warn("Ignoring invalid certfetch exclusion %v\n", problem)
+			}
+		} else {
+			logger.Warn("Invalid certfetch settings: %T\n", configJSON)
+		}
+	}
+
+	fresh.slots = make(chan struct{}, maxConcurrent)
+	logger.Info("Loaded certfetch settings maxConcurrent:%d timeout:%v exclusions:%d\n", maxConcurrent, fresh.timeout, len(fresh.exclusions))
+
+	configLocker.Lock()
+	currentConfig = fresh
+	configLocker.Unlock()
+}
+
+// getConfig returns the current settings, loading the defaults if needed
+func getConfig() *fetchConfig {
+	configLocker.RLock()
+	current := currentConfig
+	configLocker.RUnlock()
+
+	if current == nil {
+		loadConfig()
+		return getConfig()
+	}
+	return current
+}
+
+// compileExclusions parses the exclusion list from the settings. Each entry is
+// a string with an address, a CIDR, a :port, or an address or CIDR with a port
+// such as 10.0.0.0/8:443 or [2001:db8::/32]:443. Invalid entries are skipped
+// and returned as errors.
+func compileExclusions(fresh *fetchConfig, value interface{}) []error {
+	var problems []error
+
+	list, ok := value.([]interface{})
+	if !ok {
+		if value != nil {
+			problems = append(problems, fmt.Errorf("list: %T", value))
+		}
+		return problems
+	}
+
+	for index, entry := range list {
+		text, ok := entry.(string)
+		if !ok {
+			problems = append(problems, fmt.Errorf("%d: %v", index, entry))
+			continue
+		}
+		item, err := parseExclusion(text)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%d: %v", index, err))
+			continue
+		}
+		fresh.exclusions = append(fresh.exclusions, item)
+	}
+
+	return problems
+}
+
+// parseExclusion returns the exclusion for a settings string
+func parseExclusion(text string) (exclusion, error) {
+	var item exclusion
+	address := strings.TrimSpace(text)
+
+	// split off the port when there is one, which is always the case for a
+	// leading colon, a closing bracket, or a single colon in an IPv4 address
+	if strings.HasPrefix(address, "[") || strings.HasPrefix(address, ":") || strings.Count(address, ":") == 1 {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return item, err
+		}
+		number, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || number == 0 {
+			return item, fmt.Errorf("invalid port: %s", text)
+		}
+		item.port = uint16(number)
+		address = host
+	}
+
+	if address == "" {
+		if item.port == 0 {
+			return item, fmt.Errorf("empty exclusion")
+		}
+		return item, nil
+	}
+
+	if !strings.Contains(address, "/") {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return item, fmt.Errorf("invalid address: %s", text)
+		}
+		if ip.To4() != nil {
+			address += "/32"
+		} else {
+			address += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return item, err
+	}
+	item.network = network
+	return item, nil
+}
+
+// isExcluded returns true if the destination must never be probed
+func (config *fetchConfig) isExcluded(address net.IP, port uint16) bool {
+	for _, item := range config.exclusions {
+		if item.port != 0 && item.port != port {
+			continue
+		}
+		if item.network != nil && !item.network.Contains(address) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// acquire takes a fetch slot without waiting and returns false if all of them are in use
+func (config *fetchConfig) acquire() bool {
+	select {
+	case config.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release gives back a fetch slot
+func (config *fetchConfig) release() {
+	<-config.slots
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/untangle/packetd/services/certcache"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
 )
 
 const pluginName = "certsniff"
@@ -78,10 +79,21 @@ func (ME *dataCollector) getBuffer() []byte {
 	return fullbuff.Bytes()
 }
 
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.CertsniffPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.CertsniffPriority, PluginNfqueueHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down.
@@ -0,0 +1,328 @@
+package classify
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the actions that can be taken on a classified session
+const (
+	actionBlock = "block"
+	actionFlag  = "flag"
+)
+
+// the session attachments used for the application control decisions
+const (
+	controlDoneAttachment  = "classify_control_done"
+	controlBlockAttachment = "application_blocked"
+	controlFlagAttachment  = "application_flagged"
+)
+
+// applicationList holds the applications and categories for an action. The
+// applications match the application id or name and everything is compared
+// without case.
+type applicationList struct {
+	applications map[string]bool
+	categories   map[string]bool
+}
+
+// controlConfig holds the block and flag lists from the settings
+type controlConfig struct {
+	block applicationList
+	flag  applicationList
+}
+
+var currentControl *controlConfig
+var controlLocker sync.RWMutex
+
+// loadApplicationControl loads the block and flag lists from the settings
+func loadApplicationControl() {
+	fresh := new(controlConfig)
+	fresh.block = newApplicationList()
+	fresh.flag = newApplicationList()
+
+	configJSON, err := settings.GetCurrentSettings([]string{"plugins", "classify"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			fresh.block = parseApplicationList(item["block"])
+			fresh.flag = parseApplicationList(item["flag"])
+		} else {
+			logger.Warn("Invalid classify settings: %T\n", configJSON)
+		}
+	}
+
+	logger.Info("Loaded application control block:%d flag:%d\n", fresh.block.size(), fresh.flag.size())
+
+	controlLocker.Lock()
+	currentControl = fresh
+	controlLocker.Unlock()
+}
+
+// checkBlockedSession returns true if the session was already blocked. The
+// packets are dropped except for the resets we sent when the session was
+// blocked, which pass through the output hook and end up here.
+func checkBlockedSession(mess dispatch.NfqueueMessage) (dispatch.NfqueueResult, bool) {
+	if mess.Session.GetAttachment(controlBlockAttachment) == nil {
+		return dispatch.NfqueueResult{}, false
+	}
+
+	if mess.TCPLayer != nil && mess.TCPLayer.RST {
+		return dispatch.NfqueueResult{SessionRelease: false}, true
+	}
+
+	return dispatch.NfqueueResult{SessionRelease: false, PacketDrop: true}, true
+}
+
+// applyApplicationControl checks a classified session against the block and
+// flag lists once the classification is final. A blocked session has the
+// current and future packets dropped, and TCP sessions are reset in both
+// directions so established flows are torn down right away. A flagged session
+// is tagged in the dictionary and the reports. Returns true if the session
+// was blocked.
+func applyApplicationControl(mess dispatch.NfqueueMessage, ctid uint32) bool {
+	session := mess.Session
+	if session.GetAttachment(controlDoneAttachment) != nil {
+		return false
+	}
+	session.PutAttachment(controlDoneAttachment, true)
+
+	controlLocker.RLock()
+	control := currentControl
+	controlLocker.RUnlock()
+	if control == nil {
+		return false
+	}
+
+	appid, _ := session.GetAttachment("application_id").(string)
+	name, _ := session.GetAttachment("application_name").(string)
+	category, _ := session.GetAttachment("application_category").(string)
+
+	if match := control.block.find(appid, name, category); match != "" {
+		logger.Debug("Blocking application %s category %s ctid:%d\n", appid, category, ctid)
+		overseer.AddCounter("classify_application_block", 1)
+		session.PutAttachment(controlBlockAttachment, true)
+		dict.AddSessionEntry(ctid, controlBlockAttachment, true)
+		if mess.TCPLayer != nil {
+			sendResets(mess)
+		}
+		logControlEvent(session, actionBlock, controlBlockAttachment, match)
+		return true
+	}
+
+	if match := control.flag.find(appid, name, category); match != "" {
+		logger.Debug("Flagging application %s category %s ctid:%d\n", appid, category, ctid)
+		overseer.AddCounter("classify_application_flag", 1)
+		session.PutAttachment(controlFlagAttachment, true)
+		dict.AddSessionEntry(ctid, controlFlagAttachment, true)
+		logControlEvent(session, actionFlag, controlFlagAttachment, match)
+	}
+
+	return false
+}
+
+// logControlEvent logs a block or flag decision to the rule_events table
+// and sets the matching column of the session
+func logControlEvent(session *dispatch.Session, action string, column string, match string) {
+	tuple := session.GetClientSideTuple()
+
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"session_id":     session.GetSessionID(),
+		"rule_id":        "classify_" + match,
+		"action":         action,
+		"ip_protocol":    tuple.Protocol,
+		"client_address": tuple.ClientAddress,
+		"client_port":    tuple.ClientPort,
+		"server_address": tuple.ServerAddress,
+		"server_port":    tuple.ServerPort,
+	}
+
+	reports.LogEvent(reports.CreateEvent("application_"+action, "rule_events", 1, columns, nil))
+
+	sessionColumns := map[string]interface{}{
+		"session_id": session.GetSessionID(),
+	}
+	modifiedColumns := map[string]interface{}{
+		column: true,
+	}
+	reports.LogEvent(reports.CreateEvent("session_application_"+action, "sessions", 2, sessionColumns, modifiedColumns))
+}
+
+// sendResets sends a TCP reset to both ends of the session using the
+// addresses and sequence numbers from the current packet. The reset going
+// back to the sender of the packet acknowledges the packet, and the one
+// going forward uses the next sequence number from the sender.
+func sendResets(mess dispatch.NfqueueMessage) {
+	tcp := mess.TCPLayer
+
+	var source, destination net.IP
+	if mess.IP4Layer != nil {
+		source, destination = mess.IP4Layer.SrcIP, mess.IP4Layer.DstIP
+	} else if mess.IP6Layer != nil {
+		source, destination = mess.IP6Layer.SrcIP, mess.IP6Layer.DstIP
+	} else {
+		return
+	}
+
+	length := uint32(len(mess.Payload))
+	if tcp.SYN {
+		length++
+	}
+	if tcp.FIN {
+		length++
+	}
+
+	backward := &layers.TCP{SrcPort: tcp.DstPort, DstPort: tcp.SrcPort, Seq: tcp.Ack, Ack: tcp.Seq + length, RST: true, ACK: true}
+	forward := &layers.TCP{SrcPort: tcp.SrcPort, DstPort: tcp.DstPort, Seq: tcp.Seq + length, RST: true}
+
+	if err := sendRawTCP(destination, source, backward); err != nil {
+		logger.Warn("%OC|Unable to send reset to %v: %v\n", "classify_reset_failure", 10, source, err)
+	}
+	if err := sendRawTCP(source, destination, forward); err != nil {
+		logger.Warn("%OC|Unable to send reset to %v: %v\n", "classify_reset_failure", 10, destination, err)
+	}
+}
+
+// the socket option that lets an IPv6 socket bind to an address that is not
+// local, from linux/in6.h since the syscall package doesn't define it
+const ipv6Transparent = 75
+
+// sendRawTCP sends a TCP header from the source to the destination address.
+// IPv4 packets are built with the IP header and sent on an IPPROTO_RAW socket.
+// IPv6 raw sockets can't send our own IP header so the TCP header is sent on
+// an IPPROTO_TCP raw socket bound to the source address and the kernel adds
+// the IPv6 header.
+func sendRawTCP(source net.IP, destination net.IP, tcp *layers.TCP) error {
+	if source4, destination4 := source.To4(), destination.To4(); source4 != nil && destination4 != nil {
+		return sendRawTCP4(source4, destination4, tcp)
+	}
+	return sendRawTCP6(source.To16(), destination.To16(), tcp)
+}
+
+// sendRawTCP4 builds an IPv4 packet with the TCP header and sends it with a raw socket
+func sendRawTCP4(source net.IP, destination net.IP, tcp *layers.TCP) error {
+	network := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: source, DstIP: destination}
+	tcp.SetNetworkLayerForChecksum(network)
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buffer, options, network, tcp); err != nil {
+		return err
+	}
+
+	// IPPROTO_RAW sockets expect the packet to include the IP header
+	socket, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(socket)
+
+	address := &syscall.SockaddrInet4{}
+	copy(address.Addr[:], destination)
+	return syscall.Sendto(socket, buffer.Bytes(), 0, address)
+}
+
+// sendRawTCP6 sends the TCP header from the source to the destination with the
+// kernel adding the IPv6 header. The checksum is computed with the IPv6 pseudo
+// header of the addresses the kernel will use.
+func sendRawTCP6(source net.IP, destination net.IP, tcp *layers.TCP) error {
+	network := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: source, DstIP: destination}
+	tcp.SetNetworkLayerForChecksum(network)
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := gopacket.SerializeLayers(buffer, options, tcp); err != nil {
+		return err
+	}
+
+	socket, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_RAW, syscall.IPPROTO_TCP)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(socket)
+
+	// the reset going to the client uses the address of the server so we
+	// need to bind to an address that is not ours
+	if err = syscall.SetsockoptInt(socket, syscall.SOL_IPV6, ipv6Transparent, 1); err != nil {
+		return err
+	}
+	local := &syscall.SockaddrInet6{}
+	copy(local.Addr[:], source)
+	if err = syscall.Bind(socket, local); err != nil {
+		return err
+	}
+
+	address := &syscall.SockaddrInet6{}
+	copy(address.Addr[:], destination)
+	return syscall.Sendto(socket, buffer.Bytes(), 0, address)
+}
+
+// newApplicationList returns an empty application list
+func newApplicationList() applicationList {
+	return applicationList{applications: make(map[string]bool), categories: make(map[string]bool)}
+}
+
+// parseApplicationList returns the application list from a settings object
+func parseApplicationList(value interface{}) applicationList {
+	list := newApplicationList()
+
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		if value != nil {
+			logger.Warn("Invalid application list in classify settings: %T\n", value)
+		}
+		return list
+	}
+
+	for _, entry := range parseStringList(item["applications"]) {
+		list.applications[strings.ToLower(entry)] = true
+	}
+	for _, entry := range parseStringList(item["categories"]) {
+		list.categories[strings.ToLower(entry)] = true
+	}
+	return list
+}
+
+// parseStringList returns the strings in a settings list
+func parseStringList(value interface{}) []string {
+	var result []string
+	list, _ := value.([]interface{})
+	for _, entry := range list {
+		if text, ok := entry.(string); ok && text != "" {
+			result = append(result, text)
+		}
+	}
+	return result
+}
+
+// find returns the application or category that matches the list or an empty string
+func (list applicationList) find(appid string, name string, category string) string {
+	if appid != "" && list.applications[strings.ToLower(appid)] {
+		return appid
+	}
+	if name != "" && list.applications[strings.ToLower(name)] {
+		return name
+	}
+	if category != "" && list.categories[strings.ToLower(category)] {
+		return category
+	}
+	return ""
+}
+
+// size returns the number of applications and categories in the list
+func (list applicationList) size() int {
+	return len(list.applications) + len(list.categories)
+}
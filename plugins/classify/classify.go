@@ -12,6 +12,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
@@ -20,6 +21,7 @@ import (
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
 	"github.com/untangle/packetd/services/reports"
 )
 
@@ -70,31 +72,34 @@ var controlChannel = make(chan bool)
 var classdHostPort = "127.0.0.1:8123"
 var daemonAvailable = false
 
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		EnabledFunc:  checkDaemonBinary,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.ClassifyPriority, NfqueueFunc: PluginNfqueueHandler},
+			{Priority: 2, ConntrackFunc: PluginConntrackHandler},
+		},
+	}))
+}
+
 // PluginStartup is called to allow plugin specific initialization
 func PluginStartup() {
-	var err error
-	var info os.FileInfo
-
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
 
-	//  make sure the classd binary is available
-	info, err = os.Stat(daemonBinary)
-	if err != nil {
-		logger.Notice("Unable to check status of classify daemon %s (%v)\n", daemonBinary, err)
-		return
-	}
-
-	//  make sure the classd binary is executable
-	if (info.Mode() & 0111) == 0 {
-		logger.Notice("Invalid file mode for classify daemon %s (%v)\n", daemonBinary, info.Mode())
-		return
-	}
-
-	// we found the daemon so set our flag
+	// the registry only starts us when checkDaemonBinary finds the daemon so set our flag
 	daemonAvailable = true
 
-	// load the application details
+	// load the application details and the block and flag lists
 	loadApplicationTable()
+	loadApplicationControl()
+
+	// start the task that writes the application connection totals
+	go connectionTask()
 
 	// start the daemon manager to handle running the daemon process
 	go daemonProcessManager(controlChannel)
@@ -124,9 +129,36 @@ func PluginStartup() {
 			logger.Warn("Failed to properly startup pluginCloudManager\n")
 		}
 	}
+}
 
-	// insert our nfqueue subscription
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ClassifyPriority, PluginNfqueueHandler)
+// checkDaemonBinary returns true if the classd binary is available and executable
+func checkDaemonBinary() bool {
+	var err error
+	var info os.FileInfo
+
+	//  make sure the classd binary is available
+	info, err = os.Stat(daemonBinary)
+	if err != nil {
+		logger.Notice("Unable to check status of classify daemon %s (%v)\n", daemonBinary, err)
+		return false
+	}
+
+	//  make sure the classd binary is executable
+	if (info.Mode() & 0111) == 0 {
+		logger.Notice("Invalid file mode for classify daemon %s (%v)\n", daemonBinary, info.Mode())
+		return false
+	}
+
+	return true
+}
+
+// PluginSignal is called when the daemon receives a signal. We reload
+// the block and flag lists on SIGHUP.
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadApplicationControl()
+	}
 }
 
 // PluginShutdown is called when the daemon is shutting down
@@ -138,6 +170,16 @@ func PluginShutdown() {
 		return
 	}
 
+	// stop the connection task and write whatever we collected since the last interval
+	connectionShutdown <- true
+	select {
+	case <-connectionShutdown:
+		logger.Info("Successful shutdown of connectionTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown connectionTask\n")
+	}
+	logConnections()
+
 	// signal the socket manager that the system is shutting down
 	signalSocketManager(systemShutdown)
 	select {
@@ -192,6 +234,11 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		return dispatch.NfqueueResult{SessionRelease: true}
 	}
 
+	// once a session is blocked we drop every packet without sending it to classd
+	if result, blocked := checkBlockedSession(mess); blocked {
+		return result
+	}
+
 	// send the data to classd and read reply
 	reply = classifyTraffic(&mess)
 
@@ -203,6 +250,16 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	// process the reply and get the classification state
 	state, confidence := processReply(reply, mess, ctid)
 
+	// apply the block and flag lists once the session is fully classified
+	if state == navlStateClassified && applyApplicationControl(mess, ctid) {
+		return dispatch.NfqueueResult{SessionRelease: false, PacketDrop: true}
+	}
+
+	// the application is final once the session is classified
+	if state == navlStateClassified {
+		recordConnection(mess.Session)
+	}
+
 	// when NAVL is done with the session we use a counter that lets us process
 	// a few extra packets to make sure we get the full classification details
 	if state == navlStateClassified || state == navlStateTerminated || mess.Session.GetNavlCount() != 0 {
@@ -217,6 +274,11 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		if !kernel.FlagNoCloud {
 			analyzePrediction(mess.Session)
 		}
+		// sessions that never reach the classified state are checked with what we have
+		if applyApplicationControl(mess, ctid) {
+			return dispatch.NfqueueResult{SessionRelease: false, PacketDrop: true}
+		}
+		recordConnection(mess.Session)
 		return dispatch.NfqueueResult{SessionRelease: true}
 	}
 
@@ -246,7 +308,7 @@ func classifyTraffic(mess *dispatch.NfqueueMessage) string {
 	// efficient to modify the shared packet, but deeper analysis of all potentially affected consumers
 	// would have happen before making that change. For now this is probably fine.
 	if mess.IP4Layer != nil {
-		fixer = gopacket.NewPacket(mess.Packet.Data(), layers.LayerTypeIPv4, gopacket.Lazy)
+		fixer = gopacket.NewPacket(mess.Data, layers.LayerTypeIPv4, gopacket.Lazy)
 		IP4Layer = fixer.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 		proto = "IP4"
 		if mess.ClientToServer {
@@ -261,7 +323,7 @@ func classifyTraffic(mess *dispatch.NfqueueMessage) string {
 			dstport = mess.Session.GetClientSideTuple().ClientPort
 		}
 	} else if mess.IP6Layer != nil {
-		fixer = gopacket.NewPacket(mess.Packet.Data(), layers.LayerTypeIPv6, gopacket.Lazy)
+		fixer = gopacket.NewPacket(mess.Data, layers.LayerTypeIPv6, gopacket.Lazy)
 		IP6Layer = fixer.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
 		proto = "IP6"
 		if mess.ClientToServer {
@@ -289,7 +351,7 @@ func classifyTraffic(mess *dispatch.NfqueueMessage) string {
 	}
 
 	// if we have a UDP layer update with the ports we saved above
-	udpPtr := mess.Packet.Layer(layers.LayerTypeUDP)
+	udpPtr := fixer.Layer(layers.LayerTypeUDP)
 	if udpPtr != nil {
 		UDPlayer := udpPtr.(*layers.UDP)
 		UDPlayer.SrcPort = layers.UDPPort(srcport)
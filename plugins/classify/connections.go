@@ -0,0 +1,210 @@
+package classify
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/inventory"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// the session attachment set once the session has been added to the connection totals
+const connectionAttachment = "application_connection"
+
+const connectionLogIntervalSec = 60
+
+// connectionKey identifies a client talking to a server with an application
+type connectionKey struct {
+	client string
+	appid  string
+	server string
+}
+
+// connectionHolder accumulates the sessions and bytes for a connection key
+// between the writes to the app_connections table
+type connectionHolder struct {
+	client      net.IP
+	name        string
+	firstSeen   time.Time
+	lastSeen    time.Time
+	sessions    uint64
+	clientBytes uint64
+	serverBytes uint64
+}
+
+// connectionTable only holds the totals since the last write. logConnections
+// replaces it with an empty map each interval so idle connections are dropped
+// and the table can't grow beyond one interval of traffic.
+var connectionTable = make(map[connectionKey]*connectionHolder)
+var connectionMutex sync.Mutex
+var connectionShutdown = make(chan bool)
+
+// init registers the app_connections table with the reports schema registry.
+// The table has a row per day for each device, application and server so
+// the unique index starts with the application for the queries that look
+// for the devices that used an application.
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "app_connections",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "mac_address", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "address", Type: "text"},
+			{Name: "hostname", Type: "text"},
+			{Name: "application_id", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "application_name", Type: "text"},
+			{Name: "server_address", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "first_seen", Type: "bigint"},
+			{Name: "last_seen", Type: "bigint"},
+			{Name: "sessions", Type: "int8"},
+			{Name: "client_bytes", Type: "int8"},
+			{Name: "server_bytes", Type: "int8"},
+		},
+		Unique:      []string{"application_id", "time_stamp", "mac_address", "server_address"},
+		TrimPercent: .1,
+	})
+}
+
+// recordConnection adds a session to the totals for the client, application
+// and server. It is called when the session is classified or released, and
+// for the sessions that were released some other way on the first conntrack
+// update, but each session is only counted once.
+func recordConnection(session *dispatch.Session) {
+	if session.GetAttachment(connectionAttachment) != nil {
+		return
+	}
+
+	appid, _ := session.GetAttachment("application_id").(string)
+	if appid == "" {
+		return
+	}
+	name, _ := session.GetAttachment("application_name").(string)
+
+	tuple := session.GetClientSideTuple()
+	if tuple.ClientAddress == nil || tuple.ServerAddress == nil {
+		return
+	}
+
+	session.PutAttachment(connectionAttachment, true)
+
+	now := time.Now()
+	holder := getConnectionHolder(connectionKey{client: tuple.ClientAddress.String(), appid: appid, server: tuple.ServerAddress.String()}, tuple.ClientAddress, now)
+	holder.name = name
+	holder.sessions++
+	connectionMutex.Unlock()
+}
+
+// PluginConntrackHandler receives conntrack events and adds the byte counts
+// of the classified sessions to the connection totals
+func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
+	if message != 'U' {
+		return
+	}
+
+	entry.Guardian.RLock()
+	session := entry.Session
+	client := entry.ClientSideTuple.ClientAddress
+	server := entry.ClientSideTuple.ServerAddress
+	clientBytes := entry.ClientBytesDiff
+	serverBytes := entry.ServerBytesDiff
+	entry.Guardian.RUnlock()
+
+	if session == nil || client == nil || server == nil {
+		return
+	}
+
+	recordConnection(session)
+	if session.GetAttachment(connectionAttachment) == nil || (clientBytes == 0 && serverBytes == 0) {
+		return
+	}
+	appid, _ := session.GetAttachment("application_id").(string)
+
+	holder := getConnectionHolder(connectionKey{client: client.String(), appid: appid, server: server.String()}, client, time.Now())
+	holder.clientBytes += clientBytes
+	holder.serverBytes += serverBytes
+	connectionMutex.Unlock()
+}
+
+// getConnectionHolder returns the holder for a connection key, creating it if
+// needed, with the connectionMutex locked. The caller must unlock it.
+func getConnectionHolder(key connectionKey, client net.IP, now time.Time) *connectionHolder {
+	connectionMutex.Lock()
+	holder := connectionTable[key]
+	if holder == nil {
+		holder = &connectionHolder{client: client, firstSeen: now}
+		connectionTable[key] = holder
+	}
+	holder.lastSeen = now
+	return holder
+}
+
+// connectionTask periodically writes the connection totals to the database
+func connectionTask() {
+	for {
+		select {
+		case <-connectionShutdown:
+			connectionShutdown <- true
+			return
+		case <-time.After(time.Second * time.Duration(connectionLogIntervalSec)):
+			logConnections()
+		}
+	}
+}
+
+// logConnections resolves the device for each client address and adds the
+// accumulated totals to the row for the day. Only local devices are tracked
+// so connections from clients we can't find in the inventory or the neighbor
+// table are ignored.
+func logConnections() {
+	// swap in an empty table so every entry is evicted once it has been written
+	connectionMutex.Lock()
+	current := connectionTable
+	connectionTable = make(map[connectionKey]*connectionHolder)
+	connectionMutex.Unlock()
+
+	for key, holder := range current {
+		var hostname string
+		var mac string
+
+		device := inventory.FindDeviceByAddress(holder.client)
+		if device != nil {
+			mac = device.MacAddress
+			hostname = device.Hostname
+		} else if hwaddr := inventory.LookupMacAddress(holder.client); hwaddr != nil {
+			mac = hwaddr.String()
+		} else {
+			logger.Trace("Ignoring connections for non-local address %v\n", holder.client)
+			continue
+		}
+
+		columns := map[string]interface{}{
+			"time_stamp":     reports.GetUsagePeriodStart("daily", holder.lastSeen),
+			"mac_address":    mac,
+			"application_id": key.appid,
+			"server_address": key.server,
+		}
+
+		modifiedColumns := map[string]interface{}{
+			"address":      holder.client,
+			"first_seen":   reports.KeepFirst{Value: holder.firstSeen},
+			"last_seen":    holder.lastSeen,
+			"sessions":     holder.sessions,
+			"client_bytes": holder.clientBytes,
+			"server_bytes": holder.serverBytes,
+		}
+
+		// the byte updates don't know the name so don't replace it with an empty one
+		if holder.name != "" {
+			modifiedColumns["application_name"] = holder.name
+		}
+		if hostname != "" {
+			modifiedColumns["hostname"] = hostname
+		}
+
+		reports.LogEvent(reports.CreateEvent("app_connection", "app_connections", 3, columns, modifiedColumns))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/untangle/packetd/services/faults"
 	"github.com/untangle/packetd/services/logger"
 )
 
@@ -102,6 +103,12 @@ func daemonClassifyPacket(command string, buffer []byte) string {
 		return ""
 	}
 
+	// an injected fault is handled like a failed write to the daemon
+	if err = faults.Inject(faults.ClassifyDaemon, ""); err != nil {
+		logger.Err("Error writing command to daemon socket: %v\n", err)
+		return ""
+	}
+
 	logger.Trace("DAEMON COMMAND: %s\n", command)
 
 	// write the command to the daemon socket
@@ -0,0 +1,516 @@
+// Package conntimeout provides the "conntimeout" plugin
+// The conntimeout plugin adjusts the conntrack timeouts for connections that
+// must stay up while idle, like the SCADA clients that poll a few times a day.
+// The timeouts can be changed for each protocol with the conntrack sysctls, for
+// each port with nftables ct timeout policies, and for each classified
+// application. A ct timeout policy is only used by a connection that is not
+// yet confirmed, which is before the application is known, so the timeout of
+// an application is set on the conntrack entry every time the conntrack table
+// is dumped. The protocol and application timeouts can also be changed at
+// runtime through the API. Runtime changes are not saved and are lost when
+// packetd restarts.
+package conntimeout
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const pluginName = "conntimeout"
+
+// the nftables table that holds the ct timeout policies for the ports
+const tableName = "packetd-timeouts"
+
+// the application timeout is only set again when the timeout of the conntrack
+// entry is this many seconds away from it, so we don't update every entry on
+// every conntrack dump
+const refreshSlack = 30
+
+// the conntrack states that can be used in the policy of a port
+var policyStates = map[string]map[string]bool{
+	"tcp": {"syn_sent": true, "syn_recv": true, "established": true, "fin_wait": true, "close_wait": true, "last_ack": true,
+		"time_wait": true, "close": true, "syn_sent2": true, "retrans": true, "unacknowledged": true},
+	"udp": {"unreplied": true, "replied": true},
+}
+
+// PortTimeout holds the conntrack timeout policy for the connections to a port
+type PortTimeout struct {
+	Protocol string         `json:"protocol"`
+	Port     int            `json:"port"`
+	Policy   map[string]int `json:"policy"`
+}
+
+// Status holds the configured timeouts and the current conntrack timeout sysctls
+type Status struct {
+	Protocols           map[string]int `json:"protocols"`
+	Applications        map[string]int `json:"applications"`
+	Ports               []PortTimeout  `json:"ports"`
+	RuntimeProtocols    map[string]int `json:"runtimeProtocols"`
+	RuntimeApplications map[string]int `json:"runtimeApplications"`
+	Current             map[string]int `json:"current"`
+	Refreshed           uint64         `json:"refreshed"`
+	Failed              uint64         `json:"failed"`
+	Error               string         `json:"error,omitempty"`
+}
+
+// timeoutConfig holds the timeouts from the settings
+type timeoutConfig struct {
+	protocols    map[string]int
+	applications map[string]int
+	ports        []PortTimeout
+}
+
+var currentConfig = newTimeoutConfig()
+var runtimeProtocols = make(map[string]int)
+var runtimeApplications = make(map[string]int)
+
+// the sysctl values from before we changed them so they can be put back
+var originalTable = make(map[string]int)
+
+// the application timeouts used by the conntrack handler
+var applicationTable = make(map[string]int)
+
+var tableActive bool
+var lastError string
+var configLocker sync.Mutex
+var applicationLocker sync.RWMutex
+var refreshCount uint64
+var failureCount uint64
+
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: 2, ConntrackFunc: PluginConntrackHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	loadConfig()
+}
+
+// PluginShutdown function called when the daemon is shutting down. The sysctls
+// we changed are put back and the ct timeout policies are removed.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	configLocker.Lock()
+	defer configLocker.Unlock()
+
+	for name, value := range originalTable {
+		if err := kernel.SetConntrackTimeout(name, value); err != nil {
+			logger.Warn("Unable to restore conntrack timeout %s: %v\n", name, err)
+		}
+	}
+	originalTable = make(map[string]int)
+	removeTable()
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadConfig()
+	}
+}
+
+// PluginConntrackHandler is called for conntrack events. We set the timeout of
+// the conntrack entries for the classified applications that have a timeout.
+func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
+	if message != 'U' {
+		return
+	}
+
+	// the entries seen during playback are not in the conntrack table
+	if kernel.GetWarehouseFlag() == 'P' {
+		return
+	}
+
+	applicationLocker.RLock()
+	empty := (len(applicationTable) == 0)
+	applicationLocker.RUnlock()
+	if empty {
+		return
+	}
+
+	entry.Guardian.RLock()
+	session := entry.Session
+	ctid := entry.ConntrackID
+	family := entry.Family
+	tuple := entry.ClientSideTuple
+	current := entry.TimeoutSeconds
+	entry.Guardian.RUnlock()
+
+	if session == nil || (tuple.Protocol != syscall.IPPROTO_TCP && tuple.Protocol != syscall.IPPROTO_UDP) {
+		return
+	}
+
+	timeout := findApplicationTimeout(session)
+	if timeout == 0 {
+		return
+	}
+	if current+refreshSlack >= uint32(timeout) && current <= uint32(timeout)+refreshSlack {
+		return
+	}
+
+	err := kernel.UpdateConntrackTimeout(ctid, family, tuple.Protocol, tuple.ClientAddress, tuple.ServerAddress, tuple.ClientPort, tuple.ServerPort, uint32(timeout))
+	if err != nil {
+		atomic.AddUint64(&failureCount, 1)
+		logger.Warn("%OC|Unable to set the conntrack timeout ctid:%d %v\n", "conntimeout_update_failure", 10, ctid, err)
+		return
+	}
+
+	atomic.AddUint64(&refreshCount, 1)
+	overseer.AddCounter("conntimeout_update", 1)
+	logger.Debug("Set conntrack timeout ctid:%d from %d to %d\n", ctid, current, timeout)
+}
+
+// SetProtocolTimeout changes a conntrack timeout sysctl at runtime. The name is the
+// sysctl without the nf_conntrack_ prefix, like tcp_timeout_established.
+func SetProtocolTimeout(name string, seconds int) error {
+	if seconds <= 0 {
+		return fmt.Errorf("invalid timeout %d", seconds)
+	}
+	if _, found := kernel.GetConntrackTimeouts()[name]; !found {
+		return fmt.Errorf("unknown conntrack timeout %s", name)
+	}
+
+	configLocker.Lock()
+	defer configLocker.Unlock()
+
+	runtimeProtocols[name] = seconds
+	return applyProtocols()
+}
+
+// SetApplicationTimeout changes the conntrack timeout of an application at
+// runtime. The application matches the application id or name without case.
+func SetApplicationTimeout(name string, seconds int) error {
+	if name == "" || seconds <= 0 {
+		return fmt.Errorf("invalid application timeout %s %d", name, seconds)
+	}
+
+	configLocker.Lock()
+	defer configLocker.Unlock()
+
+	runtimeApplications[strings.ToLower(name)] = seconds
+	applyApplications()
+	return nil
+}
+
+// ClearTimeout removes a runtime protocol or application timeout so the
+// timeout from the settings is used again
+func ClearTimeout(kind string, name string) error {
+	configLocker.Lock()
+	defer configLocker.Unlock()
+
+	switch kind {
+	case "protocol":
+		delete(runtimeProtocols, name)
+		return applyProtocols()
+	case "application":
+		delete(runtimeApplications, strings.ToLower(name))
+		applyApplications()
+		return nil
+	}
+
+	return fmt.Errorf("unknown timeout type %s", kind)
+}
+
+// GetStatus returns the configured timeouts and the current conntrack timeout sysctls
+func GetStatus() Status {
+	configLocker.Lock()
+	defer configLocker.Unlock()
+
+	status := Status{
+		Protocols:           copyTable(currentConfig.protocols),
+		Applications:        copyTable(currentConfig.applications),
+		Ports:               append([]PortTimeout{}, currentConfig.ports...),
+		RuntimeProtocols:    copyTable(runtimeProtocols),
+		RuntimeApplications: copyTable(runtimeApplications),
+		Current:             kernel.GetConntrackTimeouts(),
+		Refreshed:           atomic.LoadUint64(&refreshCount),
+		Failed:              atomic.LoadUint64(&failureCount),
+		Error:               lastError,
+	}
+	return status
+}
+
+// loadConfig loads the timeouts from the settings and applies them
+func loadConfig() {
+	fresh := newTimeoutConfig()
+
+	configJSON, err := settings.GetCurrentSettings([]string{"plugins", "conntimeout"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			fresh.protocols = parseTable(item["protocols"], false)
+			fresh.applications = parseTable(item["applications"], true)
+			fresh.ports = parsePorts(item["ports"])
+		} else {
+			logger.Warn("Invalid conntimeout settings: %T\n", configJSON)
+		}
+	}
+
+	configLocker.Lock()
+	defer configLocker.Unlock()
+
+	currentConfig = fresh
+	if err := applyProtocols(); err != nil {
+		logger.Warn("%v\n", err)
+	}
+	applyApplications()
+	applyPorts()
+
+	logger.Info("Loaded conntimeout settings protocols:%d applications:%d ports:%d\n", len(fresh.protocols), len(fresh.applications), len(fresh.ports))
+}
+
+// applyProtocols sets the conntrack timeout sysctls from the settings and the
+// runtime changes, and puts back the ones that are no longer configured. The
+// caller must hold the configLocker.
+func applyProtocols() error {
+	var failed []string
+
+	table := copyTable(currentConfig.protocols)
+	for name, value := range runtimeProtocols {
+		table[name] = value
+	}
+
+	current := kernel.GetConntrackTimeouts()
+	for name, value := range table {
+		original, found := current[name]
+		if !found {
+			failed = append(failed, name)
+			continue
+		}
+		if _, saved := originalTable[name]; !saved {
+			originalTable[name] = original
+		}
+		if original == value {
+			continue
+		}
+		if err := kernel.SetConntrackTimeout(name, value); err != nil {
+			failed = append(failed, name)
+			continue
+		}
+		logger.Info("Set conntrack timeout %s from %d to %d\n", name, original, value)
+	}
+
+	for name, value := range originalTable {
+		if _, found := table[name]; found {
+			continue
+		}
+		if err := kernel.SetConntrackTimeout(name, value); err != nil {
+			logger.Warn("Unable to restore conntrack timeout %s: %v\n", name, err)
+			continue
+		}
+		delete(originalTable, name)
+		logger.Info("Restored conntrack timeout %s to %d\n", name, value)
+	}
+
+	if len(failed) != 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("unable to set conntrack timeouts: %s", strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// applyApplications updates the application timeouts used by the conntrack
+// handler. The caller must hold the configLocker.
+func applyApplications() {
+	table := copyTable(currentConfig.applications)
+	for name, value := range runtimeApplications {
+		table[name] = value
+	}
+
+	applicationLocker.Lock()
+	applicationTable = table
+	applicationLocker.Unlock()
+}
+
+// applyPorts replaces the timeouts table with one that has a ct timeout policy
+// for each port. The old table is deleted and the new one created by a single
+// nft command so the change is atomic. The caller must hold the configLocker.
+func applyPorts() {
+	if len(currentConfig.ports) == 0 {
+		removeTable()
+		lastError = ""
+		return
+	}
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "add table inet %s\n", tableName)
+	fmt.Fprintf(&script, "delete table inet %s\n", tableName)
+	fmt.Fprintf(&script, "table inet %s {\n", tableName)
+	for _, port := range currentConfig.ports {
+		var states []string
+		for state, value := range port.Policy {
+			states = append(states, fmt.Sprintf("%s: %d", state, value))
+		}
+		sort.Strings(states)
+		fmt.Fprintf(&script, "\tct timeout %s-%d {\n\t\tprotocol %s;\n\t\tpolicy = { %s }\n\t}\n", port.Protocol, port.Port, port.Protocol, strings.Join(states, ", "))
+	}
+	for _, hook := range []string{"prerouting", "output"} {
+		fmt.Fprintf(&script, "\tchain %s {\n\t\ttype filter hook %s priority -150; policy accept;\n", hook, hook)
+		for _, port := range currentConfig.ports {
+			fmt.Fprintf(&script, "\t\tct state new %s dport %d ct timeout set \"%s-%d\"\n", port.Protocol, port.Port, port.Protocol, port.Port)
+		}
+		fmt.Fprintf(&script, "\t}\n")
+	}
+	fmt.Fprintf(&script, "}\n")
+
+	command := exec.Command("nft", "-f", "-")
+	command.Stdin = &script
+	output, err := command.CombinedOutput()
+	if err != nil {
+		lastError = strings.TrimSpace(string(output))
+		if lastError == "" {
+			lastError = err.Error()
+		}
+		logger.Warn("%OC|Failed to update the conntrack timeout policies: %s\n", "conntimeout_nft_failure", 10, lastError)
+		return
+	}
+
+	tableActive = true
+	lastError = ""
+	logger.Info("Updated the conntrack timeout policies for %d ports\n", len(currentConfig.ports))
+}
+
+// removeTable removes the timeouts table if we created it. The caller must
+// hold the configLocker.
+func removeTable() {
+	if !tableActive {
+		return
+	}
+
+	output, err := exec.Command("nft", "delete", "table", "inet", tableName).CombinedOutput()
+	if err != nil {
+		logger.Warn("Failed to remove the conntrack timeout policies: %s\n", strings.TrimSpace(string(output)))
+		return
+	}
+
+	tableActive = false
+	logger.Info("Removed the conntrack timeout policies\n")
+}
+
+// findApplicationTimeout returns the timeout for the application of a session
+// or zero if the session is not classified or its application has no timeout
+func findApplicationTimeout(session *dispatch.Session) int {
+	appid, _ := session.GetAttachment("application_id").(string)
+	name, _ := session.GetAttachment("application_name").(string)
+	if appid == "" && name == "" {
+		return 0
+	}
+
+	applicationLocker.RLock()
+	defer applicationLocker.RUnlock()
+
+	if value, found := applicationTable[strings.ToLower(appid)]; found && appid != "" {
+		return value
+	}
+	if value, found := applicationTable[strings.ToLower(name)]; found && name != "" {
+		return value
+	}
+	return 0
+}
+
+// parseTable parses an object of names and timeouts from the settings
+func parseTable(value interface{}, lower bool) map[string]int {
+	table := make(map[string]int)
+
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return table
+	}
+
+	for name, entry := range item {
+		seconds, ok := entry.(float64)
+		if !ok || seconds <= 0 || name == "" {
+			logger.Warn("Invalid conntimeout entry %s: %v\n", name, entry)
+			continue
+		}
+		if lower {
+			name = strings.ToLower(name)
+		}
+		table[name] = int(seconds)
+	}
+
+	return table
+}
+
+// parsePorts parses the port timeout policies from the settings
+func parsePorts(value interface{}) []PortTimeout {
+	var list []PortTimeout
+	seen := make(map[string]bool)
+
+	items, _ := value.([]interface{})
+	for _, entry := range items {
+		item, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		port := PortTimeout{Policy: make(map[string]int)}
+		port.Protocol, _ = item["protocol"].(string)
+		port.Protocol = strings.ToLower(port.Protocol)
+		if number, ok := item["port"].(float64); ok {
+			port.Port = int(number)
+		}
+		states, valid := policyStates[port.Protocol]
+		if !valid || port.Port <= 0 || port.Port > 65535 {
+			logger.Warn("Invalid conntimeout port %v\n", entry)
+			continue
+		}
+		for state, seconds := range parseTable(item["policy"], true) {
+			if !states[state] {
+				logger.Warn("Invalid conntimeout %s state %s\n", port.Protocol, state)
+				continue
+			}
+			port.Policy[state] = seconds
+		}
+		key := fmt.Sprintf("%s-%d", port.Protocol, port.Port)
+		if len(port.Policy) == 0 || seen[key] {
+			logger.Warn("Invalid conntimeout port %v\n", entry)
+			continue
+		}
+		seen[key] = true
+		list = append(list, port)
+	}
+
+	return list
+}
+
+// newTimeoutConfig returns an empty timeout configuration
+func newTimeoutConfig() *timeoutConfig {
+	return &timeoutConfig{
+		protocols:    make(map[string]int),
+		applications: make(map[string]int),
+	}
+}
+
+// copyTable returns a copy of a table of timeouts
+func copyTable(table map[string]int) map[string]int {
+	result := make(map[string]int)
+	for name, value := range table {
+		result[name] = value
+	}
+	return result
+}
@@ -0,0 +1,386 @@
+// Package dhcp provides the "dhcp" plugin
+// The dhcp plugin snoops DHCP traffic on the LAN interfaces using packet sockets
+// so it works regardless of which DHCP server is running. Lease grants and
+// releases are logged to the database, and the client address, hostname, and
+// vendor class are passed to the device inventory.
+package dhcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/inventory"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+	"golang.org/x/net/bpf"
+)
+
+const pluginName = "dhcp"
+const requestTimeout = 300
+const cleanInterval = 60
+
+// the lease history is small and is kept longer for the address holder queries
+const leaseTrimPercent = .02
+
+// requestHolder is used to remember the client details from a DHCP request
+// since some servers do not echo the hostname in the ACK
+type requestHolder struct {
+	hostname    string
+	vendorClass string
+	timestamp   time.Time
+}
+
+var requestTable map[string]*requestHolder
+var requestMutex sync.Mutex
+var socketList []int
+var socketWaiter sync.WaitGroup
+var shutdownFlag bool
+var shutdownMutex sync.RWMutex
+var shutdownChannel = make(chan bool)
+
+// dhcpFilter only accepts unfragmented UDP packets to or from ports 67 and 68.
+// Packet sockets opened with SOCK_DGRAM deliver the packet starting with the
+// IP header so all of the offsets are relative to the start of the IP header.
+var dhcpFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 9, Size: 1},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 17, SkipFalse: 9},
+	bpf.LoadAbsolute{Off: 6, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 7},
+	bpf.LoadMemShift{Off: 0},
+	bpf.LoadIndirect{Off: 0, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 67, SkipTrue: 5},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 68, SkipTrue: 4},
+	bpf.LoadIndirect{Off: 2, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 67, SkipTrue: 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 68, SkipTrue: 1},
+	bpf.RetConstant{Val: 0},
+	bpf.RetConstant{Val: 65535},
+}
+
+// init registers the plugin with the plugin registry and the lease history table with
+// the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "dhcp_leases",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "event_type", Type: "text"},
+			{Name: "mac_address", Type: "text"},
+			{Name: "address", Type: "text"},
+			{Name: "hostname", Type: "text"},
+			{Name: "vendor_class", Type: "text"},
+			{Name: "lease_time", Type: "int8"},
+			{Name: "server_address", Type: "text"},
+			{Name: "interface_name", Type: "text"},
+		},
+		TrimPercent: leaseTrimPercent,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+
+	requestTable = make(map[string]*requestHolder)
+	shutdownFlag = false
+
+	for _, device := range settings.GetLanDevices() {
+		openSocket(device)
+	}
+
+	go cleanupTask()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	// the socket readers use a receive timeout so they will notice the flag and return
+	shutdownMutex.Lock()
+	shutdownFlag = true
+	shutdownMutex.Unlock()
+
+	socketWaiter.Wait()
+	for _, sock := range socketList {
+		syscall.Close(sock)
+	}
+	socketList = nil
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of cleanupTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown cleanupTask\n")
+	}
+}
+
+// openSocket opens a packet socket on the argumented device with the DHCP filter attached
+func openSocket(device string) {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		logger.Warn("Unable to find DHCP interface %s: %v\n", device, err)
+		return
+	}
+
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_IP)))
+	if err != nil {
+		logger.Warn("Unable to create DHCP socket for %s: %v\n", device, err)
+		return
+	}
+
+	raw, err := bpf.Assemble(dhcpFilter)
+	if err != nil {
+		logger.Err("Unable to assemble DHCP filter: %v\n", err)
+		syscall.Close(sock)
+		return
+	}
+
+	filter := make([]syscall.SockFilter, len(raw))
+	for x, item := range raw {
+		filter[x] = syscall.SockFilter{Code: item.Op, Jt: item.Jt, Jf: item.Jf, K: item.K}
+	}
+
+	err = syscall.AttachLsf(sock, filter)
+	if err != nil {
+		logger.Warn("Unable to attach DHCP filter for %s: %v\n", device, err)
+		syscall.Close(sock)
+		return
+	}
+
+	timeout := syscall.Timeval{Sec: 1}
+	err = syscall.SetsockoptTimeval(sock, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+	if err != nil {
+		logger.Warn("Unable to set DHCP socket timeout for %s: %v\n", device, err)
+		syscall.Close(sock)
+		return
+	}
+
+	addr := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_IP), Ifindex: iface.Index}
+	err = syscall.Bind(sock, addr)
+	if err != nil {
+		logger.Warn("Unable to bind DHCP socket for %s: %v\n", device, err)
+		syscall.Close(sock)
+		return
+	}
+
+	logger.Info("Listening for DHCP traffic on %s\n", device)
+	socketList = append(socketList, sock)
+	socketWaiter.Add(1)
+	go watchSocket(sock, device)
+}
+
+// watchSocket reads and processes DHCP packets from the socket until shutdown
+func watchSocket(sock int, device string) {
+	defer socketWaiter.Done()
+
+	buffer := make([]byte, 65535)
+
+	for {
+		shutdownMutex.RLock()
+		finished := shutdownFlag
+		shutdownMutex.RUnlock()
+		if finished {
+			return
+		}
+
+		size, _, err := syscall.Recvfrom(sock, buffer, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			logger.Warn("Error %v reading DHCP socket for %s\n", err, device)
+			return
+		}
+
+		packet := gopacket.NewPacket(buffer[:size], layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: false})
+		dhcpLayer := packet.Layer(layers.LayerTypeDHCPv4)
+		if dhcpLayer == nil {
+			continue
+		}
+
+		var server net.IP
+		if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+			server = ipLayer.(*layers.IPv4).SrcIP
+		}
+
+		processPacket(dhcpLayer.(*layers.DHCPv4), device, server)
+	}
+}
+
+// processPacket handles a single DHCP message
+func processPacket(dhcp *layers.DHCPv4, device string, source net.IP) {
+	var msgType layers.DHCPMsgType
+	var hostname string
+	var vendorClass string
+	var leaseTime uint32
+	var serverID net.IP
+	var requestIP net.IP
+
+	for _, opt := range dhcp.Options {
+		switch opt.Type {
+		case layers.DHCPOptMessageType:
+			if len(opt.Data) == 1 {
+				msgType = layers.DHCPMsgType(opt.Data[0])
+			}
+		case layers.DHCPOptHostname:
+			hostname = string(opt.Data)
+		case layers.DHCPOptClassID:
+			vendorClass = string(opt.Data)
+		case layers.DHCPOptLeaseTime:
+			if len(opt.Data) == 4 {
+				leaseTime = binary.BigEndian.Uint32(opt.Data)
+			}
+		case layers.DHCPOptServerID:
+			if len(opt.Data) == 4 {
+				serverID = net.IP(opt.Data)
+			}
+		case layers.DHCPOptRequestIP:
+			if len(opt.Data) == 4 {
+				requestIP = net.IP(opt.Data)
+			}
+		}
+	}
+
+	mac := dhcp.ClientHWAddr
+	if len(mac) == 0 {
+		return
+	}
+
+	logger.Trace("DHCP %v mac:%v ciaddr:%v yiaddr:%v hostname:%s class:%s dev:%s\n", msgType, mac, dhcp.ClientIP, dhcp.YourClientIP, hostname, vendorClass, device)
+
+	// replies without a server identifier option must have come from the server
+	if serverID == nil && dhcp.Operation == layers.DHCPOpReply {
+		serverID = source
+	}
+
+	switch msgType {
+	case layers.DHCPMsgTypeDiscover, layers.DHCPMsgTypeRequest, layers.DHCPMsgTypeInform:
+		// remember what the client told us so we have it when the ACK arrives
+		if hostname != "" || vendorClass != "" {
+			requestMutex.Lock()
+			requestTable[mac.String()] = &requestHolder{hostname: hostname, vendorClass: vendorClass, timestamp: time.Now()}
+			requestMutex.Unlock()
+		}
+		if vendorClass != "" {
+			inventory.UpdateDevice(mac, nil, "vendor_class", vendorClass)
+		}
+		if hostname != "" {
+			inventory.UpdateDevice(mac, nil, "hostname", hostname)
+		}
+
+	case layers.DHCPMsgTypeAck:
+		address := dhcp.YourClientIP
+		if address == nil || address.IsUnspecified() {
+			// an ACK for an INFORM only confirms the address the client already has
+			address = dhcp.ClientIP
+		}
+		if address == nil || address.IsUnspecified() {
+			return
+		}
+
+		requestMutex.Lock()
+		holder := requestTable[mac.String()]
+		delete(requestTable, mac.String())
+		requestMutex.Unlock()
+
+		if holder != nil {
+			if hostname == "" {
+				hostname = holder.hostname
+			}
+			if vendorClass == "" {
+				vendorClass = holder.vendorClass
+			}
+		}
+
+		logger.Debug("DHCP lease granted mac:%v address:%v hostname:%s lease:%d dev:%s\n", mac, address, hostname, leaseTime, device)
+		overseer.AddCounter("dhcp_lease_granted", 1)
+
+		inventory.UpdateDevice(mac, address, "hostname", hostname)
+		inventory.UpdateDevice(mac, address, "vendor_class", vendorClass)
+		logEvent("grant", mac, address, hostname, vendorClass, leaseTime, serverID, device)
+
+	case layers.DHCPMsgTypeRelease:
+		logger.Debug("DHCP lease released mac:%v address:%v dev:%s\n", mac, dhcp.ClientIP, device)
+		overseer.AddCounter("dhcp_lease_released", 1)
+		logEvent("release", mac, dhcp.ClientIP, hostname, vendorClass, 0, serverID, device)
+
+	case layers.DHCPMsgTypeDecline:
+		logger.Debug("DHCP lease declined mac:%v address:%v dev:%s\n", mac, requestIP, device)
+		overseer.AddCounter("dhcp_lease_declined", 1)
+		logEvent("decline", mac, requestIP, hostname, vendorClass, 0, serverID, device)
+
+	case layers.DHCPMsgTypeNak:
+		logger.Debug("DHCP request rejected mac:%v dev:%s\n", mac, device)
+		overseer.AddCounter("dhcp_lease_rejected", 1)
+		logEvent("reject", mac, nil, hostname, vendorClass, 0, serverID, device)
+	}
+}
+
+// logEvent logs a DHCP lease event to the dhcp_leases table
+func logEvent(eventType string, mac net.HardwareAddr, address net.IP, hostname string, vendorClass string, leaseTime uint32, server net.IP, device string) {
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"event_type":     eventType,
+		"mac_address":    mac.String(),
+		"hostname":       hostname,
+		"vendor_class":   vendorClass,
+		"lease_time":     leaseTime,
+		"interface_name": device,
+	}
+
+	if address != nil && !address.IsUnspecified() {
+		columns["address"] = address
+	}
+	if server != nil && !server.IsUnspecified() {
+		columns["server_address"] = server
+	}
+
+	reports.LogEvent(reports.CreateEvent("dhcp_lease_"+eventType, "dhcp_leases", 1, columns, nil))
+}
+
+// cleanupTask is a periodic task to remove request details that were never matched with an ACK
+func cleanupTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(cleanInterval * time.Second):
+			cleanRequestTable()
+		}
+	}
+}
+
+// cleanRequestTable removes stale entries from the request table
+func cleanRequestTable() {
+	requestMutex.Lock()
+	defer requestMutex.Unlock()
+
+	for key, holder := range requestTable {
+		if time.Now().Sub(holder.timestamp) > requestTimeout*time.Second {
+			delete(requestTable, key)
+		}
+	}
+}
+
+// htons converts a short from host to network byte order
+func htons(value uint16) uint16 {
+	return (value << 8) | (value >> 8)
+}
@@ -0,0 +1,271 @@
+package dns
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the dns detection settings are missing
+const (
+	defaultDomainFile    = "/etc/config/seen-domains.json"
+	defaultMaxDomains    = 100000
+	defaultLearningHours = 24
+	defaultDGAThreshold  = 0.65
+)
+
+// the shortest name we score, since short names don't have enough
+// characters for the statistics to mean anything
+const minimumDGALength = 6
+
+// detectConfig holds the newly seen domain and DGA detection settings
+type detectConfig struct {
+	newDomains   bool
+	domainFile   string
+	maxDomains   int
+	learning     time.Duration
+	dga          bool
+	dgaThreshold float64
+}
+
+// domainStore is the list of domains queried on the network as it is written
+// to disk. The creation time starts the learning period.
+type domainStore struct {
+	CreationTime time.Time        `json:"creationTime"`
+	Domains      map[string]int64 `json:"domains"`
+}
+
+var detection = detectConfig{domainFile: defaultDomainFile, maxDomains: defaultMaxDomains}
+var seenDomains = domainStore{Domains: make(map[string]int64)}
+var domainsChanged bool
+var detectMutex sync.Mutex
+
+// loadDetection loads the detection settings and the seen domains from the
+// file if it changed
+func loadDetection() {
+	fresh := detectConfig{
+		newDomains:   true,
+		domainFile:   defaultDomainFile,
+		maxDomains:   defaultMaxDomains,
+		learning:     defaultLearningHours * time.Hour,
+		dga:          true,
+		dgaThreshold: defaultDGAThreshold,
+	}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"plugins", "dns"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid dns settings: %T\n", configJSON)
+		} else {
+			if value, ok := item["newDomains"].(bool); ok {
+				fresh.newDomains = value
+			}
+			if value, ok := item["domainFile"].(string); ok && value != "" {
+				fresh.domainFile = value
+			}
+			if value, ok := item["maxDomains"].(float64); ok && value > 0 {
+				fresh.maxDomains = int(value)
+			}
+			if value, ok := item["learningHours"].(float64); ok && value >= 0 {
+				fresh.learning = time.Duration(value * float64(time.Hour))
+			}
+			if value, ok := item["dga"].(bool); ok {
+				fresh.dga = value
+			}
+			if value, ok := item["dgaThreshold"].(float64); ok && value > 0 && value <= 1 {
+				fresh.dgaThreshold = value
+			}
+		}
+	}
+
+	logger.Info("Loaded dns detection settings newDomains:%v file:%s max:%d learning:%v dga:%v threshold:%.2f\n",
+		fresh.newDomains, fresh.domainFile, fresh.maxDomains, fresh.learning, fresh.dga, fresh.dgaThreshold)
+
+	detectMutex.Lock()
+	previous := detection
+	detection = fresh
+	detectMutex.Unlock()
+
+	if fresh.newDomains && (previous.domainFile != fresh.domainFile || seenDomains.CreationTime.IsZero()) {
+		loadDomains(fresh.domainFile)
+	}
+}
+
+// getDetection returns the active detection settings
+func getDetection() detectConfig {
+	detectMutex.Lock()
+	defer detectMutex.Unlock()
+	return detection
+}
+
+// loadDomains replaces the seen domains with the list saved in the argumented file
+func loadDomains(filename string) {
+	store := domainStore{CreationTime: time.Now(), Domains: make(map[string]int64)}
+
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(data, &store)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warn("Unable to read the seen domains %s: %v\n", filename, err)
+	}
+	if store.Domains == nil {
+		store.Domains = make(map[string]int64)
+	}
+	if store.CreationTime.IsZero() {
+		store.CreationTime = time.Now()
+	}
+
+	detectMutex.Lock()
+	seenDomains = store
+	domainsChanged = true
+	detectMutex.Unlock()
+
+	logger.Info("Loaded %d seen domains from %s\n", len(store.Domains), filename)
+}
+
+// saveDomains writes the seen domains to disk if they changed since they were
+// last written. The oldest domains are dropped when there are more than the
+// limit, so a domain that hasn't been seen in a long time is new again.
+func saveDomains() {
+	detectMutex.Lock()
+	current := detection
+	if !current.newDomains || !domainsChanged {
+		detectMutex.Unlock()
+		return
+	}
+	domainsChanged = false
+
+	if len(seenDomains.Domains) > current.maxDomains {
+		list := make([]string, 0, len(seenDomains.Domains))
+		for domain := range seenDomains.Domains {
+			list = append(list, domain)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return seenDomains.Domains[list[i]] < seenDomains.Domains[list[j]]
+		})
+		for _, domain := range list[:len(list)-current.maxDomains] {
+			delete(seenDomains.Domains, domain)
+		}
+	}
+
+	data, err := json.Marshal(seenDomains)
+	count := len(seenDomains.Domains)
+	detectMutex.Unlock()
+
+	if err != nil {
+		logger.Warn("Unable to encode the seen domains: %v\n", err)
+		return
+	}
+
+	temporary := filepath.Join(filepath.Dir(current.domainFile), "."+filepath.Base(current.domainFile)+".tmp")
+	err = ioutil.WriteFile(temporary, data, 0600)
+	if err == nil {
+		err = os.Rename(temporary, current.domainFile)
+	}
+	if err != nil {
+		logger.Warn("Unable to write the seen domains %s: %v\n", current.domainFile, err)
+		os.Remove(temporary)
+		return
+	}
+
+	logger.Debug("Saved %d seen domains to %s\n", count, current.domainFile)
+}
+
+// checkNewDomain records a query for the domain and returns true if it was
+// never queried before. Nothing is new during the learning period, which
+// starts when the list of seen domains is created.
+func checkNewDomain(domain string, now time.Time) bool {
+	detectMutex.Lock()
+	defer detectMutex.Unlock()
+
+	_, found := seenDomains.Domains[domain]
+	seenDomains.Domains[domain] = now.Unix()
+	domainsChanged = true
+
+	if found {
+		return false
+	}
+	return now.Sub(seenDomains.CreationTime) >= detection.learning
+}
+
+// getBaseDomain returns the registered domain for a query name. Without a
+// public suffix list we keep the last two labels, or three when the name
+// ends with a short second level under a country code like co.uk or com.au.
+func getBaseDomain(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	labels := strings.Split(name, ".")
+	if len(labels) <= 2 {
+		return name
+	}
+
+	count := 2
+	if len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		count = 3
+	}
+	return strings.Join(labels[len(labels)-count:], ".")
+}
+
+// getDGAScore returns a score between zero and one for how likely the domain
+// was made by a domain generation algorithm. We look at the first label of
+// the registered domain, and generated names have a character distribution
+// close to random, with lots of digits, few vowels, and long consonant runs.
+func getDGAScore(domain string) float64 {
+	label := strings.SplitN(domain, ".", 2)[0]
+	if len(label) < minimumDGALength {
+		return 0
+	}
+
+	// internationalized names are encoded and look random to us
+	if strings.HasPrefix(label, "xn--") {
+		return 0
+	}
+
+	var digits, vowels, run, longest int
+	counts := make(map[rune]int)
+	for _, value := range label {
+		counts[value]++
+		switch {
+		case value >= '0' && value <= '9':
+			digits++
+			run = 0
+		case strings.ContainsRune("aeiouy", value):
+			vowels++
+			run = 0
+		case value >= 'a' && value <= 'z':
+			run++
+			if run > longest {
+				longest = run
+			}
+		default:
+			run = 0
+		}
+	}
+
+	var entropy float64
+	length := float64(len(label))
+	for _, count := range counts {
+		probability := float64(count) / length
+		entropy -= probability * math.Log2(probability)
+	}
+
+	// the entropy is compared to the most a label of this length can have
+	entropyScore := entropy / math.Log2(math.Min(length, 36))
+	digitScore := math.Min(float64(digits)/length*3, 1)
+	vowelScore := math.Max(0, 1-float64(vowels)/length/0.4)
+	runScore := math.Min(float64(longest)/5, 1)
+	lengthScore := math.Min(length/20, 1)
+
+	score := 0.35*entropyScore + 0.2*digitScore + 0.2*vowelScore + 0.15*runScore + 0.1*lengthScore
+	return math.Min(math.Max(score, 0), 1)
+}
@@ -3,17 +3,24 @@ package dns
 import (
 	"net"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/gopacket/layers"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/eventbus"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
 	"github.com/untangle/packetd/services/reports"
 )
 
 const pluginName = "dns"
 
+// how often the seen domains are written to disk when they have changed
+const domainSaveInterval = 600 * time.Second
+
 // AddressHolder is used to cache DNS names and IP addresses
 type AddressHolder struct {
 	CreationTime time.Time
@@ -26,20 +33,51 @@ var shutdownChannel = make(chan bool)
 var addressTable map[string]*AddressHolder
 var addressMutex sync.Mutex
 
+// init registers the plugin with the plugin registry and the DNS events table with
+// the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "dns_events",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "session_id", Type: "int8"},
+			{Name: "client_address", Type: "text"},
+			{Name: "event", Type: "text"},
+			{Name: "query_name", Type: "text"},
+			{Name: "domain", Type: "text"},
+			{Name: "dga_score", Type: "real"},
+		},
+		TrimPercent: .1,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.DNSPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
 // PluginStartup function is called to allow plugin specific initialization. We
 // increment the argumented WaitGroup so the main process can wait for
 // our shutdown function to return during shutdown.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
 	addressTable = make(map[string]*AddressHolder)
+	loadDetection()
+	dispatch.InsertShedder(pluginName, shedAddressTable)
 	go cleanupTask()
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.DNSPriority, PluginNfqueueHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down. We call Done
 // for the argumented WaitGroup to let the main process know we're finished.
 func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+	dispatch.RemoveShedder(pluginName)
 
 	shutdownChannel <- true
 
@@ -49,6 +87,16 @@ func PluginShutdown() {
 	case <-time.After(10 * time.Second):
 		logger.Warn("Failed to properly shutdown cleanupTask\n")
 	}
+
+	saveDomains()
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadDetection()
+	}
 }
 
 // PluginNfqueueHandler is called to handle nfqueue packet data. We only
@@ -58,7 +106,7 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	result.SessionRelease = true
 
 	// Session is over
-	if mess.Packet == nil {
+	if mess.Data == nil {
 		return result
 	}
 
@@ -81,11 +129,19 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 			mess.Session.PutAttachment("server_dns_hint", serverHint)
 		}
 
-		logEvent(mess.Session, clientHint, serverHint)
+		// sessions to a server found in the DNS cache get the DGA score of the name
+		score := -1.0
+		if len(serverHint) > 0 && getDetection().dga {
+			score = getDGAScore(getBaseDomain(serverHint))
+			mess.Session.PutAttachment("server_dga_score", score)
+			dict.AddSessionEntry(mess.Session.GetConntrackID(), "server_dga_score", int32(score*100))
+		}
+
+		logEvent(mess.Session, clientHint, serverHint, score)
 	}
 
 	// get the DNS layer
-	dnsLayer := mess.Packet.Layer(layers.LayerTypeDNS)
+	dnsLayer := mess.GetPacket().Layer(layers.LayerTypeDNS)
 	if dnsLayer == nil {
 		return result
 	}
@@ -103,6 +159,9 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		// use the first question record
 		query := dns.Questions[0]
 
+		// look for new and generated domains in every type of query
+		detectDomain(mess, ctid, string(query.Name))
+
 		// ignore requests for other than A and AAAA records
 		if (query.Type != layers.DNSTypeA) && (query.Type != layers.DNSTypeAAAA) {
 			return result
@@ -195,8 +254,22 @@ func cleanAddressTable() {
 	logger.Debug("DNS REMOVED:%d REMAINING:%d\n", counter, len(addressTable))
 }
 
-// periodic task to clean the address table
+// shedAddressTable empties the address table when memory is running low
+func shedAddressTable(level int) {
+	if level < dispatch.ShedCaches {
+		return
+	}
+
+	addressMutex.Lock()
+	logger.Notice("Shedding %d addresses from the DNS cache\n", len(addressTable))
+	addressTable = make(map[string]*AddressHolder)
+	addressMutex.Unlock()
+}
+
+// periodic task to clean the address table and save the seen domains
 func cleanupTask() {
+	lastSave := time.Now()
+
 	for {
 		select {
 		case <-shutdownChannel:
@@ -204,13 +277,83 @@ func cleanupTask() {
 			return
 		case <-time.After(60 * time.Second):
 			cleanAddressTable()
+			if time.Since(lastSave) >= domainSaveInterval {
+				saveDomains()
+				lastSave = time.Now()
+			}
 		}
 	}
 }
 
+// detectDomain checks the registered domain of a query to see if it was ever
+// queried on the network before, and scores how likely it was made by a
+// domain generation algorithm. Both results are attached to the session and
+// logged to the dns_events table.
+func detectDomain(mess dispatch.NfqueueMessage, ctid uint32, name string) {
+	config := getDetection()
+	if !config.newDomains && !config.dga {
+		return
+	}
+
+	domain := getBaseDomain(name)
+	if domain == "" {
+		return
+	}
+
+	now := time.Now()
+	score := getDGAScore(domain)
+
+	if config.newDomains && checkNewDomain(domain, now) {
+		logger.Debug("DNS NEW DOMAIN:%s NAME:%s ctid:%d\n", domain, name, ctid)
+		overseer.AddCounter("dns_new_domain", 1)
+		mess.Session.PutAttachment("dns_new_domain", domain)
+		dict.AddSessionEntry(ctid, "dns_new_domain", true)
+		logDetectEvent(mess.Session, "new_domain", name, domain, score)
+	}
+
+	if !config.dga {
+		return
+	}
+
+	mess.Session.PutAttachment("dns_dga_score", score)
+	dict.AddSessionEntry(ctid, "dns_dga_score", int32(score*100))
+
+	if score < config.dgaThreshold {
+		return
+	}
+
+	logger.Debug("DNS DGA DOMAIN:%s SCORE:%.2f ctid:%d\n", domain, score, ctid)
+	overseer.AddCounter("dns_dga_domain", 1)
+	logDetectEvent(mess.Session, "dga", name, domain, score)
+
+	client := mess.Session.GetClientSideTuple().ClientAddress
+	eventbus.PublishAlert(pluginName, "Possible generated domain "+domain+" queried by "+client.String(), map[string]interface{}{
+		"domain": domain,
+		"query":  name,
+		"client": client.String(),
+		"score":  score,
+	})
+}
+
+// logDetectEvent logs a new domain or a generated domain to the dns_events table
+func logDetectEvent(session *dispatch.Session, event string, name string, domain string, score float64) {
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"session_id":     session.GetSessionID(),
+		"client_address": session.GetClientSideTuple().ClientAddress,
+		"event":          event,
+		"query_name":     name,
+		"domain":         domain,
+		"dga_score":      score,
+	}
+
+	reports.LogEvent(reports.CreateEvent("dns_"+event, "dns_events", 1, columns, nil))
+}
+
 // logEvent logs an update event that updates the *_dns_hint columns
-// provide the session, and the client and server hints
-func logEvent(session *dispatch.Session, clientHint string, serverHint string) {
+// provide the session, the client and server hints, and the DGA score of
+// the server hint or a negative score when there isn't one
+func logEvent(session *dispatch.Session, clientHint string, serverHint string, score float64) {
 	columns := map[string]interface{}{
 		"session_id": session.GetSessionID(),
 	}
@@ -225,6 +368,9 @@ func logEvent(session *dispatch.Session, clientHint string, serverHint string) {
 		modifiedColumns["server_dns_hint"] = serverHint
 		total++
 	}
+	if score >= 0 {
+		modifiedColumns["server_dga_score"] = score
+	}
 
 	if total == 0 {
 		return
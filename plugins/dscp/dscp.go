@@ -0,0 +1,392 @@
+// Package dscp provides the "dscp" plugin
+// The dscp plugin sets the DSCP value of the packets of a session so upstream
+// equipment can honor the priority packetd gives it. The value comes from a
+// rule that tags the session with a dscp field, or from the application or
+// category the session is classified as. The value is written to the dscp
+// field of the session dictionary and the plugin maintains an nftables table
+// with a postrouting rule for each value in use that rewrites the DSCP of
+// every packet of the sessions with that value, in both directions and for
+// the whole session after packetd has released it.
+package dscp
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const pluginName = "dscp"
+
+// the nftables table that holds the DSCP rewrite rules
+const tableName = "packetd-dscp"
+
+// the session field with the DSCP value. Rules set it with a tag action.
+const dscpField = "dscp"
+
+// the session attachment set once the DSCP of a session has been decided
+const doneAttachment = "dscp_done"
+
+// the number of packets to inspect while waiting for the classification
+const defaultMaxPackets = 10
+
+// the DSCP names that can be used in place of the numbers
+var dscpNames = map[string]int{
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14, "af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30, "af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "va": 44, "be": 0, "le": 1,
+}
+
+// Status holds the DSCP configuration and the number of sessions marked with each value
+type Status struct {
+	Enabled      bool           `json:"enabled"`
+	Applications map[string]int `json:"applications"`
+	Categories   map[string]int `json:"categories"`
+	Values       []int          `json:"values"`
+	Sessions     map[int]uint64 `json:"sessions"`
+	Error        string         `json:"error,omitempty"`
+}
+
+// dscpConfig holds the DSCP settings. The applications match the application
+// id or name and everything is compared without case.
+type dscpConfig struct {
+	enabled      bool
+	applications map[string]int
+	categories   map[string]int
+	maxPackets   uint64
+}
+
+var currentConfig = newDSCPConfig()
+var configLocker sync.RWMutex
+
+// the values that have a rewrite rule and the number of sessions marked with each
+var activeValues = make(map[int]bool)
+var sessionCounts = make(map[int]uint64)
+var tableActive bool
+var lastError string
+var tableLocker sync.Mutex
+
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.DSCPPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	loadConfig()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	tableLocker.Lock()
+	defer tableLocker.Unlock()
+	removeTable()
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadConfig()
+	}
+}
+
+// PluginNfqueueHandler is called to handle nfqueue packet data. A value set by
+// a rule is used first, otherwise we look at packets until the session is
+// classified as an application or category with a value or we reach the
+// packet limit.
+func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	session := mess.Session
+	if session == nil || session.GetAttachment(doneAttachment) != nil {
+		return result
+	}
+
+	configLocker.RLock()
+	config := currentConfig
+	configLocker.RUnlock()
+
+	if !config.enabled {
+		return result
+	}
+
+	// a rule tag can use a name so we always write the number back
+	if tagged, ok := session.GetAttachment(dscpField).(string); ok && tagged != "" {
+		value, err := parseValue(tagged)
+		if err != nil {
+			logger.Warn("%OC|Invalid DSCP value %s ctid:%d\n", "dscp_invalid_value", 10, tagged, ctid)
+			session.PutAttachment(doneAttachment, true)
+			return result
+		}
+		markSession(session, ctid, value)
+		return result
+	}
+
+	appid, _ := session.GetAttachment("application_id").(string)
+	name, _ := session.GetAttachment("application_name").(string)
+	category, _ := session.GetAttachment("application_category").(string)
+
+	if value, found := config.find(appid, name, category); found {
+		markSession(session, ctid, value)
+		return result
+	}
+
+	if session.GetPacketCount() >= config.maxPackets {
+		session.PutAttachment(doneAttachment, true)
+		return result
+	}
+
+	result.SessionRelease = false
+	return result
+}
+
+// GetStatus returns the DSCP configuration and the number of sessions marked with each value
+func GetStatus() Status {
+	configLocker.RLock()
+	config := currentConfig
+	configLocker.RUnlock()
+
+	status := Status{
+		Enabled:      config.enabled,
+		Applications: make(map[string]int),
+		Categories:   make(map[string]int),
+		Values:       []int{},
+		Sessions:     make(map[int]uint64),
+	}
+	for name, value := range config.applications {
+		status.Applications[name] = value
+	}
+	for name, value := range config.categories {
+		status.Categories[name] = value
+	}
+
+	tableLocker.Lock()
+	defer tableLocker.Unlock()
+
+	for value := range activeValues {
+		status.Values = append(status.Values, value)
+	}
+	sort.Ints(status.Values)
+	for value, count := range sessionCounts {
+		status.Sessions[value] = count
+	}
+	status.Error = lastError
+	return status
+}
+
+// markSession writes the DSCP value of a session to the session dictionary and
+// adds a rewrite rule for the value if it doesn't have one yet
+func markSession(session *dispatch.Session, ctid uint32, value int) {
+	text := strconv.Itoa(value)
+	session.PutAttachment(doneAttachment, true)
+	session.PutAttachment(dscpField, text)
+	dict.AddSessionEntry(ctid, dscpField, text)
+	overseer.AddCounter("dscp_session_mark", 1)
+	logger.Debug("Setting DSCP %d ctid:%d\n", value, ctid)
+
+	tableLocker.Lock()
+	defer tableLocker.Unlock()
+
+	sessionCounts[value]++
+	if activeValues[value] {
+		return
+	}
+	activeValues[value] = true
+	syncTable()
+}
+
+// find returns the DSCP value for an application or category
+func (config *dscpConfig) find(appid string, name string, category string) (int, bool) {
+	if appid != "" {
+		if value, found := config.applications[strings.ToLower(appid)]; found {
+			return value, true
+		}
+	}
+	if name != "" {
+		if value, found := config.applications[strings.ToLower(name)]; found {
+			return value, true
+		}
+	}
+	if category != "" {
+		if value, found := config.categories[strings.ToLower(category)]; found {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// loadConfig loads the DSCP settings and rebuilds the rewrite rules for the
+// configured values along with any values that are already in use
+func loadConfig() {
+	fresh := newDSCPConfig()
+
+	configJSON, err := settings.GetCurrentSettings([]string{"plugins", "dscp"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			fresh.enabled, _ = item["enabled"].(bool)
+			fresh.applications = parseTable(item["applications"])
+			fresh.categories = parseTable(item["categories"])
+			if value, ok := item["maxPackets"].(float64); ok && value > 0 {
+				fresh.maxPackets = uint64(value)
+			}
+		} else {
+			logger.Warn("Invalid dscp settings: %T\n", configJSON)
+		}
+	}
+
+	configLocker.Lock()
+	currentConfig = fresh
+	configLocker.Unlock()
+
+	tableLocker.Lock()
+	defer tableLocker.Unlock()
+
+	if !fresh.enabled {
+		activeValues = make(map[int]bool)
+		removeTable()
+		logger.Info("DSCP marking is disabled\n")
+		return
+	}
+
+	for _, value := range fresh.applications {
+		activeValues[value] = true
+	}
+	for _, value := range fresh.categories {
+		activeValues[value] = true
+	}
+	syncTable()
+
+	logger.Info("Loaded dscp settings applications:%d categories:%d\n", len(fresh.applications), len(fresh.categories))
+}
+
+// syncTable replaces the DSCP table with one that has a rewrite rule for each
+// active value. The old table is deleted and the new one created by a single
+// nft command so the change is atomic. The caller must hold the tableLocker.
+func syncTable() {
+	var values []int
+	for value := range activeValues {
+		values = append(values, value)
+	}
+	sort.Ints(values)
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "add table inet %s\n", tableName)
+	fmt.Fprintf(&script, "delete table inet %s\n", tableName)
+	fmt.Fprintf(&script, "table inet %s {\n", tableName)
+	fmt.Fprintf(&script, "\tchain postrouting {\n\t\ttype filter hook postrouting priority 0; policy accept;\n")
+	for _, value := range values {
+		fmt.Fprintf(&script, "\t\tdict sessions ct id %s long_string %d ip dscp set %d\n", dscpField, value, value)
+		fmt.Fprintf(&script, "\t\tdict sessions ct id %s long_string %d ip6 dscp set %d\n", dscpField, value, value)
+	}
+	fmt.Fprintf(&script, "\t}\n}\n")
+
+	command := exec.Command("nft", "-f", "-")
+	command.Stdin = &script
+	output, err := command.CombinedOutput()
+	if err != nil {
+		lastError = strings.TrimSpace(string(output))
+		if lastError == "" {
+			lastError = err.Error()
+		}
+		logger.Warn("%OC|Failed to update the DSCP rules: %s\n", "dscp_sync_failure", 10, lastError)
+		return
+	}
+
+	tableActive = true
+	lastError = ""
+	logger.Info("Updated the DSCP rules for values %v\n", values)
+}
+
+// removeTable removes the DSCP table if we created it. The caller must hold the tableLocker.
+func removeTable() {
+	if !tableActive {
+		return
+	}
+
+	output, err := exec.Command("nft", "delete", "table", "inet", tableName).CombinedOutput()
+	if err != nil {
+		logger.Warn("Failed to remove the DSCP table: %s\n", strings.TrimSpace(string(output)))
+		return
+	}
+
+	tableActive = false
+	logger.Info("Removed the DSCP table\n")
+}
+
+// parseTable parses an object of names and DSCP values from the settings
+func parseTable(value interface{}) map[string]int {
+	table := make(map[string]int)
+
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return table
+	}
+
+	for name, entry := range item {
+		var dscp int
+		var err error
+		switch entry.(type) {
+		case float64:
+			dscp, err = parseValue(strconv.Itoa(int(entry.(float64))))
+		case string:
+			dscp, err = parseValue(entry.(string))
+		default:
+			err = fmt.Errorf("invalid DSCP value %v", entry)
+		}
+		if err != nil || name == "" {
+			logger.Warn("Invalid dscp entry %s: %v\n", name, entry)
+			continue
+		}
+		table[strings.ToLower(name)] = dscp
+	}
+
+	return table
+}
+
+// parseValue parses a DSCP number or name
+func parseValue(text string) (int, error) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	if value, found := dscpNames[text]; found {
+		return value, nil
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil || value < 0 || value > 63 {
+		return 0, fmt.Errorf("invalid DSCP value %s", text)
+	}
+	return value, nil
+}
+
+// newDSCPConfig returns an empty DSCP configuration
+func newDSCPConfig() *dscpConfig {
+	return &dscpConfig{
+		applications: make(map[string]int),
+		categories:   make(map[string]int),
+		maxPackets:   defaultMaxPackets,
+	}
+}
@@ -1,46 +1,202 @@
+// Package example provides the "example" plugin
+// Beyond showing how a plugin hooks into the nfqueue, conntrack, and netlogger
+// dispatch, the example plugin doubles as a test harness for QA. It can be
+// configured from the settings or the API to add artificial latency, return
+// random verdicts, and match payload patterns, and it keeps counters that can
+// be read and reset through the API to verify the dispatch pipeline.
 package example
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/patterns"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/settings"
 )
 
 const pluginName = "example"
 
-// PluginStartup function is called to allow plugin specific initialization. We
-// increment the argumented WaitGroup so the main process can wait for
-// our shutdown function to return during shutdown.
+// the session attachment that holds the payload strings found by the pattern matcher
+const stringsAttachment = "example_strings"
+
+// HarnessConfig holds the test harness configuration. The zero value leaves
+// traffic alone so the plugin behaves like a plain example by default.
+type HarnessConfig struct {
+	LatencyMs       int      `json:"latencyMs"`
+	LatencyJitterMs int      `json:"latencyJitterMs"`
+	DropPercent     float64  `json:"dropPercent"`
+	HoldPercent     float64  `json:"holdPercent"`
+	MaxHoldPackets  uint64   `json:"maxHoldPackets"`
+	PayloadPatterns []string `json:"payloadPatterns"`
+	PayloadStrings  []string `json:"payloadStrings"`
+	PatternAction   string   `json:"patternAction"`
+	DumpPackets     bool     `json:"dumpPackets"`
+}
+
+// HarnessCounters holds the test harness counters
+type HarnessCounters struct {
+	Packets        uint64            `json:"packets"`
+	Bytes          uint64            `json:"bytes"`
+	Sessions       uint64            `json:"sessions"`
+	Released       uint64            `json:"released"`
+	Held           uint64            `json:"held"`
+	Dropped        uint64            `json:"dropped"`
+	Delayed        uint64            `json:"delayed"`
+	DelayMs        uint64            `json:"delayMs"`
+	PatternMatches map[string]uint64 `json:"patternMatches"`
+	Conntrack      map[string]uint64 `json:"conntrack"`
+	Netlogger      uint64            `json:"netlogger"`
+}
+
+// HarnessStatus is returned by the API with the current config and counters
+type HarnessStatus struct {
+	Config   HarnessConfig   `json:"config"`
+	Counters HarnessCounters `json:"counters"`
+	Since    time.Time       `json:"since"`
+}
+
+var harnessConfig HarnessConfig
+var harnessPatterns []*regexp.Regexp
+var harnessCounters HarnessCounters
+var harnessSince time.Time
+var harnessMutex sync.Mutex
+
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.ExamplePriority, NfqueueFunc: PluginNfqueueHandler},
+			{Priority: 2, ConntrackFunc: PluginConntrackHandler},
+			{Priority: 2, NetloggerFunc: PluginNetloggerHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ExamplePriority, PluginNfqueueHandler)
-	dispatch.InsertConntrackSubscription(pluginName, 2, PluginConntrackHandler)
-	dispatch.InsertNetloggerSubscription(pluginName, 2, PluginNetloggerHandler)
+	ResetHarnessCounters()
+	loadHarnessConfig()
 }
 
-// PluginShutdown function called when the daemon is shutting down. We call Done
-// for the argumented WaitGroup to let the main process know we're finished.
+// PluginShutdown function called when the daemon is shutting down.
 func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+	patterns.Unregister(pluginName)
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadHarnessConfig()
+	}
 }
 
 // PluginNfqueueHandler receives a NfqueueMessage which includes a Tuple and
-// a gopacket.Packet, along with the IP and TCP or UDP layer already extracted.
-// We do whatever we like with the data, and when finished, we return an
-// integer via the argumented channel with any bits set that we want added to
-// the packet mark.
+// the raw packet data, along with the IP and TCP or UDP layer already extracted.
+// We apply the test harness config to decide the verdict and whether we want
+// to keep seeing packets for the session, and add everything to the counters.
 func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
-	// our example simply dumps the raw message to the console
-	if mess.IP4Layer != nil {
-		logger.Debug("NfqueueHandler received %d BYTES from %s to %s\n%s\n", mess.Length, mess.IP4Layer.SrcIP, mess.IP4Layer.DstIP, hex.Dump(mess.Packet.Data()))
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	harnessMutex.Lock()
+	config := harnessConfig
+	expressions := harnessPatterns
+	harnessMutex.Unlock()
+
+	if config.DumpPackets {
+		if mess.IP4Layer != nil {
+			logger.Debug("NfqueueHandler received %d BYTES from %s to %s\n%s\n", mess.Length, mess.IP4Layer.SrcIP, mess.IP4Layer.DstIP, hex.Dump(mess.Data))
+		}
+		if mess.IP6Layer != nil {
+			logger.Debug("NfqueueHandler received %d BYTES from %s to %s\n%s\n", mess.Length, mess.IP6Layer.SrcIP, mess.IP6Layer.DstIP, hex.Dump(mess.Data))
+		}
 	}
-	if mess.IP6Layer != nil {
-		logger.Debug("NfqueueHandler received %d BYTES from %s to %s\n%s\n", mess.Length, mess.IP6Layer.SrcIP, mess.IP6Layer.DstIP, hex.Dump(mess.Packet.Data()))
+
+	var delay time.Duration
+	if config.LatencyMs > 0 || config.LatencyJitterMs > 0 {
+		delay = time.Duration(config.LatencyMs) * time.Millisecond
+		if config.LatencyJitterMs > 0 {
+			delay += time.Duration(rand.Intn(config.LatencyJitterMs+1)) * time.Millisecond
+		}
+		time.Sleep(delay)
 	}
 
-	var result dispatch.NfqueueResult
-	result.SessionRelease = true
+	var matched []string
+	for _, pattern := range expressions {
+		if pattern.Match(mess.Payload) {
+			matched = append(matched, pattern.String())
+		}
+	}
+
+	// the payload strings are found by the pattern matcher before we see the packet
+	if mess.Session != nil {
+		if found, ok := mess.Session.GetAttachment(stringsAttachment).([]string); ok {
+			mess.Session.DeleteAttachment(stringsAttachment)
+			matched = append(matched, found...)
+		}
+	}
+
+	if config.DropPercent > 0 && rand.Float64()*100 < config.DropPercent {
+		result.PacketDrop = true
+	}
+
+	if config.HoldPercent > 0 && rand.Float64()*100 < config.HoldPercent {
+		result.SessionRelease = false
+	}
+
+	if len(matched) != 0 {
+		switch config.PatternAction {
+		case "drop":
+			result.PacketDrop = true
+		case "hold":
+			result.SessionRelease = false
+		case "release":
+			result.SessionRelease = true
+		}
+	}
+
+	// never hold a session forever so a bad config can't pin every session in the table
+	if !result.SessionRelease && mess.Session != nil && config.MaxHoldPackets > 0 && mess.Session.GetPacketCount() >= config.MaxHoldPackets {
+		result.SessionRelease = true
+	}
+
+	harnessMutex.Lock()
+	harnessCounters.Packets++
+	harnessCounters.Bytes += uint64(mess.Length)
+	if newSession {
+		harnessCounters.Sessions++
+	}
+	if delay > 0 {
+		harnessCounters.Delayed++
+		harnessCounters.DelayMs += uint64(delay / time.Millisecond)
+	}
+	for _, name := range matched {
+		harnessCounters.PatternMatches[name]++
+	}
+	if result.PacketDrop {
+		harnessCounters.Dropped++
+	}
+	if result.SessionRelease {
+		harnessCounters.Released++
+	} else {
+		harnessCounters.Held++
+	}
+	harnessMutex.Unlock()
 
 	return result
 }
@@ -49,6 +205,10 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 // of three possible values: N, U, or D for new entry, an update to an existing
 // entry, or delete of an existing entry.
 func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
+	harnessMutex.Lock()
+	harnessCounters.Conntrack[string(rune(message))]++
+	harnessMutex.Unlock()
+
 	entry.Guardian.RLock()
 	defer entry.Guardian.RUnlock()
 	logger.Debug("ConntrackHandler MSG:%c ID:%d PROTO:%d SADDR:%s SPORT:%d DADDR:%s DPORT:%d TX:%d RX:%d UC:%d\n",
@@ -66,6 +226,10 @@ func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
 
 // PluginNetloggerHandler receives NFLOG dispatch.
 func PluginNetloggerHandler(netlogger *dispatch.NetloggerMessage) {
+	harnessMutex.Lock()
+	harnessCounters.Netlogger++
+	harnessMutex.Unlock()
+
 	logger.Debug("NetloggerHandler PROTO:%d ICMP:%d SIF:%d DIF:%d SADR:%s DADR:%s SPORT:%d DPORT:%d MARK:%X PREFIX:%s\n",
 		netlogger.Protocol,
 		netlogger.IcmpType,
@@ -78,3 +242,103 @@ func PluginNetloggerHandler(netlogger *dispatch.NetloggerMessage) {
 		netlogger.Mark,
 		netlogger.Prefix)
 }
+
+// GetHarnessStatus returns the current test harness config and counters
+func GetHarnessStatus() HarnessStatus {
+	harnessMutex.Lock()
+	defer harnessMutex.Unlock()
+
+	status := HarnessStatus{Config: harnessConfig, Counters: harnessCounters, Since: harnessSince}
+	status.Counters.PatternMatches = make(map[string]uint64)
+	for key, value := range harnessCounters.PatternMatches {
+		status.Counters.PatternMatches[key] = value
+	}
+	status.Counters.Conntrack = make(map[string]uint64)
+	for key, value := range harnessCounters.Conntrack {
+		status.Counters.Conntrack[key] = value
+	}
+	return status
+}
+
+// PluginPatternHandler is called by the pattern matcher with the payload
+// strings found in a packet. They are attached to the session for the nfqueue
+// handler, which sees the same packet after the matcher is finished with it.
+func PluginPatternHandler(mess dispatch.NfqueueMessage, ctid uint32, matches []patterns.Match) {
+	if mess.Session == nil {
+		return
+	}
+
+	var found []string
+	for _, match := range matches {
+		found = append(found, match.Name)
+	}
+	mess.Session.PutAttachment(stringsAttachment, found)
+}
+
+// SetHarnessConfig validates and applies a new test harness config
+func SetHarnessConfig(config HarnessConfig) error {
+	var expressions []*regexp.Regexp
+
+	for _, item := range config.PayloadPatterns {
+		pattern, err := regexp.Compile(item)
+		if err != nil {
+			return err
+		}
+		expressions = append(expressions, pattern)
+	}
+
+	if len(config.PayloadStrings) == 0 {
+		patterns.Unregister(pluginName)
+	} else {
+		var list []patterns.Pattern
+		for _, item := range config.PayloadStrings {
+			list = append(list, patterns.Pattern{Name: item, Data: []byte(item)})
+		}
+		if err := patterns.Register(pluginName, list, PluginPatternHandler); err != nil {
+			return err
+		}
+	}
+
+	harnessMutex.Lock()
+	harnessConfig = config
+	harnessPatterns = expressions
+	harnessMutex.Unlock()
+
+	logger.Info("Test harness config: %+v\n", config)
+	return nil
+}
+
+// ResetHarnessCounters clears all of the test harness counters
+func ResetHarnessCounters() {
+	harnessMutex.Lock()
+	harnessCounters = HarnessCounters{PatternMatches: make(map[string]uint64), Conntrack: make(map[string]uint64)}
+	harnessSince = time.Now()
+	harnessMutex.Unlock()
+}
+
+// loadHarnessConfig loads the test harness config from the settings
+func loadHarnessConfig() {
+	var config HarnessConfig
+
+	configJSON, err := settings.GetCurrentSettings([]string{"plugins", "example"})
+	if configJSON == nil || err != nil {
+		logger.Debug("No test harness config found in settings\n")
+		SetHarnessConfig(config)
+		return
+	}
+
+	// round trip through json to get the typed config
+	data, err := json.Marshal(configJSON)
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		logger.Warn("Invalid test harness settings: %v\n", err)
+		return
+	}
+
+	err = SetHarnessConfig(config)
+	if err != nil {
+		logger.Warn("Invalid test harness settings: %v\n", err)
+	}
+}
@@ -13,15 +13,29 @@ import (
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
 	"github.com/untangle/packetd/services/reports"
 )
 
 const pluginName = "geoip"
 
 var geoDatabase *geoip2.Reader
+var asnDatabase *geoip2.Reader
 var geoMutex sync.Mutex
 var privateIPBlocks []*net.IPNet
 
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.GeoipPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
 // PluginStartup is called to allow plugin specific initialization.
 // We initialize an instance of the GeoIP engine using any existing
 // database we can find, or we download if needed. We increment the
@@ -43,6 +57,17 @@ func PluginStartup() {
 		geoDatabase = db
 	}
 
+	// the ASN database is optional and is never downloaded
+	if filename := findASNFile(); filename != "" {
+		db, err = geoip2.Open(filename)
+		if err != nil {
+			logger.Warn("Unable to load ASN Database: %s\n", err)
+		} else {
+			logger.Info("Loading ASN Database: %s\n", filename)
+			asnDatabase = db
+		}
+	}
+
 	for _, cidr := range []string{
 		"127.0.0.0/8",    // IPv4 loopback
 		"10.0.0.0/8",     // RFC1918
@@ -55,7 +80,6 @@ func PluginStartup() {
 		_, block, _ := net.ParseCIDR(cidr)
 		privateIPBlocks = append(privateIPBlocks, block)
 	}
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.GeoipPriority, PluginNfqueueHandler)
 }
 
 // PluginShutdown is called when the daemon is shutting down. We close our
@@ -70,11 +94,18 @@ func PluginShutdown() {
 		geoDatabase.Close()
 		geoDatabase = nil
 	}
+
+	if asnDatabase != nil {
+		asnDatabase.Close()
+		asnDatabase = nil
+	}
 }
 
 // PluginNfqueueHandler is called to handle nfqueue packet data. We extract
 // the source and destination IP address from the packet, lookup the GeoIP
-// country code for each, and store them in the conntrack dictionary.
+// country code for each, and store them in the conntrack dictionary. When an
+// ASN database is installed the autonomous system numbers are also attached
+// to the session.
 func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
 	var result dispatch.NfqueueResult
 
@@ -136,16 +167,64 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	logger.Debug("SRC: %v = %s ctid:%d\n", srcAddr, clientCountry, ctid)
 	logger.Debug("DST: %v = %s ctid:%d\n", dstAddr, serverCountry, ctid)
 
-	dict.AddSessionEntry(ctid, "client_country", clientCountry)
-	dict.AddSessionEntry(ctid, "server_country", serverCountry)
+	dict.AddSessionEntries(ctid, map[string]interface{}{"client_country": clientCountry, "server_country": serverCountry})
 	mess.Session.PutAttachment("client_country", clientCountry)
 	mess.Session.PutAttachment("server_country", serverCountry)
 
+	// the autonomous system numbers are zero for local and unknown addresses
+	if asnDatabase != nil {
+		mess.Session.PutAttachment("client_asn", lookupASN(srcAddr))
+		mess.Session.PutAttachment("server_asn", lookupASN(dstAddr))
+	}
+
 	logEvent(mess.Session, clientCountry, serverCountry)
 
 	return result
 }
 
+// LookupCountry returns the country code for an address. Private addresses
+// return XL and addresses that aren't in the database return XU.
+func LookupCountry(addr net.IP) string {
+	if addr == nil {
+		return "XU"
+	}
+
+	geoMutex.Lock()
+	defer geoMutex.Unlock()
+
+	if isPrivateIP(addr) {
+		return "XL"
+	}
+	if geoDatabase != nil {
+		record, err := geoDatabase.City(addr)
+		if (err == nil) && (len(record.Country.IsoCode) != 0) {
+			return record.Country.IsoCode
+		}
+	}
+	return "XU"
+}
+
+// LookupASN returns the autonomous system number for an address, or zero
+// for private addresses, addresses that aren't in the database, or when there
+// is no ASN database
+func LookupASN(addr net.IP) uint {
+	geoMutex.Lock()
+	defer geoMutex.Unlock()
+	return lookupASN(addr)
+}
+
+// lookupASN must be called with the geoMutex locked
+func lookupASN(addr net.IP) uint {
+	if asnDatabase == nil || addr == nil || isPrivateIP(addr) {
+		return 0
+	}
+	record, err := asnDatabase.ASN(addr)
+	if err != nil {
+		return 0
+	}
+	return record.AutonomousSystemNumber
+}
+
 func isPrivateIP(ip net.IP) bool {
 	for _, block := range privateIPBlocks {
 		if block.Contains(ip) {
@@ -231,6 +310,25 @@ func findGeoFile(download bool) string {
 	return "/tmp/GeoLite2-City.mmdb"
 }
 
+// findASNFile returns the location of the GeoLite2-ASN.mmdb file or an
+// empty string if it isn't installed
+func findASNFile() string {
+	possibleLocations := []string{
+		"/var/cache/untangle-geoip/GeoLite2-ASN.mmdb",
+		"/tmp/GeoLite2-ASN.mmdb",
+		"/usr/lib/GeoLite2-ASN.mmdb",
+		"/usr/share/untangle-geoip/GeoLite2-ASN.mmdb",
+		"/usr/share/geoip/GeoLite2-ASN.mmdb",
+	}
+
+	for _, filename := range possibleLocations {
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+	}
+	return ""
+}
+
 // logEvent logs an update event that updates the *_country columns
 // provide the session, and the client and server country
 func logEvent(session *dispatch.Session, clientCountry string, serverCountry string) {
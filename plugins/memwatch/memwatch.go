@@ -0,0 +1,233 @@
+// Package memwatch provides the "memwatch" plugin
+// The memwatch plugin tracks the resident memory of the process against a
+// ceiling and raises the dispatch shedding level as it gets close, so caches
+// are emptied, idle sessions are dropped sooner, and sessions are bypassed
+// earlier before we run out of memory and get killed.
+package memwatch
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/c9s/goprocinfo/linux"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const pluginName = "memwatch"
+
+// the default ceiling is this percentage of the total memory
+const defaultCeilingPercent = 50
+
+// the default number of seconds between memory checks
+const defaultIntervalSeconds = 5
+
+// the percentage of the ceiling where each shedding level starts
+var shedThresholds = []uint64{0, 70, 85, 95}
+
+// the percentage of the ceiling we must drop below a threshold before lowering the level
+const shedHysteresis = 5
+
+var ceilingBytes uint64
+var intervalSeconds int
+var rssBytes uint64
+var configMutex sync.Mutex
+var shutdownChannel = make(chan bool)
+
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		HealthFunc:   PluginHealth,
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	loadConfig()
+	go watchTask()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of watchTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown watchTask\n")
+	}
+
+	dispatch.SetShedLevel(dispatch.ShedNone)
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadConfig()
+	}
+}
+
+// PluginHealth returns an error describing the shedding state when we are shedding load
+func PluginHealth() error {
+	level := dispatch.GetShedLevel()
+	if level == dispatch.ShedNone {
+		return nil
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return fmt.Errorf("Shedding %s with RSS %d MB of %d MB ceiling", dispatch.GetShedLevelName(level), rssBytes/(1024*1024), ceilingBytes/(1024*1024))
+}
+
+// loadConfig loads the ceiling and check interval from the settings
+func loadConfig() {
+	var ceilingMB uint64
+	interval := defaultIntervalSeconds
+
+	memwatchJSON, err := settings.GetCurrentSettings([]string{"system", "memwatch"})
+	if memwatchJSON != nil && err == nil {
+		item, ok := memwatchJSON.(map[string]interface{})
+		if ok {
+			if value, ok := item["ceilingMB"].(float64); ok && value > 0 {
+				ceilingMB = uint64(value)
+			}
+			if value, ok := item["intervalSeconds"].(float64); ok && value > 0 {
+				interval = int(value)
+			}
+		} else {
+			logger.Warn("Invalid memwatch settings: %T\n", memwatchJSON)
+		}
+	}
+
+	ceiling := ceilingMB * 1024 * 1024
+	if ceiling == 0 {
+		meminfo, err := linux.ReadMemInfo("/proc/meminfo")
+		if err != nil {
+			logger.Warn("Error reading meminfo: %s\n", err.Error())
+		} else {
+			ceiling = meminfo.MemTotal * 1024 * defaultCeilingPercent / 100
+		}
+	}
+
+	configMutex.Lock()
+	ceilingBytes = ceiling
+	intervalSeconds = interval
+	configMutex.Unlock()
+
+	logger.Info("Memory watch ceiling:%d MB interval:%d seconds\n", ceiling/(1024*1024), interval)
+}
+
+// watchTask periodically checks the memory usage
+func watchTask() {
+	for {
+		configMutex.Lock()
+		interval := intervalSeconds
+		configMutex.Unlock()
+
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+			checkMemory()
+		}
+	}
+}
+
+// checkMemory compares the RSS to the ceiling and sets the shedding level
+func checkMemory() {
+	rss, err := readRSS()
+	if err != nil {
+		logger.Warn("%OC|Unable to read RSS: %s\n", "memwatch_rss_failure", 100, err.Error())
+		return
+	}
+
+	configMutex.Lock()
+	rssBytes = rss
+	ceiling := ceilingBytes
+	configMutex.Unlock()
+
+	if ceiling == 0 {
+		return
+	}
+
+	current := dispatch.GetShedLevel()
+	level := getShedLevel(rss*100/ceiling, current)
+	if level == current {
+		return
+	}
+
+	if level > current {
+		logger.Warn("RSS %d MB is %d%% of the %d MB ceiling. Raising shedding level to %s\n", rss/(1024*1024), rss*100/ceiling, ceiling/(1024*1024), dispatch.GetShedLevelName(level))
+		overseer.AddCounter("memwatch_shed_raised", 1)
+	} else {
+		logger.Notice("RSS %d MB is %d%% of the %d MB ceiling. Lowering shedding level to %s\n", rss/(1024*1024), rss*100/ceiling, ceiling/(1024*1024), dispatch.GetShedLevelName(level))
+		overseer.AddCounter("memwatch_shed_lowered", 1)
+	}
+
+	dispatch.SetShedLevel(level)
+}
+
+// getShedLevel returns the shedding level for the percentage of the ceiling
+// in use. We go up as soon as we cross a threshold but only come down once we
+// are clearly below it so we don't flap between levels.
+func getShedLevel(percent uint64, current int) int {
+	level := dispatch.ShedNone
+	for i := range shedThresholds {
+		if percent >= shedThresholds[i] {
+			level = i
+		}
+	}
+
+	if level >= current {
+		return level
+	}
+
+	for current > level && percent+shedHysteresis < shedThresholds[current] {
+		current--
+	}
+
+	return current
+}
+
+// readRSS returns the resident memory of the process in bytes
+func readRSS() (uint64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "VmRSS:" {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return value * 1024, nil
+	}
+
+	return 0, fmt.Errorf("VmRSS not found")
+}
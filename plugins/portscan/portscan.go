@@ -0,0 +1,179 @@
+// Package portscan provides the "portscan" plugin
+// The portscan plugin watches the new sessions from each source address and
+// looks for scans. A vertical scan is a source trying many distinct ports on
+// one host, and a horizontal scan is a source trying the same port on many
+// distinct hosts. A scan is logged with a summary of the ports and hosts
+// that were tried, and the source can be blocked for a cooldown period.
+package portscan
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/reports"
+)
+
+const pluginName = "portscan"
+
+// the session attachment set when a session from a blocked scanner is dropped
+const blockedAttachment = "portscan_blocked"
+
+var shutdownChannel = make(chan bool)
+
+// init registers the plugin with the plugin registry and the port scan events table with
+// the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "portscan_events",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "source_address", Type: "text"},
+			{Name: "kind", Type: "text"},
+			{Name: "ip_protocol", Type: "int2"},
+			{Name: "hosts", Type: "int4"},
+			{Name: "ports", Type: "int4"},
+			{Name: "window_seconds", Type: "int4"},
+			{Name: "evidence", Type: "text"},
+			{Name: "blocked", Type: "boolean"},
+		},
+		TrimPercent: .1,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.PortScanPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	loadConfig()
+	go cleanupTask()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of cleanupTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown cleanupTask\n")
+	}
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadConfig()
+	}
+}
+
+// PluginNfqueueHandler is called to handle nfqueue packet data. We only need
+// the first packet of each session to record the host and port the source
+// tried, but sessions from a blocked scanner have every packet dropped.
+func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	session := mess.Session
+	if session == nil {
+		return result
+	}
+
+	if session.GetAttachment(blockedAttachment) != nil {
+		result.SessionRelease = false
+		result.PacketDrop = true
+		return result
+	}
+
+	if !newSession {
+		return result
+	}
+
+	config := getConfig()
+	if config == nil || !config.enabled {
+		return result
+	}
+
+	// only TCP and UDP sessions have ports to scan
+	tuple := session.GetClientSideTuple()
+	if tuple.Protocol != syscall.IPPROTO_TCP && tuple.Protocol != syscall.IPPROTO_UDP {
+		return result
+	}
+
+	now := time.Now()
+	if isBlocked(tuple.ClientAddress, now) {
+		logger.Debug("Blocking session from scanner %v ctid:%d\n", tuple.ClientAddress, ctid)
+		overseer.AddCounter("portscan_block", 1)
+		session.PutAttachment(blockedAttachment, true)
+		dict.AddSessionEntry(ctid, blockedAttachment, true)
+		result.SessionRelease = false
+		result.PacketDrop = true
+		return result
+	}
+
+	for _, scan := range recordAttempt(config, tuple.ClientAddress, tuple.ServerAddress, tuple.ServerPort, tuple.Protocol, now) {
+		logScan(scan)
+	}
+
+	return result
+}
+
+// logScan logs a detected scan to the portscan_events table and publishes an alert
+func logScan(scan Scan) {
+	logger.Notice("Detected %s port scan from %v: %s\n", scan.Kind, scan.Source, scan.Evidence)
+	overseer.AddCounter("portscan_"+scan.Kind, 1)
+
+	columns := map[string]interface{}{
+		"time_stamp":     scan.Time,
+		"source_address": scan.Source,
+		"kind":           scan.Kind,
+		"ip_protocol":    scan.Protocol,
+		"hosts":          scan.Hosts,
+		"ports":          scan.Ports,
+		"window_seconds": scan.Window,
+		"evidence":       scan.Evidence,
+		"blocked":        scan.Blocked,
+	}
+	reports.LogEvent(reports.CreateEvent("portscan_"+scan.Kind, "portscan_events", 1, columns, nil))
+
+	eventbus.PublishAlert(pluginName, "Port scan from "+scan.Source.String(), map[string]interface{}{
+		"kind":     scan.Kind,
+		"source":   scan.Source.String(),
+		"hosts":    scan.Hosts,
+		"ports":    scan.Ports,
+		"evidence": scan.Evidence,
+		"blocked":  scan.Blocked,
+	})
+}
+
+// cleanupTask removes the expired source trackers and blocks
+func cleanupTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(60 * time.Second):
+			cleanupTrackers(time.Now())
+		}
+	}
+}
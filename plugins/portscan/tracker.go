@@ -0,0 +1,415 @@
+package portscan
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the kinds of scans
+const (
+	kindVertical   = "vertical"
+	kindHorizontal = "horizontal"
+)
+
+// the defaults used when the portscan settings are missing
+const (
+	defaultWindowSeconds   = 60
+	defaultPortThreshold   = 25
+	defaultHostThreshold   = 20
+	defaultCooldownSeconds = 600
+	defaultMaxSources      = 16384
+)
+
+// the limit on the host and port pairs kept for each source, which bounds
+// the memory used by a source that scans everything
+const maxAttempts = 4096
+
+// the number of ports or hosts listed in the evidence summary
+const evidenceItems = 10
+
+// scanConfig holds the portscan settings. The exempt networks are never
+// tracked as sources.
+type scanConfig struct {
+	enabled       bool
+	window        time.Duration
+	portThreshold int
+	hostThreshold int
+	block         bool
+	cooldown      time.Duration
+	maxSources    int
+	exempt        []*net.IPNet
+}
+
+// attempt is a host and port tried by a source
+type attempt struct {
+	protocol uint8
+	host     string
+	port     uint16
+}
+
+// sourceTracker holds the hosts and ports tried by a source in the current
+// window. The reported flags make sure each kind is only reported once.
+type sourceTracker struct {
+	start    time.Time
+	attempts map[attempt]bool
+	reported map[string]bool
+}
+
+// blockEntry holds a blocked scanner
+type blockEntry struct {
+	kind  string
+	until time.Time
+}
+
+// Scan is a detected scan with a summary of the evidence
+type Scan struct {
+	Time     time.Time `json:"time"`
+	Source   net.IP    `json:"source"`
+	Kind     string    `json:"kind"`
+	Protocol uint8     `json:"protocol"`
+	Hosts    int       `json:"hosts"`
+	Ports    int       `json:"ports"`
+	Window   int       `json:"window"`
+	Evidence string    `json:"evidence"`
+	Blocked  bool      `json:"blocked"`
+}
+
+// BlockedSource is a scanner that is blocked until the cooldown ends
+type BlockedSource struct {
+	Address string    `json:"address"`
+	Kind    string    `json:"kind"`
+	Until   time.Time `json:"until"`
+}
+
+// Status holds the portscan settings and the blocked scanners
+type Status struct {
+	Enabled       bool            `json:"enabled"`
+	Window        int             `json:"window"`
+	PortThreshold int             `json:"portThreshold"`
+	HostThreshold int             `json:"hostThreshold"`
+	Block         bool            `json:"block"`
+	Cooldown      int             `json:"cooldown"`
+	Sources       int             `json:"sources"`
+	Blocked       []BlockedSource `json:"blocked"`
+}
+
+var currentConfig *scanConfig
+var configLocker sync.RWMutex
+
+var sourceTable = make(map[string]*sourceTracker)
+var blockTable = make(map[string]blockEntry)
+var trackerLocker sync.Mutex
+
+// loadConfig loads the portscan settings
+func loadConfig() {
+	fresh := &scanConfig{
+		enabled:       true,
+		window:        defaultWindowSeconds * time.Second,
+		portThreshold: defaultPortThreshold,
+		hostThreshold: defaultHostThreshold,
+		cooldown:      defaultCooldownSeconds * time.Second,
+		maxSources:    defaultMaxSources,
+	}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"plugins", "portscan"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			for _, problem := range compileConfig(fresh, item) {
+				logger.Warn("Ignoring invalid portscan %v\n", problem)
+			}
+		} else {
+			logger.Warn("Invalid portscan settings: %T\n", configJSON)
+		}
+	}
+
+	logger.Info("Loaded portscan settings enabled:%v window:%v ports:%d hosts:%d block:%v cooldown:%v exempt:%d\n",
+		fresh.enabled, fresh.window, fresh.portThreshold, fresh.hostThreshold, fresh.block, fresh.cooldown, len(fresh.exempt))
+
+	configLocker.Lock()
+	currentConfig = fresh
+	configLocker.Unlock()
+
+	// the blocks stay until their cooldown ends unless blocking was turned off
+	trackerLocker.Lock()
+	sourceTable = make(map[string]*sourceTracker)
+	if !fresh.block {
+		blockTable = make(map[string]blockEntry)
+	}
+	trackerLocker.Unlock()
+}
+
+// compileConfig reads the portscan settings. Invalid values are skipped and
+// returned as errors.
+func compileConfig(fresh *scanConfig, item map[string]interface{}) []error {
+	var problems []error
+
+	if value, ok := item["enabled"].(bool); ok {
+		fresh.enabled = value
+	}
+	if value, ok := item["windowSeconds"].(float64); ok && value > 0 {
+		fresh.window = time.Duration(value) * time.Second
+	}
+	if value, ok := item["portThreshold"].(float64); ok && value >= 0 {
+		fresh.portThreshold = int(value)
+	}
+	if value, ok := item["hostThreshold"].(float64); ok && value >= 0 {
+		fresh.hostThreshold = int(value)
+	}
+	if value, ok := item["block"].(bool); ok {
+		fresh.block = value
+	}
+	if value, ok := item["cooldownSeconds"].(float64); ok && value > 0 {
+		fresh.cooldown = time.Duration(value) * time.Second
+	}
+	if value, ok := item["maxSources"].(float64); ok && value > 0 {
+		fresh.maxSources = int(value)
+	}
+
+	exemptSlice, _ := item["exempt"].([]interface{})
+	for _, value := range exemptSlice {
+		text, _ := value.(string)
+		network, err := parseNetwork(text)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("exempt network %v: %v", value, err))
+			continue
+		}
+		fresh.exempt = append(fresh.exempt, network)
+	}
+
+	return problems
+}
+
+// parseNetwork returns the network for an address or a network in CIDR notation
+func parseNetwork(text string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(text); err == nil {
+		return network, nil
+	}
+	address := net.ParseIP(text)
+	if address == nil {
+		return nil, fmt.Errorf("invalid address")
+	}
+	if address4 := address.To4(); address4 != nil {
+		return &net.IPNet{IP: address4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: address, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// getConfig returns the active portscan settings
+func getConfig() *scanConfig {
+	configLocker.RLock()
+	defer configLocker.RUnlock()
+	return currentConfig
+}
+
+// isExempt returns true if the address is in one of the exempt networks
+func (config *scanConfig) isExempt(address net.IP) bool {
+	for _, network := range config.exempt {
+		if network.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlocked returns true if the source is a blocked scanner
+func isBlocked(source net.IP, now time.Time) bool {
+	if source == nil {
+		return false
+	}
+
+	trackerLocker.Lock()
+	defer trackerLocker.Unlock()
+
+	entry, found := blockTable[source.String()]
+	return found && now.Before(entry.until)
+}
+
+// recordAttempt records a host and port tried by a source and returns the
+// scans detected by this attempt. A source that is detected is blocked when
+// blocking is enabled.
+func recordAttempt(config *scanConfig, source net.IP, host net.IP, port uint16, protocol uint8, now time.Time) []Scan {
+	if source == nil || host == nil || config.isExempt(source) {
+		return nil
+	}
+
+	key := source.String()
+	item := attempt{protocol: protocol, host: host.String(), port: port}
+
+	trackerLocker.Lock()
+	defer trackerLocker.Unlock()
+
+	tracker, found := sourceTable[key]
+	if !found || now.Sub(tracker.start) >= config.window {
+		if !found && len(sourceTable) >= config.maxSources {
+			overseer.AddCounter("portscan_table_full", 1)
+			return nil
+		}
+		tracker = &sourceTracker{start: now, attempts: make(map[attempt]bool), reported: make(map[string]bool)}
+		sourceTable[key] = tracker
+	}
+
+	if tracker.attempts[item] || len(tracker.attempts) >= maxAttempts {
+		return nil
+	}
+	tracker.attempts[item] = true
+
+	var scans []Scan
+
+	// a vertical scan is many ports on the host of this attempt
+	if config.portThreshold != 0 && !tracker.reported[kindVertical] {
+		ports := tracker.getPorts(item.protocol, item.host)
+		if len(ports) >= config.portThreshold {
+			tracker.reported[kindVertical] = true
+			evidence := fmt.Sprintf("%d ports on %s: %s", len(ports), item.host, summarizePorts(ports))
+			scans = append(scans, Scan{Kind: kindVertical, Hosts: 1, Ports: len(ports), Evidence: evidence})
+		}
+	}
+
+	// a horizontal scan is many hosts on the port of this attempt
+	if config.hostThreshold != 0 && !tracker.reported[kindHorizontal] {
+		hosts := tracker.getHosts(item.protocol, item.port)
+		if len(hosts) >= config.hostThreshold {
+			tracker.reported[kindHorizontal] = true
+			evidence := fmt.Sprintf("port %d on %d hosts: %s", item.port, len(hosts), summarizeList(hosts))
+			scans = append(scans, Scan{Kind: kindHorizontal, Hosts: len(hosts), Ports: 1, Evidence: evidence})
+		}
+	}
+
+	for index := range scans {
+		scans[index].Time = now
+		scans[index].Source = source
+		scans[index].Protocol = protocol
+		scans[index].Window = int(config.window / time.Second)
+		if config.block {
+			scans[index].Blocked = true
+			blockTable[key] = blockEntry{kind: scans[index].Kind, until: now.Add(config.cooldown)}
+		}
+	}
+
+	return scans
+}
+
+// getPorts returns the sorted ports tried on a host
+func (tracker *sourceTracker) getPorts(protocol uint8, host string) []int {
+	var ports []int
+	for item := range tracker.attempts {
+		if item.protocol == protocol && item.host == host {
+			ports = append(ports, int(item.port))
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// getHosts returns the sorted hosts tried on a port
+func (tracker *sourceTracker) getHosts(protocol uint8, port uint16) []string {
+	var hosts []string
+	for item := range tracker.attempts {
+		if item.protocol == protocol && item.port == port {
+			hosts = append(hosts, item.host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// summarizePorts returns the first ports in a list for the evidence summary
+func summarizePorts(ports []int) string {
+	var list []string
+	for _, port := range ports {
+		list = append(list, strconv.Itoa(port))
+	}
+	return summarizeList(list)
+}
+
+// summarizeList returns the first items in a list for the evidence summary
+func summarizeList(list []string) string {
+	if len(list) <= evidenceItems {
+		return strings.Join(list, ",")
+	}
+	return strings.Join(list[:evidenceItems], ",") + fmt.Sprintf(",... (%d more)", len(list)-evidenceItems)
+}
+
+// cleanupTrackers removes the trackers for the windows that have ended and the expired blocks
+func cleanupTrackers(now time.Time) {
+	config := getConfig()
+	if config == nil {
+		return
+	}
+
+	trackerLocker.Lock()
+	defer trackerLocker.Unlock()
+
+	for key, tracker := range sourceTable {
+		if now.Sub(tracker.start) >= config.window {
+			delete(sourceTable, key)
+		}
+	}
+	for key, entry := range blockTable {
+		if !now.Before(entry.until) {
+			logger.Info("Portscan block expired for %s\n", key)
+			delete(blockTable, key)
+		}
+	}
+}
+
+// Unblock removes the block for a scanner, or every block when the address
+// is empty, and returns the number removed
+func Unblock(address string) int {
+	trackerLocker.Lock()
+	defer trackerLocker.Unlock()
+
+	var counter int
+	if address == "" {
+		counter = len(blockTable)
+		blockTable = make(map[string]blockEntry)
+	} else if _, found := blockTable[address]; found {
+		delete(blockTable, address)
+		counter = 1
+	}
+
+	logger.Info("Removed %d portscan blocks\n", counter)
+	return counter
+}
+
+// GetStatus returns the portscan settings and the blocked scanners
+func GetStatus() Status {
+	status := Status{Blocked: []BlockedSource{}}
+
+	config := getConfig()
+	if config == nil {
+		return status
+	}
+
+	status.Enabled = config.enabled
+	status.Window = int(config.window / time.Second)
+	status.PortThreshold = config.portThreshold
+	status.HostThreshold = config.hostThreshold
+	status.Block = config.block
+	status.Cooldown = int(config.cooldown / time.Second)
+
+	now := time.Now()
+	trackerLocker.Lock()
+	status.Sources = len(sourceTable)
+	for address, entry := range blockTable {
+		if now.Before(entry.until) {
+			status.Blocked = append(status.Blocked, BlockedSource{Address: address, Kind: entry.kind, Until: entry.until})
+		}
+	}
+	trackerLocker.Unlock()
+
+	sort.Slice(status.Blocked, func(i, j int) bool {
+		return status.Blocked[i].Until.Before(status.Blocked[j].Until)
+	})
+	return status
+}
@@ -3,19 +3,38 @@ package predicttraffic
 import (
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
 	"github.com/untangle/packetd/services/predicttrafficsvc"
 	"github.com/untangle/packetd/services/reports"
 )
 
 const pluginName = "predicttraffic"
 
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		EnabledFunc:  pluginEnabled,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.PredictPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
+// pluginEnabled returns true when the cloud is enabled since the predictions come from the cloud
+func pluginEnabled() bool {
+	return !kernel.FlagNoCloud
+}
+
 // PluginStartup function is called to allow plugin specific initialization. We
 // increment the argumented WaitGroup so the main process can wait for
 // our shutdown function to return during shutdown.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.PredictPriority, PluginNfqueueHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down. We call Done
@@ -52,14 +71,15 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 // addPredictionToDict will take a ClassifiedTraffic pointer and send the data to dict
 func addPredictionToDict(ctid uint32, currentTraffic *predicttrafficsvc.ClassifiedTraffic) {
 	logger.Debug("Sending prediction info to dict with ctid: %d\n", ctid)
-	dict.AddSessionEntry(ctid, "application_id_inferred", currentTraffic.ID)
-	dict.AddSessionEntry(ctid, "application_name_inferred", currentTraffic.Name)
-	dict.AddSessionEntry(ctid, "application_confidence_inferred", roundConfidence(currentTraffic.Confidence))
-	dict.AddSessionEntry(ctid, "application_protochain_inferred", currentTraffic.ProtoChain)
-	dict.AddSessionEntry(ctid, "application_productivity_inferred", currentTraffic.Productivity)
-	dict.AddSessionEntry(ctid, "application_risk_inferred", currentTraffic.Risk)
-	dict.AddSessionEntry(ctid, "application_category_inferred", currentTraffic.Category)
-
+	dict.AddSessionEntries(ctid, map[string]interface{}{
+		"application_id_inferred":           currentTraffic.ID,
+		"application_name_inferred":         currentTraffic.Name,
+		"application_confidence_inferred":   roundConfidence(currentTraffic.Confidence),
+		"application_protochain_inferred":   currentTraffic.ProtoChain,
+		"application_productivity_inferred": currentTraffic.Productivity,
+		"application_risk_inferred":         currentTraffic.Risk,
+		"application_category_inferred":     currentTraffic.Category,
+	})
 }
 
 // addPredictionToReport will take a ClassifiedTraffic pointer and send the data into the reports sqlite database, under the sessions table
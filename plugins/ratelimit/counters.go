@@ -0,0 +1,371 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the actions taken on the sessions over a threshold
+const (
+	actionFlag  = "flag"
+	actionBlock = "block"
+)
+
+// the kinds of detections
+const (
+	kindClientRate      = "client_rate"
+	kindDestinationRate = "destination_rate"
+	kindSynFlood        = "syn_flood"
+)
+
+// the defaults used when the ratelimit settings are missing
+const (
+	defaultWindowSeconds       = 10
+	defaultClientSessions      = 200
+	defaultDestinationSessions = 1000
+	defaultHalfOpen            = 200
+	defaultMaxEntries          = 65536
+)
+
+// limitConfig holds the ratelimit settings. A threshold of zero turns off
+// the check, and the exempt networks are never counted.
+type limitConfig struct {
+	enabled             bool
+	action              string
+	window              time.Duration
+	clientSessions      uint64
+	destinationSessions uint64
+	halfOpen            uint64
+	maxEntries          int
+	exempt              []*net.IPNet
+}
+
+// rateCounter holds the counters for a client or destination in the current
+// window. The reported flags make sure each kind is only reported once.
+type rateCounter struct {
+	address     net.IP
+	start       time.Time
+	sessions    uint64
+	syns        uint64
+	established uint64
+	reported    map[string]bool
+}
+
+// Detection is a client or destination that went over a threshold
+type Detection struct {
+	Kind      string `json:"kind"`
+	Address   net.IP `json:"address"`
+	Count     uint64 `json:"count"`
+	Threshold uint64 `json:"threshold"`
+	Window    int    `json:"window"`
+	Action    string `json:"action"`
+}
+
+// Offender is a client or destination that is over a threshold in the current window
+type Offender struct {
+	Kind        string    `json:"kind"`
+	Address     net.IP    `json:"address"`
+	Count       uint64    `json:"count"`
+	Threshold   uint64    `json:"threshold"`
+	WindowStart time.Time `json:"windowStart"`
+}
+
+// Status holds the ratelimit settings and the current offenders
+type Status struct {
+	Enabled             bool       `json:"enabled"`
+	Action              string     `json:"action"`
+	Window              int        `json:"window"`
+	ClientSessions      uint64     `json:"clientSessions"`
+	DestinationSessions uint64     `json:"destinationSessions"`
+	HalfOpen            uint64     `json:"halfOpen"`
+	Clients             int        `json:"clients"`
+	Destinations        int        `json:"destinations"`
+	Offenders           []Offender `json:"offenders"`
+}
+
+var currentConfig *limitConfig
+var configLocker sync.RWMutex
+
+var clientTable = make(map[string]*rateCounter)
+var destinationTable = make(map[string]*rateCounter)
+var counterLocker sync.Mutex
+
+// loadConfig loads the ratelimit settings
+func loadConfig() {
+	fresh := &limitConfig{
+		enabled:             true,
+		action:              actionFlag,
+		window:              defaultWindowSeconds * time.Second,
+		clientSessions:      defaultClientSessions,
+		destinationSessions: defaultDestinationSessions,
+		halfOpen:            defaultHalfOpen,
+		maxEntries:          defaultMaxEntries,
+	}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"plugins", "ratelimit"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			for _, problem := range compileConfig(fresh, item) {
+				logger.Warn("Ignoring invalid ratelimit %v\n", problem)
+			}
+		} else {
+			logger.Warn("Invalid ratelimit settings: %T\n", configJSON)
+		}
+	}
+
+	logger.Info("Loaded ratelimit settings enabled:%v action:%s window:%v client:%d destination:%d halfopen:%d exempt:%d\n",
+		fresh.enabled, fresh.action, fresh.window, fresh.clientSessions, fresh.destinationSessions, fresh.halfOpen, len(fresh.exempt))
+
+	configLocker.Lock()
+	currentConfig = fresh
+	configLocker.Unlock()
+
+	// the counters started with the old window are no longer meaningful
+	counterLocker.Lock()
+	clientTable = make(map[string]*rateCounter)
+	destinationTable = make(map[string]*rateCounter)
+	counterLocker.Unlock()
+}
+
+// compileConfig reads the ratelimit settings. Invalid values are skipped and
+// returned as errors.
+func compileConfig(fresh *limitConfig, item map[string]interface{}) []error {
+	var problems []error
+
+	if value, ok := item["enabled"].(bool); ok {
+		fresh.enabled = value
+	}
+	if value, ok := item["action"].(string); ok {
+		if value == actionFlag || value == actionBlock {
+			fresh.action = value
+		} else {
+			problems = append(problems, fmt.Errorf("action: %s", value))
+		}
+	}
+	if value, ok := item["windowSeconds"].(float64); ok && value > 0 {
+		fresh.window = time.Duration(value) * time.Second
+	}
+	if value, ok := item["clientSessions"].(float64); ok && value >= 0 {
+		fresh.clientSessions = uint64(value)
+	}
+	if value, ok := item["destinationSessions"].(float64); ok && value >= 0 {
+		fresh.destinationSessions = uint64(value)
+	}
+	if value, ok := item["halfOpen"].(float64); ok && value >= 0 {
+		fresh.halfOpen = uint64(value)
+	}
+	if value, ok := item["maxEntries"].(float64); ok && value > 0 {
+		fresh.maxEntries = int(value)
+	}
+
+	exemptSlice, _ := item["exempt"].([]interface{})
+	for _, value := range exemptSlice {
+		text, _ := value.(string)
+		network, err := parseNetwork(text)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("exempt network %v: %v", value, err))
+			continue
+		}
+		fresh.exempt = append(fresh.exempt, network)
+	}
+
+	return problems
+}
+
+// parseNetwork returns the network for an address or a network in CIDR notation
+func parseNetwork(text string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(text); err == nil {
+		return network, nil
+	}
+	address := net.ParseIP(text)
+	if address == nil {
+		return nil, fmt.Errorf("invalid address")
+	}
+	if address4 := address.To4(); address4 != nil {
+		return &net.IPNet{IP: address4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: address, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// getConfig returns the active ratelimit settings
+func getConfig() *limitConfig {
+	configLocker.RLock()
+	defer configLocker.RUnlock()
+	return currentConfig
+}
+
+// isExempt returns true if the address is in one of the exempt networks
+func (config *limitConfig) isExempt(address net.IP) bool {
+	for _, network := range config.exempt {
+		if network.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// countSession counts a new session against the client and the destination.
+// It returns the thresholds crossed by this session, which are reported once
+// per window, and the kind of the first threshold the client or destination
+// is over, or an empty string when the session is within the limits.
+func countSession(config *limitConfig, client net.IP, server net.IP, syn bool, now time.Time) ([]Detection, string) {
+	var detections []Detection
+	var kind string
+
+	report := func(counter *rateCounter, name string, count uint64, threshold uint64) {
+		if threshold == 0 || count <= threshold {
+			return
+		}
+		if kind == "" {
+			kind = name
+		}
+		if counter.reported[name] {
+			return
+		}
+		counter.reported[name] = true
+		detections = append(detections, Detection{Kind: name, Address: counter.address, Count: count, Threshold: threshold, Window: int(config.window / time.Second), Action: config.action})
+	}
+
+	counterLocker.Lock()
+	defer counterLocker.Unlock()
+
+	if client != nil && !config.isExempt(client) {
+		if counter := findCounter(config, clientTable, client, now); counter != nil {
+			counter.sessions++
+			report(counter, kindClientRate, counter.sessions, config.clientSessions)
+		}
+	}
+
+	if server != nil && !config.isExempt(server) {
+		if counter := findCounter(config, destinationTable, server, now); counter != nil {
+			counter.sessions++
+			report(counter, kindDestinationRate, counter.sessions, config.destinationSessions)
+			if syn {
+				counter.syns++
+				report(counter, kindSynFlood, counter.halfOpen(), config.halfOpen)
+			}
+		}
+	}
+
+	return detections, kind
+}
+
+// completeHandshake counts a finished TCP handshake for the destination
+func completeHandshake(server net.IP) {
+	counterLocker.Lock()
+	defer counterLocker.Unlock()
+
+	counter, found := destinationTable[addressKey(server)]
+	if !found {
+		return
+	}
+	// handshakes started in the last window can finish in this one
+	if counter.established < counter.syns {
+		counter.established++
+	}
+}
+
+// findCounter returns the counter for the address in the current window,
+// starting a new window if the last one has ended. It returns nil when the
+// table is full. The caller must hold the counterLocker.
+func findCounter(config *limitConfig, table map[string]*rateCounter, address net.IP, now time.Time) *rateCounter {
+	key := addressKey(address)
+	counter, found := table[key]
+	if found && now.Sub(counter.start) < config.window {
+		return counter
+	}
+
+	if !found && len(table) >= config.maxEntries {
+		overseer.AddCounter("ratelimit_table_full", 1)
+		return nil
+	}
+
+	counter = &rateCounter{address: address, start: now, reported: make(map[string]bool)}
+	table[key] = counter
+	return counter
+}
+
+// halfOpen returns the number of handshakes started and not finished in the window
+func (counter *rateCounter) halfOpen() uint64 {
+	if counter.established >= counter.syns {
+		return 0
+	}
+	return counter.syns - counter.established
+}
+
+// cleanupCounters removes the counters for the windows that have ended
+func cleanupCounters(now time.Time) {
+	config := getConfig()
+	if config == nil {
+		return
+	}
+
+	counterLocker.Lock()
+	defer counterLocker.Unlock()
+
+	var counter int
+	for _, table := range []map[string]*rateCounter{clientTable, destinationTable} {
+		for key, item := range table {
+			if now.Sub(item.start) >= config.window {
+				delete(table, key)
+				counter++
+			}
+		}
+	}
+
+	logger.Debug("Removed %d ratelimit counters\n", counter)
+}
+
+// GetStatus returns the ratelimit settings and the clients and destinations
+// that are over a threshold in the current window
+func GetStatus() Status {
+	status := Status{Offenders: []Offender{}}
+
+	config := getConfig()
+	if config == nil {
+		return status
+	}
+
+	status.Enabled = config.enabled
+	status.Action = config.action
+	status.Window = int(config.window / time.Second)
+	status.ClientSessions = config.clientSessions
+	status.DestinationSessions = config.destinationSessions
+	status.HalfOpen = config.halfOpen
+
+	now := time.Now()
+	check := func(counter *rateCounter, kind string, count uint64, threshold uint64) {
+		if threshold != 0 && count > threshold {
+			status.Offenders = append(status.Offenders, Offender{Kind: kind, Address: counter.address, Count: count, Threshold: threshold, WindowStart: counter.start})
+		}
+	}
+
+	counterLocker.Lock()
+	status.Clients = len(clientTable)
+	status.Destinations = len(destinationTable)
+	for _, counter := range clientTable {
+		if now.Sub(counter.start) < config.window {
+			check(counter, kindClientRate, counter.sessions, config.clientSessions)
+		}
+	}
+	for _, counter := range destinationTable {
+		if now.Sub(counter.start) < config.window {
+			check(counter, kindDestinationRate, counter.sessions, config.destinationSessions)
+			check(counter, kindSynFlood, counter.halfOpen(), config.halfOpen)
+		}
+	}
+	counterLocker.Unlock()
+
+	sort.Slice(status.Offenders, func(i, j int) bool {
+		return status.Offenders[i].Count > status.Offenders[j].Count
+	})
+	return status
+}
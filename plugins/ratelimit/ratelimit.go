@@ -0,0 +1,238 @@
+// Package ratelimit provides the "ratelimit" plugin
+// The ratelimit plugin counts the new sessions from each client and to each
+// destination in a fixed window, and the TCP handshakes to each destination
+// that are started but never finished. A client or destination over the
+// threshold from the settings is reported once per window, and the sessions
+// over the threshold are flagged or dropped depending on the action. This
+// gives basic protection against floods and scanning without any help from
+// the firewall.
+package ratelimit
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/reports"
+)
+
+const pluginName = "ratelimit"
+
+// the session attachments used for the rate limit decisions
+const (
+	handshakeAttachment = "ratelimit_handshake"
+	blockedAttachment   = "ratelimit_blocked"
+	flaggedAttachment   = "ratelimit_flagged"
+)
+
+var shutdownChannel = make(chan bool)
+
+// init registers the plugin with the plugin registry and the rate limit events table with
+// the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "ratelimit_events",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "kind", Type: "text"},
+			{Name: "address", Type: "text"},
+			{Name: "count", Type: "int8"},
+			{Name: "threshold", Type: "int8"},
+			{Name: "window_seconds", Type: "int4"},
+			{Name: "action", Type: "text"},
+		},
+		TrimPercent: .1,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.RateLimitPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	loadConfig()
+	go cleanupTask()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of cleanupTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown cleanupTask\n")
+	}
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadConfig()
+	}
+}
+
+// PluginNfqueueHandler is called to handle nfqueue packet data. New sessions
+// are counted against the client and the destination, and TCP sessions are
+// watched until the client acknowledges the handshake so we can count the
+// handshakes that are never finished. Sessions over a threshold are flagged
+// or have every packet dropped.
+func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	session := mess.Session
+	if session == nil {
+		return result
+	}
+
+	// once a session is blocked we keep dropping the retransmissions
+	if session.GetAttachment(blockedAttachment) != nil {
+		result.SessionRelease = false
+		result.PacketDrop = true
+		return result
+	}
+
+	config := getConfig()
+	if config == nil || !config.enabled {
+		return result
+	}
+
+	tuple := session.GetClientSideTuple()
+
+	if !newSession {
+		if session.GetAttachment(handshakeAttachment) == nil {
+			return result
+		}
+		if mess.TCPLayer != nil && mess.ClientToServer && mess.TCPLayer.ACK && !mess.TCPLayer.SYN {
+			session.DeleteAttachment(handshakeAttachment)
+			completeHandshake(tuple.ServerAddress)
+			return result
+		}
+		// keep watching until the handshake is finished
+		result.SessionRelease = false
+		return result
+	}
+
+	syn := mess.TCPLayer != nil && mess.TCPLayer.SYN && !mess.TCPLayer.ACK
+	detections, kind := countSession(config, tuple.ClientAddress, tuple.ServerAddress, syn, time.Now())
+	for _, item := range detections {
+		logDetection(item)
+	}
+
+	if syn {
+		session.PutAttachment(handshakeAttachment, true)
+		result.SessionRelease = false
+	}
+
+	if kind == "" {
+		return result
+	}
+
+	if config.action == actionBlock {
+		logger.Debug("Blocking session over the %s threshold ctid:%d\n", kind, ctid)
+		overseer.AddCounter("ratelimit_block", 1)
+		session.PutAttachment(blockedAttachment, kind)
+		session.DeleteAttachment(handshakeAttachment)
+		dict.AddSessionEntry(ctid, blockedAttachment, true)
+		logSessionEvent(session, kind, actionBlock)
+		result.SessionRelease = false
+		result.PacketDrop = true
+		return result
+	}
+
+	if session.GetAttachment(flaggedAttachment) == nil {
+		logger.Debug("Flagging session over the %s threshold ctid:%d\n", kind, ctid)
+		overseer.AddCounter("ratelimit_flag", 1)
+		session.PutAttachment(flaggedAttachment, kind)
+		dict.AddSessionEntry(ctid, flaggedAttachment, true)
+		logSessionEvent(session, kind, actionFlag)
+	}
+	return result
+}
+
+// logDetection logs a client or destination going over a threshold to the
+// ratelimit_events table and publishes an alert
+func logDetection(item Detection) {
+	logger.Notice("Detected %s from %v: %d over the limit of %d in %d seconds\n", item.Kind, item.Address, item.Count, item.Threshold, item.Window)
+	overseer.AddCounter("ratelimit_"+item.Kind, 1)
+
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"kind":           item.Kind,
+		"address":        item.Address,
+		"count":          item.Count,
+		"threshold":      item.Threshold,
+		"window_seconds": item.Window,
+		"action":         item.Action,
+	}
+	reports.LogEvent(reports.CreateEvent("ratelimit_"+item.Kind, "ratelimit_events", 1, columns, nil))
+
+	eventbus.PublishAlert(pluginName, "Rate limit "+item.Kind+" for "+item.Address.String(), map[string]interface{}{
+		"kind":      item.Kind,
+		"address":   item.Address.String(),
+		"count":     item.Count,
+		"threshold": item.Threshold,
+		"window":    item.Window,
+		"action":    item.Action,
+	})
+}
+
+// logSessionEvent logs a flagged or blocked session to the rule_events table
+func logSessionEvent(session *dispatch.Session, kind string, action string) {
+	tuple := session.GetClientSideTuple()
+
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"session_id":     session.GetSessionID(),
+		"rule_id":        "ratelimit_" + kind,
+		"action":         action,
+		"ip_protocol":    tuple.Protocol,
+		"client_address": tuple.ClientAddress,
+		"client_port":    tuple.ClientPort,
+		"server_address": tuple.ServerAddress,
+		"server_port":    tuple.ServerPort,
+	}
+
+	reports.LogEvent(reports.CreateEvent("ratelimit_"+action, "rule_events", 1, columns, nil))
+}
+
+// cleanupTask removes the counters for the windows that have ended
+func cleanupTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(60 * time.Second):
+			cleanupCounters(time.Now())
+		}
+	}
+}
+
+// addressKey returns the key used for an address in the counter tables
+func addressKey(address net.IP) string {
+	if address == nil {
+		return ""
+	}
+	return address.String()
+}
@@ -0,0 +1,158 @@
+package reporter
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/plugins/geoip"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+	"github.com/untangle/packetd/services/zones"
+)
+
+// ruleDescriptions maps a table, chain, and rule ID to the rule description
+// from the firewall settings
+var ruleDescriptions map[string]string
+var ruleLocker sync.RWMutex
+
+// init registers the firewall events table with the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "firewall_events",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "session_id", Type: "int8"},
+			{Name: "ip_protocol", Type: "int"},
+			{Name: "icmp_type", Type: "int"},
+			{Name: "client_interface_id", Type: "int"},
+			{Name: "server_interface_id", Type: "int"},
+			{Name: "client_zone", Type: "text"},
+			{Name: "server_zone", Type: "text"},
+			{Name: "client_address", Type: "text"},
+			{Name: "client_port", Type: "int2"},
+			{Name: "server_address", Type: "text"},
+			{Name: "server_port", Type: "int2"},
+			{Name: "client_country", Type: "text"},
+			{Name: "server_country", Type: "text"},
+			{Name: "table_name", Type: "text"},
+			{Name: "chain_name", Type: "text"},
+			{Name: "rule_id", Type: "int"},
+			{Name: "rule_description", Type: "text"},
+			{Name: "action", Type: "text"},
+			{Name: "policy_id", Type: "int"},
+		},
+		TrimPercent: .1,
+	})
+}
+
+// loadRuleDescriptions loads the rule descriptions from the firewall tables
+// in the settings. The tables can be an object keyed by name or a list of
+// objects that have a name.
+func loadRuleDescriptions() {
+	fresh := make(map[string]string)
+
+	tablesJSON, err := settings.GetCurrentSettings([]string{"firewall", "tables"})
+	if tablesJSON != nil && err == nil {
+		switch tables := tablesJSON.(type) {
+		case map[string]interface{}:
+			for name, table := range tables {
+				addRuleDescriptions(fresh, name, table)
+			}
+		case []interface{}:
+			for _, table := range tables {
+				item, _ := table.(map[string]interface{})
+				name, _ := item["name"].(string)
+				addRuleDescriptions(fresh, name, table)
+			}
+		default:
+			logger.Warn("Invalid firewall tables: %T\n", tablesJSON)
+		}
+	}
+
+	logger.Info("Loaded %d firewall rule descriptions\n", len(fresh))
+
+	ruleLocker.Lock()
+	ruleDescriptions = fresh
+	ruleLocker.Unlock()
+}
+
+// addRuleDescriptions adds the descriptions of the rules in a firewall table
+func addRuleDescriptions(fresh map[string]string, tableName string, table interface{}) {
+	item, ok := table.(map[string]interface{})
+	if !ok || tableName == "" {
+		return
+	}
+
+	chains, _ := item["chains"].([]interface{})
+	for _, chain := range chains {
+		chainItem, _ := chain.(map[string]interface{})
+		chainName, _ := chainItem["name"].(string)
+		rules, _ := chainItem["rules"].([]interface{})
+		for _, rule := range rules {
+			ruleItem, _ := rule.(map[string]interface{})
+			ruleID, ok := ruleItem["ruleId"].(float64)
+			if !ok {
+				continue
+			}
+			if description, _ := ruleItem["description"].(string); description != "" {
+				fresh[getRuleKey(tableName, chainName, int(ruleID))] = description
+			}
+		}
+	}
+}
+
+// getRuleKey returns the key of a rule in the description table
+func getRuleKey(table string, chain string, ruleID int) string {
+	return fmt.Sprintf("%s/%s/%d", table, chain, ruleID)
+}
+
+// getRuleDescription returns the description of a rule or an empty string
+func getRuleDescription(table string, chain string, ruleID int) string {
+	ruleLocker.RLock()
+	defer ruleLocker.RUnlock()
+	return ruleDescriptions[getRuleKey(table, chain, ruleID)]
+}
+
+// logFirewallEvent writes a firewall rule log event to the firewall_events
+// table with the zone names, the rule description, and the countries added
+func logFirewallEvent(netlogger *dispatch.NetloggerMessage, traffic *TrafficEvent) {
+	var sessionID int64
+	if netlogger.Sessptr != nil {
+		sessionID = netlogger.Sessptr.GetSessionID()
+	}
+
+	columns := map[string]interface{}{
+		"time_stamp":          time.Now(),
+		"session_id":          sessionID,
+		"ip_protocol":         netlogger.Protocol,
+		"icmp_type":           netlogger.IcmpType,
+		"client_interface_id": netlogger.SrcInterface,
+		"server_interface_id": netlogger.DstInterface,
+		"client_zone":         zones.GetInterfaceZone(int(netlogger.SrcInterface)),
+		"server_zone":         zones.GetInterfaceZone(int(netlogger.DstInterface)),
+		"client_address":      netlogger.SrcAddress,
+		"client_port":         netlogger.SrcPort,
+		"server_address":      netlogger.DstAddress,
+		"server_port":         netlogger.DstPort,
+		"table_name":          traffic.Table,
+		"chain_name":          traffic.Chain,
+		"rule_id":             traffic.RuleID,
+		"rule_description":    getRuleDescription(traffic.Table, traffic.Chain, traffic.RuleID),
+		"action":              traffic.Action,
+		"policy_id":           traffic.Policy,
+	}
+
+	// the geoip lookups are done by the report worker to keep them off the netlogger thread
+	clientAddress := net.ParseIP(netlogger.SrcAddress)
+	serverAddress := net.ParseIP(netlogger.DstAddress)
+	enqueueReport(func() {
+		columns["client_country"] = geoip.LookupCountry(clientAddress)
+		columns["server_country"] = geoip.LookupCountry(serverAddress)
+		reports.LogEvent(reports.CreateEvent("firewall_event", "firewall_events", 1, columns, nil))
+	})
+}
@@ -0,0 +1,109 @@
+package reporter
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+// reportQueueSize is the maximum number of pending report jobs
+const reportQueueSize = 4096
+
+// QueueStatus holds the reporter queue depth and drop metrics
+type QueueStatus struct {
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	MaxDepth int64  `json:"maxDepth"`
+	Queued   uint64 `json:"queued"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// reportQueue holds the jobs that log the events to the database. The
+// dispatch handlers write the dict entries right away, since the kernel and
+// the other plugins read them, and only queue the events, so a slow database
+// can never hold up a packet verdict. When the queue is full the oldest job
+// is dropped so we lose logging detail rather than stall.
+var reportQueue = make(chan func(), reportQueueSize)
+var reportShutdown = make(chan bool)
+var reportMaxDepth int64
+var reportQueued uint64
+var reportDropped uint64
+
+// startReportQueue starts the goroutine that runs the queued report jobs
+func startReportQueue() {
+	go reportWorker()
+}
+
+// stopReportQueue stops the report worker after the queued jobs are finished
+func stopReportQueue() {
+	reportShutdown <- true
+	select {
+	case <-reportShutdown:
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown reportWorker\n")
+	}
+}
+
+// GetQueueStatus returns the current reporter queue metrics
+func GetQueueStatus() QueueStatus {
+	return QueueStatus{
+		Depth:    len(reportQueue),
+		Capacity: cap(reportQueue),
+		MaxDepth: atomic.LoadInt64(&reportMaxDepth),
+		Queued:   atomic.LoadUint64(&reportQueued),
+		Dropped:  atomic.LoadUint64(&reportDropped),
+	}
+}
+
+// enqueueReport adds a job to the report queue, dropping the oldest
+// jobs as needed to make room so the caller never blocks
+func enqueueReport(job func()) {
+	for {
+		select {
+		case reportQueue <- job:
+			atomic.AddUint64(&reportQueued, 1)
+			updateMaxDepth(int64(len(reportQueue)))
+			return
+		default:
+		}
+
+		select {
+		case <-reportQueue:
+			atomic.AddUint64(&reportDropped, 1)
+			overseer.AddCounter("reporter_queue_dropped", 1)
+			// log the message with the OC verb passing the counter name and the repeat message limit as the first two arguments
+			logger.Warn("%OC|Reporter queue at capacity[%d]. Dropping oldest report\n", "reporter_queue_full", 100, cap(reportQueue))
+		default:
+		}
+	}
+}
+
+// updateMaxDepth records the highest queue depth we have seen
+func updateMaxDepth(depth int64) {
+	for {
+		current := atomic.LoadInt64(&reportMaxDepth)
+		if depth <= current || atomic.CompareAndSwapInt64(&reportMaxDepth, current, depth) {
+			return
+		}
+	}
+}
+
+// reportWorker runs the queued report jobs until shutdown and then
+// finishes anything left in the queue before returning
+func reportWorker() {
+	for {
+		select {
+		case job := <-reportQueue:
+			job()
+		case <-reportShutdown:
+			for len(reportQueue) > 0 {
+				job := <-reportQueue
+				job()
+			}
+			reportShutdown <- true
+			return
+		}
+	}
+}
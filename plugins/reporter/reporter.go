@@ -5,27 +5,52 @@ package reporter
 import (
 	"encoding/json"
 	"net"
+	"syscall"
 	"time"
 
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
 	"github.com/untangle/packetd/services/reports"
 )
 
 const pluginName = "reporter"
 
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.ReporterPriority, NfqueueFunc: PluginNfqueueHandler},
+			{Priority: 1, ConntrackFunc: PluginConntrackHandler},
+			{Priority: 1, NetloggerFunc: PluginNetloggerHandler},
+		},
+	}))
+}
+
 // PluginStartup starts the reporter
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ReporterPriority, PluginNfqueueHandler)
-	dispatch.InsertConntrackSubscription(pluginName, 1, PluginConntrackHandler)
-	dispatch.InsertNetloggerSubscription(pluginName, 1, PluginNetloggerHandler)
+	loadRuleDescriptions()
+	startReportQueue()
 }
 
 // PluginShutdown stops the reporter
 func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+	stopReportQueue()
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadRuleDescriptions()
+	}
 }
 
 // PluginNfqueueHandler handles the first packet of a session
@@ -70,6 +95,8 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		"ip_protocol":           clientSideTuple.Protocol,
 		"client_interface_id":   session.GetClientInterfaceID(),
 		"client_interface_type": session.GetClientInterfaceType(),
+		"vlan_id":               session.GetVlanID(),
+		"client_zone":           session.GetClientZone(),
 		"local_address":         localAddress,
 		"remote_address":        remoteAddress,
 		"client_address":        clientSideTuple.ClientAddress,
@@ -78,14 +105,19 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		"server_port":           clientSideTuple.ServerPort,
 		"family":                session.GetFamily(),
 	}
-	reports.LogEvent(reports.CreateEvent("session_new", "sessions", 1, columns, nil))
+	entries := make(map[string]interface{})
 	for k, v := range columns {
 		session.PutAttachment(k, v)
 		if k == "time_stamp" {
 			continue
 		}
-		dict.AddSessionEntry(session.GetConntrackID(), k, v)
+		entries[k] = v
 	}
+
+	dict.AddSessionEntries(ctid, entries)
+	enqueueReport(func() {
+		reports.LogEvent(reports.CreateEvent("session_new", "sessions", 1, columns, nil))
+	})
 	return result
 }
 
@@ -113,13 +145,17 @@ func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
 				"server_port_new":       serverSideTuple.ServerPort,
 				"server_interface_id":   session.GetServerInterfaceID(),
 				"server_interface_type": session.GetServerInterfaceType(),
+				"server_zone":           session.GetServerZone(),
 			}
-			reports.LogEvent(reports.CreateEvent("session_nat", "sessions", 2, columns, modifiedColumns))
 			for k, v := range modifiedColumns {
 				session.PutAttachment(k, v)
-				dict.AddSessionEntry(session.GetConntrackID(), k, v)
 			}
 
+			dict.AddSessionEntries(session.GetConntrackID(), modifiedColumns)
+			enqueueReport(func() {
+				reports.LogEvent(reports.CreateEvent("session_nat", "sessions", 2, columns, modifiedColumns))
+			})
+
 		} else {
 			// We should not receive a new conntrack event for something that is not in the session table
 			// However it happens on local outbound sessions, we should handle these diffently
@@ -151,43 +187,56 @@ type TrafficEvent struct {
 func PluginNetloggerHandler(netlogger *dispatch.NetloggerMessage) {
 	var traffic TrafficEvent
 
+	// extract the details from the json passed in the prefix
+	json.Unmarshal([]byte(netlogger.Prefix), &traffic)
+
+	// every rule event goes in the firewall log, even without a session
+	if traffic.Type == "rule" {
+		logFirewallEvent(netlogger, &traffic)
+	}
+
 	if netlogger.Sessptr == nil {
 		logger.Debug("Missing session in netlogger event: %v\n", netlogger)
 		return
 	}
 
-	columns := map[string]interface{}{
-		"session_id": netlogger.Sessptr.GetSessionID(),
-	}
-
-	// extract the details from the json passed in the prefix
-	json.Unmarshal([]byte(netlogger.Prefix), &traffic)
-
-	// we currently only care about wan routing rules
+	// the session only tracks the wan routing rules
 	if traffic.Type != "rule" || traffic.Table != "wan-routing" {
 		return
 	}
 
+	columns := map[string]interface{}{
+		"session_id": netlogger.Sessptr.GetSessionID(),
+	}
+
 	modifiedColumns := make(map[string]interface{})
 	modifiedColumns["wan_rule_chain"] = traffic.Chain
 	modifiedColumns["wan_rule_id"] = traffic.RuleID
 	modifiedColumns["wan_policy_id"] = traffic.Policy
 
-	reports.LogEvent(reports.CreateEvent("reporter_netlogger", "sessions", 2, columns, modifiedColumns))
+	enqueueReport(func() {
+		reports.LogEvent(reports.CreateEvent("reporter_netlogger", "sessions", 2, columns, modifiedColumns))
+	})
 	logger.Debug("NetLogger event for %v: %v\n", columns, modifiedColumns)
 }
 
-// doAccounting does the session_minutes accounting
+// doAccounting does the session_minutes accounting. The rates are written to
+// the dict while the caller holds the conntrack lock and the database write is
+// queued for the report worker.
 func doAccounting(entry *dispatch.Conntrack, sessionID int64, ctid uint32) {
-	dict.AddSessionEntry(ctid, "byte_rate", uint32(entry.TotalByteRate))
-	dict.AddSessionEntry(ctid, "client_byte_rate", uint32(entry.ClientByteRate))
-	dict.AddSessionEntry(ctid, "server_byte_rate", uint32(entry.ServerByteRate))
-	dict.AddSessionEntry(ctid, "packet_rate", uint32(entry.TotalPacketRate))
-	dict.AddSessionEntry(ctid, "client_packet_rate", uint32(entry.ClientPacketRate))
-	dict.AddSessionEntry(ctid, "server_packet_rate", uint32(entry.ServerPacketRate))
+	entries := map[string]interface{}{
+		"byte_rate":          uint32(entry.TotalByteRate),
+		"client_byte_rate":   uint32(entry.ClientByteRate),
+		"server_byte_rate":   uint32(entry.ServerByteRate),
+		"packet_rate":        uint32(entry.TotalPacketRate),
+		"client_packet_rate": uint32(entry.ClientPacketRate),
+		"server_packet_rate": uint32(entry.ServerPacketRate),
+	}
+
+	var columns map[string]interface{}
 
 	if entry.TotalByteRate != 0 && entry.ClientByteRate != 0 && entry.ServerByteRate != 0 && entry.TotalPacketRate != 0 && entry.ClientPacketRate != 0 && entry.ServerPacketRate != 0 {
-		columns := map[string]interface{}{
+		columns = map[string]interface{}{
 			"time_stamp":         time.Now(),
 			"session_id":         sessionID,
 			"client_bytes":       entry.ClientBytesDiff,
@@ -203,6 +252,14 @@ func doAccounting(entry *dispatch.Conntrack, sessionID int64, ctid uint32) {
 			"server_packet_rate": int32(entry.ServerPacketRate),
 			"packet_rate":        int32(entry.TotalPacketRate),
 		}
-		reports.LogEvent(reports.CreateEvent("session_stat", "session_stats", 1, columns, nil))
 	}
+
+	dict.AddSessionEntries(ctid, entries)
+	if columns == nil {
+		return
+	}
+
+	enqueueReport(func() {
+		reports.LogEvent(reports.CreateEvent("session_stat", "session_stats", 1, columns, nil))
+	})
 }
@@ -8,6 +8,7 @@ import (
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
 )
 
 // ReverseHolder is used to cache a list of DNS names for an IP address
@@ -32,18 +33,31 @@ var reverseMutex sync.Mutex
 var clientMutex sync.Mutex
 var serverMutex sync.Mutex
 
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		Subscriptions: []pluginsdk.Subscription{
+			{Name: pluginName + clientSuffix, Priority: dispatch.RevDNSPriority, NfqueueFunc: PluginNfqueueClientHandler},
+			{Name: pluginName + serverSuffix, Priority: dispatch.RevDNSPriority, NfqueueFunc: PluginNfqueueServerHandler},
+		},
+	}))
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
 	reverseTable = make(map[string]*ReverseHolder)
+	dispatch.InsertShedder(pluginName, shedReverseTable)
 	go cleanupTask()
-	dispatch.InsertNfqueueSubscription(pluginName+clientSuffix, dispatch.RevDNSPriority, PluginNfqueueClientHandler)
-	dispatch.InsertNfqueueSubscription(pluginName+serverSuffix, dispatch.RevDNSPriority, PluginNfqueueServerHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down.
 func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+	dispatch.RemoveShedder(pluginName)
 
 	shutdownChannel <- true
 
@@ -265,6 +279,18 @@ func cleanReverseTable() {
 	logger.Debug("cleanReverseTable REMOVED:%d REMAINING:%d\n", counter, len(reverseTable))
 }
 
+// shedReverseTable empties the reverse table when memory is running low
+func shedReverseTable(level int) {
+	if level < dispatch.ShedCaches {
+		return
+	}
+
+	reverseMutex.Lock()
+	logger.Notice("Shedding %d addresses from the reverse DNS cache\n", len(reverseTable))
+	reverseTable = make(map[string]*ReverseHolder)
+	reverseMutex.Unlock()
+}
+
 // periodic task to clean the address table
 func cleanupTask() {
 	for {
@@ -0,0 +1,409 @@
+// Package rules provides the "rules" plugin
+// The rules plugin evaluates admin defined rules from the settings against each
+// session. A rule is a list of conditions that match against the session tuple
+// and any session attachment (geoip country, classification, SNI, etc.) and an
+// action that will tag, bypass, drop, or log the session. The rules are
+// reloaded whenever the settings change so no code changes are required.
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/policy"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const pluginName = "rules"
+
+// the number of packets to inspect while waiting for rule conditions that depend
+// on details like the classification that aren't known until later in a session
+const defaultMaxPackets = 10
+
+// ruleAction is the action performed when a rule matches
+type ruleAction struct {
+	action string
+	field  string
+	value  string
+}
+
+// sessionRule holds a single rule from the settings
+type sessionRule struct {
+	ruleID     string
+	conditions []*policy.Condition
+	action     ruleAction
+}
+
+// ruleSet holds all of the rules from the settings
+type ruleSet struct {
+	rules      []*sessionRule
+	maxPackets uint64
+}
+
+// DryRunMatch is a rule that matched a session in a dry run
+type DryRunMatch struct {
+	RuleID string `json:"ruleId"`
+	Action string `json:"action"`
+	Field  string `json:"field,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+// DryRunResult holds the rules that matched a session in a dry run along
+// with how each rule was evaluated
+type DryRunResult struct {
+	Matches []DryRunMatch      `json:"matches"`
+	Trace   []policy.RuleTrace `json:"trace"`
+}
+
+var currentRules *ruleSet
+var rulesLocker sync.RWMutex
+
+// init registers the plugin with the plugin registry and the rule events table with
+// the reports schema registry. The policy, application control, SNI filter and
+// rate limit blocks are logged to the same table.
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "rule_events",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "session_id", Type: "int8"},
+			{Name: "rule_id", Type: "text"},
+			{Name: "action", Type: "text"},
+			{Name: "ip_protocol", Type: "int"},
+			{Name: "client_address", Type: "text"},
+			{Name: "client_port", Type: "int2"},
+			{Name: "server_address", Type: "text"},
+			{Name: "server_port", Type: "int2"},
+		},
+		TrimPercent: .1,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.RulesPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	loadRules()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadRules()
+	}
+}
+
+// PluginNfqueueHandler is called to handle nfqueue packet data. We evaluate
+// every rule that has not already matched the session, and keep looking at
+// packets until every rule has matched or we reach the packet limit.
+func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	if mess.Session == nil {
+		return result
+	}
+
+	rulesLocker.RLock()
+	current := currentRules
+	rulesLocker.RUnlock()
+
+	if current == nil || len(current.rules) == 0 {
+		return result
+	}
+
+	// once a drop rule has matched we drop every packet for the session
+	if mess.Session.GetAttachment("rules_drop") != nil {
+		result.SessionRelease = false
+		result.PacketDrop = true
+		return result
+	}
+
+	pending := 0
+	now := time.Now()
+	fields := func(name string) (string, bool) {
+		return dispatch.GetSessionField(mess, name)
+	}
+
+	for _, rule := range current.rules {
+		key := "rules_matched_" + rule.ruleID
+		if mess.Session.GetAttachment(key) != nil {
+			continue
+		}
+
+		if state, _ := rule.evaluate(fields, now); state != policy.ResultMatched {
+			pending++
+			continue
+		}
+
+		mess.Session.PutAttachment(key, true)
+		logger.Debug("Rule %s matched ctid:%d action:%s\n", rule.ruleID, ctid, rule.action.action)
+		overseer.AddCounter("rules_"+rule.action.action, 1)
+
+		switch rule.action.action {
+		case "tag":
+			mess.Session.PutAttachment(rule.action.field, rule.action.value)
+			dict.AddSessionEntry(ctid, rule.action.field, rule.action.value)
+		case "bypass":
+			dict.AddSessionEntry(ctid, "bypass_packetd", true)
+			logEvent(mess, rule)
+			return result
+		case "drop":
+			mess.Session.PutAttachment("rules_drop", rule.ruleID)
+			logEvent(mess, rule)
+			result.SessionRelease = false
+			result.PacketDrop = true
+			return result
+		case "log":
+			logEvent(mess, rule)
+		}
+	}
+
+	if pending != 0 && mess.Session.GetPacketCount() < current.maxPackets {
+		result.SessionRelease = false
+	}
+
+	return result
+}
+
+// evaluate returns the result of evaluating the rule conditions and the field
+// of the first condition that did not match or is not known
+func (rule *sessionRule) evaluate(fields policy.FieldFunc, now time.Time) (string, string) {
+	for _, cond := range rule.conditions {
+		matched, found := cond.Evaluate(fields, now)
+		if !found {
+			return policy.ResultUnknown, cond.Field
+		}
+		if !matched {
+			return policy.ResultFailed, cond.Field
+		}
+	}
+	return policy.ResultMatched, ""
+}
+
+// DryRun evaluates the rules against the argumented field values and returns
+// the rules that would match. Fields that are not given never match. When
+// candidate is not nil it is compiled and evaluated instead of the active
+// rules so changes can be tested before they are saved.
+func DryRun(candidate interface{}, values map[string]string, now time.Time) (DryRunResult, error) {
+	result := DryRunResult{Matches: []DryRunMatch{}, Trace: []policy.RuleTrace{}}
+
+	rulesLocker.RLock()
+	current := currentRules
+	rulesLocker.RUnlock()
+
+	if candidate != nil {
+		item, ok := candidate.(map[string]interface{})
+		if !ok {
+			return result, errInvalid("rules")
+		}
+		current = &ruleSet{maxPackets: defaultMaxPackets}
+		if problems := compileRules(current, item); len(problems) != 0 {
+			return result, problems[0]
+		}
+	}
+
+	if current == nil {
+		return result, nil
+	}
+
+	fields := func(name string) (string, bool) {
+		value, found := values[name]
+		return value, found
+	}
+
+	for _, rule := range current.rules {
+		state, field := rule.evaluate(fields, now)
+		result.Trace = append(result.Trace, policy.RuleTrace{RuleID: rule.ruleID, Result: state, Field: field})
+		if state != policy.ResultMatched {
+			continue
+		}
+
+		result.Matches = append(result.Matches, DryRunMatch{RuleID: rule.ruleID, Action: rule.action.action, Field: rule.action.field, Value: rule.action.value})
+
+		// bypass and drop end the rule processing for a session
+		if rule.action.action == "bypass" || rule.action.action == "drop" {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// logEvent logs a rule match to the rule_events table
+func logEvent(mess dispatch.NfqueueMessage, rule *sessionRule) {
+	tuple := mess.Session.GetClientSideTuple()
+
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"session_id":     mess.Session.GetSessionID(),
+		"rule_id":        rule.ruleID,
+		"action":         rule.action.action,
+		"ip_protocol":    tuple.Protocol,
+		"client_address": tuple.ClientAddress,
+		"client_port":    tuple.ClientPort,
+		"server_address": tuple.ServerAddress,
+		"server_port":    tuple.ServerPort,
+	}
+
+	reports.LogEvent(reports.CreateEvent("rule_match", "rule_events", 1, columns, nil))
+}
+
+// loadRules loads and compiles the rules from the settings
+func loadRules() {
+	fresh := &ruleSet{maxPackets: defaultMaxPackets}
+
+	rulesJSON, err := settings.GetCurrentSettings([]string{"plugins", "rules"})
+	if rulesJSON == nil || err != nil {
+		logger.Info("No session rules found in settings\n")
+		setRules(fresh)
+		return
+	}
+
+	item, ok := rulesJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid session rules settings: %T\n", rulesJSON)
+		setRules(fresh)
+		return
+	}
+
+	for _, problem := range compileRules(fresh, item) {
+		logger.Warn("Ignoring invalid session %v\n", problem)
+	}
+
+	logger.Info("Loaded %d session rules\n", len(fresh.rules))
+	setRules(fresh)
+}
+
+// compileRules compiles the rules from the settings. Invalid rules are skipped
+// and returned as errors.
+func compileRules(fresh *ruleSet, item map[string]interface{}) []error {
+	var problems []error
+
+	if value, ok := item["maxPackets"].(float64); ok && value > 0 {
+		fresh.maxPackets = uint64(value)
+	}
+
+	ruleSlice, _ := item["rules"].([]interface{})
+	for index, value := range ruleSlice {
+		rule, err := parseRule(value, index)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("rule %d: %v", index, err))
+			continue
+		}
+		if rule != nil {
+			fresh.rules = append(fresh.rules, rule)
+		}
+	}
+
+	return problems
+}
+
+// setRules replaces the active rule set
+func setRules(fresh *ruleSet) {
+	rulesLocker.Lock()
+	currentRules = fresh
+	rulesLocker.Unlock()
+}
+
+// parseRule converts a rule from the settings. It returns nil without an error for disabled rules.
+func parseRule(value interface{}, index int) (*sessionRule, error) {
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errInvalid("rule")
+	}
+
+	if enabled, found := item["enabled"].(bool); found && !enabled {
+		return nil, nil
+	}
+
+	rule := &sessionRule{ruleID: strconv.Itoa(index)}
+	switch id := item["ruleId"].(type) {
+	case string:
+		rule.ruleID = id
+	case float64:
+		rule.ruleID = strconv.Itoa(int(id))
+	}
+
+	condSlice, _ := item["conditions"].([]interface{})
+	for _, entry := range condSlice {
+		cond, err := policy.ParseCondition(entry)
+		if err != nil {
+			return nil, err
+		}
+		rule.conditions = append(rule.conditions, cond)
+	}
+
+	actionMap, ok := item["action"].(map[string]interface{})
+	if !ok {
+		return nil, errInvalid("action")
+	}
+
+	rule.action.action, _ = actionMap["type"].(string)
+	rule.action.field, _ = actionMap["field"].(string)
+	rule.action.value = toString(actionMap["value"])
+
+	switch rule.action.action {
+	case "tag":
+		if rule.action.field == "" {
+			return nil, errInvalid("tag field")
+		}
+	case "bypass", "drop", "log":
+	default:
+		return nil, errInvalid("action type " + rule.action.action)
+	}
+
+	return rule, nil
+}
+
+// toString converts a settings value to a string
+func toString(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return value.(string)
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value.(bool))
+	}
+	return ""
+}
+
+// ruleError is returned for invalid rules
+type ruleError struct {
+	what string
+}
+
+func (e *ruleError) Error() string {
+	return "invalid " + e.what
+}
+
+// errInvalid returns an error for an invalid part of a rule
+func errInvalid(what string) error {
+	return &ruleError{what: what}
+}
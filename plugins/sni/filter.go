@@ -0,0 +1,270 @@
+package sni
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the actions for the hostname rules
+const (
+	actionAllow = "allow"
+	actionBlock = "block"
+)
+
+// the ways a rule can match the hostname
+const (
+	matchExact    = "exact"
+	matchWildcard = "wildcard"
+	matchRegex    = "regex"
+)
+
+// the session attachment set when a session is blocked
+const blockedAttachment = "sni_blocked"
+
+// filterRule holds a single hostname rule from the settings. The hostname is
+// compared without case, and a wildcard can use * for any number of
+// characters and ? for a single character.
+type filterRule struct {
+	ruleID   string
+	action   string
+	match    string
+	hostname string
+	pattern  *regexp.Regexp
+	hits     uint64
+}
+
+// filterSet holds the hostname rules and the action used when none match
+type filterSet struct {
+	rules         []*filterRule
+	defaultAction string
+	defaultHits   uint64
+}
+
+// FilterRuleStatus holds a hostname rule and the number of times it matched
+type FilterRuleStatus struct {
+	RuleID   string `json:"ruleId"`
+	Action   string `json:"action"`
+	Match    string `json:"match"`
+	Hostname string `json:"hostname"`
+	Hits     uint64 `json:"hits"`
+}
+
+// FilterStatus holds the hostname rules and the hit counters
+type FilterStatus struct {
+	DefaultAction string             `json:"defaultAction"`
+	DefaultHits   uint64             `json:"defaultHits"`
+	Rules         []FilterRuleStatus `json:"rules"`
+}
+
+var currentFilter *filterSet
+var filterLocker sync.RWMutex
+
+// loadFilter loads and compiles the hostname rules from the settings
+func loadFilter() {
+	fresh := &filterSet{defaultAction: actionAllow}
+
+	filterJSON, err := settings.GetCurrentSettings([]string{"plugins", "sni"})
+	if filterJSON != nil && err == nil {
+		item, ok := filterJSON.(map[string]interface{})
+		if ok {
+			for _, problem := range compileFilter(fresh, item) {
+				logger.Warn("Ignoring invalid SNI %v\n", problem)
+			}
+		} else {
+			logger.Warn("Invalid SNI settings: %T\n", filterJSON)
+		}
+	}
+
+	logger.Info("Loaded %d SNI rules default:%s\n", len(fresh.rules), fresh.defaultAction)
+
+	filterLocker.Lock()
+	currentFilter = fresh
+	filterLocker.Unlock()
+}
+
+// compileFilter compiles the hostname rules from the settings. Invalid rules
+// are skipped and returned as errors.
+func compileFilter(fresh *filterSet, item map[string]interface{}) []error {
+	var problems []error
+
+	if value, ok := item["defaultAction"].(string); ok {
+		if value == actionAllow || value == actionBlock {
+			fresh.defaultAction = value
+		} else {
+			problems = append(problems, fmt.Errorf("default action: %s", value))
+		}
+	}
+
+	ruleSlice, _ := item["rules"].([]interface{})
+	for index, value := range ruleSlice {
+		rule, err := parseFilterRule(value, index)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("rule %d: %v", index, err))
+			continue
+		}
+		fresh.rules = append(fresh.rules, rule)
+	}
+
+	return problems
+}
+
+// parseFilterRule returns the rule from a settings object
+func parseFilterRule(value interface{}, index int) (*filterRule, error) {
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an object")
+	}
+
+	rule := &filterRule{match: matchExact}
+	rule.ruleID, _ = item["id"].(string)
+	rule.action, _ = item["action"].(string)
+	rule.hostname, _ = item["hostname"].(string)
+	if match, ok := item["match"].(string); ok {
+		rule.match = match
+	}
+
+	if rule.ruleID == "" {
+		rule.ruleID = fmt.Sprintf("%d", index)
+	}
+	if rule.action != actionAllow && rule.action != actionBlock {
+		return nil, fmt.Errorf("invalid action: %s", rule.action)
+	}
+	if rule.hostname == "" {
+		return nil, fmt.Errorf("missing hostname")
+	}
+
+	var err error
+	switch rule.match {
+	case matchExact:
+		rule.hostname = strings.ToLower(rule.hostname)
+	case matchWildcard:
+		rule.pattern, err = compileWildcard(rule.hostname)
+	case matchRegex:
+		rule.pattern, err = regexp.Compile("(?i)" + rule.hostname)
+	default:
+		return nil, fmt.Errorf("invalid match: %s", rule.match)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// compileWildcard returns a regular expression that matches the whole hostname against a wildcard
+func compileWildcard(wildcard string) (*regexp.Regexp, error) {
+	expression := regexp.QuoteMeta(strings.ToLower(wildcard))
+	expression = strings.Replace(expression, `\*`, `.*`, -1)
+	expression = strings.Replace(expression, `\?`, `.`, -1)
+	return regexp.Compile("(?i)^" + expression + "$")
+}
+
+// checkFilter returns true if the session should be blocked. The first rule
+// that matches the hostname decides, so allow rules placed before the block
+// rules make exceptions to them. A session without a hostname only matches
+// the default action.
+func checkFilter(mess dispatch.NfqueueMessage, ctid uint32, hostname string) bool {
+	filterLocker.RLock()
+	filter := currentFilter
+	filterLocker.RUnlock()
+	if filter == nil {
+		return false
+	}
+
+	action := filter.defaultAction
+	ruleID := "default"
+	matched := false
+
+	for _, rule := range filter.rules {
+		if hostname != "" && rule.matches(hostname) {
+			atomic.AddUint64(&rule.hits, 1)
+			action = rule.action
+			ruleID = rule.ruleID
+			matched = true
+			break
+		}
+	}
+
+	if !matched {
+		atomic.AddUint64(&filter.defaultHits, 1)
+		// nothing to log when the default lets the session through
+		if action == actionAllow {
+			return false
+		}
+	}
+
+	logger.Debug("SNI %s rule %s %s ctid:%d\n", action, ruleID, hostname, ctid)
+	overseer.AddCounter("sni_"+action, 1)
+	logFilterEvent(mess.Session, ruleID, action)
+
+	if action != actionBlock {
+		return false
+	}
+
+	mess.Session.PutAttachment(blockedAttachment, ruleID)
+	dict.AddSessionEntry(ctid, blockedAttachment, true)
+	return true
+}
+
+// matches returns true if the rule matches the hostname
+func (rule *filterRule) matches(hostname string) bool {
+	if rule.pattern != nil {
+		return rule.pattern.MatchString(hostname)
+	}
+	return strings.ToLower(hostname) == rule.hostname
+}
+
+// GetFilterStatus returns the hostname rules and the hit counters
+func GetFilterStatus() FilterStatus {
+	status := FilterStatus{Rules: []FilterRuleStatus{}}
+
+	filterLocker.RLock()
+	filter := currentFilter
+	filterLocker.RUnlock()
+	if filter == nil {
+		return status
+	}
+
+	status.DefaultAction = filter.defaultAction
+	status.DefaultHits = atomic.LoadUint64(&filter.defaultHits)
+	for _, rule := range filter.rules {
+		status.Rules = append(status.Rules, FilterRuleStatus{
+			RuleID:   rule.ruleID,
+			Action:   rule.action,
+			Match:    rule.match,
+			Hostname: rule.hostname,
+			Hits:     atomic.LoadUint64(&rule.hits),
+		})
+	}
+	return status
+}
+
+// logFilterEvent logs a hostname rule decision to the rule_events table
+func logFilterEvent(session *dispatch.Session, ruleID string, action string) {
+	tuple := session.GetClientSideTuple()
+
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"session_id":     session.GetSessionID(),
+		"rule_id":        "sni_" + ruleID,
+		"action":         action,
+		"ip_protocol":    tuple.Protocol,
+		"client_address": tuple.ClientAddress,
+		"client_port":    tuple.ClientPort,
+		"server_address": tuple.ServerAddress,
+		"server_port":    tuple.ServerPort,
+	}
+
+	reports.LogEvent(reports.CreateEvent("sni_"+action, "rule_events", 1, columns, nil))
+}
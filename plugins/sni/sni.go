@@ -1,19 +1,35 @@
 package sni
 
 import (
+	"syscall"
+
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
 	"github.com/untangle/packetd/services/reports"
 )
 
 const pluginName = "sni"
 const maxPacketCount = 10
 
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.SniPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.SniPriority, PluginNfqueueHandler)
+	loadFilter()
 }
 
 // PluginShutdown function called when the daemon is shutting down.
@@ -21,9 +37,20 @@ func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
 }
 
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadFilter()
+	}
+}
+
 // PluginNfqueueHandler is called to handle nfqueue packet data. We only
 // look at traffic with port 443 as destination. When detected, we look
 // for a TLS ClientHello packet from which we extract the SNI hostname
+// and check it against the hostname rules. A blocked session has the
+// ClientHello and every later packet dropped so the handshake never
+// completes.
 func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
 	var result dispatch.NfqueueResult
 	result.SessionRelease = false
@@ -42,6 +69,12 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		return result
 	}
 
+	// once a session is blocked we keep dropping the retransmissions
+	if mess.Session.GetAttachment(blockedAttachment) != nil {
+		result.PacketDrop = true
+		return result
+	}
+
 	// Look for SNI hostname in the packet and get the release flag
 	// The extract function will set the release once it finds a valid
 	// ClientHello, but hostname could still be nil if SNI isn't found
@@ -52,10 +85,20 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		logger.Debug("Extracted SNI %s ctid:%d\n", hostname, ctid)
 		dict.AddSessionEntry(ctid, "ssl_sni", hostname)
 		logEvent(mess.Session, hostname)
+		if checkFilter(mess, ctid, hostname) {
+			result.PacketDrop = true
+			return result
+		}
 		result.SessionRelease = true
 		return result
 	}
 
+	// a ClientHello without a hostname only matches the default action
+	if release && checkFilter(mess, ctid, "") {
+		result.PacketDrop = true
+		return result
+	}
+
 	// release the session if we don't find SNI in the first few packets
 	if mess.Session.GetPacketCount() >= maxPacketCount {
 		logger.Debug("Exceeded SNI packet limit ctid:%d\n", ctid)
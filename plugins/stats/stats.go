@@ -15,8 +15,10 @@ import (
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
 	"github.com/untangle/packetd/services/reports"
 	"github.com/untangle/packetd/services/settings"
+	"github.com/untangle/packetd/services/zones"
 )
 
 const pluginName = "stats"
@@ -61,6 +63,92 @@ type interfaceMetric struct {
 	lastPingTimeout uint64
 }
 
+// WanQuality holds the current link quality details for a WAN interface
+type WanQuality struct {
+	InterfaceID  int
+	DeviceName   string
+	Latency      float64
+	Jitter       float64
+	PingTimeouts uint64
+	ActiveProbe  bool
+}
+
+// init registers the plugin with the plugin registry and the interface stats table with
+// the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "interface_stats",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "interface_id", Type: "int1"},
+			{Name: "device_name", Type: "text"},
+			{Name: "zone", Type: "text"},
+			{Name: "latency_1", Type: "real"},
+			{Name: "latency_5", Type: "real"},
+			{Name: "latency_15", Type: "real"},
+			{Name: "latency_variance", Type: "real"},
+			{Name: "passive_latency_1", Type: "real"},
+			{Name: "passive_latency_5", Type: "real"},
+			{Name: "passive_latency_15", Type: "real"},
+			{Name: "passive_latency_variance", Type: "real"},
+			{Name: "active_latency_1", Type: "real"},
+			{Name: "active_latency_5", Type: "real"},
+			{Name: "active_latency_15", Type: "real"},
+			{Name: "active_latency_variance", Type: "real"},
+			{Name: "jitter_1", Type: "real"},
+			{Name: "jitter_5", Type: "real"},
+			{Name: "jitter_15", Type: "real"},
+			{Name: "jitter_variance", Type: "real"},
+			{Name: "ping_timeout", Type: "int8"},
+			{Name: "ping_timeout_rate", Type: "int8"},
+			{Name: "rx_bytes", Type: "int8"},
+			{Name: "rx_bytes_rate", Type: "int8"},
+			{Name: "rx_packets", Type: "int8"},
+			{Name: "rx_packets_rate", Type: "int8"},
+			{Name: "rx_errs", Type: "int8"},
+			{Name: "rx_errs_rate", Type: "int8"},
+			{Name: "rx_drop", Type: "int8"},
+			{Name: "rx_drop_rate", Type: "int8"},
+			{Name: "rx_fifo", Type: "int8"},
+			{Name: "rx_fifo_rate", Type: "int8"},
+			{Name: "rx_frame", Type: "int8"},
+			{Name: "rx_frame_rate", Type: "int8"},
+			{Name: "rx_compressed", Type: "int8"},
+			{Name: "rx_compressed_rate", Type: "int8"},
+			{Name: "rx_multicast", Type: "int8"},
+			{Name: "rx_multicast_rate", Type: "int8"},
+			{Name: "tx_bytes", Type: "int8"},
+			{Name: "tx_bytes_rate", Type: "int8"},
+			{Name: "tx_packets", Type: "int8"},
+			{Name: "tx_packets_rate", Type: "int8"},
+			{Name: "tx_errs", Type: "int8"},
+			{Name: "tx_errs_rate", Type: "int8"},
+			{Name: "tx_drop", Type: "int8"},
+			{Name: "tx_drop_rate", Type: "int8"},
+			{Name: "tx_fifo", Type: "int8"},
+			{Name: "tx_fifo_rate", Type: "int8"},
+			{Name: "tx_colls", Type: "int8"},
+			{Name: "tx_colls_rate", Type: "int8"},
+			{Name: "tx_carrier", Type: "int8"},
+			{Name: "tx_carrier_rate", Type: "int8"},
+			{Name: "tx_compressed", Type: "int8"},
+			{Name: "tx_compressed_rate", Type: "int8"},
+		},
+		TrimPercent: .1,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.StatsPriority, NfqueueFunc: PluginNfqueueHandler},
+		},
+	}))
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
@@ -85,7 +173,6 @@ func PluginStartup() {
 	go interfaceTask()
 	go pingerTask()
 
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.StatsPriority, PluginNfqueueHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down.
@@ -317,6 +404,7 @@ func logInterfaceStats(seconds uint64, interfaceID int, combo Collector, passive
 		"time_stamp":               time.Now(),
 		"interface_id":             interfaceID,
 		"device_name":              diffInfo.Iface,
+		"zone":                     zones.GetInterfaceZone(interfaceID),
 		"latency_1":                combo.Latency1Min.Value,
 		"latency_5":                combo.Latency5Min.Value,
 		"latency_15":               combo.Latency15Min.Value,
@@ -670,3 +758,41 @@ func GetInterfaceRateDetails(facename string) map[string]uint64 {
 	retmap["tx_compressed_rate"] = diffInfo.TxCompressed / interfaceStatLogIntervalSec
 	return retmap
 }
+
+// GetWanQualityList returns the current link quality details for all WAN interfaces.
+// The latency and jitter values are the one minute averages and the ping timeout
+// value is the running total since startup, so callers that want a rate must
+// track the difference between calls.
+func GetWanQualityList() []WanQuality {
+	var list []WanQuality
+
+	interfaceDetailLocker.RLock()
+	for _, item := range interfaceDetailMap {
+		if !item.wanFlag {
+			continue
+		}
+		if item.interfaceID < 0 || item.interfaceID > 255 {
+			continue
+		}
+		list = append(list, WanQuality{InterfaceID: item.interfaceID, DeviceName: item.deviceName, ActiveProbe: item.pingMode != protoIGNORE})
+	}
+	interfaceDetailLocker.RUnlock()
+
+	for x := range list {
+		id := list[x].InterfaceID
+
+		statsLocker[id].Lock()
+		list[x].Latency = statsCollector[id].Latency1Min.Value
+		statsLocker[id].Unlock()
+
+		jitterLocker[id].Lock()
+		list[x].Jitter = jitterCollector[id].Latency1Min.Value
+		jitterLocker[id].Unlock()
+
+		interfaceMetricLocker.Lock()
+		list[x].PingTimeouts = interfaceMetricList[id].PingTimeout
+		interfaceMetricLocker.Unlock()
+	}
+
+	return list
+}
@@ -0,0 +1,182 @@
+// Package trafficmatrix provides the "trafficmatrix" plugin
+// The traffic matrix plugin adds up the bytes passed by each session for every
+// pair of client and server country and autonomous system, and periodically
+// writes the totals to the hourly traffic_matrix table. The country and ASN
+// come from the session attachments the geoip plugin sets, so the matrix can
+// be reported without aggregating the individual session rows.
+package trafficmatrix
+
+import (
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/reports"
+)
+
+const pluginName = "trafficmatrix"
+const matrixLogIntervalSec = 60
+
+// matrixKey identifies a cell of the traffic matrix
+type matrixKey struct {
+	clientCountry string
+	clientASN     uint
+	serverCountry string
+	serverASN     uint
+}
+
+// matrixHolder is used to accumulate the byte counts for each cell
+type matrixHolder struct {
+	clientBytes uint64
+	serverBytes uint64
+}
+
+var matrixTable map[matrixKey]*matrixHolder
+var matrixMutex sync.Mutex
+var shutdownChannel = make(chan bool)
+
+// init registers the plugin with the plugin registry and the traffic matrix
+// table with the reports schema registry. The table has one row per hour for
+// each pair of client and server country and ASN and is updated in place by
+// upsert events.
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "traffic_matrix",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "client_country", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "client_asn", Type: "int8 NOT NULL DEFAULT 0"},
+			{Name: "server_country", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "server_asn", Type: "int8 NOT NULL DEFAULT 0"},
+			{Name: "bytes", Type: "int8"},
+			{Name: "client_bytes", Type: "int8"},
+			{Name: "server_bytes", Type: "int8"},
+		},
+		Unique:      []string{"time_stamp", "client_country", "client_asn", "server_country", "server_asn"},
+		TrimPercent: .1,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: 2, ConntrackFunc: PluginConntrackHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	matrixTable = make(map[matrixKey]*matrixHolder)
+	go matrixTask()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of matrixTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown matrixTask\n")
+	}
+
+	// write whatever we collected since the last interval
+	logMatrixStats()
+}
+
+// PluginConntrackHandler receives conntrack events and adds the byte counts
+// for each session to the totals for the country and ASN pair of the session
+func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
+	if message != 'U' {
+		return
+	}
+
+	if entry.ClientBytesDiff == 0 && entry.ServerBytesDiff == 0 {
+		return
+	}
+
+	entry.Guardian.RLock()
+	session := entry.Session
+	clientBytes := entry.ClientBytesDiff
+	serverBytes := entry.ServerBytesDiff
+	entry.Guardian.RUnlock()
+
+	// sessions the geoip plugin hasn't seen are counted as unknown
+	key := matrixKey{clientCountry: "XU", serverCountry: "XU"}
+	if session != nil {
+		key.clientCountry = getCountry(session, "client_country")
+		key.serverCountry = getCountry(session, "server_country")
+		key.clientASN, _ = session.GetAttachment("client_asn").(uint)
+		key.serverASN, _ = session.GetAttachment("server_asn").(uint)
+	}
+
+	matrixMutex.Lock()
+	holder := matrixTable[key]
+	if holder == nil {
+		holder = &matrixHolder{}
+		matrixTable[key] = holder
+	}
+	holder.clientBytes += clientBytes
+	holder.serverBytes += serverBytes
+	matrixMutex.Unlock()
+}
+
+// getCountry returns a country attachment of a session or XU if it isn't set
+func getCountry(session *dispatch.Session, name string) string {
+	country, _ := session.GetAttachment(name).(string)
+	if country == "" {
+		return "XU"
+	}
+	return country
+}
+
+// matrixTask periodically writes the traffic matrix totals to the database
+func matrixTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(time.Second * time.Duration(matrixLogIntervalSec)):
+			logMatrixStats()
+		}
+	}
+}
+
+// logMatrixStats adds the accumulated byte counts of each cell to the row
+// of the current hour in the traffic matrix table
+func logMatrixStats() {
+	matrixMutex.Lock()
+	current := matrixTable
+	matrixTable = make(map[matrixKey]*matrixHolder)
+	matrixMutex.Unlock()
+
+	hour := time.Now().Truncate(time.Hour)
+
+	for key, holder := range current {
+		columns := map[string]interface{}{
+			"time_stamp":     hour,
+			"client_country": key.clientCountry,
+			"client_asn":     key.clientASN,
+			"server_country": key.serverCountry,
+			"server_asn":     key.serverASN,
+		}
+
+		modifiedColumns := map[string]interface{}{
+			"client_bytes": holder.clientBytes,
+			"server_bytes": holder.serverBytes,
+			"bytes":        holder.clientBytes + holder.serverBytes,
+		}
+
+		reports.LogEvent(reports.CreateEvent("traffic_matrix", "traffic_matrix", 3, columns, modifiedColumns))
+	}
+}
@@ -0,0 +1,165 @@
+// Package usage provides the "usage" plugin
+// The usage plugin adds up the bytes passed by each session for every local
+// client device and periodically writes the totals to the daily and monthly
+// usage tables. Devices are identified by MAC address using the device inventory
+// so the totals follow a device across address changes.
+package usage
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/inventory"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/reports"
+)
+
+const pluginName = "usage"
+const usageLogIntervalSec = 60
+
+// usageHolder is used to accumulate the byte counts for each client address
+type usageHolder struct {
+	address     net.IP
+	clientBytes uint64
+	serverBytes uint64
+}
+
+var usageTable map[string]*usageHolder
+var usageMutex sync.Mutex
+var shutdownChannel = make(chan bool)
+
+// init registers the plugin with the plugin registry
+func init() {
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: 2, ConntrackFunc: PluginConntrackHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	usageTable = make(map[string]*usageHolder)
+	go usageTask()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of usageTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown usageTask\n")
+	}
+
+	// write whatever we collected since the last interval
+	logUsageStats()
+}
+
+// PluginConntrackHandler receives conntrack events and adds the byte counts
+// for each session to the totals for the client address
+func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
+	if message != 'U' {
+		return
+	}
+
+	if entry.ClientBytesDiff == 0 && entry.ServerBytesDiff == 0 {
+		return
+	}
+
+	entry.Guardian.RLock()
+	address := entry.ClientSideTuple.ClientAddress
+	clientBytes := entry.ClientBytesDiff
+	serverBytes := entry.ServerBytesDiff
+	entry.Guardian.RUnlock()
+
+	if address == nil {
+		return
+	}
+
+	key := address.String()
+
+	usageMutex.Lock()
+	holder := usageTable[key]
+	if holder == nil {
+		holder = &usageHolder{address: address}
+		usageTable[key] = holder
+	}
+	holder.clientBytes += clientBytes
+	holder.serverBytes += serverBytes
+	usageMutex.Unlock()
+}
+
+// usageTask periodically writes the usage totals to the database
+func usageTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(time.Second * time.Duration(usageLogIntervalSec)):
+			logUsageStats()
+		}
+	}
+}
+
+// logUsageStats resolves the device for each client address and adds the
+// accumulated byte counts to the daily and monthly usage tables
+func logUsageStats() {
+	usageMutex.Lock()
+	current := usageTable
+	usageTable = make(map[string]*usageHolder)
+	usageMutex.Unlock()
+
+	now := time.Now()
+
+	for _, holder := range current {
+		var hostname string
+		var mac string
+
+		// we only track local devices so traffic from clients we can't
+		// find in the inventory or the neighbor table is ignored
+		device := inventory.FindDeviceByAddress(holder.address)
+		if device != nil {
+			mac = device.MacAddress
+			hostname = device.Hostname
+		} else if hwaddr := inventory.LookupMacAddress(holder.address); hwaddr != nil {
+			mac = hwaddr.String()
+		} else {
+			logger.Trace("Ignoring usage for non-local address %v\n", holder.address)
+			continue
+		}
+
+		for _, period := range []string{"daily", "monthly"} {
+			columns := map[string]interface{}{
+				"time_stamp":  reports.GetUsagePeriodStart(period, now),
+				"mac_address": mac,
+			}
+
+			modifiedColumns := map[string]interface{}{
+				"address":      holder.address,
+				"client_bytes": holder.clientBytes,
+				"server_bytes": holder.serverBytes,
+				"bytes":        holder.clientBytes + holder.serverBytes,
+			}
+
+			// don't replace a known hostname with an empty one
+			if hostname != "" {
+				modifiedColumns["hostname"] = hostname
+			}
+
+			reports.LogEvent(reports.CreateEvent("usage_"+period, "usage_"+period, 3, columns, modifiedColumns))
+		}
+	}
+}
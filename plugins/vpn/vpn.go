@@ -0,0 +1,357 @@
+// Package vpn provides the "vpn" plugin
+// The vpn plugin recognizes IPsec (IKE, ESP, and NAT-T), OpenVPN, and WireGuard
+// sessions, tags them with the vpn_protocol field, and tracks the number of bytes
+// passed through each tunnel so the totals can be written to the database.
+package vpn
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/reports"
+)
+
+const pluginName = "vpn"
+const maxPacketCount = 8
+const tunnelLogIntervalSec = 60
+
+// the OpenVPN port, where a server reset is trusted without seeing the client
+// session id since tls-crypt encrypts the part of the reply that has it
+const openVPNPort = 1194
+
+// the session attachment holding the session id from an OpenVPN client reset
+const openVPNSessionAttachment = "vpn_openvpn_session"
+
+// the OpenVPN hard reset opcodes
+const (
+	openVPNClientResetV1 = 1
+	openVPNServerResetV1 = 2
+	openVPNClientResetV2 = 7
+	openVPNServerResetV2 = 8
+	openVPNClientResetV3 = 10
+)
+
+// the size of the OpenVPN opcode, session id, ack count, and packet id in a
+// hard reset without tls-auth, which is the smallest a reset can be
+const openVPNMinReset = 14
+
+const (
+	protoESP = 50
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// tunnelHolder is used to accumulate the byte counts for each tunnel
+type tunnelHolder struct {
+	protocol      string
+	clientAddress net.IP
+	serverAddress net.IP
+	clientBytes   uint64
+	serverBytes   uint64
+}
+
+var tunnelTable map[string]*tunnelHolder
+var tunnelMutex sync.Mutex
+var shutdownChannel = make(chan bool)
+
+// init registers the plugin with the plugin registry and the VPN stats table with
+// the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "vpn_stats",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "vpn_protocol", Type: "text"},
+			{Name: "client_address", Type: "text"},
+			{Name: "server_address", Type: "text"},
+			{Name: "bytes", Type: "int8"},
+			{Name: "client_bytes", Type: "int8"},
+			{Name: "server_bytes", Type: "int8"},
+		},
+		TrimPercent: .1,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		Subscriptions: []pluginsdk.Subscription{
+			{Priority: dispatch.VpnPriority, NfqueueFunc: PluginNfqueueHandler},
+			{Priority: 2, ConntrackFunc: PluginConntrackHandler},
+		},
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+	tunnelTable = make(map[string]*tunnelHolder)
+	go tunnelTask()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of tunnelTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown tunnelTask\n")
+	}
+}
+
+// PluginNfqueueHandler is called to handle nfqueue packet data. We check the
+// protocol and ports of each session and look for the OpenVPN and WireGuard
+// handshake signatures in the first few packets. OpenVPN needs the resets in
+// both directions so the session is kept until the server answers.
+func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	if mess.Session == nil {
+		return result
+	}
+
+	protocol := detectProtocol(mess)
+	if protocol != "" {
+		logger.Debug("Detected VPN protocol %s ctid:%d\n", protocol, ctid)
+		mess.Session.PutAttachment("vpn_protocol", protocol)
+		dict.AddSessionEntry(ctid, "vpn_protocol", protocol)
+		logEvent(mess.Session, protocol)
+		return result
+	}
+
+	// keep looking at TCP and UDP sessions until we see enough payload
+	if mess.TCPLayer == nil && mess.UDPLayer == nil {
+		return result
+	}
+
+	if mess.Session.GetPacketCount() < maxPacketCount {
+		result.SessionRelease = false
+	}
+
+	return result
+}
+
+// PluginConntrackHandler receives conntrack events and adds the byte counts
+// for any session we have tagged to the corresponding tunnel totals
+func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
+	if message != 'U' {
+		return
+	}
+
+	entry.Guardian.RLock()
+	defer entry.Guardian.RUnlock()
+
+	if entry.Session == nil {
+		return
+	}
+
+	protocol, ok := entry.Session.GetAttachment("vpn_protocol").(string)
+	if !ok {
+		return
+	}
+
+	tuple := entry.ClientSideTuple
+	key := protocol + "|" + tuple.ClientAddress.String() + "|" + tuple.ServerAddress.String()
+
+	tunnelMutex.Lock()
+	holder := tunnelTable[key]
+	if holder == nil {
+		holder = &tunnelHolder{protocol: protocol, clientAddress: tuple.ClientAddress, serverAddress: tuple.ServerAddress}
+		tunnelTable[key] = holder
+	}
+	holder.clientBytes += entry.ClientBytesDiff
+	holder.serverBytes += entry.ServerBytesDiff
+	tunnelMutex.Unlock()
+}
+
+// detectProtocol returns the VPN protocol name for the packet or an empty string if not recognized
+func detectProtocol(mess dispatch.NfqueueMessage) string {
+	tuple := mess.MsgTuple
+
+	if tuple.Protocol == protoESP {
+		return "ipsec_esp"
+	}
+
+	if tuple.Protocol == protoUDP {
+		if tuple.ServerPort == 500 || tuple.ClientPort == 500 {
+			return "ipsec_ike"
+		}
+		if tuple.ServerPort == 4500 || tuple.ClientPort == 4500 {
+			return "ipsec_natt"
+		}
+		if isWireGuard(mess.Payload) {
+			return "wireguard"
+		}
+		if detectOpenVPN(mess, false) {
+			return "openvpn"
+		}
+	}
+
+	if tuple.Protocol == protoTCP && detectOpenVPN(mess, true) {
+		return "openvpn"
+	}
+
+	return ""
+}
+
+// detectOpenVPN keeps the session id from the client reset and returns true
+// when the server reset answers it
+func detectOpenVPN(mess dispatch.NfqueueMessage, stream bool) bool {
+	if mess.ClientToServer {
+		if id := openVPNClientReset(mess.Payload, stream); id != nil {
+			mess.Session.PutAttachment(openVPNSessionAttachment, id)
+		}
+		return false
+	}
+
+	client, _ := mess.Session.GetAttachment(openVPNSessionAttachment).([]byte)
+	return openVPNServerReset(mess.Payload, stream, client, mess.Session.GetClientSideTuple().ServerPort)
+}
+
+// isWireGuard looks for a WireGuard handshake initiation or response message
+// which start with the message type followed by three reserved zero bytes
+// and have a fixed length of 148 and 92 bytes respectively
+func isWireGuard(buffer []byte) bool {
+	if len(buffer) < 4 {
+		return false
+	}
+	if buffer[1] != 0 || buffer[2] != 0 || buffer[3] != 0 {
+		return false
+	}
+	if buffer[0] == 1 && len(buffer) == 148 {
+		return true
+	}
+	if buffer[0] == 2 && len(buffer) == 92 {
+		return true
+	}
+	return false
+}
+
+// openVPNReset returns the OpenVPN message if the buffer holds a hard reset
+// with one of the argumented opcodes, or nil if it doesn't. The opcode is in
+// the high five bits of the first byte and the key id, which is always zero
+// in a hard reset, in the low three bits. TCP sessions prefix each message
+// with a two byte length field. The session id after the opcode is random so
+// it is never zero.
+func openVPNReset(buffer []byte, stream bool, opcodes ...byte) []byte {
+	if stream {
+		if len(buffer) < 2 {
+			return nil
+		}
+		length := (int(buffer[0]) << 8) + int(buffer[1])
+		if length != len(buffer)-2 {
+			return nil
+		}
+		buffer = buffer[2:]
+	}
+
+	if len(buffer) < openVPNMinReset || buffer[0]&0x07 != 0 {
+		return nil
+	}
+	if bytes.Equal(buffer[1:9], make([]byte, 8)) {
+		return nil
+	}
+
+	for _, opcode := range opcodes {
+		if buffer[0]>>3 == opcode {
+			return buffer
+		}
+	}
+	return nil
+}
+
+// openVPNClientReset returns the session id from an OpenVPN client hard
+// reset or nil if the buffer isn't one. The reset is the first message from
+// the client so it doesn't acknowledge anything and has packet id zero, which
+// are the last five bytes unless tls-crypt encrypts them.
+func openVPNClientReset(buffer []byte, stream bool) []byte {
+	message := openVPNReset(buffer, stream, openVPNClientResetV1, openVPNClientResetV2, openVPNClientResetV3)
+	if message == nil {
+		return nil
+	}
+
+	if len(message) == openVPNMinReset && !bytes.Equal(message[9:], make([]byte, 5)) {
+		return nil
+	}
+
+	id := make([]byte, 8)
+	copy(id, message[1:9])
+	return id
+}
+
+// openVPNServerReset returns true if the buffer is an OpenVPN server hard
+// reset that acknowledges the client reset with the argumented session id.
+// Without the client session id, or when tls-crypt hides it, the server
+// reset is only trusted on the OpenVPN port.
+func openVPNServerReset(buffer []byte, stream bool, client []byte, serverPort uint16) bool {
+	message := openVPNReset(buffer, stream, openVPNServerResetV1, openVPNServerResetV2)
+	if message == nil {
+		return false
+	}
+
+	if client != nil && bytes.Contains(message[9:], client) {
+		return true
+	}
+	return serverPort == openVPNPort
+}
+
+// logEvent logs an update event that updates the vpn_protocol column
+func logEvent(session *dispatch.Session, protocol string) {
+	columns := map[string]interface{}{
+		"session_id": session.GetSessionID(),
+	}
+
+	modifiedColumns := make(map[string]interface{})
+	modifiedColumns["vpn_protocol"] = protocol
+
+	reports.LogEvent(reports.CreateEvent("session_vpn", "sessions", 2, columns, modifiedColumns))
+}
+
+// tunnelTask periodically writes the tunnel byte counts to the database
+func tunnelTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(time.Second * time.Duration(tunnelLogIntervalSec)):
+			logTunnelStats()
+		}
+	}
+}
+
+// logTunnelStats logs and resets the accumulated byte counts for every tunnel
+func logTunnelStats() {
+	tunnelMutex.Lock()
+	current := tunnelTable
+	tunnelTable = make(map[string]*tunnelHolder)
+	tunnelMutex.Unlock()
+
+	for _, holder := range current {
+		if holder.clientBytes == 0 && holder.serverBytes == 0 {
+			continue
+		}
+		columns := map[string]interface{}{
+			"time_stamp":     time.Now(),
+			"vpn_protocol":   holder.protocol,
+			"client_address": holder.clientAddress,
+			"server_address": holder.serverAddress,
+			"client_bytes":   holder.clientBytes,
+			"server_bytes":   holder.serverBytes,
+			"bytes":          holder.clientBytes + holder.serverBytes,
+		}
+		reports.LogEvent(reports.CreateEvent("vpn_stat", "vpn_stats", 1, columns, nil))
+	}
+}
@@ -0,0 +1,98 @@
+package vpn
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func decode(t *testing.T, text string) []byte {
+	data, err := hex.DecodeString(text)
+	if err != nil {
+		t.Fatalf("invalid hex %s: %v", text, err)
+	}
+	return data
+}
+
+func TestOpenVPN(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     string
+		server     string
+		stream     bool
+		serverPort uint16
+		expected   bool
+	}{
+		{
+			name:       "udp reset",
+			client:     "38" + "1122334455667788" + "00" + "00000000",
+			server:     "40" + "8877665544332211" + "01" + "00000000" + "1122334455667788" + "00000000",
+			serverPort: 51820,
+			expected:   true,
+		},
+		{
+			name:       "udp reset with tls-auth",
+			client:     "38" + "1122334455667788" + "0102030405060708090a0b0c0d0e0f1011121314" + "00000001" + "5f000000" + "00" + "00000000",
+			server:     "40" + "8877665544332211" + "1413121110090807060504030201000f0e0d0c0b" + "00000001" + "5f000001" + "01" + "00000000" + "1122334455667788" + "00000000",
+			serverPort: 443,
+			expected:   true,
+		},
+		{
+			name:       "tcp reset",
+			client:     "000e" + "38" + "1122334455667788" + "00" + "00000000",
+			server:     "001a" + "40" + "8877665544332211" + "01" + "00000000" + "1122334455667788" + "00000000",
+			stream:     true,
+			serverPort: 443,
+			expected:   true,
+		},
+		{
+			name:       "server ack for another session",
+			client:     "38" + "1122334455667788" + "00" + "00000000",
+			server:     "40" + "8877665544332211" + "01" + "00000000" + "0101010101010101" + "00000000",
+			serverPort: 443,
+			expected:   false,
+		},
+		{
+			name:       "tls-crypt on the openvpn port",
+			client:     "38" + "1122334455667788" + "0000000100000000" + "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff" + "a1b2c3d4e5",
+			server:     "40" + "8877665544332211" + "0000000100000000" + "ffeeddccbbaa99887766554433221100ffeeddccbbaa99887766554433221100" + "f1e2d3c4b5a6978877665544",
+			serverPort: 1194,
+			expected:   true,
+		},
+		{
+			name:       "nonzero key id",
+			client:     "39" + "1122334455667788" + "00" + "00000000",
+			server:     "41" + "8877665544332211" + "01" + "00000000" + "1122334455667788" + "00000000",
+			serverPort: 1194,
+			expected:   false,
+		},
+		{
+			name:       "dns query and response",
+			client:     "38ab01000001000000000000076578616d706c6503636f6d0000010001",
+			server:     "38ab81800001000100000000076578616d706c6503636f6d0000010001c00c000100010000012c00045db8d822",
+			serverPort: 53,
+			expected:   false,
+		},
+		{
+			name:       "quic initial and short header",
+			client:     "c30000000108f1e2d3c4b5a69788000044d0" + "00112233445566778899aabbccddeeff",
+			server:     "4011223344556677889900aabbccddeeff0011",
+			serverPort: 443,
+			expected:   false,
+		},
+		{
+			name:       "short client packet",
+			client:     "381122334455",
+			server:     "40" + "8877665544332211" + "01" + "00000000" + "1122334455667788" + "00000000",
+			serverPort: 443,
+			expected:   false,
+		},
+	}
+
+	for _, test := range tests {
+		client := openVPNClientReset(decode(t, test.client), test.stream)
+		result := openVPNServerReset(decode(t, test.server), test.stream, client, test.serverPort)
+		if result != test.expected {
+			t.Errorf("%s: detected %v, expected %v", test.name, result, test.expected)
+		}
+	}
+}
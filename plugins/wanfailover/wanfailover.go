@@ -0,0 +1,426 @@
+// Package wanfailover provides the "wanfailover" plugin
+// The wanfailover plugin watches the link state and the quality probes for
+// each WAN interface, and uses the failover policy from the settings to decide
+// when a WAN should be removed from or restored to the routing tables.
+package wanfailover
+
+import (
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/plugins/stats"
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+	"github.com/untangle/packetd/services/zones"
+)
+
+const pluginName = "wanfailover"
+
+// routingTable and routingSet are the nftables table and set that hold
+// the interface ID of every WAN that is currently available for routing
+const routingTable = "wan-routing"
+const routingSet = "up-wans"
+
+// WanState holds the current failover state of a WAN interface
+type WanState struct {
+	InterfaceID  int       `json:"interfaceId"`
+	DeviceName   string    `json:"device"`
+	LinkUp       bool      `json:"linkUp"`
+	Active       bool      `json:"active"`
+	Latency      float64   `json:"latency"`
+	Jitter       float64   `json:"jitter"`
+	PingTimeouts uint64    `json:"pingTimeouts"`
+	FailCount    int       `json:"failCount"`
+	PassCount    int       `json:"passCount"`
+	LastChange   time.Time `json:"lastChange"`
+	Reason       string    `json:"reason"`
+	lastTimeouts uint64
+}
+
+// failoverPolicy holds the failover configuration from the settings
+type failoverPolicy struct {
+	enabled          bool
+	intervalSeconds  int
+	maxLatency       float64
+	maxJitter        float64
+	maxTimeouts      uint64
+	failThreshold    int
+	restoreThreshold int
+}
+
+var wanStateTable map[int]*WanState
+var wanStateLocker sync.RWMutex
+
+var policy failoverPolicy
+var policyLocker sync.RWMutex
+
+var shutdownChannel = make(chan bool)
+var routingSetError error
+var routingSetLocker sync.Mutex
+
+// init registers the plugin with the plugin registry and the WAN events table with
+// the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "wan_events",
+		Owner: pluginName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "interface_id", Type: "int1"},
+			{Name: "device_name", Type: "text"},
+			{Name: "zone", Type: "text"},
+			{Name: "event_type", Type: "text"},
+			{Name: "reason", Type: "text"},
+			{Name: "link_up", Type: "boolean"},
+			{Name: "latency", Type: "real"},
+			{Name: "jitter", Type: "real"},
+			{Name: "ping_timeouts", Type: "int8"},
+		},
+		TrimPercent: .1,
+	})
+
+	pluginsdk.Register(pluginsdk.NewModule(pluginsdk.Module{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+		HealthFunc:   PluginHealth,
+	}))
+}
+
+// PluginStartup function is called to allow plugin specific initialization.
+func PluginStartup() {
+	logger.Info("PluginStartup(%s) has been called\n", pluginName)
+
+	wanStateTable = make(map[int]*WanState)
+	loadFailoverPolicy()
+	createRoutingSet()
+
+	go failoverTask()
+}
+
+// PluginShutdown function called when the daemon is shutting down.
+func PluginShutdown() {
+	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
+
+	shutdownChannel <- true
+
+	select {
+	case <-shutdownChannel:
+		logger.Info("Successful shutdown of failoverTask\n")
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown failoverTask\n")
+	}
+}
+
+// PluginSignal is called to handle system signals
+func PluginSignal(message syscall.Signal) {
+	switch message {
+	case syscall.SIGHUP:
+		loadFailoverPolicy()
+	}
+}
+
+// PluginHealth returns an error if the routing set could not be created
+func PluginHealth() error {
+	routingSetLocker.Lock()
+	defer routingSetLocker.Unlock()
+	return routingSetError
+}
+
+// GetWanStates returns a copy of the current state of all WAN interfaces sorted by interface ID
+func GetWanStates() []WanState {
+	var list []WanState
+
+	wanStateLocker.RLock()
+	for _, item := range wanStateTable {
+		list = append(list, *item)
+	}
+	wanStateLocker.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].InterfaceID < list[j].InterfaceID })
+	return list
+}
+
+// failoverTask periodically evaluates the state of every WAN interface
+func failoverTask() {
+	for {
+		policyLocker.RLock()
+		interval := policy.intervalSeconds
+		policyLocker.RUnlock()
+
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(time.Second * time.Duration(interval)):
+			evaluateWanStates()
+		}
+	}
+}
+
+// evaluateWanStates compares the current link state and quality details for each WAN
+// against the failover policy and handles any resulting failover or restore events
+func evaluateWanStates() {
+	policyLocker.RLock()
+	current := policy
+	policyLocker.RUnlock()
+
+	seen := make(map[int]bool)
+
+	for _, quality := range stats.GetWanQualityList() {
+		seen[quality.InterfaceID] = true
+
+		wanStateLocker.Lock()
+		state := wanStateTable[quality.InterfaceID]
+		added := false
+		if state == nil {
+			state = &WanState{InterfaceID: quality.InterfaceID, DeviceName: quality.DeviceName, Active: true, LastChange: time.Now(), lastTimeouts: quality.PingTimeouts}
+			wanStateTable[quality.InterfaceID] = state
+			added = true
+		}
+
+		state.DeviceName = quality.DeviceName
+		state.LinkUp = getLinkState(quality.DeviceName)
+		state.Latency = quality.Latency
+		state.Jitter = quality.Jitter
+		// a counter lower than last time was reset, like when the stats
+		// plugin restarts, so all of the current timeouts are new
+		if quality.PingTimeouts < state.lastTimeouts {
+			state.PingTimeouts = quality.PingTimeouts
+		} else {
+			state.PingTimeouts = quality.PingTimeouts - state.lastTimeouts
+		}
+		state.lastTimeouts = quality.PingTimeouts
+
+		reason := checkWanQuality(state, quality.ActiveProbe, current)
+		changed := false
+
+		if reason != "" {
+			state.PassCount = 0
+			state.FailCount++
+			if state.Active && current.enabled && state.FailCount >= current.failThreshold {
+				state.Active = false
+				state.Reason = reason
+				state.LastChange = time.Now()
+				changed = true
+			}
+		} else {
+			state.FailCount = 0
+			state.PassCount++
+			if !state.Active && state.PassCount >= current.restoreThreshold {
+				state.Active = true
+				state.Reason = "restored"
+				state.LastChange = time.Now()
+				changed = true
+			}
+		}
+
+		// if failover has been disabled make sure nothing is left in the failed state
+		if !state.Active && !current.enabled {
+			state.Active = true
+			state.Reason = "disabled"
+			state.LastChange = time.Now()
+			changed = true
+		}
+
+		snapshot := *state
+		wanStateLocker.Unlock()
+
+		// a new WAN starts out active so it goes in the routing set
+		if added && snapshot.Active {
+			updateRoutingMark("add", snapshot.InterfaceID)
+		}
+
+		if changed {
+			handleStateChange(snapshot)
+		}
+	}
+
+	// remove any interfaces that are no longer flagged as WAN
+	wanStateLocker.Lock()
+	for id := range wanStateTable {
+		if !seen[id] {
+			delete(wanStateTable, id)
+		}
+	}
+	wanStateLocker.Unlock()
+}
+
+// checkWanQuality returns the reason the WAN fails the policy checks or an empty string if it passes
+func checkWanQuality(state *WanState, activeProbe bool, current failoverPolicy) string {
+	if !state.LinkUp {
+		return "link_down"
+	}
+
+	// without active probes we only have the link state to go on
+	if !activeProbe {
+		return ""
+	}
+
+	if current.maxTimeouts != 0 && state.PingTimeouts >= current.maxTimeouts {
+		return "ping_timeout"
+	}
+	if current.maxLatency != 0 && state.Latency > current.maxLatency {
+		return "latency"
+	}
+	if current.maxJitter != 0 && state.Jitter > current.maxJitter {
+		return "jitter"
+	}
+
+	return ""
+}
+
+// handleStateChange updates the routing marks and logs the event for a WAN that has changed state
+func handleStateChange(state WanState) {
+	var eventType string
+
+	if state.Active {
+		eventType = "restore"
+		logger.Notice("WAN %s (%d) restored\n", state.DeviceName, state.InterfaceID)
+		overseer.AddCounter("wan_failover_restore", 1)
+		updateRoutingMark("add", state.InterfaceID)
+	} else {
+		eventType = "failover"
+		logger.Notice("WAN %s (%d) failed: %s\n", state.DeviceName, state.InterfaceID, state.Reason)
+		overseer.AddCounter("wan_failover_failover", 1)
+		updateRoutingMark("delete", state.InterfaceID)
+	}
+
+	columns := map[string]interface{}{
+		"time_stamp":    state.LastChange,
+		"interface_id":  state.InterfaceID,
+		"device_name":   state.DeviceName,
+		"zone":          zones.GetInterfaceZone(state.InterfaceID),
+		"event_type":    eventType,
+		"reason":        state.Reason,
+		"link_up":       state.LinkUp,
+		"latency":       state.Latency,
+		"jitter":        state.Jitter,
+		"ping_timeouts": state.PingTimeouts,
+	}
+
+	reports.LogEvent(reports.CreateEvent("wan_"+eventType, "wan_events", 1, columns, nil))
+
+	eventbus.Publish(eventbus.TopicWanState, pluginName, map[string]interface{}{
+		"interface_id": state.InterfaceID,
+		"device_name":  state.DeviceName,
+		"zone":         columns["zone"],
+		"active":       state.Active,
+		"event_type":   eventType,
+		"reason":       state.Reason,
+	})
+	if !state.Active {
+		eventbus.PublishAlert(pluginName, "WAN "+state.DeviceName+" failed: "+state.Reason, map[string]interface{}{"interface_id": state.InterfaceID})
+	}
+}
+
+// createRoutingSet creates the wan-routing table and the set of available
+// WANs if they don't exist yet. Adding a table or set that already exists
+// leaves it alone. Failover can't work without the set, so a failure is
+// logged as an error and reported by the plugin health check.
+func createRoutingSet() error {
+	script := "add table inet " + routingTable + "\n"
+	script += "add set inet " + routingTable + " " + routingSet + " { type mark; }\n"
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		err = errors.New("Unable to create " + routingTable + " " + routingSet + ": " + err.Error() + " " + strings.TrimSpace(string(output)))
+		logger.Err("%v\n", err)
+	}
+
+	routingSetLocker.Lock()
+	routingSetError = err
+	routingSetLocker.Unlock()
+	return err
+}
+
+// updateRoutingMark adds or removes the WAN interface ID from the set of
+// interfaces the wan-routing rules are allowed to mark traffic for. If the
+// set has gone missing it is created again before retrying.
+func updateRoutingMark(operation string, interfaceID int) {
+	element := "{ " + strconv.Itoa(interfaceID) + " }"
+	output, err := exec.Command("nft", operation, "element", "inet", routingTable, routingSet, element).CombinedOutput()
+	if err != nil && operation == "add" && createRoutingSet() == nil {
+		output, err = exec.Command("nft", operation, "element", "inet", routingTable, routingSet, element).CombinedOutput()
+	}
+	if err != nil {
+		logger.Err("Error updating %s %s for interface %d: %v %s\n", routingTable, routingSet, interfaceID, err, strings.TrimSpace(string(output)))
+	}
+}
+
+// getLinkState returns the link state of the argumented device. Devices
+// like PPP and tunnels report an unknown operstate so we treat that as up
+func getLinkState(device string) bool {
+	data, err := ioutil.ReadFile("/sys/class/net/" + device + "/operstate")
+	if err != nil {
+		return false
+	}
+
+	state := strings.TrimSpace(string(data))
+	if state == "up" || state == "unknown" {
+		return true
+	}
+	return false
+}
+
+// loadFailoverPolicy loads the failover policy from the settings
+func loadFailoverPolicy() {
+	var fresh failoverPolicy
+
+	fresh.enabled = true
+	fresh.intervalSeconds = 5
+	fresh.maxLatency = 0
+	fresh.maxJitter = 0
+	fresh.maxTimeouts = 3
+	fresh.failThreshold = 3
+	fresh.restoreThreshold = 5
+
+	failoverJSON, err := settings.GetCurrentSettings([]string{"wan", "failover"})
+	if failoverJSON == nil || err != nil {
+		logger.Info("No WAN failover settings found - using defaults\n")
+	} else if item, ok := failoverJSON.(map[string]interface{}); ok {
+		if value, ok := item["enabled"].(bool); ok {
+			fresh.enabled = value
+		}
+		if value, ok := item["checkInterval"].(float64); ok && value > 0 {
+			fresh.intervalSeconds = int(value)
+		}
+		if value, ok := item["maxLatency"].(float64); ok {
+			fresh.maxLatency = value
+		}
+		if value, ok := item["maxJitter"].(float64); ok {
+			fresh.maxJitter = value
+		}
+		if value, ok := item["maxTimeouts"].(float64); ok {
+			fresh.maxTimeouts = uint64(value)
+		}
+		if value, ok := item["failThreshold"].(float64); ok && value > 0 {
+			fresh.failThreshold = int(value)
+		}
+		if value, ok := item["restoreThreshold"].(float64); ok && value > 0 {
+			fresh.restoreThreshold = int(value)
+		}
+	} else {
+		logger.Warn("Invalid WAN failover settings: %T\n", failoverJSON)
+	}
+
+	policyLocker.Lock()
+	policy = fresh
+	policyLocker.Unlock()
+
+	logger.Info("Loaded WAN failover policy: %+v\n", fresh)
+}
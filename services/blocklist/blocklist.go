@@ -0,0 +1,627 @@
+// Package blocklist maintains the nftables sets of addresses that packetd
+// drops. The addresses come from three places: blocks added through the API,
+// blocks added when an alert from a configured source names an address, and
+// threat feeds that are downloaded at a regular interval. Each block has a
+// reason and an optional expiration, and the blocks from the API and alerts
+// are saved so they survive a restart. Traffic to or from a blocked address
+// is dropped by the packetd-blocklist table before it reaches packetd.
+package blocklist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the sources of the blocks that are not from a feed
+const (
+	SourceManual = "manual"
+	SourceAlert  = "alert"
+)
+
+// the defaults used when the blocklist settings are missing
+const (
+	defaultBlockFile      = "/etc/config/blocklist.json"
+	defaultMaxEntries     = 100000
+	defaultAlertTTL       = 3600
+	defaultRefreshSeconds = 3600
+)
+
+// Entry is a blocked address or network. The TTL is the number of seconds
+// until the block expires and is zero for a permanent block.
+type Entry struct {
+	Address string     `json:"address"`
+	Reason  string     `json:"reason"`
+	Source  string     `json:"source"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	TTL     int64      `json:"ttl"`
+}
+
+// Status holds the blocklist counters, the feeds, and the state of the nftables sets
+type Status struct {
+	Enabled bool           `json:"enabled"`
+	Entries int            `json:"entries"`
+	Sources map[string]int `json:"sources"`
+	Feeds   []FeedStatus   `json:"feeds"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// alertRule blocks the address in a field of the alerts from a source
+type alertRule struct {
+	source string
+	field  string
+	reason string
+	ttl    time.Duration
+}
+
+// blockConfig holds the blocklist settings. The exempt networks are never
+// blocked by an alert or a feed.
+type blockConfig struct {
+	enabled    bool
+	file       string
+	maxEntries int
+	alerts     []alertRule
+	feeds      []feedConfig
+	exempt     []*net.IPNet
+}
+
+// blockEntry is a block from the API or an alert
+type blockEntry struct {
+	network *net.IPNet
+	Entry
+}
+
+var config = blockConfig{enabled: true, file: defaultBlockFile, maxEntries: defaultMaxEntries}
+var entryTable = make(map[string]*blockEntry)
+var blockLocker sync.Mutex
+
+var alertSub *eventbus.Subscription
+var alertDone chan bool
+var shutdownChannel chan bool
+var taskWaiter sync.WaitGroup
+
+// Startup is called to handle service startup
+func Startup() {
+	loadConfig()
+	loadEntries()
+
+	shutdownChannel = make(chan bool)
+	taskWaiter.Add(1)
+	go blocklistTask()
+
+	alertSub = eventbus.Subscribe("blocklist", 0, eventbus.TopicAlert)
+	alertDone = make(chan bool)
+	go alertTask(alertSub, alertDone)
+}
+
+// Shutdown is called to handle service shutdown. The blocks are saved and
+// the nftables table is removed so nothing is dropped once packetd is gone.
+func Shutdown() {
+	eventbus.Unsubscribe(alertSub)
+	<-alertDone
+
+	close(shutdownChannel)
+	taskWaiter.Wait()
+
+	saveEntries()
+	removeTable()
+}
+
+// Reload loads the blocklist settings and updates the nftables sets
+func Reload() {
+	loadConfig()
+	requestSync()
+	requestRefresh()
+}
+
+// loadConfig loads the blocklist settings
+func loadConfig() {
+	fresh := blockConfig{enabled: true, file: defaultBlockFile, maxEntries: defaultMaxEntries}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"blocklist"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			for _, problem := range compileConfig(&fresh, item) {
+				logger.Warn("Ignoring invalid blocklist %v\n", problem)
+			}
+		} else {
+			logger.Warn("Invalid blocklist settings: %T\n", configJSON)
+		}
+	}
+
+	logger.Info("Loaded blocklist settings enabled:%v file:%s max:%d alerts:%d feeds:%d exempt:%d\n",
+		fresh.enabled, fresh.file, fresh.maxEntries, len(fresh.alerts), len(fresh.feeds), len(fresh.exempt))
+
+	blockLocker.Lock()
+	config = fresh
+	blockLocker.Unlock()
+
+	updateFeeds(fresh.feeds)
+}
+
+// compileConfig reads the blocklist settings. Invalid values are skipped and
+// returned as errors.
+func compileConfig(fresh *blockConfig, item map[string]interface{}) []error {
+	var problems []error
+
+	if value, ok := item["enabled"].(bool); ok {
+		fresh.enabled = value
+	}
+	if value, ok := item["file"].(string); ok && value != "" {
+		fresh.file = value
+	}
+	if value, ok := item["maxEntries"].(float64); ok && value > 0 {
+		fresh.maxEntries = int(value)
+	}
+
+	alertSlice, _ := item["alerts"].([]interface{})
+	for index, value := range alertSlice {
+		entry, ok := value.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Errorf("alert %d: not an object", index))
+			continue
+		}
+		rule := alertRule{ttl: defaultAlertTTL * time.Second}
+		rule.source, _ = entry["source"].(string)
+		rule.field, _ = entry["field"].(string)
+		rule.reason, _ = entry["reason"].(string)
+		if seconds, ok := entry["ttlSeconds"].(float64); ok && seconds >= 0 {
+			rule.ttl = time.Duration(seconds) * time.Second
+		}
+		if rule.source == "" || rule.field == "" {
+			problems = append(problems, fmt.Errorf("alert %d: missing source or field", index))
+			continue
+		}
+		fresh.alerts = append(fresh.alerts, rule)
+	}
+
+	feedSlice, _ := item["feeds"].([]interface{})
+	for index, value := range feedSlice {
+		feed, err := parseFeed(value)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("feed %d: %v", index, err))
+			continue
+		}
+		if feed != nil {
+			fresh.feeds = append(fresh.feeds, *feed)
+		}
+	}
+
+	exemptSlice, _ := item["exempt"].([]interface{})
+	for _, value := range exemptSlice {
+		text, _ := value.(string)
+		network, err := ParseNetwork(text)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("exempt network %v: %v", value, err))
+			continue
+		}
+		fresh.exempt = append(fresh.exempt, network)
+	}
+
+	return problems
+}
+
+// ParseNetwork returns the network for an address or a network in CIDR notation
+func ParseNetwork(text string) (*net.IPNet, error) {
+	text = strings.TrimSpace(text)
+	if _, network, err := net.ParseCIDR(text); err == nil {
+		if network.IP.To4() != nil {
+			network.IP = network.IP.To4()
+		}
+		return network, nil
+	}
+	address := net.ParseIP(text)
+	if address == nil {
+		return nil, fmt.Errorf("invalid address: %s", text)
+	}
+	if address4 := address.To4(); address4 != nil {
+		return &net.IPNet{IP: address4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: address, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// networkString returns the address for a single host network or the CIDR
+// notation for a larger one, which is the key used for the blocks
+func networkString(network *net.IPNet) string {
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return network.IP.String()
+	}
+	return network.String()
+}
+
+// isExempt returns true if the network overlaps one of the exempt networks.
+// The caller must hold the blockLocker.
+func isExempt(network *net.IPNet) bool {
+	for _, exempt := range config.exempt {
+		if exempt.Contains(network.IP) || network.Contains(exempt.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add blocks an address or network for the argumented number of seconds, or
+// until it is removed when the TTL is zero. It fails if the address is
+// already blocked.
+func Add(address string, reason string, ttl int64) (Entry, error) {
+	return addEntry(address, reason, SourceManual, ttl, false)
+}
+
+// Update changes the reason and the expiration of a block added through the
+// API or by an alert. It fails if the address is not blocked.
+func Update(address string, reason string, ttl int64) (Entry, error) {
+	network, err := ParseNetwork(address)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	blockLocker.Lock()
+	entry, found := entryTable[networkString(network)]
+	if !found {
+		blockLocker.Unlock()
+		return Entry{}, fmt.Errorf("address not found: %s", address)
+	}
+	entry.Reason = reason
+	entry.Expires = getExpiration(time.Now(), ttl)
+	result := entry.getEntry(time.Now())
+	blockLocker.Unlock()
+
+	logger.Info("Updated blocklist entry %s ttl:%d reason:%s\n", result.Address, ttl, reason)
+	saveEntries()
+	return result, nil
+}
+
+// Remove removes the block for an address, or every block from a source when
+// the address is empty, and returns the number removed. The blocks from a
+// feed can't be removed since they come back when the feed is refreshed.
+func Remove(address string, source string) (int, error) {
+	var counter int
+
+	blockLocker.Lock()
+	if address != "" {
+		network, err := ParseNetwork(address)
+		if err != nil {
+			blockLocker.Unlock()
+			return 0, err
+		}
+		key := networkString(network)
+		if _, found := entryTable[key]; found {
+			delete(entryTable, key)
+			counter = 1
+		}
+	} else {
+		for key, entry := range entryTable {
+			if source == "" || entry.Source == source || strings.HasPrefix(entry.Source, source+":") {
+				delete(entryTable, key)
+				counter++
+			}
+		}
+	}
+	blockLocker.Unlock()
+
+	logger.Info("Removed %d blocklist entries\n", counter)
+	if counter != 0 {
+		saveEntries()
+		requestSync()
+	}
+	return counter, nil
+}
+
+// Get returns the block for an address
+func Get(address string) (Entry, error) {
+	network, err := ParseNetwork(address)
+	if err != nil {
+		return Entry{}, err
+	}
+	key := networkString(network)
+
+	for _, entry := range List() {
+		if entry.Address == key {
+			return entry, nil
+		}
+	}
+	return Entry{}, fmt.Errorf("address not found: %s", address)
+}
+
+// List returns the current blocks from every source sorted by address
+func List() []Entry {
+	now := time.Now()
+	list := []Entry{}
+
+	blockLocker.Lock()
+	for _, entry := range entryTable {
+		if entry.isExpired(now) {
+			continue
+		}
+		list = append(list, entry.getEntry(now))
+	}
+	blockLocker.Unlock()
+
+	list = append(list, getFeedEntries()...)
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Address != list[j].Address {
+			return list[i].Address < list[j].Address
+		}
+		return list[i].Source < list[j].Source
+	})
+	return list
+}
+
+// GetStatus returns the blocklist counters and the feeds
+func GetStatus() Status {
+	status := Status{Sources: make(map[string]int)}
+
+	for _, entry := range List() {
+		status.Sources[entry.Source]++
+		status.Entries++
+	}
+
+	blockLocker.Lock()
+	status.Enabled = config.enabled
+	blockLocker.Unlock()
+
+	status.Feeds = getFeedStatus()
+	status.Error = getSyncError()
+	return status
+}
+
+// addEntry adds a block from the API or an alert. An alert can replace an
+// existing block from an alert to extend it, but never a block from the API.
+func addEntry(address string, reason string, source string, ttl int64, replace bool) (Entry, error) {
+	network, err := ParseNetwork(address)
+	if err != nil {
+		return Entry{}, err
+	}
+	if ttl < 0 {
+		return Entry{}, fmt.Errorf("invalid ttl: %d", ttl)
+	}
+
+	now := time.Now()
+	key := networkString(network)
+
+	blockLocker.Lock()
+	if existing, found := entryTable[key]; found && !existing.isExpired(now) {
+		if !replace || existing.Source == SourceManual {
+			blockLocker.Unlock()
+			return Entry{}, fmt.Errorf("address already blocked: %s", key)
+		}
+	}
+	if len(entryTable) >= config.maxEntries {
+		blockLocker.Unlock()
+		return Entry{}, fmt.Errorf("blocklist is full")
+	}
+
+	entry := &blockEntry{network: network}
+	entry.Address = key
+	entry.Reason = reason
+	entry.Source = source
+	entry.Created = now
+	entry.Expires = getExpiration(now, ttl)
+	entryTable[key] = entry
+	result := entry.getEntry(now)
+	blockLocker.Unlock()
+
+	logger.Info("Added blocklist entry %s source:%s ttl:%d reason:%s\n", key, source, ttl, reason)
+	saveEntries()
+	requestSync()
+	return result, nil
+}
+
+// getExpiration returns the expiration for a TTL in seconds, or nil when the TTL is zero
+func getExpiration(now time.Time, ttl int64) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	expires := now.Add(time.Duration(ttl) * time.Second)
+	return &expires
+}
+
+// isExpired returns true if the block has expired
+func (entry *blockEntry) isExpired(now time.Time) bool {
+	return entry.Expires != nil && !now.Before(*entry.Expires)
+}
+
+// getEntry returns a copy of the block with the remaining TTL
+func (entry *blockEntry) getEntry(now time.Time) Entry {
+	result := entry.Entry
+	if entry.Expires != nil {
+		result.TTL = int64(entry.Expires.Sub(now).Seconds())
+		if result.TTL < 1 {
+			result.TTL = 1
+		}
+	}
+	return result
+}
+
+// removeExpired removes the expired blocks and returns true if any were removed
+func removeExpired(now time.Time) bool {
+	var counter int
+
+	blockLocker.Lock()
+	for key, entry := range entryTable {
+		if entry.isExpired(now) {
+			logger.Info("Blocklist entry %s expired\n", key)
+			delete(entryTable, key)
+			counter++
+		}
+	}
+	blockLocker.Unlock()
+
+	if counter == 0 {
+		return false
+	}
+	saveEntries()
+	return true
+}
+
+// alertTask blocks the addresses named in the alerts from the configured sources
+func alertTask(sub *eventbus.Subscription, done chan bool) {
+	defer close(done)
+
+	for event := range sub.Events() {
+		blockLocker.Lock()
+		enabled := config.enabled
+		rules := config.alerts
+		blockLocker.Unlock()
+
+		if !enabled {
+			continue
+		}
+
+		for _, rule := range rules {
+			if rule.source != event.Source {
+				continue
+			}
+			address, _ := event.Data[rule.field].(string)
+			if address == "" {
+				continue
+			}
+			network, err := ParseNetwork(address)
+			if err != nil {
+				continue
+			}
+
+			blockLocker.Lock()
+			exempt := isExempt(network)
+			blockLocker.Unlock()
+			if exempt {
+				logger.Debug("Ignoring alert for exempt address %s\n", address)
+				continue
+			}
+
+			reason := rule.reason
+			if reason == "" {
+				reason, _ = event.Data["message"].(string)
+			}
+			_, err = addEntry(address, reason, SourceAlert+":"+event.Source, int64(rule.ttl/time.Second), true)
+			if err != nil {
+				logger.Debug("Unable to block %s from alert: %v\n", address, err)
+				continue
+			}
+			overseer.AddCounter("blocklist_alert_block", 1)
+		}
+	}
+}
+
+// blocklistTask removes the expired blocks, refreshes the feeds, and updates
+// the nftables sets when the blocks have changed
+func blocklistTask() {
+	defer taskWaiter.Done()
+
+	requestSync()
+	requestRefresh()
+
+	for {
+		select {
+		case <-shutdownChannel:
+			return
+		case <-syncChannel:
+			syncSets()
+		case <-refreshChannel:
+			if refreshFeeds(time.Now(), true) {
+				syncSets()
+			}
+		case <-time.After(60 * time.Second):
+			expired := removeExpired(time.Now())
+			refreshed := refreshFeeds(time.Now(), false)
+			if expired || refreshed {
+				syncSets()
+			}
+		}
+	}
+}
+
+// loadEntries loads the blocks saved by the last run, skipping the ones that
+// expired while packetd wasn't running
+func loadEntries() {
+	blockLocker.Lock()
+	filename := config.file
+	blockLocker.Unlock()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Unable to read the blocklist %s: %v\n", filename, err)
+		}
+		return
+	}
+
+	var list []Entry
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		logger.Warn("Unable to parse the blocklist %s: %v\n", filename, err)
+		return
+	}
+
+	now := time.Now()
+	var counter int
+
+	blockLocker.Lock()
+	for _, item := range list {
+		network, err := ParseNetwork(item.Address)
+		if err != nil {
+			logger.Debug("Ignoring invalid blocklist entry %s\n", item.Address)
+			continue
+		}
+		entry := &blockEntry{network: network, Entry: item}
+		entry.TTL = 0
+		if entry.isExpired(now) {
+			continue
+		}
+		entryTable[networkString(network)] = entry
+		counter++
+	}
+	blockLocker.Unlock()
+
+	logger.Info("Loaded %d blocklist entries from %s\n", counter, filename)
+}
+
+// saveEntries writes the blocks from the API and alerts to disk. The file is
+// replaced with a rename so a crash while writing doesn't lose the old file.
+func saveEntries() {
+	list := []Entry{}
+
+	blockLocker.Lock()
+	filename := config.file
+	for _, entry := range entryTable {
+		item := entry.Entry
+		item.TTL = 0
+		list = append(list, item)
+	}
+	blockLocker.Unlock()
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		logger.Warn("Unable to encode the blocklist: %v\n", err)
+		return
+	}
+
+	temporary := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	err = ioutil.WriteFile(temporary, data, 0600)
+	if err == nil {
+		err = os.Rename(temporary, filename)
+	}
+	if err != nil {
+		logger.Warn("Unable to write the blocklist %s: %v\n", filename, err)
+		os.Remove(temporary)
+		return
+	}
+
+	logger.Debug("Saved %d blocklist entries to %s\n", len(list), filename)
+}
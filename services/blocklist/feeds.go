@@ -0,0 +1,286 @@
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// the limit on the size of a feed download
+const maxFeedBytes = 16 * 1024 * 1024
+
+// how long we wait for a feed download
+const feedTimeout = 30 * time.Second
+
+// feedConfig holds a threat feed from the settings. A feed is a list of
+// addresses and networks with one per line, and anything after a # or ; is
+// a comment.
+type feedConfig struct {
+	name    string
+	url     string
+	reason  string
+	refresh time.Duration
+}
+
+// feedState holds the addresses from the last download of a feed
+type feedState struct {
+	feedConfig
+	networks    []*net.IPNet
+	invalid     int
+	lastUpdate  time.Time
+	lastAttempt time.Time
+	lastError   string
+}
+
+// FeedStatus holds the state of a threat feed
+type FeedStatus struct {
+	Name       string     `json:"name"`
+	URL        string     `json:"url"`
+	Entries    int        `json:"entries"`
+	Invalid    int        `json:"invalid"`
+	LastUpdate *time.Time `json:"lastUpdate,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+var feedTable = make(map[string]*feedState)
+var feedLocker sync.Mutex
+var refreshChannel = make(chan bool, 1)
+
+// parseFeed returns the feed from a settings object. It returns nil without
+// an error for disabled feeds.
+func parseFeed(value interface{}) (*feedConfig, error) {
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not an object")
+	}
+
+	if enabled, found := item["enabled"].(bool); found && !enabled {
+		return nil, nil
+	}
+
+	feed := &feedConfig{refresh: defaultRefreshSeconds * time.Second}
+	feed.name, _ = item["name"].(string)
+	feed.url, _ = item["url"].(string)
+	feed.reason, _ = item["reason"].(string)
+	if seconds, ok := item["refreshSeconds"].(float64); ok && seconds >= 60 {
+		feed.refresh = time.Duration(seconds) * time.Second
+	}
+
+	if feed.name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	if !strings.HasPrefix(feed.url, "http://") && !strings.HasPrefix(feed.url, "https://") {
+		return nil, fmt.Errorf("invalid url: %s", feed.url)
+	}
+	if feed.reason == "" {
+		feed.reason = "threat feed " + feed.name
+	}
+	return feed, nil
+}
+
+// updateFeeds replaces the feed configuration. The addresses from a feed are
+// kept if the URL didn't change so they stay blocked until the next refresh.
+func updateFeeds(list []feedConfig) {
+	fresh := make(map[string]*feedState)
+
+	feedLocker.Lock()
+	defer feedLocker.Unlock()
+
+	for _, feed := range list {
+		state, found := feedTable[feed.name]
+		if !found || state.url != feed.url {
+			state = &feedState{}
+		}
+		state.feedConfig = feed
+		fresh[feed.name] = state
+	}
+	feedTable = fresh
+}
+
+// requestRefresh asks the blocklist task to download every feed now
+func requestRefresh() {
+	select {
+	case refreshChannel <- true:
+	default:
+	}
+}
+
+// refreshFeeds downloads the feeds that are due, or every feed when force is
+// true, and returns true if the addresses from any feed changed. A feed that
+// fails keeps the addresses from the last download.
+func refreshFeeds(now time.Time, force bool) bool {
+	var due []feedConfig
+
+	feedLocker.Lock()
+	for _, state := range feedTable {
+		if force || now.Sub(state.lastAttempt) >= state.refresh {
+			state.lastAttempt = now
+			due = append(due, state.feedConfig)
+		}
+	}
+	feedLocker.Unlock()
+
+	var changed bool
+	for _, feed := range due {
+		networks, invalid, err := downloadFeed(feed.url)
+
+		feedLocker.Lock()
+		state, found := feedTable[feed.name]
+		if !found || state.url != feed.url {
+			feedLocker.Unlock()
+			continue
+		}
+		if err != nil {
+			logger.Warn("%OC|Unable to download blocklist feed %s: %v\n", "blocklist_feed_failure", 10, feed.name, err)
+			state.lastError = err.Error()
+			feedLocker.Unlock()
+			continue
+		}
+		state.networks = filterNetworks(networks)
+		state.invalid = invalid
+		state.lastUpdate = time.Now()
+		state.lastError = ""
+		count := len(state.networks)
+		feedLocker.Unlock()
+
+		logger.Info("Loaded %d addresses from blocklist feed %s (%d invalid)\n", count, feed.name, invalid)
+		changed = true
+	}
+
+	return changed
+}
+
+// filterNetworks removes the exempt networks from a feed and limits the
+// number of addresses to the maximum from the settings
+func filterNetworks(networks []*net.IPNet) []*net.IPNet {
+	var result []*net.IPNet
+
+	blockLocker.Lock()
+	defer blockLocker.Unlock()
+
+	for _, network := range networks {
+		if len(result) >= config.maxEntries {
+			logger.Warn("%OC|Blocklist feed has more than %d addresses\n", "blocklist_feed_limit", 10, config.maxEntries)
+			break
+		}
+		if isExempt(network) {
+			continue
+		}
+		result = append(result, network)
+	}
+	return result
+}
+
+// downloadFeed downloads a feed and returns the networks and the number of
+// lines that could not be parsed
+func downloadFeed(url string) ([]*net.IPNet, int, error) {
+	client := &http.Client{Timeout: feedTimeout}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("HTTP status %s", response.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, maxFeedBytes+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) > maxFeedBytes {
+		return nil, 0, fmt.Errorf("feed is larger than %d bytes", maxFeedBytes)
+	}
+
+	networks, invalid := parseFeedData(data)
+	return networks, invalid, nil
+}
+
+// parseFeedData returns the networks in a feed and the number of lines that
+// could not be parsed. Only the first field of each line is used so feeds
+// with extra columns work.
+func parseFeedData(data []byte) ([]*net.IPNet, int) {
+	var networks []*net.IPNet
+	var invalid int
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.IndexAny(line, "#;"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		network, err := ParseNetwork(fields[0])
+		if err != nil {
+			invalid++
+			continue
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, invalid
+}
+
+// getFeedEntries returns the blocks from every feed
+func getFeedEntries() []Entry {
+	var list []Entry
+
+	feedLocker.Lock()
+	defer feedLocker.Unlock()
+
+	for _, state := range feedTable {
+		for _, network := range state.networks {
+			list = append(list, Entry{Address: networkString(network), Reason: state.reason, Source: "feed:" + state.name, Created: state.lastUpdate})
+		}
+	}
+	return list
+}
+
+// getFeedNetworks returns the networks from every feed
+func getFeedNetworks() []*net.IPNet {
+	var list []*net.IPNet
+
+	feedLocker.Lock()
+	defer feedLocker.Unlock()
+
+	for _, state := range feedTable {
+		list = append(list, state.networks...)
+	}
+	return list
+}
+
+// getFeedStatus returns the state of each feed
+func getFeedStatus() []FeedStatus {
+	list := []FeedStatus{}
+
+	feedLocker.Lock()
+	defer feedLocker.Unlock()
+
+	for _, state := range feedTable {
+		item := FeedStatus{Name: state.name, URL: state.url, Entries: len(state.networks), Invalid: state.invalid, Error: state.lastError}
+		if !state.lastUpdate.IsZero() {
+			stamp := state.lastUpdate
+			item.LastUpdate = &stamp
+		}
+		list = append(list, item)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,169 @@
+package blocklist
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// the nftables table that holds the blocklist sets and the rules that drop
+// traffic to and from the addresses in them
+const tableName = "packetd-blocklist"
+
+// the number of elements added by each line of the nft script
+const elementsPerLine = 1000
+
+var syncChannel = make(chan bool, 1)
+var syncLocker sync.Mutex
+var syncError string
+var tableActive bool
+
+// requestSync asks the blocklist task to update the nftables sets
+func requestSync() {
+	select {
+	case syncChannel <- true:
+	default:
+	}
+}
+
+// getSyncError returns the error from the last update of the nftables sets
+func getSyncError() string {
+	syncLocker.Lock()
+	defer syncLocker.Unlock()
+	return syncError
+}
+
+// syncSets replaces the blocklist table with one that has every current
+// block. The old table is deleted and the new one created by a single nft
+// command so the change is atomic and nothing passes while it is replaced.
+func syncSets() {
+	now := time.Now()
+	var networks []*net.IPNet
+
+	blockLocker.Lock()
+	enabled := config.enabled
+	for _, entry := range entryTable {
+		if !entry.isExpired(now) {
+			networks = append(networks, entry.network)
+		}
+	}
+	blockLocker.Unlock()
+
+	if !enabled {
+		removeTable()
+		return
+	}
+
+	networks = append(networks, getFeedNetworks()...)
+	list4, list6 := collapseNetworks(networks)
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "add table inet %s\n", tableName)
+	fmt.Fprintf(&script, "delete table inet %s\n", tableName)
+	fmt.Fprintf(&script, "table inet %s {\n", tableName)
+	fmt.Fprintf(&script, "\tset blocklist4 { type ipv4_addr; flags interval; }\n")
+	fmt.Fprintf(&script, "\tset blocklist6 { type ipv6_addr; flags interval; }\n")
+	fmt.Fprintf(&script, "\tchain prerouting {\n\t\ttype filter hook prerouting priority -160; policy accept;\n")
+	fmt.Fprintf(&script, "\t\tip saddr @blocklist4 counter drop\n\t\tip daddr @blocklist4 counter drop\n")
+	fmt.Fprintf(&script, "\t\tip6 saddr @blocklist6 counter drop\n\t\tip6 daddr @blocklist6 counter drop\n\t}\n")
+	fmt.Fprintf(&script, "\tchain output {\n\t\ttype filter hook output priority -160; policy accept;\n")
+	fmt.Fprintf(&script, "\t\tip daddr @blocklist4 counter drop\n\t\tip6 daddr @blocklist6 counter drop\n\t}\n")
+	fmt.Fprintf(&script, "}\n")
+	writeElements(&script, "blocklist4", list4)
+	writeElements(&script, "blocklist6", list6)
+
+	command := exec.Command("nft", "-f", "-")
+	command.Stdin = &script
+	output, err := command.CombinedOutput()
+
+	syncLocker.Lock()
+	defer syncLocker.Unlock()
+
+	if err != nil {
+		syncError = strings.TrimSpace(string(output))
+		if syncError == "" {
+			syncError = err.Error()
+		}
+		logger.Warn("%OC|Failed to update the blocklist sets: %s\n", "blocklist_sync_failure", 10, syncError)
+		return
+	}
+
+	tableActive = true
+	syncError = ""
+	logger.Info("Updated the blocklist sets: %d IPv4 and %d IPv6 entries\n", len(list4), len(list6))
+}
+
+// writeElements adds the networks to a set in the nft script
+func writeElements(script *bytes.Buffer, set string, list []string) {
+	for start := 0; start < len(list); start += elementsPerLine {
+		end := start + elementsPerLine
+		if end > len(list) {
+			end = len(list)
+		}
+		fmt.Fprintf(script, "add element inet %s %s { %s }\n", tableName, set, strings.Join(list[start:end], ", "))
+	}
+}
+
+// removeTable removes the blocklist table if we created it
+func removeTable() {
+	syncLocker.Lock()
+	defer syncLocker.Unlock()
+
+	if !tableActive {
+		return
+	}
+
+	output, err := exec.Command("nft", "delete", "table", "inet", tableName).CombinedOutput()
+	if err != nil {
+		logger.Warn("Failed to remove the blocklist table: %s\n", strings.TrimSpace(string(output)))
+		return
+	}
+
+	tableActive = false
+	logger.Info("Removed the blocklist table\n")
+}
+
+// collapseNetworks returns the IPv4 and IPv6 networks without the ones that
+// are inside another network, since an interval set can't hold overlapping
+// elements. Two networks are either disjoint or one holds the other, so after
+// sorting by address and then by size we only need to compare each network
+// with the last one we kept.
+func collapseNetworks(networks []*net.IPNet) ([]string, []string) {
+	var list4, list6 []string
+
+	sort.Slice(networks, func(i, j int) bool {
+		a, b := networks[i], networks[j]
+		a4, b4 := a.IP.To4() != nil, b.IP.To4() != nil
+		if a4 != b4 {
+			return a4
+		}
+		if compare := bytes.Compare(a.IP.To16(), b.IP.To16()); compare != 0 {
+			return compare < 0
+		}
+		onesA, _ := a.Mask.Size()
+		onesB, _ := b.Mask.Size()
+		return onesA < onesB
+	})
+
+	var last *net.IPNet
+	for _, network := range networks {
+		if last != nil && last.Contains(network.IP) {
+			continue
+		}
+		last = network
+		if network.IP.To4() != nil {
+			list4 = append(list4, networkString(network))
+		} else {
+			list6 = append(list6, networkString(network))
+		}
+	}
+
+	return list4, list6
+}
@@ -12,16 +12,18 @@ import (
 	"github.com/untangle/packetd/services/reports"
 )
 
-const cleanTimeout = 86400
 const cleanInterval = 60
 
-// CertificateHolder is used to cache SSL/TLS certificates
+// CertificateHolder is used to cache SSL/TLS certificates. The lastAccess
+// time is used to evict the least recently used certificate when the cache
+// is full and is protected by the certificateMutex.
 type CertificateHolder struct {
 	CreationTime time.Time
 	Certificate  x509.Certificate
 	Available    bool
 	WaitGroup    sync.WaitGroup
 	CertLocker   sync.Mutex
+	lastAccess   time.Time
 }
 
 var shutdownChannel = make(chan bool)
@@ -30,12 +32,17 @@ var certificateMutex sync.Mutex
 
 // Startup function is called to allow service specific initialization.
 func Startup() {
+	loadConfig()
 	certificateTable = make(map[string]*CertificateHolder)
+	loadCertificates()
+	dispatch.InsertShedder("certcache", shedCertificateTable)
 	go cleanupTask()
 }
 
 // Shutdown function called when the daemon is shutting down.
 func Shutdown() {
+	dispatch.RemoveShedder("certcache")
+
 	// Send shutdown signal to cleanupTask and wait for it to return
 	shutdownChannel <- true
 	select {
@@ -43,6 +50,13 @@ func Shutdown() {
 	case <-time.After(10 * time.Second):
 		logger.Err("Failed to properly shutdown certcache cleanupTask\n")
 	}
+
+	saveCertificates()
+}
+
+// Reload loads the certificate cache settings
+func Reload() {
+	loadConfig()
 }
 
 // AttachCertificateToSession is called to attach a certificate to a session entry and
@@ -128,6 +142,9 @@ func setSessionList(session *dispatch.Session, field string, value []string, cti
 func FindCertificate(finder string) (*CertificateHolder, bool) {
 	certificateMutex.Lock()
 	entry, status := certificateTable[finder]
+	if status {
+		entry.lastAccess = time.Now()
+	}
 	certificateMutex.Unlock()
 	return entry, status
 }
@@ -135,11 +152,29 @@ func FindCertificate(finder string) (*CertificateHolder, bool) {
 // InsertCertificate adds a certificate to the cache
 func InsertCertificate(finder string, holder *CertificateHolder) {
 	certificateMutex.Lock()
-	if certificateTable[finder] != nil {
-		delete(certificateTable, finder)
+	holder.lastAccess = time.Now()
+	storeCertificate(finder, holder)
+	certificateMutex.Unlock()
+}
+
+// storeCertificate adds a certificate to the cache, removing the least recently
+// used certificate when the cache is full. The caller must hold the certificateMutex.
+func storeCertificate(finder string, holder *CertificateHolder) {
+	delete(certificateTable, finder)
+
+	if config.maxEntries > 0 && len(certificateTable) >= config.maxEntries {
+		var oldest string
+		for key, value := range certificateTable {
+			if oldest == "" || value.lastAccess.Before(certificateTable[oldest].lastAccess) {
+				oldest = key
+			}
+		}
+		logger.Debug("Evicting certificate for %s\n", oldest)
+		delete(certificateTable, oldest)
 	}
+
 	certificateTable[finder] = holder
-	certificateMutex.Unlock()
+	cacheChanged = true
 }
 
 // RemoveCertificate removes a certificate from the cache
@@ -159,19 +194,37 @@ func cleanCertificateTable() {
 
 	for key, val := range certificateTable {
 		val.CertLocker.Lock()
-		creation := val.CreationTime.Unix()
+		creation := val.CreationTime
 		val.CertLocker.Unlock()
-		if (nowtime.Unix() - creation) < cleanTimeout {
+		if nowtime.Sub(creation) < config.ttl {
 			continue
 		}
 		delete(certificateTable, key)
 		counter++
 		logger.Debug("Removing certificate for %s\n", key)
 	}
+
+	if counter != 0 {
+		cacheChanged = true
+	}
+}
+
+// shedCertificateTable empties the certificate table when memory is running low
+func shedCertificateTable(level int) {
+	if level < dispatch.ShedCaches {
+		return
+	}
+
+	certificateMutex.Lock()
+	logger.Notice("Shedding %d certificates from the certificate cache\n", len(certificateTable))
+	certificateTable = make(map[string]*CertificateHolder)
+	certificateMutex.Unlock()
 }
 
-// periodic task to clean the certificate table
+// periodic task to clean the certificate table and save it to disk
 func cleanupTask() {
+	var counter int
+
 	for {
 		select {
 		case <-shutdownChannel:
@@ -179,6 +232,10 @@ func cleanupTask() {
 			return
 		case <-time.After(cleanInterval * time.Second):
 			cleanCertificateTable()
+			counter++
+			if counter%(saveInterval/cleanInterval) == 0 {
+				saveCertificates()
+			}
 		}
 	}
 }
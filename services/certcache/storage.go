@@ -0,0 +1,233 @@
+package certcache
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the certcache settings are missing
+const defaultCacheFile = "/etc/config/certcache.json"
+const defaultMaxEntries = 4096
+const defaultTTLSeconds = 86400
+
+// how often the cache is written to disk when it has changed
+const saveInterval = 3600
+
+// cacheConfig holds the certificate cache settings
+type cacheConfig struct {
+	persist    bool
+	file       string
+	maxEntries int
+	ttl        time.Duration
+}
+
+// storedCertificate is a cached certificate as it is written to disk
+type storedCertificate struct {
+	Key          string    `json:"key"`
+	CreationTime time.Time `json:"creationTime"`
+	Certificate  []byte    `json:"certificate"`
+}
+
+// CertificateInfo holds the details of a cached certificate for the API
+type CertificateInfo struct {
+	Key          string    `json:"key"`
+	Available    bool      `json:"available"`
+	SubjectCN    string    `json:"subjectCn,omitempty"`
+	IssuerCN     string    `json:"issuerCn,omitempty"`
+	Names        []string  `json:"names,omitempty"`
+	NotAfter     time.Time `json:"notAfter,omitempty"`
+	CreationTime time.Time `json:"creationTime"`
+	LastAccess   time.Time `json:"lastAccess"`
+}
+
+var config = cacheConfig{persist: true, file: defaultCacheFile, maxEntries: defaultMaxEntries, ttl: defaultTTLSeconds * time.Second}
+var cacheChanged bool
+
+// loadConfig loads the certificate cache settings
+func loadConfig() {
+	fresh := cacheConfig{persist: true, file: defaultCacheFile, maxEntries: defaultMaxEntries, ttl: defaultTTLSeconds * time.Second}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"certcache"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid certcache settings: %T\n", configJSON)
+		} else {
+			if value, ok := item["persist"].(bool); ok {
+				fresh.persist = value
+			}
+			if value, ok := item["file"].(string); ok && value != "" {
+				fresh.file = value
+			}
+			if value, ok := item["maxEntries"].(float64); ok && value > 0 {
+				fresh.maxEntries = int(value)
+			}
+			if value, ok := item["ttlSeconds"].(float64); ok && value > 0 {
+				fresh.ttl = time.Duration(value) * time.Second
+			}
+		}
+	}
+
+	certificateMutex.Lock()
+	config = fresh
+	certificateMutex.Unlock()
+
+	logger.Info("Loaded certcache settings persist:%v file:%s maxEntries:%d ttl:%v\n", fresh.persist, fresh.file, fresh.maxEntries, fresh.ttl)
+}
+
+// loadCertificates fills the cache with the certificates saved by the last
+// run, skipping the ones that expired while packetd wasn't running
+func loadCertificates() {
+	certificateMutex.Lock()
+	current := config
+	certificateMutex.Unlock()
+
+	if !current.persist {
+		return
+	}
+
+	data, err := ioutil.ReadFile(current.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Unable to read the certificate cache %s: %v\n", current.file, err)
+		}
+		return
+	}
+
+	var list []storedCertificate
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		logger.Warn("Unable to parse the certificate cache %s: %v\n", current.file, err)
+		return
+	}
+
+	now := time.Now()
+	var counter int
+
+	certificateMutex.Lock()
+	defer certificateMutex.Unlock()
+
+	for _, stored := range list {
+		if now.Sub(stored.CreationTime) >= current.ttl {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(stored.Certificate)
+		if err != nil {
+			logger.Debug("Ignoring invalid cached certificate for %s: %v\n", stored.Key, err)
+			continue
+		}
+
+		holder := &CertificateHolder{CreationTime: stored.CreationTime, Certificate: *certificate, Available: true}
+		holder.lastAccess = now
+		storeCertificate(stored.Key, holder)
+		counter++
+	}
+
+	cacheChanged = false
+	logger.Info("Loaded %d certificates from %s\n", counter, current.file)
+}
+
+// saveCertificates writes the available certificates to disk if the cache
+// has changed since it was last written. The file is replaced with a rename
+// so a crash while writing doesn't lose the old file.
+func saveCertificates() {
+	var list []storedCertificate
+
+	certificateMutex.Lock()
+	current := config
+	changed := cacheChanged
+	cacheChanged = false
+	for key, holder := range certificateTable {
+		holder.CertLocker.Lock()
+		if holder.Available {
+			list = append(list, storedCertificate{Key: key, CreationTime: holder.CreationTime, Certificate: holder.Certificate.Raw})
+		}
+		holder.CertLocker.Unlock()
+	}
+	certificateMutex.Unlock()
+
+	if !current.persist || !changed {
+		return
+	}
+
+	if list == nil {
+		list = []storedCertificate{}
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		logger.Warn("Unable to encode the certificate cache: %v\n", err)
+		return
+	}
+
+	temporary := filepath.Join(filepath.Dir(current.file), "."+filepath.Base(current.file)+".tmp")
+	err = ioutil.WriteFile(temporary, data, 0600)
+	if err == nil {
+		err = os.Rename(temporary, current.file)
+	}
+	if err != nil {
+		logger.Warn("Unable to write the certificate cache %s: %v\n", current.file, err)
+		os.Remove(temporary)
+		return
+	}
+
+	logger.Debug("Saved %d certificates to %s\n", len(list), current.file)
+}
+
+// GetCertificates returns the details of the cached certificates ordered by the most recent access
+func GetCertificates() []CertificateInfo {
+	list := []CertificateInfo{}
+
+	certificateMutex.Lock()
+	for key, holder := range certificateTable {
+		info := CertificateInfo{Key: key, LastAccess: holder.lastAccess}
+		holder.CertLocker.Lock()
+		info.Available = holder.Available
+		info.CreationTime = holder.CreationTime
+		if holder.Available {
+			info.SubjectCN = holder.Certificate.Subject.CommonName
+			info.IssuerCN = holder.Certificate.Issuer.CommonName
+			info.Names = holder.Certificate.DNSNames
+			info.NotAfter = holder.Certificate.NotAfter
+		}
+		holder.CertLocker.Unlock()
+		list = append(list, info)
+	}
+	certificateMutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastAccess.After(list[j].LastAccess)
+	})
+	return list
+}
+
+// FlushCertificates removes the certificate for the argumented key or every
+// certificate when the key is empty, and returns the number removed
+func FlushCertificates(key string) int {
+	var counter int
+
+	certificateMutex.Lock()
+	if key == "" {
+		counter = len(certificateTable)
+		certificateTable = make(map[string]*CertificateHolder)
+	} else if _, found := certificateTable[key]; found {
+		delete(certificateTable, key)
+		counter = 1
+	}
+	if counter != 0 {
+		cacheChanged = true
+	}
+	certificateMutex.Unlock()
+
+	logger.Info("Flushed %d certificates from the certificate cache\n", counter)
+	saveCertificates()
+	return counter
+}
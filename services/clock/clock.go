@@ -0,0 +1,362 @@
+// Package clock watches the health of the system clock. The kernel tells us
+// if the NTP daemon has the clock synchronized and its estimated error, and
+// the NTP servers in the settings are queried for their stratum and the offset
+// of the local clock. The wall clock is also compared to the monotonic clock
+// so a step is noticed no matter what caused it. An alert is raised when the
+// clock stays unsynchronized or steps too far, and the unsynchronized periods
+// and the steps are logged to the clock_events table so the report events
+// with time stamps from those periods can be recognized.
+package clock
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the clock settings are missing
+const (
+	defaultIntervalSeconds      = 30
+	defaultStepSeconds          = 30
+	defaultUnsyncedAlertSeconds = 900
+)
+
+// the default NTP server is the daemon on the appliance
+var defaultServers = []string{"127.0.0.1"}
+
+// the kernel clock state and status bits from timex.h
+const (
+	timeError     = 5
+	statusUnsync  = 0x0040
+	statusNanosec = 0x2000
+)
+
+// Step holds a jump of the wall clock
+type Step struct {
+	Time     time.Time `json:"time"`
+	StepMs   int64     `json:"stepMs"`
+	Expected time.Time `json:"expected"`
+}
+
+// Status holds the health of the clock
+type Status struct {
+	Synchronized  bool       `json:"synchronized"`
+	UnsyncedSince *time.Time `json:"unsyncedSince,omitempty"`
+	KernelOffset  float64    `json:"kernelOffsetMs"`
+	MaxErrorMs    float64    `json:"maxErrorMs"`
+	EstErrorMs    float64    `json:"estErrorMs"`
+	Server        string     `json:"server,omitempty"`
+	Stratum       int        `json:"stratum,omitempty"`
+	OffsetMs      float64    `json:"offsetMs"`
+	DelayMs       float64    `json:"delayMs,omitempty"`
+	LastCheck     time.Time  `json:"lastCheck"`
+	Steps         uint64     `json:"steps"`
+	LastStep      *Step      `json:"lastStep,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// clockConfig holds the clock settings
+type clockConfig struct {
+	interval      time.Duration
+	stepLimit     time.Duration
+	unsyncedAlert time.Duration
+	servers       []string
+}
+
+var config clockConfig
+var status Status
+var clockLocker sync.Mutex
+var alerted bool
+var reloadChannel = make(chan bool, 1)
+var shutdownChannel = make(chan bool)
+var checkWaiter sync.WaitGroup
+
+// init registers the clock events table with the reports schema registry. The
+// table has the periods the clock was not synchronized and the steps of the
+// clock, so the events logged with a wrong time stamp can be found.
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "clock_events",
+		Owner: "clock",
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "end_time", Type: "bigint"},
+			{Name: "event", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "offset_ms", Type: "real"},
+			{Name: "step_ms", Type: "int8"},
+		},
+		TrimPercent: .1,
+	})
+}
+
+// Startup is called to handle service startup
+func Startup() {
+	loadSettings()
+	checkWaiter.Add(1)
+	go checkTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	close(shutdownChannel)
+	checkWaiter.Wait()
+}
+
+// Reload loads the clock settings
+func Reload() {
+	loadSettings()
+	select {
+	case reloadChannel <- true:
+	default:
+	}
+}
+
+// GetStatus returns the health of the clock
+func GetStatus() Status {
+	clockLocker.Lock()
+	defer clockLocker.Unlock()
+
+	result := status
+	if status.UnsyncedSince != nil {
+		stamp := *status.UnsyncedSince
+		result.UnsyncedSince = &stamp
+	}
+	if status.LastStep != nil {
+		step := *status.LastStep
+		result.LastStep = &step
+	}
+	return result
+}
+
+// IsSynchronized returns false while the clock is not synchronized, so the
+// time stamps from now may be wrong
+func IsSynchronized() bool {
+	clockLocker.Lock()
+	defer clockLocker.Unlock()
+	return status.UnsyncedSince == nil
+}
+
+// loadSettings loads the clock settings
+func loadSettings() {
+	fresh := clockConfig{
+		interval:      defaultIntervalSeconds * time.Second,
+		stepLimit:     defaultStepSeconds * time.Second,
+		unsyncedAlert: defaultUnsyncedAlertSeconds * time.Second,
+		servers:       defaultServers,
+	}
+
+	clockJSON, err := settings.GetCurrentSettings([]string{"clock"})
+	if clockJSON != nil && err == nil {
+		item, ok := clockJSON.(map[string]interface{})
+		if ok {
+			if value, ok := item["intervalSeconds"].(float64); ok && value > 0 {
+				fresh.interval = time.Duration(value) * time.Second
+			}
+			if value, ok := item["stepSeconds"].(float64); ok && value > 0 {
+				fresh.stepLimit = time.Duration(value * float64(time.Second))
+			}
+			if value, ok := item["unsyncedAlertSeconds"].(float64); ok && value >= 0 {
+				fresh.unsyncedAlert = time.Duration(value) * time.Second
+			}
+			if list, ok := item["servers"].([]interface{}); ok {
+				fresh.servers = nil
+				for _, entry := range list {
+					if server, ok := entry.(string); ok && server != "" {
+						fresh.servers = append(fresh.servers, server)
+					}
+				}
+			}
+		} else {
+			logger.Warn("Invalid clock settings: %T\n", clockJSON)
+		}
+	}
+
+	clockLocker.Lock()
+	config = fresh
+	clockLocker.Unlock()
+
+	logger.Info("Loaded clock settings interval:%v step:%v unsyncedAlert:%v servers:%v\n", fresh.interval, fresh.stepLimit, fresh.unsyncedAlert, fresh.servers)
+}
+
+// checkTask checks the clock at the configured interval. The wall time of
+// each check is compared to the monotonic time since the last one to find
+// the steps.
+func checkTask() {
+	defer checkWaiter.Done()
+
+	last := time.Now()
+	for {
+		now := time.Now()
+		// Round(0) drops the monotonic reading so Sub uses the wall clock
+		if drift := now.Round(0).Sub(last.Round(0)) - now.Sub(last); drift != 0 {
+			checkStep(now, drift)
+		}
+		last = now
+
+		checkClock(now)
+
+		clockLocker.Lock()
+		delay := config.interval
+		clockLocker.Unlock()
+
+		select {
+		case <-shutdownChannel:
+			return
+		case <-reloadChannel:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// checkStep records a step of the wall clock that is over the limit
+func checkStep(now time.Time, drift time.Duration) {
+	clockLocker.Lock()
+	limit := config.stepLimit
+	if drift < limit && drift > -limit {
+		clockLocker.Unlock()
+		return
+	}
+	step := Step{Time: now.Round(0), StepMs: drift.Milliseconds(), Expected: now.Round(0).Add(-drift)}
+	status.Steps++
+	status.LastStep = &step
+	clockLocker.Unlock()
+
+	overseer.AddCounter("clock_step", 1)
+	logger.Warn("The clock stepped %v\n", drift)
+
+	eventbus.PublishAlert("clock", fmt.Sprintf("The clock stepped %v", drift.Round(time.Millisecond)), map[string]interface{}{
+		"stepMs":   step.StepMs,
+		"expected": step.Expected,
+	})
+
+	columns := map[string]interface{}{
+		"time_stamp": step.Time,
+		"end_time":   step.Time,
+		"event":      "step",
+		"step_ms":    step.StepMs,
+	}
+	reports.LogEvent(reports.CreateEvent("clock_step", "clock_events", 1, columns, nil))
+}
+
+// checkClock reads the kernel clock state, queries the NTP servers, and
+// updates the status. The clock is unsynchronized when the kernel says so.
+func checkClock(now time.Time) {
+	var timex syscall.Timex
+	state, err := syscall.Adjtimex(&timex)
+
+	clockLocker.Lock()
+	servers := config.servers
+	clockLocker.Unlock()
+
+	var result ntpResult
+	var queryErr error
+	for _, server := range servers {
+		if result, queryErr = queryServer(server); queryErr == nil {
+			break
+		}
+	}
+
+	clockLocker.Lock()
+	status.LastCheck = now
+	status.Error = ""
+
+	synchronized := true
+	if err != nil {
+		status.Error = fmt.Sprintf("adjtimex: %v", err)
+	} else {
+		synchronized = state != timeError && timex.Status&statusUnsync == 0
+		offset := float64(timex.Offset) / 1000
+		if timex.Status&statusNanosec != 0 {
+			offset /= 1000
+		}
+		status.KernelOffset = offset
+		status.MaxErrorMs = float64(timex.Maxerror) / 1000
+		status.EstErrorMs = float64(timex.Esterror) / 1000
+	}
+
+	if len(servers) != 0 && queryErr != nil {
+		status.Server, status.Stratum, status.DelayMs = "", 0, 0
+		status.OffsetMs = status.KernelOffset
+		if status.Error == "" {
+			status.Error = queryErr.Error()
+		}
+	} else if len(servers) != 0 {
+		status.Server = result.server
+		status.Stratum = result.stratum
+		status.OffsetMs = float64(result.offset.Microseconds()) / 1000
+		status.DelayMs = float64(result.delay.Microseconds()) / 1000
+	} else {
+		status.OffsetMs = status.KernelOffset
+	}
+
+	status.Synchronized = synchronized
+	changed := synchronized != (status.UnsyncedSince == nil)
+	var since time.Time
+	if changed && !synchronized {
+		stamp := now.Round(0)
+		status.UnsyncedSince = &stamp
+	} else if changed {
+		since = *status.UnsyncedSince
+		status.UnsyncedSince = nil
+	}
+
+	raise := false
+	var unsynced time.Duration
+	if status.UnsyncedSince != nil {
+		unsynced = now.Round(0).Sub(*status.UnsyncedSince)
+		if !alerted && unsynced >= config.unsyncedAlert {
+			alerted = true
+			raise = true
+		}
+	} else {
+		alerted = false
+	}
+	unsyncedSince := status.UnsyncedSince
+	offset := status.OffsetMs
+	clockLocker.Unlock()
+
+	if changed {
+		logUnsyncedPeriod(synchronized, unsyncedSince, since, now.Round(0), offset)
+	}
+
+	if raise {
+		overseer.AddCounter("clock_unsynced", 1)
+		logger.Warn("The clock has not been synchronized for %v\n", unsynced.Round(time.Second))
+		eventbus.PublishAlert("clock", fmt.Sprintf("The clock has not been synchronized for %v", unsynced.Round(time.Second)), map[string]interface{}{
+			"unsyncedSince": *unsyncedSince,
+		})
+	}
+}
+
+// logUnsyncedPeriod adds a period to the clock_events table when the clock
+// stops being synchronized and sets the end of it when the clock is back
+func logUnsyncedPeriod(synchronized bool, unsyncedSince *time.Time, since time.Time, now time.Time, offset float64) {
+	if !synchronized {
+		logger.Notice("The clock is not synchronized\n")
+		columns := map[string]interface{}{
+			"time_stamp": *unsyncedSince,
+			"event":      "unsynced",
+			"offset_ms":  offset,
+		}
+		reports.LogEvent(reports.CreateEvent("clock_unsynced", "clock_events", 1, columns, nil))
+		return
+	}
+
+	logger.Notice("The clock is synchronized after %v\n", now.Sub(since).Round(time.Second))
+	columns := map[string]interface{}{
+		"time_stamp": since,
+		"event":      "unsynced",
+	}
+	modifiedColumns := map[string]interface{}{
+		"end_time":  now,
+		"offset_ms": offset,
+	}
+	reports.LogEvent(reports.CreateEvent("clock_synced", "clock_events", 2, columns, modifiedColumns))
+}
@@ -0,0 +1,98 @@
+package clock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// the seconds between the NTP epoch in 1900 and the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// the size of an NTP packet without extensions
+const ntpPacketSize = 48
+
+// the time we wait for an NTP reply
+const ntpTimeout = 3 * time.Second
+
+// ntpResult holds what we learn about the clock from an NTP server
+type ntpResult struct {
+	server  string
+	stratum int
+	offset  time.Duration
+	delay   time.Duration
+}
+
+// queryServer sends an SNTP request to a server and returns its stratum, the
+// offset of the local clock from it, and the round trip delay
+func queryServer(server string) (ntpResult, error) {
+	result := ntpResult{server: server}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	conn, err := net.DialTimeout("udp", server, ntpTimeout)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+	// leap indicator unknown, version 4, client mode
+	request := make([]byte, ntpPacketSize)
+	request[0] = 0x23
+	sent := time.Now()
+	putTimestamp(request[40:48], sent)
+
+	if _, err = conn.Write(request); err != nil {
+		return result, err
+	}
+
+	reply := make([]byte, ntpPacketSize)
+	count, err := conn.Read(reply)
+	received := time.Now()
+	if err != nil {
+		return result, err
+	}
+	if count < ntpPacketSize {
+		return result, errors.New("short NTP reply")
+	}
+
+	if mode := reply[0] & 0x07; mode != 4 {
+		return result, fmt.Errorf("unexpected NTP mode %d", mode)
+	}
+	// the originate time of the reply must be the transmit time we sent
+	if binary.BigEndian.Uint64(reply[24:32]) != binary.BigEndian.Uint64(request[40:48]) {
+		return result, errors.New("NTP reply does not match the request")
+	}
+	// stratum zero is a kiss-o'-death and 16 is a server that isn't synchronized
+	result.stratum = int(reply[1])
+	if result.stratum == 0 || result.stratum >= 16 {
+		return result, fmt.Errorf("NTP server is not synchronized (stratum %d)", result.stratum)
+	}
+
+	serverReceive := getTimestamp(reply[32:40])
+	serverTransmit := getTimestamp(reply[40:48])
+
+	result.offset = (serverReceive.Sub(sent) + serverTransmit.Sub(received)) / 2
+	result.delay = received.Sub(sent) - serverTransmit.Sub(serverReceive)
+	return result, nil
+}
+
+// putTimestamp writes a time as a 64 bit NTP timestamp
+func putTimestamp(data []byte, when time.Time) {
+	seconds := uint64(when.Unix()) + ntpEpochOffset
+	fraction := (uint64(when.Nanosecond()) << 32) / uint64(time.Second)
+	binary.BigEndian.PutUint64(data, seconds<<32|fraction)
+}
+
+// getTimestamp reads a 64 bit NTP timestamp
+func getTimestamp(data []byte) time.Time {
+	value := binary.BigEndian.Uint64(data)
+	seconds := int64(value>>32) - ntpEpochOffset
+	nanoseconds := int64(((value & 0xffffffff) * uint64(time.Second)) >> 32)
+	return time.Unix(seconds, nanoseconds)
+}
@@ -0,0 +1,348 @@
+// Package cloud maintains an outbound connection to a management server so a
+// fleet of devices can be managed when they are behind NAT. The device opens
+// a WebSocket to the server, uploads telemetry at a regular interval, and
+// runs the commands the server sends after checking they were signed with
+// the key from the settings.
+package cloud
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the cloud settings are missing
+const defaultTelemetryInterval = 300
+
+// the delays between connection attempts, which double after each failure
+const minimumRetryDelay = 5 * time.Second
+const maximumRetryDelay = 300 * time.Second
+
+// how often we ping the server and how long we wait for a connection
+const pingInterval = 30 * time.Second
+const connectTimeout = 30 * time.Second
+
+// cloudConfig holds the management server settings
+type cloudConfig struct {
+	enabled   bool
+	url       string
+	insecure  bool
+	publicKey ed25519.PublicKey
+	interval  time.Duration
+}
+
+// Status holds the state of the management connection
+type Status struct {
+	Enabled       bool      `json:"enabled"`
+	URL           string    `json:"url"`
+	Connected     bool      `json:"connected"`
+	ConnectTime   time.Time `json:"connectTime,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	CommandsRun   uint64    `json:"commandsRun"`
+	CommandsFail  uint64    `json:"commandsFailed"`
+	TelemetrySent uint64    `json:"telemetrySent"`
+}
+
+// telemetryMessage is uploaded to the server at the telemetry interval
+type telemetryMessage struct {
+	Type         string            `json:"type"`
+	UID          string            `json:"uid"`
+	Board        string            `json:"board"`
+	Time         int64             `json:"time"`
+	Uptime       int64             `json:"uptime"`
+	Sessions     int               `json:"sessions"`
+	EventsLogged uint64            `json:"eventsLogged"`
+	Goroutines   int               `json:"goroutines"`
+	Memory       uint64            `json:"memory"`
+	Counters     map[string]uint64 `json:"counters"`
+}
+
+// the counters included in the telemetry
+var telemetryCounters = []string{"shed_session_bypass", "elephant_session_bypass", "policy_quota_exceeded", "privacy_packets", "cloud_command_rejected"}
+
+var currentConfig *cloudConfig
+var configLocker sync.RWMutex
+var currentStatus Status
+var statusLocker sync.Mutex
+var reloadChannel = make(chan bool, 1)
+var shutdownChannel = make(chan bool)
+var agentWaiter sync.WaitGroup
+var startTime = time.Now()
+
+// Startup is called to handle service startup
+func Startup() {
+	loadConfig()
+	agentWaiter.Add(1)
+	go agentTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	close(shutdownChannel)
+	agentWaiter.Wait()
+}
+
+// Reload loads the management server settings and reconnects if they changed
+func Reload() {
+	loadConfig()
+	select {
+	case reloadChannel <- true:
+	default:
+	}
+}
+
+// GetStatus returns the state of the management connection
+func GetStatus() Status {
+	statusLocker.Lock()
+	status := currentStatus
+	statusLocker.Unlock()
+
+	status.CommandsRun = atomic.LoadUint64(&commandsRun)
+	status.CommandsFail = atomic.LoadUint64(&commandsFailed)
+	status.TelemetrySent = atomic.LoadUint64(&telemetrySent)
+	return status
+}
+
+// loadConfig loads the management server settings
+func loadConfig() {
+	fresh := &cloudConfig{interval: defaultTelemetryInterval * time.Second}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"cloud", "management"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			if problem := parseConfig(fresh, item); problem != nil {
+				logger.Warn("Ignoring invalid cloud settings: %v\n", problem)
+				fresh.enabled = false
+			}
+		} else {
+			logger.Warn("Invalid cloud settings: %T\n", configJSON)
+		}
+	}
+
+	logger.Info("Loaded cloud settings enabled:%v url:%s interval:%v\n", fresh.enabled, fresh.url, fresh.interval)
+
+	configLocker.Lock()
+	currentConfig = fresh
+	configLocker.Unlock()
+
+	statusLocker.Lock()
+	currentStatus.Enabled = fresh.enabled
+	currentStatus.URL = fresh.url
+	statusLocker.Unlock()
+}
+
+// parseConfig fills the config from a settings object. The server must use
+// wss unless insecure is set for a lab server, and the public key is a base64
+// encoded ed25519 key.
+func parseConfig(fresh *cloudConfig, item map[string]interface{}) error {
+	fresh.enabled, _ = item["enabled"].(bool)
+	fresh.url, _ = item["url"].(string)
+	fresh.insecure, _ = item["insecure"].(bool)
+	if value, ok := item["telemetryInterval"].(float64); ok && value > 0 {
+		fresh.interval = time.Duration(value) * time.Second
+	}
+
+	if !fresh.enabled {
+		return nil
+	}
+	if fresh.url == "" {
+		return fmt.Errorf("missing url")
+	}
+	location, err := url.Parse(fresh.url)
+	if err != nil {
+		return fmt.Errorf("url: %v", err)
+	}
+	switch {
+	case location.Scheme == "wss":
+	case location.Scheme == "ws" && fresh.insecure:
+		logger.Warn("The cloud connection to %s is insecure, the command results and telemetry are not encrypted\n", fresh.url)
+	default:
+		return fmt.Errorf("url: unsupported scheme %s", location.Scheme)
+	}
+
+	encoded, _ := item["publicKey"].(string)
+	if encoded == "" {
+		return fmt.Errorf("missing publicKey")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("publicKey: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("publicKey: invalid length %d", len(key))
+	}
+	fresh.publicKey = ed25519.PublicKey(key)
+	return nil
+}
+
+// getConfig returns the current management server settings
+func getConfig() *cloudConfig {
+	configLocker.RLock()
+	defer configLocker.RUnlock()
+	return currentConfig
+}
+
+// agentTask keeps the connection to the management server open while it is
+// enabled, waiting longer after each failed attempt
+func agentTask() {
+	defer agentWaiter.Done()
+	delay := minimumRetryDelay
+
+	for {
+		config := getConfig()
+		if config != nil && config.enabled {
+			connected, err := runConnection(config)
+			if err != nil {
+				logger.Warn("%OC|Cloud connection to %s failed: %v\n", "cloud_connect_failure", 10, config.url, err)
+				setConnected(false, err)
+			}
+			if connected {
+				delay = minimumRetryDelay
+			}
+		}
+
+		select {
+		case <-shutdownChannel:
+			return
+		case <-reloadChannel:
+			delay = minimumRetryDelay
+			continue
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maximumRetryDelay {
+			delay = maximumRetryDelay
+		}
+	}
+}
+
+// runConnection connects to the server and handles the connection until it
+// fails, the settings are reloaded or we shut down. Returns true if the
+// connection was established.
+func runConnection(config *cloudConfig) (bool, error) {
+	uid, err := settings.GetUID()
+	if err != nil {
+		return false, err
+	}
+
+	header := make(http.Header)
+	header.Set("X-Device-UID", uid)
+	header.Set("X-Device-Board", settings.GetBoardName())
+
+	socket, err := dialWebSocket(config.url, header, connectTimeout, config.insecure)
+	if err != nil {
+		return false, err
+	}
+	defer socket.Close()
+
+	logger.Info("Connected to cloud management server %s\n", config.url)
+	overseer.AddCounter("cloud_connect", 1)
+	setConnected(true, nil)
+
+	readChannel := make(chan []byte)
+	errorChannel := make(chan error, 1)
+	go func() {
+		for {
+			message, err := socket.ReadMessage()
+			if err != nil {
+				errorChannel <- err
+				return
+			}
+			readChannel <- message
+		}
+	}()
+
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
+	telemetryTicker := time.NewTicker(config.interval)
+	defer telemetryTicker.Stop()
+
+	sendTelemetry(socket, uid)
+
+	for {
+		select {
+		case <-shutdownChannel:
+			setConnected(false, nil)
+			return true, nil
+		case <-reloadChannel:
+			logger.Info("Closing cloud management connection to reload settings\n")
+			setConnected(false, nil)
+			return true, nil
+		case err := <-errorChannel:
+			return true, err
+		case message := <-readChannel:
+			handleMessage(socket, config, uid, message)
+		case <-pingTicker.C:
+			if err := socket.Ping(); err != nil {
+				return true, err
+			}
+		case <-telemetryTicker.C:
+			sendTelemetry(socket, uid)
+		}
+	}
+}
+
+// setConnected updates the connection state in the status
+func setConnected(connected bool, err error) {
+	statusLocker.Lock()
+	defer statusLocker.Unlock()
+
+	currentStatus.Connected = connected
+	if connected {
+		currentStatus.ConnectTime = time.Now()
+		currentStatus.LastError = ""
+	} else {
+		currentStatus.ConnectTime = time.Time{}
+	}
+	if err != nil {
+		currentStatus.LastError = err.Error()
+	}
+}
+
+// sendTelemetry uploads the current state of the device to the server
+func sendTelemetry(socket *websocket, uid string) {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	telemetry := telemetryMessage{
+		Type:         "telemetry",
+		UID:          uid,
+		Board:        settings.GetBoardName(),
+		Time:         time.Now().Unix(),
+		Uptime:       int64(time.Since(startTime).Seconds()),
+		Sessions:     len(dispatch.GetConntrackTable()),
+		EventsLogged: atomic.LoadUint64(&reports.EventsLogged),
+		Goroutines:   runtime.NumGoroutine(),
+		Memory:       memory.Alloc,
+		Counters:     make(map[string]uint64),
+	}
+	for _, name := range telemetryCounters {
+		telemetry.Counters[name] = overseer.GetCounter(name)
+	}
+
+	data, err := json.Marshal(telemetry)
+	if err != nil {
+		logger.Warn("Unable to encode cloud telemetry: %v\n", err)
+		return
+	}
+	if err := socket.WriteMessage(data); err != nil {
+		logger.Warn("Unable to send cloud telemetry: %v\n", err)
+		return
+	}
+	atomic.AddUint64(&telemetrySent, 1)
+}
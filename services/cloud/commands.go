@@ -0,0 +1,334 @@
+package cloud
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// commands older or newer than this are rejected to limit replays
+const commandWindow = 300 * time.Second
+
+// the limits on a capture requested by the server
+const captureDirectory = "/tmp"
+const maxCaptureSeconds = 600
+
+// commandMessage is a command sent by the server. The signature is the
+// ed25519 signature of the device UID, id, command, timestamp, and payload,
+// each followed by a newline except the payload, so a command signed for one
+// device can't be replayed on another.
+type commandMessage struct {
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	Command   string          `json:"command"`
+	Timestamp int64           `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+	Signature []byte          `json:"signature"`
+}
+
+// resultMessage is sent back to the server when a command is finished
+type resultMessage struct {
+	Type    string      `json:"type"`
+	ID      string      `json:"id"`
+	Success bool        `json:"success"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// commandFunction runs a command with the payload from the server
+type commandFunction func(payload json.RawMessage) (interface{}, error)
+
+var commandTable = map[string]commandFunction{
+	"settings":         commandSettings,
+	"settings_confirm": commandSettingsConfirm,
+	"report_query":     commandReportQuery,
+	"capture":          commandCapture,
+	"sanitize":         commandSanitize,
+}
+
+var seenCommands = make(map[string]time.Time)
+var seenLocker sync.Mutex
+var captureLocker sync.Mutex
+var commandsRun uint64
+var commandsFailed uint64
+var telemetrySent uint64
+
+// handleMessage checks and runs a command from the server and sends the result
+func handleMessage(socket *websocket, config *cloudConfig, uid string, data []byte) {
+	var message commandMessage
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		logger.Warn("%OC|Invalid cloud message: %v\n", "cloud_command_rejected", 10, err)
+		return
+	}
+	if message.Type != "command" {
+		logger.Debug("Ignoring cloud message type %s\n", message.Type)
+		return
+	}
+
+	result := resultMessage{Type: "result", ID: message.ID}
+
+	err = verifyCommand(config, uid, &message, time.Now())
+	if err != nil {
+		logger.Warn("%OC|Rejected cloud command %s: %v\n", "cloud_command_rejected", 10, message.ID, err)
+		result.Error = err.Error()
+		sendResult(socket, &result)
+		return
+	}
+
+	logger.Info("Running cloud command %s id:%s\n", message.Command, message.ID)
+
+	// commands can take a while so they run without holding up the connection
+	go func() {
+		output, err := commandTable[message.Command](message.Payload)
+		if err != nil {
+			logger.Warn("Cloud command %s id:%s failed: %v\n", message.Command, message.ID, err)
+			atomic.AddUint64(&commandsFailed, 1)
+			result.Error = err.Error()
+		} else {
+			atomic.AddUint64(&commandsRun, 1)
+			overseer.AddCounter("cloud_command_"+message.Command, 1)
+			result.Success = true
+			result.Result = output
+		}
+		sendResult(socket, &result)
+	}()
+}
+
+// verifyCommand returns an error if the command is unknown, the signature
+// is not valid, the timestamp is outside the window, or the command was
+// already received. The ids are kept until their timestamp has left the
+// window, after which the command is rejected anyway.
+func verifyCommand(config *cloudConfig, uid string, message *commandMessage, now time.Time) error {
+	if message.ID == "" {
+		return fmt.Errorf("missing id")
+	}
+	if _, found := commandTable[message.Command]; !found {
+		return fmt.Errorf("unknown command: %s", message.Command)
+	}
+
+	if !ed25519.Verify(config.publicKey, getSignedData(uid, message), message.Signature) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	stamp := time.Unix(message.Timestamp, 0)
+	if stamp.Before(now.Add(-commandWindow)) || stamp.After(now.Add(commandWindow)) {
+		return fmt.Errorf("timestamp outside the allowed window")
+	}
+
+	seenLocker.Lock()
+	defer seenLocker.Unlock()
+
+	for id, seen := range seenCommands {
+		if seen.Before(now.Add(-commandWindow)) {
+			delete(seenCommands, id)
+		}
+	}
+	if _, found := seenCommands[message.ID]; found {
+		return fmt.Errorf("duplicate id")
+	}
+	seenCommands[message.ID] = stamp
+	return nil
+}
+
+// getSignedData returns the bytes covered by the command signature
+func getSignedData(uid string, message *commandMessage) []byte {
+	var buffer strings.Builder
+	fmt.Fprintf(&buffer, "%s\n%s\n%s\n%d\n", uid, message.ID, message.Command, message.Timestamp)
+	buffer.Write(message.Payload)
+	return []byte(buffer.String())
+}
+
+// sendResult sends the result of a command to the server
+func sendResult(socket *websocket, result *resultMessage) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Warn("Unable to encode cloud result: %v\n", err)
+		return
+	}
+	if err := socket.WriteMessage(data); err != nil {
+		logger.Warn("Unable to send cloud result: %v\n", err)
+	}
+}
+
+// commandSettings stages the value at a settings path and commits it like a
+// change from the UI, so the change is validated and rolled back unless the
+// server sends a settings_confirm command within the confirm seconds, which
+// default to settings.DefaultConfirmSeconds. The path is a list of segments
+// or a slash separated string. This fails if other changes are already staged.
+func commandSettings(payload json.RawMessage) (interface{}, error) {
+	var request struct {
+		Path    interface{} `json:"path"`
+		Value   interface{} `json:"value"`
+		Confirm *int        `json:"confirm"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	confirm := settings.DefaultConfirmSeconds
+	if request.Confirm != nil {
+		confirm = *request.Confirm
+	}
+	if confirm < 0 {
+		return nil, fmt.Errorf("invalid confirm seconds: %d", confirm)
+	}
+
+	var segments []string
+	switch path := request.Path.(type) {
+	case string:
+		segments = strings.Split(strings.Trim(path, "/"), "/")
+	case []interface{}:
+		for _, item := range path {
+			segment, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid path segment: %v", item)
+			}
+			segments = append(segments, segment)
+		}
+	default:
+		return nil, fmt.Errorf("invalid path: %v", request.Path)
+	}
+
+	if settings.GetStagingStatus().Staged {
+		return nil, fmt.Errorf("other settings changes are already staged")
+	}
+
+	_, err = settings.StageSettings(segments, request.Value)
+	if err != nil {
+		settings.DiscardStagedSettings()
+		return nil, err
+	}
+
+	result, err := settings.CommitStagedSettings(confirm)
+	if err != nil {
+		settings.DiscardStagedSettings()
+		return result, err
+	}
+
+	reloadSettings()
+	return map[string]interface{}{"confirmSeconds": confirm, "validation": result}, nil
+}
+
+// commandSettingsConfirm confirms the settings from a commit so they are not
+// rolled back
+func commandSettingsConfirm(payload json.RawMessage) (interface{}, error) {
+	err := settings.ConfirmSettings()
+	if err != nil {
+		return nil, err
+	}
+	return "OK", nil
+}
+
+// reloadSettings sends ourselves a SIGHUP so the services and plugins load
+// the committed settings
+func reloadSettings() {
+	err := syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	if err != nil {
+		logger.Warn("Unable to reload the settings: %v\n", err)
+	}
+}
+
+// commandReportQuery runs a report query and returns the rows
+func commandReportQuery(payload json.RawMessage) (interface{}, error) {
+	query, err := reports.CreateQuery(string(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reports.CloseQuery(query.ID)
+
+	data, err := reports.GetData(query.ID)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+// commandCapture captures the traffic to a file in the capture directory for
+// the argumented number of seconds. Only one capture can run at a time.
+func commandCapture(payload json.RawMessage) (interface{}, error) {
+	var request struct {
+		Filename string  `json:"filename"`
+		Seconds  float64 `json:"seconds"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(request.Filename)
+	if name == "." || name == "/" || name == ".." {
+		return nil, fmt.Errorf("invalid filename: %s", request.Filename)
+	}
+	if request.Seconds <= 0 || request.Seconds > maxCaptureSeconds {
+		return nil, fmt.Errorf("seconds must be between 1 and %d", maxCaptureSeconds)
+	}
+	filename := filepath.Join(captureDirectory, name)
+
+	captureLocker.Lock()
+	defer captureLocker.Unlock()
+
+	if kernel.GetWarehouseFlag() != 'I' {
+		return nil, fmt.Errorf("warehouse is busy")
+	}
+
+	logger.Info("Beginning cloud capture to file:%s\n", filename)
+	err = dispatch.StartWarehouseCapture(filename)
+	if err != nil {
+		return nil, err
+	}
+	kernel.SetWarehouseFlag('C')
+
+	select {
+	case <-time.After(time.Duration(request.Seconds * float64(time.Second))):
+	case <-shutdownChannel:
+	}
+
+	dispatch.CloseWarehouseCapture()
+	kernel.SetWarehouseFlag('I')
+	logger.Info("Finished cloud capture to file:%s\n", filename)
+
+	return filename, nil
+}
+
+// commandSanitize writes a sanitized copy of a capture in the capture
+// directory, which can be shared with the vendors, and returns its filename
+// with the counts from the sanitizing
+func commandSanitize(payload json.RawMessage) (interface{}, error) {
+	var request struct {
+		Filename string `json:"filename"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	name := filepath.Base(request.Filename)
+	if name == "." || name == "/" || name == ".." {
+		return nil, fmt.Errorf("invalid filename: %s", request.Filename)
+	}
+	source := filepath.Join(captureDirectory, name)
+	target := source + ".sanitized"
+
+	result, err := dispatch.SanitizeFile(source, target)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"filename": target, "result": result}, nil
+}
@@ -0,0 +1,257 @@
+package cloud
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The WebSocket opcodes from RFC 6455
+const (
+	opcodeContinuation = 0x0
+	opcodeText         = 0x1
+	opcodeBinary       = 0x2
+	opcodeClose        = 0x8
+	opcodePing         = 0x9
+	opcodePong         = 0xA
+)
+
+// the GUID added to the key for the handshake accept value
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// the largest message we accept from the server
+const maxMessageSize = 1024 * 1024
+
+// websocket is the client side of a WebSocket connection. Messages can be
+// written by several goroutines but only one goroutine can read.
+type websocket struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	writeLocker sync.Mutex
+}
+
+// dialWebSocket connects to a wss URL and completes the handshake. A ws URL
+// is only allowed when insecure is true.
+func dialWebSocket(target string, header http.Header, timeout time.Duration, insecure bool) (*websocket, error) {
+	location, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	host := location.Host
+	if location.Port() == "" {
+		switch location.Scheme {
+		case "ws":
+			host = net.JoinHostPort(location.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(location.Hostname(), "443")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch location.Scheme {
+	case "ws":
+		if !insecure {
+			return nil, fmt.Errorf("insecure scheme: %s", location.Scheme)
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: location.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", location.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	request := &http.Request{
+		Method:     "GET",
+		URL:        location,
+		Host:       location.Host,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	request.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	err = request.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %s", response.Status)
+	}
+
+	digest := sha1.Sum([]byte(key + websocketGUID))
+	if response.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(digest[:]) {
+		conn.Close()
+		return nil, errors.New("handshake failed: invalid accept value")
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &websocket{conn: conn, reader: reader}, nil
+}
+
+// ReadMessage returns the next text or binary message. The pings from the
+// server are answered while waiting, and a close from the server returns io.EOF.
+func (socket *websocket) ReadMessage() ([]byte, error) {
+	var message []byte
+
+	for {
+		final, opcode, payload, err := socket.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opcodePing:
+			err = socket.writeFrame(opcodePong, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case opcodePong:
+			continue
+		case opcodeClose:
+			socket.writeFrame(opcodeClose, nil)
+			return nil, io.EOF
+		case opcodeText, opcodeBinary, opcodeContinuation:
+		default:
+			return nil, fmt.Errorf("invalid opcode: %d", opcode)
+		}
+
+		message = append(message, payload...)
+		if len(message) > maxMessageSize {
+			return nil, errors.New("message too large")
+		}
+		if final {
+			return message, nil
+		}
+	}
+}
+
+// WriteMessage sends a text message
+func (socket *websocket) WriteMessage(data []byte) error {
+	return socket.writeFrame(opcodeText, data)
+}
+
+// Ping sends a ping to the server
+func (socket *websocket) Ping() error {
+	return socket.writeFrame(opcodePing, nil)
+}
+
+// Close closes the connection
+func (socket *websocket) Close() error {
+	socket.writeFrame(opcodeClose, nil)
+	return socket.conn.Close()
+}
+
+// readFrame reads a frame from the server, which is never masked
+func (socket *websocket) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(socket.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	final := (header[0] & 0x80) != 0
+	opcode := int(header[0] & 0x0F)
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(socket.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(socket.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	if length > maxMessageSize {
+		return false, 0, nil, errors.New("frame too large")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(socket.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	return final, opcode, payload, nil
+}
+
+// writeFrame writes a single frame, which the client must always mask
+func (socket *websocket) writeFrame(opcode int, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|byte(opcode))
+
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 0x80|126, byte(length>>8), byte(length))
+	default:
+		var extended [8]byte
+		binary.BigEndian.PutUint64(extended[:], uint64(length))
+		frame = append(frame, 0x80|127)
+		frame = append(frame, extended[:]...)
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for index, value := range payload {
+		frame = append(frame, value^mask[index%4])
+	}
+
+	socket.writeLocker.Lock()
+	defer socket.writeLocker.Unlock()
+
+	socket.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err := socket.conn.Write(frame)
+	return err
+}
@@ -0,0 +1,264 @@
+// Package crashreport saves a report for each panic that packetd catches so
+// crashes in the field can be looked at after the process is gone. A report
+// holds the panic value, the stack of the goroutine that panicked, the recent
+// log messages, and the counters, and is written to persistent storage before
+// the caller decides whether to carry on or let the process die. The oldest
+// reports are removed once the limit from the settings is reached.
+package crashreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the crashreport settings are missing
+const defaultDirectory = "/etc/config/crashreports"
+const defaultMaxReports = 10
+
+// the file name suffix of the reports
+const reportSuffix = ".json"
+
+// Report holds the details of a panic
+type Report struct {
+	ID         string            `json:"id"`
+	Time       time.Time         `json:"time"`
+	Source     string            `json:"source"`
+	Panic      string            `json:"panic"`
+	Goroutines int               `json:"goroutines"`
+	Stack      string            `json:"stack"`
+	Log        []string          `json:"log"`
+	Counters   map[string]uint64 `json:"counters"`
+}
+
+// Summary holds the fields of a report that are shown in the list
+type Summary struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Panic  string    `json:"panic"`
+}
+
+// reportConfig holds the crashreport settings
+type reportConfig struct {
+	directory  string
+	maxReports int
+}
+
+var config = reportConfig{directory: defaultDirectory, maxReports: defaultMaxReports}
+var reportLocker sync.Mutex
+var validID = regexp.MustCompile(`^panic-[0-9]{8}-[0-9]{6}\.[0-9]{6}$`)
+
+// Startup is called to handle service startup
+func Startup() {
+	loadSettings()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+}
+
+// Reload loads the crashreport settings
+func Reload() {
+	loadSettings()
+}
+
+// Capture saves a report for a recovered panic. The source says where the
+// panic was caught and the stack should come from debug.Stack in the deferred
+// function that recovered it, so it still shows where the panic started.
+func Capture(source string, recovered interface{}, stack []byte) {
+	now := time.Now()
+	report := Report{
+		ID:         "panic-" + now.Format("20060102-150405.000000"),
+		Time:       now,
+		Source:     source,
+		Panic:      fmt.Sprintf("%v", recovered),
+		Goroutines: runtime.NumGoroutine(),
+		Stack:      string(stack),
+		Log:        logger.GetRecentMessages(),
+		Counters:   overseer.GetCounters(),
+	}
+
+	overseer.AddCounter("crash_reports", 1)
+	logger.Crit("Panic in %s: %v\n", source, recovered)
+
+	err := writeReport(&report)
+	if err != nil {
+		logger.Err("Unable to save the crash report for %s: %v\n", source, err)
+		return
+	}
+	logger.Crit("Saved crash report %s\n", report.ID)
+}
+
+// List returns the summary of every saved report with the most recent first
+func List() []Summary {
+	list := []Summary{}
+
+	reportLocker.Lock()
+	directory := config.directory
+	reportLocker.Unlock()
+
+	for _, id := range getReportIDs(directory) {
+		report, err := readReport(directory, id)
+		if err != nil {
+			logger.Warn("Unable to read crash report %s: %v\n", id, err)
+			continue
+		}
+		list = append(list, Summary{ID: report.ID, Time: report.Time, Source: report.Source, Panic: report.Panic})
+	}
+
+	return list
+}
+
+// Get returns the report with the argumented id
+func Get(id string) (*Report, error) {
+	if !validID.MatchString(id) {
+		return nil, fmt.Errorf("invalid crash report id: %s", id)
+	}
+
+	reportLocker.Lock()
+	directory := config.directory
+	reportLocker.Unlock()
+
+	return readReport(directory, id)
+}
+
+// Remove removes the report with the argumented id
+func Remove(id string) error {
+	if !validID.MatchString(id) {
+		return fmt.Errorf("invalid crash report id: %s", id)
+	}
+
+	reportLocker.Lock()
+	defer reportLocker.Unlock()
+
+	return os.Remove(filepath.Join(config.directory, id+reportSuffix))
+}
+
+// Clear removes every saved report and returns the number removed
+func Clear() int {
+	var counter int
+
+	reportLocker.Lock()
+	defer reportLocker.Unlock()
+
+	for _, id := range getReportIDs(config.directory) {
+		if os.Remove(filepath.Join(config.directory, id+reportSuffix)) == nil {
+			counter++
+		}
+	}
+
+	logger.Info("Removed %d crash reports\n", counter)
+	return counter
+}
+
+// loadSettings loads the crashreport settings
+func loadSettings() {
+	fresh := reportConfig{directory: defaultDirectory, maxReports: defaultMaxReports}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"crashreport"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid crashreport settings: %T\n", configJSON)
+		} else {
+			if value, ok := item["directory"].(string); ok && value != "" {
+				fresh.directory = value
+			}
+			if value, ok := item["maxReports"].(float64); ok && value > 0 {
+				fresh.maxReports = int(value)
+			}
+		}
+	}
+
+	reportLocker.Lock()
+	config = fresh
+	reportLocker.Unlock()
+
+	logger.Info("Loaded crashreport settings directory:%s maxReports:%d\n", fresh.directory, fresh.maxReports)
+}
+
+// writeReport writes a report to the directory and removes the oldest
+// reports over the limit. The file is written with a rename so a crash while
+// writing doesn't leave a partial report behind.
+func writeReport(report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	reportLocker.Lock()
+	defer reportLocker.Unlock()
+
+	err = os.MkdirAll(config.directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(config.directory, report.ID+reportSuffix)
+	temporary := filepath.Join(config.directory, "."+report.ID+".tmp")
+	err = ioutil.WriteFile(temporary, data, 0600)
+	if err == nil {
+		err = os.Rename(temporary, filename)
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+
+	list := getReportIDs(config.directory)
+	for index := config.maxReports; index < len(list); index++ {
+		os.Remove(filepath.Join(config.directory, list[index]+reportSuffix))
+	}
+
+	return nil
+}
+
+// readReport reads the report with the argumented id from the directory
+func readReport(directory string, id string) (*Report, error) {
+	data, err := ioutil.ReadFile(filepath.Join(directory, id+reportSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	report := new(Report)
+	err = json.Unmarshal(data, report)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// getReportIDs returns the ids of the reports in the directory with the most
+// recent first, which is the reverse order of the names since they hold the time
+func getReportIDs(directory string) []string {
+	var list []string
+
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return list
+	}
+
+	for _, info := range infos {
+		id := strings.TrimSuffix(info.Name(), reportSuffix)
+		if info.IsDir() || !validID.MatchString(id) || id+reportSuffix != info.Name() {
+			continue
+		}
+		list = append(list, id)
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(list)))
+	return list
+}
@@ -0,0 +1,390 @@
+// Package dhcpclient releases and renews the DHCP leases of an interface
+// through whichever DHCP client the platform runs. OpenWrt runs udhcpc for
+// IPv4 and odhcp6c for DHCPv6 and RA, which are told what to do with signals.
+// Other distributions run dhclient or systemd-networkd, which are driven with
+// their own commands. The client already running for the interface is used
+// when there is one, otherwise the first one installed. After the action the
+// addresses of the interface are returned as the lease state.
+package dhcpclient
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The address families a lease can be for
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// The actions that can be done to a lease
+const (
+	ActionRelease = "release"
+	ActionRenew   = "renew"
+)
+
+// the time we wait for an address after a renew
+const renewWait = 5 * time.Second
+
+// ErrNoClient is returned when no DHCP client is available for the family
+var ErrNoClient = errors.New("no DHCP client found")
+
+// ErrUnsupported is returned when the client can't do the action
+var ErrUnsupported = errors.New("action not supported by the DHCP client")
+
+// Client is a DHCP client that can release and renew the lease of an interface
+type Client interface {
+	// Name returns the name of the client
+	Name() string
+	// Family returns the address family the client handles
+	Family() string
+	// Installed returns true if the client is on the system
+	Installed() bool
+	// Running returns true if the client is running for the device
+	Running(device string) bool
+	// Release releases the lease of the device
+	Release(device string) error
+	// Renew renews the lease of the device
+	Renew(device string) error
+}
+
+// Lease holds the result of an action and the lease state of the interface after it
+type Lease struct {
+	Device    string   `json:"device"`
+	Family    string   `json:"family"`
+	Action    string   `json:"action"`
+	Client    string   `json:"client,omitempty"`
+	Bound     bool     `json:"bound"`
+	Addresses []string `json:"addresses"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// clientList holds the clients in the order they are tried
+var clientList = []Client{
+	&signalClient{name: "udhcpc", family: FamilyIPv4, release: syscall.SIGUSR2, renew: syscall.SIGUSR1},
+	&signalClient{name: "odhcp6c", family: FamilyIPv6, release: syscall.SIGUSR2, renew: syscall.SIGUSR1},
+	&dhclient{family: FamilyIPv4},
+	&dhclient{family: FamilyIPv6},
+	&networkd{family: FamilyIPv4},
+	&networkd{family: FamilyIPv6},
+}
+
+// Detect returns the client for the device and family, which is the one
+// running for the device if there is one, or the first one installed
+func Detect(device string, family string) (Client, error) {
+	var installed Client
+
+	for _, client := range clientList {
+		if client.Family() != family || !client.Installed() {
+			continue
+		}
+		if client.Running(device) {
+			return client, nil
+		}
+		if installed == nil {
+			installed = client
+		}
+	}
+
+	if installed == nil {
+		return nil, ErrNoClient
+	}
+	return installed, nil
+}
+
+// Release releases the lease of the device for the family and returns the lease state
+func Release(device string, family string) Lease {
+	return apply(device, family, ActionRelease)
+}
+
+// Renew renews the lease of the device for the family and returns the lease state
+func Renew(device string, family string) Lease {
+	return apply(device, family, ActionRenew)
+}
+
+// apply does the action with the client for the device and family
+func apply(device string, family string, action string) Lease {
+	lease := Lease{Device: device, Family: family, Action: action}
+
+	if _, err := net.InterfaceByName(device); err != nil {
+		lease.Error = err.Error()
+		return lease
+	}
+
+	client, err := Detect(device, family)
+	if err != nil {
+		lease.Error = err.Error()
+		return lease
+	}
+	lease.Client = client.Name()
+
+	if action == ActionRelease {
+		err = client.Release(device)
+	} else {
+		err = client.Renew(device)
+	}
+	if err != nil {
+		lease.Error = err.Error()
+		logger.Warn("Failed to %s the %s lease of %s with %s: %v\n", action, family, device, client.Name(), err)
+	} else {
+		logger.Info("Sent %s of the %s lease of %s to %s\n", action, family, device, client.Name())
+	}
+
+	// the clients do the work in the background so give a renew some time
+	deadline := time.Now().Add(renewWait)
+	for {
+		lease.Addresses = getAddresses(device, family)
+		lease.Bound = len(lease.Addresses) != 0
+		if action != ActionRenew || err != nil || lease.Bound || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return lease
+}
+
+// getAddresses returns the addresses of the family on the device. The IPv6
+// link local address is always there so it is not part of the lease.
+func getAddresses(device string, family string) []string {
+	list := []string{}
+
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return list
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return list
+	}
+
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if (ipnet.IP.To4() != nil) != (family == FamilyIPv4) {
+			continue
+		}
+		if ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		list = append(list, ipnet.String())
+	}
+
+	return list
+}
+
+// findProcesses returns the pids of the named program running with the device in its arguments
+func findProcesses(name string, device string) []int {
+	var list []int
+
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return list
+	}
+
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile("/proc/" + dir.Name() + "/cmdline")
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		if filepath.Base(args[0]) != name {
+			continue
+		}
+		for _, arg := range args[1:] {
+			if arg == device || arg == "-i"+device {
+				list = append(list, pid)
+				break
+			}
+		}
+	}
+
+	return list
+}
+
+// runCommand runs a client command and returns the output as the error if it fails
+func runCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			return fmt.Errorf("%s: %s", name, text)
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// signalClient is a client that keeps running for the interface and is told
+// to release or renew with signals, like udhcpc and odhcp6c
+type signalClient struct {
+	name    string
+	family  string
+	release syscall.Signal
+	renew   syscall.Signal
+}
+
+func (c *signalClient) Name() string {
+	return c.name
+}
+
+func (c *signalClient) Family() string {
+	return c.family
+}
+
+func (c *signalClient) Installed() bool {
+	_, err := exec.LookPath(c.name)
+	return err == nil
+}
+
+func (c *signalClient) Running(device string) bool {
+	return len(findProcesses(c.name, device)) != 0
+}
+
+func (c *signalClient) Release(device string) error {
+	return c.signal(device, c.release)
+}
+
+func (c *signalClient) Renew(device string) error {
+	return c.signal(device, c.renew)
+}
+
+// signal sends the signal to the client running for the device, which is
+// started by the network configuration so we can't start one ourselves
+func (c *signalClient) signal(device string, sig syscall.Signal) error {
+	list := findProcesses(c.name, device)
+	if len(list) == 0 {
+		return fmt.Errorf("%s is not running for %s", c.name, device)
+	}
+
+	for _, pid := range list {
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		if err = process.Signal(sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dhclient is the ISC DHCP client, which handles DHCPv6 with the -6 flag
+type dhclient struct {
+	family string
+}
+
+func (c *dhclient) Name() string {
+	if c.family == FamilyIPv6 {
+		return "dhclient -6"
+	}
+	return "dhclient"
+}
+
+func (c *dhclient) Family() string {
+	return c.family
+}
+
+func (c *dhclient) Installed() bool {
+	_, err := exec.LookPath("dhclient")
+	return err == nil
+}
+
+func (c *dhclient) Running(device string) bool {
+	for _, pid := range findProcesses("dhclient", device) {
+		data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+		if err != nil {
+			continue
+		}
+		ipv6 := strings.Contains(string(data), "\x00-6\x00")
+		if ipv6 == (c.family == FamilyIPv6) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *dhclient) Release(device string) error {
+	return runCommand("dhclient", c.arguments("-r", device)...)
+}
+
+// Renew releases the lease first since dhclient won't start while another
+// instance is running for the device
+func (c *dhclient) Renew(device string) error {
+	runCommand("dhclient", c.arguments("-x", device)...)
+	return runCommand("dhclient", c.arguments("-nw", device)...)
+}
+
+// arguments returns the dhclient arguments for the family
+func (c *dhclient) arguments(flag string, device string) []string {
+	if c.family == FamilyIPv6 {
+		return []string{"-6", flag, device}
+	}
+	return []string{"-4", flag, device}
+}
+
+// networkd is systemd-networkd, which handles DHCPv4, DHCPv6, and RA itself
+// and is driven with networkctl. It can renew a lease but not release one
+// without taking the link down, so release isn't supported.
+type networkd struct {
+	family string
+}
+
+func (c *networkd) Name() string {
+	return "systemd-networkd"
+}
+
+func (c *networkd) Family() string {
+	return c.family
+}
+
+func (c *networkd) Installed() bool {
+	_, err := exec.LookPath("networkctl")
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat("/run/systemd/netif/links")
+	return err == nil
+}
+
+func (c *networkd) Running(device string) bool {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return false
+	}
+	data, err := ioutil.ReadFile("/run/systemd/netif/links/" + strconv.Itoa(iface.Index))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(data), "NETWORK_FILE=")
+}
+
+func (c *networkd) Release(device string) error {
+	return ErrUnsupported
+}
+
+// Renew renews the DHCPv4 lease, and for IPv6 reconfigures the link which
+// restarts DHCPv6 and the router solicitation
+func (c *networkd) Renew(device string) error {
+	if c.family == FamilyIPv6 {
+		return runCommand("networkctl", "reconfigure", device)
+	}
+	return runCommand("networkctl", "renew", device)
+}
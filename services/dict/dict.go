@@ -10,8 +10,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/untangle/packetd/services/faults"
 	"github.com/untangle/packetd/services/logger"
 )
 
@@ -25,6 +27,21 @@ var shutdownChannel = make(chan bool)
 var readMutex = &sync.Mutex{}
 var disabled = false
 
+// suppressedSessions holds the ctids of the sessions that must not be written
+var suppressedSessions sync.Map
+
+// the session fields that are still written for a suppressed session since
+// they control how the kernel handles the session rather than describe it
+var suppressedAllowed = map[string]bool{
+	"bypass_packetd": true,
+}
+
+// SessionObserver is called with each field written to the session table
+type SessionObserver func(ctid uint32, field string, value interface{})
+
+// sessionObserver holds the SessionObserver used for debugging, which may be nil
+var sessionObserver atomic.Value
+
 // Startup dict service
 func Startup() {
 	if disabled {
@@ -51,6 +68,19 @@ func Disable() {
 	disabled = true
 }
 
+// IsDisabled returns true if dict was disabled on the command line
+func IsDisabled() bool {
+	return disabled
+}
+
+// CheckModule returns an error if the nft_dict kernel module isn't loaded
+func CheckModule() error {
+	if _, err := os.Stat(pathBase); err != nil {
+		return fmt.Errorf("nft_dict module not loaded: %v", err)
+	}
+	return nil
+}
+
 // Entry holds a dictionary entry
 // Table is the string name of the table the entry's dictionary is in
 // Key is the key of this entry's dictionary in the table
@@ -343,6 +373,20 @@ func (p Entry) GetBool() (bool, error) {
 // This function will return an error if it is unable to open
 // or write to /proc/net/dict/write
 func writeEntry(setstr string) error {
+	return writeEntries([]string{setstr})
+}
+
+// writeEntries writes out a list of set strings to the dict proc write node
+// The node is opened once for the whole list but every set string is passed
+// in a separate write since the kernel parses one entry per write.
+// This function will return an error if it is unable to open
+// or write to /proc/net/dict/write
+func writeEntries(setstrs []string) error {
+	if err := faults.Inject(faults.DictWrite, ""); err != nil {
+		logger.Warn("writeEntry: %s\n", err.Error())
+		return err
+	}
+
 	file, err := os.OpenFile(pathBase+"/write", os.O_WRONLY, 0660)
 
 	if err != nil {
@@ -352,10 +396,12 @@ func writeEntry(setstr string) error {
 
 	defer file.Close()
 
-	_, err = file.WriteString(setstr)
-	if err != nil {
-		logger.Warn("writeEntry: %s Failed to write %s\n", err.Error(), setstr)
-		return (err)
+	for _, setstr := range setstrs {
+		_, err = file.WriteString(setstr)
+		if err != nil {
+			logger.Warn("writeEntry: %s Failed to write %s\n", err.Error(), setstr)
+			return (err)
+		}
 	}
 
 	file.Sync()
@@ -513,29 +559,71 @@ func generateKey(key interface{}) string {
 
 // AddEntry adds a field/value entry for the supplied key in the supplied table
 func AddEntry(table string, key interface{}, field string, value interface{}) error {
-	var setstr string
+	if isSuppressed(table, key, field) {
+		return nil
+	}
+
+	setstr := generateEntry(table, key, field, value)
+	if setstr == "" {
+		return nil
+	}
+
+	observeEntry(table, key, field, value)
+	err := writeEntry(setstr)
+
+	if err != nil {
+		logger.Warn("AddEntry: %s Failed to write %s\n", err.Error(), setstr)
+	}
+
+	return err
+}
+
+// AddEntries adds all of the field/value entries for the supplied key in the
+// supplied table with a single open of the dict proc write node. This should
+// be used in place of AddEntry when setting several fields at once.
+func AddEntries(table string, key interface{}, entries map[string]interface{}) error {
+	setstrs := make([]string, 0, len(entries))
+
+	for field, value := range entries {
+		if isSuppressed(table, key, field) {
+			continue
+		}
+		setstr := generateEntry(table, key, field, value)
+		if setstr != "" {
+			observeEntry(table, key, field, value)
+			setstrs = append(setstrs, setstr)
+		}
+	}
 
+	if len(setstrs) == 0 {
+		return nil
+	}
+
+	err := writeEntries(setstrs)
+
+	if err != nil {
+		logger.Warn("AddEntries: %s Failed to write %d entries for %s%s\n", err.Error(), len(setstrs), generateTable(table), generateKey(key))
+	}
+
+	return err
+}
+
+// generateEntry generates the set string for a field/value entry
+// It returns an empty string for empty string values which are not written
+func generateEntry(table string, key interface{}, field string, value interface{}) string {
 	switch value.(type) {
 	case string:
 		if value.(string) == "" {
 			logger.Warn("AddEntry: Set empty string request for %s %s %s\n", generateTable(table), generateKey(key), generateField(field))
-			return nil
+			return ""
 		}
 	}
 
-	setstr = fmt.Sprintf("%s%s%s%s", generateTable(table), generateKey(key), generateField(field), generateValue(value))
-
 	if logger.IsDebugEnabled() {
 		logger.Debug("SET table: %s[%v] | %s = %v\n", table, key, field, value)
 	}
 
-	err := writeEntry(setstr)
-
-	if err != nil {
-		logger.Warn("AddEntry: %s Failed to write %s\n", err.Error(), setstr)
-	}
-
-	return err
+	return fmt.Sprintf("%s%s%s%s", generateTable(table), generateKey(key), generateField(field), generateValue(value))
 }
 
 // AddHostEntry adds a field/value entry for the supplied ip key in the host table
@@ -562,6 +650,60 @@ func AddSessionEntry(key uint32, field string, value interface{}) error {
 	return AddEntry("sessions", key, field, value)
 }
 
+// AddSessionEntries adds all of the field/value entries for the supplied int key in the session table
+// This is a convenience wrapper for AddEntries
+func AddSessionEntries(key uint32, entries map[string]interface{}) error {
+	return AddEntries("sessions", key, entries)
+}
+
+// SuppressSession stops the writes to the session table for the argumented
+// ctid until UnsuppressSession is called, except for the fields that control
+// how the kernel handles the session
+func SuppressSession(key uint32) {
+	suppressedSessions.Store(key, true)
+}
+
+// UnsuppressSession allows the writes to the session table for the argumented ctid
+func UnsuppressSession(key uint32) {
+	suppressedSessions.Delete(key)
+}
+
+// isSuppressed returns true if the field must not be written for the key in the table
+func isSuppressed(table string, key interface{}, field string) bool {
+	if table != "sessions" || suppressedAllowed[field] {
+		return false
+	}
+	ctid, ok := key.(uint32)
+	if !ok {
+		return false
+	}
+	if _, found := suppressedSessions.Load(ctid); !found {
+		return false
+	}
+	logger.Trace("Suppressed %s for session %d\n", field, ctid)
+	return true
+}
+
+// SetSessionObserver sets the function that is called with each field written
+// to the session table. Passing nil removes the observer.
+func SetSessionObserver(observer SessionObserver) {
+	sessionObserver.Store(observer)
+}
+
+// observeEntry passes a session table write to the session observer
+func observeEntry(table string, key interface{}, field string, value interface{}) {
+	if table != "sessions" {
+		return
+	}
+	observer, _ := sessionObserver.Load().(SessionObserver)
+	if observer == nil {
+		return
+	}
+	if ctid, ok := key.(uint32); ok {
+		observer(ctid, field, value)
+	}
+}
+
 // DeleteDictionary removes a dictionary with the supplied key in the supplied table
 func DeleteDictionary(table string, key interface{}) error {
 	var setstr string
@@ -0,0 +1,512 @@
+// Package discovery provides a passive device discovery service. It listens
+// for mDNS, SSDP, and LLMNR multicast traffic on the LAN interfaces, extracts
+// any device names, services, and models it can find, and feeds the details
+// to the device inventory.
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/inventory"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const cleanTimeout = 3600
+const cleanInterval = 60
+
+// DiscoveredService holds the details of a service announced by a device
+type DiscoveredService struct {
+	Protocol string    `json:"protocol"`
+	Type     string    `json:"type"`
+	Name     string    `json:"name"`
+	Location string    `json:"location,omitempty"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// DiscoveredDevice holds the details of a device found using discovery traffic
+type DiscoveredDevice struct {
+	Address    string              `json:"address"`
+	MacAddress string              `json:"macAddress"`
+	Interface  string              `json:"interface"`
+	Hostname   string              `json:"hostname"`
+	Model      string              `json:"model"`
+	Services   []DiscoveredService `json:"services"`
+	LastSeen   time.Time           `json:"lastSeen"`
+	serviceMap map[string]*DiscoveredService
+}
+
+// listener describes one of the multicast groups we listen to
+type listener struct {
+	protocol string
+	network  string
+	address  string
+}
+
+var listenerList = []listener{
+	{"mdns", "udp4", "224.0.0.251:5353"},
+	{"mdns", "udp6", "[ff02::fb]:5353"},
+	{"ssdp", "udp4", "239.255.255.250:1900"},
+	{"llmnr", "udp4", "224.0.0.252:5355"},
+	{"llmnr", "udp6", "[ff02::1:3]:5355"},
+}
+
+var deviceTable map[string]*DiscoveredDevice
+var deviceMutex sync.RWMutex
+var connList []net.PacketConn
+var connMutex sync.Mutex
+var shutdownChannel = make(chan bool)
+
+// Startup function is called to allow service specific initialization.
+func Startup() {
+	deviceTable = make(map[string]*DiscoveredDevice)
+
+	var ifaceList []*net.Interface
+	for _, device := range settings.GetLanDevices() {
+		iface, err := net.InterfaceByName(device)
+		if err != nil {
+			logger.Warn("Unable to find discovery interface %s: %v\n", device, err)
+			continue
+		}
+		ifaceList = append(ifaceList, iface)
+	}
+
+	if len(ifaceList) != 0 {
+		for _, item := range listenerList {
+			openListener(ifaceList, item)
+		}
+	}
+
+	go cleanupTask()
+}
+
+// Shutdown function called when the daemon is shutting down.
+func Shutdown() {
+	// closing the connections will interrupt the blocking reads in each listener
+	connMutex.Lock()
+	for _, conn := range connList {
+		conn.Close()
+	}
+	connList = nil
+	connMutex.Unlock()
+
+	shutdownChannel <- true
+	select {
+	case <-shutdownChannel:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown discovery cleanupTask\n")
+	}
+}
+
+// GetDiscoveredDevices returns a copy of all devices found using discovery traffic
+func GetDiscoveredDevices() []DiscoveredDevice {
+	var list []DiscoveredDevice
+
+	deviceMutex.RLock()
+	defer deviceMutex.RUnlock()
+
+	for _, device := range deviceTable {
+		dup := *device
+		dup.Services = nil
+		for _, service := range device.serviceMap {
+			dup.Services = append(dup.Services, *service)
+		}
+		sort.Slice(dup.Services, func(i, j int) bool { return dup.Services[i].Type < dup.Services[j].Type })
+		dup.serviceMap = nil
+		list = append(list, dup)
+	}
+
+	return list
+}
+
+// multicastSocket is the socket for one of the listeners. It joins the group
+// on every LAN interface and gets the index of the interface each packet came
+// in on from the control messages, since a socket bound to a multicast group
+// gets the packets for the group from all of the interfaces.
+type multicastSocket struct {
+	ip4      *ipv4.PacketConn
+	ip6      *ipv6.PacketConn
+	devices  map[int]string
+	protocol string
+}
+
+// openListener joins the multicast group for the argumented listener on the argumented interfaces
+func openListener(ifaceList []*net.Interface, item listener) {
+	addr, err := net.ResolveUDPAddr(item.network, item.address)
+	if err != nil {
+		logger.Warn("Unable to resolve %s address %s: %v\n", item.protocol, item.address, err)
+		return
+	}
+
+	// other daemons like avahi may be listening on the same port
+	config := net.ListenConfig{Control: setReuseAddress}
+	conn, err := config.ListenPacket(context.Background(), item.network, item.address)
+	if err != nil {
+		logger.Warn("Unable to listen for %s on %s: %v\n", item.protocol, item.address, err)
+		return
+	}
+
+	socket := &multicastSocket{devices: make(map[int]string), protocol: item.protocol}
+	group := &net.UDPAddr{IP: addr.IP}
+	if item.network == "udp6" {
+		socket.ip6 = ipv6.NewPacketConn(conn)
+		err = socket.ip6.SetControlMessage(ipv6.FlagInterface, true)
+	} else {
+		socket.ip4 = ipv4.NewPacketConn(conn)
+		err = socket.ip4.SetControlMessage(ipv4.FlagInterface, true)
+	}
+	if err != nil {
+		logger.Warn("Unable to get the %s interfaces: %v\n", item.protocol, err)
+		conn.Close()
+		return
+	}
+
+	for _, iface := range ifaceList {
+		if socket.ip6 != nil {
+			err = socket.ip6.JoinGroup(iface, group)
+		} else {
+			err = socket.ip4.JoinGroup(iface, group)
+		}
+		if err != nil {
+			logger.Warn("Unable to listen for %s on %s: %v\n", item.protocol, iface.Name, err)
+			continue
+		}
+		socket.devices[iface.Index] = iface.Name
+		logger.Info("Listening for %s discovery traffic on %s %s\n", item.protocol, iface.Name, item.address)
+	}
+
+	if len(socket.devices) == 0 {
+		conn.Close()
+		return
+	}
+
+	connMutex.Lock()
+	connList = append(connList, conn)
+	connMutex.Unlock()
+
+	go watchListener(socket)
+}
+
+// setReuseAddress sets SO_REUSEADDR on a socket before it is bound
+func setReuseAddress(network string, address string, raw syscall.RawConn) error {
+	var sockErr error
+	err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// read reads a packet and returns the size, the source address, and the
+// index of the interface from the control message
+func (socket *multicastSocket) read(buffer []byte) (int, net.Addr, int, error) {
+	if socket.ip6 != nil {
+		size, control, peer, err := socket.ip6.ReadFrom(buffer)
+		if err != nil || control == nil {
+			return size, peer, 0, err
+		}
+		return size, peer, control.IfIndex, nil
+	}
+
+	size, control, peer, err := socket.ip4.ReadFrom(buffer)
+	if err != nil || control == nil {
+		return size, peer, 0, err
+	}
+	return size, peer, control.IfIndex, nil
+}
+
+// watchListener reads and parses discovery packets until the socket is closed
+func watchListener(socket *multicastSocket) {
+	buffer := make([]byte, 9000)
+
+	for {
+		size, peer, index, err := socket.read(buffer)
+		if err != nil {
+			// we close the connection to interrupt the blocking read on shutdown
+			// so we look for and squelch that specific error since it is expected
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				logger.Warn("Error %v reading %s discovery traffic\n", err, socket.protocol)
+			}
+			return
+		}
+
+		// the group may also be joined on other interfaces by other sockets
+		device, found := socket.devices[index]
+		if !found {
+			continue
+		}
+
+		source, ok := peer.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		data := make([]byte, size)
+		copy(data, buffer[:size])
+
+		switch socket.protocol {
+		case "mdns":
+			parseMDNS(source.IP, device, data)
+		case "ssdp":
+			parseSSDP(source.IP, device, data)
+		case "llmnr":
+			parseLLMNR(source.IP, device, data)
+		}
+	}
+}
+
+// parseMDNS extracts the hostname, services, and model from an mDNS packet
+func parseMDNS(source net.IP, device string, data []byte) {
+	dns := &layers.DNS{}
+	err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+	if err != nil {
+		logger.Trace("Unable to decode mDNS packet from %v: %v\n", source, err)
+		return
+	}
+
+	// we only learn from responses and announcements since queries
+	// tell us what the sender is looking for rather than what it is
+	if !dns.QR {
+		return
+	}
+
+	records := append(dns.Answers, dns.Additionals...)
+	for _, answer := range records {
+		name := strings.TrimSuffix(string(answer.Name), ".")
+		switch answer.Type {
+		case layers.DNSTypeA, layers.DNSTypeAAAA:
+			if answer.IP.Equal(source) {
+				updateHostname(source, device, strings.TrimSuffix(name, ".local"))
+			}
+		case layers.DNSTypePTR:
+			target := strings.TrimSuffix(string(answer.PTR), ".")
+			if strings.HasPrefix(name, "_") {
+				updateService(source, device, DiscoveredService{Protocol: "mdns", Type: name, Name: target})
+			}
+		case layers.DNSTypeSRV:
+			target := strings.TrimSuffix(string(answer.SRV.Name), ".")
+			updateHostname(source, device, strings.TrimSuffix(target, ".local"))
+		case layers.DNSTypeTXT:
+			for _, txt := range answer.TXTs {
+				pair := strings.SplitN(string(txt), "=", 2)
+				if len(pair) != 2 {
+					continue
+				}
+				switch strings.ToLower(pair[0]) {
+				case "md", "model", "usb_mdl", "ty":
+					updateModel(source, device, pair[1])
+				}
+			}
+		}
+	}
+}
+
+// parseSSDP extracts the service type, location, and server details from an SSDP packet
+func parseSSDP(source net.IP, device string, data []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		return
+	}
+
+	// we only learn from announcements and search responses since M-SEARCH requests are queries
+	line := scanner.Text()
+	if !strings.HasPrefix(line, "NOTIFY") && !strings.HasPrefix(line, "HTTP/1.1 200") {
+		return
+	}
+
+	// the rest of the message is formatted like HTTP headers
+	headers := make(map[string]string)
+	for scanner.Scan() {
+		pair := strings.SplitN(scanner.Text(), ":", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		headers[strings.ToUpper(strings.TrimSpace(pair[0]))] = strings.TrimSpace(pair[1])
+	}
+
+	service := DiscoveredService{Protocol: "ssdp"}
+	service.Type = headers["NT"]
+	if service.Type == "" {
+		service.Type = headers["ST"]
+	}
+	service.Name = headers["USN"]
+	service.Location = headers["LOCATION"]
+
+	// ssdp:byebye means the service is going away
+	if headers["NTS"] == "ssdp:byebye" {
+		removeService(source, service)
+		return
+	}
+
+	if service.Type != "" {
+		updateService(source, device, service)
+	}
+
+	if headers["SERVER"] != "" {
+		updateModel(source, device, headers["SERVER"])
+	}
+}
+
+// parseLLMNR extracts the names queried by hosts using LLMNR. A host will
+// query for its own name when it starts up to check for conflicts, so a
+// query from an address we don't know anything else about is a good hint
+func parseLLMNR(source net.IP, device string, data []byte) {
+	dns := &layers.DNS{}
+	err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+	if err != nil {
+		logger.Trace("Unable to decode LLMNR packet from %v: %v\n", source, err)
+		return
+	}
+
+	for _, question := range dns.Questions {
+		name := string(question.Name)
+		if name == "" {
+			continue
+		}
+		updateService(source, device, DiscoveredService{Protocol: "llmnr", Type: "query", Name: name})
+	}
+}
+
+// findDevice returns the device for the argumented address, creating it if needed
+// You must hold the deviceMutex write lock to call this function
+func findDevice(source net.IP, device string) *DiscoveredDevice {
+	key := source.String()
+	entry := deviceTable[key]
+	if entry == nil {
+		entry = &DiscoveredDevice{Address: key, Interface: device, serviceMap: make(map[string]*DiscoveredService)}
+		mac := inventory.LookupMacAddress(source)
+		if mac != nil {
+			entry.MacAddress = mac.String()
+		}
+		deviceTable[key] = entry
+	}
+	entry.LastSeen = time.Now()
+	return entry
+}
+
+// updateHostname sets the hostname for the device and feeds it to the inventory
+func updateHostname(source net.IP, device string, hostname string) {
+	if hostname == "" {
+		return
+	}
+
+	deviceMutex.Lock()
+	entry := findDevice(source, device)
+	changed := (entry.Hostname != hostname)
+	entry.Hostname = hostname
+	mac := entry.MacAddress
+	deviceMutex.Unlock()
+
+	if changed {
+		logger.Debug("Discovered hostname %s for %v\n", hostname, source)
+		feedInventory(mac, source, "hostname", hostname)
+	}
+}
+
+// updateModel sets the model for the device and feeds it to the inventory
+func updateModel(source net.IP, device string, model string) {
+	if model == "" {
+		return
+	}
+
+	deviceMutex.Lock()
+	entry := findDevice(source, device)
+	changed := (entry.Model != model)
+	entry.Model = model
+	mac := entry.MacAddress
+	deviceMutex.Unlock()
+
+	if changed {
+		logger.Debug("Discovered model %s for %v\n", model, source)
+		feedInventory(mac, source, "model", model)
+	}
+}
+
+// updateService adds or refreshes a service for the device
+func updateService(source net.IP, device string, service DiscoveredService) {
+	key := service.Protocol + "|" + service.Type + "|" + service.Name
+	service.LastSeen = time.Now()
+
+	deviceMutex.Lock()
+	entry := findDevice(source, device)
+	_, existing := entry.serviceMap[key]
+	entry.serviceMap[key] = &service
+	mac := entry.MacAddress
+	deviceMutex.Unlock()
+
+	if !existing && service.Protocol != "llmnr" {
+		logger.Debug("Discovered %s service %s for %v\n", service.Protocol, service.Type, source)
+		feedInventory(mac, source, "discovery_"+service.Protocol, service.Type)
+	}
+}
+
+// removeService removes a service for the device
+func removeService(source net.IP, service DiscoveredService) {
+	key := service.Protocol + "|" + service.Type + "|" + service.Name
+
+	deviceMutex.Lock()
+	entry := deviceTable[source.String()]
+	if entry != nil {
+		delete(entry.serviceMap, key)
+	}
+	deviceMutex.Unlock()
+}
+
+// feedInventory passes a discovered detail to the device inventory when we know the MAC address
+func feedInventory(mac string, source net.IP, field string, value string) {
+	if mac == "" {
+		return
+	}
+
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return
+	}
+
+	inventory.UpdateDevice(hwaddr, source, field, value)
+}
+
+// cleanupTask is a periodic task to remove devices and services that have not been seen recently
+func cleanupTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(cleanInterval * time.Second):
+			cleanDeviceTable()
+		}
+	}
+}
+
+// cleanDeviceTable removes stale entries from the device table
+func cleanDeviceTable() {
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+
+	for key, entry := range deviceTable {
+		for name, service := range entry.serviceMap {
+			if time.Now().Sub(service.LastSeen) > cleanTimeout*time.Second {
+				delete(entry.serviceMap, name)
+			}
+		}
+		if time.Now().Sub(entry.LastSeen) > cleanTimeout*time.Second {
+			logger.Debug("Removing stale discovery entry %s\n", key)
+			delete(deviceTable, key)
+		}
+	}
+}
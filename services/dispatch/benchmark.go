@@ -0,0 +1,288 @@
+package dispatch
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// benchmark conntrack ID's start above the simulated ones to stay clear of any real entries
+const benchmarkConntrackBase = 0xC0000000
+
+// BenchmarkLatency holds the time spent in one plugin handler during a benchmark
+type BenchmarkLatency struct {
+	Calls     uint64  `json:"calls"`
+	TotalMs   float64 `json:"totalMs"`
+	AverageMs float64 `json:"averageMs"`
+	MaxMs     float64 `json:"maxMs"`
+}
+
+// BenchmarkResult holds the results of a benchmark run
+type BenchmarkResult struct {
+	Sessions          int                          `json:"sessions"`
+	Packets           uint64                       `json:"packets"`
+	Workers           int                          `json:"workers"`
+	ElapsedSeconds    float64                      `json:"elapsedSeconds"`
+	SessionsPerSecond float64                      `json:"sessionsPerSecond"`
+	PacketsPerSecond  float64                      `json:"packetsPerSecond"`
+	NfqueueLatency    map[string]*BenchmarkLatency `json:"nfqueueLatency"`
+	ConntrackLatency  map[string]*BenchmarkLatency `json:"conntrackLatency"`
+}
+
+// benchmarkTemplate describes one kind of session in the canned traffic profile
+type benchmarkTemplate struct {
+	protocol       layers.IPProtocol
+	serverPort     uint16
+	clientPayloads [][]byte
+	serverPayloads [][]byte
+}
+
+var benchmarkActive int32
+var benchmarkTiming int32
+var benchmarkMutex sync.Mutex
+var benchmarkNfqueue map[string]*BenchmarkLatency
+var benchmarkConntrack map[string]*BenchmarkLatency
+
+// RunBenchmark replays a canned traffic profile through the nfqueue and
+// conntrack handlers and returns the throughput along with the time spent
+// in each plugin. The sessions use addresses from the 198.18.0.0/15 range
+// reserved for benchmarking so they are easy to spot in the reports.
+func RunBenchmark(sessionCount int, packetCount int) (*BenchmarkResult, error) {
+	if sessionCount <= 0 || packetCount <= 0 {
+		return nil, errors.New("The session and packet counts must be greater than zero")
+	}
+
+	if !atomic.CompareAndSwapInt32(&benchmarkActive, 0, 1) {
+		return nil, errors.New("A benchmark is already running")
+	}
+	defer atomic.StoreInt32(&benchmarkActive, 0)
+
+	benchmarkMutex.Lock()
+	benchmarkNfqueue = make(map[string]*BenchmarkLatency)
+	benchmarkConntrack = make(map[string]*BenchmarkLatency)
+	benchmarkMutex.Unlock()
+
+	profile := benchmarkProfile()
+	workers := runtime.NumCPU()
+	work := make(chan int, workers)
+	var packets uint64
+	var wg sync.WaitGroup
+
+	logger.Info("Starting benchmark sessions:%d packets:%d workers:%d\n", sessionCount, packetCount, workers)
+
+	atomic.StoreInt32(&benchmarkTiming, 1)
+	start := time.Now()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			for index := range work {
+				count := runBenchmarkSession(index, profile[index%len(profile)], packetCount)
+				atomic.AddUint64(&packets, count)
+			}
+			wg.Done()
+		}()
+	}
+
+	for i := 0; i < sessionCount; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	elapsed := time.Since(start).Seconds()
+	atomic.StoreInt32(&benchmarkTiming, 0)
+
+	result := &BenchmarkResult{
+		Sessions:       sessionCount,
+		Packets:        packets,
+		Workers:        workers,
+		ElapsedSeconds: elapsed,
+	}
+
+	if elapsed > 0 {
+		result.SessionsPerSecond = float64(sessionCount) / elapsed
+		result.PacketsPerSecond = float64(packets) / elapsed
+	}
+
+	benchmarkMutex.Lock()
+	result.NfqueueLatency = benchmarkNfqueue
+	result.ConntrackLatency = benchmarkConntrack
+	benchmarkNfqueue = nil
+	benchmarkConntrack = nil
+	benchmarkMutex.Unlock()
+
+	for _, item := range result.NfqueueLatency {
+		item.AverageMs = item.TotalMs / float64(item.Calls)
+	}
+	for _, item := range result.ConntrackLatency {
+		item.AverageMs = item.TotalMs / float64(item.Calls)
+	}
+
+	logger.Info("Finished benchmark sessions/sec:%.1f packets/sec:%.1f elapsed:%.3f\n", result.SessionsPerSecond, result.PacketsPerSecond, elapsed)
+	return result, nil
+}
+
+// recordBenchmarkTime adds the time spent in a plugin handler to the
+// benchmark totals when a benchmark is running
+func recordBenchmarkTime(nfqueueFlag bool, owner string, millis float64) {
+	if atomic.LoadInt32(&benchmarkTiming) == 0 {
+		return
+	}
+
+	benchmarkMutex.Lock()
+	defer benchmarkMutex.Unlock()
+
+	table := benchmarkConntrack
+	if nfqueueFlag {
+		table = benchmarkNfqueue
+	}
+
+	if table == nil {
+		return
+	}
+
+	item := table[owner]
+	if item == nil {
+		item = new(BenchmarkLatency)
+		table[owner] = item
+	}
+
+	item.Calls++
+	item.TotalMs += millis
+	if millis > item.MaxMs {
+		item.MaxMs = millis
+	}
+}
+
+// runBenchmarkSession passes the packets and conntrack events for a single
+// session through the handlers and returns the number of packets
+func runBenchmarkSession(index int, template benchmarkTemplate, packetCount int) uint64 {
+	ctid := uint32(benchmarkConntrackBase + index)
+	client := net.IPv4(198, 18, byte(index/250), byte(index%250+1)).To4()
+	server := net.IPv4(198, 19, byte(index/250), byte(index%250+1)).To4()
+	clientPort := uint16(10000 + index%50000)
+
+	var clientBytes, serverBytes, clientPackets, serverPackets uint64
+	started := uint64(time.Now().UnixNano())
+
+	for i := 0; i < packetCount; i++ {
+		var packet gopacket.Packet
+		var mark uint32
+
+		if i == 0 {
+			mark = simulateNewSessionMark
+		}
+
+		// the client sends first and then the packets alternate
+		if i%2 == 0 {
+			payload := template.clientPayloads[(i/2)%len(template.clientPayloads)]
+			packet = buildBenchmarkPacket(template.protocol, client, clientPort, server, template.serverPort, payload)
+			clientPackets++
+			clientBytes += uint64(len(packet.Data()))
+		} else {
+			payload := template.serverPayloads[(i/2)%len(template.serverPayloads)]
+			packet = buildBenchmarkPacket(template.protocol, server, template.serverPort, client, clientPort, payload)
+			serverPackets++
+			serverBytes += uint64(len(packet.Data()))
+		}
+
+		nfqueueCallback(ctid, syscall.AF_INET, packet.Data(), mark, 0, 0)
+
+		if i == 0 {
+			conntrackCallback(ctid, 0, syscall.AF_INET, 'N', uint8(template.protocol),
+				client, server, clientPort, template.serverPort,
+				client, server, clientPort, template.serverPort,
+				clientBytes, serverBytes, clientPackets, serverPackets,
+				started, 0, 120, 0)
+		}
+	}
+
+	for _, eventType := range []uint8{'U', 'D'} {
+		var stop uint64
+		if eventType == 'D' {
+			stop = uint64(time.Now().UnixNano())
+		}
+		conntrackCallback(ctid, 0, syscall.AF_INET, eventType, uint8(template.protocol),
+			client, server, clientPort, template.serverPort,
+			client, server, clientPort, template.serverPort,
+			clientBytes, serverBytes, clientPackets, serverPackets,
+			started, stop, 120, 0)
+	}
+
+	return uint64(packetCount)
+}
+
+// buildBenchmarkPacket creates an IPv4 packet with the argumented addresses and payload
+func buildBenchmarkPacket(protocol layers.IPProtocol, srcAddr net.IP, srcPort uint16, dstAddr net.IP, dstPort uint16, payload []byte) gopacket.Packet {
+	var transport gopacket.SerializableLayer
+
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: protocol, SrcIP: srcAddr, DstIP: dstAddr}
+
+	if protocol == layers.IPProtocolTCP {
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), Window: 65535, ACK: true, PSH: true}
+		tcp.SetNetworkLayerForChecksum(ip4)
+		transport = tcp
+	} else {
+		udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+		udp.SetNetworkLayerForChecksum(ip4)
+		transport = udp
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip4, transport, gopacket.Payload(payload))
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+}
+
+// benchmarkProfile returns the canned traffic profile with a mix of web, TLS, and DNS sessions
+func benchmarkProfile() []benchmarkTemplate {
+	var profile []benchmarkTemplate
+
+	profile = append(profile, benchmarkTemplate{
+		protocol:       layers.IPProtocolTCP,
+		serverPort:     80,
+		clientPayloads: [][]byte{[]byte("GET /index.html HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: packetd-benchmark\r\nAccept: */*\r\n\r\n")},
+		serverPayloads: [][]byte{[]byte("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 512\r\n\r\n"), make([]byte, 1400)},
+	})
+
+	// a TLS record header followed by enough filler to look like a handshake
+	hello := append([]byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc, 0x03, 0x03}, make([]byte, 505)...)
+	profile = append(profile, benchmarkTemplate{
+		protocol:       layers.IPProtocolTCP,
+		serverPort:     443,
+		clientPayloads: [][]byte{hello, make([]byte, 600)},
+		serverPayloads: [][]byte{make([]byte, 1400)},
+	})
+
+	query := &layers.DNS{ID: 0x1234, RD: true, Questions: []layers.DNSQuestion{{Name: []byte("www.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+	answer := &layers.DNS{ID: 0x1234, QR: true, RD: true, RA: true, Questions: query.Questions,
+		Answers: []layers.DNSResourceRecord{{Name: []byte("www.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.IPv4(198, 19, 255, 1).To4()}}}
+
+	profile = append(profile, benchmarkTemplate{
+		protocol:       layers.IPProtocolUDP,
+		serverPort:     53,
+		clientPayloads: [][]byte{serializeBenchmarkLayer(query)},
+		serverPayloads: [][]byte{serializeBenchmarkLayer(answer)},
+	})
+
+	return profile
+}
+
+// serializeBenchmarkLayer returns the serialized bytes for a layer
+func serializeBenchmarkLayer(layer gopacket.SerializableLayer) []byte {
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, layer)
+	if err != nil {
+		logger.Warn("Unable to serialize benchmark payload: %v\n", err)
+		return []byte{0}
+	}
+	return buffer.Bytes()
+}
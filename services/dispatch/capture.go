@@ -0,0 +1,445 @@
+package dispatch
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// Capture files hold the raw traffic of the customers so they can be
+// encrypted and signed with the keys in the settings. When encryption is
+// enabled the kernel writes the capture to a pipe instead of the file, and
+// the capture is encrypted as it arrives so the traffic never reaches the
+// disk in the clear. The file is a header followed by segments sealed with
+// AES-256-GCM, the last one flagged so a truncated file is detected. When
+// signing is enabled the finished capture gets a .sig file with the ed25519
+// signature of its SHA-256 digest. The playback decrypts the capture through
+// a pipe the same way.
+
+// captureMagic starts an encrypted capture file
+const captureMagic = "PDCAPENC"
+const captureVersion = 1
+
+// the header is the magic, the version, and the nonce prefix of the segments
+const captureHeaderSize = 16
+const captureSegmentSize = 65536
+
+// the flag in the segment length that marks the last segment
+const captureFinalFlag = 0x80000000
+
+// captureConfig holds the capture encryption and signing settings
+type captureConfig struct {
+	encrypt    bool
+	key        []byte
+	sign       bool
+	privateKey ed25519.PrivateKey
+}
+
+// captureSignature is written next to a signed capture
+type captureSignature struct {
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// activeCapture holds the capture that is running
+type activeCapture struct {
+	filename string
+	config   captureConfig
+	done     chan error
+}
+
+var currentCapture *activeCapture
+var captureMutex sync.Mutex
+
+// loadCaptureConfig loads the capture encryption and signing settings. The
+// keys are hex encoded, a 256 bit AES key and a 32 byte ed25519 seed. An
+// enabled option without a valid key is an error so a capture is never
+// written in the clear by mistake.
+func loadCaptureConfig() (captureConfig, error) {
+	var config captureConfig
+
+	for _, name := range []string{"encryption", "signing"} {
+		itemJSON, err := settings.GetCurrentSettings([]string{"warehouse", name})
+		if itemJSON == nil || err != nil {
+			continue
+		}
+		item, ok := itemJSON.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid warehouse %s settings: %T\n", name, itemJSON)
+			continue
+		}
+		if enabled, _ := item["enabled"].(bool); !enabled {
+			continue
+		}
+
+		switch name {
+		case "encryption":
+			value, _ := item["key"].(string)
+			key, err := decodeCaptureKey(value, 32)
+			if err != nil {
+				return config, fmt.Errorf("warehouse encryption key: %v", err)
+			}
+			config.encrypt = true
+			config.key = key
+		case "signing":
+			value, _ := item["privateKey"].(string)
+			seed, err := decodeCaptureKey(value, ed25519.SeedSize)
+			if err != nil {
+				return config, fmt.Errorf("warehouse signing key: %v", err)
+			}
+			config.sign = true
+			config.privateKey = ed25519.NewKeyFromSeed(seed)
+		}
+	}
+	return config, nil
+}
+
+// decodeCaptureKey converts a hex encoded key of the argumented size to bytes
+func decodeCaptureKey(value string, size int) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	return key, nil
+}
+
+// StartWarehouseCapture starts capturing the traffic to the argumented file,
+// encrypting it on the way when that is enabled
+func StartWarehouseCapture(filename string) error {
+	config, err := loadCaptureConfig()
+	if err != nil {
+		return err
+	}
+
+	captureMutex.Lock()
+	defer captureMutex.Unlock()
+
+	if currentCapture != nil {
+		return errors.New("a capture is already running")
+	}
+	capture := &activeCapture{filename: filename, config: config}
+
+	if !config.encrypt {
+		kernel.SetWarehouseFile(filename)
+		kernel.StartWarehouseCapture()
+		currentCapture = capture
+		return nil
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// the kernel opens the pipe by name so our end is closed once it has its own
+	kernel.SetWarehouseFile(fmt.Sprintf("/proc/self/fd/%d", writer.Fd()))
+	kernel.StartWarehouseCapture()
+	writer.Close()
+
+	capture.done = make(chan error, 1)
+	go func() {
+		err := encryptCapture(reader, file, config.key)
+		reader.Close()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		capture.done <- err
+	}()
+
+	logger.Info("Encrypting capture to file:%s\n", filename)
+	currentCapture = capture
+	return nil
+}
+
+// CloseWarehouseCapture finishes the running capture and signs it when
+// signing is enabled
+func CloseWarehouseCapture() {
+	kernel.CloseWarehouseCapture()
+
+	captureMutex.Lock()
+	capture := currentCapture
+	currentCapture = nil
+	captureMutex.Unlock()
+
+	if capture == nil {
+		return
+	}
+
+	if capture.done != nil {
+		if err := <-capture.done; err != nil {
+			logger.Err("Unable to encrypt capture %s: %v\n", capture.filename, err)
+			return
+		}
+	}
+
+	if capture.config.sign {
+		if err := signCaptureFile(capture.filename, capture.config.privateKey); err != nil {
+			logger.Err("Unable to sign capture %s: %v\n", capture.filename, err)
+		}
+	}
+}
+
+// encryptCapture reads the capture from the reader until it is closed and
+// writes the encrypted segments
+func encryptCapture(reader io.Reader, writer io.Writer, key []byte) error {
+	gcm, err := getCaptureCipher(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, captureHeaderSize)
+	copy(header, captureMagic)
+	header[8] = captureVersion
+	if _, err = io.ReadFull(rand.Reader, header[9:]); err != nil {
+		return err
+	}
+	if _, err = writer.Write(header); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, captureSegmentSize)
+	var counter uint32
+
+	for {
+		count, err := io.ReadFull(reader, buffer)
+		final := (err == io.EOF || err == io.ErrUnexpectedEOF)
+		if err != nil && !final {
+			return err
+		}
+
+		sealed := gcm.Seal(nil, getSegmentNonce(header, counter, final), buffer[:count], header)
+		length := uint32(len(sealed))
+		if final {
+			length |= captureFinalFlag
+		}
+
+		prefix := make([]byte, 4)
+		binary.BigEndian.PutUint32(prefix, length)
+		if _, err = writer.Write(prefix); err != nil {
+			return err
+		}
+		if _, err = writer.Write(sealed); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+		counter++
+	}
+}
+
+// decryptCapture reads an encrypted capture from the reader and writes the
+// capture to the writer. A capture that ends before its last segment is an
+// error.
+func decryptCapture(reader io.Reader, writer io.Writer, key []byte) error {
+	gcm, err := getCaptureCipher(key)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, captureHeaderSize)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if string(header[:8]) != captureMagic || header[8] != captureVersion {
+		return errors.New("not an encrypted capture")
+	}
+
+	prefix := make([]byte, 4)
+	var counter uint32
+
+	for {
+		if _, err = io.ReadFull(reader, prefix); err != nil {
+			return fmt.Errorf("truncated capture: %v", err)
+		}
+		length := binary.BigEndian.Uint32(prefix)
+		final := (length&captureFinalFlag != 0)
+		length &^= captureFinalFlag
+		if length > captureSegmentSize+uint32(gcm.Overhead()) {
+			return fmt.Errorf("invalid segment length %d", length)
+		}
+
+		sealed := make([]byte, length)
+		if _, err = io.ReadFull(reader, sealed); err != nil {
+			return fmt.Errorf("truncated capture: %v", err)
+		}
+
+		data, err := gcm.Open(nil, getSegmentNonce(header, counter, final), sealed, header)
+		if err != nil {
+			return err
+		}
+		if _, err = writer.Write(data); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+		counter++
+	}
+}
+
+// getCaptureCipher returns the AES-256-GCM cipher for the key
+func getCaptureCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// getSegmentNonce returns the nonce of a segment, which is the random prefix
+// from the header, the segment counter, and the final flag
+func getSegmentNonce(header []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[9:16])
+	binary.BigEndian.PutUint32(nonce[7:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// isEncryptedCapture returns true if the file is an encrypted capture
+func isEncryptedCapture(filename string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(captureMagic))
+	if _, err = io.ReadFull(file, magic); err != nil {
+		return false
+	}
+	return string(magic) == captureMagic
+}
+
+// readCaptureFile returns the content of a capture file, decrypted if it is encrypted
+func readCaptureFile(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil || !bytes.HasPrefix(data, []byte(captureMagic)) {
+		return data, err
+	}
+
+	config, err := loadCaptureConfig()
+	if err != nil {
+		return nil, err
+	}
+	if !config.encrypt {
+		return nil, errors.New("the capture is encrypted and there is no warehouse encryption key")
+	}
+
+	var output bytes.Buffer
+	err = decryptCapture(bytes.NewReader(data), &output, config.key)
+	if err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+// openPlaybackFile returns the name the kernel opens to play back a capture.
+// An encrypted capture is decrypted into a pipe whose name is returned, and
+// the returned function must be called when the playback is finished.
+func openPlaybackFile(filename string) (string, func(), error) {
+	if !isEncryptedCapture(filename) {
+		return filename, func() {}, nil
+	}
+
+	config, err := loadCaptureConfig()
+	if err != nil {
+		return "", nil, err
+	}
+	if !config.encrypt {
+		return "", nil, errors.New("the capture is encrypted and there is no warehouse encryption key")
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		file.Close()
+		return "", nil, err
+	}
+
+	go func() {
+		err := decryptCapture(file, writer, config.key)
+		if err != nil {
+			logger.Warn("Unable to decrypt capture %s: %v\n", filename, err)
+		}
+		writer.Close()
+		file.Close()
+	}()
+
+	// closing our end stops the decryption if the playback ends early
+	return fmt.Sprintf("/proc/self/fd/%d", reader.Fd()), func() { reader.Close() }, nil
+}
+
+// signCaptureFile writes the signature of a file to the file with .sig added
+func signCaptureFile(filename string, privateKey ed25519.PrivateKey) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return err
+	}
+	digest := hash.Sum(nil)
+
+	signature := captureSignature{
+		Algorithm: "ed25519",
+		Digest:    "sha256:" + hex.EncodeToString(digest),
+		PublicKey: hex.EncodeToString(privateKey.Public().(ed25519.PublicKey)),
+		Signature: hex.EncodeToString(ed25519.Sign(privateKey, digest)),
+	}
+
+	data, err := json.MarshalIndent(signature, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Signed capture %s\n", filename)
+	return ioutil.WriteFile(filename+".sig", append(data, '\n'), 0600)
+}
+
+// signSanitizedFile signs a sanitized capture when signing is enabled
+func signSanitizedFile(filename string) error {
+	config, err := loadCaptureConfig()
+	if err != nil || !config.sign {
+		return err
+	}
+	return signCaptureFile(filename, config.privateKey)
+}
@@ -0,0 +1,121 @@
+package dispatch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+// the size of a full segment in an encrypted capture with its length prefix
+const testSegmentSize = 4 + captureSegmentSize + 16
+
+// encryptTestCapture returns random capture data and the encrypted capture
+func encryptTestCapture(t *testing.T, size int, key []byte) ([]byte, []byte) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	if err := encryptCapture(bytes.NewReader(data), &output, key); err != nil {
+		t.Fatal(err)
+	}
+	return data, output.Bytes()
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+
+	tests := []struct {
+		name     string
+		size     int
+		segments int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"one segment", captureSegmentSize, 2},
+		{"one segment and a byte", captureSegmentSize + 1, 2},
+		{"several segments", 3*captureSegmentSize + 100, 4},
+	}
+
+	for _, test := range tests {
+		data, encrypted := encryptTestCapture(t, test.size, key)
+
+		// every segment but the last is full and the last has the final flag
+		last := captureHeaderSize + (test.segments-1)*testSegmentSize
+		if len(encrypted) != last+4+test.size%captureSegmentSize+16 {
+			t.Errorf("%s: encrypted size %d is not %d segments", test.name, len(encrypted), test.segments)
+			continue
+		}
+		if binary.BigEndian.Uint32(encrypted[last:])&captureFinalFlag == 0 {
+			t.Errorf("%s: last segment is not final", test.name)
+		}
+
+		var output bytes.Buffer
+		if err := decryptCapture(bytes.NewReader(encrypted), &output, key); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(output.Bytes(), data) {
+			t.Errorf("%s: decrypted %d bytes do not match the %d captured", test.name, output.Len(), len(data))
+		}
+	}
+}
+
+func TestCaptureTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	otherKey := bytes.Repeat([]byte{2}, 32)
+
+	// three segments, the last one with a single byte
+	_, encrypted := encryptTestCapture(t, 2*captureSegmentSize+1, key)
+	first := encrypted[captureHeaderSize : captureHeaderSize+testSegmentSize]
+	second := encrypted[captureHeaderSize+testSegmentSize : captureHeaderSize+2*testSegmentSize]
+	last := encrypted[captureHeaderSize+2*testSegmentSize:]
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(append([][]byte{encrypted[:captureHeaderSize]}, parts...), nil)
+	}
+	flip := func(offset int) []byte {
+		data := append([]byte{}, encrypted...)
+		data[offset] ^= 1
+		return data
+	}
+	setFinal := func(segment []byte, final bool) []byte {
+		data := append([]byte{}, segment...)
+		length := binary.BigEndian.Uint32(data) &^ captureFinalFlag
+		if final {
+			length |= captureFinalFlag
+		}
+		binary.BigEndian.PutUint32(data, length)
+		return data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		key  []byte
+	}{
+		{"truncated", encrypted[:len(encrypted)-1], key},
+		{"truncated in length", encrypted[:captureHeaderSize+testSegmentSize+2], key},
+		{"header only", encrypted[:captureHeaderSize], key},
+		{"missing final segment", join(first, second), key},
+		{"swapped segments", join(second, first, last), key},
+		{"dropped segment", join(first, last), key},
+		{"final segment first", join(last, first, second), key},
+		{"early final flag", join(first, setFinal(second, true)), key},
+		{"cleared final flag", join(first, second, setFinal(last, false)), key},
+		{"flipped header byte", flip(12), key},
+		{"flipped data byte", flip(captureHeaderSize + 100), key},
+		{"flipped tag byte", flip(len(encrypted) - 1), key},
+		{"wrong key", encrypted, otherKey},
+		{"not a capture", []byte("PDCAPXXX00000000"), key},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		if err := decryptCapture(bytes.NewReader(test.data), &output, test.key); err == nil {
+			t.Errorf("%s: decrypted without an error", test.name)
+		}
+	}
+}
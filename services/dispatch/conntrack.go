@@ -49,6 +49,7 @@ type Conntrack struct {
 	ServerPacketRate  float32 // the Server packet rate site the last update
 	TotalPacketRate   float32 // the Total packet rate site the last update
 	Guardian          sync.RWMutex
+	interval          sessionInterval // the traffic since the last interval stats event
 }
 
 var conntrackTable map[uint32]*Conntrack
@@ -109,6 +110,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			}
 			logger.Err("%OC|Deleting obsolete conntrack entry %v.\n", "contrack_obsolete_duplicate", 0, ctid)
 			conntrack.Guardian.RUnlock()
+			reportSessionEnd(conntrack, endReasonEviction)
 			removeConntrackStale(ctid, conntrack)
 			conntrackFound = false
 			conntrack = nil
@@ -119,6 +121,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			logger.Warn("Actual: %s Expected: %s\n", clientSideTuple.String(), conntrack.ClientSideTuple.String())
 			logger.Err("%OC|Deleting obsolete conntrack entry %v.\n", "contrack_obsolete_mismatch", 0, ctid)
 			conntrack.Guardian.RUnlock()
+			reportSessionEnd(conntrack, endReasonEviction)
 			removeConntrackStale(ctid, conntrack)
 			conntrackFound = false
 			conntrack = nil
@@ -133,6 +136,9 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			return
 		}
 
+		finishInterval(conntrack, clientBytes, serverBytes, clientPackets, serverPackets)
+		setFinalCounters(conntrack, clientBytes, serverBytes, clientPackets, serverPackets, timestampStart, timestampStop)
+		reportSessionEnd(conntrack, getEndReason(protocol, tcpState))
 		removeConntrackStale(ctid, conntrack)
 
 		// just return now, we don't pass DELETE events to subscribers
@@ -161,7 +167,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 				logger.Err("%OC|Conntrack NEW ID mismatch: %s  %d != %d\n", "conntrack_new_id_mismatch", 0, session.GetClientSideTuple().String(), ctid, session.GetConntrackID())
 				return
 			}
-			if !session.GetClientSideTuple().Equal(conntrack.ClientSideTuple) {
+			if !session.GetClientSideTuple().Equal(conntrack.ClientSideTuple) && !isRemoteReverse(session, conntrack.ClientSideTuple) {
 				// We found a session, but the tuple is not what we expect.
 
 				// This happens in some scenarios. For example:
@@ -181,12 +187,16 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 				}
 
 				// Remove that session from the sessionTable - we can conclude its not valid anymore
+				countMismatch(ctid, session, conntrack.ClientSideTuple)
 				session.flushDict()
 				session.removeFromSessionTable()
 				session = nil
 			}
 		}
 
+		// a packet that conntrack merged into this ctid has a session under its own ctid
+		session = reconcileSession(ctid, session, conntrack.ClientSideTuple)
+
 		// if we find the session entry update with the server side tuple and
 		// create another index for the session using the server side tuple
 		if session != nil {
@@ -202,8 +212,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			session.SetServerInterfaceType(uint8((conntrack.ConnMark & 0x0C000000) >> 26))
 			session.SetConntrackConfirmed(true)
 			session.SetConntrackPointer(conntrack)
-			session.SetLastActivity(time.Now())
-			session.AddEventCount(1)
+			session.accountEvent(time.Now())
 			conntrack.Session = session
 			conntrack.SessionID = session.GetSessionID()
 		} else {
@@ -245,8 +254,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			conntrack.ConnMark = connmark
 		}
 		if conntrack.Session != nil {
-			conntrack.Session.SetLastActivity(time.Now())
-			conntrack.Session.AddEventCount(1)
+			conntrack.Session.accountEvent(time.Now())
 		}
 
 		conntrack.TimeoutSeconds = timeout
@@ -255,6 +263,10 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 		conntrack.TimestampStop = timestampStop
 
 		updateStatsAndRates(conntrack, clientBytes, serverBytes, clientPackets, serverPackets, secondsSinceLastUpdate)
+		if conntrack.Session != nil {
+			accountPolicyQuota(conntrack.Session, conntrack.TotalBytesDiff)
+		}
+		accountInterval(conntrack, conntrack.LastUpdateTime)
 		conntrack.Guardian.Unlock()
 	}
 
@@ -275,7 +287,10 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			logger.Debug("Calling conntrack APP:%s PRIORITY:%d\n", key, priority)
 			wg.Add(1)
 			go func(val SubscriptionHolder) {
+				defer reportPanic("conntrack", val.Owner)
+				t1 := getMicroseconds()
 				val.ConntrackFunc(int(eventType), conntrack)
+				recordBenchmarkTime(false, val.Owner, float64(getMicroseconds()-t1)/1000.0)
 				wg.Done()
 				logger.Debug("Finished conntrack APP:%s PRIORITY:%d\n", val.Owner, val.Priority)
 			}(val)
@@ -340,6 +355,7 @@ func cleanConntrackTable() {
 	defer conntrackTableMutex.Unlock()
 
 	for ctid, conntrack := range conntrackTable {
+		evicted := false
 		conntrack.Guardian.RLock()
 		// We use 10000 seconds because 7440 is the established idle tcp timeout default
 		if time.Now().Sub(conntrack.LastActivityTime) > 10000*time.Second {
@@ -357,8 +373,13 @@ func cleanConntrackTable() {
 				conntrack.Session.removeFromSessionTable()
 			}
 			delete(conntrackTable, ctid)
+			evicted = true
 		}
 		conntrack.Guardian.RUnlock()
+
+		if evicted {
+			reportSessionEnd(conntrack, endReasonEviction)
+		}
 	}
 }
 
@@ -0,0 +1,185 @@
+package dispatch
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetDecoder holds the preallocated layers used to decode nfqueue packets.
+// Decoders are pooled and reused so the hot path doesn't allocate a gopacket
+// Packet and a new set of layers for every packet. The full gopacket Packet is
+// only created if a subscriber asks for it with NfqueueMessage.GetPacket.
+//
+// The packet data from the kernel is freed as soon as the verdict is set, so
+// it is copied to the buffer of the decoder and the layers point into that
+// copy instead. A decoder that may still be in use by a subscriber that timed
+// out is never returned to the pool, so the data it holds stays valid.
+type packetDecoder struct {
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	routing ipv6Extension
+	frag    ipv6Extension
+	dest    ipv6Extension
+	tcp     layers.TCP
+	udp     layers.UDP
+	icmp4   layers.ICMPv4
+	payload gopacket.Payload
+	decoded []gopacket.LayerType
+	parser4 *gopacket.DecodingLayerParser
+	parser6 *gopacket.DecodingLayerParser
+
+	buffer      []byte
+	data        []byte
+	packet      gopacket.Packet
+	packetMutex sync.Mutex
+}
+
+var decoderPool = sync.Pool{
+	New: func() interface{} {
+		return newPacketDecoder()
+	},
+}
+
+// newPacketDecoder creates a packetDecoder with parsers for IPv4 and IPv6
+func newPacketDecoder() *packetDecoder {
+	decoder := new(packetDecoder)
+	decoder.decoded = make([]gopacket.LayerType, 0, 8)
+	decoder.parser4 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &decoder.ip4, &decoder.tcp, &decoder.udp, &decoder.icmp4, &decoder.payload)
+	decoder.routing.layerType = layers.LayerTypeIPv6Routing
+	decoder.frag.layerType = layers.LayerTypeIPv6Fragment
+	decoder.dest.layerType = layers.LayerTypeIPv6Destination
+	decoder.parser6 = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &decoder.ip6, &decoder.routing, &decoder.frag, &decoder.dest, &decoder.tcp, &decoder.udp, &decoder.payload)
+
+	// we stop at the first layer we don't handle, since anything past the
+	// transport layer is left for the plugins that need it
+	decoder.parser4.IgnoreUnsupported = true
+	decoder.parser6.IgnoreUnsupported = true
+	return decoder
+}
+
+// getPacketDecoder returns a decoder from the pool
+func getPacketDecoder() *packetDecoder {
+	return decoderPool.Get().(*packetDecoder)
+}
+
+// putPacketDecoder returns a decoder to the pool. It must only be called
+// once nothing is holding a reference to the decoded layers or the data.
+func putPacketDecoder(decoder *packetDecoder) {
+	decoder.data = nil
+	decoder.packet = nil
+	decoderPool.Put(decoder)
+}
+
+// decode decodes the network and transport layers of the packet data into the
+// argumented message. It returns false if the data is not an IP packet.
+func (decoder *packetDecoder) decode(data []byte, mess *NfqueueMessage) bool {
+	var parser *gopacket.DecodingLayerParser
+
+	if len(data) == 0 {
+		return false
+	}
+
+	decoder.buffer = append(decoder.buffer[:0], data...)
+	data = decoder.buffer
+	decoder.data = data
+	mess.Data = data
+	mess.decoder = decoder
+
+	switch data[0] & 0xF0 {
+	case 0x40:
+		parser = decoder.parser4
+	case 0x60:
+		parser = decoder.parser6
+	default:
+		return false
+	}
+
+	// errors past the network layer leave the layers we did decode in place
+	// which matches what we got from the lazy gopacket decoder
+	parser.DecodeLayers(data, &decoder.decoded)
+
+	for _, layerType := range decoder.decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			mess.IP4Layer = &decoder.ip4
+		case layers.LayerTypeIPv6:
+			mess.IP6Layer = &decoder.ip6
+		case layers.LayerTypeTCP:
+			mess.TCPLayer = &decoder.tcp
+			if len(decoder.tcp.Payload) != 0 {
+				mess.Payload = decoder.tcp.Payload
+			}
+		case layers.LayerTypeUDP:
+			mess.UDPLayer = &decoder.udp
+			if len(decoder.udp.Payload) != 0 {
+				mess.Payload = decoder.udp.Payload
+			}
+		case layers.LayerTypeICMPv4:
+			mess.ICMPv4Layer = &decoder.icmp4
+			if len(decoder.icmp4.Payload) != 0 {
+				mess.Payload = decoder.icmp4.Payload
+			}
+		}
+	}
+
+	return mess.IP4Layer != nil || mess.IP6Layer != nil
+}
+
+// ipv6Extension skips an IPv6 extension header so the transport layer after it
+// is decoded. The hop-by-hop header is decoded by the IPv6 layer itself, so we
+// only need the routing, fragment and destination options headers. Only the
+// first fragment of a packet has the transport header, so we stop at the
+// fragment header of the others.
+type ipv6Extension struct {
+	layers.IPv6ExtensionSkipper
+	layerType gopacket.LayerType
+}
+
+// DecodeFromBytes implementation according to gopacket.DecodingLayer
+func (ext *ipv6Extension) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	err := ext.IPv6ExtensionSkipper.DecodeFromBytes(data, df)
+	if err != nil {
+		return err
+	}
+	if ext.layerType == layers.LayerTypeIPv6Fragment && binary.BigEndian.Uint16(data[2:4])&0xFFF8 != 0 {
+		ext.NextHeader = layers.IPProtocolNoNextHeader
+	}
+	return nil
+}
+
+// CanDecode implementation according to gopacket.DecodingLayer
+func (ext *ipv6Extension) CanDecode() gopacket.LayerClass {
+	return ext.layerType
+}
+
+// LayerType returns the type of the extension header
+func (ext *ipv6Extension) LayerType() gopacket.LayerType {
+	return ext.layerType
+}
+
+// GetPacket returns a fully decoded gopacket Packet for the message. It is
+// created the first time it is requested and shared by all the subscribers
+// for the packet, so plugins that only need the layers in the message never
+// pay for it. The packet and its data must not be used after the handler returns.
+func (mess NfqueueMessage) GetPacket() gopacket.Packet {
+	decoder := mess.decoder
+	if decoder == nil {
+		return nil
+	}
+
+	decoder.packetMutex.Lock()
+	defer decoder.packetMutex.Unlock()
+
+	if decoder.packet == nil {
+		if mess.IP4Layer != nil {
+			decoder.packet = gopacket.NewPacket(decoder.data, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		} else {
+			decoder.packet = gopacket.NewPacket(decoder.data, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		}
+	}
+
+	return decoder.packet
+}
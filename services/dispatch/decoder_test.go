@@ -0,0 +1,138 @@
+package dispatch
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// buildIPv6Packet returns an IPv6 packet with the argumented extension
+// headers in front of a TCP or UDP header and a small payload
+func buildIPv6Packet(t *testing.T, extensions [][]byte, protocol layers.IPProtocol) []byte {
+	var transport []byte
+	transportBuffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true}
+
+	switch protocol {
+	case layers.IPProtocolTCP:
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, Seq: 1, DataOffset: 5, ACK: true, PSH: true}
+		if err := gopacket.SerializeLayers(transportBuffer, options, tcp, gopacket.Payload("hello")); err != nil {
+			t.Fatal(err)
+		}
+	case layers.IPProtocolUDP:
+		udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+		if err := gopacket.SerializeLayers(transportBuffer, options, udp, gopacket.Payload("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transport = transportBuffer.Bytes()
+
+	// chain the next header fields of the extensions and the IPv6 header
+	next := protocol
+	var payload []byte
+	for i := len(extensions) - 1; i >= 0; i-- {
+		header := append([]byte{}, extensions[i]...)
+		header[0] = byte(next)
+		payload = append(header, payload...)
+		next = layers.IPProtocol(extensions[i][0])
+	}
+	payload = append(payload, transport...)
+
+	ip6 := &layers.IPv6{
+		Version:    6,
+		NextHeader: next,
+		HopLimit:   64,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, options, ip6, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecodeIPv6Extensions(t *testing.T) {
+	// the first byte of each header is the type of the header, which is
+	// replaced with the next header when the packet is built
+	hopByHop := []byte{byte(layers.IPProtocolIPv6HopByHop), 0, 1, 4, 0, 0, 0, 0}
+	routing := []byte{byte(layers.IPProtocolIPv6Routing), 0, 0, 0, 0, 0, 0, 0}
+	destination := []byte{byte(layers.IPProtocolIPv6Destination), 0, 1, 4, 0, 0, 0, 0}
+	firstFragment := []byte{byte(layers.IPProtocolIPv6Fragment), 0, 0, 1, 0, 0, 0, 1}
+	laterFragment := []byte{byte(layers.IPProtocolIPv6Fragment), 0, 0, 8, 0, 0, 0, 1}
+
+	tests := []struct {
+		name       string
+		extensions [][]byte
+		protocol   layers.IPProtocol
+		transport  bool
+	}{
+		{"no extensions udp", nil, layers.IPProtocolUDP, true},
+		{"no extensions tcp", nil, layers.IPProtocolTCP, true},
+		{"hop by hop tcp", [][]byte{hopByHop}, layers.IPProtocolTCP, true},
+		{"routing udp", [][]byte{routing}, layers.IPProtocolUDP, true},
+		{"destination tcp", [][]byte{destination}, layers.IPProtocolTCP, true},
+		{"chain udp", [][]byte{hopByHop, destination, routing, destination}, layers.IPProtocolUDP, true},
+		{"first fragment udp", [][]byte{firstFragment}, layers.IPProtocolUDP, true},
+		{"later fragment udp", [][]byte{laterFragment}, layers.IPProtocolUDP, false},
+		{"hop by hop later fragment tcp", [][]byte{hopByHop, laterFragment}, layers.IPProtocolTCP, false},
+	}
+
+	for _, test := range tests {
+		var mess NfqueueMessage
+		data := buildIPv6Packet(t, test.extensions, test.protocol)
+		decoder := newPacketDecoder()
+
+		if !decoder.decode(data, &mess) {
+			t.Errorf("%s: not decoded", test.name)
+			continue
+		}
+		if mess.IP6Layer == nil {
+			t.Errorf("%s: missing IPv6 layer", test.name)
+		}
+
+		var port layers.TCPPort
+		found := mess.TCPLayer != nil || mess.UDPLayer != nil
+		if mess.TCPLayer != nil {
+			port = mess.TCPLayer.SrcPort
+		}
+		if mess.UDPLayer != nil {
+			port = layers.TCPPort(mess.UDPLayer.SrcPort)
+		}
+
+		if found != test.transport {
+			t.Errorf("%s: transport layer found %v, expected %v", test.name, found, test.transport)
+			continue
+		}
+		if !test.transport {
+			continue
+		}
+		if port != 40000 {
+			t.Errorf("%s: source port %d, expected 40000", test.name, port)
+		}
+		if string(mess.Payload) != "hello" {
+			t.Errorf("%s: payload %q, expected %q", test.name, mess.Payload, "hello")
+		}
+	}
+}
+
+func TestDecodeCopiesData(t *testing.T) {
+	var mess NfqueueMessage
+	data := buildIPv6Packet(t, nil, layers.IPProtocolUDP)
+	decoder := newPacketDecoder()
+
+	if !decoder.decode(data, &mess) {
+		t.Fatal("not decoded")
+	}
+
+	// the kernel frees the packet buffer after the verdict
+	for i := range data {
+		data[i] = 0
+	}
+
+	if mess.UDPLayer == nil || mess.UDPLayer.SrcPort != 40000 || string(mess.Payload) != "hello" {
+		t.Errorf("decoded layers changed with the original data")
+	}
+}
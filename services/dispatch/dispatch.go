@@ -9,11 +9,15 @@ package dispatch
 
 import (
 	"net"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/untangle/packetd/services/crashreport"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/supervisor"
 )
 
 // SubscriptionHolder stores the details of a data callback subscription
@@ -30,8 +34,13 @@ type SubscriptionHolder struct {
 // and working to the highest. The order will be random among multiple subscribers
 // that have the same priority.
 //
+// 0 - The latency handler is called first so the handshake timing isn't
+//     influenced by time spent waiting for other plugins.
+//
 // 1 - The reporter plugin gets the most critical priority so it can create events
 //     for capturing the data that is generated by other plugins and services.
+//     The pattern matcher is also called here so the payload matches for a packet
+//     are delivered before the general purpose plugins see the packet.
 //
 // 2 - The general purpose plugins are called next
 //
@@ -41,12 +50,27 @@ type SubscriptionHolder struct {
 // 4 - We want the stats plugin to be called last so our network latency calculations
 //     aren't influenced by time spent waiting for other plugins.
 
+// LatencyPriority ... We want this to be called before everything else
+const LatencyPriority = 0
+
+// HASyncPriority ... We want this to be called before everything else so the state restored from the HA primary is seen by the other handlers
+const HASyncPriority = 0
+
 // ReporterPriority ... We want this to be called FIRST
 const ReporterPriority = 1
 
 // StatsPriority ... We want this to be called LAST
 const StatsPriority = 4
 
+// PatternsPriority ... We want this to be called before the general purpose plugins
+const PatternsPriority = 1
+
+// RateLimitPriority ... We want this to be called before the general purpose plugins so floods are dropped early
+const RateLimitPriority = 1
+
+// PortScanPriority ... We want this to be called before the general purpose plugins so scanners are dropped early
+const PortScanPriority = 1
+
 // PredictPriority ...
 const PredictPriority = 2
 
@@ -74,6 +98,24 @@ const RevDNSPriority = 2
 // SniPriority ...
 const SniPriority = 2
 
+// VpnPriority ...
+const VpnPriority = 2
+
+// TCPHealthPriority ...
+const TCPHealthPriority = 2
+
+// SessionCapturePriority ... We want this to be called before everything else so the packets are captured as they arrived
+const SessionCapturePriority = 0
+
+// RulesPriority ... We want this to be called after prediction so rules can match the application
+const RulesPriority = 3
+
+// PolicyPriority ... We want this to be called after classify so the policy can match the application
+const PolicyPriority = 4
+
+// DSCPPriority ... We want this to be called after rules and classify so we can use the rule tags and the application
+const DSCPPriority = 4
+
 // list of subscribers to each of the three data sources
 var nfqueueSubList map[string]SubscriptionHolder
 var conntrackSubList map[string]SubscriptionHolder
@@ -92,6 +134,15 @@ var cleanupMutex sync.Mutex
 // channel used to shutdown the cleaner task
 var shutdownCleanerTask = make(chan bool)
 
+// the interval of the cleaner task and the time the supervisor allows between
+// runs, since a deadlock on the session or conntrack table stops the cleaner
+const cleanerInterval = 60 * time.Second
+const cleanerHeartbeatTimeout = 3 * cleanerInterval
+
+// the time the supervisor allows without a packet making it through the
+// subscribers while there are packets being handled
+const nfqueueHeartbeatTimeout = cleanerHeartbeatTimeout
+
 // stores the interval of conntrack updates
 var conntrackIntervalSeconds int
 
@@ -100,7 +151,7 @@ func Startup(ctInterval int) {
 	conntrackIntervalSeconds = ctInterval
 
 	// create the session, conntrack, and certificate tables
-	sessionTable = make(map[uint32]*Session)
+	clearSessionTable()
 	conntrackTable = make(map[uint32]*Conntrack)
 
 	// create the nfqueue, conntrack, and netlogger subscription tables
@@ -108,6 +159,22 @@ func Startup(ctInterval int) {
 	conntrackSubList = make(map[string]SubscriptionHolder)
 	netloggerSubList = make(map[string]SubscriptionHolder)
 
+	// load the dispatch settings
+	Reload()
+
+	// the policy engine decisions are applied by dispatch
+	InsertNfqueueSubscription("policy", PolicyPriority, policyHandler)
+
+	// the TCP handshake is timed by dispatch for passive latency monitoring
+	InsertNfqueueSubscription("latency", LatencyPriority, latencyHandler)
+	InsertShedder("latency", shedLatencyTable)
+
+	// the TCP health tracking is optional and releases sessions when disabled
+	InsertNfqueueSubscription("tcphealth", TCPHealthPriority, tcpHealthHandler)
+
+	// the session capture writes the packets of each captured session to its own file
+	InsertNfqueueSubscription("sessioncapture", SessionCapturePriority, sessionCaptureHandler)
+
 	// initialize the sessionIndex counter
 	// highest 16 bits are zero
 	// middle  32 bits should be epoch
@@ -121,11 +188,16 @@ func Startup(ctInterval int) {
 	kernel.RegisterNetloggerCallback(netloggerCallback)
 
 	// start cleaner tasks to clean tables
+	supervisor.Register("dispatch", cleanerHeartbeatTimeout)
+	supervisor.Register("nfqueue", nfqueueHeartbeatTimeout)
 	go cleanerTask()
 }
 
 // Shutdown stops the event handling service
 func Shutdown() {
+	supervisor.Unregister("dispatch")
+	supervisor.Unregister("nfqueue")
+
 	// Send shutdown signal to periodicTask and wait for it to return
 	shutdownCleanerTask <- true
 	select {
@@ -133,6 +205,20 @@ func Shutdown() {
 	case <-time.After(10 * time.Second):
 		logger.Err("Failed to properly shutdown cleanerTask\n")
 	}
+
+	// log the end of the sessions that are still active
+	endAllSessions()
+	StopSessionCapture()
+}
+
+// Reload loads the dispatch settings
+func Reload() {
+	loadElephantFlow()
+	loadIntervalStats()
+	loadTCPHealth()
+	loadPrivacy()
+	loadMirror()
+	loadMidSession()
 }
 
 // cleanerTask is a periodic task to cleanup conntrack and session tables
@@ -144,11 +230,20 @@ func cleanerTask() {
 		case <-shutdownCleanerTask:
 			shutdownCleanerTask <- true
 			return
-		case <-time.After(60 * time.Second):
+		case <-time.After(cleanerInterval):
 			counter++
 			logger.Debug("Calling cleaner task %d\n", counter)
 			cleanSessionTable()
 			cleanConntrackTable()
+			cleanRemoteSessions()
+			cleanUnconfirmed()
+			supervisor.Beat("dispatch")
+
+			// the packet handling only beats when packets get through, so
+			// we beat for it while nothing is waiting on the subscribers
+			if atomic.LoadInt32(&packetsInFlight) == 0 {
+				supervisor.Beat("nfqueue")
+			}
 		}
 	}
 }
@@ -160,6 +255,15 @@ func dupIP(ip net.IP) net.IP {
 	return dup
 }
 
+// reportPanic is deferred around the subscription handlers to save a crash
+// report for a panic before it continues on and takes down the process
+func reportPanic(kind string, owner string) {
+	if recovered := recover(); recovered != nil {
+		crashreport.Capture(kind+" "+owner, recovered, debug.Stack())
+		panic(recovered)
+	}
+}
+
 // InsertNfqueueSubscription adds a subscription for receiving nfqueue messages
 func InsertNfqueueSubscription(owner string, priority int, function NfqueueHandlerFunction) {
 	var holder SubscriptionHolder
@@ -231,14 +335,22 @@ func InsertNetloggerSubscription(owner string, priority int, function NetloggerH
 // HandleWarehousePlayback spins up a goroutine that will playback a warehouse capture
 // file, wait until the playback is finished, and save the netfilter and conntrack
 // cleanup lists that are returned from the playback function
-func HandleWarehousePlayback() {
+func HandleWarehousePlayback(filename string) error {
+	playfile, finished, err := openPlaybackFile(filename)
+	if err != nil {
+		return err
+	}
+	kernel.SetWarehouseFile(playfile)
+
 	go func() {
 		cleanupMutex.Lock()
 		defer cleanupMutex.Unlock()
+		defer finished()
 		nfCleanupList = make(map[uint32]bool)
 		ctCleanupList = make(map[uint32]bool)
 		kernel.WarehousePlaybackFile(nfCleanupList, ctCleanupList)
 	}()
+	return nil
 }
 
 // HandleWarehouseCleanup removes the nfqueue and conntrack entries that
@@ -0,0 +1,133 @@
+package dispatch
+
+import (
+	"sync/atomic"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the subscription owner we wait for before releasing an elephant flow
+const classifyOwner = "classify"
+
+// the session attachments that mark a drop or block decision. The subscribers
+// that made the decision must keep seeing the packets so they can drop them,
+// so these sessions are never released as elephant flows.
+var elephantHoldAttachments = []string{policyDropAttachment, "rules_drop", "application_blocked"}
+
+// the subscription owners that hold the session while their rules are still
+// being evaluated
+var elephantHoldOwners = []string{"policy", "rules"}
+
+// ElephantConfig holds the elephant flow cutoff settings. Once a session has
+// moved more than the byte or packet threshold all of the subscriptions are
+// released and the session is bypassed so large transfers stop traversing
+// userspace. A zero threshold is not checked. When WaitForClassify is set the
+// session is not released until the classify plugin has finished with it.
+type ElephantConfig struct {
+	Enabled         bool   `json:"enabled"`
+	Bytes           uint64 `json:"bytes"`
+	Packets         uint64 `json:"packets"`
+	WaitForClassify bool   `json:"waitForClassify"`
+}
+
+// ElephantStatus holds the elephant flow settings and the number of released sessions
+type ElephantStatus struct {
+	Config   ElephantConfig `json:"config"`
+	Released uint64         `json:"released"`
+}
+
+var elephantConfig atomic.Value
+var elephantReleased uint64
+
+// loadElephantFlow loads the elephant flow settings
+func loadElephantFlow() {
+	config := loadElephantConfig()
+	elephantConfig.Store(config)
+	logger.Info("Loaded elephant flow cutoff enabled:%v bytes:%d packets:%d waitForClassify:%v\n", config.Enabled, config.Bytes, config.Packets, config.WaitForClassify)
+}
+
+// GetElephantStatus returns the elephant flow settings and counters
+func GetElephantStatus() ElephantStatus {
+	status := ElephantStatus{Released: atomic.LoadUint64(&elephantReleased)}
+	status.Config, _ = elephantConfig.Load().(ElephantConfig)
+	return status
+}
+
+// checkElephantFlow returns true and bypasses the session if it has passed the
+// elephant flow threshold, classification is done, and no rule has dropped or
+// blocked the session or is still waiting to be evaluated
+func checkElephantFlow(session *Session, packetcount uint64) bool {
+	config, _ := elephantConfig.Load().(ElephantConfig)
+	if !config.Enabled {
+		return false
+	}
+
+	overBytes := (config.Bytes != 0 && session.GetByteCount() >= config.Bytes)
+	overPackets := (config.Packets != 0 && packetcount >= config.Packets)
+	if !overBytes && !overPackets {
+		return false
+	}
+
+	for _, name := range elephantHoldAttachments {
+		if session.GetAttachment(name) != nil {
+			return false
+		}
+	}
+
+	session.subLocker.Lock()
+	defer session.subLocker.Unlock()
+
+	for _, owner := range elephantHoldOwners {
+		if _, found := session.subscriptions[owner]; found {
+			return false
+		}
+	}
+
+	if config.WaitForClassify {
+		if _, found := session.subscriptions[classifyOwner]; found {
+			return false
+		}
+	}
+
+	logger.Debug("Releasing elephant flow %v ctid:%d Packets:%d Bytes:%d Subscribers:%v\n", session.GetClientSideTuple(), session.GetConntrackID(), packetcount, session.GetByteCount(), session.subscriptions)
+	session.subscriptions = make(map[string]SubscriptionHolder)
+	dict.AddSessionEntry(session.GetConntrackID(), "bypass_packetd", true)
+
+	atomic.AddUint64(&elephantReleased, 1)
+	overseer.AddCounter("elephant_session_bypass", 1)
+	return true
+}
+
+// loadElephantConfig loads the elephant flow settings
+func loadElephantConfig() ElephantConfig {
+	result := ElephantConfig{WaitForClassify: true}
+
+	elephantJSON, err := settings.GetCurrentSettings([]string{"dispatch", "elephantFlow"})
+	if elephantJSON == nil || err != nil {
+		return result
+	}
+
+	item, ok := elephantJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid elephant flow settings: %T\n", elephantJSON)
+		return result
+	}
+
+	if value, ok := item["enabled"].(bool); ok {
+		result.Enabled = value
+	}
+	if value, ok := item["bytes"].(float64); ok && value > 0 {
+		result.Bytes = uint64(value)
+	}
+	if value, ok := item["packets"].(float64); ok && value > 0 {
+		result.Packets = uint64(value)
+	}
+	if value, ok := item["waitForClassify"].(bool); ok {
+		result.WaitForClassify = value
+	}
+
+	return result
+}
@@ -0,0 +1,47 @@
+package dispatch
+
+import "testing"
+
+func TestCheckElephantFlow(t *testing.T) {
+	elephantConfig.Store(ElephantConfig{Enabled: true, Packets: 100, WaitForClassify: true})
+	defer elephantConfig.Store(ElephantConfig{})
+
+	tests := []struct {
+		name          string
+		packets       uint64
+		attachment    string
+		subscriptions []string
+		released      bool
+	}{
+		{"under threshold", 99, "", nil, false},
+		{"over threshold", 100, "", nil, true},
+		{"other subscriber", 100, "", []string{"geoip"}, true},
+		{"waiting for classify", 100, "", []string{classifyOwner}, false},
+		{"policy drop", 100, policyDropAttachment, nil, false},
+		{"rules drop", 100, "rules_drop", nil, false},
+		{"application blocked", 100, "application_blocked", nil, false},
+		{"policy pending", 100, "", []string{"policy"}, false},
+		{"rules pending", 100, "", []string{"rules"}, false},
+	}
+
+	for _, test := range tests {
+		session := &Session{
+			attachments:   make(map[string]interface{}),
+			subscriptions: make(map[string]SubscriptionHolder),
+		}
+		if test.attachment != "" {
+			session.PutAttachment(test.attachment, "test")
+		}
+		for _, owner := range test.subscriptions {
+			session.subscriptions[owner] = SubscriptionHolder{Owner: owner}
+		}
+
+		released := checkElephantFlow(session, test.packets)
+		if released != test.released {
+			t.Errorf("%s: released %v, expected %v", test.name, released, test.released)
+		}
+		if released && len(session.subscriptions) != 0 {
+			t.Errorf("%s: subscriptions not cleared: %v", test.name, session.subscriptions)
+		}
+	}
+}
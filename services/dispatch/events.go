@@ -0,0 +1,73 @@
+package dispatch
+
+import (
+	"time"
+
+	"github.com/untangle/packetd/services/eventbus"
+)
+
+// publishSessionNew publishes the session.new event for a new session
+func publishSessionNew(session *Session) {
+	if session.IsPrivate() || !eventbus.HasSubscribers(eventbus.TopicSessionNew) {
+		return
+	}
+
+	tuple := session.GetClientSideTuple()
+	eventbus.Publish(eventbus.TopicSessionNew, "dispatch", map[string]interface{}{
+		"session_id":          session.GetSessionID(),
+		"family":              session.GetFamily(),
+		"ip_protocol":         tuple.Protocol,
+		"client_address":      tuple.ClientAddress.String(),
+		"client_port":         tuple.ClientPort,
+		"server_address":      tuple.ServerAddress.String(),
+		"server_port":         tuple.ServerPort,
+		"client_interface_id": session.GetClientInterfaceID(),
+		"client_zone":         session.GetClientZone(),
+		"vlan_id":             session.GetVlanID(),
+	})
+}
+
+// publishSessionEnd publishes the session.end event when the conntrack entry
+// for a session is deleted
+func publishSessionEnd(conntrack *Conntrack, reason string) {
+	if conntrack == nil || conntrack.Session == nil || conntrack.Session.IsPrivate() || !eventbus.HasSubscribers(eventbus.TopicSessionEnd) {
+		return
+	}
+
+	conntrack.Guardian.RLock()
+	defer conntrack.Guardian.RUnlock()
+
+	session := conntrack.Session
+	tuple := session.GetClientSideTuple()
+	eventbus.Publish(eventbus.TopicSessionEnd, "dispatch", map[string]interface{}{
+		"session_id":     session.GetSessionID(),
+		"ip_protocol":    tuple.Protocol,
+		"client_address": tuple.ClientAddress.String(),
+		"client_port":    tuple.ClientPort,
+		"server_address": tuple.ServerAddress.String(),
+		"server_port":    tuple.ServerPort,
+		"client_bytes":   conntrack.ClientBytes,
+		"server_bytes":   conntrack.ServerBytes,
+		"client_packets": conntrack.ClientPackets,
+		"server_packets": conntrack.ServerPackets,
+		"duration":       getSessionDuration(conntrack, time.Now()).Seconds(),
+		"end_reason":     reason,
+	})
+}
+
+// publishSessionConflict publishes the session.conflict event when a ctid is
+// reused while its session is in the table or a session is merged into another
+func publishSessionConflict(kind string, ctid uint32, generation uint32, previous Tuple, current Tuple, migrated int) {
+	if !eventbus.HasSubscribers(eventbus.TopicSessionConflict) {
+		return
+	}
+
+	eventbus.Publish(eventbus.TopicSessionConflict, "dispatch", map[string]interface{}{
+		"kind":           kind,
+		"conntrack_id":   ctid,
+		"generation":     generation,
+		"previous_tuple": previous.String(),
+		"tuple":          current.String(),
+		"migrated":       migrated,
+	})
+}
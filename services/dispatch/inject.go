@@ -0,0 +1,86 @@
+//go:build integration
+// +build integration
+
+package dispatch
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+)
+
+// ConntrackEvent holds the values the kernel passes for a conntrack event
+type ConntrackEvent struct {
+	ConntrackID    uint32
+	Connmark       uint32
+	Family         uint8
+	EventType      uint8
+	Protocol       uint8
+	Client         net.IP
+	Server         net.IP
+	ClientPort     uint16
+	ServerPort     uint16
+	ClientNew      net.IP
+	ServerNew      net.IP
+	ClientPortNew  uint16
+	ServerPortNew  uint16
+	ClientBytes    uint64
+	ServerBytes    uint64
+	ClientPackets  uint64
+	ServerPackets  uint64
+	TimestampStart uint64
+	TimestampStop  uint64
+	Timeout        uint32
+	TCPState       uint8
+}
+
+// NetloggerEvent holds the values the kernel passes for a netlogger event
+type NetloggerEvent struct {
+	Version      uint8
+	Protocol     uint8
+	IcmpType     uint16
+	SrcInterface uint8
+	DstInterface uint8
+	SrcAddress   string
+	DstAddress   string
+	SrcPort      uint16
+	DstPort      uint16
+	Mark         uint32
+	ConntrackID  uint32
+	Prefix       string
+}
+
+// InjectNfqueue passes a packet to the nfqueue handler as if it came from the
+// kernel and returns the verdict that would have been given to the kernel
+func InjectNfqueue(ctid uint32, family uint32, packet gopacket.Packet, pmark uint32) int {
+	return nfqueueCallback(ctid, family, packet.Data(), pmark, 0, 0)
+}
+
+// InjectConntrack passes an event to the conntrack handler as if it came from the kernel
+func InjectConntrack(event ConntrackEvent) {
+	conntrackCallback(event.ConntrackID, event.Connmark, event.Family, event.EventType, event.Protocol,
+		event.Client, event.Server, event.ClientPort, event.ServerPort,
+		event.ClientNew, event.ServerNew, event.ClientPortNew, event.ServerPortNew,
+		event.ClientBytes, event.ServerBytes, event.ClientPackets, event.ServerPackets,
+		event.TimestampStart, event.TimestampStop, event.Timeout, event.TCPState)
+}
+
+// InjectNetlogger passes an event to the netlogger handler as if it came from the kernel
+func InjectNetlogger(event NetloggerEvent) {
+	netloggerCallback(event.Version, event.Protocol, event.IcmpType, event.SrcInterface, event.DstInterface,
+		event.SrcAddress, event.DstAddress, event.SrcPort, event.DstPort, event.Mark, event.ConntrackID, event.Prefix)
+}
+
+// FindSession returns the session for the argumented ctid or nil if not found
+func FindSession(ctid uint32) *Session {
+	return findSession(ctid)
+}
+
+// FindConntrack returns the conntrack entry for the argumented ctid or nil if not found
+func FindConntrack(ctid uint32) *Conntrack {
+	conntrack, found := findConntrack(ctid)
+	if !found {
+		return nil
+	}
+	return conntrack
+}
@@ -0,0 +1,155 @@
+package dispatch
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// IntervalConfig holds the interval stats settings. Sessions that live longer
+// than the minimum age log the bytes and packets moved during each interval
+// so the reports can graph long transfers while they are running instead of
+// counting all of the traffic when the session ends.
+type IntervalConfig struct {
+	Enabled           bool `json:"enabled"`
+	IntervalSeconds   int  `json:"intervalSeconds"`
+	MinimumAgeSeconds int  `json:"minimumAgeSeconds"`
+}
+
+// the defaults used when the interval stats settings are missing
+const defaultIntervalSeconds = 60
+const defaultMinimumAgeSeconds = 60
+
+// sessionInterval holds the traffic counted since the last interval event.
+// It is only changed while holding the Guardian lock of the conntrack.
+type sessionInterval struct {
+	start         time.Time
+	events        uint64
+	clientBytes   uint64
+	serverBytes   uint64
+	clientPackets uint64
+	serverPackets uint64
+}
+
+var intervalConfig atomic.Value
+
+// loadIntervalStats loads the interval stats settings
+func loadIntervalStats() {
+	config := loadIntervalConfig()
+	intervalConfig.Store(config)
+	logger.Info("Loaded interval stats enabled:%v interval:%d minimumAge:%d\n", config.Enabled, config.IntervalSeconds, config.MinimumAgeSeconds)
+}
+
+// accountInterval adds the traffic from the last conntrack update to the
+// current interval and logs an interval event when the interval is over.
+// The caller must hold the Guardian lock of the conntrack.
+func accountInterval(conntrack *Conntrack, now time.Time) {
+	config, _ := intervalConfig.Load().(IntervalConfig)
+	if !config.Enabled {
+		return
+	}
+
+	interval := &conntrack.interval
+	if interval.start.IsZero() {
+		interval.start = conntrack.CreationTime
+	}
+
+	interval.clientBytes += conntrack.ClientBytesDiff
+	interval.serverBytes += conntrack.ServerBytesDiff
+	interval.clientPackets += conntrack.ClientPacketsDiff
+	interval.serverPackets += conntrack.ServerPacketsDiff
+
+	if now.Sub(conntrack.CreationTime) < time.Duration(config.MinimumAgeSeconds)*time.Second {
+		return
+	}
+	if now.Sub(interval.start) < time.Duration(config.IntervalSeconds)*time.Second {
+		return
+	}
+
+	logIntervalEvent(conntrack, now)
+}
+
+// finishInterval logs the traffic since the last interval event when a session
+// that has already logged interval events ends, so the intervals add up to the
+// session total. The arguments are the final counters from the delete event.
+func finishInterval(conntrack *Conntrack, clientBytes uint64, serverBytes uint64, clientPackets uint64, serverPackets uint64) {
+	conntrack.Guardian.Lock()
+	defer conntrack.Guardian.Unlock()
+
+	interval := &conntrack.interval
+	if interval.events == 0 {
+		return
+	}
+
+	// the counters are zero when the delete event doesn't include them
+	if clientBytes > conntrack.ClientBytes {
+		interval.clientBytes += clientBytes - conntrack.ClientBytes
+	}
+	if serverBytes > conntrack.ServerBytes {
+		interval.serverBytes += serverBytes - conntrack.ServerBytes
+	}
+	if clientPackets > conntrack.ClientPackets {
+		interval.clientPackets += clientPackets - conntrack.ClientPackets
+	}
+	if serverPackets > conntrack.ServerPackets {
+		interval.serverPackets += serverPackets - conntrack.ServerPackets
+	}
+
+	if interval.clientPackets == 0 && interval.serverPackets == 0 {
+		return
+	}
+
+	logIntervalEvent(conntrack, time.Now())
+}
+
+// logIntervalEvent logs the traffic for the current interval and starts the next one.
+// The caller must hold the Guardian lock of the conntrack.
+func logIntervalEvent(conntrack *Conntrack, now time.Time) {
+	interval := &conntrack.interval
+
+	columns := map[string]interface{}{
+		"time_stamp":       now,
+		"session_id":       conntrack.SessionID,
+		"interval_seconds": int32(now.Sub(interval.start).Seconds()),
+		"bytes":            interval.clientBytes + interval.serverBytes,
+		"client_bytes":     interval.clientBytes,
+		"server_bytes":     interval.serverBytes,
+		"packets":          interval.clientPackets + interval.serverPackets,
+		"client_packets":   interval.clientPackets,
+		"server_packets":   interval.serverPackets,
+	}
+	reports.LogEvent(reports.CreateEvent("session_interval", "session_intervals", 1, columns, nil))
+
+	*interval = sessionInterval{start: now, events: interval.events + 1}
+}
+
+// loadIntervalConfig loads the interval stats settings
+func loadIntervalConfig() IntervalConfig {
+	result := IntervalConfig{IntervalSeconds: defaultIntervalSeconds, MinimumAgeSeconds: defaultMinimumAgeSeconds}
+
+	intervalJSON, err := settings.GetCurrentSettings([]string{"dispatch", "intervalStats"})
+	if intervalJSON == nil || err != nil {
+		return result
+	}
+
+	item, ok := intervalJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid interval stats settings: %T\n", intervalJSON)
+		return result
+	}
+
+	if value, ok := item["enabled"].(bool); ok {
+		result.Enabled = value
+	}
+	if value, ok := item["intervalSeconds"].(float64); ok && value > 0 {
+		result.IntervalSeconds = int(value)
+	}
+	if value, ok := item["minimumAgeSeconds"].(float64); ok && value >= 0 {
+		result.MinimumAgeSeconds = int(value)
+	}
+
+	return result
+}
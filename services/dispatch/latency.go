@@ -0,0 +1,249 @@
+package dispatch
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// the session attachments used to time the TCP handshake
+const (
+	handshakeSynAttachment    = "handshake_syn_time"
+	handshakeSynAckAttachment = "handshake_synack_time"
+)
+
+// the number of packets we look at before giving up on the handshake
+const handshakePacketLimit = 8
+
+// the maximum number of servers we keep latency stats for
+const latencyServerLimit = 1024
+
+// the weight of a new measurement in the moving average
+const latencyAverageWeight = 0.125
+
+// LatencyStats holds the handshake round trip times measured for a server or an interface
+type LatencyStats struct {
+	Count    uint64    `json:"count"`
+	Average  float64   `json:"average"`
+	Minimum  float64   `json:"minimum"`
+	Maximum  float64   `json:"maximum"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// ServerLatency holds the server side round trip times for a server address
+type ServerLatency struct {
+	Address string `json:"address"`
+	LatencyStats
+}
+
+// InterfaceLatency holds the round trip times for the sessions on an interface.
+// The server side times are for the sessions that leave on the interface, which
+// for a WAN is the latency of the upstream path, and the client side times are
+// for the sessions that arrive on the interface.
+type InterfaceLatency struct {
+	InterfaceID int          `json:"interfaceId"`
+	Zone        string       `json:"zone"`
+	Server      LatencyStats `json:"server"`
+	Client      LatencyStats `json:"client"`
+}
+
+// LatencyStatus holds the handshake round trip times for the servers and interfaces
+type LatencyStatus struct {
+	Servers    []ServerLatency    `json:"servers"`
+	Interfaces []InterfaceLatency `json:"interfaces"`
+}
+
+var serverLatencyTable = make(map[string]*LatencyStats)
+var interfaceLatencyTable = make(map[int]*InterfaceLatency)
+var latencyLocker sync.Mutex
+
+// latencyHandler is the nfqueue subscription that measures the TCP handshake. The
+// server side round trip is the time from the SYN to the SYN-ACK and the client
+// side is the time from the SYN-ACK to the ACK. It is called before the other
+// subscribers so the plugins don't add to the times.
+func latencyHandler(mess NfqueueMessage, ctid uint32, newSession bool) NfqueueResult {
+	var result NfqueueResult
+	result.SessionRelease = true
+
+	now := time.Now()
+	session := mess.Session
+	tcp := mess.TCPLayer
+	if session == nil || tcp == nil || tcp.RST || tcp.FIN || session.GetPacketCount() > handshakePacketLimit {
+		return result
+	}
+
+	result.SessionRelease = false
+
+	switch {
+	case tcp.SYN && !tcp.ACK && mess.ClientToServer:
+		// a retransmitted SYN restarts the timing so we measure the one that was answered
+		session.PutAttachment(handshakeSynAttachment, now)
+
+	case tcp.SYN && tcp.ACK && !mess.ClientToServer:
+		syn, found := session.GetAttachment(handshakeSynAttachment).(time.Time)
+		if !found {
+			result.SessionRelease = true
+			break
+		}
+		if session.GetAttachment(handshakeSynAckAttachment) == nil {
+			session.PutAttachment(handshakeSynAckAttachment, now)
+			recordServerLatency(session, ctid, now.Sub(syn), now)
+		}
+
+	case tcp.ACK && !tcp.SYN && mess.ClientToServer:
+		synack, found := session.GetAttachment(handshakeSynAckAttachment).(time.Time)
+		if found {
+			recordClientLatency(session, ctid, now.Sub(synack), now)
+			result.SessionRelease = true
+		}
+	}
+
+	return result
+}
+
+// recordServerLatency saves the server side round trip time for the session and the stats
+func recordServerLatency(session *Session, ctid uint32, rtt time.Duration, now time.Time) {
+	millis := getMilliseconds(rtt)
+	logger.Debug("Server handshake RTT %.3f ms for %v\n", millis, session.GetClientSideTuple())
+
+	dict.AddSessionEntry(ctid, "server_rtt_us", uint32(rtt/time.Microsecond))
+	logLatencyEvent(session, "server_rtt", millis)
+
+	address := session.GetClientSideTuple().ServerAddress
+	interfaceID := int(session.GetServerInterfaceID())
+	zone := session.GetServerZone()
+
+	latencyLocker.Lock()
+	defer latencyLocker.Unlock()
+
+	findServerLatency(address).add(millis, now)
+	findInterfaceLatency(interfaceID, zone).Server.add(millis, now)
+}
+
+// recordClientLatency saves the client side round trip time for the session and the stats
+func recordClientLatency(session *Session, ctid uint32, rtt time.Duration, now time.Time) {
+	millis := getMilliseconds(rtt)
+	logger.Debug("Client handshake RTT %.3f ms for %v\n", millis, session.GetClientSideTuple())
+
+	dict.AddSessionEntry(ctid, "client_rtt_us", uint32(rtt/time.Microsecond))
+	logLatencyEvent(session, "client_rtt", millis)
+
+	interfaceID := int(session.GetClientInterfaceID())
+	zone := session.GetClientZone()
+
+	latencyLocker.Lock()
+	defer latencyLocker.Unlock()
+
+	findInterfaceLatency(interfaceID, zone).Client.add(millis, now)
+}
+
+// logLatencyEvent updates the session in the reports with a round trip time
+func logLatencyEvent(session *Session, name string, millis float64) {
+	columns := map[string]interface{}{
+		"session_id": session.GetSessionID(),
+	}
+	modifiedColumns := map[string]interface{}{
+		name: millis,
+	}
+	reports.LogEvent(reports.CreateEvent("session_"+name, "sessions", 2, columns, modifiedColumns))
+}
+
+// GetLatencyStatus returns the handshake round trip times for the servers and interfaces
+func GetLatencyStatus() LatencyStatus {
+	status := LatencyStatus{Servers: []ServerLatency{}, Interfaces: []InterfaceLatency{}}
+
+	latencyLocker.Lock()
+	for address, stats := range serverLatencyTable {
+		status.Servers = append(status.Servers, ServerLatency{Address: address, LatencyStats: *stats})
+	}
+	for _, stats := range interfaceLatencyTable {
+		status.Interfaces = append(status.Interfaces, *stats)
+	}
+	latencyLocker.Unlock()
+
+	sort.Slice(status.Servers, func(i, j int) bool {
+		return status.Servers[i].Count > status.Servers[j].Count
+	})
+	sort.Slice(status.Interfaces, func(i, j int) bool {
+		return status.Interfaces[i].InterfaceID < status.Interfaces[j].InterfaceID
+	})
+
+	return status
+}
+
+// shedLatencyTable empties the server latency table when we are short on memory
+func shedLatencyTable(level int) {
+	if level < ShedCaches {
+		return
+	}
+
+	latencyLocker.Lock()
+	serverLatencyTable = make(map[string]*LatencyStats)
+	latencyLocker.Unlock()
+}
+
+// add adds a round trip time in milliseconds to the stats
+func (stats *LatencyStats) add(millis float64, now time.Time) {
+	if stats.Count == 0 {
+		stats.Average = millis
+		stats.Minimum = millis
+		stats.Maximum = millis
+	} else {
+		stats.Average += (millis - stats.Average) * latencyAverageWeight
+		if millis < stats.Minimum {
+			stats.Minimum = millis
+		}
+		if millis > stats.Maximum {
+			stats.Maximum = millis
+		}
+	}
+	stats.Count++
+	stats.LastSeen = now
+}
+
+// findServerLatency returns the stats for a server, replacing the server that
+// was seen least recently when the table is full. The caller must hold the latencyLocker.
+func findServerLatency(address net.IP) *LatencyStats {
+	key := address.String()
+	stats, found := serverLatencyTable[key]
+	if found {
+		return stats
+	}
+
+	if len(serverLatencyTable) >= latencyServerLimit {
+		var oldest string
+		for item, value := range serverLatencyTable {
+			if oldest == "" || value.LastSeen.Before(serverLatencyTable[oldest].LastSeen) {
+				oldest = item
+			}
+		}
+		delete(serverLatencyTable, oldest)
+	}
+
+	stats = new(LatencyStats)
+	serverLatencyTable[key] = stats
+	return stats
+}
+
+// findInterfaceLatency returns the stats for an interface. The caller must hold the latencyLocker.
+func findInterfaceLatency(interfaceID int, zone string) *InterfaceLatency {
+	stats, found := interfaceLatencyTable[interfaceID]
+	if !found {
+		stats = &InterfaceLatency{InterfaceID: interfaceID}
+		interfaceLatencyTable[interfaceID] = stats
+	}
+	if zone != "" {
+		stats.Zone = zone
+	}
+	return stats
+}
+
+// getMilliseconds returns a duration as fractional milliseconds
+func getMilliseconds(value time.Duration) float64 {
+	return float64(value) / float64(time.Millisecond)
+}
@@ -0,0 +1,238 @@
+package dispatch
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+// Conntrack ids are reused, and a new packet can get a ctid that still has a
+// session in our table, or be merged by conntrack into another entry with the
+// same tuple when two packets of a new flow race to be confirmed. Each session
+// has a generation that counts the sessions that have held its ctid while the
+// previous one was still in the table. The sessions that are not confirmed yet
+// are also indexed by tuple, so when the conntrack NEW event arrives for a
+// ctid we can find the session created for a packet that was merged into it,
+// move that session to the ctid, and copy the attachments of any other dying
+// session with the same tuple so the work the subscribers did isn't lost.
+
+// the kinds of session conflicts counted and published
+const (
+	conflictReuse    = "reuse"
+	conflictMismatch = "mismatch"
+	conflictMerge    = "merge"
+)
+
+// ConflictStatus holds the number of each kind of session conflict
+type ConflictStatus struct {
+	Reused     uint64 `json:"reused"`
+	Mismatched uint64 `json:"mismatched"`
+	Merged     uint64 `json:"merged"`
+	Migrated   uint64 `json:"migrated"`
+	Pending    int    `json:"pending"`
+}
+
+var unconfirmedTable = make(map[string][]*Session)
+var unconfirmedLocker sync.Mutex
+var conflictReused uint64
+var conflictMismatched uint64
+var conflictMerged uint64
+var conflictMigrated uint64
+
+// GetGeneration returns the number of sessions that have held the ctid of
+// this session, including this one, while the previous one was in the table
+func (sess *Session) GetGeneration() uint32 {
+	return atomic.LoadUint32(&sess.generation)
+}
+
+// setGeneration sets the generation of the session
+func (sess *Session) setGeneration(value uint32) {
+	atomic.StoreUint32(&sess.generation, value)
+}
+
+// GetConflictStatus returns the number of each kind of session conflict
+func GetConflictStatus() ConflictStatus {
+	status := ConflictStatus{
+		Reused:     atomic.LoadUint64(&conflictReused),
+		Mismatched: atomic.LoadUint64(&conflictMismatched),
+		Merged:     atomic.LoadUint64(&conflictMerged),
+		Migrated:   atomic.LoadUint64(&conflictMigrated),
+	}
+
+	unconfirmedLocker.Lock()
+	for _, list := range unconfirmedTable {
+		status.Pending += len(list)
+	}
+	unconfirmedLocker.Unlock()
+
+	return status
+}
+
+// addUnconfirmed indexes a new session by tuple until it is confirmed
+func addUnconfirmed(session *Session) {
+	key := session.GetClientSideTuple().String()
+
+	unconfirmedLocker.Lock()
+	unconfirmedTable[key] = append(unconfirmedTable[key], session)
+	unconfirmedLocker.Unlock()
+}
+
+// takeUnconfirmed removes and returns the unconfirmed sessions for a tuple
+func takeUnconfirmed(tuple Tuple) []*Session {
+	key := tuple.String()
+
+	unconfirmedLocker.Lock()
+	list := unconfirmedTable[key]
+	delete(unconfirmedTable, key)
+	unconfirmedLocker.Unlock()
+
+	return list
+}
+
+// replaceSession creates the session for a new packet that got the ctid of a
+// session still in the table, which is then dead
+func replaceSession(previous *Session, mess NfqueueMessage, ctid uint32) *Session {
+	previous.removeFromSessionTable()
+
+	session := createSession(mess, ctid)
+	session.setGeneration(previous.GetGeneration() + 1)
+
+	atomic.AddUint64(&conflictReused, 1)
+	overseer.AddCounter("session_ctid_reuse", 1)
+	publishSessionConflict(conflictReuse, ctid, session.GetGeneration(), previous.GetClientSideTuple(), session.GetClientSideTuple(), 0)
+	return session
+}
+
+// reconcileSession is called for the conntrack NEW event of a ctid with the
+// session we found for it, which is nil if there was none or it had the
+// wrong tuple. Any unconfirmed session with the tuple of the event that was
+// created under another ctid is a packet conntrack merged into this one. The
+// first one becomes the session when we have none, and the attachments of the
+// others are copied to the session before they are removed. It returns the
+// session for the ctid, which may still be nil.
+func reconcileSession(ctid uint32, session *Session, tuple Tuple) *Session {
+	var migrated int
+
+	for _, other := range takeUnconfirmed(tuple) {
+		if other == session || other.GetConntrackConfirmed() {
+			continue
+		}
+
+		// the other session is only still pending if it is in the table
+		oldctid := other.GetConntrackID()
+		if findSession(oldctid) != other {
+			continue
+		}
+
+		if session == nil {
+			moveSession(other, ctid)
+			session = other
+
+			atomic.AddUint64(&conflictMerged, 1)
+			overseer.AddCounter("session_merge", 1)
+			logger.Debug("Moved session %v from ctid %d to %d\n", tuple, oldctid, ctid)
+			publishSessionConflict(conflictMerge, ctid, session.GetGeneration(), tuple, tuple, 0)
+			continue
+		}
+
+		migrated += migrateAttachments(other, session)
+		other.flushDict()
+		other.removeFromSessionTable()
+
+		atomic.AddUint64(&conflictMerged, 1)
+		overseer.AddCounter("session_merge", 1)
+		logger.Debug("Merged session %v from ctid %d into %d with %d attachments\n", tuple, oldctid, ctid, migrated)
+		publishSessionConflict(conflictMerge, ctid, session.GetGeneration(), tuple, tuple, migrated)
+	}
+
+	if migrated != 0 {
+		atomic.AddUint64(&conflictMigrated, uint64(migrated))
+		overseer.AddCounter("session_merge_attachments", uint64(migrated))
+	}
+
+	return session
+}
+
+// moveSession moves a session that is still pending to another ctid. The
+// privacy of the session is kept, which removeFromSessionTable would release.
+func moveSession(session *Session, ctid uint32) {
+	oldctid := session.GetConntrackID()
+	session.flushDict()
+
+	shard := getSessionShard(oldctid)
+	shard.mutex.Lock()
+	if current, found := shard.sessions.Load(oldctid); found && current.(*Session) == session {
+		shard.sessions.Delete(oldctid)
+	}
+	shard.mutex.Unlock()
+
+	session.SetConntrackID(ctid)
+	session.setGeneration(session.GetGeneration() + 1)
+	if session.IsPrivate() {
+		dict.UnsuppressSession(oldctid)
+		dict.SuppressSession(ctid)
+	}
+	insertSessionTable(ctid, session)
+}
+
+// migrateAttachments copies the attachments of a dying session that the
+// session doesn't have yet and returns the number copied
+func migrateAttachments(from *Session, to *Session) int {
+	var count int
+
+	source := make(map[string]interface{})
+	attachments := from.LockAttachments()
+	for name, value := range attachments {
+		source[name] = value
+	}
+	from.UnlockAttachments()
+
+	target := to.LockAttachments()
+	for name, value := range source {
+		if _, found := target[name]; !found {
+			target[name] = value
+			count++
+		}
+	}
+	to.UnlockAttachments()
+
+	return count
+}
+
+// countMismatch counts a conntrack NEW event for a ctid that had a session with another tuple
+func countMismatch(ctid uint32, session *Session, tuple Tuple) {
+	atomic.AddUint64(&conflictMismatched, 1)
+	overseer.AddCounter("session_ctid_mismatch", 1)
+	publishSessionConflict(conflictMismatch, ctid, session.GetGeneration(), session.GetClientSideTuple(), tuple, 0)
+}
+
+// cleanUnconfirmed removes the sessions that have been confirmed, removed
+// from the session table, or idle longer than an unconfirmed session is kept
+func cleanUnconfirmed() {
+	now := time.Now()
+
+	unconfirmedLocker.Lock()
+	defer unconfirmedLocker.Unlock()
+
+	for key, list := range unconfirmedTable {
+		var keep []*Session
+		for _, session := range list {
+			if session.GetConntrackConfirmed() || findSession(session.GetConntrackID()) != session {
+				continue
+			}
+			if now.Sub(session.GetLastActivity()) > 60*time.Second {
+				continue
+			}
+			keep = append(keep, session)
+		}
+		if len(keep) == 0 {
+			delete(unconfirmedTable, key)
+		} else {
+			unconfirmedTable[key] = keep
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package dispatch
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// A mid-session packet belongs to a flow we never saw start, which happens
+// after a restart, when conntrack picks up a flow in the middle, or when the
+// other direction of the flow is routed through another box. By default these
+// are bypassed as before, but the settings can instead track them as degraded
+// sessions that the subscribers see as new, or drop them. RST and FIN packets
+// are always bypassed since they are common when a flow ends. When reconstruct
+// is enabled a tracked session is built from the conntrack entry if there is
+// one, which has the real direction and start time of the flow. The recent
+// mid-session flows are kept for the status since asymmetric routing shows up
+// as a steady stream of them.
+
+// the mid-session actions in the settings
+const (
+	MidSessionBypass = "bypass"
+	MidSessionTrack  = "track"
+	MidSessionDrop   = "drop"
+)
+
+// the attachment that marks a session tracked from the middle
+const midSessionAttachment = "mid_session"
+
+// the number of recent mid-session flows kept for the status
+const maxMidSessionRecent = 50
+
+// MidSessionConfig holds the mid-session packet settings
+type MidSessionConfig struct {
+	Action      string `json:"action"`
+	Reconstruct bool   `json:"reconstruct"`
+}
+
+// MidSessionFlow holds a recent mid-session flow and what was done with it
+type MidSessionFlow struct {
+	Time          time.Time `json:"time"`
+	Tuple         string    `json:"tuple"`
+	Action        string    `json:"action"`
+	Reconstructed bool      `json:"reconstructed"`
+}
+
+// MidSessionStatus holds the mid-session settings, the counters, and the recent flows
+type MidSessionStatus struct {
+	Config        MidSessionConfig `json:"config"`
+	Bypassed      uint64           `json:"bypassed"`
+	Tracked       uint64           `json:"tracked"`
+	Dropped       uint64           `json:"dropped"`
+	Reconstructed uint64           `json:"reconstructed"`
+	Recent        []MidSessionFlow `json:"recent"`
+}
+
+var midSessionConfig atomic.Value
+var midSessionBypassed uint64
+var midSessionTracked uint64
+var midSessionDropped uint64
+var midSessionReconstructed uint64
+var midSessionRecent []MidSessionFlow
+var midSessionLocker sync.Mutex
+
+// loadMidSession loads the mid-session packet settings
+func loadMidSession() {
+	config := MidSessionConfig{Action: MidSessionBypass}
+
+	midJSON, err := settings.GetCurrentSettings([]string{"dispatch", "midSession"})
+	if midJSON != nil && err == nil {
+		item, ok := midJSON.(map[string]interface{})
+		if ok {
+			if value, ok := item["action"].(string); ok {
+				switch value {
+				case MidSessionBypass, MidSessionTrack, MidSessionDrop:
+					config.Action = value
+				default:
+					logger.Warn("Invalid mid-session action: %s\n", value)
+				}
+			}
+			if value, ok := item["reconstruct"].(bool); ok {
+				config.Reconstruct = value
+			}
+		} else {
+			logger.Warn("Invalid mid-session settings: %T\n", midJSON)
+		}
+	}
+
+	midSessionConfig.Store(config)
+	logger.Info("Loaded mid-session handling action:%s reconstruct:%v\n", config.Action, config.Reconstruct)
+}
+
+// GetMidSessionStatus returns the mid-session settings, the counters, and the recent flows
+func GetMidSessionStatus() MidSessionStatus {
+	status := MidSessionStatus{
+		Bypassed:      atomic.LoadUint64(&midSessionBypassed),
+		Tracked:       atomic.LoadUint64(&midSessionTracked),
+		Dropped:       atomic.LoadUint64(&midSessionDropped),
+		Reconstructed: atomic.LoadUint64(&midSessionReconstructed),
+	}
+	status.Config, _ = midSessionConfig.Load().(MidSessionConfig)
+
+	midSessionLocker.Lock()
+	status.Recent = make([]MidSessionFlow, len(midSessionRecent))
+	copy(status.Recent, midSessionRecent)
+	midSessionLocker.Unlock()
+
+	return status
+}
+
+// handleMidSession applies the mid-session action to a packet for an unknown
+// session that isn't new. It returns the session to pass to the subscribers
+// when the packet is tracked, or nil and the verdict for the packet.
+func handleMidSession(mess NfqueueMessage, ctid uint32) (*Session, int) {
+	if mess.TCPLayer != nil && mess.TCPLayer.RST {
+		logger.Debug("Ignoring mid-session RST packet: %s %d\n", mess.MsgTuple, ctid)
+		dict.AddSessionEntry(ctid, "bypass_packetd", true)
+		return nil, NfAccept
+	}
+	if mess.TCPLayer != nil && mess.TCPLayer.FIN {
+		logger.Debug("Ignoring mid-session FIN packet: %s %d\n", mess.MsgTuple, ctid)
+		dict.AddSessionEntry(ctid, "bypass_packetd", true)
+		return nil, NfAccept
+	}
+
+	config, _ := midSessionConfig.Load().(MidSessionConfig)
+
+	switch config.Action {
+	case MidSessionDrop:
+		atomic.AddUint64(&midSessionDropped, 1)
+		overseer.AddCounter("mid_session_drop", 1)
+		logger.Debug("Dropping mid-session packet: %s %d\n", mess.MsgTuple, ctid)
+		addMidSessionFlow(mess.MsgTuple, config.Action, false)
+		return nil, NfDrop
+	case MidSessionTrack:
+		session := createSession(mess, ctid)
+		reconstructed := config.Reconstruct && reconstructSession(session, ctid)
+		session.PutAttachment(midSessionAttachment, true)
+		atomic.AddUint64(&midSessionTracked, 1)
+		overseer.AddCounter("mid_session_track", 1)
+		logger.Info("Tracking mid-session packet: %s %d reconstructed:%v\n", mess.MsgTuple, ctid, reconstructed)
+		addMidSessionFlow(session.GetClientSideTuple(), config.Action, reconstructed)
+		return session, NfAccept
+	}
+
+	atomic.AddUint64(&midSessionBypassed, 1)
+	overseer.AddCounter("mid_session_bypass", 1)
+	logger.Info("Ignoring mid-session packet: %s %d\n", mess.MsgTuple, ctid)
+	addMidSessionFlow(mess.MsgTuple, config.Action, false)
+	dict.AddSessionEntry(ctid, "bypass_packetd", true)
+	return nil, NfAccept
+}
+
+// reconstructSession fills in a session tracked from the middle using the
+// conntrack entry for the flow and links the two so the session is reported
+// and ended like any other. It returns false if there is no conntrack entry.
+func reconstructSession(session *Session, ctid uint32) bool {
+	conntrack, found := findConntrack(ctid)
+	if !found || conntrack == nil {
+		return false
+	}
+
+	conntrack.Guardian.Lock()
+	session.SetClientSideTuple(conntrack.ClientSideTuple)
+	session.SetServerSideTuple(conntrack.ServerSideTuple)
+	if !conntrack.CreationTime.IsZero() {
+		session.SetCreationTime(conntrack.CreationTime)
+	}
+	session.SetServerInterfaceID(uint8((conntrack.ConnMark & 0x0000FF00) >> 8))
+	session.SetServerInterfaceType(uint8((conntrack.ConnMark & 0x0C000000) >> 26))
+	session.SetConntrackConfirmed(true)
+	session.SetConntrackPointer(conntrack)
+	conntrack.Session = session
+	conntrack.SessionID = session.GetSessionID()
+	conntrack.Guardian.Unlock()
+
+	atomic.AddUint64(&midSessionReconstructed, 1)
+	overseer.AddCounter("mid_session_reconstruct", 1)
+	return true
+}
+
+// addMidSessionFlow adds a flow to the recent mid-session flows. Dropped
+// flows keep sending packets so a repeat of the last flow is only counted.
+func addMidSessionFlow(tuple Tuple, action string, reconstructed bool) {
+	flow := MidSessionFlow{Time: time.Now(), Tuple: tuple.String(), Action: action, Reconstructed: reconstructed}
+
+	midSessionLocker.Lock()
+	if count := len(midSessionRecent); count != 0 && midSessionRecent[count-1].Tuple == flow.Tuple && midSessionRecent[count-1].Action == flow.Action {
+		midSessionLocker.Unlock()
+		return
+	}
+	midSessionRecent = append(midSessionRecent, flow)
+	if len(midSessionRecent) > maxMidSessionRecent {
+		midSessionRecent = midSessionRecent[len(midSessionRecent)-maxMidSessionRecent:]
+	}
+	midSessionLocker.Unlock()
+}
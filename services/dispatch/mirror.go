@@ -0,0 +1,418 @@
+package dispatch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the session attachment that holds the name of the mirror target
+const mirrorAttachment = "policy_mirror"
+
+// The mirror target types
+const (
+	MirrorVXLAN     = "vxlan"
+	MirrorERSPAN    = "erspan"
+	MirrorInterface = "interface"
+)
+
+// the default VXLAN destination port
+const defaultVXLANPort = 4789
+
+// the ethertypes used for the ethernet header and the ERSPAN type II encapsulation
+const (
+	etherTypeIPv4   = 0x0800
+	etherTypeIPv6   = 0x86DD
+	etherTypeERSPAN = 0x88BE
+)
+
+// the locally administered addresses used for the ethernet header of the mirrored
+// packets since the real addresses are not known once the packet reaches nfqueue
+var mirrorSourceMAC = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+var mirrorDestinationMAC = []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+
+// MirrorTarget holds a mirror destination from the settings. The packets of
+// sessions that match a policy rule with the mirror action are copied to the
+// target named in the rule. A VXLAN or ERSPAN target sends the packets to a
+// remote analysis host, and an interface target writes them to a local
+// interface. Every packet of a mirrored session goes through userspace, so a
+// non-zero MaxPackets releases the session after that many packets.
+type MirrorTarget struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Address    string `json:"address,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	VNI        uint32 `json:"vni,omitempty"`
+	SessionID  uint16 `json:"sessionId,omitempty"`
+	Interface  string `json:"interface,omitempty"`
+	MaxPackets uint64 `json:"maxPackets"`
+}
+
+// MirrorTargetStatus holds a mirror target and the counters
+type MirrorTargetStatus struct {
+	MirrorTarget
+	Sessions  uint64 `json:"sessions"`
+	Packets   uint64 `json:"packets"`
+	Bytes     uint64 `json:"bytes"`
+	Errors    uint64 `json:"errors"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// mirrorSender sends a mirrored packet to a target
+type mirrorSender interface {
+	send(packet []byte) error
+	close()
+}
+
+// mirrorTarget holds a mirror target with the sender and the counters
+type mirrorTarget struct {
+	config    MirrorTarget
+	sender    mirrorSender
+	sessions  uint64
+	packets   uint64
+	bytes     uint64
+	errors    uint64
+	mutex     sync.Mutex
+	lastError string
+}
+
+var mirrorTable = make(map[string]*mirrorTarget)
+var mirrorLocker sync.RWMutex
+
+// loadMirror loads the mirror targets from the settings and opens the senders.
+// The senders of the previous targets are closed once the new ones are in place.
+func loadMirror() {
+	fresh := make(map[string]*mirrorTarget)
+
+	mirrorJSON, err := settings.GetCurrentSettings([]string{"dispatch", "mirror"})
+	if mirrorJSON != nil && err == nil {
+		item, ok := mirrorJSON.(map[string]interface{})
+		if ok {
+			for _, problem := range compileMirror(fresh, item) {
+				logger.Warn("Ignoring invalid mirror %v\n", problem)
+			}
+		} else {
+			logger.Warn("Invalid mirror settings: %T\n", mirrorJSON)
+		}
+	}
+
+	mirrorLocker.Lock()
+	previous := mirrorTable
+	mirrorTable = fresh
+	mirrorLocker.Unlock()
+
+	for _, target := range previous {
+		target.sender.close()
+	}
+
+	logger.Info("Loaded %d mirror targets\n", len(fresh))
+}
+
+// compileMirror parses the mirror targets from the settings and opens the
+// senders. Invalid targets are skipped and returned as errors.
+func compileMirror(fresh map[string]*mirrorTarget, item map[string]interface{}) []error {
+	var problems []error
+
+	targetSlice, _ := item["targets"].([]interface{})
+	for index, value := range targetSlice {
+		config, err := parseMirrorTarget(value)
+		if err == nil && fresh[config.Name] != nil {
+			err = fmt.Errorf("duplicate name %s", config.Name)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("target %d: %v", index, err))
+			continue
+		}
+
+		sender, err := openMirrorSender(config)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("target %s: %v", config.Name, err))
+			continue
+		}
+
+		logger.Info("Mirror target %s type:%s address:%s interface:%s\n", config.Name, config.Type, config.Address, config.Interface)
+		fresh[config.Name] = &mirrorTarget{config: config, sender: sender}
+	}
+
+	return problems
+}
+
+// parseMirrorTarget returns the mirror target from a settings object
+func parseMirrorTarget(value interface{}) (MirrorTarget, error) {
+	var config MirrorTarget
+
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return config, fmt.Errorf("not an object")
+	}
+
+	config.Name, _ = item["name"].(string)
+	config.Type, _ = item["type"].(string)
+	config.Address, _ = item["address"].(string)
+	config.Interface, _ = item["interface"].(string)
+	if number, ok := item["port"].(float64); ok {
+		config.Port = int(number)
+	}
+	if number, ok := item["vni"].(float64); ok {
+		config.VNI = uint32(number)
+	}
+	if number, ok := item["sessionId"].(float64); ok {
+		config.SessionID = uint16(number)
+	}
+	if number, ok := item["maxPackets"].(float64); ok && number > 0 {
+		config.MaxPackets = uint64(number)
+	}
+
+	if config.Name == "" {
+		return config, fmt.Errorf("missing name")
+	}
+
+	switch config.Type {
+	case MirrorVXLAN:
+		if config.Port == 0 {
+			config.Port = defaultVXLANPort
+		}
+		if config.Port < 1 || config.Port > 65535 {
+			return config, fmt.Errorf("invalid port: %d", config.Port)
+		}
+		if config.VNI > 0xFFFFFF {
+			return config, fmt.Errorf("invalid vni: %d", config.VNI)
+		}
+		if net.ParseIP(config.Address) == nil {
+			return config, fmt.Errorf("invalid address: %s", config.Address)
+		}
+	case MirrorERSPAN:
+		if net.ParseIP(config.Address) == nil {
+			return config, fmt.Errorf("invalid address: %s", config.Address)
+		}
+		// the ERSPAN session id is only 10 bits
+		if config.SessionID > 0x3FF {
+			return config, fmt.Errorf("invalid session id: %d", config.SessionID)
+		}
+	case MirrorInterface:
+		if config.Interface == "" {
+			return config, fmt.Errorf("missing interface")
+		}
+	default:
+		return config, fmt.Errorf("invalid type: %s", config.Type)
+	}
+
+	return config, nil
+}
+
+// startMirror attaches the named mirror target to a session that matched a
+// policy rule with the mirror action and mirrors the current packet. Returns
+// true if the session is being mirrored.
+func startMirror(mess NfqueueMessage, ctid uint32, name string) bool {
+	session := mess.Session
+	if session.IsPrivate() || session.GetAttachment(mirrorAttachment) != nil {
+		return false
+	}
+
+	mirrorLocker.RLock()
+	target := mirrorTable[name]
+	mirrorLocker.RUnlock()
+	if target == nil {
+		logger.Warn("%OC|Unknown mirror target %s\n", "mirror_unknown_target", 10, name)
+		return false
+	}
+
+	logger.Debug("Mirroring session to %s ctid:%d\n", name, ctid)
+	atomic.AddUint64(&target.sessions, 1)
+	session.PutAttachment(mirrorAttachment, name)
+	return mirrorPacket(mess)
+}
+
+// mirrorPacket copies the current packet of a mirrored session to the target
+// and returns true while the session should stay in nfqueue to be mirrored
+func mirrorPacket(mess NfqueueMessage) bool {
+	name, ok := mess.Session.GetAttachment(mirrorAttachment).(string)
+	if !ok {
+		return false
+	}
+
+	mirrorLocker.RLock()
+	target := mirrorTable[name]
+	mirrorLocker.RUnlock()
+	if target == nil {
+		return false
+	}
+
+	count := mess.Session.GetPacketCount()
+	if target.config.MaxPackets != 0 && count > target.config.MaxPackets {
+		return false
+	}
+
+	err := target.sender.send(mess.Data)
+	if err != nil {
+		atomic.AddUint64(&target.errors, 1)
+		target.mutex.Lock()
+		target.lastError = err.Error()
+		target.mutex.Unlock()
+		logger.Warn("%OC|Unable to mirror packet to %s: %v\n", "mirror_send_failure", 10, name, err)
+	} else {
+		atomic.AddUint64(&target.packets, 1)
+		atomic.AddUint64(&target.bytes, uint64(len(mess.Data)))
+	}
+
+	return target.config.MaxPackets == 0 || count < target.config.MaxPackets
+}
+
+// GetMirrorStatus returns the mirror targets and the counters ordered by name
+func GetMirrorStatus() []MirrorTargetStatus {
+	status := []MirrorTargetStatus{}
+
+	mirrorLocker.RLock()
+	for _, target := range mirrorTable {
+		item := MirrorTargetStatus{MirrorTarget: target.config}
+		item.Sessions = atomic.LoadUint64(&target.sessions)
+		item.Packets = atomic.LoadUint64(&target.packets)
+		item.Bytes = atomic.LoadUint64(&target.bytes)
+		item.Errors = atomic.LoadUint64(&target.errors)
+		target.mutex.Lock()
+		item.LastError = target.lastError
+		target.mutex.Unlock()
+		status = append(status, item)
+	}
+	mirrorLocker.RUnlock()
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return status
+}
+
+// openMirrorSender returns the sender for a mirror target
+func openMirrorSender(config MirrorTarget) (mirrorSender, error) {
+	switch config.Type {
+	case MirrorVXLAN:
+		conn, err := net.Dial("udp", net.JoinHostPort(config.Address, fmt.Sprintf("%d", config.Port)))
+		if err != nil {
+			return nil, err
+		}
+		return &vxlanSender{conn: conn, vni: config.VNI}, nil
+	case MirrorERSPAN:
+		network := "ip6:47"
+		if net.ParseIP(config.Address).To4() != nil {
+			network = "ip4:47"
+		}
+		conn, err := net.Dial(network, config.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &erspanSender{conn: conn, sessionID: config.SessionID}, nil
+	case MirrorInterface:
+		device, err := net.InterfaceByName(config.Interface)
+		if err != nil {
+			return nil, err
+		}
+		// a zero protocol gives a socket that only sends
+		socket, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &interfaceSender{socket: socket, address: &syscall.SockaddrLinklayer{Ifindex: device.Index}}, nil
+	}
+
+	return nil, fmt.Errorf("invalid type: %s", config.Type)
+}
+
+// vxlanSender sends the packets in an ethernet frame with a VXLAN header over UDP
+type vxlanSender struct {
+	conn net.Conn
+	vni  uint32
+}
+
+func (sender *vxlanSender) send(packet []byte) error {
+	// the I flag says the VNI is valid and the VNI is in the top 24 bits of the second word
+	header := make([]byte, 8, 8+14+len(packet))
+	header[0] = 0x08
+	binary.BigEndian.PutUint32(header[4:], sender.vni<<8)
+
+	_, err := sender.conn.Write(appendEthernetFrame(header, packet))
+	return err
+}
+
+func (sender *vxlanSender) close() {
+	sender.conn.Close()
+}
+
+// erspanSender sends the packets in an ethernet frame with a GRE and ERSPAN type II header
+type erspanSender struct {
+	conn      net.Conn
+	sessionID uint16
+	sequence  uint32
+	mutex     sync.Mutex
+}
+
+func (sender *erspanSender) send(packet []byte) error {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	// the GRE header has the sequence number present flag and the ERSPAN
+	// protocol, and the ERSPAN header has version 1 and the session id
+	header := make([]byte, 16, 16+14+len(packet))
+	binary.BigEndian.PutUint16(header[0:], 0x1000)
+	binary.BigEndian.PutUint16(header[2:], etherTypeERSPAN)
+	binary.BigEndian.PutUint32(header[4:], sender.sequence)
+	binary.BigEndian.PutUint16(header[8:], 0x1000)
+	binary.BigEndian.PutUint16(header[10:], sender.sessionID&0x3FF)
+	sender.sequence++
+
+	_, err := sender.conn.Write(appendEthernetFrame(header, packet))
+	return err
+}
+
+func (sender *erspanSender) close() {
+	sender.conn.Close()
+}
+
+// interfaceSender writes the packets in an ethernet frame to a local interface
+type interfaceSender struct {
+	socket  int
+	address *syscall.SockaddrLinklayer
+	closed  bool
+	mutex   sync.Mutex
+}
+
+func (sender *interfaceSender) send(packet []byte) error {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	// the socket descriptor could be reused once closed so we check under the lock
+	if sender.closed {
+		return fmt.Errorf("sender closed")
+	}
+	return syscall.Sendto(sender.socket, appendEthernetFrame(make([]byte, 0, 14+len(packet)), packet), 0, sender.address)
+}
+
+func (sender *interfaceSender) close() {
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+
+	if !sender.closed {
+		syscall.Close(sender.socket)
+		sender.closed = true
+	}
+}
+
+// appendEthernetFrame appends an ethernet header and the IP packet to the
+// buffer, using the IP version of the packet for the ethertype
+func appendEthernetFrame(buffer []byte, packet []byte) []byte {
+	etherType := uint16(etherTypeIPv4)
+	if len(packet) != 0 && packet[0]>>4 == 6 {
+		etherType = etherTypeIPv6
+	}
+
+	buffer = append(buffer, mirrorDestinationMAC...)
+	buffer = append(buffer, mirrorSourceMAC...)
+	buffer = append(buffer, byte(etherType>>8), byte(etherType))
+	return append(buffer, packet...)
+}
@@ -67,6 +67,7 @@ func netloggerCallback(version uint8,
 			logger.Debug("Calling netlogger APP:%s PRIORITY:%d\n", key, priority)
 			wg.Add(1)
 			go func(val SubscriptionHolder) {
+				defer reportPanic("netlogger", val.Owner)
 				val.NetloggerFunc(&netlogger)
 				wg.Done()
 				logger.Debug("Finished netlogger APP:%s PRIORITY:%d\n", key, priority)
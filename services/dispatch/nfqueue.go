@@ -2,12 +2,16 @@ package dispatch
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/faults"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/supervisor"
+	"github.com/untangle/packetd/services/zones"
 )
 
 // maxAllowedTime is the maximum time a plugin is allowed to process a packet.
@@ -24,13 +28,17 @@ const NfAccept = 1
 //NfqueueHandlerFunction defines a pointer to a nfqueue callback function
 type NfqueueHandlerFunction func(NfqueueMessage, uint32, bool) NfqueueResult
 
-// NfqueueMessage is used to pass nfqueue traffic to interested plugins
+// NfqueueMessage is used to pass nfqueue traffic to interested plugins. The
+// Data and the layers point at the packet buffer and the pooled decoder, so
+// they must not be used after the handler returns.
 type NfqueueMessage struct {
 	Session        *Session
 	MsgTuple       Tuple
 	Family         int
-	Packet         gopacket.Packet
+	Data           []byte
 	PacketMark     uint32
+	InterfaceIndex uint32
+	VlanID         uint16
 	Length         int
 	ClientToServer bool
 	IP4Layer       *layers.IPv4
@@ -39,19 +47,28 @@ type NfqueueMessage struct {
 	UDPLayer       *layers.UDP
 	ICMPv4Layer    *layers.ICMPv4
 	Payload        []byte
+	decoder        *packetDecoder
 }
 
 // NfqueueResult returns status and other information from a subscription handler function
 type NfqueueResult struct {
 	SessionRelease bool
+	PacketDrop     bool
 }
 
 // subscriberResult returns status and other information from a subscription handler function
 type subscriberResult struct {
 	owner          string
 	sessionRelease bool
+	packetDrop     bool
 }
 
+// packetsInFlight is the number of packets being passed to the subscribers and
+// lastPacketBeat is the second the last one got through, which are used for
+// the nfqueue heartbeat
+var packetsInFlight int32
+var lastPacketBeat int64
+
 // ReleaseSession is called by a subscriber to stop receiving traffic for a session
 func ReleaseSession(session *Session, owner string) {
 	session.subLocker.Lock()
@@ -73,90 +90,121 @@ func ReleaseSession(session *Session, owner string) {
 
 // nfqueueCallback is the callback for the packet
 // return the mark to set on the packet
-func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetLength int, pmark uint32) int {
+func nfqueueCallback(ctid uint32, family uint32, data []byte, pmark uint32, indev uint32, vlanid uint16) int {
 	var mess NfqueueMessage
 	//printSessionTable()
 
 	mess.Family = int(family)
-	mess.Packet = packet
 	mess.PacketMark = pmark
-	mess.Length = packetLength
+	mess.InterfaceIndex = indev
+	mess.VlanID = vlanid
+	mess.Length = len(data)
+
+	// decode the IPv4 or IPv6 and the TCP or UDP layers using a pooled decoder
+	decoder := getPacketDecoder()
+	if !decoder.decode(data, &mess) {
+		putPacketDecoder(decoder)
+		return NfAccept
+	}
 
-	// get the IPv4 and IPv6 layers
-	ip4Layer := mess.Packet.Layer(layers.LayerTypeIPv4)
-	ip6Layer := mess.Packet.Layer(layers.LayerTypeIPv6)
+	atomic.AddInt32(&packetsInFlight, 1)
+	verdict, finished := handleNfqueueMessage(ctid, mess, pmark)
+	atomic.AddInt32(&packetsInFlight, -1)
+	packetBeat()
+
+	// a subscriber that timed out may still be using the decoder and the copy
+	// of the packet data it holds, so we leave it for the garbage collector
+	if finished {
+		putPacketDecoder(decoder)
+	}
 
-	if ip4Layer != nil {
-		mess.IP4Layer = ip4Layer.(*layers.IPv4)
+	return verdict
+}
+
+// packetBeat records that a packet made it through the subscribers with the
+// supervisor. The heartbeat is only updated once a second to keep the lock of
+// the supervisor off the packet path.
+func packetBeat() {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&lastPacketBeat)
+	if now != last && atomic.CompareAndSwapInt64(&lastPacketBeat, last, now) {
+		supervisor.Beat("nfqueue")
+	}
+}
+
+// handleNfqueueMessage finds or creates the session for a decoded packet and
+// passes it to the subscribers. It returns the verdict and false if any of the
+// subscribers did not finish with the packet.
+func handleNfqueueMessage(ctid uint32, mess NfqueueMessage, pmark uint32) (int, bool) {
+	if mess.IP4Layer != nil {
 		mess.MsgTuple.Protocol = uint8(mess.IP4Layer.Protocol)
 		mess.MsgTuple.ClientAddress = dupIP(mess.IP4Layer.SrcIP)
 		mess.MsgTuple.ServerAddress = dupIP(mess.IP4Layer.DstIP)
-	} else if ip6Layer != nil {
-		mess.IP6Layer = ip6Layer.(*layers.IPv6)
+	} else {
 		mess.MsgTuple.Protocol = uint8(mess.IP6Layer.NextHeader)
 		mess.MsgTuple.ClientAddress = dupIP(mess.IP6Layer.SrcIP)
 		mess.MsgTuple.ServerAddress = dupIP(mess.IP6Layer.DstIP)
-	} else {
-		return NfAccept
 	}
 
 	// we shouldn't be queueing loopback packets
 	// if we catch one throw a warning
 	if mess.MsgTuple.ClientAddress.IsLoopback() || mess.MsgTuple.ServerAddress.IsLoopback() {
 		logger.Warn("nfqueue event for loopback packet: %v\n", mess.MsgTuple)
-		return NfAccept
+		return NfAccept, true
 	}
 
 	newSession := ((pmark & 0x10000000) != 0)
 
-	// get the TCP layer
-	tcpLayer := mess.Packet.Layer(layers.LayerTypeTCP)
-	if tcpLayer != nil {
-		mess.TCPLayer = tcpLayer.(*layers.TCP)
+	if mess.TCPLayer != nil {
 		mess.MsgTuple.ClientPort = uint16(mess.TCPLayer.SrcPort)
 		mess.MsgTuple.ServerPort = uint16(mess.TCPLayer.DstPort)
 	}
 
-	// get the UDP layer
-	udpLayer := mess.Packet.Layer(layers.LayerTypeUDP)
-	if udpLayer != nil {
-		mess.UDPLayer = udpLayer.(*layers.UDP)
+	if mess.UDPLayer != nil {
 		mess.MsgTuple.ClientPort = uint16(mess.UDPLayer.SrcPort)
 		mess.MsgTuple.ServerPort = uint16(mess.UDPLayer.DstPort)
 	}
 
-	// get the Application layer
-	appLayer := mess.Packet.ApplicationLayer()
-	if appLayer != nil {
-		mess.Payload = appLayer.Payload()
-	}
-
 	if logger.IsTraceEnabled() {
 		logger.Trace("nfqueue event[%d]: %v 0x%08x\n", ctid, mess.MsgTuple, pmark)
 	}
 
+	// the trace is nil unless a dispatch trace is running
+	trace := beginPacketTrace(ctid, &mess, newSession)
+
 	session := findSession(ctid)
 
+	// a session adopted from another appliance or tracked from the middle is
+	// new to the subscribers even though the flow started before this packet
+	recovered := false
+
 	if session == nil {
-		if !newSession {
+		// a packet that belongs to a session tracked by another appliance is adopted
+		// before it can be treated as a stray or as a session in the wrong direction
+		remote := findRemoteSession(mess.MsgTuple)
+		if remote != nil {
+			trace.setLookup("remote")
+			session = adoptRemoteSession(mess, ctid, remote)
+			recovered = true
+		} else if !newSession {
 			// If we did not find the session in the session table, and this isn't a new packet
-			// Then we somehow missed the first packet - Just mark the connection as bypassed
-			// and return the packet
-			// This is common in a few scenarios, so just log those as debug statements
-			if mess.TCPLayer != nil && mess.TCPLayer.RST {
-				logger.Debug("Ignoring mid-session RST packet: %s %d\n", mess.MsgTuple, ctid)
-			} else if mess.TCPLayer != nil && mess.TCPLayer.FIN {
-				logger.Debug("Ignoring mid-session FIN packet: %s %d\n", mess.MsgTuple, ctid)
-			} else {
-				logger.Info("Ignoring mid-session packet: %s %d\n", mess.MsgTuple, ctid)
+			// Then we somehow missed the first packet - the mid-session settings decide if
+			// the connection is bypassed, tracked, or dropped
+			var verdict int
+			trace.setLookup("midsession")
+			session, verdict = handleMidSession(mess, ctid)
+			if session == nil {
+				trace.finish("midsession", verdict)
+				return verdict, true
 			}
-
-			dict.AddSessionEntry(ctid, "bypass_packetd", true)
-			return NfAccept
+			recovered = true
+		} else {
+			trace.setLookup("created")
+			session = createSession(mess, ctid)
 		}
-		session = createSession(mess, ctid)
 		mess.Session = session
 	} else {
+		trace.setLookup("found")
 		if newSession {
 			if mess.MsgTuple.Equal(session.GetClientSideTuple()) {
 				// netfilter considers this a "new" session, but the tuple is identical.
@@ -182,8 +230,8 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 				logger.Debug("Conflicting session [%d] %v != %v\n", ctid, mess.MsgTuple, session.GetClientSideTuple())
 				// We don't need to flush here - this is a new session its already been flushed
 				// session.flushDict()
-				session.removeFromSessionTable()
-				session = createSession(mess, ctid)
+				trace.setLookup("replaced")
+				session = replaceSession(session, mess, ctid)
 				mess.Session = session
 			}
 		}
@@ -199,7 +247,7 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 	// Sanity check - if this is a new session we should not have an existing conntrack entry (yet)
 	// This does occur under normal circumstatnces when a ctid gets reused, and we get an
 	// nfqueue event for the new session (same ctid) before we get the conntrack delete event
-	if newSession {
+	if newSession && !recovered {
 		conntrack, _ := findConntrack(ctid)
 		if conntrack != nil {
 			logger.Debug("Found existing conntrack (ctid: %v) for new session:\n", ctid)
@@ -216,12 +264,31 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 		mess.ClientToServer = false
 	}
 
-	// if this is a new session set the client side interface index and type
+	// if this is a new session set the client side interface index, type, VLAN, and zone
+	// using the zone of the client interface unless a zone matches the VLAN or bridge.
+	// A recovered session is new to the subscribers but its first packet may be a reply.
+	if recovered {
+		newSession = true
+	}
 	if newSession {
-		session.SetClientInterfaceID(uint8((pmark & 0x000000FF)))
-		session.SetClientInterfaceType(uint8((pmark & 0x03000000) >> 24))
+		if mess.ClientToServer {
+			session.SetClientInterfaceID(uint8((pmark & 0x000000FF)))
+			session.SetClientInterfaceType(uint8((pmark & 0x03000000) >> 24))
+			vlanid, zone := zones.FindPacketZone(mess.InterfaceIndex, mess.VlanID)
+			if zone == "" {
+				zone = zones.GetInterfaceZone(int(session.GetClientInterfaceID()))
+			}
+			session.SetVlanID(vlanid)
+			session.SetClientZone(zone)
+		}
+		checkPrivacy(session, true)
+		publishSessionNew(session)
+	} else {
+		checkPrivacy(session, false)
 	}
 
+	trace.setSession(session, mess, newSession)
+
 	// if this is a server-to-client packet and the server interface info is not
 	// set yet, we can set it now (normally this is set during the conntrack new event)
 	// but in some cases we get the response packet first
@@ -231,25 +298,43 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 	}
 
 	// Update some accounting bits
-	session.SetLastActivity(time.Now())
-	session.AddPacketCount(1)
-	session.AddByteCount(uint64(mess.Length))
-	session.AddEventCount(1)
+	packetcount := session.accountPacket(uint64(mess.Length), time.Now())
 
 	// If we've processed this many packets without all the plugins releasing
 	// there is likely an issue. Only warn at "== X" packet count
 	// to avoid flooding logs with a "> X" condition
-	packetcount := session.GetPacketCount()
 	if packetcount == 100 || packetcount == 200 {
 		logger.Warn("Deep session scan. %v ctid:%v Packets:%v Bytes:%v Subscribers:%v Age:%v\n", session.GetClientSideTuple(), ctid, session.GetPacketCount(), session.GetByteCount(), session.subscriptions, time.Since(session.GetCreationTime()))
 	}
 
-	return callSubscribers(ctid, session, mess, pmark, newSession)
+	// when we are short on memory we stop looking at sessions after a few packets
+	if packetcount > shedBypassPackets && GetShedLevel() >= ShedBypass {
+		overseer.AddCounter("shed_session_bypass", 1)
+		dict.AddSessionEntry(ctid, "bypass_packetd", true)
+		trace.finish("shed_bypass", NfAccept)
+		return NfAccept, true
+	}
+
+	// large transfers are bypassed once they pass the elephant flow threshold
+	if checkElephantFlow(session, packetcount) {
+		trace.finish("elephant_bypass", NfAccept)
+		return NfAccept, true
+	}
+
+	// the subscribers never see the payload of a private session
+	if session.IsPrivate() {
+		overseer.AddCounter("privacy_packets", 1)
+		maskPayload(&mess)
+	}
+
+	verdict, finished := callSubscribers(ctid, session, mess, pmark, newSession, trace)
+	trace.finish("subscribers", verdict)
+	return verdict, finished
 }
 
 // callSubscribers calls all the nfqueue message subscribers (plugins)
-// and returns a verdict and the new mark
-func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark uint32, newSession bool) int {
+// and returns the verdict and false if any subscriber timed out
+func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark uint32, newSession bool, trace *packetTrace) (int, bool) {
 	resultsChannel := make(chan subscriberResult)
 
 	// We loop and increment the priority until all subscriptions have been called
@@ -259,11 +344,14 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 	// If there are no subscribers anymore, just release now
 	if subtotal == 0 {
 		dict.AddSessionEntry(session.GetConntrackID(), "bypass_packetd", true)
-		return NfAccept
+		trace.finish("no_subscribers", NfAccept)
+		return NfAccept, true
 	}
 
 	subcount := 0
 	priority := 0
+	verdict := NfAccept
+	var timeoutCount int32
 	var timeMap = make(map[string]float64)
 	var timeMapLock = sync.RWMutex{}
 
@@ -287,23 +375,33 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 				t1 := getMicroseconds()
 
 				go func() {
+					defer reportPanic("nfqueue", key)
+					// an injected error releases the session like a plugin that gave up on it
+					if faults.Inject(faults.PluginHandler, key) != nil {
+						c <- subscriberResult{owner: key, sessionRelease: true}
+						return
+					}
 					result := val.NfqueueFunc(mess, ctid, newSession)
-					c <- subscriberResult{owner: key, sessionRelease: result.SessionRelease}
+					c <- subscriberResult{owner: key, sessionRelease: result.SessionRelease, packetDrop: result.PacketDrop}
 				}()
 
 				select {
 				case result := <-c:
+					trace.addPlugin(TracePlugin{Owner: key, Priority: pri, Duration: float64(getMicroseconds()-t1) / 1000.0, Release: result.sessionRelease, Drop: result.packetDrop})
 					resultsChannel <- result
 					timeoutTimer.Stop()
 				case <-timeoutTimer.C:
 					logger.Err("%OC|Timeout reached while processing nfqueue. plugin:%s\n", "nfqueue_plugin_timeout", 0, key)
-					c <- subscriberResult{owner: key, sessionRelease: true}
+					atomic.AddInt32(&timeoutCount, 1)
+					trace.addPlugin(TracePlugin{Owner: key, Priority: pri, Duration: float64(getMicroseconds()-t1) / 1000.0, Release: true, Timeout: true})
+					resultsChannel <- subscriberResult{owner: key, sessionRelease: true}
 				}
 
 				timediff := (float64(getMicroseconds()-t1) / 1000.0)
 				timeMapLock.Lock()
 				timeMap[val.Owner] = timediff
 				timeMapLock.Unlock()
+				recordBenchmarkTime(true, val.Owner, timediff)
 
 				if logger.IsTraceEnabled() {
 					logger.Trace("Finished nfqueue PLUGIN:%s PRI:%d CTID:%d ms:%.1f\n", key, pri, ctid, timediff)
@@ -321,6 +419,10 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 				if result.sessionRelease {
 					ReleaseSession(session, result.owner)
 				}
+				// any subscriber can ask for the packet to be dropped
+				if result.packetDrop {
+					verdict = NfDrop
+				}
 			}
 		}
 
@@ -338,27 +440,30 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 		timeMapLock.RUnlock()
 	}
 
-	// return the updated mark to be set on the packet
-	return NfAccept
+	// return the verdict for the packet
+	return verdict, atomic.LoadInt32(&timeoutCount) == 0
 }
 
 // createSession creates a new session and inserts the forward mapping
 // into the session table
 func createSession(mess NfqueueMessage, ctid uint32) *Session {
 	session := new(Session)
+	now := time.Now()
 	session.SetSessionID(nextSessionID())
 	session.SetConntrackID(ctid)
-	session.SetCreationTime(time.Now())
+	session.SetCreationTime(now)
 	session.SetPacketCount(1)
 	session.SetByteCount(uint64(mess.Length))
 	session.SetEventCount(1)
-	session.SetLastActivity(time.Now())
+	session.SetLastActivity(now)
 	session.SetClientSideTuple(mess.MsgTuple)
 	session.SetFamily(uint8(mess.Family))
 	session.SetConntrackConfirmed(false)
+	session.setGeneration(1)
 	session.attachments = make(map[string]interface{})
 	AttachNfqueueSubscriptions(session)
 	insertSessionTable(ctid, session)
+	addUnconfirmed(session)
 	return session
 }
 
@@ -0,0 +1,166 @@
+package dispatch
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// InspectorFunction is called while a playback is being debugged with the
+// conntrack ID of the last record played and returns the plugin state for it
+type InspectorFunction func(ctid uint32) interface{}
+
+// PlaybackState describes the position of the warehouse playback and the
+// state of the session for the last record that was played
+type PlaybackState struct {
+	Status      string                 `json:"status"`
+	Paused      bool                   `json:"paused"`
+	Speed       int                    `json:"speed"`
+	Position    uint64                 `json:"position"`
+	Origin      string                 `json:"origin,omitempty"`
+	ConntrackID uint32                 `json:"conntrack_id,omitempty"`
+	Session     *PlaybackSession       `json:"session,omitempty"`
+	Conntrack   bool                   `json:"conntrack"`
+	Inspectors  map[string]interface{} `json:"inspectors,omitempty"`
+}
+
+// PlaybackSession is the dispatch state of a session seen during playback
+type PlaybackSession struct {
+	SessionID     int64             `json:"session_id"`
+	ClientTuple   string            `json:"client_tuple"`
+	ServerTuple   string            `json:"server_tuple"`
+	PacketCount   uint64            `json:"packet_count"`
+	ByteCount     uint64            `json:"byte_count"`
+	Confirmed     bool              `json:"confirmed"`
+	Subscriptions []string          `json:"subscriptions"`
+	Attachments   map[string]string `json:"attachments"`
+}
+
+var inspectorList = make(map[string]InspectorFunction)
+var inspectorMutex sync.Mutex
+
+// InsertInspector adds a function that returns the plugin state for the
+// session of the last record played when a playback is being debugged
+func InsertInspector(owner string, function InspectorFunction) {
+	logger.Info("Adding Inspector (%s)\n", owner)
+
+	inspectorMutex.Lock()
+	inspectorList[owner] = function
+	inspectorMutex.Unlock()
+}
+
+// RemoveInspector removes the inspector function for the argumented owner
+func RemoveInspector(owner string) {
+	inspectorMutex.Lock()
+	delete(inspectorList, owner)
+	inspectorMutex.Unlock()
+}
+
+// PausePlayback pauses or resumes the warehouse playback. Resuming drops any
+// steps that were requested but not yet played.
+func PausePlayback(paused bool) {
+	logger.Info("Setting playback paused:%v\n", paused)
+	kernel.SetWarehousePaused(paused)
+}
+
+// StepPlayback plays the argumented number of records of a paused playback
+func StepPlayback(count int) error {
+	if count <= 0 {
+		return fmt.Errorf("invalid step count %d", count)
+	}
+	if !kernel.GetWarehousePaused() {
+		return fmt.Errorf("playback is not paused")
+	}
+	kernel.StepWarehousePlayback(count)
+	return nil
+}
+
+// SetPlaybackSpeed changes the speed of the warehouse playback. The speed is a
+// percentage of the original capture speed, with zero meaning as fast as possible.
+func SetPlaybackSpeed(speed int) error {
+	if speed < 0 {
+		return fmt.Errorf("invalid playback speed %d", speed)
+	}
+	logger.Info("Setting playback speed:%d\n", speed)
+	kernel.SetWarehouseSpeed(speed)
+	return nil
+}
+
+// GetPlaybackState returns the position of the warehouse playback along with
+// the dispatch and plugin state for the session of the last record played
+func GetPlaybackState() PlaybackState {
+	var state PlaybackState
+
+	switch kernel.GetWarehouseFlag() {
+	case 'I':
+		state.Status = "IDLE"
+	case 'P':
+		state.Status = "PLAYBACK"
+	case 'C':
+		state.Status = "CAPTURE"
+	default:
+		state.Status = "UNKNOWN"
+	}
+
+	state.Paused = kernel.GetWarehousePaused()
+	state.Speed = kernel.GetWarehouseSpeed()
+
+	position, origin, ctid := kernel.GetWarehousePosition()
+	state.Position = position
+	if position == 0 {
+		return state
+	}
+
+	state.Origin = string(rune(origin))
+	state.ConntrackID = ctid
+
+	if sess := findSession(ctid); sess != nil {
+		state.Session = getPlaybackSession(sess)
+	}
+	_, state.Conntrack = findConntrack(ctid)
+
+	inspectorMutex.Lock()
+	defer inspectorMutex.Unlock()
+
+	if len(inspectorList) != 0 {
+		state.Inspectors = make(map[string]interface{})
+		for owner, function := range inspectorList {
+			state.Inspectors[owner] = function(ctid)
+		}
+	}
+
+	return state
+}
+
+// getPlaybackSession returns the dispatch state of a session
+func getPlaybackSession(sess *Session) *PlaybackSession {
+	result := &PlaybackSession{
+		SessionID:     sess.GetSessionID(),
+		ClientTuple:   sess.GetClientSideTuple().String(),
+		ServerTuple:   sess.GetServerSideTuple().String(),
+		PacketCount:   sess.GetPacketCount(),
+		ByteCount:     sess.GetByteCount(),
+		Confirmed:     sess.GetConntrackConfirmed(),
+		Subscriptions: []string{},
+		Attachments:   make(map[string]string),
+	}
+
+	sess.subLocker.Lock()
+	for owner := range sess.subscriptions {
+		result.Subscriptions = append(result.Subscriptions, owner)
+	}
+	sess.subLocker.Unlock()
+	sort.Strings(result.Subscriptions)
+
+	// the attachments can hold anything so we only return them as strings
+	sess.attachmentLock.Lock()
+	for name, value := range sess.attachments {
+		result.Attachments[name] = fmt.Sprintf("%v", value)
+	}
+	sess.attachmentLock.Unlock()
+
+	return result
+}
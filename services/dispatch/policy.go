@@ -0,0 +1,242 @@
+package dispatch
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/inventory"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/policy"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// the session attachments used to track the policy evaluation
+const (
+	policyGenerationAttachment = "policy_generation"
+	policyNextAttachment       = "policy_next"
+	policyDropAttachment       = "policy_drop"
+	policyQuotaAttachment      = "policy_quota"
+)
+
+// policyHandler is the nfqueue subscription that applies the policy engine
+// decisions to sessions. It keeps the session until every rule has been
+// evaluated or the packet limit is reached, so rules can match fields like
+// the classification that aren't known on the first packet.
+func policyHandler(mess NfqueueMessage, ctid uint32, newSession bool) NfqueueResult {
+	var result NfqueueResult
+	result.SessionRelease = true
+
+	session := mess.Session
+	if session == nil || !policy.IsActive() {
+		return result
+	}
+
+	// once a drop decision has been made we drop every packet for the session
+	if session.GetAttachment(policyDropAttachment) != nil {
+		result.SessionRelease = false
+		result.PacketDrop = true
+		return result
+	}
+
+	// mirrored sessions stay in nfqueue until the target packet limit is reached
+	mirrored := mirrorPacket(mess)
+
+	generation, _ := session.GetAttachment(policyGenerationAttachment).(uint64)
+	next, _ := session.GetAttachment(policyNextAttachment).(int)
+	final := session.GetPacketCount() >= policy.GetMaxPackets()
+
+	fields := func(name string) (string, bool) {
+		return GetSessionField(mess, name)
+	}
+
+	decided := policy.Evaluate(generation, next, fields, time.Now(), final)
+	session.PutAttachment(policyGenerationAttachment, decided.Generation)
+	session.PutAttachment(policyNextAttachment, decided.Next)
+
+	for _, decision := range decided.Decisions {
+		if applyPolicyDecision(mess, ctid, decision, &result) {
+			mirrored = true
+		}
+	}
+
+	if (decided.Pending || mirrored) && !result.PacketDrop {
+		result.SessionRelease = false
+	}
+
+	return result
+}
+
+// applyPolicyDecision applies a policy decision to the session and returns
+// true if the session started being mirrored
+func applyPolicyDecision(mess NfqueueMessage, ctid uint32, decision policy.Decision, result *NfqueueResult) bool {
+	var mirrored bool
+	session := mess.Session
+	action := decision.Action
+
+	logger.Debug("Policy rule %s matched ctid:%d action:%s\n", decision.RuleID, ctid, action.Type)
+	overseer.AddCounter("policy_"+action.Type, 1)
+
+	// the bytes are counted against the bucket even when the bucket is over
+	// the limit and the quota action was replaced by the exceeded action
+	if decision.Quota != "" {
+		session.PutAttachment(policyQuotaAttachment, decision.Quota)
+		dict.AddSessionEntry(ctid, "quota_bucket", decision.Quota)
+	}
+
+	switch action.Type {
+	case policy.ActionTag:
+		session.PutAttachment(action.Field, action.Value)
+		dict.AddSessionEntry(ctid, action.Field, action.Value)
+	case policy.ActionPriority:
+		priority, _ := strconv.Atoi(action.Value)
+		session.PutAttachment("priority", priority)
+		dict.AddSessionEntry(ctid, "priority", priority)
+	case policy.ActionBypass:
+		dict.AddSessionEntry(ctid, "bypass_packetd", true)
+	case policy.ActionDrop:
+		session.PutAttachment(policyDropAttachment, decision.RuleID)
+		result.SessionRelease = false
+		result.PacketDrop = true
+	case policy.ActionMirror:
+		mirrored = startMirror(mess, ctid, action.Value)
+	}
+
+	if decision.QuotaExceeded {
+		overseer.AddCounter("policy_quota_exceeded", 1)
+	}
+
+	if decision.QuotaExceeded || action.Type == policy.ActionBypass || action.Type == policy.ActionDrop || action.Type == policy.ActionMirror {
+		logPolicyEvent(mess, decision)
+	}
+
+	return mirrored
+}
+
+// accountPolicyQuota adds the bytes from a conntrack update to the quota
+// bucket of the session if it has one
+func accountPolicyQuota(session *Session, bytes uint64) {
+	if bucket, ok := session.GetAttachment(policyQuotaAttachment).(string); ok && bucket != "" {
+		policy.AddQuotaBytes(bucket, bytes)
+	}
+}
+
+// logPolicyEvent logs a policy decision to the rule_events table
+func logPolicyEvent(mess NfqueueMessage, decision policy.Decision) {
+	tuple := mess.Session.GetClientSideTuple()
+	action := decision.Action.Type
+	if decision.QuotaExceeded {
+		action = "quota_exceeded_" + action
+	}
+
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"session_id":     mess.Session.GetSessionID(),
+		"rule_id":        "policy_" + decision.RuleID,
+		"action":         action,
+		"ip_protocol":    tuple.Protocol,
+		"client_address": tuple.ClientAddress,
+		"client_port":    tuple.ClientPort,
+		"server_address": tuple.ServerAddress,
+		"server_port":    tuple.ServerPort,
+	}
+
+	reports.LogEvent(reports.CreateEvent("policy_match", "rule_events", 1, columns, nil))
+}
+
+// GetSessionField returns the value of the named field as a string for the
+// policy engine and the rules plugin. The tuple, interface, zone, and client
+// MAC address fields are handled directly and anything else is looked up in
+// the session attachments which hold most of the values the plugins write to
+// the dict, like the geoip country, classification, username, and hostname. The
+// certificate fields are short names for the certcache attachments, which
+// are set once certsniff or certfetch finds the server certificate.
+func GetSessionField(mess NfqueueMessage, field string) (string, bool) {
+	tuple := mess.Session.GetClientSideTuple()
+
+	switch field {
+	case "protocol":
+		return strconv.Itoa(int(tuple.Protocol)), true
+	case "client_address":
+		return tuple.ClientAddress.String(), true
+	case "server_address":
+		return tuple.ServerAddress.String(), true
+	case "client_port":
+		return strconv.Itoa(int(tuple.ClientPort)), true
+	case "server_port":
+		return strconv.Itoa(int(tuple.ServerPort)), true
+	case "family":
+		return strconv.Itoa(mess.Family), true
+	case "client_interface_id":
+		return strconv.Itoa(int(mess.Session.GetClientInterfaceID())), true
+	case "server_interface_id":
+		return strconv.Itoa(int(mess.Session.GetServerInterfaceID())), true
+	case "vlan_id":
+		return strconv.Itoa(int(mess.Session.GetVlanID())), true
+	case "client_zone":
+		return mess.Session.GetClientZone(), true
+	case "server_zone":
+		// the server interface isn't known until the conntrack new event
+		if mess.Session.GetServerInterfaceID() == 0 {
+			return "", false
+		}
+		return mess.Session.GetServerZone(), true
+	case "packet_count":
+		return strconv.FormatUint(mess.Session.GetPacketCount(), 10), true
+	case "byte_count":
+		return strconv.FormatUint(mess.Session.GetByteCount(), 10), true
+	case "client_mac":
+		// the lookup can read the ARP table so the result is kept in the
+		// session, and a client we can't find has an empty MAC address
+		if value, ok := mess.Session.GetAttachment(field).(string); ok {
+			return value, true
+		}
+		var value string
+		if mac := inventory.LookupMacAddress(tuple.ClientAddress); mac != nil {
+			value = mac.String()
+		}
+		mess.Session.PutAttachment(field, value)
+		return value, true
+	case "certificate_cn":
+		field = "certificate_subject_cn"
+	case "certificate_names":
+		// the subject common name followed by the subject alternative names
+		field = "cert_dns_names"
+	case "certificate_issuer":
+		// some issuers leave out the common name so we use the organization instead
+		field = "certificate_issuer_cn"
+		if mess.Session.GetAttachment(field) == nil {
+			field = "certificate_issuer_o"
+		}
+	}
+
+	value := mess.Session.GetAttachment(field)
+	if value == nil {
+		return "", false
+	}
+
+	switch value.(type) {
+	case string:
+		return value.(string), true
+	case bool:
+		return strconv.FormatBool(value.(bool)), true
+	case int:
+		return strconv.Itoa(value.(int)), true
+	case uint8:
+		return strconv.Itoa(int(value.(uint8))), true
+	case uint16:
+		return strconv.Itoa(int(value.(uint16))), true
+	case uint32:
+		return strconv.FormatUint(uint64(value.(uint32)), 10), true
+	case uint64:
+		return strconv.FormatUint(value.(uint64), 10), true
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64), true
+	case net.IP:
+		return value.(net.IP).String(), true
+	}
+
+	return "", false
+}
@@ -0,0 +1,190 @@
+package dispatch
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// how long the events of a private session are still dropped after the
+// session ends, for the plugins that log something after the session is gone
+const privacyLinger = 60 * time.Second
+
+// privacyConfig holds the do not inspect exclusions. The sessions of the
+// clients, the destinations, and the application categories in the lists
+// are private, which means the payload is hidden from the subscribers and
+// nothing about them is written to the dictionary or the reports. They are
+// still counted.
+type privacyConfig struct {
+	clients      []*net.IPNet
+	destinations []*net.IPNet
+	categories   map[string]bool
+}
+
+var privacyExclusions atomic.Value
+
+// loadPrivacy loads the do not inspect exclusions from the settings
+func loadPrivacy() {
+	config := &privacyConfig{categories: make(map[string]bool)}
+
+	privacyJSON, err := settings.GetCurrentSettings([]string{"dispatch", "doNotInspect"})
+	if privacyJSON != nil && err == nil {
+		item, ok := privacyJSON.(map[string]interface{})
+		if ok {
+			config.clients = parsePrivacyNetworks(item["clients"])
+			config.destinations = parsePrivacyNetworks(item["destinations"])
+			list, _ := item["categories"].([]interface{})
+			for _, value := range list {
+				if category, ok := value.(string); ok && category != "" {
+					config.categories[strings.ToLower(category)] = true
+				}
+			}
+		} else {
+			logger.Warn("Invalid do not inspect settings: %T\n", privacyJSON)
+		}
+	}
+
+	privacyExclusions.Store(config)
+	logger.Info("Loaded do not inspect exclusions clients:%d destinations:%d categories:%d\n", len(config.clients), len(config.destinations), len(config.categories))
+}
+
+// parsePrivacyNetworks returns the networks from a list of addresses and CIDRs
+func parsePrivacyNetworks(value interface{}) []*net.IPNet {
+	var networks []*net.IPNet
+
+	list, _ := value.([]interface{})
+	for _, entry := range list {
+		text, ok := entry.(string)
+		if !ok || text == "" {
+			continue
+		}
+		if !strings.Contains(text, "/") {
+			if strings.Contains(text, ":") {
+				text = text + "/128"
+			} else {
+				text = text + "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(text)
+		if err != nil {
+			logger.Warn("Ignoring invalid do not inspect network %s: %v\n", text, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+// checkPrivacy makes the session private if it matches the exclusions. The
+// addresses are checked when the session is created, while the category is
+// checked until the session is classified, so anything written about the
+// session before then is removed from the dictionary.
+func checkPrivacy(session *Session, newSession bool) {
+	if session.IsPrivate() {
+		return
+	}
+
+	config, _ := privacyExclusions.Load().(*privacyConfig)
+	if config == nil {
+		return
+	}
+
+	if newSession {
+		tuple := session.GetClientSideTuple()
+		if matchPrivacyNetworks(config.clients, tuple.ClientAddress) || matchPrivacyNetworks(config.destinations, tuple.ServerAddress) {
+			setSessionPrivate(session, "address")
+		}
+		return
+	}
+
+	if len(config.categories) == 0 {
+		return
+	}
+
+	category, _ := session.GetAttachment("application_category").(string)
+	if category != "" && config.categories[strings.ToLower(category)] {
+		setSessionPrivate(session, "category")
+		session.flushDict()
+	}
+}
+
+// matchPrivacyNetworks returns true if the address is in any of the networks
+func matchPrivacyNetworks(networks []*net.IPNet, address net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// setSessionPrivate makes the session private and stops the dictionary and reports writes
+func setSessionPrivate(session *Session, reason string) {
+	atomic.StoreUint32(&session.private, 1)
+	reports.SuppressSession(session.GetSessionID())
+	dict.SuppressSession(session.GetConntrackID())
+	overseer.AddCounter("privacy_session_"+reason, 1)
+}
+
+// releasePrivacy stops suppressing the writes for a private session that is
+// being removed from the session table. The ctid can be reused right away so
+// the dictionary writes are allowed now, while the events for the session ID
+// are dropped a little longer.
+func releasePrivacy(session *Session) {
+	dict.UnsuppressSession(session.GetConntrackID())
+	sessionID := session.GetSessionID()
+	time.AfterFunc(privacyLinger, func() {
+		reports.UnsuppressSession(sessionID)
+	})
+}
+
+// maskPayload removes the payload from a message for a private session so
+// the subscribers only see the headers
+func maskPayload(mess *NfqueueMessage) {
+	length := len(mess.Payload)
+	if length != 0 {
+		if len(mess.Data) >= length {
+			mess.Data = mess.Data[:len(mess.Data)-length]
+		}
+		if mess.IP4Layer != nil && len(mess.IP4Layer.Payload) >= length {
+			ip := *mess.IP4Layer
+			ip.Payload = ip.Payload[:len(ip.Payload)-length]
+			mess.IP4Layer = &ip
+		}
+		if mess.IP6Layer != nil && len(mess.IP6Layer.Payload) >= length {
+			ip := *mess.IP6Layer
+			ip.Payload = ip.Payload[:len(ip.Payload)-length]
+			mess.IP6Layer = &ip
+		}
+	}
+	mess.Payload = nil
+
+	if mess.TCPLayer != nil {
+		tcp := *mess.TCPLayer
+		tcp.Payload = nil
+		mess.TCPLayer = &tcp
+	}
+	if mess.UDPLayer != nil {
+		udp := *mess.UDPLayer
+		udp.Payload = nil
+		mess.UDPLayer = &udp
+	}
+	if mess.ICMPv4Layer != nil {
+		icmp := *mess.ICMPv4Layer
+		icmp.Payload = nil
+		mess.ICMPv4Layer = &icmp
+	}
+}
+
+// IsPrivate returns true if the session matched the do not inspect exclusions
+func (sess *Session) IsPrivate() bool {
+	return atomic.LoadUint32(&sess.private) != 0
+}
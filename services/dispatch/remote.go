@@ -0,0 +1,151 @@
+package dispatch
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+// With asymmetric routing the two directions of a flow can pass through
+// different appliances, so the packets one box sees may start in the middle
+// of a session or in the reply direction. The sessions tracked by the other
+// appliances are kept here, and a packet with no session that matches one of
+// them in either direction is adopted as that session, with the client side
+// tuple and the attachments from the appliance that saw it first, instead of
+// being bypassed as a mid-session stray.
+
+// the attachment holding the appliance an adopted session came from
+const remoteSourceAttachment = "remote_source"
+
+// how long a remote session is kept without being refreshed
+const remoteSessionTimeout = 5 * time.Minute
+
+// RemoteSession holds a session tracked by another appliance
+type RemoteSession struct {
+	Source          string
+	ClientSideTuple Tuple
+	Attachments     map[string]interface{}
+	updated         time.Time
+}
+
+// RemoteStatus holds the number of remote sessions from each appliance and the number adopted
+type RemoteStatus struct {
+	Sources map[string]int `json:"sources"`
+	Adopted uint64         `json:"adopted"`
+}
+
+var remoteTable = make(map[string]*RemoteSession)
+var remoteLocker sync.Mutex
+var remoteAdopted uint64
+
+// UpdateRemoteSessions adds the sessions tracked by the argumented appliance.
+// When replace is true the list is everything the appliance is tracking and
+// the sessions from it that are missing from the list are removed.
+func UpdateRemoteSessions(source string, list []RemoteSession, replace bool) {
+	now := time.Now()
+
+	remoteLocker.Lock()
+	defer remoteLocker.Unlock()
+
+	if replace {
+		for key, item := range remoteTable {
+			if item.Source == source {
+				delete(remoteTable, key)
+			}
+		}
+	}
+
+	for index := range list {
+		item := list[index]
+		item.Source = source
+		item.updated = now
+		remoteTable[item.ClientSideTuple.String()] = &item
+	}
+}
+
+// RemoveRemoteSessions removes the argumented sessions tracked by the
+// argumented appliance once it has stopped tracking them
+func RemoveRemoteSessions(source string, list []Tuple) {
+	remoteLocker.Lock()
+	defer remoteLocker.Unlock()
+
+	for _, tuple := range list {
+		key := tuple.String()
+		if item := remoteTable[key]; item != nil && item.Source == source {
+			delete(remoteTable, key)
+		}
+	}
+}
+
+// GetRemoteStatus returns the number of remote sessions from each appliance and the number adopted
+func GetRemoteStatus() RemoteStatus {
+	status := RemoteStatus{Sources: make(map[string]int), Adopted: atomic.LoadUint64(&remoteAdopted)}
+
+	remoteLocker.Lock()
+	for _, item := range remoteTable {
+		status.Sources[item.Source]++
+	}
+	remoteLocker.Unlock()
+
+	return status
+}
+
+// findRemoteSession returns the remote session for a packet tuple in either direction or nil if not found
+func findRemoteSession(tuple Tuple) *RemoteSession {
+	remoteLocker.Lock()
+	defer remoteLocker.Unlock()
+
+	if len(remoteTable) == 0 {
+		return nil
+	}
+	if item := remoteTable[tuple.String()]; item != nil {
+		return item
+	}
+	return remoteTable[tuple.StringReverse()]
+}
+
+// adoptRemoteSession creates the session for a packet that belongs to a
+// session tracked by another appliance, keeping the direction of the flow
+// and the attachments from that appliance
+func adoptRemoteSession(mess NfqueueMessage, ctid uint32, remote *RemoteSession) *Session {
+	session := createSession(mess, ctid)
+	session.SetClientSideTuple(remote.ClientSideTuple)
+	for name, value := range remote.Attachments {
+		session.PutAttachment(name, value)
+	}
+	session.PutAttachment(remoteSourceAttachment, remote.Source)
+
+	atomic.AddUint64(&remoteAdopted, 1)
+	overseer.AddCounter("remote_session_adopted", 1)
+	logger.Debug("Adopted session %d %v from %s\n", ctid, remote.ClientSideTuple, remote.Source)
+	return session
+}
+
+// IsRemote returns true if the session was adopted from another appliance
+func (sess *Session) IsRemote() bool {
+	return sess.GetAttachment(remoteSourceAttachment) != nil
+}
+
+// isRemoteReverse returns true if the session was adopted from another
+// appliance and the argumented conntrack tuple is its reply direction, which
+// is how the conntrack entry looks when this box saw the reply first
+func isRemoteReverse(session *Session, tuple Tuple) bool {
+	return session.IsRemote() && session.GetClientSideTuple().EqualReverse(tuple)
+}
+
+// cleanRemoteSessions removes the remote sessions that have not been refreshed
+func cleanRemoteSessions() {
+	now := time.Now()
+
+	remoteLocker.Lock()
+	defer remoteLocker.Unlock()
+
+	for key, item := range remoteTable {
+		if now.Sub(item.updated) > remoteSessionTimeout {
+			delete(remoteTable, key)
+		}
+	}
+}
@@ -0,0 +1,610 @@
+package dispatch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// Captures are sanitized before they are shared outside the company. The
+// client addresses and the addresses on the local networks are replaced with
+// addresses from the benchmark and documentation ranges, the same address
+// always getting the same replacement within a file, and the MAC addresses
+// are replaced with locally administered ones. The payload of every packet
+// is removed, leaving the IP and transport headers, except the TLS handshake
+// records at the start of a TCP payload since the hello and certificate
+// details are what the classification depends on. Frames that are not IP
+// are dropped since ARP and the like are full of addresses.
+
+// the warehouse file and record header sizes, which follow the structures
+// in warehouse.c on a 64 bit platform
+const warehouseFileHeaderSize = 64
+const warehouseDataHeaderSize = 40
+
+// the offsets of the addresses in the conntrack_info and netlogger_info
+// structures of common.h
+var conntrackAddressOffsets = []int{8, 24, 40, 56}
+var netloggerAddressOffsets = []int{6, 70}
+
+const conntrackInfoSize = 136
+const netloggerInfoSize = 404
+const netloggerAddressSize = 64
+
+// the TLS record types that are kept in a sanitized payload
+const tlsChangeCipherSpec = 20
+const tlsAlert = 21
+const tlsHandshake = 22
+const tlsApplicationData = 23
+
+// SanitizeResult holds the counts from sanitizing a capture file
+type SanitizeResult struct {
+	Records       int   `json:"records"`
+	Dropped       int   `json:"dropped"`
+	Addresses     int   `json:"addresses"`
+	MacAddresses  int   `json:"macAddresses"`
+	StrippedBytes int64 `json:"strippedBytes"`
+}
+
+// captureSanitizer holds the replacement addresses for one capture file
+type captureSanitizer struct {
+	clients   map[string]bool
+	addresses map[string]net.IP
+	macs      map[string]net.HardwareAddr
+	next4     uint32
+	next6     uint64
+	nextMac   uint32
+	result    SanitizeResult
+}
+
+// the replacement addresses come from 198.18.0.0/15 and 2001:db8::/32, the
+// IPv4 range wrapping around in the unlikely case it runs out
+var sanitizeBase4 = net.IPv4(198, 18, 0, 0).To4()
+var sanitizeBase6 = net.ParseIP("2001:db8::")
+
+const sanitizeLimit4 = 0x1FFFE
+
+// SanitizeFile writes a copy of a warehouse capture or pcap file to the target
+// with the client and local addresses and the MAC addresses replaced, and the
+// payloads removed. The source is read twice, first to find the clients. An
+// encrypted capture is decrypted, and the copy is signed when signing is enabled.
+func SanitizeFile(source string, target string) (*SanitizeResult, error) {
+	data, err := readCaptureFile(source)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, fmt.Errorf("%s is not a capture file", source)
+	}
+
+	sanitizer := &captureSanitizer{
+		clients:   make(map[string]bool),
+		addresses: make(map[string]net.IP),
+		macs:      make(map[string]net.HardwareAddr),
+	}
+
+	var output bytes.Buffer
+	magic := binary.LittleEndian.Uint32(data[0:4])
+	switch magic {
+	case pcapMagicMicro, pcapMagicNano, swapUint32(pcapMagicMicro), swapUint32(pcapMagicNano):
+		err = sanitizer.sanitizePcap(data, &output)
+	default:
+		err = sanitizer.sanitizeWarehouse(data, &output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(target, output.Bytes(), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = signSanitizedFile(target)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Sanitized %s to %s records:%d dropped:%d addresses:%d macs:%d stripped:%d\n", source, target,
+		sanitizer.result.Records, sanitizer.result.Dropped, sanitizer.result.Addresses, sanitizer.result.MacAddresses, sanitizer.result.StrippedBytes)
+	return &sanitizer.result, nil
+}
+
+// sanitizeWarehouse sanitizes the nfqueue, conntrack, and netlogger records
+// of a warehouse capture. The clients are the original source and the reply
+// destination of the conntrack records, and the source of the first packet
+// of each session.
+func (s *captureSanitizer) sanitizeWarehouse(data []byte, output io.Writer) error {
+	if len(data) < warehouseFileHeaderSize || !bytes.HasPrefix(data[48:], []byte("UTPDCF")) {
+		return fmt.Errorf("not a warehouse or pcap file")
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		if pass == 1 {
+			output.Write(data[:warehouseFileHeaderSize])
+		}
+
+		offset := warehouseFileHeaderSize
+		for offset+warehouseDataHeaderSize <= len(data) {
+			header := data[offset : offset+warehouseDataHeaderSize]
+			length := int(binary.LittleEndian.Uint32(header[20:24]))
+			mark := binary.LittleEndian.Uint32(header[24:28])
+			offset += warehouseDataHeaderSize
+			if offset+length > len(data) {
+				return fmt.Errorf("truncated warehouse record at %d", offset)
+			}
+			record := data[offset : offset+length]
+			offset += length
+
+			if pass == 0 {
+				s.findWarehouseClients(header[0], record, mark)
+				continue
+			}
+
+			var sanitized []byte
+			switch header[0] {
+			case 'Q':
+				sanitized = s.sanitizePacket(record)
+			case 'C':
+				sanitized = s.sanitizeConntrack(record)
+			case 'L':
+				sanitized = s.sanitizeNetlogger(record)
+			}
+			if sanitized == nil {
+				s.result.Dropped++
+				continue
+			}
+
+			fresh := make([]byte, warehouseDataHeaderSize)
+			copy(fresh, header)
+			binary.LittleEndian.PutUint32(fresh[20:24], uint32(len(sanitized)))
+			output.Write(fresh)
+			output.Write(sanitized)
+			s.result.Records++
+		}
+	}
+	return nil
+}
+
+// findWarehouseClients adds the client addresses of a warehouse record
+func (s *captureSanitizer) findWarehouseClients(origin byte, record []byte, mark uint32) {
+	switch origin {
+	case 'Q':
+		if mark&simulateNewSessionMark == 0 {
+			return
+		}
+		if source, _ := getPacketAddresses(record); source != nil {
+			s.clients[source.String()] = true
+		}
+	case 'C':
+		if len(record) < conntrackInfoSize {
+			return
+		}
+		for _, offset := range []int{conntrackAddressOffsets[0], conntrackAddressOffsets[3]} {
+			if address := getConntrackAddress(record, offset); address != nil {
+				s.clients[address.String()] = true
+			}
+		}
+	}
+}
+
+// sanitizePcap sanitizes the frames of a pcap file. The client of a flow is
+// the source of its first packet, the same as the pcap simulation.
+func (s *captureSanitizer) sanitizePcap(data []byte, output io.Writer) error {
+	if len(data) < 24 {
+		return fmt.Errorf("truncated pcap header")
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(data[0:4])
+	if magic == swapUint32(pcapMagicMicro) || magic == swapUint32(pcapMagicNano) {
+		order = binary.BigEndian
+	}
+	linkType := order.Uint32(data[20:24])
+
+	switch linkType {
+	case pcapLinkEthernet, pcapLinkRaw, pcapLinkLinuxSLL, pcapLinkIPv4, pcapLinkIPv6:
+	default:
+		return fmt.Errorf("unsupported pcap link type %d", linkType)
+	}
+
+	flowTable := make(map[string]*simulateFlow)
+	var ctidIndex uint32
+
+	for pass := 0; pass < 2; pass++ {
+		if pass == 1 {
+			output.Write(data[:24])
+		}
+
+		offset := 24
+		for offset+16 <= len(data) {
+			header := data[offset : offset+16]
+			captured := int(order.Uint32(header[8:12]))
+			offset += 16
+			if offset+captured > len(data) {
+				return fmt.Errorf("truncated pcap record at %d", offset)
+			}
+			frame := data[offset : offset+captured]
+			offset += captured
+
+			if pass == 0 {
+				if packet, _ := decodePcapPacket(linkType, frame); packet != nil {
+					if flow, _, newFlow := findSimulateFlow(flowTable, packet, &ctidIndex); newFlow {
+						s.clients[flow.client.String()] = true
+					}
+				}
+				continue
+			}
+
+			sanitized := s.sanitizeFrame(linkType, frame)
+			if sanitized == nil {
+				s.result.Dropped++
+				continue
+			}
+
+			fresh := make([]byte, 16)
+			copy(fresh, header)
+			order.PutUint32(fresh[8:12], uint32(len(sanitized)))
+			order.PutUint32(fresh[12:16], uint32(len(sanitized)))
+			output.Write(fresh)
+			output.Write(sanitized)
+			s.result.Records++
+		}
+	}
+	return nil
+}
+
+// sanitizeFrame returns the sanitized copy of a pcap frame or nil if the
+// frame is dropped
+func (s *captureSanitizer) sanitizeFrame(linkType uint32, frame []byte) []byte {
+	var offset int
+	var etherType uint16
+
+	switch linkType {
+	case pcapLinkEthernet:
+		offset = 14
+		for len(frame) >= offset && binary.BigEndian.Uint16(frame[offset-2:offset]) == 0x8100 {
+			offset += 4
+		}
+		if len(frame) < offset {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[offset-2 : offset])
+	case pcapLinkLinuxSLL:
+		offset = 16
+		if len(frame) < offset {
+			return nil
+		}
+		etherType = binary.BigEndian.Uint16(frame[14:16])
+	default:
+		return s.sanitizePacket(frame)
+	}
+
+	if etherType != 0x0800 && etherType != 0x86DD {
+		return nil
+	}
+
+	packet := s.sanitizePacket(frame[offset:])
+	if packet == nil {
+		return nil
+	}
+
+	sanitized := make([]byte, offset, offset+len(packet))
+	copy(sanitized, frame[:offset])
+	if linkType == pcapLinkEthernet {
+		s.replaceMac(sanitized[0:6])
+		s.replaceMac(sanitized[6:12])
+	} else {
+		length := int(binary.BigEndian.Uint16(sanitized[4:6]))
+		if length > 8 {
+			length = 8
+		}
+		s.replaceMac(sanitized[6 : 6+length])
+	}
+	return append(sanitized, packet...)
+}
+
+// sanitizePacket returns the sanitized copy of an IP packet or nil if it
+// can't be parsed. The lengths and checksums are updated to match.
+func (s *captureSanitizer) sanitizePacket(packet []byte) []byte {
+	if len(packet) == 0 {
+		return nil
+	}
+
+	var headerSize, protocol int
+	var fragment bool
+
+	switch packet[0] >> 4 {
+	case 4:
+		headerSize = int(packet[0]&0x0F) * 4
+		if headerSize < 20 || len(packet) < headerSize {
+			return nil
+		}
+		if total := int(binary.BigEndian.Uint16(packet[2:4])); total >= headerSize && total < len(packet) {
+			packet = packet[:total]
+		}
+		protocol = int(packet[9])
+		fragment = binary.BigEndian.Uint16(packet[6:8])&0x1FFF != 0
+	case 6:
+		headerSize = 40
+		if len(packet) < headerSize {
+			return nil
+		}
+		if total := headerSize + int(binary.BigEndian.Uint16(packet[4:6])); total < len(packet) {
+			packet = packet[:total]
+		}
+		protocol = int(packet[6])
+	default:
+		return nil
+	}
+
+	transport := packet[headerSize:]
+	var transportSize int
+
+	if !fragment {
+		switch protocol {
+		case syscall.IPPROTO_TCP:
+			if len(transport) >= 20 {
+				transportSize = int(transport[12]>>4) * 4
+			}
+		case syscall.IPPROTO_UDP, syscall.IPPROTO_ICMP, syscall.IPPROTO_ICMPV6:
+			transportSize = 8
+		}
+	}
+	if transportSize > len(transport) {
+		transportSize = len(transport)
+	}
+
+	payload := transport[transportSize:]
+	var kept int
+	if protocol == syscall.IPPROTO_TCP && transportSize >= 20 {
+		kept = getTLSMetadataSize(payload)
+	}
+	s.result.StrippedBytes += int64(len(payload) - kept)
+
+	sanitized := make([]byte, 0, headerSize+transportSize+kept)
+	sanitized = append(sanitized, packet[:headerSize+transportSize+kept]...)
+
+	if sanitized[0]>>4 == 4 {
+		s.replaceAddress(sanitized[12:16])
+		s.replaceAddress(sanitized[16:20])
+		binary.BigEndian.PutUint16(sanitized[2:4], uint16(len(sanitized)))
+		binary.BigEndian.PutUint16(sanitized[10:12], 0)
+		binary.BigEndian.PutUint16(sanitized[10:12], getChecksum(sanitized[:headerSize], 0))
+	} else {
+		s.replaceAddress(sanitized[8:24])
+		s.replaceAddress(sanitized[24:40])
+		// anything behind an extension header is dropped along with the payload
+		if transportSize == 0 {
+			sanitized[6] = 59
+		}
+		binary.BigEndian.PutUint16(sanitized[4:6], uint16(len(sanitized)-headerSize))
+	}
+
+	if transportSize > 0 {
+		updateTransportChecksum(sanitized, headerSize, protocol)
+	}
+	return sanitized
+}
+
+// sanitizeConntrack returns the sanitized copy of a conntrack_info record
+func (s *captureSanitizer) sanitizeConntrack(record []byte) []byte {
+	if len(record) < conntrackInfoSize {
+		return nil
+	}
+
+	sanitized := append([]byte(nil), record...)
+	size := 4
+	if sanitized[5] == syscall.AF_INET6 {
+		size = 16
+	}
+	for _, offset := range conntrackAddressOffsets {
+		s.replaceAddress(sanitized[offset : offset+size])
+	}
+	return sanitized
+}
+
+// sanitizeNetlogger returns the sanitized copy of a netlogger_info record,
+// which has the addresses as text
+func (s *captureSanitizer) sanitizeNetlogger(record []byte) []byte {
+	if len(record) < netloggerInfoSize {
+		return nil
+	}
+
+	sanitized := append([]byte(nil), record...)
+	for _, offset := range netloggerAddressOffsets {
+		field := sanitized[offset : offset+netloggerAddressSize]
+		text := string(field)
+		if index := bytes.IndexByte(field, 0); index >= 0 {
+			text = string(field[:index])
+		}
+		address := net.ParseIP(text)
+		if address == nil {
+			continue
+		}
+		if address.To4() != nil {
+			address = address.To4()
+		}
+		s.replaceAddress(address)
+		for index := range field {
+			field[index] = 0
+		}
+		copy(field[:netloggerAddressSize-1], address.String())
+	}
+	return sanitized
+}
+
+// replaceAddress replaces an address in place if it belongs to a client or a
+// local network
+func (s *captureSanitizer) replaceAddress(raw []byte) {
+	address := net.IP(raw)
+	key := address.String()
+
+	if !s.clients[key] && !isLocalAddress(address) {
+		return
+	}
+
+	replacement, found := s.addresses[key]
+	if !found {
+		if len(raw) == 4 {
+			s.next4 = (s.next4 % sanitizeLimit4) + 1
+			replacement = make(net.IP, 4)
+			binary.BigEndian.PutUint32(replacement, binary.BigEndian.Uint32(sanitizeBase4)+s.next4)
+		} else {
+			s.next6++
+			replacement = make(net.IP, 16)
+			copy(replacement, sanitizeBase6)
+			binary.BigEndian.PutUint64(replacement[8:], s.next6)
+		}
+		s.addresses[key] = replacement
+		s.result.Addresses++
+	}
+	copy(raw, replacement)
+}
+
+// replaceMac replaces a MAC address in place unless it is broadcast or multicast
+func (s *captureSanitizer) replaceMac(raw []byte) {
+	if len(raw) == 0 || raw[0]&0x01 != 0 {
+		return
+	}
+
+	key := net.HardwareAddr(raw).String()
+	replacement, found := s.macs[key]
+	if !found {
+		s.nextMac++
+		replacement = make(net.HardwareAddr, len(raw))
+		replacement[0] = 0x02
+		for index := len(raw) - 1; index > 0 && index >= len(raw)-3; index-- {
+			replacement[index] = byte(s.nextMac >> uint(8*(len(raw)-1-index)))
+		}
+		s.macs[key] = replacement
+		s.result.MacAddresses++
+	}
+	copy(raw, replacement)
+}
+
+// isLocalAddress returns true for the private, shared, loopback, and link
+// local addresses
+func isLocalAddress(address net.IP) bool {
+	if address.IsPrivate() || address.IsLoopback() || address.IsLinkLocalUnicast() {
+		return true
+	}
+	if ip4 := address.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xC0 == 64 {
+		return true
+	}
+	return false
+}
+
+// getPacketAddresses returns the source and destination of an IP packet
+func getPacketAddresses(packet []byte) (net.IP, net.IP) {
+	if len(packet) >= 20 && packet[0]>>4 == 4 {
+		return net.IP(packet[12:16]), net.IP(packet[16:20])
+	}
+	if len(packet) >= 40 && packet[0]>>4 == 6 {
+		return net.IP(packet[8:24]), net.IP(packet[24:40])
+	}
+	return nil, nil
+}
+
+// getConntrackAddress returns the address at the offset of a conntrack_info record
+func getConntrackAddress(record []byte, offset int) net.IP {
+	switch record[5] {
+	case syscall.AF_INET:
+		return net.IP(record[offset : offset+4])
+	case syscall.AF_INET6:
+		return net.IP(record[offset : offset+16])
+	}
+	return nil
+}
+
+// getTLSMetadataSize returns the size of the TLS records at the start of a
+// TCP payload that are kept. The handshake, alert, and change cipher spec
+// records are kept whole, and only the header of the first application data
+// record, which ends what is kept.
+func getTLSMetadataSize(payload []byte) int {
+	var size int
+
+	for len(payload)-size >= 5 {
+		record := payload[size:]
+		if record[1] != 3 || record[2] > 4 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(record[3:5]))
+
+		switch record[0] {
+		case tlsChangeCipherSpec, tlsAlert, tlsHandshake:
+			size += 5 + length
+			if size > len(payload) {
+				return len(payload)
+			}
+			continue
+		case tlsApplicationData:
+			size += 5
+		}
+		break
+	}
+	return size
+}
+
+// updateTransportChecksum calculates the TCP, UDP, or ICMP checksum of a
+// packet after its addresses and length were changed
+func updateTransportChecksum(packet []byte, headerSize int, protocol int) {
+	transport := packet[headerSize:]
+
+	var offset int
+	switch protocol {
+	case syscall.IPPROTO_TCP:
+		offset = 16
+	case syscall.IPPROTO_UDP:
+		offset = 6
+		binary.BigEndian.PutUint16(transport[4:6], uint16(len(transport)))
+	case syscall.IPPROTO_ICMP, syscall.IPPROTO_ICMPV6:
+		offset = 2
+	default:
+		return
+	}
+	if len(transport) < offset+2 {
+		return
+	}
+	binary.BigEndian.PutUint16(transport[offset:offset+2], 0)
+
+	// ICMP for IPv4 is the only one without the pseudo header
+	var initial uint32
+	if protocol != syscall.IPPROTO_ICMP {
+		source, destination := getPacketAddresses(packet)
+		initial = getChecksumSum(source, 0)
+		initial = getChecksumSum(destination, initial)
+		initial += uint32(protocol) + uint32(len(transport))
+	}
+
+	checksum := getChecksum(transport, initial)
+	if checksum == 0 && protocol == syscall.IPPROTO_UDP {
+		checksum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(transport[offset:offset+2], checksum)
+}
+
+// getChecksum returns the internet checksum of the data added to the initial sum
+func getChecksum(data []byte, initial uint32) uint16 {
+	sum := getChecksumSum(data, initial)
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// getChecksumSum adds the 16 bit words of the data to the sum
+func getChecksumSum(data []byte, sum uint32) uint32 {
+	for index := 0; index+1 < len(data); index += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[index : index+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
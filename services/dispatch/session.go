@@ -8,6 +8,7 @@ import (
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/zones"
 )
 
 // Session stores information about a packetd session
@@ -41,12 +42,16 @@ type Session struct {
 	eventCount  uint64
 	navlCount   uint64
 
+	// creationTime and lastActivityTime store the session creation time and the time of
+	// the last session activity as unix nanoseconds so they can be accessed atomically
+	creationTime     int64
+	lastActivityTime int64
+
 	// conntrackID is the conntrack ID. ConntrackIDs (ctid) are unique but reused.
 	conntrackID uint32
 
-	// creationTime stores the creation time of the session
-	creationTime time.Time
-	creationLock sync.Mutex
+	// generation counts the sessions that have held the ctid while the previous one was in the table
+	generation uint32
 
 	// clientSideTuple stores the client-side (pre-NAT) session tuple
 	clientSideTuple Tuple
@@ -63,9 +68,19 @@ type Session struct {
 	serverInterfaceID   uint32
 	serverInterfaceType uint32
 
+	// vlanID stores the 802.1Q VLAN ID of the client side of the session
+	vlanID uint32
+
+	// clientZone stores the name of the logical zone of the client side of the session
+	clientZone     string
+	clientZoneLock sync.Mutex
+
 	// family stores the family indicator of the session
 	family uint32
 
+	// private is set when the session matched the do not inspect exclusions
+	private uint32
+
 	// conntrackConfirmed is true if this session has been confirmed by conntrack. false otherwise
 	// A session becomes confirmed by conntrack once its packet reaches the final CONNTRACK_CONFIRM
 	// priority in netfilter, and we get an conntrack "NEW" event for it.
@@ -83,17 +98,32 @@ type Session struct {
 	// attachments stores the metadata attachments
 	attachments    map[string]interface{}
 	attachmentLock sync.Mutex
+}
+
+// the number of shards in the session table which must be a power of two
+const sessionShardCount = 64
 
-	// used to keep track of the last session activity
-	lastActivityTime time.Time
-	lastActivityLock sync.Mutex
+// sessionShard holds one part of the session table. Lookups use the sync.Map
+// without locking, while the mutex serializes the changes that need to check
+// the current entry first.
+type sessionShard struct {
+	sessions sync.Map
+	mutex    sync.Mutex
 }
 
-// sessionTable is the global session table
-var sessionTable map[uint32]*Session
+// sessionTable is the global session table sharded by ctid to reduce lock contention
+var sessionTable [sessionShardCount]sessionShard
 
-// sessionMutex is the lock for sessionTable
-var sessionMutex sync.Mutex
+// SessionTableStats holds the number of sessions in each session table shard
+type SessionTableStats struct {
+	Shards      int     `json:"shards"`
+	Sessions    int     `json:"sessions"`
+	Confirmed   int     `json:"confirmed"`
+	MinShard    int     `json:"minShard"`
+	MaxShard    int     `json:"maxShard"`
+	AverageSize float64 `json:"averageSize"`
+	ShardSizes  []int   `json:"shardSizes"`
+}
 
 // sessionIndex stores the next available unique SessionID
 var sessionIndex int64
@@ -234,6 +264,37 @@ func (sess *Session) SetClientInterfaceType(value uint8) uint8 {
 	return value
 }
 
+// GetVlanID gets the client side VLAN ID
+func (sess *Session) GetVlanID() uint16 {
+	return uint16(atomic.LoadUint32(&sess.vlanID))
+}
+
+// SetVlanID sets the client side VLAN ID
+func (sess *Session) SetVlanID(value uint16) uint16 {
+	atomic.StoreUint32(&sess.vlanID, uint32(value))
+	return value
+}
+
+// GetClientZone gets the client side zone name
+func (sess *Session) GetClientZone() string {
+	sess.clientZoneLock.Lock()
+	defer sess.clientZoneLock.Unlock()
+	return sess.clientZone
+}
+
+// SetClientZone sets the client side zone name
+func (sess *Session) SetClientZone(value string) string {
+	sess.clientZoneLock.Lock()
+	defer sess.clientZoneLock.Unlock()
+	sess.clientZone = value
+	return value
+}
+
+// GetServerZone gets the zone of the server side interface
+func (sess *Session) GetServerZone() string {
+	return zones.GetInterfaceZone(int(sess.GetServerInterfaceID()))
+}
+
 // GetPacketCount gets the packet count
 func (sess *Session) GetPacketCount() uint64 {
 	return atomic.LoadUint64(&sess.packetCount)
@@ -300,32 +361,39 @@ func (sess *Session) AddNavlCount(value uint64) uint64 {
 
 // GetCreationTime gets the time the entry was created
 func (sess *Session) GetCreationTime() time.Time {
-	sess.creationLock.Lock()
-	defer sess.creationLock.Unlock()
-	value := sess.creationTime
-	return value
+	return unixNanoTime(atomic.LoadInt64(&sess.creationTime))
 }
 
 // SetCreationTime sets the time the entry was created
 func (sess *Session) SetCreationTime(value time.Time) {
-	sess.creationLock.Lock()
-	defer sess.creationLock.Unlock()
-	sess.creationTime = value
+	atomic.StoreInt64(&sess.creationTime, value.UnixNano())
 }
 
 // GetLastActivity gets the time of the last session activity
 func (sess *Session) GetLastActivity() time.Time {
-	sess.lastActivityLock.Lock()
-	defer sess.lastActivityLock.Unlock()
-	value := sess.lastActivityTime
-	return value
+	return unixNanoTime(atomic.LoadInt64(&sess.lastActivityTime))
 }
 
 // SetLastActivity sets the time of the last session activity
 func (sess *Session) SetLastActivity(value time.Time) {
-	sess.lastActivityLock.Lock()
-	defer sess.lastActivityLock.Unlock()
-	sess.lastActivityTime = value
+	atomic.StoreInt64(&sess.lastActivityTime, value.UnixNano())
+}
+
+// accountPacket updates the packet, byte, and event counts and the last
+// activity time for a packet and returns the new packet count. The counters
+// are updated independently so a reader may briefly see the packet count
+// without the matching byte count, which is fine for accounting purposes.
+func (sess *Session) accountPacket(length uint64, now time.Time) uint64 {
+	atomic.StoreInt64(&sess.lastActivityTime, now.UnixNano())
+	atomic.AddUint64(&sess.byteCount, length)
+	atomic.AddUint64(&sess.eventCount, 1)
+	return atomic.AddUint64(&sess.packetCount, 1)
+}
+
+// accountEvent updates the event count and the last activity time for a conntrack event
+func (sess *Session) accountEvent(now time.Time) {
+	atomic.StoreInt64(&sess.lastActivityTime, now.UnixNano())
+	atomic.AddUint64(&sess.eventCount, 1)
 }
 
 // GetConntrackConfirmed gets the conntrack confirmed flag
@@ -375,102 +443,185 @@ func (sess *Session) SetFamily(value uint8) uint8 {
 // it does a sanity check to make sure the session in question
 // is actually in the table
 func (sess *Session) removeFromSessionTable() {
-	sessionMutex.Lock()
-	sessInTable, found := sessionTable[sess.GetConntrackID()]
-	if found && sess == sessInTable {
-		delete(sessionTable, sess.GetConntrackID())
+	ctid := sess.GetConntrackID()
+	shard := getSessionShard(ctid)
+	shard.mutex.Lock()
+	sessInTable, found := shard.sessions.Load(ctid)
+	if found && sess == sessInTable.(*Session) {
+		shard.sessions.Delete(ctid)
+		if sess.IsPrivate() {
+			releasePrivacy(sess)
+		}
 	}
-	sessionMutex.Unlock()
+	shard.mutex.Unlock()
 }
 
 // flushDict flushes the dict for the session
 // it does a sanity check to make sure it ows its ctid
 // by doing a lookup in the session table
 func (sess *Session) flushDict() {
-	sessionMutex.Lock()
-	sessInTable, found := sessionTable[sess.GetConntrackID()]
-	if found && sess == sessInTable {
-		dict.DeleteSession(sess.GetConntrackID())
+	ctid := sess.GetConntrackID()
+	shard := getSessionShard(ctid)
+	shard.mutex.Lock()
+	sessInTable, found := shard.sessions.Load(ctid)
+	if found && sess == sessInTable.(*Session) {
+		dict.DeleteSession(ctid)
 	}
-	sessionMutex.Unlock()
+	shard.mutex.Unlock()
 }
 
 // nextSessionID returns the next sequential session ID value
 func nextSessionID() int64 {
-	var value int64
-	sessionMutex.Lock()
-	value = sessionIndex
-	sessionIndex++
+	for {
+		value := atomic.LoadInt64(&sessionIndex)
+		next := value + 1
+		if next < 0 {
+			next = 1
+		}
+		if atomic.CompareAndSwapInt64(&sessionIndex, value, next) {
+			return value
+		}
+	}
+}
 
-	if sessionIndex < 0 {
-		sessionIndex = 1
+// unixNanoTime converts unix nanoseconds to a time, leaving zero as the zero time
+func unixNanoTime(value int64) time.Time {
+	if value == 0 {
+		return time.Time{}
 	}
+	return time.Unix(0, value)
+}
 
-	sessionMutex.Unlock()
-	return (value)
+// getSessionShard returns the session table shard for a ctid. The ctid values
+// are mostly sequential so we multiply by a large odd constant to spread them.
+func getSessionShard(ctid uint32) *sessionShard {
+	return &sessionTable[(ctid*2654435761)>>24&(sessionShardCount-1)]
 }
 
 // findSession searches for an sess in the session table
 func findSession(ctid uint32) *Session {
-	sessionMutex.Lock()
-	sess, status := sessionTable[ctid]
-	logger.Trace("Lookup session index %v -> %v\n", ctid, status)
-	sessionMutex.Unlock()
+	sess, status := getSessionShard(ctid).sessions.Load(ctid)
+	if logger.IsTraceEnabled() {
+		logger.Trace("Lookup session index %v -> %v\n", ctid, status)
+	}
 	if status == false {
 		return nil
 	}
-	return sess
+	return sess.(*Session)
 }
 
 // insertSessionTable adds an sess to the session table
 func insertSessionTable(ctid uint32, sess *Session) {
 	logger.Trace("Insert session index %v -> %v\n", ctid, sess.GetClientSideTuple())
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
-	if sessionTable[ctid] != nil {
+	shard := getSessionShard(ctid)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if _, found := shard.sessions.Load(ctid); found {
 		logger.Warn("Overriding previous session: %v\n", ctid)
-		delete(sessionTable, ctid)
 	}
-	sessionTable[ctid] = sess
+	shard.sessions.Store(ctid, sess)
 	dict.AddSessionEntry(sess.GetConntrackID(), "session_id", sess.GetSessionID())
 }
 
+// clearSessionTable removes all the sessions from the session table
+func clearSessionTable() {
+	for i := range sessionTable {
+		shard := &sessionTable[i]
+		shard.mutex.Lock()
+		shard.sessions.Range(func(key interface{}, value interface{}) bool {
+			shard.sessions.Delete(key)
+			return true
+		})
+		shard.mutex.Unlock()
+	}
+}
+
 // cleanSessionTable cleans the session table by removing stale entries
 func cleanSessionTable() {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
-
-	for ctid, session := range sessionTable {
-		// Having stale sessions is normal if sessions get blocked. Their conntrack is
-		// never get confirmed and thus there is never a delete conntrack event so we
-		// clean those session up quickly to keep the dict from getting huge.
-		// However, if we find a a stale conntrack-confirmed session that is bad.
-		if session.GetConntrackConfirmed() {
-			// We use 10000 seconds for confirmed sessions because 7440 is the established idle tcp timeout default
-			if time.Now().Sub(session.GetLastActivity()) > 10000*time.Second {
-				logger.Err("%OC|Removing stale (%v) session [%v] %v\n", "stale_session_removed", 0, time.Now().Sub(session.GetLastActivity()), ctid, session.GetClientSideTuple())
-				dict.DeleteSession(ctid)
-				delete(sessionTable, ctid)
-			}
-		} else {
-			// We remove unconfirmed sessions after 60 seconds to keep things lean and clean
-			if time.Now().Sub(session.GetLastActivity()) > 60*time.Second {
-				if logger.IsTraceEnabled() {
-					logger.Err("Removing unconfirmed (%v) session [%v] %v\n", time.Now().Sub(session.GetLastActivity()), ctid, session.GetClientSideTuple())
+	confirmedTimeout := 10000 * time.Second
+	unconfirmedTimeout := 60 * time.Second
+	shedding := false
+
+	// when we are short on memory we keep idle sessions for much less time
+	if GetShedLevel() >= ShedSessions {
+		shedding = true
+		confirmedTimeout = 1800 * time.Second
+		unconfirmedTimeout = 10 * time.Second
+	}
+
+	for i := range sessionTable {
+		shard := &sessionTable[i]
+		shard.mutex.Lock()
+		shard.sessions.Range(func(key interface{}, value interface{}) bool {
+			ctid := key.(uint32)
+			session := value.(*Session)
+
+			// Having stale sessions is normal if sessions get blocked. Their conntrack is
+			// never get confirmed and thus there is never a delete conntrack event so we
+			// clean those session up quickly to keep the dict from getting huge.
+			// However, if we find a a stale conntrack-confirmed session that is bad.
+			if session.GetConntrackConfirmed() {
+				// We use 10000 seconds for confirmed sessions because 7440 is the established idle tcp timeout default
+				if shedding && time.Now().Sub(session.GetLastActivity()) > confirmedTimeout {
+					overseer.AddCounter("shed_session_removed", 1)
+					dict.DeleteSession(ctid)
+					shard.sessions.Delete(ctid)
+				} else if time.Now().Sub(session.GetLastActivity()) > confirmedTimeout {
+					logger.Err("%OC|Removing stale (%v) session [%v] %v\n", "stale_session_removed", 0, time.Now().Sub(session.GetLastActivity()), ctid, session.GetClientSideTuple())
+					dict.DeleteSession(ctid)
+					shard.sessions.Delete(ctid)
+				}
+			} else {
+				// We remove unconfirmed sessions after 60 seconds to keep things lean and clean
+				if time.Now().Sub(session.GetLastActivity()) > unconfirmedTimeout {
+					if logger.IsTraceEnabled() {
+						logger.Err("Removing unconfirmed (%v) session [%v] %v\n", time.Now().Sub(session.GetLastActivity()), ctid, session.GetClientSideTuple())
+					}
+					overseer.AddCounter("unconfirmed_session_removed", 1)
+					dict.DeleteSession(ctid)
+					shard.sessions.Delete(ctid)
 				}
-				overseer.AddCounter("unconfirmed_session_removed", 1)
-				dict.DeleteSession(ctid)
-				delete(sessionTable, ctid)
 			}
+			return true
+		})
+		shard.mutex.Unlock()
+	}
+}
+
+// GetSessionTableStats returns the number of sessions in each shard of the
+// session table so an uneven spread of the ctids can be spotted
+func GetSessionTableStats() SessionTableStats {
+	stats := SessionTableStats{Shards: sessionShardCount, ShardSizes: make([]int, sessionShardCount)}
+
+	for i := range sessionTable {
+		count := 0
+		sessionTable[i].sessions.Range(func(key interface{}, value interface{}) bool {
+			count++
+			if value.(*Session).GetConntrackConfirmed() {
+				stats.Confirmed++
+			}
+			return true
+		})
+		stats.ShardSizes[i] = count
+		stats.Sessions += count
+		if i == 0 || count < stats.MinShard {
+			stats.MinShard = count
+		}
+		if count > stats.MaxShard {
+			stats.MaxShard = count
 		}
 	}
+
+	stats.AverageSize = float64(stats.Sessions) / float64(sessionShardCount)
+	return stats
 }
 
 // printSessionTable prints the session table
 func printSessionTable() {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
-	for k, v := range sessionTable {
-		logger.Debug("Session[%v] = %s\n", k, v.GetClientSideTuple().String())
+	for i := range sessionTable {
+		sessionTable[i].sessions.Range(func(key interface{}, value interface{}) bool {
+			logger.Debug("Session[%v] = %s\n", key, value.(*Session).GetClientSideTuple().String())
+			return true
+		})
 	}
 }
@@ -0,0 +1,399 @@
+package dispatch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The session capture is a warehouse mode that writes the packets of each
+// new session matching a filter to its own pcap file, named by the session
+// ID and the tuple, so a single problematic flow can be looked at without
+// digging it out of a capture of everything. The filter matches the session
+// fields the policy rules use. The files are encrypted and signed the same
+// as the warehouse captures when that is enabled. Every packet of a captured
+// session goes through userspace until the packet limit is reached.
+
+// the session attachment that holds the capture of a session
+const sessionCaptureAttachment = "session_capture"
+
+// the defaults of the session capture
+const defaultSessionCaptureDirectory = "/tmp/sessions"
+const defaultSessionCapturePackets = 1000
+const defaultSessionCaptureSessions = 100
+
+// SessionCaptureConfig holds the options of a session capture
+type SessionCaptureConfig struct {
+	Directory   string            `json:"directory"`
+	Filter      map[string]string `json:"filter"`
+	PacketLimit uint64            `json:"packetLimit"`
+	MaxSessions int               `json:"maxSessions"`
+}
+
+// SessionCaptureEntry is the index entry of a captured session
+type SessionCaptureEntry struct {
+	SessionID  int64     `json:"sessionId"`
+	Filename   string    `json:"filename"`
+	Protocol   uint8     `json:"protocol"`
+	Client     string    `json:"clientAddress"`
+	ClientPort uint16    `json:"clientPort"`
+	Server     string    `json:"serverAddress"`
+	ServerPort uint16    `json:"serverPort"`
+	Started    time.Time `json:"started"`
+	Packets    uint64    `json:"packets"`
+	Bytes      uint64    `json:"bytes"`
+	Finished   bool      `json:"finished"`
+}
+
+// SessionCaptureStatus holds the session capture options and the index
+type SessionCaptureStatus struct {
+	Running  bool                  `json:"running"`
+	Config   SessionCaptureConfig  `json:"config"`
+	Sessions []SessionCaptureEntry `json:"sessions"`
+}
+
+// sessionCapture holds the file of a captured session
+type sessionCapture struct {
+	mutex   sync.Mutex
+	entry   *SessionCaptureEntry
+	file    *os.File
+	writer  io.Writer
+	pipe    *io.PipeWriter
+	done    chan error
+	config  captureConfig
+	limit   uint64
+	closed  bool
+	running *sessionCaptureRun
+}
+
+// sessionCaptureRun holds a started session capture
+type sessionCaptureRun struct {
+	config   SessionCaptureConfig
+	protect  captureConfig
+	entries  map[int64]*SessionCaptureEntry
+	captures map[int64]*sessionCapture
+	stopped  bool
+}
+
+var sessionCaptureState *sessionCaptureRun
+var sessionCaptureMutex sync.Mutex
+
+// StartSessionCapture starts capturing the new sessions that match the
+// filter, replacing the index of the previous session capture
+func StartSessionCapture(config SessionCaptureConfig) error {
+	if config.Directory == "" {
+		config.Directory = defaultSessionCaptureDirectory
+	}
+	if config.PacketLimit == 0 {
+		config.PacketLimit = defaultSessionCapturePackets
+	}
+	if config.MaxSessions <= 0 {
+		config.MaxSessions = defaultSessionCaptureSessions
+	}
+	for field := range config.Filter {
+		if _, ok := sessionCaptureFields[field]; !ok {
+			return fmt.Errorf("unknown filter field %s", field)
+		}
+	}
+
+	protect, err := loadCaptureConfig()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(config.Directory, 0700); err != nil {
+		return err
+	}
+
+	sessionCaptureMutex.Lock()
+	defer sessionCaptureMutex.Unlock()
+
+	if sessionCaptureState != nil && !sessionCaptureState.stopped {
+		return errors.New("a session capture is already running")
+	}
+
+	sessionCaptureState = &sessionCaptureRun{
+		config:   config,
+		protect:  protect,
+		entries:  make(map[int64]*SessionCaptureEntry),
+		captures: make(map[int64]*sessionCapture),
+	}
+
+	logger.Info("Beginning session capture to %s filter:%v packets:%d sessions:%d\n", config.Directory, config.Filter, config.PacketLimit, config.MaxSessions)
+	return nil
+}
+
+// StopSessionCapture stops the session capture and closes the files of the
+// sessions still being captured
+func StopSessionCapture() {
+	sessionCaptureMutex.Lock()
+	running := sessionCaptureState
+	var list []*sessionCapture
+	if running != nil && !running.stopped {
+		running.stopped = true
+		for _, capture := range running.captures {
+			list = append(list, capture)
+		}
+	}
+	sessionCaptureMutex.Unlock()
+
+	for _, capture := range list {
+		capture.close()
+	}
+	if running != nil {
+		logger.Info("Finished session capture sessions:%d\n", len(running.entries))
+	}
+}
+
+// GetSessionCaptureStatus returns the session capture options and the
+// captured sessions in the order they started
+func GetSessionCaptureStatus() SessionCaptureStatus {
+	sessionCaptureMutex.Lock()
+	defer sessionCaptureMutex.Unlock()
+
+	status := SessionCaptureStatus{Sessions: []SessionCaptureEntry{}}
+	running := sessionCaptureState
+	if running == nil {
+		return status
+	}
+
+	status.Running = !running.stopped
+	status.Config = running.config
+	for _, entry := range running.entries {
+		status.Sessions = append(status.Sessions, *entry)
+	}
+	sort.Slice(status.Sessions, func(i, j int) bool {
+		return status.Sessions[i].SessionID < status.Sessions[j].SessionID
+	})
+	return status
+}
+
+// GetSessionCaptureFile returns the file of a captured session
+func GetSessionCaptureFile(sessionID int64) (string, error) {
+	sessionCaptureMutex.Lock()
+	defer sessionCaptureMutex.Unlock()
+
+	if sessionCaptureState == nil || sessionCaptureState.entries[sessionID] == nil {
+		return "", fmt.Errorf("session %d was not captured", sessionID)
+	}
+	return sessionCaptureState.entries[sessionID].Filename, nil
+}
+
+// the session fields the filter can match, which are the ones known on the
+// first packet of the session
+var sessionCaptureFields = map[string]bool{
+	"protocol":            true,
+	"client_address":      true,
+	"server_address":      true,
+	"client_port":         true,
+	"server_port":         true,
+	"family":              true,
+	"client_interface_id": true,
+	"vlan_id":             true,
+	"client_zone":         true,
+	"client_mac":          true,
+}
+
+// sessionCaptureHandler is the nfqueue subscription that writes the packets
+// of the captured sessions to their files
+func sessionCaptureHandler(mess NfqueueMessage, ctid uint32, newSession bool) NfqueueResult {
+	var result NfqueueResult
+	result.SessionRelease = true
+
+	session := mess.Session
+	if session == nil {
+		return result
+	}
+
+	capture, _ := session.GetAttachment(sessionCaptureAttachment).(*sessionCapture)
+	if capture == nil {
+		if !newSession || session.IsPrivate() {
+			return result
+		}
+		capture = startSessionCapture(mess)
+		if capture == nil {
+			return result
+		}
+		session.PutAttachment(sessionCaptureAttachment, capture)
+	}
+
+	result.SessionRelease = !capture.write(mess.Data)
+	return result
+}
+
+// startSessionCapture creates the capture of a new session if it matches the
+// filter and the session limit isn't reached
+func startSessionCapture(mess NfqueueMessage) *sessionCapture {
+	sessionCaptureMutex.Lock()
+	running := sessionCaptureState
+	if running == nil || running.stopped || len(running.entries) >= running.config.MaxSessions {
+		sessionCaptureMutex.Unlock()
+		return nil
+	}
+	config := running.config
+	sessionCaptureMutex.Unlock()
+
+	for field, value := range config.Filter {
+		if found, ok := GetSessionField(mess, field); !ok || found != value {
+			return nil
+		}
+	}
+
+	tuple := mess.Session.GetClientSideTuple()
+	entry := &SessionCaptureEntry{
+		SessionID:  mess.Session.GetSessionID(),
+		Protocol:   tuple.Protocol,
+		Client:     tuple.ClientAddress.String(),
+		ClientPort: tuple.ClientPort,
+		Server:     tuple.ServerAddress.String(),
+		ServerPort: tuple.ServerPort,
+		Started:    time.Now(),
+	}
+	name := fmt.Sprintf("%d_%d_%s_%d_%s_%d.pcap", entry.SessionID, entry.Protocol, entry.Client, entry.ClientPort, entry.Server, entry.ServerPort)
+	entry.Filename = filepath.Join(config.Directory, strings.Replace(name, ":", "-", -1))
+
+	capture, err := openSessionCapture(entry, running)
+	if err != nil {
+		logger.Warn("%OC|Unable to capture session %d: %v\n", "session_capture_failure", 10, entry.SessionID, err)
+		return nil
+	}
+
+	sessionCaptureMutex.Lock()
+	defer sessionCaptureMutex.Unlock()
+
+	// the capture may have been stopped or filled while the file was created
+	if running.stopped || len(running.entries) >= config.MaxSessions {
+		go capture.close()
+		return nil
+	}
+	running.entries[entry.SessionID] = entry
+	running.captures[entry.SessionID] = capture
+	return capture
+}
+
+// openSessionCapture creates the file of a captured session and writes the
+// pcap header, through the encryption when it is enabled
+func openSessionCapture(entry *SessionCaptureEntry, running *sessionCaptureRun) (*sessionCapture, error) {
+	file, err := os.OpenFile(entry.Filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	capture := &sessionCapture{
+		entry:   entry,
+		file:    file,
+		writer:  file,
+		config:  running.protect,
+		limit:   running.config.PacketLimit,
+		running: running,
+	}
+
+	if capture.config.encrypt {
+		reader, writer := io.Pipe()
+		capture.pipe = writer
+		capture.writer = writer
+		capture.done = make(chan error, 1)
+		go func() {
+			err := encryptCapture(reader, file, capture.config.key)
+			reader.CloseWithError(err)
+			capture.done <- err
+		}()
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagicNano)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkRaw)
+	if _, err = capture.writer.Write(header); err != nil {
+		capture.close()
+		return nil, err
+	}
+	return capture, nil
+}
+
+// write adds a packet to the capture of a session and returns true while the
+// session should stay in nfqueue to be captured
+func (capture *sessionCapture) write(packet []byte) bool {
+	capture.mutex.Lock()
+	if capture.closed {
+		capture.mutex.Unlock()
+		return false
+	}
+
+	now := time.Now()
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(now.Nanosecond()))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(packet)))
+	record = append(record, packet...)
+
+	_, err := capture.writer.Write(record)
+
+	sessionCaptureMutex.Lock()
+	capture.entry.Packets++
+	capture.entry.Bytes += uint64(len(packet))
+	full := capture.entry.Packets >= capture.limit
+	sessionCaptureMutex.Unlock()
+	capture.mutex.Unlock()
+
+	if err != nil {
+		logger.Warn("%OC|Unable to capture session %d: %v\n", "session_capture_failure", 10, capture.entry.SessionID, err)
+	}
+	if err != nil || full {
+		capture.close()
+		return false
+	}
+	return true
+}
+
+// close finishes the file of a captured session and signs it when signing is enabled
+func (capture *sessionCapture) close() {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	if capture.closed {
+		return
+	}
+	capture.closed = true
+
+	var err error
+	if capture.pipe != nil {
+		capture.pipe.Close()
+		err = <-capture.done
+	}
+	if closeErr := capture.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && capture.config.sign {
+		err = signCaptureFile(capture.entry.Filename, capture.config.privateKey)
+	}
+	if err != nil {
+		logger.Warn("%OC|Unable to finish session capture %s: %v\n", "session_capture_failure", 10, capture.entry.Filename, err)
+	}
+
+	sessionCaptureMutex.Lock()
+	capture.entry.Finished = true
+	delete(capture.running.captures, capture.entry.SessionID)
+	sessionCaptureMutex.Unlock()
+}
+
+// closeSessionCapture closes the capture of a session that ended
+func closeSessionCapture(conntrack *Conntrack) {
+	if conntrack == nil || conntrack.Session == nil {
+		return
+	}
+	if capture, ok := conntrack.Session.GetAttachment(sessionCaptureAttachment).(*sessionCapture); ok {
+		capture.close()
+	}
+}
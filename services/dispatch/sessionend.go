@@ -0,0 +1,140 @@
+package dispatch
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/reports"
+)
+
+// The reasons a session ended that are logged in the session_end event
+const (
+	endReasonFIN      = "fin"
+	endReasonRST      = "rst"
+	endReasonTimeout  = "timeout"
+	endReasonEviction = "eviction"
+	endReasonShutdown = "shutdown"
+)
+
+// The conntrack TCP states we use to find why a TCP session ended
+const (
+	tcpStateFinWait  = 4
+	tcpStateTimeWait = 7
+	tcpStateClose    = 8
+)
+
+// getEndReason returns why a session ended from the protocol and the last
+// TCP state of a conntrack delete event. A reset moves the state to CLOSE and
+// a FIN moves it somewhere between FIN_WAIT and TIME_WAIT. Anything else,
+// including every session that isn't TCP, ended because it timed out.
+func getEndReason(protocol uint8, tcpState uint8) string {
+	if protocol != syscall.IPPROTO_TCP {
+		return endReasonTimeout
+	}
+
+	switch {
+	case tcpState == tcpStateClose:
+		return endReasonRST
+	case tcpState >= tcpStateFinWait && tcpState <= tcpStateTimeWait:
+		return endReasonFIN
+	}
+
+	return endReasonTimeout
+}
+
+// setFinalCounters updates the conntrack with the counters and timestamps from
+// the delete event. The counters are zero when the event doesn't include them
+// so we only ever move them forward.
+func setFinalCounters(conntrack *Conntrack, clientBytes uint64, serverBytes uint64, clientPackets uint64, serverPackets uint64, timestampStart uint64, timestampStop uint64) {
+	conntrack.Guardian.Lock()
+	defer conntrack.Guardian.Unlock()
+
+	if clientBytes > conntrack.ClientBytes {
+		conntrack.ClientBytes = clientBytes
+	}
+	if serverBytes > conntrack.ServerBytes {
+		conntrack.ServerBytes = serverBytes
+	}
+	if clientPackets > conntrack.ClientPackets {
+		conntrack.ClientPackets = clientPackets
+	}
+	if serverPackets > conntrack.ServerPackets {
+		conntrack.ServerPackets = serverPackets
+	}
+	conntrack.TotalBytes = conntrack.ClientBytes + conntrack.ServerBytes
+	conntrack.TotalPackets = conntrack.ClientPackets + conntrack.ServerPackets
+
+	if timestampStart != 0 {
+		conntrack.TimestampStart = timestampStart
+	}
+	if timestampStop != 0 {
+		conntrack.TimestampStop = timestampStop
+	}
+}
+
+// reportSessionEnd logs the session_end and TCP health events, publishes the session.end
+// event, and closes the capture of the session
+func reportSessionEnd(conntrack *Conntrack, reason string) {
+	logSessionEnd(conntrack, reason)
+	logTCPHealth(conntrack)
+	publishSessionEnd(conntrack, reason)
+	closeSessionCapture(conntrack)
+}
+
+// logSessionEnd updates the session in the reports with the end time, the
+// traffic totals, the duration, and the reason the session ended. The totals
+// use a prefix so they don't collide with the session_stats columns in joins.
+func logSessionEnd(conntrack *Conntrack, reason string) {
+	if conntrack == nil || conntrack.Session == nil {
+		return
+	}
+
+	conntrack.Guardian.RLock()
+	defer conntrack.Guardian.RUnlock()
+
+	now := time.Now()
+	columns := map[string]interface{}{
+		"session_id": conntrack.SessionID,
+	}
+	modifiedColumns := map[string]interface{}{
+		"end_time":             now,
+		"end_reason":           reason,
+		"duration":             getSessionDuration(conntrack, now).Seconds(),
+		"total_bytes":          conntrack.TotalBytes,
+		"total_client_bytes":   conntrack.ClientBytes,
+		"total_server_bytes":   conntrack.ServerBytes,
+		"total_packets":        conntrack.TotalPackets,
+		"total_client_packets": conntrack.ClientPackets,
+		"total_server_packets": conntrack.ServerPackets,
+	}
+	reports.LogEvent(reports.CreateEvent("session_end", "sessions", 2, columns, modifiedColumns))
+}
+
+// getSessionDuration returns how long the session lasted. We use the conntrack
+// timestamps when the kernel has them enabled since they are exact, otherwise
+// the time from when we first saw the session. The caller must hold the
+// Guardian lock of the conntrack.
+func getSessionDuration(conntrack *Conntrack, now time.Time) time.Duration {
+	if conntrack.TimestampStart != 0 && conntrack.TimestampStop > conntrack.TimestampStart {
+		return time.Duration(conntrack.TimestampStop - conntrack.TimestampStart)
+	}
+	if conntrack.Session != nil {
+		return now.Sub(conntrack.Session.GetCreationTime())
+	}
+	return now.Sub(conntrack.CreationTime)
+}
+
+// endAllSessions logs the end of every session we are tracking when packetd is shutting down
+func endAllSessions() {
+	var list []*Conntrack
+
+	conntrackTableMutex.Lock()
+	for _, conntrack := range conntrackTable {
+		list = append(list, conntrack)
+	}
+	conntrackTableMutex.Unlock()
+
+	for _, conntrack := range list {
+		reportSessionEnd(conntrack, endReasonShutdown)
+	}
+}
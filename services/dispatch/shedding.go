@@ -0,0 +1,106 @@
+package dispatch
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The shedding levels used to reduce memory usage when it gets close to the
+// limit. Each level includes everything done at the lower levels.
+const (
+	// ShedNone is normal operation
+	ShedNone = 0
+	// ShedCaches asks the services and plugins to empty their caches
+	ShedCaches = 1
+	// ShedSessions shortens the time idle sessions are kept in the session table
+	ShedSessions = 2
+	// ShedBypass bypasses sessions after only a few packets
+	ShedBypass = 3
+)
+
+// the number of packets we look at before bypassing a session at the ShedBypass level
+const shedBypassPackets = 8
+
+// ShedderFunction is called with the new level when the shedding level changes
+type ShedderFunction func(level int)
+
+var shedLevel int32
+var shedderList = make(map[string]ShedderFunction)
+var shedderMutex sync.Mutex
+
+// InsertShedder adds a function that is called when the shedding level changes
+func InsertShedder(owner string, function ShedderFunction) {
+	logger.Info("Adding Shedder (%s)\n", owner)
+
+	shedderMutex.Lock()
+	shedderList[owner] = function
+	shedderMutex.Unlock()
+}
+
+// RemoveShedder removes the shedder function for the argumented owner
+func RemoveShedder(owner string) {
+	shedderMutex.Lock()
+	delete(shedderList, owner)
+	shedderMutex.Unlock()
+}
+
+// GetShedLevel returns the current shedding level
+func GetShedLevel() int {
+	return int(atomic.LoadInt32(&shedLevel))
+}
+
+// GetShedLevelName returns the name of a shedding level
+func GetShedLevelName(level int) string {
+	switch level {
+	case ShedNone:
+		return "none"
+	case ShedCaches:
+		return "caches"
+	case ShedSessions:
+		return "sessions"
+	case ShedBypass:
+		return "bypass"
+	}
+	return "unknown"
+}
+
+// SetShedLevel sets the shedding level and calls all the shedder functions
+// when it changes. The shedders are called in owner order so the log is easy
+// to follow, and are also called when the level drops so they can recover.
+func SetShedLevel(level int) {
+	previous := int(atomic.SwapInt32(&shedLevel, int32(level)))
+	if previous == level {
+		return
+	}
+
+	logger.Notice("Shedding level changed from %s to %s\n", GetShedLevelName(previous), GetShedLevelName(level))
+	if level > previous {
+		eventbus.PublishAlert("dispatch", "Shedding level raised to "+GetShedLevelName(level), map[string]interface{}{"level": level, "previous": previous})
+	}
+
+	// the session table is cleaned right away using the shorter timeouts
+	if level >= ShedSessions && previous < ShedSessions {
+		cleanSessionTable()
+	}
+
+	shedderMutex.Lock()
+	var owners []string
+	for owner := range shedderList {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	functions := make([]ShedderFunction, len(owners))
+	for i, owner := range owners {
+		functions[i] = shedderList[owner]
+	}
+	shedderMutex.Unlock()
+
+	for i, function := range functions {
+		logger.Info("Calling shedder %s for level %s\n", owners[i], GetShedLevelName(level))
+		function(level)
+	}
+}
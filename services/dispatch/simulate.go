@@ -0,0 +1,338 @@
+package dispatch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// pcap file magic numbers for microsecond and nanosecond timestamps
+const pcapMagicMicro = 0xa1b2c3d4
+const pcapMagicNano = 0xa1b23c4d
+
+// pcap link types we know how to handle
+const pcapLinkEthernet = 1
+const pcapLinkRaw = 101
+const pcapLinkLinuxSLL = 113
+const pcapLinkIPv4 = 228
+const pcapLinkIPv6 = 229
+
+// the mark bit set by the kernel rules for the first packet of a session
+const simulateNewSessionMark = 0x10000000
+
+// simulated conntrack ID's start high to stay clear of any real entries
+const simulateConntrackBase = 0x80000000
+
+// simulateFlow tracks a connection found in a pcap file
+type simulateFlow struct {
+	ctid          uint32
+	family        uint8
+	protocol      uint8
+	client        net.IP
+	server        net.IP
+	clientPort    uint16
+	serverPort    uint16
+	clientBytes   uint64
+	serverBytes   uint64
+	clientPackets uint64
+	serverPackets uint64
+	started       time.Time
+	lastUpdate    time.Time
+	finished      bool
+}
+
+// SimulateFile plays back the traffic in a warehouse capture or pcap file
+// through the nfqueue and conntrack handlers, in place of the kernel hooks.
+// The speed is a percentage of the original capture speed, with zero
+// meaning as fast as possible. It returns when playback is finished.
+func SimulateFile(filename string, speed int) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	var magic uint32
+	err = binary.Read(file, binary.LittleEndian, &magic)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	cleanupMutex.Lock()
+	defer cleanupMutex.Unlock()
+	nfCleanupList = make(map[uint32]bool)
+	ctCleanupList = make(map[uint32]bool)
+
+	switch magic {
+	case pcapMagicMicro, pcapMagicNano, swapUint32(pcapMagicMicro), swapUint32(pcapMagicNano):
+		logger.Info("Simulating traffic from pcap file %s speed %d%%\n", filename, speed)
+		kernel.SetWarehouseSpeed(speed)
+		return simulatePcap(filename)
+	}
+
+	playfile, finished, err := openPlaybackFile(filename)
+	if err != nil {
+		return err
+	}
+	defer finished()
+
+	logger.Info("Simulating traffic from warehouse file %s speed %d%%\n", filename, speed)
+	kernel.SetWarehouseFile(playfile)
+	kernel.SetWarehouseSpeed(speed)
+	kernel.SetWarehouseFlag('P')
+	kernel.WarehousePlaybackFile(nfCleanupList, ctCleanupList)
+	return nil
+}
+
+// simulatePcap plays back the packets in a pcap file. Since a pcap file has
+// no conntrack details we track the connections ourselves and create the
+// conntrack new, update, and destroy events the kernel would have sent.
+func simulatePcap(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := make([]byte, 24)
+	_, err = io.ReadFull(file, header)
+	if err != nil {
+		return err
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(header[0:4])
+	if magic == swapUint32(pcapMagicMicro) || magic == swapUint32(pcapMagicNano) {
+		order = binary.BigEndian
+		magic = swapUint32(magic)
+	}
+
+	nanoFlag := (magic == pcapMagicNano)
+	linkType := order.Uint32(header[20:24])
+
+	switch linkType {
+	case pcapLinkEthernet, pcapLinkRaw, pcapLinkLinuxSLL, pcapLinkIPv4, pcapLinkIPv6:
+	default:
+		return fmt.Errorf("unsupported pcap link type %d", linkType)
+	}
+
+	flowTable := make(map[string]*simulateFlow)
+	updateInterval := time.Duration(conntrackIntervalSeconds) * time.Second
+	ctidIndex := uint32(simulateConntrackBase)
+	record := make([]byte, 16)
+	var lastFrame time.Time
+	var packetCount int
+
+	kernel.ResetWarehousePosition()
+
+	for !kernel.GetShutdownFlag() {
+		_, err = io.ReadFull(file, record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		seconds := int64(order.Uint32(record[0:4]))
+		fraction := int64(order.Uint32(record[4:8]))
+		captured := order.Uint32(record[8:12])
+
+		if !nanoFlag {
+			fraction = fraction * 1000
+		}
+		frameTime := time.Unix(seconds, fraction)
+
+		data := make([]byte, captured)
+		_, err = io.ReadFull(file, data)
+		if err != nil {
+			return err
+		}
+
+		// while paused the packets are only played one step at a time
+		stepping := kernel.GetWarehousePaused()
+		if !kernel.WaitWarehouseStep() {
+			break
+		}
+
+		// the speed can be changed while the simulation is running
+		speed := kernel.GetWarehouseSpeed()
+		if !stepping && speed > 0 && !lastFrame.IsZero() && frameTime.After(lastFrame) {
+			time.Sleep(frameTime.Sub(lastFrame) * 100 / time.Duration(speed))
+		}
+		lastFrame = frameTime
+
+		packet, vlanid := decodePcapPacket(linkType, data)
+		if packet == nil {
+			continue
+		}
+
+		flow, clientToServer, newFlow := findSimulateFlow(flowTable, packet, &ctidIndex)
+		if flow == nil || flow.finished {
+			continue
+		}
+
+		if clientToServer {
+			flow.clientPackets++
+			flow.clientBytes += uint64(len(packet.Data()))
+		} else {
+			flow.serverPackets++
+			flow.serverBytes += uint64(len(packet.Data()))
+		}
+
+		var mark uint32
+		if newFlow {
+			mark = simulateNewSessionMark
+			flow.started = frameTime
+			flow.lastUpdate = frameTime
+		}
+
+		nfCleanupList[flow.ctid] = true
+		nfqueueCallback(flow.ctid, uint32(flow.family), packet.Data(), mark, 0, vlanid)
+		kernel.SetWarehousePlayed('Q', flow.ctid)
+		packetCount++
+
+		// the kernel sends the new event once the connection is confirmed after the first packet
+		if newFlow {
+			simulateConntrack(flow, 'N', frameTime)
+		} else if frameTime.Sub(flow.lastUpdate) >= updateInterval {
+			simulateConntrack(flow, 'U', frameTime)
+			flow.lastUpdate = frameTime
+		}
+
+		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil && tcpLayer.(*layers.TCP).RST {
+			simulateConntrack(flow, 'D', frameTime)
+			flow.finished = true
+		}
+	}
+
+	// everything still open at the end of the capture gets a final update and destroy
+	for _, flow := range flowTable {
+		if flow.finished {
+			continue
+		}
+		simulateConntrack(flow, 'U', lastFrame)
+		simulateConntrack(flow, 'D', lastFrame)
+	}
+
+	logger.Info("Finished pcap simulation packets:%d sessions:%d\n", packetCount, len(flowTable))
+	return nil
+}
+
+// findSimulateFlow returns the flow for a packet, creating a new one if the
+// packet doesn't match an existing flow in either direction
+func findSimulateFlow(flowTable map[string]*simulateFlow, packet gopacket.Packet, ctidIndex *uint32) (*simulateFlow, bool, bool) {
+	var protocol uint8
+	var family uint8
+	var srcAddr, dstAddr net.IP
+	var srcPort, dstPort uint16
+
+	if ip4 := packet.Layer(layers.LayerTypeIPv4); ip4 != nil {
+		layer := ip4.(*layers.IPv4)
+		protocol = uint8(layer.Protocol)
+		srcAddr, dstAddr = layer.SrcIP, layer.DstIP
+		family = syscall.AF_INET
+	} else if ip6 := packet.Layer(layers.LayerTypeIPv6); ip6 != nil {
+		layer := ip6.(*layers.IPv6)
+		protocol = uint8(layer.NextHeader)
+		srcAddr, dstAddr = layer.SrcIP, layer.DstIP
+		family = syscall.AF_INET6
+	} else {
+		return nil, false, false
+	}
+
+	if tcp := packet.Layer(layers.LayerTypeTCP); tcp != nil {
+		srcPort, dstPort = uint16(tcp.(*layers.TCP).SrcPort), uint16(tcp.(*layers.TCP).DstPort)
+	} else if udp := packet.Layer(layers.LayerTypeUDP); udp != nil {
+		srcPort, dstPort = uint16(udp.(*layers.UDP).SrcPort), uint16(udp.(*layers.UDP).DstPort)
+	}
+
+	forward := fmt.Sprintf("%d|%s|%d|%s|%d", protocol, srcAddr, srcPort, dstAddr, dstPort)
+	if flow, found := flowTable[forward]; found {
+		return flow, true, false
+	}
+
+	reverse := fmt.Sprintf("%d|%s|%d|%s|%d", protocol, dstAddr, dstPort, srcAddr, srcPort)
+	if flow, found := flowTable[reverse]; found {
+		return flow, false, false
+	}
+
+	*ctidIndex++
+	flow := &simulateFlow{
+		ctid:       *ctidIndex,
+		family:     family,
+		protocol:   protocol,
+		client:     dupIP(srcAddr),
+		server:     dupIP(dstAddr),
+		clientPort: srcPort,
+		serverPort: dstPort,
+	}
+	flowTable[forward] = flow
+	return flow, true, true
+}
+
+// simulateConntrack passes a conntrack event for the flow to the conntrack handler
+func simulateConntrack(flow *simulateFlow, eventType uint8, when time.Time) {
+	var stop uint64
+
+	if eventType == 'D' {
+		stop = uint64(when.UnixNano())
+	}
+
+	ctCleanupList[flow.ctid] = true
+	conntrackCallback(flow.ctid, 0, flow.family, eventType, flow.protocol,
+		flow.client, flow.server, flow.clientPort, flow.serverPort,
+		flow.client, flow.server, flow.clientPort, flow.serverPort,
+		flow.clientBytes, flow.serverBytes, flow.clientPackets, flow.serverPackets,
+		uint64(flow.started.UnixNano()), stop, 120, 0)
+}
+
+// decodePcapPacket strips the link layer from a pcap frame and returns the IP packet
+// and the VLAN ID of the outer 802.1Q tag
+func decodePcapPacket(linkType uint32, data []byte) (gopacket.Packet, uint16) {
+	var offset int
+	var vlanid uint16
+
+	switch linkType {
+	case pcapLinkEthernet:
+		offset = 14
+		// skip over any VLAN tags, keeping the VLAN ID from the outer tag
+		for len(data) >= offset+2 && binary.BigEndian.Uint16(data[offset-2:offset]) == 0x8100 {
+			if vlanid == 0 {
+				vlanid = binary.BigEndian.Uint16(data[offset:offset+2]) & 0x0FFF
+			}
+			offset += 4
+		}
+	case pcapLinkLinuxSLL:
+		offset = 16
+	}
+
+	if len(data) <= offset {
+		return nil, 0
+	}
+
+	data = data[offset:]
+
+	switch data[0] & 0xF0 {
+	case 0x40:
+		return gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default), vlanid
+	case 0x60:
+		return gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default), vlanid
+	}
+
+	return nil, 0
+}
+
+// swapUint32 reverses the byte order of a uint32
+func swapUint32(value uint32) uint32 {
+	return (value>>24)&0xFF | (value>>8)&0xFF00 | (value<<8)&0xFF0000 | (value<<24)&0xFF000000
+}
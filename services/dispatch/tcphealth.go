@@ -0,0 +1,198 @@
+package dispatch
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the session attachment that holds the TCP health tracking
+const tcpHealthAttachment = "tcp_health"
+
+// TCPHealthConfig holds the TCP health settings. When enabled the sequence
+// numbers, acknowledgements, and windows of TCP sessions are followed to count
+// retransmissions, duplicate ACKs, and zero window events, which are logged with
+// the session when it ends. Every packet of a tracked session goes through
+// userspace, so a non-zero PacketLimit releases the session after that many packets.
+type TCPHealthConfig struct {
+	Enabled     bool   `json:"enabled"`
+	PacketLimit uint64 `json:"packetLimit"`
+}
+
+// tcpDirection holds the tracking for one direction of a TCP session
+type tcpDirection struct {
+	started    bool
+	nextSeq    uint32
+	acked      bool
+	lastAck    uint32
+	lastWindow uint16
+	zeroWindow bool
+}
+
+// tcpHealth holds the tracking and the counters for a TCP session
+type tcpHealth struct {
+	mutex           sync.Mutex
+	client          tcpDirection
+	server          tcpDirection
+	retransmissions uint64
+	duplicateAcks   uint64
+	zeroWindows     uint64
+}
+
+var tcpHealthConfig atomic.Value
+
+// loadTCPHealth loads the TCP health settings
+func loadTCPHealth() {
+	config := loadTCPHealthConfig()
+	tcpHealthConfig.Store(config)
+	logger.Info("Loaded TCP health tracking enabled:%v packetLimit:%d\n", config.Enabled, config.PacketLimit)
+}
+
+// tcpHealthHandler is the nfqueue subscription that follows TCP sessions to
+// count the retransmissions, duplicate ACKs, and zero window events
+func tcpHealthHandler(mess NfqueueMessage, ctid uint32, newSession bool) NfqueueResult {
+	var result NfqueueResult
+	result.SessionRelease = true
+
+	config, _ := tcpHealthConfig.Load().(TCPHealthConfig)
+	session := mess.Session
+	if !config.Enabled || session == nil || mess.TCPLayer == nil {
+		return result
+	}
+	if config.PacketLimit != 0 && session.GetPacketCount() > config.PacketLimit {
+		return result
+	}
+
+	health, _ := session.GetAttachment(tcpHealthAttachment).(*tcpHealth)
+	if health == nil {
+		health = new(tcpHealth)
+		session.PutAttachment(tcpHealthAttachment, health)
+	}
+
+	health.track(mess)
+	result.SessionRelease = false
+	return result
+}
+
+// track updates the tracking and the counters with a packet
+func (health *tcpHealth) track(mess NfqueueMessage) {
+	tcp := mess.TCPLayer
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	side := &health.server
+	if mess.ClientToServer {
+		side = &health.client
+	}
+
+	// the SYN and FIN flags use a sequence number like a byte of data
+	length := uint32(len(mess.Payload))
+	if tcp.SYN {
+		length++
+	}
+	if tcp.FIN {
+		length++
+	}
+
+	// a segment that ends at or before the highest sequence already sent is a retransmission
+	if length != 0 {
+		end := tcp.Seq + length
+		if side.started && !sequenceAfter(end, side.nextSeq) {
+			health.retransmissions++
+		} else {
+			side.nextSeq = end
+			side.started = true
+		}
+	}
+
+	if tcp.RST {
+		return
+	}
+
+	// a pure ACK that repeats the last acknowledgement and window is a duplicate
+	if tcp.ACK {
+		if length == 0 && side.acked && tcp.Ack == side.lastAck && tcp.Window == side.lastWindow {
+			health.duplicateAcks++
+		}
+		side.acked = true
+		side.lastAck = tcp.Ack
+		side.lastWindow = tcp.Window
+	}
+
+	// count each time the receiver closes the window rather than every packet while it is closed
+	if tcp.Window == 0 && !tcp.SYN {
+		if !side.zeroWindow {
+			health.zeroWindows++
+		}
+		side.zeroWindow = true
+	} else {
+		side.zeroWindow = false
+	}
+}
+
+// logTCPHealth updates the session in the reports with the TCP health counters
+func logTCPHealth(conntrack *Conntrack) {
+	if conntrack == nil || conntrack.Session == nil {
+		return
+	}
+
+	health, _ := conntrack.Session.GetAttachment(tcpHealthAttachment).(*tcpHealth)
+	if health == nil {
+		return
+	}
+
+	health.mutex.Lock()
+	retransmissions := health.retransmissions
+	duplicateAcks := health.duplicateAcks
+	zeroWindows := health.zeroWindows
+	health.mutex.Unlock()
+
+	overseer.AddCounter("tcp_health_retransmissions", retransmissions)
+	overseer.AddCounter("tcp_health_duplicate_acks", duplicateAcks)
+	overseer.AddCounter("tcp_health_zero_windows", zeroWindows)
+
+	columns := map[string]interface{}{
+		"session_id": conntrack.Session.GetSessionID(),
+	}
+	modifiedColumns := map[string]interface{}{
+		"retransmissions": retransmissions,
+		"duplicate_acks":  duplicateAcks,
+		"zero_windows":    zeroWindows,
+	}
+	reports.LogEvent(reports.CreateEvent("session_tcp_health", "sessions", 2, columns, modifiedColumns))
+}
+
+// sequenceAfter returns true if sequence number a comes after b, allowing for wraparound
+func sequenceAfter(a uint32, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// loadTCPHealthConfig loads the TCP health settings
+func loadTCPHealthConfig() TCPHealthConfig {
+	var result TCPHealthConfig
+
+	healthJSON, err := settings.GetCurrentSettings([]string{"dispatch", "tcpHealth"})
+	if healthJSON == nil || err != nil {
+		return result
+	}
+
+	item, ok := healthJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid TCP health settings: %T\n", healthJSON)
+		return result
+	}
+
+	if value, ok := item["enabled"].(bool); ok {
+		result.Enabled = value
+	}
+	if value, ok := item["packetLimit"].(float64); ok && value > 0 {
+		result.PacketLimit = uint64(value)
+	}
+
+	return result
+}
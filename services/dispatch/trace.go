@@ -0,0 +1,334 @@
+package dispatch
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The dispatch trace is an opt-in debugging mode that records every decision
+// made for the packets of the traced sessions: the session lookup result, the
+// plugins called with their results and durations, the fields written to the
+// session dictionary, and the verdict. A trace follows a single ctid, or the
+// new sessions that match a filter of the session fields the session capture
+// uses. Packets that never get a session, like the mid-session packets that
+// are bypassed or dropped, can only be traced by ctid.
+
+// the session attachment that marks a session that matched the trace filter
+const traceAttachment = "dispatch_trace"
+
+// the defaults of the dispatch trace
+const defaultTracePackets = 1000
+const defaultTraceSessions = 10
+
+// TraceConfig holds the options of a dispatch trace
+type TraceConfig struct {
+	ConntrackID uint32            `json:"conntrackId"`
+	Filter      map[string]string `json:"filter"`
+	MaxPackets  int               `json:"maxPackets"`
+	MaxSessions int               `json:"maxSessions"`
+}
+
+// TracePlugin is the result of a subscriber called for a traced packet
+type TracePlugin struct {
+	Owner    string  `json:"owner"`
+	Priority int     `json:"priority"`
+	Duration float64 `json:"duration"`
+	Release  bool    `json:"release"`
+	Drop     bool    `json:"drop"`
+	Timeout  bool    `json:"timeout"`
+}
+
+// TraceWrite is a session dictionary field written for a traced packet
+type TraceWrite struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+// TracePacket holds the decisions made for a traced packet
+type TracePacket struct {
+	Time           time.Time     `json:"time"`
+	ConntrackID    uint32        `json:"conntrackId"`
+	SessionID      int64         `json:"sessionId"`
+	Tuple          string        `json:"tuple"`
+	Length         int           `json:"length"`
+	ClientToServer bool          `json:"clientToServer"`
+	NewSession     bool          `json:"newSession"`
+	Private        bool          `json:"private"`
+	Lookup         string        `json:"lookup"`
+	Plugins        []TracePlugin `json:"plugins"`
+	Writes         []TraceWrite  `json:"writes"`
+	Decision       string        `json:"decision"`
+	Verdict        string        `json:"verdict"`
+	Duration       float64       `json:"duration"`
+}
+
+// TraceStatus holds the trace options and the traced packets
+type TraceStatus struct {
+	Running  bool          `json:"running"`
+	Config   TraceConfig   `json:"config"`
+	Sessions int           `json:"sessions"`
+	Dropped  uint64        `json:"dropped"`
+	Packets  []TracePacket `json:"packets"`
+}
+
+// traceRun holds a started dispatch trace
+type traceRun struct {
+	config   TraceConfig
+	sessions map[int64]bool
+	packets  []TracePacket
+	dropped  uint64
+	stopped  bool
+}
+
+// packetTrace collects the decisions for a packet while it is dispatched
+type packetTrace struct {
+	mutex    sync.Mutex
+	run      *traceRun
+	record   TracePacket
+	started  int64
+	matched  bool
+	finished bool
+}
+
+var traceState *traceRun
+var traceMutex sync.Mutex
+
+// traceActive is checked for every packet so it is kept apart from the state
+var traceActive int32
+
+// traceFlight holds the packet trace of each ctid being dispatched so the
+// dictionary writes can be added to it
+var traceFlight sync.Map
+
+// StartTrace starts tracing the packets of the ctid or of the new sessions
+// that match the filter, replacing the packets of the previous trace
+func StartTrace(config TraceConfig) error {
+	if config.ConntrackID == 0 && len(config.Filter) == 0 {
+		return errors.New("a conntrack ID or a filter is required")
+	}
+	if config.MaxPackets <= 0 {
+		config.MaxPackets = defaultTracePackets
+	}
+	if config.MaxSessions <= 0 {
+		config.MaxSessions = defaultTraceSessions
+	}
+	for field := range config.Filter {
+		if _, ok := sessionCaptureFields[field]; !ok {
+			return fmt.Errorf("unknown filter field %s", field)
+		}
+	}
+
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
+	if traceState != nil && !traceState.stopped {
+		return errors.New("a trace is already running")
+	}
+
+	traceState = &traceRun{
+		config:   config,
+		sessions: make(map[int64]bool),
+	}
+	dict.SetSessionObserver(traceDictWrite)
+	atomic.StoreInt32(&traceActive, 1)
+
+	logger.Info("Beginning dispatch trace ctid:%d filter:%v packets:%d sessions:%d\n", config.ConntrackID, config.Filter, config.MaxPackets, config.MaxSessions)
+	return nil
+}
+
+// StopTrace stops the dispatch trace, keeping the traced packets until the next trace is started
+func StopTrace() {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
+	if traceState == nil || traceState.stopped {
+		return
+	}
+
+	atomic.StoreInt32(&traceActive, 0)
+	dict.SetSessionObserver(nil)
+	traceState.stopped = true
+
+	logger.Info("Finished dispatch trace packets:%d sessions:%d\n", len(traceState.packets), len(traceState.sessions))
+}
+
+// GetTraceStatus returns the options of the dispatch trace and the traced packets
+func GetTraceStatus() TraceStatus {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
+	status := TraceStatus{Packets: []TracePacket{}}
+	if traceState == nil {
+		return status
+	}
+
+	status.Running = !traceState.stopped
+	status.Config = traceState.config
+	status.Sessions = len(traceState.sessions)
+	status.Dropped = traceState.dropped
+	status.Packets = append(status.Packets, traceState.packets...)
+	return status
+}
+
+// beginPacketTrace returns the trace for a packet while a dispatch trace is
+// running, or nil otherwise. All of the packetTrace functions can be called
+// with nil so the dispatch code doesn't need to check.
+func beginPacketTrace(ctid uint32, mess *NfqueueMessage, newSession bool) *packetTrace {
+	if atomic.LoadInt32(&traceActive) == 0 {
+		return nil
+	}
+
+	traceMutex.Lock()
+	run := traceState
+	traceMutex.Unlock()
+
+	if run == nil || run.stopped {
+		return nil
+	}
+
+	trace := &packetTrace{
+		run:     run,
+		started: getMicroseconds(),
+		matched: (run.config.ConntrackID != 0 && run.config.ConntrackID == ctid),
+	}
+	trace.record.Time = time.Now()
+	trace.record.ConntrackID = ctid
+	trace.record.Tuple = mess.MsgTuple.String()
+	trace.record.Length = mess.Length
+	trace.record.NewSession = newSession
+	trace.record.Plugins = []TracePlugin{}
+	trace.record.Writes = []TraceWrite{}
+
+	traceFlight.Store(ctid, trace)
+	return trace
+}
+
+// setLookup records the result of the session table lookup
+func (trace *packetTrace) setLookup(lookup string) {
+	if trace == nil {
+		return
+	}
+	trace.mutex.Lock()
+	trace.record.Lookup = lookup
+	trace.mutex.Unlock()
+}
+
+// setSession records the session of the packet and checks if the session
+// matches the trace filter. The filter is only checked for new sessions.
+func (trace *packetTrace) setSession(session *Session, mess NfqueueMessage, newSession bool) {
+	if trace == nil {
+		return
+	}
+
+	trace.mutex.Lock()
+	trace.record.SessionID = session.GetSessionID()
+	trace.record.ClientToServer = mess.ClientToServer
+	trace.record.NewSession = newSession
+	trace.record.Private = session.IsPrivate()
+	trace.mutex.Unlock()
+
+	if trace.matched {
+		return
+	}
+
+	if run, _ := session.GetAttachment(traceAttachment).(*traceRun); run == trace.run {
+		trace.matched = true
+		return
+	}
+
+	if !newSession || len(trace.run.config.Filter) == 0 {
+		return
+	}
+
+	for field, value := range trace.run.config.Filter {
+		if found, ok := GetSessionField(mess, field); !ok || found != value {
+			return
+		}
+	}
+
+	traceMutex.Lock()
+	if trace.run.stopped || len(trace.run.sessions) >= trace.run.config.MaxSessions {
+		traceMutex.Unlock()
+		return
+	}
+	trace.run.sessions[session.GetSessionID()] = true
+	traceMutex.Unlock()
+
+	session.PutAttachment(traceAttachment, trace.run)
+	trace.matched = true
+}
+
+// addPlugin records the result of a subscriber
+func (trace *packetTrace) addPlugin(plugin TracePlugin) {
+	if trace == nil {
+		return
+	}
+	trace.mutex.Lock()
+	trace.record.Plugins = append(trace.record.Plugins, plugin)
+	trace.mutex.Unlock()
+}
+
+// finish records the decision and verdict for the packet and adds it to the
+// trace if it matched. Only the first call for a packet is recorded so the
+// specific decisions can be made before the general one.
+func (trace *packetTrace) finish(decision string, verdict int) {
+	if trace == nil {
+		return
+	}
+
+	trace.mutex.Lock()
+	if trace.finished {
+		trace.mutex.Unlock()
+		return
+	}
+	trace.finished = true
+	trace.record.Decision = decision
+	if verdict == NfDrop {
+		trace.record.Verdict = "drop"
+	} else {
+		trace.record.Verdict = "accept"
+	}
+	trace.record.Duration = (float64(getMicroseconds()-trace.started) / 1000.0)
+	trace.mutex.Unlock()
+
+	traceFlight.CompareAndDelete(trace.record.ConntrackID, trace)
+
+	if !trace.matched {
+		return
+	}
+
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
+	if trace.run.stopped {
+		return
+	}
+	if len(trace.run.packets) >= trace.run.config.MaxPackets {
+		trace.run.dropped++
+		return
+	}
+	trace.mutex.Lock()
+	trace.run.packets = append(trace.run.packets, trace.record)
+	trace.mutex.Unlock()
+}
+
+// traceDictWrite is the dict session observer that adds the fields written
+// for a ctid to the trace of the packet being dispatched for it
+func traceDictWrite(ctid uint32, field string, value interface{}) {
+	item, found := traceFlight.Load(ctid)
+	if !found {
+		return
+	}
+	trace := item.(*packetTrace)
+	trace.mutex.Lock()
+	if !trace.finished {
+		trace.record.Writes = append(trace.record.Writes, TraceWrite{Field: field, Value: fmt.Sprintf("%v", value)})
+	}
+	trace.mutex.Unlock()
+}
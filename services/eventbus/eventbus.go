@@ -0,0 +1,219 @@
+// Package eventbus provides a lightweight publish and subscribe bus inside
+// packetd. Dispatch, the services, and the plugins publish events like
+// session lifecycle, device discovery, WAN state, and alerts, and the sinks
+// (the API event stream, webhooks, and reports) subscribe to the topics they
+// want without the producers knowing who is listening. Publishing never
+// blocks. If a subscriber falls behind the events are dropped and counted.
+package eventbus
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The event topics published inside packetd
+const (
+	TopicSessionNew       = "session.new"
+	TopicSessionEnd       = "session.end"
+	TopicSessionConflict  = "session.conflict"
+	TopicDeviceDiscovered = "device.discovered"
+	TopicWanState         = "wan.state"
+	TopicAlert            = "alert"
+	TopicLogin            = "auth.login"
+	TopicPrefixChange     = "network.prefix"
+)
+
+// the default number of events queued for a subscriber
+const defaultBufferSize = 256
+
+// Event is a single event published on the bus
+type Event struct {
+	Topic  string                 `json:"topic"`
+	Source string                 `json:"source"`
+	Time   time.Time              `json:"time"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+// Subscription receives the events for a list of topics. A topic ending with
+// .* matches every topic with that prefix and * matches everything.
+type Subscription struct {
+	name      string
+	topics    []string
+	channel   chan Event
+	delivered uint64
+	dropped   uint64
+}
+
+// SubscriberStatus holds the counters for a subscription
+type SubscriberStatus struct {
+	Name      string   `json:"name"`
+	Topics    []string `json:"topics"`
+	Queued    int      `json:"queued"`
+	Capacity  int      `json:"capacity"`
+	Delivered uint64   `json:"delivered"`
+	Dropped   uint64   `json:"dropped"`
+}
+
+// Status holds the published event counts and the subscribers
+type Status struct {
+	Published   map[string]uint64  `json:"published"`
+	Subscribers []SubscriberStatus `json:"subscribers"`
+}
+
+// Publish holds the read lock while sending so a channel can't be closed by
+// Unsubscribe during a send. The sends never block so the lock is held briefly.
+var subscriptionList []*Subscription
+var subscriptionMutex sync.RWMutex
+var publishedTable sync.Map
+
+// Startup is called to handle service startup
+func Startup() {
+	loadWebhooks()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	stopWebhooks()
+}
+
+// Subscribe returns a subscription that receives the events for the argumented
+// topics. A buffer size of zero uses the default.
+func Subscribe(name string, bufferSize int, topics ...string) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+
+	sub := &Subscription{name: name, topics: topics, channel: make(chan Event, bufferSize)}
+
+	subscriptionMutex.Lock()
+	subscriptionList = append(subscriptionList, sub)
+	subscriptionMutex.Unlock()
+
+	logger.Debug("Adding event subscription %s %v\n", name, topics)
+	return sub
+}
+
+// Unsubscribe removes a subscription and closes the event channel
+func Unsubscribe(sub *Subscription) {
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+
+	// the channel is only closed if it was still subscribed so we never close it twice
+	for index, item := range subscriptionList {
+		if item == sub {
+			subscriptionList = append(subscriptionList[:index:index], subscriptionList[index+1:]...)
+			close(sub.channel)
+			logger.Debug("Removing event subscription %s\n", sub.name)
+			return
+		}
+	}
+}
+
+// Events returns the channel that receives the events for the subscription
+func (sub *Subscription) Events() <-chan Event {
+	return sub.channel
+}
+
+// HasSubscribers returns true if anyone is subscribed to the argumented
+// topic. Producers on busy paths can use it to skip building the event.
+func HasSubscribers(topic string) bool {
+	subscriptionMutex.RLock()
+	defer subscriptionMutex.RUnlock()
+
+	for _, sub := range subscriptionList {
+		if sub.matches(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish sends an event to all of the subscribers of the topic
+func Publish(topic string, source string, data map[string]interface{}) {
+	event := Event{Topic: topic, Source: source, Time: time.Now(), Data: data}
+
+	counter, _ := publishedTable.LoadOrStore(topic, new(uint64))
+	atomic.AddUint64(counter.(*uint64), 1)
+
+	subscriptionMutex.RLock()
+	defer subscriptionMutex.RUnlock()
+
+	for _, sub := range subscriptionList {
+		if !sub.matches(topic) {
+			continue
+		}
+		select {
+		case sub.channel <- event:
+			atomic.AddUint64(&sub.delivered, 1)
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			logger.Warn("%OC|Event subscriber %s is full, dropping %s event\n", "eventbus_dropped", 100, sub.name, topic)
+		}
+	}
+}
+
+// PublishAlert publishes an alert with a message and optional details
+func PublishAlert(source string, message string, details map[string]interface{}) {
+	data := map[string]interface{}{"message": message}
+	for key, value := range details {
+		data[key] = value
+	}
+	Publish(TopicAlert, source, data)
+}
+
+// GetStatus returns the published event counts and the subscriber counters
+func GetStatus() Status {
+	status := Status{Published: make(map[string]uint64), Subscribers: []SubscriberStatus{}}
+
+	publishedTable.Range(func(key interface{}, value interface{}) bool {
+		status.Published[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+
+	subscriptionMutex.RLock()
+	for _, sub := range subscriptionList {
+		status.Subscribers = append(status.Subscribers, SubscriberStatus{
+			Name:      sub.name,
+			Topics:    sub.topics,
+			Queued:    len(sub.channel),
+			Capacity:  cap(sub.channel),
+			Delivered: atomic.LoadUint64(&sub.delivered),
+			Dropped:   atomic.LoadUint64(&sub.dropped),
+		})
+	}
+	subscriptionMutex.RUnlock()
+
+	sort.SliceStable(status.Subscribers, func(i, j int) bool {
+		return status.Subscribers[i].Name < status.Subscribers[j].Name
+	})
+
+	return status
+}
+
+// matches returns true if the subscription wants the argumented topic
+func (sub *Subscription) matches(topic string) bool {
+	for _, item := range sub.topics {
+		if MatchTopic(item, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTopic returns true if the topic matches the pattern. A pattern ending
+// with .* matches the prefix and any topic below it, and * matches everything.
+func MatchTopic(pattern string, topic string) bool {
+	if pattern == "*" || pattern == topic {
+		return true
+	}
+	if strings.HasSuffix(pattern, ".*") {
+		prefix := strings.TrimSuffix(pattern, "*")
+		return strings.HasPrefix(topic, prefix) || topic == strings.TrimSuffix(prefix, ".")
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package eventbus
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the default timeout for posting an event to a webhook
+const defaultWebhookTimeout = 5 * time.Second
+
+// webhook posts the events for its topics to a URL as JSON
+type webhook struct {
+	url    string
+	client *http.Client
+	sub    *Subscription
+}
+
+var webhookList []*webhook
+var webhookMutex sync.Mutex
+
+// Reload reloads the webhooks from the settings
+func Reload() {
+	loadWebhooks()
+}
+
+// loadWebhooks replaces the running webhooks with the ones in the settings
+func loadWebhooks() {
+	stopWebhooks()
+
+	webhooksJSON, err := settings.GetCurrentSettings([]string{"eventbus", "webhooks"})
+	if webhooksJSON == nil || err != nil {
+		return
+	}
+
+	webhookSlice, ok := webhooksJSON.([]interface{})
+	if !ok {
+		logger.Warn("Invalid webhook settings: %T\n", webhooksJSON)
+		return
+	}
+
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+
+	for index, value := range webhookSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			logger.Warn("Ignoring invalid webhook %d\n", index)
+			continue
+		}
+		if enabled, found := item["enabled"].(bool); found && !enabled {
+			continue
+		}
+
+		url, _ := item["url"].(string)
+		if url == "" {
+			logger.Warn("Ignoring webhook %d without a url\n", index)
+			continue
+		}
+
+		var topics []string
+		topicSlice, _ := item["topics"].([]interface{})
+		for _, entry := range topicSlice {
+			if topic, ok := entry.(string); ok && topic != "" {
+				topics = append(topics, topic)
+			}
+		}
+		if len(topics) == 0 {
+			topics = []string{"*"}
+		}
+
+		timeout := defaultWebhookTimeout
+		if seconds, ok := item["timeout"].(float64); ok && seconds > 0 {
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+
+		hook := &webhook{url: url, client: &http.Client{Timeout: timeout}}
+		hook.sub = Subscribe("webhook:"+url, 0, topics...)
+		webhookList = append(webhookList, hook)
+		go hook.sender()
+	}
+
+	logger.Info("Loaded %d event webhooks\n", len(webhookList))
+}
+
+// stopWebhooks stops all of the running webhooks
+func stopWebhooks() {
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+
+	for _, hook := range webhookList {
+		Unsubscribe(hook.sub)
+	}
+	webhookList = nil
+}
+
+// sender posts the events for the webhook until the subscription is closed
+func (hook *webhook) sender() {
+	for event := range hook.sub.Events() {
+		body, err := json.Marshal(event)
+		if err != nil {
+			logger.Warn("Unable to encode %s event: %v\n", event.Topic, err)
+			continue
+		}
+
+		response, err := hook.client.Post(hook.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Warn("%OC|Failed to post event to webhook %s: %v\n", "eventbus_webhook_failure", 10, hook.url, err)
+			continue
+		}
+		response.Body.Close()
+
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			logger.Warn("%OC|Webhook %s returned status %d\n", "eventbus_webhook_status", 10, hook.url, response.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Package faults injects delays and errors at a few points in packetd so the
+// degradation behavior can be verified before it happens in the field. The
+// faults are set through the debug API, and only while the faults settings
+// allow it, so a production box can't have faults injected by accident.
+package faults
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the points where faults can be injected
+const (
+	DictWrite      = "dict_write"
+	ReportsInsert  = "reports_insert"
+	ClassifyDaemon = "classify_daemon"
+	PluginHandler  = "plugin_handler"
+)
+
+// the longest delay that can be injected
+const maxDelayMs = 120000
+
+var pointList = map[string]bool{
+	DictWrite:      true,
+	ReportsInsert:  true,
+	ClassifyDaemon: true,
+	PluginHandler:  true,
+}
+
+// ErrInjected is returned for an injected error
+var ErrInjected = errors.New("injected fault")
+
+// Fault holds a delay and an error rate for an injection point. The target
+// limits the fault to a plugin owner for the plugin handlers or to a table
+// for the reports inserts, and an empty target matches everything.
+// The counters come first so they are aligned for the atomic operations.
+type Fault struct {
+	Delays       uint64 `json:"delays"`
+	Errors       uint64 `json:"errors"`
+	Point        string `json:"point"`
+	Target       string `json:"target"`
+	DelayMs      int    `json:"delayMs"`
+	ErrorPercent int    `json:"errorPercent"`
+}
+
+// Status holds the faults setting and the faults being injected
+type Status struct {
+	Allowed bool    `json:"allowed"`
+	Faults  []Fault `json:"faults"`
+}
+
+var faultTable = make(map[string]*Fault)
+var faultMutex sync.RWMutex
+var allowed bool
+
+// faultCount is checked for every call to Inject so it is kept apart from the table
+var faultCount int32
+
+// Startup is called when the service starts
+func Startup() {
+	Reload()
+}
+
+// Shutdown is called when the service stops
+func Shutdown() {
+	Clear()
+}
+
+// Reload loads the faults settings. Faults can only be injected while they
+// are enabled in the settings, and disabling them clears any active faults.
+func Reload() {
+	enabled := false
+
+	faultsJSON, err := settings.GetCurrentSettings([]string{"faults"})
+	if faultsJSON != nil && err == nil {
+		item, ok := faultsJSON.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid faults settings: %T\n", faultsJSON)
+		} else if value, ok := item["enabled"].(bool); ok {
+			enabled = value
+		}
+	}
+
+	faultMutex.Lock()
+	allowed = enabled
+	faultMutex.Unlock()
+
+	if !enabled {
+		Clear()
+	}
+
+	logger.Info("Loaded faults settings enabled:%v\n", enabled)
+}
+
+// Set adds or replaces the fault for a point and target
+func Set(fault Fault) error {
+	if !pointList[fault.Point] {
+		return fmt.Errorf("unknown fault point %s", fault.Point)
+	}
+	if fault.DelayMs < 0 || fault.DelayMs > maxDelayMs {
+		return fmt.Errorf("invalid delay %d", fault.DelayMs)
+	}
+	if fault.ErrorPercent < 0 || fault.ErrorPercent > 100 {
+		return fmt.Errorf("invalid error percent %d", fault.ErrorPercent)
+	}
+	if fault.DelayMs == 0 && fault.ErrorPercent == 0 {
+		return errors.New("a delay or an error percent is required")
+	}
+
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+
+	if !allowed {
+		return errors.New("fault injection is not enabled in the settings")
+	}
+
+	fault.Delays = 0
+	fault.Errors = 0
+	faultTable[fault.Point+"|"+fault.Target] = &fault
+	atomic.StoreInt32(&faultCount, int32(len(faultTable)))
+
+	logger.Warn("Injecting fault point:%s target:%s delay:%d errors:%d%%\n", fault.Point, fault.Target, fault.DelayMs, fault.ErrorPercent)
+	return nil
+}
+
+// Clear removes all of the faults
+func Clear() {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+
+	if len(faultTable) == 0 {
+		return
+	}
+
+	faultTable = make(map[string]*Fault)
+	atomic.StoreInt32(&faultCount, 0)
+	logger.Info("Cleared all injected faults\n")
+}
+
+// GetStatus returns the faults setting and the faults being injected
+func GetStatus() Status {
+	faultMutex.RLock()
+	defer faultMutex.RUnlock()
+
+	status := Status{Allowed: allowed, Faults: []Fault{}}
+	for _, fault := range faultTable {
+		item := *fault
+		item.Delays = atomic.LoadUint64(&fault.Delays)
+		item.Errors = atomic.LoadUint64(&fault.Errors)
+		status.Faults = append(status.Faults, item)
+	}
+	sort.Slice(status.Faults, func(i, j int) bool {
+		if status.Faults[i].Point != status.Faults[j].Point {
+			return status.Faults[i].Point < status.Faults[j].Point
+		}
+		return status.Faults[i].Target < status.Faults[j].Target
+	})
+	return status
+}
+
+// Inject applies the fault for a point and target, sleeping for the delay
+// and returning ErrInjected for the configured share of the calls. The fault
+// for the target is used before the one for all targets. It returns nil right
+// away when no faults are set.
+func Inject(point string, target string) error {
+	if atomic.LoadInt32(&faultCount) == 0 {
+		return nil
+	}
+
+	faultMutex.RLock()
+	fault := faultTable[point+"|"+target]
+	if fault == nil {
+		fault = faultTable[point+"|"]
+	}
+	faultMutex.RUnlock()
+
+	if fault == nil {
+		return nil
+	}
+
+	if fault.DelayMs > 0 {
+		atomic.AddUint64(&fault.Delays, 1)
+		time.Sleep(time.Duration(fault.DelayMs) * time.Millisecond)
+	}
+
+	if fault.ErrorPercent > 0 && rand.Intn(100) < fault.ErrorPercent {
+		atomic.AddUint64(&fault.Errors, 1)
+		logger.Debug("Injected fault point:%s target:%s\n", point, target)
+		return ErrInjected
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+//go:build integration
+// +build integration
+
+// Package harness provides helpers for end-to-end tests of the dispatch
+// pipeline. It starts the services that don't depend on the kernel module and
+// injects synthetic nfqueue, conntrack, and netlogger events, so session
+// tracking, plugin chains, and reports logging can be tested in CI and on
+// developer machines. It is only built with the integration build tag.
+package harness
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// the mark bit set by the kernel rules for the first packet of a session
+const newSessionMark = 0x10000000
+
+// the conntrack update interval passed to dispatch
+const conntrackIntervalSec = 60
+
+var conntrackIndex uint32
+var reportsEnabled bool
+
+// Options controls which services are started by the harness
+type Options struct {
+	Reports bool
+	Plugins bool
+}
+
+// Flow is a synthetic connection used to generate packets and conntrack events
+type Flow struct {
+	ConntrackID   uint32
+	Protocol      uint8
+	Client        net.IP
+	Server        net.IP
+	ClientPort    uint16
+	ServerPort    uint16
+	clientBytes   uint64
+	serverBytes   uint64
+	clientPackets uint64
+	serverPackets uint64
+	sequence      uint32
+	started       uint64
+}
+
+// Startup starts dispatch and the optional services. The dict is disabled so
+// we don't try to load the nft_dict kernel module, and any dict writes will
+// fail with a warning since the module isn't available in a test environment.
+// An error is returned if the reports were requested and couldn't be started.
+func Startup(options Options) error {
+	dict.Disable()
+	dispatch.Startup(conntrackIntervalSec)
+
+	if options.Reports {
+		if err := reports.Startup(); err != nil {
+			return err
+		}
+		reportsEnabled = true
+	}
+
+	if options.Plugins {
+		pluginsdk.StartPlugins()
+	}
+	return nil
+}
+
+// Shutdown stops everything started by Startup
+func Shutdown() {
+	pluginsdk.StopPlugins()
+
+	if reportsEnabled {
+		reports.WaitForEvents(5 * time.Second)
+		reports.Shutdown()
+		reportsEnabled = false
+	}
+
+	dispatch.Shutdown()
+}
+
+// NewFlow returns a flow for the argumented protocol and addresses with a unique conntrack ID
+func NewFlow(protocol uint8, client string, clientPort uint16, server string, serverPort uint16) *Flow {
+	return &Flow{
+		ConntrackID: atomic.AddUint32(&conntrackIndex, 1),
+		Protocol:    protocol,
+		Client:      net.ParseIP(client),
+		Server:      net.ParseIP(server),
+		ClientPort:  clientPort,
+		ServerPort:  serverPort,
+		sequence:    1000,
+	}
+}
+
+// ClientPacket injects a packet from the client to the server and returns the verdict
+func (flow *Flow) ClientPacket(payload []byte) int {
+	return flow.inject(true, payload)
+}
+
+// ServerPacket injects a packet from the server to the client and returns the verdict
+func (flow *Flow) ServerPacket(payload []byte) int {
+	return flow.inject(false, payload)
+}
+
+// Conntrack injects a conntrack event of the argumented type (N, U, or D) with
+// the byte and packet counts for all the packets injected for the flow so far
+func (flow *Flow) Conntrack(eventType uint8) {
+	if flow.started == 0 {
+		flow.started = uint64(time.Now().UnixNano())
+	}
+
+	event := dispatch.ConntrackEvent{
+		ConntrackID:    flow.ConntrackID,
+		Family:         uint8(flow.family()),
+		EventType:      eventType,
+		Protocol:       flow.Protocol,
+		Client:         flow.Client,
+		Server:         flow.Server,
+		ClientPort:     flow.ClientPort,
+		ServerPort:     flow.ServerPort,
+		ClientNew:      flow.Client,
+		ServerNew:      flow.Server,
+		ClientPortNew:  flow.ClientPort,
+		ServerPortNew:  flow.ServerPort,
+		ClientBytes:    flow.clientBytes,
+		ServerBytes:    flow.serverBytes,
+		ClientPackets:  flow.clientPackets,
+		ServerPackets:  flow.serverPackets,
+		TimestampStart: flow.started,
+		Timeout:        120,
+	}
+
+	if eventType == 'D' {
+		event.TimestampStop = uint64(time.Now().UnixNano())
+	}
+
+	dispatch.InjectConntrack(event)
+}
+
+// Session returns the dispatch session for the flow or nil if there isn't one
+func (flow *Flow) Session() *dispatch.Session {
+	return dispatch.FindSession(flow.ConntrackID)
+}
+
+// inject builds a packet for the flow, passes it to dispatch, and returns the verdict
+func (flow *Flow) inject(clientToServer bool, payload []byte) int {
+	var mark uint32
+
+	if flow.clientPackets == 0 && flow.serverPackets == 0 {
+		mark = newSessionMark
+	}
+
+	packet := flow.buildPacket(clientToServer, payload)
+	if clientToServer {
+		flow.clientPackets++
+		flow.clientBytes += uint64(len(packet.Data()))
+	} else {
+		flow.serverPackets++
+		flow.serverBytes += uint64(len(packet.Data()))
+	}
+
+	return dispatch.InjectNfqueue(flow.ConntrackID, flow.family(), packet, mark)
+}
+
+// family returns the address family of the flow
+func (flow *Flow) family() uint32 {
+	if flow.Client.To4() != nil {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+// buildPacket creates a packet for the flow in the argumented direction
+func (flow *Flow) buildPacket(clientToServer bool, payload []byte) gopacket.Packet {
+	var network gopacket.NetworkLayer
+	var stack []gopacket.SerializableLayer
+	var firstLayer gopacket.LayerType
+
+	srcIP, dstIP := flow.Client, flow.Server
+	srcPort, dstPort := flow.ClientPort, flow.ServerPort
+	if !clientToServer {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	if flow.family() == syscall.AF_INET {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocol(flow.Protocol), SrcIP: srcIP.To4(), DstIP: dstIP.To4()}
+		network = ip4
+		stack = append(stack, ip4)
+		firstLayer = layers.LayerTypeIPv4
+	} else {
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocol(flow.Protocol), SrcIP: srcIP, DstIP: dstIP}
+		network = ip6
+		stack = append(stack, ip6)
+		firstLayer = layers.LayerTypeIPv6
+	}
+
+	switch layers.IPProtocol(flow.Protocol) {
+	case layers.IPProtocolTCP:
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), Seq: flow.sequence, Window: 65535, ACK: true, PSH: len(payload) != 0}
+		tcp.SetNetworkLayerForChecksum(network)
+		stack = append(stack, tcp)
+		flow.sequence += uint32(len(payload))
+	case layers.IPProtocolUDP:
+		udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+		udp.SetNetworkLayerForChecksum(network)
+		stack = append(stack, udp)
+	}
+
+	stack = append(stack, gopacket.Payload(payload))
+
+	buffer := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, stack...)
+
+	return gopacket.NewPacket(buffer.Bytes(), firstLayer, gopacket.Default)
+}
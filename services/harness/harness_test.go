@@ -0,0 +1,63 @@
+//go:build integration
+// +build integration
+
+package harness
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/untangle/packetd/services/dispatch"
+)
+
+func TestSessionTracking(t *testing.T) {
+	var calls int32
+
+	Startup(Options{})
+	defer Shutdown()
+
+	dispatch.InsertNfqueueSubscription("harness_test", 2, func(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+		var result dispatch.NfqueueResult
+		count := atomic.AddInt32(&calls, 1)
+		result.SessionRelease = (count >= 3)
+		result.PacketDrop = (string(mess.Payload) == "drop")
+		return result
+	})
+
+	flow := NewFlow(6, "192.168.1.100", 40000, "10.1.2.3", 443)
+
+	if verdict := flow.ClientPacket([]byte("hello")); verdict != dispatch.NfAccept {
+		t.Fatalf("unexpected verdict %d for first packet", verdict)
+	}
+
+	session := flow.Session()
+	if session == nil {
+		t.Fatalf("session not created for ctid %d", flow.ConntrackID)
+	}
+
+	if verdict := flow.ServerPacket([]byte("drop")); verdict != dispatch.NfDrop {
+		t.Fatalf("unexpected verdict %d for dropped packet", verdict)
+	}
+
+	flow.ClientPacket([]byte("third"))
+	flow.ClientPacket([]byte("released"))
+
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("subscriber called %d times after release", calls)
+	}
+
+	tuple := session.GetClientSideTuple()
+	if tuple.ClientPort != 40000 || tuple.ServerPort != 443 || !tuple.ServerAddress.Equal(flow.Server) {
+		t.Fatalf("unexpected session tuple %v", tuple)
+	}
+
+	flow.Conntrack('N')
+	if dispatch.FindConntrack(flow.ConntrackID) == nil {
+		t.Fatalf("conntrack entry not created for ctid %d", flow.ConntrackID)
+	}
+
+	flow.Conntrack('D')
+	if dispatch.FindConntrack(flow.ConntrackID) != nil {
+		t.Fatalf("conntrack entry not removed for ctid %d", flow.ConntrackID)
+	}
+}
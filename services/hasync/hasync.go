@@ -0,0 +1,593 @@
+// Package hasync keeps a warm standby packetd in step with the primary so a
+// VRRP failover doesn't lose the classification and policy state of the
+// existing flows. The primary sends a snapshot of the session dictionary
+// entries and attachments, the device inventory, and the host and user
+// mappings to the standby when it connects and at a longer interval after
+// that, with only the changes sent in between, over a TCP connection that is
+// encrypted and authenticated with a shared secret. The listener is bound to
+// the sync address, or to the local address on the same network as the peer. The standby restores the
+// devices and mappings right away and holds the session state until the same
+// flows show up, usually copied by conntrackd, since the conntrack ids are
+// different on each appliance. With the auto role the appliance that holds
+// the VRRP virtual address is the primary.
+//
+// For asymmetric routing, where the two directions of a flow can pass through
+// different appliances, every appliance uses the peer role. Each one sends
+// its sessions to the other, with the new sessions sent as soon as they are
+// created, and the sessions received are given to dispatch so a packet that
+// belongs to one of them is tracked as that session instead of a stray.
+package hasync
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the roles in the settings
+const (
+	RoleAuto    = "auto"
+	RolePrimary = "primary"
+	RoleStandby = "standby"
+	RolePeer    = "peer"
+)
+
+// the defaults used when the hasync settings are missing
+const defaultPort = 8485
+const defaultIntervalSeconds = 5
+const defaultHoldSeconds = 300
+
+// the interval for the full snapshots, with the changes sent in between
+const fullSnapshotInterval = 60 * time.Second
+
+// the limits on the connections
+const dialTimeout = 5 * time.Second
+const minReadTimeout = 60 * time.Second
+const updateQueueSize = 4096
+const maxUpdateSessions = 256
+
+// Status holds the hasync settings and the state of the channel
+type Status struct {
+	Enabled          bool                  `json:"enabled"`
+	Role             string                `json:"role"`
+	Primary          bool                  `json:"primary"`
+	PeerAddress      string                `json:"peerAddress"`
+	Port             int                   `json:"port"`
+	Connected        bool                  `json:"connected"`
+	LastSent         *time.Time            `json:"lastSent,omitempty"`
+	SentSessions     int                   `json:"sentSessions"`
+	LastReceived     *time.Time            `json:"lastReceived,omitempty"`
+	ReceivedFrom     string                `json:"receivedFrom,omitempty"`
+	ReceivedSessions int                   `json:"receivedSessions"`
+	PendingSessions  int                   `json:"pendingSessions"`
+	Remote           dispatch.RemoteStatus `json:"remote"`
+	Error            string                `json:"error,omitempty"`
+}
+
+// syncConfig holds the hasync settings
+type syncConfig struct {
+	enabled        bool
+	role           string
+	virtualAddress net.IP
+	syncAddress    net.IP
+	peerAddress    string
+	port           int
+	secret         string
+	interval       time.Duration
+	hold           time.Duration
+}
+
+var config = syncConfig{role: RoleAuto, port: defaultPort, interval: defaultIntervalSeconds * time.Second, hold: defaultHoldSeconds * time.Second}
+var stateLocker sync.Mutex
+var pending *pendingState
+var appliedTable = make(map[uint32]uint8)
+var primary bool
+var connected bool
+var lastSent time.Time
+var sentSessions int
+var lastReceived time.Time
+var receivedFrom string
+var receivedSessions int
+var lastError string
+var listener net.Listener
+var updateChannel = make(chan SessionState, updateQueueSize)
+var shutdownChannel chan bool
+var syncWaiter sync.WaitGroup
+
+// Startup is called to handle service startup
+func Startup() {
+	dispatch.InsertConntrackSubscription("hasync", dispatch.HASyncPriority, conntrackHandler)
+	dispatch.InsertNfqueueSubscription("hasync", dispatch.HASyncPriority, nfqueueHandler)
+	loadSettings()
+	startSync()
+}
+
+// Shutdown is called to handle service shutdown. The subscriptions stay in
+// dispatch but do nothing once the stored state is cleared.
+func Shutdown() {
+	stopSync()
+
+	stateLocker.Lock()
+	pending = nil
+	appliedTable = make(map[uint32]uint8)
+	stateLocker.Unlock()
+}
+
+// Reload loads the hasync settings and restarts the channel
+func Reload() {
+	stopSync()
+	loadSettings()
+	startSync()
+}
+
+// GetStatus returns the hasync settings and the state of the channel
+func GetStatus() Status {
+	stateLocker.Lock()
+	defer stateLocker.Unlock()
+
+	status := Status{
+		Enabled:          config.enabled,
+		Role:             config.role,
+		Primary:          primary,
+		PeerAddress:      config.peerAddress,
+		Port:             config.port,
+		Connected:        connected,
+		SentSessions:     sentSessions,
+		ReceivedFrom:     receivedFrom,
+		ReceivedSessions: receivedSessions,
+		Error:            lastError,
+	}
+	if !lastSent.IsZero() {
+		stamp := lastSent
+		status.LastSent = &stamp
+	}
+	if !lastReceived.IsZero() {
+		stamp := lastReceived
+		status.LastReceived = &stamp
+	}
+	if pending != nil {
+		status.PendingSessions = len(pending.sessions)
+	}
+	status.Remote = dispatch.GetRemoteStatus()
+	return status
+}
+
+// loadSettings loads the hasync settings
+func loadSettings() {
+	fresh := syncConfig{role: RoleAuto, port: defaultPort, interval: defaultIntervalSeconds * time.Second, hold: defaultHoldSeconds * time.Second}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"hasync"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid hasync settings: %T\n", configJSON)
+		} else {
+			if value, ok := item["enabled"].(bool); ok {
+				fresh.enabled = value
+			}
+			if value, ok := item["role"].(string); ok {
+				switch value {
+				case RoleAuto, RolePrimary, RoleStandby, RolePeer:
+					fresh.role = value
+				default:
+					logger.Warn("Invalid hasync role: %s\n", value)
+				}
+			}
+			if value, ok := item["virtualAddress"].(string); ok && value != "" {
+				fresh.virtualAddress = net.ParseIP(value)
+				if fresh.virtualAddress == nil {
+					logger.Warn("Invalid hasync virtual address: %s\n", value)
+				}
+			}
+			if value, ok := item["syncAddress"].(string); ok && value != "" {
+				fresh.syncAddress = net.ParseIP(value)
+				if fresh.syncAddress == nil {
+					logger.Warn("Invalid hasync sync address: %s\n", value)
+				}
+			}
+			if value, ok := item["peerAddress"].(string); ok {
+				fresh.peerAddress = value
+			}
+			if value, ok := item["port"].(float64); ok && value > 0 && value < 65536 {
+				fresh.port = int(value)
+			}
+			if value, ok := item["secret"].(string); ok {
+				fresh.secret = value
+			}
+			if value, ok := item["intervalSeconds"].(float64); ok && value > 0 {
+				fresh.interval = time.Duration(value) * time.Second
+			}
+			if value, ok := item["holdSeconds"].(float64); ok && value > 0 {
+				fresh.hold = time.Duration(value) * time.Second
+			}
+		}
+	}
+
+	if fresh.enabled && fresh.role == RoleAuto && fresh.virtualAddress == nil {
+		logger.Warn("The hasync auto role needs the virtual address - staying in standby\n")
+	}
+
+	stateLocker.Lock()
+	config = fresh
+	stateLocker.Unlock()
+
+	logger.Info("Loaded hasync settings enabled:%v role:%s peer:%s port:%d interval:%v\n", fresh.enabled, fresh.role, fresh.peerAddress, fresh.port, fresh.interval)
+}
+
+// startSync starts the listener for the snapshots and the task that sends
+// them. Both run on each appliance since either one can be the primary.
+func startSync() {
+	stateLocker.Lock()
+	current := config
+	stateLocker.Unlock()
+
+	if !current.enabled {
+		return
+	}
+
+	aead, err := newCipher(current.secret)
+	if err != nil {
+		setError("Unable to start hasync: %v", err)
+		return
+	}
+
+	shutdownChannel = make(chan bool)
+
+	local := listenAddress(current)
+	if local == nil {
+		setError("Unable to listen for hasync: no sync address and no local address on the network of peer %s", current.peerAddress)
+	} else if socket, err := net.Listen("tcp", net.JoinHostPort(local.String(), strconv.Itoa(current.port))); err != nil {
+		setError("Unable to listen on hasync address %v port %d: %v", local, current.port, err)
+	} else {
+		logger.Info("Listening for hasync on %v port %d\n", local, current.port)
+		stateLocker.Lock()
+		listener = socket
+		stateLocker.Unlock()
+		syncWaiter.Add(1)
+		go listenTask(socket, aead)
+	}
+
+	syncWaiter.Add(1)
+	go sendTask(current, aead)
+}
+
+// stopSync stops the listener and the send task
+func stopSync() {
+	if shutdownChannel == nil {
+		return
+	}
+
+	close(shutdownChannel)
+	stateLocker.Lock()
+	if listener != nil {
+		listener.Close()
+		listener = nil
+	}
+	stateLocker.Unlock()
+
+	syncWaiter.Wait()
+	shutdownChannel = nil
+
+	stateLocker.Lock()
+	primary = false
+	connected = false
+	stateLocker.Unlock()
+}
+
+// listenAddress returns the address for the listener, which is the sync
+// address from the settings or the local address on the same network as the
+// peer, so the state is never accepted on the WAN or other interfaces. The
+// virtual address is skipped since it moves to the primary.
+func listenAddress(current syncConfig) net.IP {
+	if current.syncAddress != nil {
+		return current.syncAddress
+	}
+
+	peer := net.ParseIP(current.peerAddress)
+	if peer == nil {
+		return nil
+	}
+
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.Contains(peer) && !network.IP.Equal(peer) && !network.IP.Equal(current.virtualAddress) {
+			return network.IP
+		}
+	}
+	return nil
+}
+
+// isPrimary returns true if this appliance should send the snapshots
+func isPrimary(current syncConfig) bool {
+	switch current.role {
+	case RolePrimary, RolePeer:
+		return true
+	case RoleStandby:
+		return false
+	}
+
+	if current.virtualAddress == nil {
+		return false
+	}
+
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.Equal(current.virtualAddress) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendTask sends the changes to the peer at the interval while this
+// appliance is the primary, connecting again after any error. In the peer
+// role the new sessions are also sent as soon as they are created.
+func sendTask(current syncConfig, aead cipher.AEAD) {
+	defer syncWaiter.Done()
+
+	var peer *channel
+	tracker := newSyncTracker()
+	node, _ := os.Hostname()
+	shutdown := shutdownChannel
+	timer := time.NewTimer(0)
+
+	defer func() {
+		timer.Stop()
+		if peer != nil {
+			peer.conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-timer.C:
+			peer = sendSnapshot(current, aead, peer, node, tracker)
+			timer.Reset(current.interval)
+		case state := <-updateChannel:
+			peer = sendUpdate(current, peer, node, state)
+		}
+	}
+}
+
+// sendSnapshot checks the role and sends the changes since the last message,
+// or a full snapshot with everything the primary knows on a new connection
+// and at the full snapshot interval. It returns the channel to use for the
+// next message.
+func sendSnapshot(current syncConfig, aead cipher.AEAD, peer *channel, node string, tracker *syncTracker) *channel {
+	active := isPrimary(current)
+
+	stateLocker.Lock()
+	if active && !primary {
+		logger.Notice("This appliance is now the hasync primary\n")
+	} else if !active && primary {
+		logger.Notice("This appliance is now the hasync standby\n")
+	}
+	primary = active
+	stateLocker.Unlock()
+
+	if !active || current.peerAddress == "" {
+		return closePeer(peer)
+	}
+
+	if peer == nil {
+		peer = dialPeer(current, aead, node)
+		if peer == nil {
+			return nil
+		}
+		tracker.reset()
+	}
+
+	snapshot := buildSnapshot(node)
+	full := tracker.due()
+	if !full {
+		tracker.delta(snapshot)
+	}
+
+	err := peer.writeMessage(snapshot, current.interval+dialTimeout)
+	if err != nil {
+		setError("Unable to send the hasync snapshot to %s: %v", current.peerAddress, err)
+		return closePeer(peer)
+	}
+
+	if full {
+		tracker.sent(snapshot)
+		overseer.AddCounter("hasync_snapshots_sent", 1)
+	} else {
+		overseer.AddCounter("hasync_deltas_sent", 1)
+	}
+	stateLocker.Lock()
+	lastSent = snapshot.Time
+	sentSessions = len(tracker.sessions)
+	lastError = ""
+	stateLocker.Unlock()
+	return peer
+}
+
+// sendUpdate sends the new sessions waiting in the update channel. They are
+// dropped if there is no connection since the next snapshot has them anyway.
+func sendUpdate(current syncConfig, peer *channel, node string, state SessionState) *channel {
+	update := &Snapshot{Node: node, Time: time.Now(), Update: true, Sessions: []SessionState{state}}
+	for len(update.Sessions) < maxUpdateSessions && len(updateChannel) != 0 {
+		update.Sessions = append(update.Sessions, <-updateChannel)
+	}
+
+	if peer == nil {
+		return nil
+	}
+
+	err := peer.writeMessage(update, dialTimeout)
+	if err != nil {
+		setError("Unable to send the hasync update to %s: %v", current.peerAddress, err)
+		return closePeer(peer)
+	}
+
+	overseer.AddCounter("hasync_updates_sent", 1)
+	return peer
+}
+
+// closePeer closes the channel to the peer if there is one and returns nil
+func closePeer(peer *channel) *channel {
+	if peer != nil {
+		peer.conn.Close()
+		setConnected(false)
+	}
+	return nil
+}
+
+// dialPeer connects to the standby and answers the challenge
+func dialPeer(current syncConfig, aead cipher.AEAD, node string) *channel {
+	address := net.JoinHostPort(current.peerAddress, strconv.Itoa(current.port))
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		setError("Unable to connect to hasync peer %s: %v", address, err)
+		return nil
+	}
+
+	peer, err := dialChannel(conn, aead, node)
+	if err != nil {
+		conn.Close()
+		setError("Unable to start the hasync channel with %s: %v", address, err)
+		return nil
+	}
+
+	logger.Info("Connected to hasync peer %s\n", address)
+	setConnected(true)
+	return peer
+}
+
+// listenTask accepts the connections from the primary
+func listenTask(socket net.Listener, aead cipher.AEAD) {
+	defer syncWaiter.Done()
+
+	shutdown := shutdownChannel
+	for {
+		conn, err := socket.Accept()
+		if err != nil {
+			select {
+			case <-shutdown:
+				return
+			default:
+			}
+			logger.Warn("Unable to accept hasync connection: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		syncWaiter.Add(1)
+		go receiveTask(conn, aead, shutdown)
+	}
+}
+
+// receiveTask reads the snapshots from a connection until it fails or the
+// service is stopped. A connection that doesn't authenticate is closed.
+func receiveTask(conn net.Conn, aead cipher.AEAD, shutdown chan bool) {
+	defer syncWaiter.Done()
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-shutdown:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	remote := conn.RemoteAddr().String()
+	peer, name, err := acceptChannel(conn, aead)
+	if err != nil {
+		logger.Warn("Unable to start the hasync channel with %s: %v\n", remote, err)
+		return
+	}
+	logger.Info("Accepted hasync connection from %s (%s)\n", name, remote)
+
+	stateLocker.Lock()
+	timeout := 3 * config.interval
+	stateLocker.Unlock()
+	if timeout < minReadTimeout {
+		timeout = minReadTimeout
+	}
+
+	for {
+		snapshot := new(Snapshot)
+		err := peer.readMessage(snapshot, timeout)
+		if err != nil {
+			select {
+			case <-shutdown:
+			default:
+				logger.Warn("Closing hasync connection from %s: %v\n", remote, err)
+			}
+			return
+		}
+
+		stateLocker.Lock()
+		active := primary
+		role := config.role
+		stateLocker.Unlock()
+
+		if role == RolePeer {
+			restoreRemote(snapshot)
+		} else if active {
+			logger.Warn("Ignoring hasync snapshot from %s since this appliance is the primary\n", snapshot.Node)
+			continue
+		} else {
+			restoreSnapshot(snapshot)
+		}
+
+		if snapshot.Update {
+			overseer.AddCounter("hasync_updates_received", 1)
+			continue
+		}
+
+		if snapshot.Delta {
+			overseer.AddCounter("hasync_deltas_received", 1)
+			logger.Debug("Received hasync changes from %s with %d sessions and %d removed\n", snapshot.Node, len(snapshot.Sessions), len(snapshot.Removed))
+			stateLocker.Lock()
+			lastReceived = time.Now()
+			receivedFrom = snapshot.Node
+			stateLocker.Unlock()
+			continue
+		}
+
+		overseer.AddCounter("hasync_snapshots_received", 1)
+		logger.Debug("Received hasync snapshot from %s with %d sessions and %d devices\n", snapshot.Node, len(snapshot.Sessions), len(snapshot.Devices))
+
+		stateLocker.Lock()
+		lastReceived = time.Now()
+		receivedFrom = snapshot.Node
+		receivedSessions = len(snapshot.Sessions)
+		stateLocker.Unlock()
+	}
+}
+
+// setConnected sets whether the send task has a connection to the peer
+func setConnected(value bool) {
+	stateLocker.Lock()
+	connected = value
+	stateLocker.Unlock()
+}
+
+// setError logs an error and keeps it for the status
+func setError(format string, args ...interface{}) {
+	stateLocker.Lock()
+	lastError = fmt.Sprintf(format, args...)
+	stateLocker.Unlock()
+	logger.Warn(format+"\n", args...)
+}
@@ -0,0 +1,209 @@
+package hasync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Every message on the channel is a frame with a four byte length followed by
+// a random nonce and the JSON message sealed with AES-GCM. The key is derived
+// from the shared secret with PBKDF2, so a peer without it can neither read
+// the state nor send any. When the standby accepts a connection it sends a
+// random challenge, and the challenge and a sequence number are the additional
+// data of each frame, so a recorded frame can't be replayed on this or any
+// other connection. The primary answers the challenge with a small hello
+// frame, and until that frame has been opened the standby won't read a frame
+// larger than a few KB from the connection.
+
+// the limits on the channel
+const challengeSize = 16
+const maxHelloFrameSize = 4 << 10
+const maxFrameSize = 64 << 20
+const handshakeTimeout = 10 * time.Second
+
+// the key derivation parameters, which must be the same on every appliance
+const keySalt = "packetd-hasync"
+const keyIterations = 100000
+const keySize = 32
+
+// channel is one end of an authenticated connection
+type channel struct {
+	conn      net.Conn
+	aead      cipher.AEAD
+	challenge []byte
+	sequence  uint64
+	verified  bool
+}
+
+// hello is the first message the primary sends on a new connection
+type hello struct {
+	Node string `json:"node"`
+}
+
+// newCipher returns the AES-GCM cipher for the shared secret
+func newCipher(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, errors.New("missing shared secret")
+	}
+
+	block, err := aes.NewCipher(deriveKey(secret))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey returns the AES key for the shared secret using PBKDF2 with
+// HMAC-SHA256 so a weak secret is expensive to guess from captured frames
+func deriveKey(secret string) []byte {
+	prf := hmac.New(sha256.New, []byte(secret))
+	key := make([]byte, 0, keySize)
+
+	for block := uint32(1); len(key) < keySize; block++ {
+		prf.Reset()
+		prf.Write([]byte(keySalt))
+		binary.Write(prf, binary.BigEndian, block)
+		sum := prf.Sum(nil)
+
+		result := make([]byte, len(sum))
+		copy(result, sum)
+		for round := 1; round < keyIterations; round++ {
+			prf.Reset()
+			prf.Write(sum)
+			sum = prf.Sum(sum[:0])
+			for index := range result {
+				result[index] ^= sum[index]
+			}
+		}
+		key = append(key, result...)
+	}
+
+	return key[:keySize]
+}
+
+// acceptChannel sends a new challenge on a connection accepted by the standby
+// and waits for the hello from the primary, returning the name it sent
+func acceptChannel(conn net.Conn, aead cipher.AEAD) (*channel, string, error) {
+	challenge := make([]byte, challengeSize)
+	if _, err := io.ReadFull(rand.Reader, challenge); err != nil {
+		return nil, "", err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	_, err := conn.Write(challenge)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	ch := &channel{conn: conn, aead: aead, challenge: challenge}
+	greeting := new(hello)
+	if err := ch.readMessage(greeting, handshakeTimeout); err != nil {
+		return nil, "", err
+	}
+	return ch, greeting.Node, nil
+}
+
+// dialChannel reads the challenge on a connection made by the primary and
+// sends the hello
+func dialChannel(conn net.Conn, aead cipher.AEAD, node string) (*channel, error) {
+	challenge := make([]byte, challengeSize)
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	_, err := io.ReadFull(conn, challenge)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	ch := &channel{conn: conn, aead: aead, challenge: challenge}
+	if err := ch.writeMessage(&hello{Node: node}, handshakeTimeout); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// additionalData returns the challenge and the sequence number of the next frame
+func (ch *channel) additionalData() []byte {
+	data := make([]byte, len(ch.challenge)+8)
+	copy(data, ch.challenge)
+	binary.BigEndian.PutUint64(data[len(ch.challenge):], ch.sequence)
+	return data
+}
+
+// writeMessage seals and writes a message
+func (ch *channel) writeMessage(message interface{}, timeout time.Duration) error {
+	plain, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, ch.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	ch.sequence++
+	sealed := ch.aead.Seal(nonce, nonce, plain, ch.additionalData())
+	if len(sealed) > maxFrameSize {
+		return fmt.Errorf("message too large: %d bytes", len(sealed))
+	}
+
+	frame := make([]byte, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	copy(frame[4:], sealed)
+
+	ch.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = ch.conn.Write(frame)
+	ch.conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// readMessage reads and opens a message. A frame that fails to open means the
+// peer has the wrong secret or the frame was changed or replayed. Only small
+// frames are read until the first one has been opened, so a connection that
+// hasn't authenticated can't make us allocate a large buffer.
+func (ch *channel) readMessage(message interface{}, timeout time.Duration) error {
+	ch.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer ch.conn.SetReadDeadline(time.Time{})
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(ch.conn, header); err != nil {
+		return err
+	}
+
+	limit := uint32(maxHelloFrameSize)
+	if ch.verified {
+		limit = maxFrameSize
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > limit || int(size) < ch.aead.NonceSize()+ch.aead.Overhead() {
+		return fmt.Errorf("invalid frame size: %d bytes", size)
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(ch.conn, sealed); err != nil {
+		return err
+	}
+
+	ch.sequence++
+	nonce := sealed[:ch.aead.NonceSize()]
+	plain, err := ch.aead.Open(nil, nonce, sealed[ch.aead.NonceSize():], ch.additionalData())
+	if err != nil {
+		return errors.New("authentication failed")
+	}
+	ch.verified = true
+
+	return json.Unmarshal(plain, message)
+}
@@ -0,0 +1,535 @@
+package hasync
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/inventory"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+// the dictionary tables that hold the host and user mappings
+var syncTables = []string{"host", "user"}
+
+// the state of a session that has been written to the dictionary or the attachments
+const (
+	appliedDict = 1 << iota
+	appliedSession
+)
+
+// Value holds an attachment or dictionary value with its type so the
+// standby gets back the same type the primary had
+type Value struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// SessionState holds the dictionary entries and the attachments of a session
+// on the primary. The conntrack id is different on the standby so the session
+// is found with the client side tuple.
+type SessionState struct {
+	Protocol      uint8            `json:"protocol"`
+	ClientAddress string           `json:"clientAddress"`
+	ClientPort    uint16           `json:"clientPort"`
+	ServerAddress string           `json:"serverAddress"`
+	ServerPort    uint16           `json:"serverPort"`
+	Dict          map[string]Value `json:"dict,omitempty"`
+	Attachments   map[string]Value `json:"attachments,omitempty"`
+}
+
+// TableEntry holds an entry from the host or user table in the dictionary
+type TableEntry struct {
+	Table string `json:"table"`
+	Key   Value  `json:"key"`
+	Field string `json:"field"`
+	Value Value  `json:"value"`
+}
+
+// Snapshot is the state the primary sends to the standby. An update only
+// holds the sessions created since the last snapshot. A delta holds the
+// sessions that changed and the ones that are gone since the last message,
+// and only has the devices and mappings if any of them changed.
+type Snapshot struct {
+	Node     string             `json:"node"`
+	Time     time.Time          `json:"time"`
+	Update   bool               `json:"update,omitempty"`
+	Delta    bool               `json:"delta,omitempty"`
+	Sessions []SessionState     `json:"sessions"`
+	Removed  []SessionState     `json:"removed,omitempty"`
+	Devices  []inventory.Device `json:"devices"`
+	Tables   []TableEntry       `json:"tables"`
+}
+
+// syncTracker holds a hash of each session and of the devices and mappings
+// sent on the current connection so the next message only has the changes
+type syncTracker struct {
+	sessions  map[string]sentSession
+	inventory uint64
+	lastFull  time.Time
+}
+
+// pendingState holds the sessions from the last snapshot until they are
+// found on the standby or the hold time has passed
+type pendingState struct {
+	received time.Time
+	sessions map[string]*SessionState
+}
+
+// encodeValue returns the value with its type or false if the type can't be sent
+func encodeValue(value interface{}) (Value, bool) {
+	switch item := value.(type) {
+	case string:
+		return Value{Type: "string", Value: item}, true
+	case bool:
+		return Value{Type: "bool", Value: strconv.FormatBool(item)}, true
+	case int:
+		return Value{Type: "int", Value: strconv.FormatInt(int64(item), 10)}, true
+	case int32:
+		return Value{Type: "int32", Value: strconv.FormatInt(int64(item), 10)}, true
+	case int64:
+		return Value{Type: "int64", Value: strconv.FormatInt(item, 10)}, true
+	case uint8:
+		return Value{Type: "uint8", Value: strconv.FormatUint(uint64(item), 10)}, true
+	case uint16:
+		return Value{Type: "uint16", Value: strconv.FormatUint(uint64(item), 10)}, true
+	case uint32:
+		return Value{Type: "uint32", Value: strconv.FormatUint(uint64(item), 10)}, true
+	case uint64:
+		return Value{Type: "uint64", Value: strconv.FormatUint(item, 10)}, true
+	case float64:
+		return Value{Type: "float64", Value: strconv.FormatFloat(item, 'g', -1, 64)}, true
+	case net.IP:
+		if item == nil {
+			return Value{}, false
+		}
+		return Value{Type: "ip", Value: item.String()}, true
+	case net.HardwareAddr:
+		if item == nil {
+			return Value{}, false
+		}
+		return Value{Type: "mac", Value: item.String()}, true
+	}
+	return Value{}, false
+}
+
+// decodeValue returns the value with the type it had on the primary
+func decodeValue(value Value) (interface{}, error) {
+	switch value.Type {
+	case "string":
+		return value.Value, nil
+	case "bool":
+		return strconv.ParseBool(value.Value)
+	case "int":
+		number, err := strconv.ParseInt(value.Value, 10, 0)
+		return int(number), err
+	case "int32":
+		number, err := strconv.ParseInt(value.Value, 10, 32)
+		return int32(number), err
+	case "int64":
+		return strconv.ParseInt(value.Value, 10, 64)
+	case "uint8":
+		number, err := strconv.ParseUint(value.Value, 10, 8)
+		return uint8(number), err
+	case "uint16":
+		number, err := strconv.ParseUint(value.Value, 10, 16)
+		return uint16(number), err
+	case "uint32":
+		number, err := strconv.ParseUint(value.Value, 10, 32)
+		return uint32(number), err
+	case "uint64":
+		return strconv.ParseUint(value.Value, 10, 64)
+	case "float64":
+		return strconv.ParseFloat(value.Value, 64)
+	case "ip":
+		ip := net.ParseIP(value.Value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address: %s", value.Value)
+		}
+		return ip, nil
+	case "mac":
+		return net.ParseMAC(value.Value)
+	}
+	return nil, fmt.Errorf("invalid type: %s", value.Type)
+}
+
+// decodeValues returns the values of a map, leaving out any that are invalid
+func decodeValues(values map[string]Value) map[string]interface{} {
+	result := make(map[string]interface{})
+	for name, value := range values {
+		item, err := decodeValue(value)
+		if err != nil {
+			logger.Debug("Ignoring invalid value for %s: %v\n", name, err)
+			continue
+		}
+		result[name] = item
+	}
+	return result
+}
+
+// tupleKey returns the key used to find the state of a session
+func tupleKey(protocol uint8, client net.IP, clientPort uint16, server net.IP, serverPort uint16) string {
+	tuple := dispatch.Tuple{Protocol: protocol, ClientAddress: client, ClientPort: clientPort, ServerAddress: server, ServerPort: serverPort}
+	return tuple.String()
+}
+
+// buildSnapshot returns the state of the sessions, the devices, and the host
+// and user mappings that the standby needs to carry on after a failover
+func buildSnapshot(node string) *Snapshot {
+	snapshot := &Snapshot{Node: node, Time: time.Now(), Sessions: []SessionState{}, Tables: []TableEntry{}}
+
+	dictSessions, err := dict.GetSessions()
+	if err != nil {
+		logger.Debug("Unable to read the dictionary sessions: %v\n", err)
+	}
+
+	for ctid, conntrack := range dispatch.GetConntrackTable() {
+		conntrack.Guardian.RLock()
+		tuple := conntrack.ClientSideTuple
+		session := conntrack.Session
+		conntrack.Guardian.RUnlock()
+
+		// the appliance a session was adopted from is already tracking it
+		if session != nil && session.IsRemote() {
+			continue
+		}
+
+		state := SessionState{
+			Protocol:      tuple.Protocol,
+			ClientAddress: tuple.ClientAddress.String(),
+			ClientPort:    tuple.ClientPort,
+			ServerAddress: tuple.ServerAddress.String(),
+			ServerPort:    tuple.ServerPort,
+			Dict:          make(map[string]Value),
+			Attachments:   make(map[string]Value),
+		}
+
+		for field, value := range dictSessions[ctid] {
+			if encoded, ok := encodeValue(value); ok {
+				state.Dict[field] = encoded
+			}
+		}
+
+		if session != nil {
+			attachments := session.LockAttachments()
+			for name, value := range attachments {
+				if encoded, ok := encodeValue(value); ok {
+					state.Attachments[name] = encoded
+				}
+			}
+			session.UnlockAttachments()
+		}
+
+		if len(state.Dict) != 0 || len(state.Attachments) != 0 {
+			snapshot.Sessions = append(snapshot.Sessions, state)
+		}
+	}
+
+	snapshot.Devices = inventory.GetDevices()
+
+	for _, table := range syncTables {
+		entries, err := dict.GetTable(table)
+		if err != nil {
+			logger.Debug("Unable to read the dictionary %s table: %v\n", table, err)
+			continue
+		}
+		for _, entry := range entries {
+			key, keyOK := encodeValue(entry.Key)
+			value, valueOK := encodeValue(entry.Value)
+			if keyOK && valueOK {
+				snapshot.Tables = append(snapshot.Tables, TableEntry{Table: table, Key: key, Field: entry.Field, Value: value})
+			}
+		}
+	}
+
+	return snapshot
+}
+
+// sentSession holds the hash and the tuple of a session that was sent
+type sentSession struct {
+	hash  uint64
+	tuple SessionState
+}
+
+// newSyncTracker returns a tracker that sends a full snapshot first
+func newSyncTracker() *syncTracker {
+	return &syncTracker{sessions: make(map[string]sentSession)}
+}
+
+// reset forgets what was sent so the next message is a full snapshot
+func (tracker *syncTracker) reset() {
+	tracker.sessions = make(map[string]sentSession)
+	tracker.inventory = 0
+	tracker.lastFull = time.Time{}
+}
+
+// due returns true if the next message must be a full snapshot
+func (tracker *syncTracker) due() bool {
+	return tracker.lastFull.IsZero() || time.Since(tracker.lastFull) >= fullSnapshotInterval
+}
+
+// sent records the hashes of a full snapshot that was sent
+func (tracker *syncTracker) sent(snapshot *Snapshot) {
+	tracker.sessions = make(map[string]sentSession)
+	for _, state := range snapshot.Sessions {
+		tracker.sessions[stateKey(&state)] = sentSession{hash: hashValue(state), tuple: tupleState(state)}
+	}
+	tracker.inventory = hashValue([]interface{}{snapshot.Devices, snapshot.Tables})
+	tracker.lastFull = snapshot.Time
+}
+
+// delta turns a full snapshot into the changes since the last message and
+// records the new hashes
+func (tracker *syncTracker) delta(snapshot *Snapshot) {
+	current := make(map[string]sentSession, len(snapshot.Sessions))
+	changed := []SessionState{}
+
+	for _, state := range snapshot.Sessions {
+		key := stateKey(&state)
+		hash := hashValue(state)
+		current[key] = sentSession{hash: hash, tuple: tupleState(state)}
+		if previous, found := tracker.sessions[key]; !found || previous.hash != hash {
+			changed = append(changed, state)
+		}
+	}
+
+	var removed []SessionState
+	for key, previous := range tracker.sessions {
+		if _, found := current[key]; !found {
+			removed = append(removed, previous.tuple)
+		}
+	}
+
+	snapshot.Delta = true
+	snapshot.Sessions = changed
+	snapshot.Removed = removed
+	tracker.sessions = current
+
+	inventory := hashValue([]interface{}{snapshot.Devices, snapshot.Tables})
+	if inventory == tracker.inventory {
+		snapshot.Devices = nil
+		snapshot.Tables = nil
+	}
+	tracker.inventory = inventory
+}
+
+// hashValue returns a hash of the JSON encoding of a value, which has the map
+// keys sorted so the same state always has the same hash
+func hashValue(value interface{}) uint64 {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0
+	}
+	hash := fnv.New64a()
+	hash.Write(data)
+	return hash.Sum64()
+}
+
+// stateKey returns the key used to find the state of a session
+func stateKey(state *SessionState) string {
+	return tupleKey(state.Protocol, net.ParseIP(state.ClientAddress), state.ClientPort, net.ParseIP(state.ServerAddress), state.ServerPort)
+}
+
+// tupleState returns a copy of a session state with only the tuple
+func tupleState(state SessionState) SessionState {
+	return SessionState{Protocol: state.Protocol, ClientAddress: state.ClientAddress, ClientPort: state.ClientPort, ServerAddress: state.ServerAddress, ServerPort: state.ServerPort}
+}
+
+// restoreSnapshot stores the sessions from a snapshot received by the standby
+// and restores the devices and the host and user mappings. The sessions that
+// already exist here are updated now and the others when they show up. A full
+// snapshot replaces the stored sessions while a delta is merged into them.
+func restoreSnapshot(snapshot *Snapshot) {
+	stateLocker.Lock()
+	fresh := &pendingState{received: time.Now(), sessions: make(map[string]*SessionState)}
+	if snapshot.Delta && pending != nil {
+		fresh.sessions = pending.sessions
+	}
+	for index := range snapshot.Sessions {
+		state := &snapshot.Sessions[index]
+		fresh.sessions[stateKey(state)] = state
+	}
+	for index := range snapshot.Removed {
+		delete(fresh.sessions, stateKey(&snapshot.Removed[index]))
+	}
+	pending = fresh
+	stateLocker.Unlock()
+
+	for _, device := range snapshot.Devices {
+		inventory.ImportDevice(device)
+	}
+
+	restoreTables(snapshot.Tables)
+
+	conntrackTable := dispatch.GetConntrackTable()
+
+	// forget the sessions that are gone so the table doesn't grow
+	stateLocker.Lock()
+	for ctid := range appliedTable {
+		if _, found := conntrackTable[ctid]; !found {
+			delete(appliedTable, ctid)
+		}
+	}
+	stateLocker.Unlock()
+
+	for ctid, conntrack := range conntrackTable {
+		conntrack.Guardian.RLock()
+		tuple := conntrack.ClientSideTuple
+		session := conntrack.Session
+		conntrack.Guardian.RUnlock()
+		applyState(ctid, tuple, session)
+	}
+}
+
+// restoreRemote gives the sessions received in the peer role to dispatch. A
+// snapshot replaces the sessions from the peer and also restores the devices
+// and mappings, a delta adds and removes the sessions that changed, and an
+// update only adds the new sessions.
+func restoreRemote(snapshot *Snapshot) {
+	list := make([]dispatch.RemoteSession, 0, len(snapshot.Sessions))
+	for _, state := range snapshot.Sessions {
+		client := net.ParseIP(state.ClientAddress)
+		server := net.ParseIP(state.ServerAddress)
+		if client == nil || server == nil {
+			continue
+		}
+		tuple := dispatch.Tuple{Protocol: state.Protocol, ClientAddress: client, ClientPort: state.ClientPort, ServerAddress: server, ServerPort: state.ServerPort}
+		list = append(list, dispatch.RemoteSession{ClientSideTuple: tuple, Attachments: decodeValues(state.Attachments)})
+	}
+	dispatch.UpdateRemoteSessions(snapshot.Node, list, !snapshot.Update && !snapshot.Delta)
+
+	if len(snapshot.Removed) != 0 {
+		removed := make([]dispatch.Tuple, 0, len(snapshot.Removed))
+		for _, state := range snapshot.Removed {
+			removed = append(removed, dispatch.Tuple{Protocol: state.Protocol, ClientAddress: net.ParseIP(state.ClientAddress), ClientPort: state.ClientPort, ServerAddress: net.ParseIP(state.ServerAddress), ServerPort: state.ServerPort})
+		}
+		dispatch.RemoveRemoteSessions(snapshot.Node, removed)
+	}
+
+	if snapshot.Update {
+		return
+	}
+
+	for _, device := range snapshot.Devices {
+		inventory.ImportDevice(device)
+	}
+	restoreTables(snapshot.Tables)
+}
+
+// restoreTables writes the host and user mappings to the dictionary
+func restoreTables(list []TableEntry) {
+	for _, entry := range list {
+		key, err := decodeValue(entry.Key)
+		if err != nil {
+			continue
+		}
+		value, err := decodeValue(entry.Value)
+		if err != nil {
+			continue
+		}
+		dict.AddEntry(entry.Table, key, entry.Field, value)
+	}
+}
+
+// applyState writes the stored state of a session to the dictionary and to
+// the attachments. The dictionary is written as soon as the conntrack entry
+// exists, and the attachments once the session has been created.
+func applyState(ctid uint32, tuple dispatch.Tuple, session *dispatch.Session) {
+	key := tuple.String()
+
+	stateLocker.Lock()
+	if pending == nil {
+		stateLocker.Unlock()
+		return
+	}
+	if time.Since(pending.received) > config.hold {
+		logger.Info("Discarding %d sessions received %v ago\n", len(pending.sessions), time.Since(pending.received).Truncate(time.Second))
+		pending = nil
+		stateLocker.Unlock()
+		return
+	}
+	state := pending.sessions[key]
+	if state == nil {
+		stateLocker.Unlock()
+		return
+	}
+	flags := appliedTable[ctid]
+	writeDict := (flags&appliedDict == 0)
+	writeSession := (session != nil && flags&appliedSession == 0)
+	if writeDict {
+		flags |= appliedDict
+	}
+	if writeSession {
+		flags |= appliedSession
+	}
+	appliedTable[ctid] = flags
+	stateLocker.Unlock()
+
+	if writeDict && len(state.Dict) != 0 {
+		dict.AddEntries("sessions", ctid, decodeValues(state.Dict))
+	}
+
+	if writeSession {
+		for name, value := range decodeValues(state.Attachments) {
+			session.PutAttachment(name, value)
+		}
+		overseer.AddCounter("hasync_sessions_restored", 1)
+		logger.Debug("Restored the state of session %d %s\n", ctid, key)
+	}
+}
+
+// conntrackHandler applies the stored state when a conntrack entry is created,
+// which is when conntrackd copies the entry from the primary
+func conntrackHandler(message int, entry *dispatch.Conntrack) {
+	if message != 'N' {
+		return
+	}
+
+	entry.Guardian.RLock()
+	ctid := entry.ConntrackID
+	tuple := entry.ClientSideTuple
+	session := entry.Session
+	entry.Guardian.RUnlock()
+
+	applyState(ctid, tuple, session)
+}
+
+// nfqueueHandler applies the stored state when a session is created so the
+// other handlers see the classification from the primary. In the peer role
+// the new session is queued to be sent to the peer right away, so it can
+// track the reply direction if that passes through the other appliance.
+func nfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	if !newSession {
+		return dispatch.NfqueueResult{SessionRelease: true}
+	}
+
+	applyState(ctid, mess.Session.GetClientSideTuple(), mess.Session)
+
+	stateLocker.Lock()
+	peerRole := (config.enabled && config.role == RolePeer)
+	stateLocker.Unlock()
+
+	if peerRole && !mess.Session.IsRemote() {
+		tuple := mess.Session.GetClientSideTuple()
+		state := SessionState{
+			Protocol:      tuple.Protocol,
+			ClientAddress: tuple.ClientAddress.String(),
+			ClientPort:    tuple.ClientPort,
+			ServerAddress: tuple.ServerAddress.String(),
+			ServerPort:    tuple.ServerPort,
+		}
+		select {
+		case updateChannel <- state:
+		default:
+			overseer.AddCounter("hasync_updates_dropped", 1)
+		}
+	}
+
+	return dispatch.NfqueueResult{SessionRelease: true}
+}
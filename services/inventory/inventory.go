@@ -0,0 +1,314 @@
+// Package inventory maintains the table of devices that have been seen on the
+// local networks. Other services and plugins feed it with whatever they learn
+// about a device (address, hostname, vendor, model) and the details are also
+// written to the device and host tables in the dictionary.
+package inventory
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+)
+
+const cleanTimeout = 86400 * 7
+const cleanInterval = 3600
+
+// Device holds the details we know about a single device
+type Device struct {
+	MacAddress string            `json:"macAddress"`
+	IPAddress  string            `json:"ipAddress"`
+	Hostname   string            `json:"hostname"`
+	Vendor     string            `json:"vendor"`
+	Model      string            `json:"model"`
+	Details    map[string]string `json:"details"`
+	FirstSeen  time.Time         `json:"firstSeen"`
+	LastSeen   time.Time         `json:"lastSeen"`
+}
+
+var deviceTable map[string]*Device
+var addressTable map[string]string
+var deviceMutex sync.RWMutex
+var shutdownChannel = make(chan bool)
+
+// Startup function is called to allow service specific initialization.
+func Startup() {
+	deviceTable = make(map[string]*Device)
+	addressTable = make(map[string]string)
+	go cleanupTask()
+}
+
+// Shutdown function called when the daemon is shutting down.
+func Shutdown() {
+	shutdownChannel <- true
+	select {
+	case <-shutdownChannel:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown inventory cleanupTask\n")
+	}
+}
+
+// UpdateDevice updates the inventory entry for the argumented MAC address,
+// creating it if needed. The IP address is optional and will be ignored if
+// nil. The field can be hostname, vendor, model, or any other name which will
+// be stored in the device details. Empty fields or values are ignored.
+func UpdateDevice(mac net.HardwareAddr, ip net.IP, field string, value string) {
+	if len(mac) == 0 {
+		return
+	}
+
+	key := mac.String()
+	now := time.Now()
+
+	deviceMutex.Lock()
+	device := deviceTable[key]
+	discovered := (device == nil)
+	if discovered {
+		device = &Device{MacAddress: key, Details: make(map[string]string), FirstSeen: now}
+		deviceTable[key] = device
+		logger.Debug("Adding new device %s %v\n", key, ip)
+	}
+	device.LastSeen = now
+
+	if ip != nil && !ip.IsUnspecified() {
+		if device.IPAddress != "" && device.IPAddress != ip.String() {
+			delete(addressTable, device.IPAddress)
+		}
+		device.IPAddress = ip.String()
+		addressTable[device.IPAddress] = key
+	}
+
+	if field != "" && value != "" {
+		switch field {
+		case "hostname":
+			device.Hostname = value
+		case "vendor":
+			device.Vendor = value
+		case "model":
+			device.Model = value
+		default:
+			device.Details[field] = value
+		}
+	}
+	deviceMutex.Unlock()
+
+	if discovered {
+		data := map[string]interface{}{"mac_address": key}
+		if ip != nil && !ip.IsUnspecified() {
+			data["ip_address"] = ip.String()
+		}
+		if field != "" && value != "" {
+			data[field] = value
+		}
+		eventbus.Publish(eventbus.TopicDeviceDiscovered, "inventory", data)
+	}
+
+	if ip != nil && !ip.IsUnspecified() {
+		dict.AddDeviceEntry(mac, "ip_address", ip)
+		dict.AddHostEntry(ip, "mac_address", mac)
+	}
+
+	if field != "" && value != "" {
+		dict.AddDeviceEntry(mac, field, value)
+		if ip != nil && !ip.IsUnspecified() {
+			dict.AddHostEntry(ip, field, value)
+		}
+	}
+}
+
+// ImportDevice merges a device learned by another appliance into the
+// inventory. A device we already know is only replaced if the imported one
+// was seen more recently, and no discovery event is published since the
+// device was already announced on the appliance that found it.
+func ImportDevice(imported Device) {
+	mac, err := net.ParseMAC(imported.MacAddress)
+	if err != nil {
+		return
+	}
+
+	key := mac.String()
+
+	deviceMutex.Lock()
+	device := deviceTable[key]
+	if device != nil && !imported.LastSeen.After(device.LastSeen) {
+		deviceMutex.Unlock()
+		return
+	}
+	if device != nil && device.IPAddress != "" && addressTable[device.IPAddress] == key {
+		delete(addressTable, device.IPAddress)
+	}
+	fresh := copyDevice(&imported)
+	fresh.MacAddress = key
+	if device != nil && device.FirstSeen.Before(fresh.FirstSeen) {
+		fresh.FirstSeen = device.FirstSeen
+	}
+	deviceTable[key] = fresh
+	if fresh.IPAddress != "" {
+		addressTable[fresh.IPAddress] = key
+	}
+	deviceMutex.Unlock()
+
+	entries := map[string]interface{}{}
+	for field, value := range fresh.Details {
+		if value != "" {
+			entries[field] = value
+		}
+	}
+	if fresh.Hostname != "" {
+		entries["hostname"] = fresh.Hostname
+	}
+	if fresh.Vendor != "" {
+		entries["vendor"] = fresh.Vendor
+	}
+	if fresh.Model != "" {
+		entries["model"] = fresh.Model
+	}
+
+	ip := net.ParseIP(fresh.IPAddress)
+	if ip != nil {
+		entries["mac_address"] = mac
+		dict.AddEntries("host", ip, entries)
+		delete(entries, "mac_address")
+		entries["ip_address"] = ip
+	}
+	dict.AddEntries("device", mac, entries)
+}
+
+// FindDevice returns a copy of the inventory entry for the argumented MAC address or nil if not found
+func FindDevice(mac net.HardwareAddr) *Device {
+	deviceMutex.RLock()
+	defer deviceMutex.RUnlock()
+
+	device := deviceTable[mac.String()]
+	if device == nil {
+		return nil
+	}
+	return copyDevice(device)
+}
+
+// FindDeviceByAddress returns a copy of the inventory entry that currently
+// owns the argumented IP address or nil if not found
+func FindDeviceByAddress(ip net.IP) *Device {
+	deviceMutex.RLock()
+	defer deviceMutex.RUnlock()
+
+	key, found := addressTable[ip.String()]
+	if !found {
+		return nil
+	}
+	device := deviceTable[key]
+	if device == nil {
+		return nil
+	}
+	return copyDevice(device)
+}
+
+// GetDevices returns a copy of all devices in the inventory
+func GetDevices() []Device {
+	var list []Device
+
+	deviceMutex.RLock()
+	defer deviceMutex.RUnlock()
+
+	for _, device := range deviceTable {
+		list = append(list, *copyDevice(device))
+	}
+	return list
+}
+
+// LookupMacAddress returns the MAC address for the argumented IP address
+// using the inventory first and then the kernel neighbor table
+func LookupMacAddress(ip net.IP) net.HardwareAddr {
+	deviceMutex.RLock()
+	key, found := addressTable[ip.String()]
+	deviceMutex.RUnlock()
+
+	if found {
+		mac, err := net.ParseMAC(key)
+		if err == nil {
+			return mac
+		}
+	}
+
+	return lookupArpTable(ip)
+}
+
+// lookupArpTable searches /proc/net/arp for the argumented IPv4 address
+func lookupArpTable(ip net.IP) net.HardwareAddr {
+	if ip.To4() == nil {
+		return nil
+	}
+
+	file, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	target := ip.String()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// IP address, HW type, Flags, HW address, Mask, Device
+		if len(fields) < 6 || fields[0] != target {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil {
+			return nil
+		}
+		// incomplete entries have an all zero MAC address
+		if mac.String() == "00:00:00:00:00:00" {
+			return nil
+		}
+		return mac
+	}
+
+	return nil
+}
+
+// copyDevice returns a copy of the argumented device including the details map
+func copyDevice(device *Device) *Device {
+	dup := *device
+	dup.Details = make(map[string]string)
+	for k, v := range device.Details {
+		dup.Details[k] = v
+	}
+	return &dup
+}
+
+// cleanupTask is a periodic task to remove devices that have not been seen recently
+func cleanupTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(cleanInterval * time.Second):
+			cleanDeviceTable()
+		}
+	}
+}
+
+// cleanDeviceTable removes stale entries from the device table
+func cleanDeviceTable() {
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+
+	for key, device := range deviceTable {
+		if time.Now().Sub(device.LastSeen) < cleanTimeout*time.Second {
+			continue
+		}
+		logger.Debug("Removing stale device %s\n", key)
+		if addressTable[device.IPAddress] == key {
+			delete(addressTable, device.IPAddress)
+		}
+		delete(deviceTable, key)
+	}
+}
@@ -12,6 +12,11 @@
 static char		*g_warehouse_file = NULL;
 static int		g_warehouse_speed = 100;
 static int		g_warehouse_flag = 'I';
+static int		g_warehouse_paused = 0;
+static int		g_warehouse_steps = 0;
+static u_int64_t	g_warehouse_position = 0;
+static int		g_warehouse_origin = 0;
+static u_int32_t	g_warehouse_ctid = 0;
 static int		g_bypass = 0;
 static int		g_debug = 0;
 
@@ -131,3 +136,74 @@ void set_warehouse_speed(int value)
 {
 	g_warehouse_speed = value;
 }
+
+int get_warehouse_paused(void)
+{
+	return(g_warehouse_paused);
+}
+
+void set_warehouse_paused(int value)
+{
+	g_warehouse_paused = value;
+	if (value == 0) __sync_lock_test_and_set(&g_warehouse_steps,0);
+}
+
+void add_warehouse_steps(int count)
+{
+	__sync_fetch_and_add(&g_warehouse_steps,count);
+}
+
+/*
+ * Called by the playback before each record. While the playback is paused
+ * this waits until a step is added or the playback is resumed. Returns 1 if
+ * the record is played as a step, 0 if the playback is not paused, and -1
+ * if the daemon is shutting down.
+ */
+int warehouse_wait_step(void)
+{
+	struct timespec		wait;
+	int					steps;
+
+	wait.tv_sec = 0;
+	wait.tv_nsec = 10000000;
+
+	while (g_warehouse_paused != 0) {
+		if (get_shutdown_flag() != 0) return(-1);
+
+		steps = g_warehouse_steps;
+		if ((steps > 0) && (__sync_bool_compare_and_swap(&g_warehouse_steps,steps,steps - 1))) return(1);
+
+		nanosleep(&wait,NULL);
+	}
+
+	return(0);
+}
+
+void set_warehouse_played(int origin,uint32_t ctid)
+{
+	g_warehouse_origin = origin;
+	g_warehouse_ctid = ctid;
+	__sync_fetch_and_add(&g_warehouse_position,1);
+}
+
+u_int64_t get_warehouse_position(void)
+{
+	return(g_warehouse_position);
+}
+
+int get_warehouse_origin(void)
+{
+	return(g_warehouse_origin);
+}
+
+uint32_t get_warehouse_ctid(void)
+{
+	return(g_warehouse_ctid);
+}
+
+void reset_warehouse_position(void)
+{
+	g_warehouse_position = 0;
+	g_warehouse_origin = 0;
+	g_warehouse_ctid = 0;
+}
@@ -33,6 +33,13 @@
 
 #define LOG_TRACE	LOG_DEBUG+1
 
+// the callback sources and reasons passed to go_callback_error
+#define CALLBACK_NFQUEUE	1
+#define CALLBACK_CONNTRACK	2
+#define CALLBACK_NETLOGGER	3
+#define CALLBACK_ERROR_PARSE	1
+#define CALLBACK_ERROR_DROP	2
+
 /*
  * We have a single set of variables for the orig and repl source and
  * destination addresses that are large enough to hold either an IPv4
@@ -94,9 +101,10 @@ struct nflog_data {
 	struct nfattr	**nfa;
 };
 
-extern void go_nfqueue_callback(uint32_t mark,unsigned char* data,int len,uint32_t ctid,uint32_t nfid,uint32_t family,char* memory,int playflag,int index);
+extern void go_nfqueue_callback(uint32_t mark,unsigned char* data,int len,uint32_t ctid,uint32_t nfid,uint32_t family,uint32_t indev,uint16_t vlanid,char* memory,int playflag,int index);
 extern void go_netlogger_callback(struct netlogger_info* info,int playflag);
 extern void go_conntrack_callback(struct conntrack_info* info,int playflag);
+extern void go_callback_error(int source,int index,uint32_t indev,int reason);
 
 extern void go_child_startup(void);
 extern void go_child_shutdown(void);
@@ -124,6 +132,15 @@ void set_warehouse_file(char *filename);
 char *get_warehouse_file(void);
 int get_warehouse_speed(void);
 void set_warehouse_speed(int value);
+int get_warehouse_paused(void);
+void set_warehouse_paused(int value);
+void add_warehouse_steps(int count);
+int warehouse_wait_step(void);
+void set_warehouse_played(int origin,uint32_t ctid);
+u_int64_t get_warehouse_position(void);
+int get_warehouse_origin(void);
+uint32_t get_warehouse_ctid(void);
+void reset_warehouse_position(void);
 void start_warehouse_capture(void);
 void close_warehouse_capture(void);
 
@@ -131,15 +148,18 @@ int conntrack_startup(void);
 void conntrack_shutdown(void);
 int conntrack_thread(void);
 void conntrack_dump(void);
+int conntrack_update_timeout(uint8_t family,uint8_t proto,const void *saddr,const void *daddr,uint16_t sport,uint16_t dport,uint32_t ctid,uint32_t timeout);
 int conntrack_update_mark(uint32_t ctid, uint32_t mask, uint32_t value);
 
 int nfq_get_ct_info(struct nfq_data *nfad, unsigned char **data);
 uint32_t nfq_get_conntrack_id(struct nfq_data *nfad, int l3num);
+uint16_t nfq_get_vlan_id(struct nfq_data *nfad);
 int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data *nfad,void *data);
 int nfqueue_set_verdict(int index, uint32_t nfid, uint32_t verdict);
 int nfqueue_startup(int index);
 void nfqueue_shutdown(int index);
 int nfqueue_thread(int index);
+int nfqueue_get_base(void);
 void nfqueue_free_buffer(char *buffer);
 
 int netlogger_callback(struct nflog_g_handle *gh,struct nfgenmsg *nfmsg,struct nflog_data *nfa,void *data);
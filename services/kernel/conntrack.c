@@ -196,7 +196,8 @@ int conntrack_thread(void)
 		ret = select(sock+1,&tester,NULL,NULL,&tv);
 		if (ret < 1) continue;
 		if (FD_ISSET(sock,&tester) == 0) continue;
-		nfct_catch(nfcth);
+		// ENOBUFS means the kernel dropped events because we fell behind
+		if ((nfct_catch(nfcth) < 0) && (errno == ENOBUFS)) go_callback_error(CALLBACK_CONNTRACK,0,0,CALLBACK_ERROR_DROP);
 	}
 
 	// call our conntrack shutdown function
@@ -218,3 +219,43 @@ void conntrack_dump(void)
 	ret = nfct_send(nfcth,NFCT_Q_DUMP,&family);
 	if (ret < 0) logmessage(LOG_WARNING,logsrc,"nfct_send() result:%d errno:%d\n",ret,errno);
 }
+
+int conntrack_update_timeout(uint8_t family,uint8_t proto,const void *saddr,const void *daddr,uint16_t sport,uint16_t dport,uint32_t ctid,uint32_t timeout)
+{
+	struct nfct_handle	*handle;
+	struct nf_conntrack	*ct;
+	int					ret;
+
+	ct = nfct_new();
+	if (ct == NULL) return(-1);
+
+	// the kernel finds the entry by the original tuple and checks the ID
+	nfct_set_attr_u8(ct,ATTR_L3PROTO,family);
+	if (family == AF_INET) {
+		nfct_set_attr(ct,ATTR_IPV4_SRC,saddr);
+		nfct_set_attr(ct,ATTR_IPV4_DST,daddr);
+	} else {
+		nfct_set_attr(ct,ATTR_IPV6_SRC,saddr);
+		nfct_set_attr(ct,ATTR_IPV6_DST,daddr);
+	}
+	nfct_set_attr_u8(ct,ATTR_L4PROTO,proto);
+	nfct_set_attr_u16(ct,ATTR_PORT_SRC,htobe16(sport));
+	nfct_set_attr_u16(ct,ATTR_PORT_DST,htobe16(dport));
+	nfct_set_attr_u32(ct,ATTR_ID,ctid);
+	nfct_set_attr_u32(ct,ATTR_TIMEOUT,timeout);
+
+	// we use our own handle since the event handle belongs to the conntrack thread
+	handle = nfct_open(CONNTRACK,0);
+	if (handle == NULL) {
+		logmessage(LOG_WARNING,logsrc,"Error %d returned from nfct_open()\n",errno);
+		nfct_destroy(ct);
+		return(-1);
+	}
+
+	ret = nfct_query(handle,NFCT_Q_UPDATE,ct);
+	if (ret < 0) ret = errno;
+
+	nfct_close(handle);
+	nfct_destroy(ct);
+	return(ret);
+}
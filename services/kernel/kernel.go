@@ -8,22 +8,23 @@ package kernel
 import "C"
 
 import (
+	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 	"unsafe"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/untangle/packetd/services/logger"
 )
 
 // ConntrackCallback is a function to handle conntrack events
 type ConntrackCallback func(uint32, uint32, uint8, uint8, uint8, net.IP, net.IP, uint16, uint16, net.IP, net.IP, uint16, uint16, uint64, uint64, uint64, uint64, uint64, uint64, uint32, uint8)
 
-// NfqueueCallback is a function to handle nfqueue events
-type NfqueueCallback func(uint32, uint32, gopacket.Packet, int, uint32) int
+// NfqueueCallback is a function to handle nfqueue events. The last two
+// arguments are the input interface index and the 802.1Q VLAN ID.
+type NfqueueCallback func(uint32, uint32, []byte, uint32, uint32, uint16) int
 
 // NetloggerCallback is a function to handle netlogger events
 type NetloggerCallback func(uint8, uint8, uint16, uint8, uint8, string, string, uint16, uint16, uint32, uint32, string)
@@ -37,6 +38,7 @@ var netloggerCallback NetloggerCallback
 var shutdownFlag uint32
 var shutdownChannel = make(chan bool)
 var shutdownChannelCloseOnce sync.Once
+var nfqueueThreadCount int
 
 // FlagNoNfqueue can be set to disable the nfqueue callback
 var FlagNoNfqueue bool
@@ -55,8 +57,10 @@ var FlagNoCloud bool
 var nfCleanTracker map[uint32]bool
 var ctCleanTracker map[uint32]bool
 
-// Startup starts kernel services
-func Startup() {
+// Startup starts kernel services. The C services are started later by
+// StartCallbacks so there is nothing here that can fail yet.
+func Startup() error {
+	return nil
 }
 
 // Shutdown stops kernel services
@@ -71,6 +75,7 @@ func StartCallbacks(numNfqueueThreads int, intervalSeconds int) {
 	}
 
 	if FlagNoNfqueue == false {
+		nfqueueThreadCount = numNfqueueThreads
 		for x := 0; x < numNfqueueThreads; x++ {
 			go func(x C.int) {
 				//runtime.LockOSThread()
@@ -173,6 +178,13 @@ func SetBypassFlag(value int) {
 	C.set_bypass_flag(C.int(value))
 }
 
+// GetQueueRange returns the first and last nfqueue numbers we are listening
+// on. The last is less than the first if the nfqueue threads are not running.
+func GetQueueRange() (int, int) {
+	first := int(C.nfqueue_get_base())
+	return first, first + nfqueueThreadCount - 1
+}
+
 // GetWarehouseFlag gets the value of the warehouse traffic capture and playback flag
 func GetWarehouseFlag() int {
 	return int(C.get_warehouse_flag())
@@ -188,6 +200,52 @@ func SetWarehouseSpeed(value int) {
 	C.set_warehouse_speed(C.int(value))
 }
 
+// GetWarehouseSpeed gets the traffic playback speed
+func GetWarehouseSpeed() int {
+	return int(C.get_warehouse_speed())
+}
+
+// SetWarehousePaused pauses or resumes the traffic playback
+func SetWarehousePaused(value bool) {
+	if value {
+		C.set_warehouse_paused(C.int(1))
+	} else {
+		C.set_warehouse_paused(C.int(0))
+	}
+}
+
+// GetWarehousePaused returns true if the traffic playback is paused
+func GetWarehousePaused() bool {
+	return (C.get_warehouse_paused() != 0)
+}
+
+// StepWarehousePlayback lets a paused traffic playback play the argumented number of records
+func StepWarehousePlayback(count int) {
+	C.add_warehouse_steps(C.int(count))
+}
+
+// WaitWarehouseStep waits while the traffic playback is paused until a step is
+// taken. It returns false if the daemon is shutting down.
+func WaitWarehouseStep() bool {
+	return (C.warehouse_wait_step() >= 0)
+}
+
+// SetWarehousePlayed records the origin and conntrack ID of a played record
+func SetWarehousePlayed(origin int, ctid uint32) {
+	C.set_warehouse_played(C.int(origin), C.uint32_t(ctid))
+}
+
+// GetWarehousePosition returns the number of records played and the origin
+// and conntrack ID of the last one
+func GetWarehousePosition() (uint64, int, uint32) {
+	return uint64(C.get_warehouse_position()), int(C.get_warehouse_origin()), uint32(C.get_warehouse_ctid())
+}
+
+// ResetWarehousePosition clears the number of records played
+func ResetWarehousePosition() {
+	C.reset_warehouse_position()
+}
+
 // SetWarehouseFile sets the filename used by the warehouse for traffic capture and playback
 func SetWarehouseFile(filename string) {
 	C.set_warehouse_file(C.CString(filename))
@@ -232,9 +290,10 @@ func go_set_shutdown_flag() {
 }
 
 //export go_nfqueue_callback
-func go_nfqueue_callback(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint32_t, nfid C.uint32_t, family C.uint32_t, buffer *C.char, playflag C.int, index C.int) {
+func go_nfqueue_callback(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint32_t, nfid C.uint32_t, family C.uint32_t, indev C.uint32_t, vlanid C.uint16_t, buffer *C.char, playflag C.int, index C.int) {
 	if nfqueueCallback == nil {
 		logger.Warn("No queue callback registered. Ignoring packet.\n")
+		recordCallbackError(sourceNfqueue, int(index), uint32(indev), reasonDrop)
 		C.nfqueue_set_verdict(index, nfid, C.NF_ACCEPT)
 		C.nfqueue_free_buffer(buffer)
 		return
@@ -245,26 +304,19 @@ func go_nfqueue_callback(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint
 		nfCleanTracker[uint32(C.int(ctid))] = true
 	}
 
-	f := func(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint32_t, nfid C.uint32_t, family C.uint32_t, buffer *C.char) {
+	f := func(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint32_t, nfid C.uint32_t, family C.uint32_t, indev C.uint32_t, vlanid C.uint16_t, buffer *C.char) {
 
-		var packet gopacket.Packet
-		var packetLength int
 		var conntrackID uint32 = uint32(C.int(ctid))
 		var pmark uint32 = uint32(C.int(mark))
 		var fam uint32 = uint32(C.int(family))
 
-		// create a Go pointer and gopacket from the packet data
+		// create a Go slice that points directly at the packet data so we don't
+		// copy the packet, which means it is only valid until the buffer is freed
 		pointer := (*[0xFFFF]byte)(unsafe.Pointer(data))[:int(size):int(size)]
 
-		if pointer[0]&0xF0 == 0x40 {
-			packet = gopacket.NewPacket(pointer, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
-		} else {
-			packet = gopacket.NewPacket(pointer, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
-		}
-
-		packetLength = int(size)
-
-		verdict := nfqueueCallback(conntrackID, fam, packet, packetLength, pmark)
+		start := time.Now()
+		verdict := nfqueueCallback(conntrackID, fam, pointer, pmark, uint32(indev), uint16(vlanid))
+		recordNfqueue(int(index), uint32(indev), time.Since(start))
 		if playflag == 0 {
 			C.nfqueue_set_verdict(index, nfid, C.uint32_t(verdict))
 		}
@@ -283,9 +335,9 @@ func go_nfqueue_callback(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint
 	// if this is not a playback, handle this packet is a goroutine
 	// and return the main thread immediately so it can handle more packets
 	if playflag != 0 {
-		f(mark, data, size, ctid, nfid, family, buffer)
+		f(mark, data, size, ctid, nfid, family, indev, vlanid, buffer)
 	} else {
-		go f(mark, data, size, ctid, nfid, family, buffer)
+		go f(mark, data, size, ctid, nfid, family, indev, vlanid, buffer)
 	}
 
 	return
@@ -317,6 +369,7 @@ func go_conntrack_callback(info *C.struct_conntrack_info, playflag C.int) {
 
 	if conntrackCallback == nil {
 		logger.Warn("No conntrack callback registered. Ignoring event.\n")
+		recordCallbackError(sourceConntrack, int(info.msg_type), 0, reasonDrop)
 		return
 	}
 
@@ -380,10 +433,12 @@ func go_conntrack_callback(info *C.struct_conntrack_info, playflag C.int) {
 	clientPortNew = uint16(info.repl_dport)
 	serverPortNew = uint16(info.repl_sport)
 
+	start := time.Now()
 	conntrackCallback(ctid, connmark, family, eventType, protocol,
 		client, server, clientPort, serverPort,
 		clientNew, serverNew, clientPortNew, serverPortNew,
 		c2sBytes, s2cBytes, c2sPackets, s2cPackets, timestampStart, timestampStop, timeout, tcpState)
+	recordConntrack(eventType, time.Since(start))
 }
 
 //export go_netlogger_callback
@@ -403,10 +458,18 @@ func go_netlogger_callback(info *C.struct_netlogger_info, playflag C.int) {
 
 	if netloggerCallback == nil {
 		logger.Warn("No conntrack callback registered. Ignoring event.\n")
+		recordCallbackError(sourceNetlogger, int(srcInterface), 0, reasonDrop)
 		return
 	}
 
+	start := time.Now()
 	netloggerCallback(version, protocol, icmpType, srcInterface, dstInterface, srcAddress, dstAddress, srcPort, dstPort, mark, ctid, prefix)
+	recordNetlogger(srcInterface, time.Since(start))
+}
+
+//export go_callback_error
+func go_callback_error(source C.int, index C.int, indev C.uint32_t, reason C.int) {
+	recordCallbackError(int(source), int(index), uint32(indev), int(reason))
 }
 
 //export go_child_startup
@@ -453,6 +516,28 @@ func timeUntilNextMin() time.Duration {
 	return duration
 }
 
+// UpdateConntrackTimeout sets the timeout of the TCP or UDP conntrack entry with the
+// argumented ID and original tuple. The kernel still resets the timeout to the
+// protocol default for the state of the connection when the next packet is seen.
+func UpdateConntrackTimeout(ctid uint32, family uint8, protocol uint8, client net.IP, server net.IP, clientPort uint16, serverPort uint16, timeout uint32) error {
+	var saddr, daddr net.IP
+
+	if family == syscall.AF_INET {
+		saddr, daddr = client.To4(), server.To4()
+	} else {
+		saddr, daddr = client.To16(), server.To16()
+	}
+	if saddr == nil || daddr == nil {
+		return fmt.Errorf("invalid conntrack addresses %v %v", client, server)
+	}
+
+	ret := C.conntrack_update_timeout(C.uint8_t(family), C.uint8_t(protocol), unsafe.Pointer(&saddr[0]), unsafe.Pointer(&daddr[0]), C.uint16_t(clientPort), C.uint16_t(serverPort), C.uint32_t(ctid), C.uint32_t(timeout))
+	if ret != 0 {
+		return fmt.Errorf("conntrack update failed for ctid %d: %d", ctid, int(ret))
+	}
+	return nil
+}
+
 // WarehousePlaybackFile plays a warehouse capture file and returns the list of netfilter
 // conntrack sessions that were detected so the caller can clean them up
 func WarehousePlaybackFile(nflist map[uint32]bool, ctlist map[uint32]bool) {
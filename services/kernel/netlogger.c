@@ -69,7 +69,10 @@ int netlogger_callback(struct nflog_g_handle *gh,struct nfgenmsg *nfmsg,struct n
 
 	// get the raw packet and check for sanity
 	packet_size = nflog_get_payload(nfa,&packet_data);
-	if ((packet_data == NULL) || (packet_size < 20)) return(0);
+	if ((packet_data == NULL) || (packet_size < 20)) {
+		go_callback_error(CALLBACK_NETLOGGER,0,0,CALLBACK_ERROR_PARSE);
+		return(0);
+	}
 
 	// get the prefix string
 	prefix = nflog_get_prefix(nfa);
@@ -263,6 +266,7 @@ int netlogger_thread(void)
 		// recycle connection on error
 		if (ret < 0) {
 			logmessage(LOG_ERR,logsrc,"Error %d returned from recv() - Recycling nflog connection\n",errno);
+			go_callback_error(CALLBACK_NETLOGGER,0,0,CALLBACK_ERROR_DROP);
 			netlogger_shutdown();
 			sleep(1000);
 			ret = netlogger_startup();
@@ -59,6 +59,30 @@ unsigned int nfq_get_conntrack_id(struct nfq_data *nfad, int l3num)
 	return(id);
 }
 
+uint16_t nfq_get_vlan_id(struct nfq_data *nfad)
+{
+	struct nfattr			*vlan;
+	struct nfattr			*attr;
+	int						len;
+
+	// the kernel only includes the VLAN attribute when the packet has an 802.1Q tag
+	vlan = nfad->data[NFQA_VLAN-1];
+	if (vlan == NULL) return(0);
+
+	attr = NFA_DATA(vlan);
+	len = NFA_PAYLOAD(vlan);
+
+	while (NFA_OK(attr,len)) {
+		if ((NFA_TYPE(attr)) == NFQA_VLAN_TCI) {
+			// the VLAN ID is the low 12 bits of the tag control information
+			return(ntohs(*(uint16_t *)NFA_DATA(attr)) & 0x0FFF);
+		}
+		attr = NFA_NEXT(attr,len);
+	}
+
+	return(0);
+}
+
 int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data *nfad,void *data)
 {
 	struct nfqnl_msg_packet_hdr*    hdr;
@@ -66,6 +90,8 @@ int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data
     uint32_t                        mark;
 	uint32_t    					ctid;
     uint32_t                        nfid;
+    uint32_t                        indev;
+    uint16_t                        vlanid;
 	struct iphdr*                   iphead;
 	int								rawlen;
     uint32_t                        family;
@@ -82,6 +108,10 @@ int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data
 	mark = nfq_get_nfmark(nfad);
     family = nfmsg->nfgen_family;
 
+	// get the input interface index and the 802.1Q VLAN ID if the packet was tagged
+	indev = nfq_get_indev(nfad);
+	vlanid = nfq_get_vlan_id(nfad);
+
 	// get the packet length and data
 	rawlen = nfq_get_payload(nfad,(unsigned char **)&rawpkt);
 
@@ -89,6 +119,7 @@ int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data
 	if (rawlen < (int)sizeof(struct iphdr)) {
 		nfq_set_verdict(qh,(hdr ? ntohl(hdr->packet_id) : 0),NF_ACCEPT,0,NULL);
 		logmessage(LOG_WARNING,logsrc,"Invalid length %d received\n",rawlen);
+		go_callback_error(CALLBACK_NFQUEUE,index,indev,CALLBACK_ERROR_PARSE);
 		nfqueue_free_buffer(buff);
 		return(0);
 	}
@@ -97,6 +128,7 @@ int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data
 	iphead = (struct iphdr *)rawpkt;
 
 	if (iphead->version != 4 && iphead->version != 6) {
+		go_callback_error(CALLBACK_NFQUEUE,index,indev,CALLBACK_ERROR_PARSE);
 		nfqueue_free_buffer(buff);
         return(0);
     }
@@ -111,6 +143,7 @@ int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data
             ip_addr.s_addr = iphead->daddr;
             logmessage(LOG_DEBUG,logsrc,"Error: dst IP: %s\n", inet_ntoa(ip_addr));
         }
+		go_callback_error(CALLBACK_NFQUEUE,index,indev,CALLBACK_ERROR_PARSE);
 		nfqueue_set_verdict(index, nfid, NF_ACCEPT);
         nfqueue_free_buffer(buff);
         return 0;
@@ -118,7 +151,7 @@ int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data
 
 	if (get_warehouse_flag() == 'C') warehouse_capture('Q',rawpkt,rawlen,mark,ctid,nfid,family);
 
-	if (get_bypass_flag() == 0) go_nfqueue_callback(mark,rawpkt,rawlen,ctid,nfid,family,buff,0,index);
+	if (get_bypass_flag() == 0) go_nfqueue_callback(mark,rawpkt,rawlen,ctid,nfid,family,indev,vlanid,buff,0,index);
 	else nfqueue_set_verdict(index, nfid, NF_ACCEPT);
 
 	return(0);
@@ -225,6 +258,11 @@ void nfqueue_shutdown(int index)
         nfq_close(h);
 }
 
+int nfqueue_get_base(void)
+{
+	return(cfg_net_queue);
+}
+
 int nfqueue_thread(int index)
 {
 	struct pollfd	network;
@@ -295,6 +333,8 @@ int nfqueue_thread(int index)
         if (ret < 0) {
 			if ((errno == EAGAIN) || (errno == EINTR) || (errno == ENOBUFS)) {
 				logmessage(LOG_WARNING,logsrc,"Detected error %d (%s) while calling recv()\n",errno,strerror(errno));
+				// ENOBUFS means the kernel dropped messages because we fell behind
+				if (errno == ENOBUFS) go_callback_error(CALLBACK_NFQUEUE,index,0,CALLBACK_ERROR_DROP);
 				continue;
 			}
             logmessage(LOG_ERR,logsrc,"Error %d (%s) returned from recv()\n",errno,strerror(errno));
@@ -0,0 +1,217 @@
+package kernel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The callback sources and error reasons passed by the C code to
+// go_callback_error, which must match the values in common.h
+const (
+	sourceNfqueue   = 1
+	sourceConntrack = 2
+	sourceNetlogger = 3
+
+	reasonParse = 1
+	reasonDrop  = 2
+)
+
+// CallbackStats holds the counters for the callbacks of a queue, interface,
+// or event type. Dropped counts the messages that were lost before they got
+// to packetd, and Errors counts the messages that could not be parsed.
+type CallbackStats struct {
+	Events        uint64  `json:"events"`
+	Dropped       uint64  `json:"dropped"`
+	Errors        uint64  `json:"errors"`
+	AverageMicros float64 `json:"averageMicros"`
+	MaxMicros     float64 `json:"maxMicros"`
+}
+
+// Statistics holds the callback counters of the nfqueue, conntrack, and
+// netlogger handlers. The nfqueue counters are kept by queue number and by
+// input interface, the conntrack counters by event type, and the netlogger
+// counters by source interface id.
+type Statistics struct {
+	NfqueueQueues     map[string]CallbackStats `json:"nfqueueQueues"`
+	NfqueueInterfaces map[string]CallbackStats `json:"nfqueueInterfaces"`
+	Conntrack         map[string]CallbackStats `json:"conntrack"`
+	Netlogger         map[string]CallbackStats `json:"netlogger"`
+	Since             time.Time                `json:"since"`
+}
+
+// callbackCounter holds the counters for one key. Every field is updated
+// with atomic operations since the callbacks run on many threads.
+type callbackCounter struct {
+	events   uint64
+	dropped  uint64
+	errors   uint64
+	nanos    uint64
+	maxNanos uint64
+}
+
+// counterTable maps a key to the counters for it
+type counterTable struct {
+	table sync.Map
+}
+
+var nfqueueQueueStats counterTable
+var nfqueueInterfaceStats counterTable
+var conntrackStats counterTable
+var netloggerStats counterTable
+var statsSince atomic.Value
+
+func init() {
+	statsSince.Store(time.Now())
+}
+
+// GetStatistics returns the callback counters
+func GetStatistics() Statistics {
+	base, _ := GetQueueRange()
+
+	stats := Statistics{
+		NfqueueQueues:     nfqueueQueueStats.collect(func(key int) string { return strconv.Itoa(base + key) }),
+		NfqueueInterfaces: nfqueueInterfaceStats.collect(getInterfaceName),
+		Conntrack:         conntrackStats.collect(getConntrackEventName),
+		Netlogger:         netloggerStats.collect(strconv.Itoa),
+		Since:             statsSince.Load().(time.Time),
+	}
+	return stats
+}
+
+// ResetStatistics clears the callback counters
+func ResetStatistics() {
+	nfqueueQueueStats.reset()
+	nfqueueInterfaceStats.reset()
+	conntrackStats.reset()
+	netloggerStats.reset()
+	statsSince.Store(time.Now())
+}
+
+// recordNfqueue counts an nfqueue callback for the queue index and the input interface
+func recordNfqueue(index int, indev uint32, elapsed time.Duration) {
+	nfqueueQueueStats.get(index).record(elapsed)
+	nfqueueInterfaceStats.get(int(indev)).record(elapsed)
+}
+
+// recordConntrack counts a conntrack callback for the event type
+func recordConntrack(eventType uint8, elapsed time.Duration) {
+	conntrackStats.get(int(eventType)).record(elapsed)
+}
+
+// recordNetlogger counts a netlogger callback for the source interface id
+func recordNetlogger(srcInterface uint8, elapsed time.Duration) {
+	netloggerStats.get(int(srcInterface)).record(elapsed)
+}
+
+// recordCallbackError counts a message that was dropped or could not be parsed
+func recordCallbackError(source int, index int, indev uint32, reason int) {
+	var list []*callbackCounter
+
+	switch source {
+	case sourceNfqueue:
+		list = append(list, nfqueueQueueStats.get(index))
+		if indev != 0 {
+			list = append(list, nfqueueInterfaceStats.get(int(indev)))
+		}
+	case sourceConntrack:
+		list = append(list, conntrackStats.get(index))
+	case sourceNetlogger:
+		list = append(list, netloggerStats.get(index))
+	default:
+		return
+	}
+
+	for _, item := range list {
+		if reason == reasonDrop {
+			atomic.AddUint64(&item.dropped, 1)
+		} else {
+			atomic.AddUint64(&item.errors, 1)
+		}
+	}
+}
+
+// get returns the counters for a key, adding them if needed
+func (counters *counterTable) get(key int) *callbackCounter {
+	if item, found := counters.table.Load(key); found {
+		return item.(*callbackCounter)
+	}
+	item, _ := counters.table.LoadOrStore(key, new(callbackCounter))
+	return item.(*callbackCounter)
+}
+
+// reset removes all of the counters
+func (counters *counterTable) reset() {
+	counters.table.Range(func(key interface{}, value interface{}) bool {
+		counters.table.Delete(key)
+		return true
+	})
+}
+
+// collect returns the counters with the keys converted to names
+func (counters *counterTable) collect(name func(int) string) map[string]CallbackStats {
+	result := make(map[string]CallbackStats)
+	counters.table.Range(func(key interface{}, value interface{}) bool {
+		result[name(key.(int))] = value.(*callbackCounter).snapshot()
+		return true
+	})
+	return result
+}
+
+// record counts a callback and the time it took
+func (item *callbackCounter) record(elapsed time.Duration) {
+	nanos := uint64(elapsed)
+	atomic.AddUint64(&item.events, 1)
+	atomic.AddUint64(&item.nanos, nanos)
+	for {
+		current := atomic.LoadUint64(&item.maxNanos)
+		if nanos <= current || atomic.CompareAndSwapUint64(&item.maxNanos, current, nanos) {
+			return
+		}
+	}
+}
+
+// snapshot returns the current values of the counters
+func (item *callbackCounter) snapshot() CallbackStats {
+	stats := CallbackStats{
+		Events:    atomic.LoadUint64(&item.events),
+		Dropped:   atomic.LoadUint64(&item.dropped),
+		Errors:    atomic.LoadUint64(&item.errors),
+		MaxMicros: float64(atomic.LoadUint64(&item.maxNanos)) / 1000,
+	}
+	if stats.Events != 0 {
+		stats.AverageMicros = float64(atomic.LoadUint64(&item.nanos)) / float64(stats.Events) / 1000
+	}
+	return stats
+}
+
+// getInterfaceName returns the name of the interface with the argumented
+// index, or the index when the interface is gone. Zero is used when the
+// interface isn't known.
+func getInterfaceName(index int) string {
+	if index == 0 {
+		return "unknown"
+	}
+	if item, err := net.InterfaceByIndex(index); err == nil {
+		return item.Name
+	}
+	return fmt.Sprintf("index%d", index)
+}
+
+// getConntrackEventName returns the name of a conntrack event type
+func getConntrackEventName(eventType int) string {
+	switch eventType {
+	case 'N':
+		return "new"
+	case 'U':
+		return "update"
+	case 'D':
+		return "destroy"
+	case 0:
+		return "unknown"
+	}
+	return strconv.Itoa(eventType)
+}
@@ -0,0 +1,52 @@
+package kernel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the directory with the conntrack sysctls
+const conntrackSysctlPath = "/proc/sys/net/netfilter"
+
+// GetConntrackTimeouts returns the conntrack timeout sysctls in seconds. They are
+// named without the nf_conntrack_ prefix, like tcp_timeout_established.
+func GetConntrackTimeouts() map[string]int {
+	timeouts := make(map[string]int)
+
+	list, _ := filepath.Glob(conntrackSysctlPath + "/nf_conntrack_*timeout*")
+	for _, filename := range list {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		value, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			continue
+		}
+		timeouts[strings.TrimPrefix(filepath.Base(filename), "nf_conntrack_")] = value
+	}
+
+	return timeouts
+}
+
+// SetConntrackTimeout sets a conntrack timeout sysctl. The new value is used for the
+// connections that change state or see a packet after it is set.
+func SetConntrackTimeout(name string, seconds int) error {
+	if !strings.Contains(name, "timeout") || strings.ContainsAny(name, "/.") {
+		return fmt.Errorf("invalid conntrack timeout %s", name)
+	}
+	if seconds <= 0 {
+		return fmt.Errorf("invalid conntrack timeout %s value %d", name, seconds)
+	}
+
+	filename := conntrackSysctlPath + "/nf_conntrack_" + name
+	if _, err := os.Stat(filename); err != nil {
+		return fmt.Errorf("unknown conntrack timeout %s", name)
+	}
+
+	return ioutil.WriteFile(filename, []byte(strconv.Itoa(seconds)), 0644)
+}
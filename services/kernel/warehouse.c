@@ -100,6 +100,7 @@ void warehouse_playback(void)
 	FILE					*data;
 	size_t					found;
 	int						speed;
+	int						stepping;
 
 	filename = get_warehouse_file();
 
@@ -142,6 +143,7 @@ void warehouse_playback(void)
 	speed = get_warehouse_speed();
 	last.tv_sec = 0;
 	last.tv_nsec = 0;
+	reset_warehouse_position();
 
 	logmessage(LOG_INFO,logsrc,"Beginning playback %s version %d.%d speed %d%%\n",filename,fh.majver,fh.minver,speed);
 
@@ -179,7 +181,20 @@ void warehouse_playback(void)
 
 		// read the packet data from the file
 		found = fread(buffer,1,dh.length,data);
-		if (found != dh.length) break;
+		if (found != dh.length) {
+			free(buffer);
+			break;
+		}
+
+		// while paused the records are only played one step at a time
+		stepping = warehouse_wait_step();
+		if (stepping < 0) {
+			free(buffer);
+			break;
+		}
+
+		// the speed can be changed while the playback is running
+		speed = get_warehouse_speed();
 
 		// if last is not set this is the first packet so no sleep needed otherwise we calculate
 		// the difference between the last and current timestamp and pause for that long
@@ -196,9 +211,9 @@ void warehouse_playback(void)
 		last.tv_sec = dh.stamp_sec;
 		last.tv_nsec = dh.stamp_nsec;
 
-		// only sleep if speed is not zero and the pause is not zero
+		// only sleep if speed is not zero and the pause is not zero and we are not stepping
 		// FIXME - we currently ignore the remain value which would only be valid if the call is interrupted but do we even care?
-		if ((speed > 0) && ((pause.tv_sec != 0) || (pause.tv_nsec != 0))) {
+		if ((stepping == 0) && (speed > 0) && ((pause.tv_sec != 0) || (pause.tv_nsec != 0))) {
 			nanosleep(&pause,&remain);
 		}
 
@@ -206,17 +221,20 @@ void warehouse_playback(void)
 		{
 			case 'Q':
 				dh.ctid |= 0xF0000000;
-				go_nfqueue_callback(dh.mark,buffer,dh.length,dh.ctid,dh.nfid,dh.family,buffer,1,0);
+				go_nfqueue_callback(dh.mark,buffer,dh.length,dh.ctid,dh.nfid,dh.family,0,0,buffer,1,0);
+				set_warehouse_played(dh.origin,dh.ctid);
 				break;
 
 			case 'C':
 				ctptr->conn_id |= 0xF0000000;
 				go_conntrack_callback(ctptr,1);
+				set_warehouse_played(dh.origin,ctptr->conn_id);
 				free(buffer);
 				break;
 
 			case 'L':
 				go_netlogger_callback(nlptr,1);
+				set_warehouse_played(dh.origin,nlptr->ctid);
 				free(buffer);
 				break;
 
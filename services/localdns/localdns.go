@@ -0,0 +1,441 @@
+// Package localdns manages the names dnsmasq answers for on the LAN. The
+// static DNS records are kept in the dns section of the settings and the
+// hostnames given to the DHCP reservations in the dhcp section, so changes are
+// written to the settings, which runs sync-settings to rewrite the dnsmasq
+// configuration, and dnsmasq is then signaled to drop the cached names. The
+// names packetd knows from every source, the settings, the DHCP leases, and
+// the discovery traffic, can also be returned as one list.
+package localdns
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/untangle/packetd/services/discovery"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// The sources of the names
+const (
+	SourceStatic      = "static"
+	SourceReservation = "reservation"
+	SourceLease       = "lease"
+	SourceLease6      = "lease6"
+	SourceDiscovery   = "discovery"
+)
+
+// the lease files written by dnsmasq and odhcpd
+var leaseFile = "/tmp/dhcp.leases"
+var lease6File = "/tmp/hosts/odhcpd"
+
+// the settings paths of the static records and the DHCP reservations
+var staticPath = []string{"dns", "staticEntries"}
+var reservationPath = []string{"dhcp", "staticDhcpEntries"}
+
+// ErrNotFound is returned when removing a record or reservation that doesn't exist
+var ErrNotFound = errors.New("entry not found")
+
+// Record holds a name and an address packetd knows and where it came from
+type Record struct {
+	Name       string `json:"name"`
+	Address    string `json:"address"`
+	MacAddress string `json:"macAddress,omitempty"`
+	Source     string `json:"source"`
+	Expires    int64  `json:"expires,omitempty"`
+}
+
+// Reservation holds a DHCP reservation and the hostname dnsmasq gives it
+type Reservation struct {
+	MacAddress  string `json:"macAddress"`
+	Address     string `json:"address"`
+	Hostname    string `json:"hostname"`
+	Description string `json:"description,omitempty"`
+}
+
+// settingsLocker serializes the changes so one doesn't overwrite another
+var settingsLocker sync.Mutex
+
+// GetRecords returns the names from every source sorted by name
+func GetRecords() []Record {
+	var list []Record
+
+	static, _ := getEntries(staticPath, true)
+	for _, entry := range static {
+		name, _ := entry["name"].(string)
+		address, _ := entry["address"].(string)
+		if name != "" && address != "" {
+			list = append(list, Record{Name: name, Address: address, Source: SourceStatic})
+		}
+	}
+
+	reservations, _ := getEntries(reservationPath, true)
+	for _, entry := range reservations {
+		reservation := parseReservation(entry)
+		if reservation.Hostname != "" {
+			list = append(list, Record{Name: reservation.Hostname, Address: reservation.Address, MacAddress: reservation.MacAddress, Source: SourceReservation})
+		}
+	}
+
+	list = append(list, readLeases()...)
+	list = append(list, readLeases6()...)
+
+	for _, device := range discovery.GetDiscoveredDevices() {
+		if device.Hostname != "" {
+			list = append(list, Record{Name: device.Hostname, Address: device.Address, MacAddress: device.MacAddress, Source: SourceDiscovery})
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Source < list[j].Source
+	})
+	return list
+}
+
+// GetStaticRecords returns the static DNS records in the settings
+func GetStaticRecords() []Record {
+	list := []Record{}
+
+	entries, _ := getEntries(staticPath, false)
+	for _, entry := range entries {
+		name, _ := entry["name"].(string)
+		address, _ := entry["address"].(string)
+		list = append(list, Record{Name: name, Address: address, Source: SourceStatic})
+	}
+	return list
+}
+
+// AddStaticRecord adds a static DNS record. A record with the same name and
+// address is left alone.
+func AddStaticRecord(name string, address string) error {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if net.ParseIP(address) == nil {
+		return fmt.Errorf("invalid address %s", address)
+	}
+
+	settingsLocker.Lock()
+	defer settingsLocker.Unlock()
+
+	entries, err := getEntries(staticPath, false)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry["name"] == name && entry["address"] == address {
+			return nil
+		}
+	}
+
+	entries = append(entries, map[string]interface{}{"name": name, "address": address})
+	if err = setEntries(staticPath, entries); err != nil {
+		return err
+	}
+
+	logger.Info("Added static DNS record %s %s\n", name, address)
+	return nil
+}
+
+// RemoveStaticRecord removes the static DNS records for a name, or only the
+// one with the address if it is not empty
+func RemoveStaticRecord(name string, address string) error {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	settingsLocker.Lock()
+	defer settingsLocker.Unlock()
+
+	entries, err := getEntries(staticPath, false)
+	if err != nil {
+		return err
+	}
+
+	var kept []map[string]interface{}
+	for _, entry := range entries {
+		if entry["name"] == name && (address == "" || entry["address"] == address) {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	if len(kept) == len(entries) {
+		return ErrNotFound
+	}
+
+	if err = setEntries(staticPath, kept); err != nil {
+		return err
+	}
+
+	logger.Info("Removed static DNS record %s %s\n", name, address)
+	return nil
+}
+
+// GetReservations returns the DHCP reservations in the settings
+func GetReservations() []Reservation {
+	list := []Reservation{}
+
+	entries, _ := getEntries(reservationPath, false)
+	for _, entry := range entries {
+		list = append(list, parseReservation(entry))
+	}
+	return list
+}
+
+// SetReservation adds the DHCP reservation for a MAC address or changes the
+// address and hostname of the existing one. The other fields of an existing
+// reservation are kept.
+func SetReservation(reservation Reservation) error {
+	mac, err := net.ParseMAC(reservation.MacAddress)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %s", reservation.MacAddress)
+	}
+	if ip := net.ParseIP(reservation.Address); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid address %s", reservation.Address)
+	}
+	reservation.Hostname = strings.ToLower(reservation.Hostname)
+	if reservation.Hostname != "" {
+		if err = validateName(reservation.Hostname); err != nil {
+			return err
+		}
+		if strings.Contains(reservation.Hostname, ".") {
+			return fmt.Errorf("invalid hostname %s", reservation.Hostname)
+		}
+	}
+	reservation.MacAddress = mac.String()
+
+	settingsLocker.Lock()
+	defer settingsLocker.Unlock()
+
+	entries, err := getEntries(reservationPath, false)
+	if err != nil {
+		return err
+	}
+
+	var found map[string]interface{}
+	for _, entry := range entries {
+		if parseReservation(entry).MacAddress == reservation.MacAddress {
+			found = entry
+			continue
+		}
+		if entry["address"] == reservation.Address {
+			return fmt.Errorf("address %s is reserved for %v", reservation.Address, entry["macAddress"])
+		}
+	}
+	if found == nil {
+		found = make(map[string]interface{})
+		entries = append(entries, found)
+	}
+
+	found["macAddress"] = reservation.MacAddress
+	found["address"] = reservation.Address
+	if reservation.Hostname != "" {
+		found["hostname"] = reservation.Hostname
+	} else {
+		delete(found, "hostname")
+	}
+	if reservation.Description != "" {
+		found["description"] = reservation.Description
+	}
+
+	if err = setEntries(reservationPath, entries); err != nil {
+		return err
+	}
+
+	logger.Info("Set DHCP reservation %s %s %s\n", reservation.MacAddress, reservation.Address, reservation.Hostname)
+	return nil
+}
+
+// RemoveReservation removes the DHCP reservation for a MAC address
+func RemoveReservation(macAddress string) error {
+	mac, err := net.ParseMAC(macAddress)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %s", macAddress)
+	}
+
+	settingsLocker.Lock()
+	defer settingsLocker.Unlock()
+
+	entries, err := getEntries(reservationPath, false)
+	if err != nil {
+		return err
+	}
+
+	var kept []map[string]interface{}
+	for _, entry := range entries {
+		if parseReservation(entry).MacAddress != mac.String() {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(entries) {
+		return ErrNotFound
+	}
+
+	if err = setEntries(reservationPath, kept); err != nil {
+		return err
+	}
+
+	logger.Info("Removed DHCP reservation %s\n", mac.String())
+	return nil
+}
+
+// validateName returns an error if the name isn't a valid DNS name
+func validateName(name string) error {
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid name %s", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid name %s", name)
+		}
+		for _, char := range label {
+			if (char < 'a' || char > 'z') && (char < '0' || char > '9') && char != '-' {
+				return fmt.Errorf("invalid name %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseReservation returns the reservation from an entry in the settings
+func parseReservation(entry map[string]interface{}) Reservation {
+	var reservation Reservation
+	reservation.MacAddress, _ = entry["macAddress"].(string)
+	reservation.Address, _ = entry["address"].(string)
+	reservation.Hostname, _ = entry["hostname"].(string)
+	reservation.Description, _ = entry["description"].(string)
+	if mac, err := net.ParseMAC(reservation.MacAddress); err == nil {
+		reservation.MacAddress = mac.String()
+	}
+	return reservation
+}
+
+// getEntries returns the list of objects at the settings path from the
+// current settings or the saved settings. A missing list is empty.
+func getEntries(segments []string, current bool) ([]map[string]interface{}, error) {
+	var value interface{}
+	var err error
+
+	if current {
+		value, err = settings.GetCurrentSettings(segments)
+	} else {
+		value, err = settings.GetSettings(segments)
+	}
+	if err != nil || value == nil {
+		// the settings functions return an error when the list is missing
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid %s settings: %T", strings.Join(segments, "/"), value)
+	}
+
+	var entries []map[string]interface{}
+	for _, item := range list {
+		if entry, ok := item.(map[string]interface{}); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// setEntries writes the list of objects to the settings path and signals
+// dnsmasq once sync-settings has rewritten its configuration
+func setEntries(segments []string, entries []map[string]interface{}) error {
+	list := make([]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+
+	if _, err := settings.SetSettings(segments, list); err != nil {
+		return err
+	}
+
+	signalDnsmasq()
+	return nil
+}
+
+// signalDnsmasq sends SIGHUP to dnsmasq so it clears the cache and reads the
+// hosts files again
+func signalDnsmasq() {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile("/proc/" + dir.Name() + "/cmdline")
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		if filepath.Base(args[0]) != "dnsmasq" {
+			continue
+		}
+		if err = syscall.Kill(pid, syscall.SIGHUP); err != nil {
+			logger.Warn("Unable to signal dnsmasq %d: %v\n", pid, err)
+			continue
+		}
+		logger.Debug("Signaled dnsmasq %d\n", pid)
+	}
+}
+
+// readLeases returns the names from the dnsmasq lease file
+func readLeases() []Record {
+	var list []Record
+
+	data, err := ioutil.ReadFile(leaseFile)
+	if err != nil {
+		return list
+	}
+
+	// <expires> <mac> <address> <hostname> <client id>
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] == "*" {
+			continue
+		}
+		expires, _ := strconv.ParseInt(fields[0], 10, 64)
+		list = append(list, Record{Name: fields[3], Address: fields[2], MacAddress: fields[1], Source: SourceLease, Expires: expires})
+	}
+	return list
+}
+
+// readLeases6 returns the names from the odhcpd lease file
+func readLeases6() []Record {
+	var list []Record
+
+	data, err := ioutil.ReadFile(lease6File)
+	if err != nil {
+		return list
+	}
+
+	// # <interface> <duid> <iaid> <hostname> <valid until> <assigned> <length> <address/length>...
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 9 || fields[0] != "#" || fields[2] == "ipv4" || fields[4] == "-" {
+			continue
+		}
+		expires, _ := strconv.ParseInt(fields[5], 10, 64)
+		for _, address := range fields[8:] {
+			address = strings.SplitN(address, "/", 2)[0]
+			list = append(list, Record{Name: fields[4], Address: address, Source: SourceLease6, Expires: expires})
+		}
+	}
+	return list
+}
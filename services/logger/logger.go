@@ -102,13 +102,13 @@ func LogMessage(level int32, format string, args ...interface{}) {
 	}
 
 	if len(args) == 0 {
-		fmt.Printf("%s%-6s %18s: %s", getPrefix(), logLevelName[level], packageName, format)
+		writeMessage(level, packageName, format)
 	} else {
 		buffer := LogFormatter(format, args...)
 		if len(buffer) == 0 {
 			return
 		}
-		fmt.Printf("%s%-6s %18s: %s", getPrefix(), logLevelName[level], packageName, buffer)
+		writeMessage(level, packageName, buffer)
 	}
 }
 
@@ -120,13 +120,13 @@ func LogMessageSource(level int32, source string, format string, args ...interfa
 	}
 
 	if len(args) == 0 {
-		fmt.Printf("%s%-6s %18s: %s", getPrefix(), logLevelName[level], source, format)
+		writeMessage(level, source, format)
 	} else {
 		buffer := LogFormatter(format, args...)
 		if len(buffer) == 0 {
 			return
 		}
-		fmt.Printf("%s%-6s %18s: %s", getPrefix(), logLevelName[level], source, buffer)
+		writeMessage(level, source, buffer)
 	}
 }
 
@@ -0,0 +1,44 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// the number of recent log messages we keep for the crash reports
+const recentMessageLimit = 200
+
+var recentMessages [recentMessageLimit]string
+var recentIndex int
+var recentCount int
+var recentLocker sync.Mutex
+
+// writeMessage prints a log message and keeps a copy with the wall clock time
+// in the recent messages so it can be included when a panic is reported
+func writeMessage(level int32, source string, message string) {
+	fmt.Printf("%s%-6s %18s: %s", getPrefix(), logLevelName[level], source, message)
+
+	line := fmt.Sprintf("%s %-6s %s: %s", time.Now().Format("2006-01-02T15:04:05.000"), logLevelName[level], source, message)
+
+	recentLocker.Lock()
+	recentMessages[recentIndex] = line
+	recentIndex = (recentIndex + 1) % recentMessageLimit
+	if recentCount < recentMessageLimit {
+		recentCount++
+	}
+	recentLocker.Unlock()
+}
+
+// GetRecentMessages returns the most recent log messages with the oldest first
+func GetRecentMessages() []string {
+	recentLocker.Lock()
+	defer recentLocker.Unlock()
+
+	list := make([]string, 0, recentCount)
+	start := (recentIndex - recentCount + recentMessageLimit) % recentMessageLimit
+	for i := 0; i < recentCount; i++ {
+		list = append(list, recentMessages[(start+i)%recentMessageLimit])
+	}
+	return list
+}
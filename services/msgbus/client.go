@@ -0,0 +1,190 @@
+package msgbus
+
+import (
+	"sync/atomic"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// handleMessage handles a message from a connected client
+func (client *busClient) handleMessage(message *Message) {
+	atomic.AddUint64(&client.received, 1)
+
+	switch message.Type {
+	case TypePing:
+		reply := newMessage(TypePong)
+		reply.ID = message.ID
+		client.send(reply, true)
+	case TypeSubscribe:
+		for _, topic := range message.Topics {
+			if !client.allowTopic(topic) {
+				client.send(newError(message.ID, "topic not allowed: "+topic), true)
+				return
+			}
+		}
+		client.setTopics(mergeTopics(client.getTopics(), message.Topics, true))
+		client.sendResult(message.ID, client.getTopics())
+	case TypeUnsubscribe:
+		client.setTopics(mergeTopics(client.getTopics(), message.Topics, false))
+		client.sendResult(message.ID, client.getTopics())
+	case TypeCommand:
+		client.runCommand(message)
+	default:
+		client.send(newError(message.ID, "unknown type: "+message.Type), true)
+	}
+}
+
+// runCommand runs a command if the client can use it and sends the result
+func (client *busClient) runCommand(message *Message) {
+	function, found := commandTable[message.Command]
+	if !found {
+		client.send(newError(message.ID, "unknown command: "+message.Command), true)
+		return
+	}
+	if !client.getConfig().commands[message.Command] {
+		client.send(newError(message.ID, "command not allowed: "+message.Command), true)
+		return
+	}
+
+	logger.Debug("Running message bus command %s for %s\n", message.Command, client.name)
+	result, err := function(client, message.Args)
+	if err != nil {
+		client.send(newError(message.ID, err.Error()), true)
+		return
+	}
+	client.sendResult(message.ID, result)
+}
+
+// sendResult sends the result of a request
+func (client *busClient) sendResult(id string, result interface{}) {
+	reply := newMessage(TypeResult)
+	reply.ID = id
+	reply.Result = result
+	client.send(reply, true)
+}
+
+// send queues a message for the client. The replies wait for room in the
+// queue but events are dropped if the client is not keeping up.
+func (client *busClient) send(message *Message, wait bool) {
+	if wait {
+		client.sendList <- message
+		return
+	}
+	select {
+	case client.sendList <- message:
+	default:
+		atomic.AddUint64(&client.dropped, 1)
+		logger.Warn("%OC|Message bus client %s is full, dropping event\n", "msgbus_dropped", 100, client.name)
+	}
+}
+
+// writeTask writes the queued messages to the client until the queue is closed
+func (client *busClient) writeTask(done chan bool) {
+	defer close(done)
+	for message := range client.sendList {
+		if err := writeMessage(client.conn, message); err != nil {
+			logger.Debug("Unable to write to message bus client %s: %v\n", client.name, err)
+			client.conn.Close()
+			// keep draining so the senders never block
+			for range client.sendList {
+			}
+			return
+		}
+	}
+}
+
+// allowTopic returns true if the client can subscribe to the topic
+func (client *busClient) allowTopic(topic string) bool {
+	return client.getConfig().allowTopic(topic)
+}
+
+// getConfig returns the settings of the client, which are replaced when the
+// settings are reloaded
+func (client *busClient) getConfig() *clientConfig {
+	clientLocker.Lock()
+	defer clientLocker.Unlock()
+	return client.config
+}
+
+// allowTopic returns true if the topic is covered by one of the topics
+// allowed in the settings
+func (item *clientConfig) allowTopic(topic string) bool {
+	for _, pattern := range item.topics {
+		if eventbus.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// getTopics returns the topics the client is subscribed to
+func (client *busClient) getTopics() []string {
+	clientLocker.Lock()
+	defer clientLocker.Unlock()
+	return append([]string{}, client.topics...)
+}
+
+// setTopics replaces the event subscription of the client. The event bus
+// subscriptions have a fixed list of topics so the old one is removed.
+func (client *busClient) setTopics(topics []string) {
+	clientLocker.Lock()
+	old := client.sub
+	oldDone := client.subDone
+	client.sub = nil
+	client.subDone = nil
+	client.topics = nil
+	if len(topics) != 0 {
+		client.sub = eventbus.Subscribe("msgbus:"+client.name, 0, topics...)
+		client.subDone = make(chan bool)
+		client.topics = topics
+		go client.forwardTask(client.sub, client.subDone)
+	}
+	clientLocker.Unlock()
+
+	if old != nil {
+		eventbus.Unsubscribe(old)
+		<-oldDone
+	}
+}
+
+// forwardTask sends the events from a subscription to the client until the
+// subscription is removed
+func (client *busClient) forwardTask(sub *eventbus.Subscription, done chan bool) {
+	defer close(done)
+	for event := range sub.Events() {
+		message := newMessage(TypeEvent)
+		item := event
+		message.Event = &item
+		client.send(message, false)
+	}
+}
+
+// mergeTopics adds or removes topics from a list
+func mergeTopics(current []string, changes []string, add bool) []string {
+	result := []string{}
+	for _, topic := range current {
+		if !add && contains(changes, topic) {
+			continue
+		}
+		result = append(result, topic)
+	}
+	if add {
+		for _, topic := range changes {
+			if !contains(result, topic) {
+				result = append(result, topic)
+			}
+		}
+	}
+	return result
+}
+
+// contains returns true if the list has the argumented string
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
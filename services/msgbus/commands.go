@@ -0,0 +1,84 @@
+package msgbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// commandFunction runs a message bus command for a client with the arguments from the message
+type commandFunction func(client *busClient, args json.RawMessage) (interface{}, error)
+
+// The commands are limited to reading state and raising alerts, so a
+// companion process can't change how traffic is handled
+var commandTable = map[string]commandFunction{
+	"status":   commandStatus,
+	"counter":  commandCounter,
+	"settings": commandSettings,
+	"alert":    commandAlert,
+}
+
+// commandStatus returns the event bus status
+func commandStatus(client *busClient, args json.RawMessage) (interface{}, error) {
+	return eventbus.GetStatus(), nil
+}
+
+// commandCounter returns the value of an overseer counter
+func commandCounter(client *busClient, args json.RawMessage) (interface{}, error) {
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := unmarshalArgs(args, &request); err != nil {
+		return nil, err
+	}
+	if request.Name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	return overseer.GetCounter(request.Name), nil
+}
+
+// commandSettings returns the settings at a slash separated path with the
+// secrets redacted
+func commandSettings(client *busClient, args json.RawMessage) (interface{}, error) {
+	var request struct {
+		Path string `json:"path"`
+	}
+	if err := unmarshalArgs(args, &request); err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	if path := strings.Trim(request.Path, "/"); path != "" {
+		segments = strings.Split(path, "/")
+	}
+	return settings.GetSettings(segments)
+}
+
+// commandAlert publishes an alert on the event bus from the client
+func commandAlert(client *busClient, args json.RawMessage) (interface{}, error) {
+	var request struct {
+		Message string                 `json:"message"`
+		Details map[string]interface{} `json:"details"`
+	}
+	if err := unmarshalArgs(args, &request); err != nil {
+		return nil, err
+	}
+	if request.Message == "" {
+		return nil, fmt.Errorf("missing message")
+	}
+
+	eventbus.PublishAlert("msgbus:"+client.name, request.Message, request.Details)
+	return "OK", nil
+}
+
+// unmarshalArgs decodes the command arguments, which can be missing
+func unmarshalArgs(args json.RawMessage, target interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	return json.Unmarshal(args, target)
+}
@@ -0,0 +1,491 @@
+// Package msgbus lets companion processes on the box, like classd, the UI
+// backend, or custom scripts, subscribe to the packetd events and run a
+// limited set of commands over a local unix socket. Each message is a
+// versioned JSON object on a line. The message bus is disabled unless it is
+// enabled in the settings. Only root can connect to the socket, which is
+// checked again with the peer credentials, and a client starts with a hello
+// message that must have the token of a client from the settings, which
+// limits the topics and commands it can use.
+package msgbus
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the message bus settings are missing
+const defaultSocketFile = "/var/run/packetd-msgbus.sock"
+
+// the limits on a client connection
+const helloTimeout = 10 * time.Second
+const maxMessageSize = 65536
+const sendQueueSize = 256
+
+// clientConfig holds a client from the settings that can connect with a token
+type clientConfig struct {
+	name     string
+	token    string
+	topics   []string
+	commands map[string]bool
+}
+
+// busConfig holds the message bus settings
+type busConfig struct {
+	enabled    bool
+	socketFile string
+	clients    []*clientConfig
+}
+
+// busClient is a connected client
+type busClient struct {
+	conn     net.Conn
+	name     string
+	config   *clientConfig
+	sendList chan *Message
+	topics   []string
+	sub      *eventbus.Subscription
+	subDone  chan bool
+	dropped  uint64
+	received uint64
+}
+
+// ClientStatus holds the state of a connected client
+type ClientStatus struct {
+	Name     string   `json:"name"`
+	Topics   []string `json:"topics"`
+	Received uint64   `json:"received"`
+	Dropped  uint64   `json:"dropped"`
+}
+
+// Status holds the message bus state
+type Status struct {
+	Enabled    bool           `json:"enabled"`
+	SocketFile string         `json:"socketFile"`
+	Version    int            `json:"version"`
+	Clients    []ClientStatus `json:"clients"`
+}
+
+var currentConfig *busConfig
+var configLocker sync.RWMutex
+var listener net.Listener
+var listenerFile string
+var listenerLocker sync.Mutex
+var clientTable = make(map[*busClient]bool)
+var clientLocker sync.Mutex
+
+// init registers the client tokens with the settings secrets
+func init() {
+	settings.RegisterSecret("msgbus/clients/*/token", settings.SecretEncrypt)
+}
+
+// Startup is called to handle service startup
+func Startup() {
+	Reload()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	stopListener()
+
+	clientLocker.Lock()
+	for client := range clientTable {
+		client.conn.Close()
+	}
+	clientLocker.Unlock()
+}
+
+// Reload loads the message bus settings and restarts the socket if it changed.
+// Connected clients get the access from the new settings, and are
+// disconnected if their token was removed or the message bus was disabled.
+func Reload() {
+	fresh := loadConfig()
+
+	configLocker.Lock()
+	currentConfig = fresh
+	configLocker.Unlock()
+
+	checkClients(fresh)
+
+	listenerLocker.Lock()
+	running := listener != nil
+	changed := listenerFile != fresh.socketFile
+	listenerLocker.Unlock()
+
+	if running && (!fresh.enabled || changed) {
+		stopListener()
+		running = false
+	}
+	if fresh.enabled && !running {
+		startListener(fresh.socketFile)
+	}
+}
+
+// checkClients applies the argumented settings to the connected clients. A
+// client whose token is no longer in the settings or that is subscribed to a
+// topic it is no longer allowed to use is disconnected, and every client is
+// disconnected when the message bus is disabled. The others get the new
+// topics and commands.
+func checkClients(config *busConfig) {
+	clientLocker.Lock()
+	defer clientLocker.Unlock()
+
+	for client := range clientTable {
+		var item *clientConfig
+		if config.enabled {
+			item = findClientConfig(config, client.config.token)
+		}
+
+		if item == nil {
+			logger.Info("Disconnecting message bus client %s\n", client.name)
+			client.conn.Close()
+			continue
+		}
+
+		client.config = item
+		for _, topic := range client.topics {
+			if !item.allowTopic(topic) {
+				logger.Info("Disconnecting message bus client %s from topic %s\n", client.name, topic)
+				client.conn.Close()
+				break
+			}
+		}
+	}
+}
+
+// findClientConfig returns the client from the settings with the argumented
+// token or nil if there isn't one
+func findClientConfig(config *busConfig, token string) *clientConfig {
+	for _, item := range config.clients {
+		if subtle.ConstantTimeCompare([]byte(item.token), []byte(token)) == 1 {
+			return item
+		}
+	}
+	return nil
+}
+
+// GetStatus returns the message bus state and the connected clients
+func GetStatus() Status {
+	configLocker.RLock()
+	config := currentConfig
+	configLocker.RUnlock()
+
+	status := Status{Version: SchemaVersion, Clients: []ClientStatus{}}
+	if config != nil {
+		status.Enabled = config.enabled
+		status.SocketFile = config.socketFile
+	}
+
+	clientLocker.Lock()
+	for client := range clientTable {
+		item := ClientStatus{Name: client.name, Topics: append([]string{}, client.topics...)}
+		item.Received = atomic.LoadUint64(&client.received)
+		item.Dropped = atomic.LoadUint64(&client.dropped)
+		status.Clients = append(status.Clients, item)
+	}
+	clientLocker.Unlock()
+
+	return status
+}
+
+// loadConfig returns the message bus settings
+func loadConfig() *busConfig {
+	fresh := &busConfig{socketFile: defaultSocketFile}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"msgbus"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			for _, problem := range compileConfig(fresh, item) {
+				logger.Warn("Ignoring invalid message bus %v\n", problem)
+			}
+		} else {
+			logger.Warn("Invalid message bus settings: %T\n", configJSON)
+		}
+	}
+
+	logger.Info("Loaded message bus settings enabled:%v socket:%s clients:%d\n", fresh.enabled, fresh.socketFile, len(fresh.clients))
+	return fresh
+}
+
+// compileConfig fills the config from a settings object. Invalid clients
+// are skipped and returned as errors.
+func compileConfig(fresh *busConfig, item map[string]interface{}) []error {
+	var problems []error
+
+	if value, ok := item["enabled"].(bool); ok {
+		fresh.enabled = value
+	}
+	if value, ok := item["socketFile"].(string); ok && value != "" {
+		fresh.socketFile = value
+	}
+
+	clientSlice, _ := item["clients"].([]interface{})
+	for index, value := range clientSlice {
+		entry, ok := value.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Errorf("client %d: not an object", index))
+			continue
+		}
+
+		client := &clientConfig{commands: make(map[string]bool)}
+		client.name, _ = entry["name"].(string)
+		client.token, _ = entry["token"].(string)
+		if client.name == "" || client.token == "" {
+			problems = append(problems, fmt.Errorf("client %d: missing name or token", index))
+			continue
+		}
+		client.topics = parseStringList(entry["topics"])
+		for _, command := range parseStringList(entry["commands"]) {
+			if _, found := commandTable[command]; !found {
+				problems = append(problems, fmt.Errorf("client %s: unknown command %s", client.name, command))
+				continue
+			}
+			client.commands[command] = true
+		}
+		fresh.clients = append(fresh.clients, client)
+	}
+
+	return problems
+}
+
+// parseStringList returns the strings in a settings list
+func parseStringList(value interface{}) []string {
+	var result []string
+	list, _ := value.([]interface{})
+	for _, entry := range list {
+		if text, ok := entry.(string); ok && text != "" {
+			result = append(result, text)
+		}
+	}
+	return result
+}
+
+// startListener starts accepting clients on the unix socket, which only root
+// can connect to
+func startListener(filename string) {
+	os.Remove(filename)
+
+	socket, err := net.Listen("unix", filename)
+	if err != nil {
+		logger.Warn("Unable to listen on %s: %v\n", filename, err)
+		return
+	}
+
+	err = os.Chmod(filename, 0600)
+	if err != nil {
+		logger.Warn("Unable to set permissions on %s: %v\n", filename, err)
+		socket.Close()
+		return
+	}
+
+	listenerLocker.Lock()
+	listener = socket
+	listenerFile = filename
+	listenerLocker.Unlock()
+
+	logger.Info("Listening for message bus clients on %s\n", filename)
+	go acceptClients(socket)
+}
+
+// stopListener stops accepting clients
+func stopListener() {
+	listenerLocker.Lock()
+	defer listenerLocker.Unlock()
+
+	if listener == nil {
+		return
+	}
+	listener.Close()
+	os.Remove(listenerFile)
+	listener = nil
+	listenerFile = ""
+}
+
+// acceptClients accepts clients until the listener is closed
+func acceptClients(socket net.Listener) {
+	for {
+		conn, err := socket.Accept()
+		if err != nil {
+			return
+		}
+		go handleClient(conn)
+	}
+}
+
+// handleClient checks the hello message from a client and then handles the
+// messages until the client disconnects
+func handleClient(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, 4096)
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	hello, err := readMessage(reader)
+	if err != nil {
+		writeMessage(conn, newError("", err.Error()))
+		return
+	}
+
+	client, err := authenticateClient(conn, hello)
+	if err != nil {
+		logger.Warn("%OC|Rejected message bus client %s: %v\n", "msgbus_client_rejected", 10, hello.Name, err)
+		writeMessage(conn, newError(hello.ID, err.Error()))
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	logger.Info("Message bus client %s connected\n", client.name)
+	overseer.AddCounter("msgbus_client_connect", 1)
+
+	writerDone := make(chan bool)
+	go client.writeTask(writerDone)
+
+	welcome := newMessage(TypeWelcome)
+	welcome.ID = hello.ID
+	welcome.Name = client.name
+	client.send(welcome, true)
+
+	for {
+		message, err := readMessage(reader)
+		if err != nil {
+			if _, ok := err.(*schemaError); ok {
+				client.send(newError("", err.Error()), true)
+				continue
+			}
+			break
+		}
+		client.handleMessage(message)
+	}
+
+	clientLocker.Lock()
+	delete(clientTable, client)
+	clientLocker.Unlock()
+
+	client.setTopics(nil)
+	close(client.sendList)
+	<-writerDone
+
+	logger.Info("Message bus client %s disconnected\n", client.name)
+}
+
+// schemaError is returned for a message that isn't valid but doesn't end the connection
+type schemaError struct {
+	text string
+}
+
+func (problem *schemaError) Error() string {
+	return problem.text
+}
+
+// readMessage reads and decodes the next message from a client
+func readMessage(reader *bufio.Reader) (*Message, error) {
+	var line []byte
+	for {
+		chunk, prefix, err := reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxMessageSize {
+			return nil, fmt.Errorf("message too large")
+		}
+		if !prefix {
+			break
+		}
+	}
+
+	message := new(Message)
+	if err := json.Unmarshal(line, message); err != nil {
+		return nil, &schemaError{text: "invalid message: " + err.Error()}
+	}
+	if message.Version != SchemaVersion {
+		return nil, &schemaError{text: fmt.Sprintf("unsupported version %d, expected %d", message.Version, SchemaVersion)}
+	}
+	return message, nil
+}
+
+// writeMessage encodes a message and writes it to the connection
+func writeMessage(conn net.Conn, message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+// authenticateClient returns the client for a hello message and adds it to
+// the connected clients. The process on the other end must run as root or as
+// the same user as packetd, and must give the token of a client in the
+// settings.
+func authenticateClient(conn net.Conn, hello *Message) (*busClient, error) {
+	if hello.Type != TypeHello {
+		return nil, fmt.Errorf("expected hello")
+	}
+
+	uid := getPeerUID(conn)
+	if uid != 0 && uid != os.Geteuid() {
+		return nil, fmt.Errorf("peer user %d not allowed", uid)
+	}
+	if hello.Token == "" {
+		return nil, fmt.Errorf("token required")
+	}
+
+	client := &busClient{conn: conn, name: hello.Name, sendList: make(chan *Message, sendQueueSize)}
+
+	// the settings are read and the client is added with the lock held so a
+	// reload either happens first or sees the client
+	clientLocker.Lock()
+	defer clientLocker.Unlock()
+
+	configLocker.RLock()
+	config := currentConfig
+	configLocker.RUnlock()
+
+	if !config.enabled {
+		return nil, fmt.Errorf("message bus disabled")
+	}
+	item := findClientConfig(config, hello.Token)
+	if item == nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	client.name = item.name
+	client.config = item
+	clientTable[client] = true
+	return client, nil
+}
+
+// getPeerUID returns the user id of the process on the other end of a unix
+// socket or -1 if it can't be found
+func getPeerUID(conn net.Conn) int {
+	unix, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1
+	}
+	raw, err := unix.SyscallConn()
+	if err != nil {
+		return -1
+	}
+
+	uid := -1
+	raw.Control(func(fd uintptr) {
+		cred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+		if err == nil {
+			uid = int(cred.Uid)
+		}
+	})
+	return uid
+}
@@ -0,0 +1,60 @@
+package msgbus
+
+import (
+	"encoding/json"
+
+	"github.com/untangle/packetd/services/eventbus"
+)
+
+// SchemaVersion is the version of the message bus messages. A client must use this
+// version in every message, and the version only changes when a message
+// changes in a way old clients can't handle.
+const SchemaVersion = 1
+
+// The message types a client can send
+const (
+	TypeHello       = "hello"
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypeCommand     = "command"
+	TypePing        = "ping"
+)
+
+// The message types the message bus sends
+const (
+	TypeWelcome = "welcome"
+	TypeEvent   = "event"
+	TypeResult  = "result"
+	TypeError   = "error"
+	TypePong    = "pong"
+)
+
+// Message is a single message bus message. Each message is a JSON object on one
+// line, and only the fields used by the type are set. The ID is chosen by the
+// client and copied to the result or error for a command.
+type Message struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Name    string          `json:"name,omitempty"`
+	Token   string          `json:"token,omitempty"`
+	Topics  []string        `json:"topics,omitempty"`
+	Command string          `json:"command,omitempty"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	Event   *eventbus.Event `json:"event,omitempty"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// newMessage returns a message of the argumented type with the current version
+func newMessage(kind string) *Message {
+	return &Message{Version: SchemaVersion, Type: kind}
+}
+
+// newError returns an error message for the argumented request id
+func newError(id string, text string) *Message {
+	message := newMessage(TypeError)
+	message.ID = id
+	message.Error = text
+	return message
+}
@@ -0,0 +1,609 @@
+// Package neighbors watches the MAC address bound to each IP address in the
+// kernel neighbor table, which the kernel learns from ARP for IPv4 and from
+// NDP for IPv6, and looks for the changes a spoofing attack makes. An address
+// that moves to a new MAC address is logged to the neighbor_events table, and
+// an alert is raised when the address is a gateway or a protected address,
+// when the new MAC address already holds another IPv4 address, or when the
+// address keeps moving between MAC addresses. The MAC address that took the
+// address can be blocked for a cooldown period.
+package neighbors
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const serviceName = "neighbors"
+
+// The kinds of neighbor events. A change is an address that moved to a new
+// MAC address without looking like spoofing, and the other kinds raise an alert.
+const (
+	KindChange   = "change"
+	KindGateway  = "gateway"
+	KindTakeover = "takeover"
+	KindFlap     = "flap"
+)
+
+// the defaults used when the neighbors settings are missing
+const (
+	defaultIntervalSeconds   = 10
+	defaultFlapCount         = 3
+	defaultFlapWindowSeconds = 600
+	defaultBlockSeconds      = 3600
+)
+
+// the bindings that have not been seen for this long are forgotten
+const staleTimeout = 24 * time.Hour
+
+// the number of neighbor events kept for the status
+const maxEvents = 100
+
+// Binding holds the MAC address bound to an IP address. The changes are
+// the times the address moved to a new MAC address in the flap window.
+type Binding struct {
+	Address    string      `json:"address"`
+	MacAddress string      `json:"macAddress"`
+	Interface  string      `json:"interface"`
+	State      string      `json:"state"`
+	Gateway    bool        `json:"gateway"`
+	FirstSeen  time.Time   `json:"firstSeen"`
+	LastSeen   time.Time   `json:"lastSeen"`
+	Changes    []time.Time `json:"-"`
+	Flapping   bool        `json:"-"`
+}
+
+// Event is an address that moved to a new MAC address
+type Event struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Address   string    `json:"address"`
+	Interface string    `json:"interface"`
+	OldMac    string    `json:"oldMac"`
+	NewMac    string    `json:"newMac"`
+	Evidence  string    `json:"evidence"`
+	Blocked   bool      `json:"blocked"`
+}
+
+// BlockedMac is a MAC address that is blocked until the cooldown ends
+type BlockedMac struct {
+	MacAddress string    `json:"macAddress"`
+	Kind       string    `json:"kind"`
+	Address    string    `json:"address"`
+	Until      time.Time `json:"until"`
+}
+
+// Status holds the neighbors settings, the current bindings, the blocked
+// MAC addresses and the recent events
+type Status struct {
+	Enabled   bool         `json:"enabled"`
+	Block     bool         `json:"block"`
+	Gateways  []string     `json:"gateways"`
+	Bindings  []Binding    `json:"bindings"`
+	Blocked   []BlockedMac `json:"blocked"`
+	Events    []Event      `json:"events"`
+	LastCheck time.Time    `json:"lastCheck"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// neighborConfig holds the neighbors settings. The protected addresses are
+// treated like the gateways and the exempt MAC addresses, like a router that
+// answers ARP for the hosts behind it, never raise an alert.
+type neighborConfig struct {
+	enabled    bool
+	interval   time.Duration
+	flapCount  int
+	flapWindow time.Duration
+	block      bool
+	cooldown   time.Duration
+	protected  map[string]bool
+	exempt     map[string]bool
+}
+
+// neighbor is an entry of the kernel neighbor table
+type neighbor struct {
+	Dst    string   `json:"dst"`
+	Dev    string   `json:"dev"`
+	Lladdr string   `json:"lladdr"`
+	State  []string `json:"state"`
+}
+
+// route is an entry of the kernel routing table
+type route struct {
+	Dst     string `json:"dst"`
+	Gateway string `json:"gateway"`
+}
+
+var config neighborConfig
+var bindingTable = make(map[string]*Binding)
+var blockTable = make(map[string]BlockedMac)
+var gatewayTable = make(map[string]bool)
+var eventList []Event
+var lastCheck time.Time
+var lastError string
+var neighborLocker sync.Mutex
+var reloadChannel = make(chan bool, 1)
+var shutdownChannel = make(chan bool)
+var checkWaiter sync.WaitGroup
+
+// init registers the neighbor events table with the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "neighbor_events",
+		Owner: serviceName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "kind", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "address", Type: "text"},
+			{Name: "interface", Type: "text"},
+			{Name: "old_mac", Type: "text"},
+			{Name: "new_mac", Type: "text"},
+			{Name: "evidence", Type: "text"},
+			{Name: "blocked", Type: "boolean"},
+		},
+		TrimPercent: .1,
+	})
+}
+
+// Startup is called to handle service startup
+func Startup() {
+	loadSettings()
+	checkWaiter.Add(1)
+	go checkTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	close(shutdownChannel)
+	checkWaiter.Wait()
+	removeTable()
+}
+
+// Reload loads the neighbors settings and checks the neighbor table right away
+func Reload() {
+	loadSettings()
+	select {
+	case reloadChannel <- true:
+	default:
+	}
+}
+
+// GetStatus returns the neighbors settings, the current bindings, the blocked
+// MAC addresses and the recent events
+func GetStatus() Status {
+	neighborLocker.Lock()
+	defer neighborLocker.Unlock()
+
+	now := time.Now()
+	status := Status{
+		Enabled:   config.enabled,
+		Block:     config.block,
+		Gateways:  []string{},
+		Bindings:  []Binding{},
+		Blocked:   []BlockedMac{},
+		Events:    append([]Event{}, eventList...),
+		LastCheck: lastCheck,
+		Error:     lastError,
+	}
+	for address := range gatewayTable {
+		status.Gateways = append(status.Gateways, address)
+	}
+	sort.Strings(status.Gateways)
+	for _, item := range bindingTable {
+		status.Bindings = append(status.Bindings, *item)
+	}
+	sort.Slice(status.Bindings, func(i, j int) bool {
+		return status.Bindings[i].Address < status.Bindings[j].Address
+	})
+	for _, entry := range blockTable {
+		if now.Before(entry.Until) {
+			status.Blocked = append(status.Blocked, entry)
+		}
+	}
+	sort.Slice(status.Blocked, func(i, j int) bool {
+		return status.Blocked[i].Until.Before(status.Blocked[j].Until)
+	})
+	return status
+}
+
+// Unblock removes the block for a MAC address, or every block when the MAC
+// address is empty, and returns the number removed
+func Unblock(mac string) (int, error) {
+	var counter int
+
+	neighborLocker.Lock()
+	if mac == "" {
+		counter = len(blockTable)
+		blockTable = make(map[string]BlockedMac)
+	} else {
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			neighborLocker.Unlock()
+			return 0, fmt.Errorf("invalid MAC address %s", mac)
+		}
+		if _, found := blockTable[hwaddr.String()]; found {
+			delete(blockTable, hwaddr.String())
+			counter = 1
+		}
+	}
+	neighborLocker.Unlock()
+
+	if counter != 0 {
+		syncTable()
+	}
+
+	logger.Info("Removed %d neighbor blocks\n", counter)
+	return counter, nil
+}
+
+// loadSettings loads the neighbors settings
+func loadSettings() {
+	fresh := neighborConfig{
+		enabled:    true,
+		interval:   defaultIntervalSeconds * time.Second,
+		flapCount:  defaultFlapCount,
+		flapWindow: defaultFlapWindowSeconds * time.Second,
+		cooldown:   defaultBlockSeconds * time.Second,
+		protected:  make(map[string]bool),
+		exempt:     make(map[string]bool),
+	}
+
+	neighborJSON, err := settings.GetCurrentSettings([]string{"neighbors"})
+	if neighborJSON != nil && err == nil {
+		item, ok := neighborJSON.(map[string]interface{})
+		if ok {
+			compileConfig(&fresh, item)
+		} else {
+			logger.Warn("Invalid neighbors settings: %T\n", neighborJSON)
+		}
+	}
+
+	neighborLocker.Lock()
+	config = fresh
+	if !fresh.block {
+		blockTable = make(map[string]BlockedMac)
+	}
+	neighborLocker.Unlock()
+
+	syncTable()
+
+	logger.Info("Loaded neighbors settings enabled:%v interval:%v flap:%d/%v block:%v cooldown:%v protected:%d exempt:%d\n",
+		fresh.enabled, fresh.interval, fresh.flapCount, fresh.flapWindow, fresh.block, fresh.cooldown, len(fresh.protected), len(fresh.exempt))
+}
+
+// compileConfig reads the neighbors settings. Invalid values are logged and skipped.
+func compileConfig(fresh *neighborConfig, item map[string]interface{}) {
+	if value, ok := item["enabled"].(bool); ok {
+		fresh.enabled = value
+	}
+	if value, ok := item["intervalSeconds"].(float64); ok && value > 0 {
+		fresh.interval = time.Duration(value) * time.Second
+	}
+	if value, ok := item["flapCount"].(float64); ok && value >= 0 {
+		fresh.flapCount = int(value)
+	}
+	if value, ok := item["flapWindowSeconds"].(float64); ok && value > 0 {
+		fresh.flapWindow = time.Duration(value) * time.Second
+	}
+	if value, ok := item["block"].(bool); ok {
+		fresh.block = value
+	}
+	if value, ok := item["blockSeconds"].(float64); ok && value > 0 {
+		fresh.cooldown = time.Duration(value) * time.Second
+	}
+
+	protectedSlice, _ := item["protected"].([]interface{})
+	for _, value := range protectedSlice {
+		text, _ := value.(string)
+		address := net.ParseIP(text)
+		if address == nil {
+			logger.Warn("Ignoring invalid neighbors protected address %v\n", value)
+			continue
+		}
+		fresh.protected[address.String()] = true
+	}
+
+	exemptSlice, _ := item["exempt"].([]interface{})
+	for _, value := range exemptSlice {
+		text, _ := value.(string)
+		mac, err := net.ParseMAC(text)
+		if err != nil {
+			logger.Warn("Ignoring invalid neighbors exempt MAC address %v\n", value)
+			continue
+		}
+		fresh.exempt[mac.String()] = true
+	}
+}
+
+// checkTask checks the neighbor table at the configured interval
+func checkTask() {
+	defer checkWaiter.Done()
+
+	for {
+		neighborLocker.Lock()
+		enabled := config.enabled
+		delay := config.interval
+		neighborLocker.Unlock()
+
+		if enabled {
+			checkNeighbors()
+		}
+
+		select {
+		case <-shutdownChannel:
+			return
+		case <-reloadChannel:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// checkNeighbors reads the neighbor table and the gateways and compares each
+// binding with the one we saw before
+func checkNeighbors() {
+	now := time.Now()
+	gateways, gerr := readGateways()
+	list, err := readNeighbors()
+
+	neighborLocker.Lock()
+	lastCheck = now
+	if err != nil {
+		lastError = err.Error()
+		neighborLocker.Unlock()
+		logger.Warn("%OC|Unable to read the neighbor table: %v\n", "neighbors_read_failure", 10, err)
+		return
+	}
+	lastError = ""
+
+	// keep the gateways we know if the routes can't be read
+	if gerr == nil {
+		gatewayTable = gateways
+	}
+
+	var events []Event
+	for _, item := range list {
+		if event := updateBinding(item, now); event != nil {
+			events = append(events, *event)
+		}
+	}
+
+	expired := cleanTables(now)
+	neighborLocker.Unlock()
+
+	for _, event := range events {
+		logNeighborEvent(event)
+	}
+
+	if expired || blockedAny(events) {
+		syncTable()
+	}
+}
+
+// updateBinding records the MAC address of a neighbor table entry and returns
+// an event if the address moved to a new MAC address. The caller must hold
+// the neighborLocker.
+func updateBinding(item neighbor, now time.Time) *Event {
+	ip := net.ParseIP(item.Dst)
+	mac, err := net.ParseMAC(item.Lladdr)
+	if ip == nil || err != nil || isUnusable(item.State) {
+		return nil
+	}
+
+	address := ip.String()
+	hwaddr := mac.String()
+	gateway := gatewayTable[address] || config.protected[address]
+
+	binding := bindingTable[address]
+	if binding == nil {
+		bindingTable[address] = &Binding{Address: address, MacAddress: hwaddr, Interface: item.Dev, State: strings.Join(item.State, ","), Gateway: gateway, FirstSeen: now, LastSeen: now}
+		return nil
+	}
+
+	binding.Interface = item.Dev
+	binding.State = strings.Join(item.State, ",")
+	binding.Gateway = gateway
+	binding.LastSeen = now
+	if binding.MacAddress == hwaddr {
+		return nil
+	}
+
+	event := &Event{Time: now, Kind: KindChange, Address: address, Interface: item.Dev, OldMac: binding.MacAddress, NewMac: hwaddr}
+	binding.MacAddress = hwaddr
+	binding.FirstSeen = now
+
+	// the changes outside the flap window are forgotten
+	var changes []time.Time
+	for _, when := range binding.Changes {
+		if now.Sub(when) < config.flapWindow {
+			changes = append(changes, when)
+		}
+	}
+	binding.Changes = append(changes, now)
+	if len(changes) == 0 {
+		binding.Flapping = false
+	}
+
+	if config.exempt[hwaddr] {
+		event.Evidence = fmt.Sprintf("%s moved from %s to exempt %s", address, event.OldMac, hwaddr)
+		return event
+	}
+
+	others := findOtherAddresses(hwaddr, address)
+	if gateway {
+		event.Kind = KindGateway
+		event.Evidence = fmt.Sprintf("gateway %s moved from %s to %s", address, event.OldMac, hwaddr)
+		if len(others) != 0 {
+			event.Evidence += " which also holds " + strings.Join(others, ",")
+		}
+	} else if len(others) != 0 && ip.To4() != nil {
+		event.Kind = KindTakeover
+		event.Evidence = fmt.Sprintf("%s moved from %s to %s which also holds %s", address, event.OldMac, hwaddr, strings.Join(others, ","))
+	} else if config.flapCount != 0 && len(binding.Changes) >= config.flapCount && !binding.Flapping {
+		binding.Flapping = true
+		event.Kind = KindFlap
+		event.Evidence = fmt.Sprintf("%s changed MAC address %d times in %v, now %s", address, len(binding.Changes), config.flapWindow, hwaddr)
+	} else {
+		event.Evidence = fmt.Sprintf("%s moved from %s to %s", address, event.OldMac, hwaddr)
+	}
+
+	if event.Kind != KindChange && config.block {
+		event.Blocked = true
+		blockTable[hwaddr] = BlockedMac{MacAddress: hwaddr, Kind: event.Kind, Address: address, Until: now.Add(config.cooldown)}
+	}
+
+	return event
+}
+
+// findOtherAddresses returns the other IPv4 addresses bound to a MAC address.
+// The IPv6 addresses are left out since a host normally has several of them.
+// The caller must hold the neighborLocker.
+func findOtherAddresses(hwaddr string, address string) []string {
+	var list []string
+	for _, binding := range bindingTable {
+		if binding.MacAddress != hwaddr || binding.Address == address {
+			continue
+		}
+		if ip := net.ParseIP(binding.Address); ip != nil && ip.To4() != nil {
+			list = append(list, binding.Address)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// cleanTables removes the stale bindings and the expired blocks and returns
+// true if a block expired. The caller must hold the neighborLocker.
+func cleanTables(now time.Time) bool {
+	var expired bool
+
+	for address, binding := range bindingTable {
+		if now.Sub(binding.LastSeen) >= staleTimeout {
+			delete(bindingTable, address)
+		}
+	}
+	for mac, entry := range blockTable {
+		if !now.Before(entry.Until) {
+			logger.Info("Neighbor block expired for %s\n", mac)
+			delete(blockTable, mac)
+			expired = true
+		}
+	}
+	return expired
+}
+
+// blockedAny returns true if any of the events blocked a MAC address
+func blockedAny(events []Event) bool {
+	for _, event := range events {
+		if event.Blocked {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnusable returns true for the neighbor states that don't hold a
+// confirmed MAC address
+func isUnusable(states []string) bool {
+	for _, state := range states {
+		switch state {
+		case "INCOMPLETE", "FAILED", "NOARP":
+			return true
+		}
+	}
+	return false
+}
+
+// logNeighborEvent logs a neighbor event to the neighbor_events table and
+// the status, and publishes an alert for the kinds that look like spoofing
+func logNeighborEvent(event Event) {
+	neighborLocker.Lock()
+	eventList = append(eventList, event)
+	if len(eventList) > maxEvents {
+		eventList = eventList[len(eventList)-maxEvents:]
+	}
+	neighborLocker.Unlock()
+
+	overseer.AddCounter("neighbors_"+event.Kind, 1)
+
+	columns := map[string]interface{}{
+		"time_stamp": event.Time,
+		"kind":       event.Kind,
+		"address":    event.Address,
+		"interface":  event.Interface,
+		"old_mac":    event.OldMac,
+		"new_mac":    event.NewMac,
+		"evidence":   event.Evidence,
+		"blocked":    event.Blocked,
+	}
+	reports.LogEvent(reports.CreateEvent("neighbor_"+event.Kind, "neighbor_events", 1, columns, nil))
+
+	if event.Kind == KindChange {
+		logger.Info("Neighbor %s\n", event.Evidence)
+		return
+	}
+
+	logger.Notice("Possible neighbor spoofing (%s): %s blocked:%v\n", event.Kind, event.Evidence, event.Blocked)
+	eventbus.PublishAlert(serviceName, "Possible neighbor spoofing of "+event.Address, map[string]interface{}{
+		"kind":      event.Kind,
+		"address":   event.Address,
+		"interface": event.Interface,
+		"oldMac":    event.OldMac,
+		"newMac":    event.NewMac,
+		"evidence":  event.Evidence,
+		"blocked":   event.Blocked,
+	})
+}
+
+// readNeighbors returns the entries of the kernel neighbor table for both families
+func readNeighbors() ([]neighbor, error) {
+	var list []neighbor
+
+	for _, family := range []string{"-4", "-6"} {
+		var part []neighbor
+		output, err := exec.Command("ip", "-json", family, "neigh", "show").Output()
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(output, &part); err != nil {
+			return nil, err
+		}
+		list = append(list, part...)
+	}
+
+	return list, nil
+}
+
+// readGateways returns the gateways of the default routes in every routing
+// table, since each WAN has its own table when there are several
+func readGateways() (map[string]bool, error) {
+	table := make(map[string]bool)
+
+	for _, family := range []string{"-4", "-6"} {
+		var list []route
+		output, err := exec.Command("ip", "-json", family, "route", "show", "default", "table", "all").Output()
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(output, &list); err != nil {
+			return nil, err
+		}
+		for _, item := range list {
+			if ip := net.ParseIP(item.Gateway); ip != nil {
+				table[ip.String()] = true
+			}
+		}
+	}
+
+	return table, nil
+}
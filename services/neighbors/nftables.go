@@ -0,0 +1,101 @@
+package neighbors
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// the nftables tables that drop the ARP and the traffic from the blocked MAC addresses
+const tableName = "packetd-neighbors"
+
+var syncLocker sync.Mutex
+var tableActive bool
+
+// syncTable replaces the neighbors tables with ones that hold every current
+// block, or removes them when nothing is blocked. The arp table drops the
+// ARP packets so the blocked MAC address can't poison our neighbor table
+// again, and the inet table drops everything else it sends including the
+// NDP advertisements.
+func syncTable() {
+	now := time.Now()
+	var list []string
+
+	neighborLocker.Lock()
+	for mac, entry := range blockTable {
+		if now.Before(entry.Until) {
+			list = append(list, mac)
+		}
+	}
+	neighborLocker.Unlock()
+
+	syncLocker.Lock()
+	defer syncLocker.Unlock()
+
+	if len(list) == 0 {
+		removeTableLocked()
+		return
+	}
+
+	sort.Strings(list)
+	elements := strings.Join(list, ", ")
+
+	var script bytes.Buffer
+	for _, family := range []string{"arp", "inet"} {
+		fmt.Fprintf(&script, "add table %s %s\n", family, tableName)
+		fmt.Fprintf(&script, "delete table %s %s\n", family, tableName)
+	}
+	fmt.Fprintf(&script, "table arp %s {\n", tableName)
+	fmt.Fprintf(&script, "\tset blocked { type ether_addr; elements = { %s } }\n", elements)
+	fmt.Fprintf(&script, "\tchain input {\n\t\ttype filter hook input priority -160; policy accept;\n")
+	fmt.Fprintf(&script, "\t\tarp saddr ether @blocked counter drop\n\t}\n}\n")
+	fmt.Fprintf(&script, "table inet %s {\n", tableName)
+	fmt.Fprintf(&script, "\tset blocked { type ether_addr; elements = { %s } }\n", elements)
+	fmt.Fprintf(&script, "\tchain prerouting {\n\t\ttype filter hook prerouting priority -160; policy accept;\n")
+	fmt.Fprintf(&script, "\t\tether saddr @blocked counter drop\n\t}\n}\n")
+
+	command := exec.Command("nft", "-f", "-")
+	command.Stdin = &script
+	output, err := command.CombinedOutput()
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if message == "" {
+			message = err.Error()
+		}
+		logger.Warn("%OC|Failed to update the neighbor blocks: %s\n", "neighbors_sync_failure", 10, message)
+		return
+	}
+
+	tableActive = true
+	logger.Info("Updated the neighbor blocks: %v\n", list)
+}
+
+// removeTable removes the neighbors tables if we created them
+func removeTable() {
+	syncLocker.Lock()
+	defer syncLocker.Unlock()
+	removeTableLocked()
+}
+
+// removeTableLocked removes the neighbors tables. The caller must hold the syncLocker.
+func removeTableLocked() {
+	if !tableActive {
+		return
+	}
+
+	for _, family := range []string{"arp", "inet"} {
+		output, err := exec.Command("nft", "delete", "table", family, tableName).CombinedOutput()
+		if err != nil {
+			logger.Warn("Failed to remove the neighbors %s table: %s\n", family, strings.TrimSpace(string(output)))
+		}
+	}
+
+	tableActive = false
+	logger.Info("Removed the neighbors tables\n")
+}
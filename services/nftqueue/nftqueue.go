@@ -0,0 +1,334 @@
+// Package nftqueue manages the per-zone nftables rules that decide which
+// traffic is sent to packetd. The packetd_rules script creates an empty
+// packetd-zones chain that is called just before the default queue rule, and
+// this service fills it with rules that bypass new sessions from disabled
+// zones or send the packets received in a zone to its own range of queues.
+// The zones come from the settings and can be changed at runtime through the
+// API, so inspection can be enabled one network segment at a time without
+// editing the firewall scripts. Runtime changes are not saved and are lost
+// when packetd restarts.
+package nftqueue
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+	"github.com/untangle/packetd/services/zones"
+)
+
+// the nftables table and chain created by the packetd_rules script
+const tableName = "packetd"
+const zoneChain = "packetd-zones"
+
+// the conntrack mark bit that bypasses a session and the packet mark bit
+// that tells packetd a packet is new, which we clear on bypassed packets
+const bypassMark = "0x80000000"
+const newPacketMask = "0xefffffff"
+
+// ZoneConfig holds the queue configuration for a zone. A disabled zone is
+// not inspected. The queue range is optional and must be inside the range
+// packetd is listening on, otherwise the default queues are used.
+type ZoneConfig struct {
+	Zone       string `json:"zone"`
+	Enabled    bool   `json:"enabled"`
+	QueueStart int    `json:"queueStart,omitempty"`
+	QueueEnd   int    `json:"queueEnd,omitempty"`
+	Runtime    bool   `json:"runtime,omitempty"`
+}
+
+// Status holds the zone configuration and the rules in the zone chain
+type Status struct {
+	Active     bool         `json:"active"`
+	QueueStart int          `json:"queueStart"`
+	QueueEnd   int          `json:"queueEnd"`
+	Zones      []ZoneConfig `json:"zones"`
+	Rules      []string     `json:"rules"`
+	Error      string       `json:"error,omitempty"`
+}
+
+var settingsTable = make(map[string]ZoneConfig)
+var runtimeTable = make(map[string]ZoneConfig)
+var activeRules []string
+var lastError string
+var rulesActive bool
+var nftqueueLocker sync.Mutex
+
+// Startup is called to handle service startup
+func Startup() {
+	settings.RegisterValidator("nftqueue", validateZones)
+	Reload()
+}
+
+// Shutdown is called to handle service shutdown. The zone chain is removed
+// along with the rest of the packetd rules so there is nothing to do here.
+func Shutdown() {
+	nftqueueLocker.Lock()
+	rulesActive = false
+	nftqueueLocker.Unlock()
+}
+
+// Activate is called after the packetd rules are inserted to fill the zone chain
+func Activate() {
+	nftqueueLocker.Lock()
+	defer nftqueueLocker.Unlock()
+
+	rulesActive = true
+	applyRules()
+}
+
+// Reload loads the zone configuration from the settings and updates the zone
+// chain. This is also called when the zones are reloaded so the rules pick up
+// any changes to the zone interfaces.
+func Reload() {
+	fresh := loadZones()
+
+	nftqueueLocker.Lock()
+	defer nftqueueLocker.Unlock()
+
+	settingsTable = fresh
+	applyRules()
+}
+
+// SetZone changes the configuration of a zone until packetd is restarted
+func SetZone(config ZoneConfig) error {
+	err := checkZone(config)
+	if err != nil {
+		return err
+	}
+
+	config.Runtime = true
+
+	nftqueueLocker.Lock()
+	defer nftqueueLocker.Unlock()
+
+	runtimeTable[config.Zone] = config
+	logger.Info("Setting nfqueue zone %s enabled:%v queues:%d-%d\n", config.Zone, config.Enabled, config.QueueStart, config.QueueEnd)
+	return applyRules()
+}
+
+// ClearZone removes the runtime configuration of a zone so the settings are used again
+func ClearZone(zone string) error {
+	nftqueueLocker.Lock()
+	defer nftqueueLocker.Unlock()
+
+	delete(runtimeTable, zone)
+	logger.Info("Clearing nfqueue zone %s\n", zone)
+	return applyRules()
+}
+
+// GetStatus returns the zone configuration and the rules in the zone chain
+func GetStatus() Status {
+	status := Status{Zones: []ZoneConfig{}, Rules: []string{}}
+	status.QueueStart, status.QueueEnd = kernel.GetQueueRange()
+
+	nftqueueLocker.Lock()
+	defer nftqueueLocker.Unlock()
+
+	status.Active = rulesActive
+	status.Error = lastError
+	status.Zones = append(status.Zones, getZoneList()...)
+	status.Rules = append(status.Rules, activeRules...)
+	return status
+}
+
+// applyRules replaces the rules in the zone chain with the rules for the current
+// configuration. The chain is flushed and filled by a single nft command so the
+// change is atomic. The caller must hold the nftqueueLocker.
+func applyRules() error {
+	if !rulesActive || kernel.FlagNoNfqueue {
+		return nil
+	}
+
+	rules := buildRules(getZoneList())
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "flush chain inet %s %s\n", tableName, zoneChain)
+	for _, rule := range rules {
+		fmt.Fprintf(&script, "add rule inet %s %s %s\n", tableName, zoneChain, rule)
+	}
+
+	command := exec.Command("nft", "-f", "-")
+	command.Stdin = &script
+	output, err := command.CombinedOutput()
+	if err != nil {
+		lastError = strings.TrimSpace(string(output))
+		if lastError == "" {
+			lastError = err.Error()
+		}
+		logger.Warn("Failed to update the nfqueue zone rules: %s\n", lastError)
+		return fmt.Errorf("nft: %s", lastError)
+	}
+
+	activeRules = rules
+	lastError = ""
+	logger.Info("Updated the nfqueue zone rules: %d rules\n", len(rules))
+	return nil
+}
+
+// getZoneList returns the configuration of each zone with the runtime changes
+// replacing the settings. The caller must hold the nftqueueLocker.
+func getZoneList() []ZoneConfig {
+	merged := make(map[string]ZoneConfig)
+	for name, config := range settingsTable {
+		merged[name] = config
+	}
+	for name, config := range runtimeTable {
+		merged[name] = config
+	}
+
+	var list []ZoneConfig
+	for _, config := range merged {
+		list = append(list, config)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Zone < list[j].Zone
+	})
+	return list
+}
+
+// buildRules returns the zone chain rules for the argumented zones. New sessions
+// from a disabled zone get the bypass bit in the conntrack mark so the rest of
+// their packets skip the queue, even the replies received in other zones. A zone
+// with a queue range sends the packets received on its interfaces to those queues.
+func buildRules(list []ZoneConfig) []string {
+	var rules []string
+	first, last := kernel.GetQueueRange()
+
+	for _, config := range list {
+		if config.Enabled && config.QueueStart == 0 {
+			continue
+		}
+
+		devices := zones.GetZoneDevices(config.Zone)
+		if len(devices) == 0 {
+			logger.Warn("%OC|Unable to find the interfaces of nfqueue zone %s\n", "nftqueue_zone_missing", 10, config.Zone)
+			continue
+		}
+
+		match := "iifname { \"" + strings.Join(devices, "\", \"") + "\" }"
+
+		if !config.Enabled {
+			rules = append(rules, fmt.Sprintf("ct state new %s meta mark set mark and %s ct mark set ct mark or %s counter accept", match, newPacketMask, bypassMark))
+			continue
+		}
+
+		if config.QueueStart < first || config.QueueEnd > last {
+			logger.Warn("%OC|Ignoring nfqueue zone %s queues %d-%d outside %d-%d\n", "nftqueue_queue_range", 10, config.Zone, config.QueueStart, config.QueueEnd, first, last)
+			continue
+		}
+
+		if config.QueueStart == config.QueueEnd {
+			rules = append(rules, fmt.Sprintf("%s counter queue num %d bypass", match, config.QueueStart))
+		} else {
+			rules = append(rules, fmt.Sprintf("%s counter queue num %d-%d fanout,bypass", match, config.QueueStart, config.QueueEnd))
+		}
+	}
+
+	return rules
+}
+
+// checkZone returns an error if the argumented zone configuration is not valid
+func checkZone(config ZoneConfig) error {
+	if config.Zone == "" {
+		return fmt.Errorf("missing zone name")
+	}
+	if config.QueueStart == 0 && config.QueueEnd == 0 {
+		return nil
+	}
+	if config.QueueStart <= 0 || config.QueueEnd < config.QueueStart {
+		return fmt.Errorf("invalid queue range %d-%d", config.QueueStart, config.QueueEnd)
+	}
+
+	// the kernel range is only known once the nfqueue threads are running
+	first, last := kernel.GetQueueRange()
+	if last >= first && (config.QueueStart < first || config.QueueEnd > last) {
+		return fmt.Errorf("queue range %d-%d is outside %d-%d", config.QueueStart, config.QueueEnd, first, last)
+	}
+	return nil
+}
+
+// parseZone returns the zone configuration from a settings object
+func parseZone(item map[string]interface{}) ZoneConfig {
+	config := ZoneConfig{Enabled: true}
+	config.Zone, _ = item["zone"].(string)
+	if enabled, ok := item["enabled"].(bool); ok {
+		config.Enabled = enabled
+	}
+	if value, ok := item["queueStart"].(float64); ok {
+		config.QueueStart = int(value)
+		config.QueueEnd = int(value)
+	}
+	if value, ok := item["queueEnd"].(float64); ok {
+		config.QueueEnd = int(value)
+	}
+	return config
+}
+
+// loadZones loads the zone configuration from the settings
+func loadZones() map[string]ZoneConfig {
+	table := make(map[string]ZoneConfig)
+
+	zonesJSON, err := settings.GetCurrentSettings([]string{"nfqueue", "zones"})
+	if zonesJSON == nil || err != nil {
+		return table
+	}
+
+	zoneSlice, ok := zonesJSON.([]interface{})
+	if !ok {
+		logger.Warn("Invalid nfqueue zone settings: %T\n", zonesJSON)
+		return table
+	}
+
+	for _, value := range zoneSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid nfqueue zone in settings: %T\n", value)
+			continue
+		}
+		config := parseZone(item)
+		err := checkZone(config)
+		if err != nil {
+			logger.Warn("Ignoring nfqueue zone %s: %v\n", config.Zone, err)
+			continue
+		}
+		table[config.Zone] = config
+	}
+
+	return table
+}
+
+// validateZones checks the nfqueue zones in the staged settings
+func validateZones(jsonSettings map[string]interface{}) []string {
+	var problems []string
+
+	section, _ := jsonSettings["nfqueue"].(map[string]interface{})
+	if section == nil || section["zones"] == nil {
+		return problems
+	}
+
+	zoneSlice, ok := section["zones"].([]interface{})
+	if !ok {
+		return []string{"nfqueue zones must be a list"}
+	}
+
+	for index, value := range zoneSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("nfqueue zone %d is not an object", index))
+			continue
+		}
+		err := checkZone(parseZone(item))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("nfqueue zone %d: %v", index, err))
+		}
+	}
+
+	return problems
+}
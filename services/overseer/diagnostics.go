@@ -0,0 +1,250 @@
+package overseer
+
+import (
+	"bufio"
+	"bytes"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the number of contention sites returned for each lock profile
+const maxContentionSites = 10
+
+// the sampling used for the lock profiles while contention profiling is enabled
+const contentionMutexFraction = 100
+const contentionBlockRate = int(time.Millisecond)
+
+// GoroutineStats holds the number of goroutines in total and by state
+type GoroutineStats struct {
+	Total   int            `json:"total"`
+	ByState map[string]int `json:"byState"`
+}
+
+// GCStats holds the garbage collector and heap statistics
+type GCStats struct {
+	NumGC        uint32    `json:"numGC"`
+	LastGC       time.Time `json:"lastGC"`
+	PauseTotal   float64   `json:"pauseTotalMs"`
+	LastPause    float64   `json:"lastPauseMs"`
+	MaxPause     float64   `json:"maxPauseMs"`
+	CPUFraction  float64   `json:"cpuFraction"`
+	HeapAlloc    uint64    `json:"heapAlloc"`
+	HeapInuse    uint64    `json:"heapInuse"`
+	HeapObjects  uint64    `json:"heapObjects"`
+	HeapReleased uint64    `json:"heapReleased"`
+	NextGC       uint64    `json:"nextGC"`
+	Sys          uint64    `json:"sys"`
+	GCPercent    int       `json:"gcPercent"`
+	MemoryLimit  int64     `json:"memoryLimit"`
+	ForcedGC     uint32    `json:"forcedGC"`
+	TotalAlloc   uint64    `json:"totalAlloc"`
+	Mallocs      uint64    `json:"mallocs"`
+	Frees        uint64    `json:"frees"`
+	StackInuse   uint64    `json:"stackInuse"`
+	Goroutines   int       `json:"goroutines"`
+	GOMAXPROCS   int       `json:"gomaxprocs"`
+	NumCPU       int       `json:"numCPU"`
+	NumCgoCall   int64     `json:"numCgoCall"`
+}
+
+// ContentionSite is a place in the code where goroutines waited on a lock
+type ContentionSite struct {
+	Function string  `json:"function"`
+	Location string  `json:"location"`
+	Count    int64   `json:"count"`
+	DelayMs  float64 `json:"delayMs"`
+}
+
+// ContentionStats holds the busiest sites from the mutex and block profiles
+type ContentionStats struct {
+	Enabled bool             `json:"enabled"`
+	Mutex   []ContentionSite `json:"mutex"`
+	Block   []ContentionSite `json:"block"`
+}
+
+// GetGoroutineStats returns the number of goroutines by state
+func GetGoroutineStats() GoroutineStats {
+	var buffer bytes.Buffer
+	stats := GoroutineStats{ByState: make(map[string]int)}
+
+	pprof.Lookup("goroutine").WriteTo(&buffer, 2)
+
+	// each goroutine starts with a line like: goroutine 7 [chan receive, 5 minutes]:
+	scanner := bufio.NewScanner(&buffer)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "goroutine ") {
+			continue
+		}
+		start := strings.Index(line, "[")
+		end := strings.Index(line, "]")
+		if start < 0 || end < start {
+			continue
+		}
+		state := line[start+1 : end]
+		if comma := strings.Index(state, ","); comma >= 0 {
+			state = state[:comma]
+		}
+		stats.ByState[state]++
+		stats.Total++
+	}
+
+	return stats
+}
+
+// GetGCStats returns the garbage collector and heap statistics
+func GetGCStats() GCStats {
+	var memory runtime.MemStats
+	var collector debug.GCStats
+
+	runtime.ReadMemStats(&memory)
+	collector.PauseQuantiles = make([]time.Duration, 5)
+	debug.ReadGCStats(&collector)
+
+	stats := GCStats{
+		NumGC:        memory.NumGC,
+		LastGC:       collector.LastGC,
+		PauseTotal:   float64(collector.PauseTotal) / float64(time.Millisecond),
+		MaxPause:     float64(collector.PauseQuantiles[4]) / float64(time.Millisecond),
+		CPUFraction:  memory.GCCPUFraction,
+		HeapAlloc:    memory.HeapAlloc,
+		HeapInuse:    memory.HeapInuse,
+		HeapObjects:  memory.HeapObjects,
+		HeapReleased: memory.HeapReleased,
+		NextGC:       memory.NextGC,
+		Sys:          memory.Sys,
+		ForcedGC:     memory.NumForcedGC,
+		TotalAlloc:   memory.TotalAlloc,
+		Mallocs:      memory.Mallocs,
+		Frees:        memory.Frees,
+		StackInuse:   memory.StackInuse,
+		Goroutines:   runtime.NumGoroutine(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumCPU:       runtime.NumCPU(),
+		NumCgoCall:   runtime.NumCgoCall(),
+		MemoryLimit:  debug.SetMemoryLimit(-1),
+	}
+	if len(collector.Pause) != 0 {
+		stats.LastPause = float64(collector.Pause[0]) / float64(time.Millisecond)
+	}
+
+	// reading the GOGC value from debug.SetGCPercent would change it
+	sample := []metrics.Sample{{Name: "/gc/gogc:percent"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() == metrics.KindUint64 {
+		stats.GCPercent = int(sample[0].Value.Uint64())
+	}
+
+	return stats
+}
+
+// SetContentionProfiling turns the sampling for the mutex and block profiles
+// on or off. The sampling adds some overhead to every lock so it is only
+// enabled while lock contention is being looked at.
+func SetContentionProfiling(enabled bool) {
+	if enabled {
+		runtime.SetMutexProfileFraction(contentionMutexFraction)
+		runtime.SetBlockProfileRate(contentionBlockRate)
+	} else {
+		runtime.SetMutexProfileFraction(0)
+		runtime.SetBlockProfileRate(0)
+	}
+}
+
+// GetContentionStats returns the sites with the longest lock waits from the
+// mutex and block profiles. The profiles only hold data while contention
+// profiling is enabled and the totals are since packetd started.
+func GetContentionStats() ContentionStats {
+	return ContentionStats{
+		Enabled: runtime.SetMutexProfileFraction(-1) > 0,
+		Mutex:   getContentionSites("mutex"),
+		Block:   getContentionSites("block"),
+	}
+}
+
+// getContentionSites parses the text form of a mutex or block profile and
+// returns the busiest sites. Each record has the total cycles and count on
+// the first line followed by the stack, and the site is the first frame
+// outside of the sync and runtime packages.
+func getContentionSites(name string) []ContentionSite {
+	var buffer bytes.Buffer
+	list := []ContentionSite{}
+
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		return list
+	}
+	profile.WriteTo(&buffer, 1)
+
+	table := make(map[string]*ContentionSite)
+	cyclesPerSecond := 0.0
+	var current *ContentionSite
+	var cycles, count int64
+
+	scanner := bufio.NewScanner(&buffer)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "cycles/second=") {
+			cyclesPerSecond, _ = strconv.ParseFloat(strings.TrimPrefix(line, "cycles/second="), 64)
+			continue
+		}
+
+		// a frame line looks like: #	0x4a4b3c	main.worker+0x3c	/path/file.go:42
+		if strings.HasPrefix(line, "#") {
+			if current != nil {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				continue
+			}
+			function := fields[2]
+			if plus := strings.LastIndex(function, "+"); plus > 0 {
+				function = function[:plus]
+			}
+			if strings.HasPrefix(function, "sync.") || strings.HasPrefix(function, "runtime.") || strings.HasPrefix(function, "internal/") {
+				continue
+			}
+			current = table[function]
+			if current == nil {
+				current = &ContentionSite{Function: function, Location: fields[3]}
+				table[function] = current
+			}
+			current.Count += count
+			if cyclesPerSecond > 0 {
+				current.DelayMs += float64(cycles) / cyclesPerSecond * 1000.0
+			}
+			continue
+		}
+
+		// a record line looks like: 35789 12 @ 0x46b2a4 0x4a4b3c
+		if at := strings.Index(line, " @ "); at > 0 {
+			fields := strings.Fields(line[:at])
+			if len(fields) == 2 {
+				cycles, _ = strconv.ParseInt(fields[0], 10, 64)
+				count, _ = strconv.ParseInt(fields[1], 10, 64)
+				current = nil
+			}
+		}
+	}
+
+	for _, site := range table {
+		list = append(list, *site)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DelayMs > list[j].DelayMs
+	})
+	if len(list) > maxContentionSites {
+		list = list[:maxContentionSites]
+	}
+	return list
+}
@@ -3,67 +3,122 @@ package overseer
 import (
 	"bytes"
 	"fmt"
+	"math/rand/v2"
+	"runtime"
 	"sync"
+	"sync/atomic"
 )
 
-var counterTable map[string]uint64
-var counterMutex sync.Mutex
+// the maximum number of shards for each counter
+const maxCounterShards = 64
+
+// counterShard holds one part of a counter padded out to a full cache line
+// so the shards being updated from different CPU's don't share a line
+type counterShard struct {
+	value uint64
+	_     [56]byte
+}
+
+// counter holds the shards for a named counter. Updates are spread across
+// the shards and the value is the sum of all the shards.
+type counter struct {
+	shards []counterShard
+}
+
+// counterTable maps the counter name to the counter
+var counterTable sync.Map
+
+// counterShards is the number of shards allocated for each counter
+var counterShards int
 
 // Startup is called to handle service startup
 func Startup() {
-	counterTable = make(map[string]uint64)
+	counterTable.Range(func(key interface{}, value interface{}) bool {
+		counterTable.Delete(key)
+		return true
+	})
 }
 
 // Shutdown is called to handle service shutdown
 func Shutdown() {
+	stopPersistence()
 }
 
-// AddCounter is called to increment a named counter
+// AddCounter is called to increment a named counter. The amount is added
+// to a random shard of the counter so concurrent callers rarely touch the
+// same cache line, and no lock is taken once the counter exists. It returns
+// the counter total which is the sum of all the shards.
 func AddCounter(name string, amount uint64) uint64 {
-	counterMutex.Lock()
-	defer counterMutex.Unlock()
-
-	value, found := counterTable[name]
-	if found {
-		counterTable[name] = value + amount
-	} else {
-		counterTable[name] = amount
-	}
-
-	return counterTable[name]
+	item := findCounter(name)
+	atomic.AddUint64(&item.shards[rand.Uint32()&uint32(len(item.shards)-1)].value, amount)
+	return item.total()
 }
 
 // GetCounter is called to get the value of a named counter
 func GetCounter(name string) uint64 {
-	counterMutex.Lock()
-	defer counterMutex.Unlock()
-
-	value, found := counterTable[name]
+	value, found := counterTable.Load(name)
 	if found {
-		return value
+		return value.(*counter).total()
 	}
 	return 0
 }
 
+// GetCounters returns the current value of every named counter
+func GetCounters() map[string]uint64 {
+	result := make(map[string]uint64)
+	counterTable.Range(func(key interface{}, value interface{}) bool {
+		result[key.(string)] = value.(*counter).total()
+		return true
+	})
+	return result
+}
+
 // GenerateReport is called to create a dynamic HTTP page that shows all named counters
 func GenerateReport() bytes.Buffer {
 	var buffer bytes.Buffer
 
-	counterMutex.Lock()
-	defer counterMutex.Unlock()
-
 	buffer.WriteString("<TABLE BORDER=2 CELLPADDING=4 BGCOLOR=#EEEEEE>\r\n")
 	buffer.WriteString("<TR><TD><B>Counter Name</B></TD><TD><B>Value</B></TD></TR>\r\n")
 
-	for name, value := range counterTable {
+	counterTable.Range(func(key interface{}, value interface{}) bool {
 		buffer.WriteString("<TR><TD><TT>")
-		buffer.WriteString(name)
+		buffer.WriteString(key.(string))
 		buffer.WriteString("</TT></TD><TD><TT>")
-		buffer.WriteString(fmt.Sprintf("%v", value))
+		buffer.WriteString(fmt.Sprintf("%v", value.(*counter).total()))
 		buffer.WriteString("</TT></TD></TR>\n\n")
-	}
+		return true
+	})
 
 	buffer.WriteString("</TABLE>\r\n")
 
 	return buffer
 }
+
+// findCounter returns the counter for a name, creating it if it doesn't exist
+func findCounter(name string) *counter {
+	value, found := counterTable.Load(name)
+	if found {
+		return value.(*counter)
+	}
+
+	value, _ = counterTable.LoadOrStore(name, &counter{shards: make([]counterShard, counterShards)})
+	return value.(*counter)
+}
+
+// total returns the sum of all the counter shards
+func (item *counter) total() uint64 {
+	var total uint64
+	for i := range item.shards {
+		total += atomic.LoadUint64(&item.shards[i].value)
+	}
+	return total
+}
+
+// init sets the number of shards to use for each counter which is the
+// number of CPU's rounded up to a power of two so we can mask the index
+func init() {
+	counterShards = 1
+	for counterShards < runtime.GOMAXPROCS(0) && counterShards < maxCounterShards {
+		counterShards *= 2
+	}
+}
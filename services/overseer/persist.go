@@ -0,0 +1,223 @@
+package overseer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PersistConfig holds the counters that are saved across restarts. A name
+// that ends with * selects every counter that starts with the rest of the
+// name. The selected counters are written to the file at the interval and
+// when the service shuts down.
+type PersistConfig struct {
+	File            string   `json:"file"`
+	Counters        []string `json:"counters"`
+	IntervalSeconds int      `json:"intervalSeconds"`
+}
+
+// PersistStatus holds the persistence settings and the result of the last save
+type PersistStatus struct {
+	Config   PersistConfig     `json:"config"`
+	Restored int               `json:"restored"`
+	LastSave *time.Time        `json:"lastSave,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+// storedCounters is the file format for the saved counters
+type storedCounters struct {
+	Time     time.Time         `json:"time"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+var persistConfig PersistConfig
+var persistLocker sync.Mutex
+var persistStarted bool
+var persistLoaded bool
+var persistRestored int
+var persistLastSave time.Time
+var persistError string
+var persistReload = make(chan bool, 1)
+var persistShutdown chan bool
+var persistWaiter sync.WaitGroup
+
+// SetPersistence sets the counters that are saved across restarts. The first
+// call with a file and counters adds the saved values to the selected
+// counters and returns the number restored, and later calls only change the
+// settings so the counters are not restored twice.
+func SetPersistence(config PersistConfig) (int, error) {
+	persistLocker.Lock()
+	defer persistLocker.Unlock()
+
+	persistConfig = config
+
+	if persistStarted {
+		select {
+		case persistReload <- true:
+		default:
+		}
+	} else {
+		persistStarted = true
+		persistShutdown = make(chan bool)
+		persistWaiter.Add(1)
+		go persistTask()
+	}
+
+	if persistLoaded || config.File == "" || len(config.Counters) == 0 {
+		return 0, nil
+	}
+	persistLoaded = true
+
+	data, err := ioutil.ReadFile(config.File)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var stored storedCounters
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return 0, err
+	}
+
+	for name, value := range stored.Counters {
+		if !isPersistent(config, name) {
+			continue
+		}
+		AddCounter(name, value)
+		persistRestored++
+	}
+
+	return persistRestored, nil
+}
+
+// GetPersistStatus returns the persistence settings, the result of the last
+// save, and the current value of the saved counters
+func GetPersistStatus() PersistStatus {
+	persistLocker.Lock()
+	status := PersistStatus{Config: persistConfig, Restored: persistRestored, Error: persistError}
+	if !persistLastSave.IsZero() {
+		stamp := persistLastSave
+		status.LastSave = &stamp
+	}
+	persistLocker.Unlock()
+
+	status.Counters = getPersistentCounters(status.Config)
+	return status
+}
+
+// stopPersistence stops the save task and writes the counters one last time
+func stopPersistence() {
+	persistLocker.Lock()
+	started := persistStarted
+	persistStarted = false
+	persistLocker.Unlock()
+
+	if started {
+		close(persistShutdown)
+		persistWaiter.Wait()
+		saveCounters()
+	}
+
+	// the counters are cleared when the service starts again so they are restored again
+	persistLocker.Lock()
+	persistLoaded = false
+	persistRestored = 0
+	persistLocker.Unlock()
+}
+
+// persistTask saves the counters at the configured interval
+func persistTask() {
+	defer persistWaiter.Done()
+
+	persistLocker.Lock()
+	shutdown := persistShutdown
+	persistLocker.Unlock()
+
+	for {
+		persistLocker.Lock()
+		interval := time.Duration(persistConfig.IntervalSeconds) * time.Second
+		persistLocker.Unlock()
+
+		// without an interval the counters are only saved at shutdown
+		var timer <-chan time.Time
+		if interval > 0 {
+			timer = time.After(interval)
+		}
+
+		select {
+		case <-shutdown:
+			return
+		case <-persistReload:
+		case <-timer:
+			saveCounters()
+		}
+	}
+}
+
+// saveCounters writes the selected counters to the file. The file is
+// replaced with a rename so a crash while writing doesn't lose the old file.
+func saveCounters() {
+	persistLocker.Lock()
+	config := persistConfig
+	persistLocker.Unlock()
+
+	if config.File == "" || len(config.Counters) == 0 {
+		return
+	}
+
+	stored := storedCounters{Time: time.Now(), Counters: getPersistentCounters(config)}
+	data, err := json.Marshal(stored)
+	if err == nil {
+		temporary := filepath.Join(filepath.Dir(config.File), "."+filepath.Base(config.File)+".tmp")
+		err = ioutil.WriteFile(temporary, data, 0600)
+		if err == nil {
+			err = os.Rename(temporary, config.File)
+		}
+		if err != nil {
+			os.Remove(temporary)
+		}
+	}
+
+	persistLocker.Lock()
+	if err != nil {
+		persistError = err.Error()
+	} else {
+		persistError = ""
+		persistLastSave = stored.Time
+	}
+	persistLocker.Unlock()
+}
+
+// getPersistentCounters returns the current value of the selected counters
+func getPersistentCounters(config PersistConfig) map[string]uint64 {
+	result := make(map[string]uint64)
+	counterTable.Range(func(key interface{}, value interface{}) bool {
+		if isPersistent(config, key.(string)) {
+			result[key.(string)] = value.(*counter).total()
+		}
+		return true
+	})
+	return result
+}
+
+// isPersistent returns true if the named counter is selected for saving
+func isPersistent(config PersistConfig, name string) bool {
+	for _, pattern := range config.Counters {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package patterns
+
+// automaton is an Aho-Corasick matcher for all of the registered patterns.
+// The failure links are folded into the transition table when it is built,
+// so scanning is one table lookup per byte no matter how many patterns are
+// registered. An automaton is never changed after it is built, so it can be
+// shared by all of the nfqueue threads without locking.
+type automaton struct {
+	next    [][256]int32
+	outputs [][]int32
+	entries []patternEntry
+}
+
+// patternEntry holds a registered pattern and the owner that is told about matches
+type patternEntry struct {
+	owner    string
+	pattern  Pattern
+	function MatchFunction
+}
+
+// buildAutomaton returns an automaton that finds the argumented patterns
+func buildAutomaton(entries []patternEntry) *automaton {
+	machine := &automaton{entries: entries}
+	machine.addState()
+
+	// build the trie with the output of each pattern on its last state
+	for index, entry := range entries {
+		var state int32
+		for _, value := range entry.pattern.Data {
+			if machine.next[state][value] == 0 {
+				machine.next[state][value] = machine.addState()
+			}
+			state = machine.next[state][value]
+		}
+		machine.outputs[state] = append(machine.outputs[state], int32(index))
+	}
+
+	// walk the trie breadth first so the failure state of each state is finished
+	// before we get to it, then fill the missing transitions from the failure state
+	// and add its outputs for the patterns that end in a suffix of this state
+	fail := make([]int32, len(machine.next))
+	var queue []int32
+	for value := 0; value < 256; value++ {
+		if state := machine.next[0][value]; state != 0 {
+			queue = append(queue, state)
+		}
+	}
+
+	for len(queue) != 0 {
+		state := queue[0]
+		queue = queue[1:]
+
+		if len(machine.outputs[fail[state]]) != 0 {
+			outputs := make([]int32, 0, len(machine.outputs[state])+len(machine.outputs[fail[state]]))
+			outputs = append(outputs, machine.outputs[state]...)
+			machine.outputs[state] = append(outputs, machine.outputs[fail[state]]...)
+		}
+
+		for value := 0; value < 256; value++ {
+			target := machine.next[state][value]
+			if target == 0 {
+				machine.next[state][value] = machine.next[fail[state]][value]
+				continue
+			}
+			fail[target] = machine.next[fail[state]][value]
+			queue = append(queue, target)
+		}
+	}
+
+	return machine
+}
+
+// addState adds an empty state and returns the index
+func (machine *automaton) addState() int32 {
+	machine.next = append(machine.next, [256]int32{})
+	machine.outputs = append(machine.outputs, nil)
+	return int32(len(machine.next) - 1)
+}
+
+// scan runs the data through the automaton starting at the argumented state and
+// calls the found function with the entry index and the position just past the
+// end of each match. The returned state is passed to the next scan of the same
+// stream so patterns that cross packet boundaries are found.
+func (machine *automaton) scan(state int32, data []byte, found func(index int32, position int)) int32 {
+	for position, value := range data {
+		state = machine.next[state][value]
+		for _, index := range machine.outputs[state] {
+			found(index, position+1)
+		}
+	}
+	return state
+}
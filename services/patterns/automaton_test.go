@@ -0,0 +1,97 @@
+package patterns
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// scanChunks runs the chunks through the automaton as one stream and returns
+// the name and the stream position of each match
+func scanChunks(machine *automaton, chunks []string) []string {
+	var found []string
+	var state int32
+	var offset int
+
+	for _, chunk := range chunks {
+		state = machine.scan(state, []byte(chunk), func(index int32, position int) {
+			found = append(found, fmt.Sprintf("%s@%d", machine.entries[index].pattern.Name, offset+position))
+		})
+		offset += len(chunk)
+	}
+	return found
+}
+
+func TestAutomaton(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		chunks   []string
+		expected []string
+	}{
+		{"single", []string{"abc"}, []string{"xxabcxx"}, []string{"abc@5"}},
+		{"none", []string{"abc"}, []string{"ababab"}, nil},
+		{"repeated", []string{"ab"}, []string{"abab"}, []string{"ab@2", "ab@4"}},
+		{"overlapping", []string{"he", "she", "his", "hers"}, []string{"ushers"}, []string{"she@4", "he@4", "hers@6"}},
+		{"suffix", []string{"abcd", "bc"}, []string{"abcd"}, []string{"bc@3", "abcd@4"}},
+		{"self overlap", []string{"aa"}, []string{"aaaa"}, []string{"aa@2", "aa@3", "aa@4"}},
+		{"failure link", []string{"abab", "bac"}, []string{"ababac"}, []string{"abab@4", "bac@6"}},
+		{"across packets", []string{"needle"}, []string{"xxnee", "dlexx"}, []string{"needle@8"}},
+		{"one byte packets", []string{"abc"}, []string{"a", "b", "c"}, []string{"abc@3"}},
+		{"binary", []string{"\x00\xff"}, []string{"\xff\x00\xff\x00"}, []string{"\x00\xff@3"}},
+	}
+
+	for _, test := range tests {
+		var entries []patternEntry
+		for _, item := range test.patterns {
+			entries = append(entries, patternEntry{owner: "test", pattern: Pattern{Name: item, Data: []byte(item)}})
+		}
+		machine := buildAutomaton(entries)
+
+		found := scanChunks(machine, test.chunks)
+		if !reflect.DeepEqual(found, test.expected) {
+			t.Errorf("%s: found %v, expected %v", test.name, found, test.expected)
+		}
+	}
+}
+
+func TestSequence(t *testing.T) {
+	type segment struct {
+		seq  uint32
+		syn  bool
+		data string
+	}
+
+	tests := []struct {
+		name     string
+		segments []segment
+		expected []string
+		reset    bool
+	}{
+		{"in order", []segment{{100, true, ""}, {101, false, "abc"}, {104, false, "def"}}, []string{"", "abc", "def"}, false},
+		{"retransmit", []segment{{1, false, "abc"}, {1, false, "abc"}, {4, false, "def"}}, []string{"abc", "", "def"}, false},
+		{"overlap", []segment{{1, false, "abc"}, {2, false, "bcdef"}}, []string{"abc", "def"}, false},
+		{"gap", []segment{{1, false, "abc"}, {10, false, "xyz"}}, []string{"abc", "xyz"}, true},
+		{"wrap", []segment{{0xfffffffe, false, "abcd"}, {2, false, "ef"}}, []string{"abcd", "ef"}, false},
+	}
+
+	for _, test := range tests {
+		var stream scanStream
+		var output []string
+
+		for _, item := range test.segments {
+			stream.state = 1
+			tcp := &layers.TCP{Seq: item.seq, SYN: item.syn}
+			output = append(output, string(stream.sequence(tcp, []byte(item.data))))
+		}
+
+		if !reflect.DeepEqual(output, test.expected) {
+			t.Errorf("%s: scanned %q, expected %q", test.name, output, test.expected)
+		}
+		if (stream.state == 0) != test.reset {
+			t.Errorf("%s: state reset %v, expected %v", test.name, stream.state == 0, test.reset)
+		}
+	}
+}
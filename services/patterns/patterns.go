@@ -0,0 +1,361 @@
+// Package patterns provides a shared multi-pattern matcher for session
+// payloads. Plugins register the byte patterns they are looking for along
+// with a callback, and the payload of each session is scanned once for the
+// patterns of every plugin. The matcher runs before the general purpose
+// plugins, so the callbacks for a packet are finished before those plugins
+// see the same packet. Each direction of a session is scanned as a stream,
+// so patterns that cross packet boundaries are found, until the session has
+// passed the scan limit from the settings.
+package patterns
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// The directions a pattern can be matched in
+const (
+	DirectionAny    = 0
+	DirectionClient = 1
+	DirectionServer = 2
+)
+
+// the session attachment that holds the scan state
+const scanAttachment = "pattern_scan"
+
+// the default number of payload bytes we scan in each session
+const defaultScanBytes = 16384
+
+// the limit on the total length of the registered patterns, which bounds the
+// size of the automaton since every state uses a kilobyte
+const maxPatternBytes = 16384
+
+// Pattern is a byte sequence a plugin wants to find in session payloads. The
+// Direction limits the matches to the traffic sent by the client or the server.
+type Pattern struct {
+	Name      string
+	Data      []byte
+	Direction int
+}
+
+// Match is a pattern found in a session payload. The Offset is the position
+// just past the end of the match in the stream for the direction.
+type Match struct {
+	Name           string
+	Offset         uint64
+	ClientToServer bool
+}
+
+// MatchFunction is called with the matches for an owner in a packet
+type MatchFunction func(mess dispatch.NfqueueMessage, ctid uint32, matches []Match)
+
+// Status holds the registered patterns and the scan counters
+type Status struct {
+	ScanBytes uint64         `json:"scanBytes"`
+	Owners    map[string]int `json:"owners"`
+	States    int            `json:"states"`
+	Sessions  uint64         `json:"sessions"`
+	Matches   uint64         `json:"matches"`
+}
+
+// scanStream holds the automaton state and the offset for one direction of a
+// session. For TCP the next expected sequence number is tracked so the bytes
+// of retransmitted segments are not scanned twice.
+type scanStream struct {
+	state   int32
+	offset  uint64
+	nextSeq uint32
+	synced  bool
+}
+
+// scanState holds the scan state of a session. The packets of a session can
+// be handled by more than one nfqueue thread so the locker protects the streams.
+type scanState struct {
+	locker  sync.Mutex
+	machine *automaton
+	client  scanStream
+	server  scanStream
+}
+
+// registration holds the patterns and the callback of an owner
+type registration struct {
+	patterns []Pattern
+	function MatchFunction
+}
+
+var registrationTable = make(map[string]registration)
+var registrationLocker sync.Mutex
+var currentMachine atomic.Value
+var scanBytes uint64
+var sessionCount uint64
+var matchCount uint64
+
+// Startup is called to handle service startup
+func Startup() {
+	Reload()
+	dispatch.InsertNfqueueSubscription("patterns", dispatch.PatternsPriority, nfqueueHandler)
+}
+
+// Shutdown is called to handle service shutdown. The subscription stays in
+// dispatch but releases every session once the automaton is gone.
+func Shutdown() {
+	registrationLocker.Lock()
+	defer registrationLocker.Unlock()
+
+	registrationTable = make(map[string]registration)
+	currentMachine.Store((*automaton)(nil))
+}
+
+// Reload loads the scan limit from the settings
+func Reload() {
+	limit := uint64(defaultScanBytes)
+
+	value, err := settings.GetCurrentSettings([]string{"patterns", "scanBytes"})
+	if err == nil && value != nil {
+		if number, ok := value.(float64); ok && number > 0 {
+			limit = uint64(number)
+		} else {
+			logger.Warn("Invalid pattern scan limit: %v\n", value)
+		}
+	}
+
+	atomic.StoreUint64(&scanBytes, limit)
+	logger.Info("Loaded pattern scan limit: %d bytes\n", limit)
+}
+
+// Register adds or replaces the patterns for an owner. The function is called
+// with the matches for the owner in each packet that has any.
+func Register(owner string, list []Pattern, function MatchFunction) error {
+	if function == nil {
+		return fmt.Errorf("missing match function for %s", owner)
+	}
+	for _, pattern := range list {
+		if len(pattern.Data) == 0 {
+			return fmt.Errorf("empty pattern %s for %s", pattern.Name, owner)
+		}
+		if pattern.Direction < DirectionAny || pattern.Direction > DirectionServer {
+			return fmt.Errorf("invalid direction %d for pattern %s", pattern.Direction, pattern.Name)
+		}
+	}
+
+	registrationLocker.Lock()
+	defer registrationLocker.Unlock()
+
+	total := 0
+	for name, item := range registrationTable {
+		if name == owner {
+			continue
+		}
+		total += getPatternBytes(item.patterns)
+	}
+	if total+getPatternBytes(list) > maxPatternBytes {
+		return fmt.Errorf("patterns for %s exceed the %d byte limit", owner, maxPatternBytes)
+	}
+
+	logger.Info("Registering %d patterns for %s\n", len(list), owner)
+	registrationTable[owner] = registration{patterns: list, function: function}
+	rebuildMachine()
+	return nil
+}
+
+// Unregister removes the patterns for an owner
+func Unregister(owner string) {
+	registrationLocker.Lock()
+	defer registrationLocker.Unlock()
+
+	if _, found := registrationTable[owner]; !found {
+		return
+	}
+
+	logger.Info("Unregistering patterns for %s\n", owner)
+	delete(registrationTable, owner)
+	rebuildMachine()
+}
+
+// GetStatus returns the registered patterns and the scan counters
+func GetStatus() Status {
+	status := Status{Owners: make(map[string]int)}
+	status.ScanBytes = atomic.LoadUint64(&scanBytes)
+	status.Sessions = atomic.LoadUint64(&sessionCount)
+	status.Matches = atomic.LoadUint64(&matchCount)
+
+	registrationLocker.Lock()
+	for owner, item := range registrationTable {
+		status.Owners[owner] = len(item.patterns)
+	}
+	registrationLocker.Unlock()
+
+	if machine, _ := currentMachine.Load().(*automaton); machine != nil {
+		status.States = len(machine.next)
+	}
+	return status
+}
+
+// nfqueueHandler scans the payload of each packet for the registered patterns
+// and calls the owners of the patterns that are found
+func nfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
+	var result dispatch.NfqueueResult
+	result.SessionRelease = true
+
+	session := mess.Session
+	machine, _ := currentMachine.Load().(*automaton)
+	if machine == nil || session == nil {
+		return result
+	}
+
+	limit := atomic.LoadUint64(&scanBytes)
+	attachments := session.LockAttachments()
+	scan, _ := attachments[scanAttachment].(*scanState)
+	if scan == nil {
+		scan = &scanState{machine: machine}
+		attachments[scanAttachment] = scan
+		atomic.AddUint64(&sessionCount, 1)
+	}
+	session.UnlockAttachments()
+
+	scan.locker.Lock()
+
+	// patterns registered since the last packet start matching from here on
+	if scan.machine != machine {
+		scan.machine = machine
+		scan.client.state = 0
+		scan.server.state = 0
+	}
+
+	scanned := scan.client.offset + scan.server.offset
+	if scanned >= limit {
+		scan.locker.Unlock()
+		return result
+	}
+
+	stream := &scan.server
+	if mess.ClientToServer {
+		stream = &scan.client
+	}
+
+	data := mess.Payload
+	if mess.TCPLayer != nil {
+		data = stream.sequence(mess.TCPLayer, data)
+	}
+	if uint64(len(data)) > limit-scanned {
+		data = data[:limit-scanned]
+	}
+
+	var owners []string
+	matches := make(map[string][]Match)
+	stream.state = machine.scan(stream.state, data, func(index int32, position int) {
+		entry := machine.entries[index]
+		if entry.pattern.Direction == DirectionClient && !mess.ClientToServer {
+			return
+		}
+		if entry.pattern.Direction == DirectionServer && mess.ClientToServer {
+			return
+		}
+		if _, found := matches[entry.owner]; !found {
+			owners = append(owners, entry.owner)
+		}
+		matches[entry.owner] = append(matches[entry.owner], Match{Name: entry.pattern.Name, Offset: stream.offset + uint64(position), ClientToServer: mess.ClientToServer})
+	})
+	stream.offset += uint64(len(data))
+	scan.locker.Unlock()
+
+	// the owners are called without the lock so they can't stall the other direction
+	for _, owner := range owners {
+		list := matches[owner]
+		logger.Debug("Found %d patterns for %s ctid:%d\n", len(list), owner, ctid)
+		atomic.AddUint64(&matchCount, uint64(len(list)))
+		getFunction(machine, owner)(mess, ctid, list)
+	}
+
+	result.SessionRelease = (scanned+uint64(len(data)) >= limit)
+	return result
+}
+
+// sequence returns the part of a TCP payload that has not been scanned yet and
+// moves the next expected sequence number past it. The bytes of retransmitted
+// and overlapping segments that were already scanned are skipped. When segments
+// are missing the automaton state is reset, so a match is never put together
+// from the bytes on both sides of the gap.
+func (stream *scanStream) sequence(tcp *layers.TCP, data []byte) []byte {
+	seq := tcp.Seq
+	if tcp.SYN {
+		seq++
+	}
+
+	if !stream.synced {
+		stream.synced = true
+		stream.nextSeq = seq + uint32(len(data))
+		return data
+	}
+
+	diff := int32(seq - stream.nextSeq)
+	if diff > 0 {
+		logger.Trace("Missing %d bytes in pattern stream, resetting state\n", diff)
+		stream.state = 0
+		stream.nextSeq = seq + uint32(len(data))
+		return data
+	}
+
+	if diff < 0 {
+		if int(-diff) >= len(data) {
+			return nil
+		}
+		data = data[-diff:]
+	}
+
+	stream.nextSeq += uint32(len(data))
+	return data
+}
+
+// getFunction returns the match function of an owner in the argumented automaton
+func getFunction(machine *automaton, owner string) MatchFunction {
+	for _, entry := range machine.entries {
+		if entry.owner == owner {
+			return entry.function
+		}
+	}
+	return nil
+}
+
+// rebuildMachine builds a new automaton for the registered patterns.
+// The caller must hold the registrationLocker.
+func rebuildMachine() {
+	var owners []string
+	for owner := range registrationTable {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	var entries []patternEntry
+	for _, owner := range owners {
+		item := registrationTable[owner]
+		for _, pattern := range item.patterns {
+			entries = append(entries, patternEntry{owner: owner, pattern: pattern, function: item.function})
+		}
+	}
+
+	if len(entries) == 0 {
+		currentMachine.Store((*automaton)(nil))
+		return
+	}
+
+	machine := buildAutomaton(entries)
+	currentMachine.Store(machine)
+	logger.Info("Built pattern automaton with %d patterns and %d states\n", len(entries), len(machine.next))
+}
+
+// getPatternBytes returns the total length of the argumented patterns
+func getPatternBytes(list []Pattern) int {
+	var total int
+	for _, pattern := range list {
+		total += len(pattern.Data)
+	}
+	return total
+}
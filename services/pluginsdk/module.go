@@ -0,0 +1,74 @@
+package pluginsdk
+
+import (
+	"syscall"
+)
+
+// Module is a Plugin built from the package level functions most plugins
+// are written with. Any of the function fields may be nil.
+type Module struct {
+	PluginName    string
+	StartupFunc   func()
+	ShutdownFunc  func()
+	SignalFunc    func(syscall.Signal)
+	HealthFunc    func() error
+	EnabledFunc   func() bool
+	Subscriptions []Subscription
+}
+
+// module wraps a Module so the Subscriptions field doesn't collide with the Plugin method
+type module struct {
+	def Module
+}
+
+// NewModule returns a Plugin for the argumented Module
+func NewModule(def Module) Plugin {
+	return &module{def: def}
+}
+
+// Name returns the plugin name
+func (m *module) Name() string {
+	return m.def.PluginName
+}
+
+// Startup calls the plugin startup function
+func (m *module) Startup() {
+	if m.def.StartupFunc != nil {
+		m.def.StartupFunc()
+	}
+}
+
+// Shutdown calls the plugin shutdown function
+func (m *module) Shutdown() {
+	if m.def.ShutdownFunc != nil {
+		m.def.ShutdownFunc()
+	}
+}
+
+// Subscriptions returns the plugin subscriptions
+func (m *module) Subscriptions() []Subscription {
+	return m.def.Subscriptions
+}
+
+// SettingsChanged passes a SIGHUP to the plugin signal function
+func (m *module) SettingsChanged() {
+	if m.def.SignalFunc != nil {
+		m.def.SignalFunc(syscall.SIGHUP)
+	}
+}
+
+// HealthCheck calls the plugin health function
+func (m *module) HealthCheck() error {
+	if m.def.HealthFunc != nil {
+		return m.def.HealthFunc()
+	}
+	return nil
+}
+
+// Enabled calls the plugin enabled function
+func (m *module) Enabled() bool {
+	if m.def.EnabledFunc != nil {
+		return m.def.EnabledFunc()
+	}
+	return true
+}
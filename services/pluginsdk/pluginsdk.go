@@ -0,0 +1,239 @@
+// Package pluginsdk defines the Plugin interface implemented by all packetd
+// plugins along with the registry used to start, stop, signal, and check the
+// health of every registered plugin. Plugins register themselves from an init
+// function so the main process only needs to import the plugin package.
+package pluginsdk
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/untangle/packetd/services/crashreport"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// Plugin is the interface implemented by all plugins
+type Plugin interface {
+	// Name returns the unique name of the plugin
+	Name() string
+	// Startup is called to allow plugin specific initialization
+	Startup()
+	// Shutdown is called when the daemon is shutting down
+	Shutdown()
+	// Subscriptions returns the dispatch subscriptions for the plugin. They
+	// are inserted by the registry after the plugin Startup has returned.
+	Subscriptions() []Subscription
+	// SettingsChanged is called when the settings have been changed
+	SettingsChanged()
+	// HealthCheck returns nil if the plugin is healthy or an error describing the problem
+	HealthCheck() error
+}
+
+// Conditional is an optional interface for plugins that should only be
+// started under certain conditions. Plugins that don't implement it are
+// always started.
+type Conditional interface {
+	Enabled() bool
+}
+
+// Subscription describes a dispatch subscription for a plugin. Exactly one
+// of the handler functions should be set. The Name defaults to the plugin
+// name and only needs to be set for plugins with more than one subscription
+// of the same type.
+type Subscription struct {
+	Name          string
+	Priority      int
+	NfqueueFunc   dispatch.NfqueueHandlerFunction
+	ConntrackFunc dispatch.ConntrackHandlerFunction
+	NetloggerFunc dispatch.NetloggerHandlerFunction
+}
+
+// PluginStatus holds the status of a registered plugin
+type PluginStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// registryEntry holds a registered plugin and its current state
+type registryEntry struct {
+	plugin  Plugin
+	running bool
+}
+
+var registry = make(map[string]*registryEntry)
+var registryMutex sync.RWMutex
+
+// Register adds a plugin to the registry. It is normally called from the
+// init function of the plugin package.
+func Register(plugin Plugin) {
+	registryMutex.Lock()
+	_, existing := registry[plugin.Name()]
+	registry[plugin.Name()] = &registryEntry{plugin: plugin}
+	registryMutex.Unlock()
+
+	if existing {
+		panic("DUPLICATE PLUGIN REGISTRATION DETECTED: " + plugin.Name())
+	}
+}
+
+// StartPlugins starts all of the enabled plugins in parallel and inserts
+// their dispatch subscriptions
+func StartPlugins() {
+	var wg sync.WaitGroup
+
+	for _, entry := range getEntries() {
+		if cond, ok := entry.plugin.(Conditional); ok && !cond.Enabled() {
+			logger.Info("Plugin %s is not enabled\n", entry.plugin.Name())
+			continue
+		}
+
+		wg.Add(1)
+		go func(entry *registryEntry) {
+			defer wg.Done()
+			// a plugin that panics during startup is left stopped without subscriptions
+			if !callPlugin(entry.plugin.Name(), "startup", entry.plugin.Startup) {
+				return
+			}
+			insertSubscriptions(entry.plugin)
+			registryMutex.Lock()
+			entry.running = true
+			registryMutex.Unlock()
+		}(entry)
+	}
+
+	wg.Wait()
+}
+
+// StopPlugins stops all of the running plugins in parallel
+func StopPlugins() {
+	var wg sync.WaitGroup
+
+	for _, entry := range getEntries() {
+		registryMutex.RLock()
+		running := entry.running
+		registryMutex.RUnlock()
+		if !running {
+			continue
+		}
+
+		wg.Add(1)
+		go func(entry *registryEntry) {
+			callPlugin(entry.plugin.Name(), "shutdown", entry.plugin.Shutdown)
+			registryMutex.Lock()
+			entry.running = false
+			registryMutex.Unlock()
+			wg.Done()
+		}(entry)
+	}
+
+	wg.Wait()
+}
+
+// SignalPlugins passes system signals to the running plugins in parallel.
+// A SIGHUP means the settings have changed.
+func SignalPlugins(message syscall.Signal) {
+	var wg sync.WaitGroup
+
+	if message != syscall.SIGHUP {
+		return
+	}
+
+	for _, entry := range getEntries() {
+		registryMutex.RLock()
+		running := entry.running
+		registryMutex.RUnlock()
+		if !running {
+			continue
+		}
+
+		wg.Add(1)
+		go func(entry *registryEntry) {
+			callPlugin(entry.plugin.Name(), "settings", entry.plugin.SettingsChanged)
+			wg.Done()
+		}(entry)
+	}
+
+	wg.Wait()
+}
+
+// GetPluginStatus returns the status and health of every registered plugin sorted by name
+func GetPluginStatus() []PluginStatus {
+	var list []PluginStatus
+
+	for _, entry := range getEntries() {
+		registryMutex.RLock()
+		status := PluginStatus{Name: entry.plugin.Name(), Running: entry.running}
+		registryMutex.RUnlock()
+
+		if status.Running {
+			var err error
+			if !callPlugin(entry.plugin.Name(), "health check", func() { err = entry.plugin.HealthCheck() }) {
+				err = fmt.Errorf("health check panic")
+			}
+			if err != nil {
+				status.Error = err.Error()
+			} else {
+				status.Healthy = true
+			}
+		}
+
+		list = append(list, status)
+	}
+
+	return list
+}
+
+// callPlugin calls a plugin function and saves a crash report if it panics
+// so one broken plugin doesn't take down the daemon. Returns false if the
+// function panicked.
+func callPlugin(name string, action string, function func()) (ok bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			crashreport.Capture("plugin "+name+" "+action, recovered, debug.Stack())
+			logger.Err("Plugin %s panicked during %s: %v\n", name, action, recovered)
+			ok = false
+		}
+	}()
+
+	function()
+	return true
+}
+
+// getEntries returns the registry entries sorted by plugin name
+func getEntries() []*registryEntry {
+	var list []*registryEntry
+
+	registryMutex.RLock()
+	for _, entry := range registry {
+		list = append(list, entry)
+	}
+	registryMutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].plugin.Name() < list[j].plugin.Name() })
+	return list
+}
+
+// insertSubscriptions adds the dispatch subscriptions for the argumented plugin
+func insertSubscriptions(plugin Plugin) {
+	for _, sub := range plugin.Subscriptions() {
+		name := sub.Name
+		if name == "" {
+			name = plugin.Name()
+		}
+		if sub.NfqueueFunc != nil {
+			dispatch.InsertNfqueueSubscription(name, sub.Priority, sub.NfqueueFunc)
+		}
+		if sub.ConntrackFunc != nil {
+			dispatch.InsertConntrackSubscription(name, sub.Priority, sub.ConntrackFunc)
+		}
+		if sub.NetloggerFunc != nil {
+			dispatch.InsertNetloggerSubscription(name, sub.Priority, sub.NetloggerFunc)
+		}
+	}
+}
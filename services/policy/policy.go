@@ -0,0 +1,909 @@
+// Package policy provides the policy engine. The policy is an ordered list of
+// rules from the settings. Each rule has conditions that match against the
+// session fields (tuple, zone, geoip, classification, certificate, user, device), the
+// time of day, and the named schedules, and an action that will bypass, drop, tag, set the priority,
+// mirror the packets to a named mirror target, or assign the session to a quota bucket. The engine only evaluates the
+// rules. The actions are applied by dispatch, and the same evaluation is
+// available as a dry run so rules can be tested without any traffic.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/schedule"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// The policy action types
+const (
+	ActionBypass   = "bypass"
+	ActionDrop     = "drop"
+	ActionTag      = "tag"
+	ActionPriority = "priority"
+	ActionQuota    = "quota"
+	ActionMirror   = "mirror"
+)
+
+// The rule evaluation results used in the dry run trace
+const (
+	ResultMatched = "matched"
+	ResultFailed  = "failed"
+	ResultUnknown = "unknown"
+)
+
+// the number of packets to inspect while waiting for rule conditions that depend
+// on details like the classification that aren't known until later in a session
+const defaultMaxPackets = 10
+
+// SourceFunc returns policy rules and quotas in the settings format
+type SourceFunc func() ([]interface{}, []interface{})
+
+// FieldFunc returns the value of the named session field and false if the
+// field is not known (yet) for the session
+type FieldFunc func(name string) (string, bool)
+
+// Condition is a single condition that must be true for a rule to match
+type Condition struct {
+	Field    string `json:"field"`
+	Operator string `json:"op"`
+	Value    string `json:"value"`
+	list     []string
+	network  *net.IPNet
+	pattern  *regexp.Regexp
+	low      string
+	high     string
+}
+
+// Action is the action performed when a rule matches
+type Action struct {
+	Type  string `json:"type"`
+	Field string `json:"field,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// Rule holds a single policy rule from the settings
+type Rule struct {
+	RuleID      string       `json:"ruleId"`
+	Description string       `json:"description,omitempty"`
+	Conditions  []*Condition `json:"conditions"`
+	Action      Action       `json:"action"`
+}
+
+// Decision is an action from a rule that matched a session. Quota is the
+// bucket the session is assigned to, which is kept even when the bucket is
+// over the limit and the action is replaced by the exceeded action.
+type Decision struct {
+	RuleID        string `json:"ruleId"`
+	Action        Action `json:"action"`
+	Quota         string `json:"quota,omitempty"`
+	QuotaExceeded bool   `json:"quotaExceeded,omitempty"`
+}
+
+// RuleTrace describes how a rule was evaluated for a dry run
+type RuleTrace struct {
+	RuleID string `json:"ruleId"`
+	Result string `json:"result"`
+	Field  string `json:"field,omitempty"`
+}
+
+// Result holds the decisions from evaluating the policy. Next is the index of
+// the rule where evaluation should continue on the next packet, and Pending is
+// true if a rule is waiting for a field that isn't known yet. Finished is true
+// once a bypass or drop decision has been made.
+type Result struct {
+	Generation uint64      `json:"generation"`
+	Next       int         `json:"next"`
+	Pending    bool        `json:"pending"`
+	Finished   bool        `json:"finished"`
+	Decisions  []Decision  `json:"decisions"`
+	Trace      []RuleTrace `json:"trace,omitempty"`
+}
+
+// RuleStatus holds a rule and the number of times it has matched
+type RuleStatus struct {
+	Rule *Rule  `json:"rule"`
+	Hits uint64 `json:"hits"`
+}
+
+// QuotaStatus holds the configuration and usage of a quota bucket
+type QuotaStatus struct {
+	Name           string    `json:"name"`
+	LimitBytes     uint64    `json:"limitBytes"`
+	UsedBytes      uint64    `json:"usedBytes"`
+	Period         string    `json:"period"`
+	PeriodStart    time.Time `json:"periodStart"`
+	Exceeded       bool      `json:"exceeded"`
+	ExceededAction Action    `json:"exceededAction"`
+}
+
+// Status holds the current policy and counters
+type Status struct {
+	Generation uint64        `json:"generation"`
+	MaxPackets uint64        `json:"maxPackets"`
+	Rules      []RuleStatus  `json:"rules"`
+	Quotas     []QuotaStatus `json:"quotas"`
+}
+
+// quotaBucket tracks the bytes used by the sessions assigned to a bucket
+type quotaBucket struct {
+	name        string
+	limitBytes  uint64
+	period      string
+	exceeded    Action
+	usedBytes   uint64
+	periodStart time.Time
+	mutex       sync.Mutex
+}
+
+// policySet holds the compiled policy from the settings
+type policySet struct {
+	generation uint64
+	rules      []*Rule
+	hits       []uint64
+	quotas     map[string]*quotaBucket
+	maxPackets uint64
+}
+
+var currentPolicy = &policySet{maxPackets: defaultMaxPackets, quotas: make(map[string]*quotaBucket)}
+var policyLocker sync.RWMutex
+var policyGeneration uint64
+var sourceTable = make(map[string]SourceFunc)
+var sourceLocker sync.Mutex
+
+// Startup is called to handle service startup
+func Startup() {
+	settings.RegisterValidator("policy", validatePolicy)
+	Reload()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+}
+
+// Reload loads and compiles the policy from the settings. The rules from the
+// registered sources are evaluated before the rules in the settings, even
+// when the policy in the settings is disabled. The usage of the quota buckets
+// is kept for buckets that still exist.
+func Reload() {
+	fresh := &policySet{maxPackets: defaultMaxPackets, quotas: make(map[string]*quotaBucket)}
+	fresh.generation = atomic.AddUint64(&policyGeneration, 1)
+	item := make(map[string]interface{})
+
+	policyJSON, err := settings.GetCurrentSettings([]string{"policy"})
+	if policyJSON == nil || err != nil {
+		logger.Info("No policy found in settings\n")
+	} else if value, ok := policyJSON.(map[string]interface{}); !ok {
+		logger.Warn("Invalid policy settings: %T\n", policyJSON)
+	} else if enabled, found := value["enabled"].(bool); found && !enabled {
+		logger.Info("The policy is disabled\n")
+	} else {
+		item = value
+	}
+
+	compileSources(fresh, true)
+	compilePolicy(fresh, item, true)
+
+	logger.Info("Loaded %d policy rules and %d quotas\n", len(fresh.rules), len(fresh.quotas))
+	setPolicy(fresh)
+}
+
+// RegisterSource registers a function that returns policy rules and quotas in
+// the settings format. This lets a service like the profiles build its
+// features from policy rules. The rules need a ruleId, and the service must
+// call Reload when they change.
+func RegisterSource(name string, source SourceFunc) {
+	sourceLocker.Lock()
+	sourceTable[name] = source
+	sourceLocker.Unlock()
+}
+
+// compileSources compiles the rules and quotas from the registered sources in
+// the order of the source names. Invalid rules and quotas are skipped and
+// returned as errors, and are also logged when verbose is true.
+func compileSources(fresh *policySet, verbose bool) []error {
+	var problems []error
+
+	sourceLocker.Lock()
+	var names []string
+	for name := range sourceTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sources []SourceFunc
+	for _, name := range names {
+		sources = append(sources, sourceTable[name])
+	}
+	sourceLocker.Unlock()
+
+	for index, source := range sources {
+		ruleSlice, quotaSlice := source()
+
+		for _, value := range quotaSlice {
+			bucket, err := parseQuota(value)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s quota: %v", names[index], err))
+				continue
+			}
+			fresh.quotas[bucket.name] = bucket
+		}
+
+		for _, value := range ruleSlice {
+			item, _ := value.(map[string]interface{})
+			if item == nil || item["ruleId"] == nil {
+				problems = append(problems, fmt.Errorf("%s rule: missing ruleId", names[index]))
+				continue
+			}
+			rule, err := parseRule(value, 0)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s rule %v: %v", names[index], item["ruleId"], err))
+				continue
+			}
+			if rule == nil {
+				continue
+			}
+			if rule.Action.Type == ActionQuota && fresh.quotas[rule.Action.Value] == nil {
+				problems = append(problems, fmt.Errorf("%s rule %s: unknown quota %s", names[index], rule.RuleID, rule.Action.Value))
+				continue
+			}
+			fresh.rules = append(fresh.rules, rule)
+		}
+	}
+
+	if verbose {
+		for _, problem := range problems {
+			logger.Warn("Ignoring invalid policy %v\n", problem)
+		}
+	}
+
+	return problems
+}
+
+// compilePolicy compiles the rules and quotas from the policy settings. Invalid
+// rules and quotas are skipped and returned as errors, and are also logged
+// when verbose is true. The usage of the quota buckets that exist in the
+// active policy is copied to the new buckets.
+func compilePolicy(fresh *policySet, item map[string]interface{}, verbose bool) []error {
+	var problems []error
+
+	if value, ok := item["maxPackets"].(float64); ok && value > 0 {
+		fresh.maxPackets = uint64(value)
+	}
+
+	quotaSlice, _ := item["quotas"].([]interface{})
+	for index, value := range quotaSlice {
+		bucket, err := parseQuota(value)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("quota %d: %v", index, err))
+			continue
+		}
+		fresh.quotas[bucket.name] = bucket
+	}
+
+	ruleSlice, _ := item["rules"].([]interface{})
+	for index, value := range ruleSlice {
+		rule, err := parseRule(value, index)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("rule %d: %v", index, err))
+			continue
+		}
+		if rule == nil {
+			continue
+		}
+		if rule.Action.Type == ActionQuota && fresh.quotas[rule.Action.Value] == nil {
+			problems = append(problems, fmt.Errorf("rule %s: unknown quota %s", rule.RuleID, rule.Action.Value))
+			continue
+		}
+		fresh.rules = append(fresh.rules, rule)
+	}
+	fresh.hits = make([]uint64, len(fresh.rules))
+
+	// keep the usage of the quota buckets that still exist
+	current := getPolicy()
+	for name, bucket := range fresh.quotas {
+		if previous, found := current.quotas[name]; found {
+			previous.mutex.Lock()
+			bucket.usedBytes = previous.usedBytes
+			bucket.periodStart = previous.periodStart
+			previous.mutex.Unlock()
+		}
+	}
+
+	if verbose {
+		for _, problem := range problems {
+			logger.Warn("Ignoring invalid policy %v\n", problem)
+		}
+	}
+
+	return problems
+}
+
+// validatePolicy checks the policy in the staged settings
+func validatePolicy(jsonSettings map[string]interface{}) []string {
+	var problems []string
+
+	if jsonSettings["policy"] == nil {
+		return problems
+	}
+
+	item, ok := jsonSettings["policy"].(map[string]interface{})
+	if !ok {
+		return []string{"policy must be an object"}
+	}
+
+	fresh := &policySet{maxPackets: defaultMaxPackets, quotas: make(map[string]*quotaBucket)}
+	for _, problem := range compilePolicy(fresh, item, false) {
+		problems = append(problems, problem.Error())
+	}
+
+	return problems
+}
+
+// IsActive returns true if there are any policy rules
+func IsActive() bool {
+	return len(getPolicy().rules) != 0
+}
+
+// GetMaxPackets returns the number of packets to inspect while rules are waiting for fields
+func GetMaxPackets() uint64 {
+	return getPolicy().maxPackets
+}
+
+// Evaluate evaluates the policy rules for a session starting at the argumented
+// rule index. The rules are evaluated in order, and we stop at the first rule
+// that needs a field that isn't known yet so a later rule can't make a
+// decision that an earlier rule should have made. When final is true unknown
+// fields are treated as not matching so evaluation can finish. If the policy
+// has been reloaded since the generation was returned we start over.
+func Evaluate(generation uint64, start int, fields FieldFunc, now time.Time, final bool) Result {
+	current := getPolicy()
+	if generation != current.generation {
+		start = 0
+	}
+	return current.evaluate(start, fields, now, final, false)
+}
+
+// DryRun evaluates the complete policy against the argumented field values
+// and returns the decisions along with how each rule was evaluated. The hit
+// counters and quota usage are not changed. When candidate is not nil it is
+// compiled after the rules from the registered sources and evaluated instead
+// of the active policy so changes can be tested before they are saved, and
+// any invalid rules are returned as an error.
+func DryRun(candidate interface{}, values map[string]string, now time.Time) (Result, error) {
+	fields := func(name string) (string, bool) {
+		value, found := values[name]
+		return value, found
+	}
+
+	if candidate == nil {
+		return getPolicy().evaluate(0, fields, now, true, true), nil
+	}
+
+	item, ok := candidate.(map[string]interface{})
+	if !ok {
+		return Result{}, errInvalid("policy")
+	}
+
+	fresh := &policySet{maxPackets: defaultMaxPackets, quotas: make(map[string]*quotaBucket)}
+	compileSources(fresh, false)
+	if enabled, found := item["enabled"].(bool); !found || enabled {
+		if problems := compilePolicy(fresh, item, false); len(problems) != 0 {
+			return Result{}, problems[0]
+		}
+	}
+
+	return fresh.evaluate(0, fields, now, true, true), nil
+}
+
+// AddQuotaBytes adds bytes used by a session to a quota bucket
+func AddQuotaBytes(name string, bytes uint64) {
+	bucket := getPolicy().quotas[name]
+	if bucket == nil || bytes == 0 {
+		return
+	}
+
+	bucket.mutex.Lock()
+	bucket.checkPeriod(time.Now())
+	bucket.usedBytes += bytes
+	bucket.mutex.Unlock()
+}
+
+// GetStatus returns the current policy along with the rule and quota counters
+func GetStatus() Status {
+	current := getPolicy()
+	now := time.Now()
+
+	status := Status{Generation: current.generation, MaxPackets: current.maxPackets, Rules: []RuleStatus{}, Quotas: []QuotaStatus{}}
+
+	for index, rule := range current.rules {
+		status.Rules = append(status.Rules, RuleStatus{Rule: rule, Hits: atomic.LoadUint64(&current.hits[index])})
+	}
+
+	for _, bucket := range current.quotas {
+		bucket.mutex.Lock()
+		bucket.checkPeriod(now)
+		status.Quotas = append(status.Quotas, QuotaStatus{
+			Name:           bucket.name,
+			LimitBytes:     bucket.limitBytes,
+			UsedBytes:      bucket.usedBytes,
+			Period:         bucket.period,
+			PeriodStart:    bucket.periodStart,
+			Exceeded:       bucket.usedBytes >= bucket.limitBytes,
+			ExceededAction: bucket.exceeded,
+		})
+		bucket.mutex.Unlock()
+	}
+
+	sort.Slice(status.Quotas, func(i, j int) bool { return status.Quotas[i].Name < status.Quotas[j].Name })
+
+	return status
+}
+
+// evaluate evaluates the rules starting at the argumented index
+func (current *policySet) evaluate(start int, fields FieldFunc, now time.Time, final bool, trace bool) Result {
+	result := Result{Generation: current.generation, Decisions: []Decision{}}
+
+	for index := start; index < len(current.rules); index++ {
+		rule := current.rules[index]
+		state, field := rule.evaluate(fields, now)
+
+		if trace {
+			result.Trace = append(result.Trace, RuleTrace{RuleID: rule.RuleID, Result: state, Field: field})
+		}
+
+		if state == ResultUnknown && !final {
+			result.Next = index
+			result.Pending = true
+			return result
+		}
+
+		if state != ResultMatched {
+			continue
+		}
+
+		if !trace {
+			atomic.AddUint64(&current.hits[index], 1)
+		}
+
+		decision := Decision{RuleID: rule.RuleID, Action: rule.Action}
+
+		// sessions assigned to a bucket that is over the limit get the exceeded action instead
+		if rule.Action.Type == ActionQuota {
+			decision.Quota = rule.Action.Value
+			bucket := current.quotas[rule.Action.Value]
+			if bucket != nil && bucket.isExceeded(now) {
+				decision.QuotaExceeded = true
+				if bucket.exceeded.Type != "" {
+					decision.Action = bucket.exceeded
+				}
+			}
+		}
+
+		result.Decisions = append(result.Decisions, decision)
+
+		if decision.Action.Type == ActionBypass || decision.Action.Type == ActionDrop {
+			result.Next = len(current.rules)
+			result.Finished = true
+			return result
+		}
+	}
+
+	result.Next = len(current.rules)
+	return result
+}
+
+// evaluate returns the result of evaluating the rule conditions and the field
+// of the first condition that did not match or is not known
+func (rule *Rule) evaluate(fields FieldFunc, now time.Time) (string, string) {
+	for _, cond := range rule.Conditions {
+		matched, found := cond.Evaluate(fields, now)
+		if !found {
+			return ResultUnknown, cond.Field
+		}
+		if !matched {
+			return ResultFailed, cond.Field
+		}
+	}
+	return ResultMatched, ""
+}
+
+// Evaluate returns true if the condition matches the field value from the
+// argumented function, and false for the second value if the field is not
+// known. The schedule and time fields are handled here using the argumented
+// time in the schedule timezone.
+func (cond *Condition) Evaluate(fields FieldFunc, now time.Time) (bool, bool) {
+	if cond.Field == "schedule" {
+		return cond.matchesSchedule(now), true
+	}
+
+	value, found := getFieldValue(fields, cond.Field, now)
+	if !found {
+		return false, false
+	}
+	return cond.Matches(value), true
+}
+
+// matchesSchedule returns true if the named schedules are active for the
+// == and in operators, or not active for the != and not_in operators
+func (cond *Condition) matchesSchedule(now time.Time) bool {
+	names := cond.list
+	if len(names) == 0 {
+		names = []string{cond.Value}
+	}
+
+	active := false
+	for _, name := range names {
+		current, found := schedule.IsActive(name, now)
+		if !found {
+			logger.Debug("Policy condition references unknown schedule %s\n", name)
+		}
+		if current {
+			active = true
+			break
+		}
+	}
+
+	if cond.Operator == "!=" || cond.Operator == "not_in" {
+		return !active
+	}
+	return active
+}
+
+// getFieldValue returns the value of a field. The time fields are handled
+// here and everything else comes from the session.
+func getFieldValue(fields FieldFunc, name string, now time.Time) (string, bool) {
+	local := now.In(schedule.GetLocation())
+
+	switch name {
+	case "time_of_day":
+		return local.Format("15:04"), true
+	case "day_of_week":
+		return strings.ToLower(local.Weekday().String()[0:3]), true
+	case "hour":
+		return strconv.Itoa(local.Hour()), true
+	}
+	return fields(name)
+}
+
+// Matches returns true if the argumented value matches the condition
+func (cond *Condition) Matches(value string) bool {
+	switch cond.Operator {
+	case "==":
+		return value == cond.Value
+	case "!=":
+		return value != cond.Value
+	case "<", "<=", ">", ">=":
+		left, err1 := strconv.ParseFloat(value, 64)
+		right, err2 := strconv.ParseFloat(cond.Value, 64)
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		switch cond.Operator {
+		case "<":
+			return left < right
+		case "<=":
+			return left <= right
+		case ">":
+			return left > right
+		default:
+			return left >= right
+		}
+	case "in", "not_in":
+		found := false
+		for _, item := range cond.list {
+			if item == value {
+				found = true
+				break
+			}
+		}
+		return found == (cond.Operator == "in")
+	case "cidr":
+		addr := net.ParseIP(value)
+		return addr != nil && cond.network.Contains(addr)
+	case "contains":
+		return strings.Contains(value, cond.Value)
+	case "prefix":
+		return strings.HasPrefix(value, cond.Value)
+	case "suffix":
+		return strings.HasSuffix(value, cond.Value)
+	case "matches":
+		return cond.pattern.MatchString(value)
+	case "wildcard":
+		// fields like the certificate names hold a list so any name can match
+		for _, name := range strings.Split(value, "|") {
+			if cond.pattern.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	case "between":
+		// a range like 22:00-06:00 that wraps around midnight matches outside the reversed range
+		if cond.low <= cond.high {
+			return value >= cond.low && value < cond.high
+		}
+		return value >= cond.low || value < cond.high
+	}
+	return false
+}
+
+// ParseCondition converts a rule condition from the settings
+func ParseCondition(value interface{}) (*Condition, error) {
+	cond := new(Condition)
+
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errInvalid("condition")
+	}
+
+	cond.Field, _ = item["field"].(string)
+	cond.Operator, _ = item["op"].(string)
+	cond.Value = toString(item["value"])
+
+	if cond.Field == "" {
+		return nil, errInvalid("condition field")
+	}
+	if cond.Operator == "" {
+		cond.Operator = "=="
+	}
+
+	if cond.Field == "schedule" {
+		switch cond.Operator {
+		case "==", "!=", "in", "not_in":
+		default:
+			return nil, errInvalid("schedule operator " + cond.Operator)
+		}
+	}
+
+	switch cond.Operator {
+	case "==", "!=", "<", "<=", ">", ">=", "contains", "prefix", "suffix":
+	case "in", "not_in":
+		for _, part := range strings.Split(cond.Value, ",") {
+			cond.list = append(cond.list, strings.TrimSpace(part))
+		}
+	case "cidr":
+		_, network, err := net.ParseCIDR(cond.Value)
+		if err != nil {
+			return nil, err
+		}
+		cond.network = network
+	case "matches":
+		pattern, err := regexp.Compile(cond.Value)
+		if err != nil {
+			return nil, err
+		}
+		cond.pattern = pattern
+	case "wildcard":
+		pattern, err := compileWildcard(cond.Value)
+		if err != nil {
+			return nil, err
+		}
+		cond.pattern = pattern
+	case "between":
+		parts := strings.Split(cond.Value, "-")
+		if len(parts) != 2 {
+			return nil, errInvalid("range " + cond.Value)
+		}
+		cond.low = strings.TrimSpace(parts[0])
+		cond.high = strings.TrimSpace(parts[1])
+	default:
+		return nil, errInvalid("operator " + cond.Operator)
+	}
+
+	return cond, nil
+}
+
+// compileWildcard returns a regular expression that matches a whole hostname
+// against a wildcard like *.example.com without case
+func compileWildcard(wildcard string) (*regexp.Regexp, error) {
+	expression := regexp.QuoteMeta(strings.ToLower(wildcard))
+	expression = strings.Replace(expression, `\*`, `.*`, -1)
+	expression = strings.Replace(expression, `\?`, `.`, -1)
+	return regexp.Compile("(?i)^" + expression + "$")
+}
+
+// parseRule converts a rule from the settings. It returns nil without an error for disabled rules.
+func parseRule(value interface{}, index int) (*Rule, error) {
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errInvalid("rule")
+	}
+
+	if enabled, found := item["enabled"].(bool); found && !enabled {
+		return nil, nil
+	}
+
+	rule := &Rule{RuleID: strconv.Itoa(index), Conditions: []*Condition{}}
+	switch id := item["ruleId"].(type) {
+	case string:
+		rule.RuleID = id
+	case float64:
+		rule.RuleID = strconv.Itoa(int(id))
+	}
+	rule.Description, _ = item["description"].(string)
+
+	condSlice, _ := item["conditions"].([]interface{})
+	for _, entry := range condSlice {
+		cond, err := ParseCondition(entry)
+		if err != nil {
+			return nil, err
+		}
+		rule.Conditions = append(rule.Conditions, cond)
+	}
+
+	action, err := parseAction(item["action"])
+	if err != nil {
+		return nil, err
+	}
+	rule.Action = action
+
+	return rule, nil
+}
+
+// parseAction converts a rule action from the settings
+func parseAction(value interface{}) (Action, error) {
+	var action Action
+
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return action, errInvalid("action")
+	}
+
+	action.Type, _ = item["type"].(string)
+	action.Field, _ = item["field"].(string)
+	action.Value = toString(item["value"])
+
+	switch action.Type {
+	case ActionBypass, ActionDrop:
+	case ActionTag:
+		if action.Field == "" {
+			return action, errInvalid("tag field")
+		}
+	case ActionPriority:
+		if _, err := strconv.Atoi(action.Value); err != nil {
+			return action, errInvalid("priority " + action.Value)
+		}
+	case ActionQuota:
+		if action.Value == "" {
+			return action, errInvalid("quota name")
+		}
+	case ActionMirror:
+		if action.Value == "" {
+			return action, errInvalid("mirror target")
+		}
+	default:
+		return action, errInvalid("action type " + action.Type)
+	}
+
+	return action, nil
+}
+
+// parseQuota converts a quota bucket from the settings
+func parseQuota(value interface{}) (*quotaBucket, error) {
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errInvalid("quota")
+	}
+
+	bucket := &quotaBucket{period: "daily"}
+	bucket.name, _ = item["name"].(string)
+	if bucket.name == "" {
+		return nil, errInvalid("quota name")
+	}
+
+	limit, ok := item["limitBytes"].(float64)
+	if !ok || limit <= 0 {
+		return nil, errInvalid("quota limit")
+	}
+	bucket.limitBytes = uint64(limit)
+
+	if period, ok := item["period"].(string); ok && period != "" {
+		bucket.period = period
+	}
+	switch bucket.period {
+	case "hourly", "daily", "weekly", "monthly":
+	default:
+		return nil, errInvalid("quota period " + bucket.period)
+	}
+
+	if item["exceededAction"] != nil {
+		action, err := parseAction(item["exceededAction"])
+		if err != nil {
+			return nil, err
+		}
+		if action.Type == ActionQuota {
+			return nil, errInvalid("quota exceeded action")
+		}
+		bucket.exceeded = action
+	}
+
+	return bucket, nil
+}
+
+// isExceeded returns true if the bucket has used up the limit for the period
+// containing the argumented time. It doesn't change the usage since a dry run
+// can pass any time.
+func (bucket *quotaBucket) isExceeded(now time.Time) bool {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	if !bucket.getPeriodStart(now).Equal(bucket.periodStart) {
+		return false
+	}
+	return bucket.usedBytes >= bucket.limitBytes
+}
+
+// checkPeriod resets the usage when a new period starts. The caller must hold the mutex.
+func (bucket *quotaBucket) checkPeriod(now time.Time) {
+	start := bucket.getPeriodStart(now)
+	if !start.Equal(bucket.periodStart) {
+		bucket.periodStart = start
+		bucket.usedBytes = 0
+	}
+}
+
+// getPeriodStart returns the start of the period containing the argumented time
+func (bucket *quotaBucket) getPeriodStart(now time.Time) time.Time {
+	var start time.Time
+	year, month, day := now.Date()
+
+	switch bucket.period {
+	case "hourly":
+		start = time.Date(year, month, day, now.Hour(), 0, 0, 0, now.Location())
+	case "weekly":
+		start = time.Date(year, month, day-int(now.Weekday()), 0, 0, 0, 0, now.Location())
+	case "monthly":
+		start = time.Date(year, month, 1, 0, 0, 0, 0, now.Location())
+	default:
+		start = time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	}
+
+	return start
+}
+
+// getPolicy returns the active policy
+func getPolicy() *policySet {
+	policyLocker.RLock()
+	defer policyLocker.RUnlock()
+	return currentPolicy
+}
+
+// setPolicy replaces the active policy
+func setPolicy(fresh *policySet) {
+	policyLocker.Lock()
+	currentPolicy = fresh
+	policyLocker.Unlock()
+}
+
+// toString converts a settings value to a string
+func toString(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return value.(string)
+	case float64:
+		return strconv.FormatFloat(value.(float64), 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value.(bool))
+	}
+	return ""
+}
+
+// policyError is returned for invalid policy settings
+type policyError struct {
+	what string
+}
+
+func (e *policyError) Error() string {
+	return "invalid " + e.what
+}
+
+// errInvalid returns an error for an invalid part of the policy
+func errInvalid(what string) error {
+	return &policyError{what: what}
+}
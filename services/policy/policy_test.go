@@ -0,0 +1,179 @@
+package policy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// compileTestPolicy compiles a policy from the argumented settings JSON
+func compileTestPolicy(t *testing.T, text string) *policySet {
+	var item map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &item); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := &policySet{maxPackets: defaultMaxPackets, quotas: make(map[string]*quotaBucket)}
+	if problems := compilePolicy(fresh, item, false); len(problems) != 0 {
+		t.Fatal(problems)
+	}
+	return fresh
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		operator string
+		value    string
+		input    string
+		expected bool
+	}{
+		{"equal", "==", "tcp", "tcp", true},
+		{"not equal", "!=", "tcp", "udp", true},
+		{"less", "<", "1024", "80", true},
+		{"less not number", "<", "1024", "http", false},
+		{"greater equal", ">=", "443", "443", true},
+		{"in", "in", "80, 443", "443", true},
+		{"not in", "not_in", "80, 443", "443", false},
+		{"cidr", "cidr", "192.168.1.0/24", "192.168.1.10", true},
+		{"cidr outside", "cidr", "192.168.1.0/24", "192.168.2.10", false},
+		{"cidr not address", "cidr", "192.168.1.0/24", "host", false},
+		{"contains", "contains", "tube", "youtube", true},
+		{"prefix", "prefix", "you", "youtube", true},
+		{"suffix", "suffix", "tube", "youtube", true},
+		{"matches", "matches", "^you.*e$", "youtube", true},
+		{"between", "between", "08:00-17:00", "12:30", true},
+		{"between end", "between", "08:00-17:00", "17:00", false},
+		{"between wrap", "between", "22:00-06:00", "23:15", true},
+		{"between wrap outside", "between", "22:00-06:00", "12:00", false},
+	}
+
+	for _, test := range tests {
+		cond, err := ParseCondition(map[string]interface{}{"field": "test", "op": test.operator, "value": test.value})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if cond.Matches(test.input) != test.expected {
+			t.Errorf("%s: %q matched %v, expected %v", test.name, test.input, !test.expected, test.expected)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	current := compileTestPolicy(t, `{
+		"rules": [
+			{"ruleId": "tag-web", "conditions": [{"field": "server_port", "op": "in", "value": "80,443"}], "action": {"type": "tag", "field": "class", "value": "web"}},
+			{"ruleId": "disabled", "enabled": false, "conditions": [], "action": {"type": "drop"}},
+			{"ruleId": "block-app", "conditions": [{"field": "application_name", "value": "BitTorrent"}], "action": {"type": "drop"}},
+			{"ruleId": "bypass-lan", "conditions": [{"field": "server_address", "op": "cidr", "value": "10.0.0.0/8"}], "action": {"type": "bypass"}},
+			{"ruleId": "priority", "conditions": [], "action": {"type": "priority", "value": 3}}
+		]
+	}`)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		values    map[string]string
+		start     int
+		final     bool
+		decisions []string
+		next      int
+		pending   bool
+		finished  bool
+	}{
+		{"waiting for application", map[string]string{"server_port": "443"}, 0, false, []string{"tag-web"}, 1, true, false},
+		{"continue after application", map[string]string{"application_name": "HTTP", "server_address": "8.8.8.8"}, 1, false, []string{"priority"}, 4, false, false},
+		{"drop stops evaluation", map[string]string{"server_port": "6881", "application_name": "BitTorrent"}, 0, false, []string{"block-app"}, 4, false, true},
+		{"bypass stops evaluation", map[string]string{"server_port": "80", "application_name": "HTTP", "server_address": "10.1.2.3"}, 0, false, []string{"tag-web", "bypass-lan"}, 4, false, true},
+		{"final ignores unknown", map[string]string{"server_port": "22"}, 0, true, []string{"priority"}, 4, false, false},
+	}
+
+	for _, test := range tests {
+		fields := func(name string) (string, bool) {
+			value, found := test.values[name]
+			return value, found
+		}
+
+		result := current.evaluate(test.start, fields, now, test.final, false)
+
+		var decisions []string
+		for _, decision := range result.Decisions {
+			decisions = append(decisions, decision.RuleID)
+		}
+		if !reflect.DeepEqual(decisions, test.decisions) {
+			t.Errorf("%s: decisions %v, expected %v", test.name, decisions, test.decisions)
+		}
+		if result.Next != test.next || result.Pending != test.pending || result.Finished != test.finished {
+			t.Errorf("%s: next %d pending %v finished %v, expected %d %v %v", test.name, result.Next, result.Pending, result.Finished, test.next, test.pending, test.finished)
+		}
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	current := compileTestPolicy(t, `{
+		"quotas": [{"name": "guest", "limitBytes": 1000, "period": "daily", "exceededAction": {"type": "priority", "value": 7}}],
+		"rules": [{"ruleId": "guest", "conditions": [], "action": {"type": "quota", "value": "guest"}}]
+	}`)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	fields := func(name string) (string, bool) { return "", false }
+
+	bucket := current.quotas["guest"]
+	bucket.periodStart = bucket.getPeriodStart(now)
+	bucket.usedBytes = 1000
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		exceeded bool
+		action   string
+	}{
+		{"same day", now.Add(time.Hour), true, ActionPriority},
+		{"next day", now.Add(24 * time.Hour), false, ActionQuota},
+	}
+
+	for _, test := range tests {
+		result := current.evaluate(0, fields, test.now, true, false)
+		if len(result.Decisions) != 1 {
+			t.Errorf("%s: %d decisions, expected 1", test.name, len(result.Decisions))
+			continue
+		}
+		decision := result.Decisions[0]
+		if decision.Quota != "guest" || decision.QuotaExceeded != test.exceeded || decision.Action.Type != test.action {
+			t.Errorf("%s: got %+v, expected exceeded %v with %s", test.name, decision, test.exceeded, test.action)
+		}
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	tests := []struct {
+		name     string
+		wildcard string
+		input    string
+		expected bool
+	}{
+		{"exact", "www.example.com", "www.example.com", true},
+		{"subdomain", "*.example.com", "www.example.com", true},
+		{"bare domain", "*.example.com", "example.com", false},
+		{"case", "*.Example.COM", "WWW.example.com", true},
+		{"dot is literal", "www.example.com", "wwwxexample.com", false},
+		{"whole name", "example.com", "example.com.evil.net", false},
+		{"single character", "cdn?.example.com", "cdn1.example.com", true},
+		{"single character missing", "cdn?.example.com", "cdn.example.com", false},
+		{"any name in list", "*.googlevideo.com", "www.google.com|r1.googlevideo.com", true},
+		{"no name in list", "*.googlevideo.com", "www.google.com|google.com", false},
+		{"issuer", "Let's Encrypt*", "Let's Encrypt Authority X3", true},
+	}
+
+	for _, test := range tests {
+		cond, err := ParseCondition(map[string]interface{}{"field": "certificate_names", "op": "wildcard", "value": test.wildcard})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if cond.Matches(test.input) != test.expected {
+			t.Errorf("%s: %q matched %q %v, expected %v", test.name, test.wildcard, test.input, !test.expected, test.expected)
+		}
+	}
+}
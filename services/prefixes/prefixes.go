@@ -0,0 +1,573 @@
+// Package prefixes watches the IPv6 prefixes delegated to the WAN interfaces.
+// On OpenWrt odhcp6c hands the delegated prefixes to netifd, which reports
+// them in the ipv6-prefix section of the interface dump along with the part
+// assigned to each LAN. The dump is read at an interval and every prefix that
+// appears or goes away is logged to the prefix_events table and published on
+// the event bus. When an interface loses a prefix and gets a new one at the
+// same time the ISP has renumbered the network, and the addresses inside the
+// old prefix are moved to the new one in the settings paths we are told to
+// keep up to date, which by default is the network interfaces so the LAN
+// addresses and router advertisements follow the new prefix. Other paths,
+// like the rules that match the LAN prefix, can be added in the settings.
+package prefixes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+const serviceName = "prefixes"
+
+// the defaults used when the prefixes settings are missing
+const defaultIntervalSeconds = 30
+
+// the number of prefix changes kept for the status
+const maxChanges = 50
+
+// The prefix events
+const (
+	EventAdded      = "added"
+	EventRemoved    = "removed"
+	EventRenumbered = "renumbered"
+)
+
+// the settings paths rewritten on a renumbering when the settings have none
+var defaultRewritePaths = [][]string{{"network", "interfaces"}}
+
+// the command that dumps the netifd interfaces and the file used when there is no ubus
+var ubusCommand = []string{"/bin/ubus", "call", "network.interface", "dump"}
+var interfacesFile = "/etc/config/interfaces.json"
+
+// Prefix holds a prefix delegated to an interface and the parts of it
+// assigned to the LAN interfaces
+type Prefix struct {
+	Interface string            `json:"interface"`
+	Device    string            `json:"device"`
+	Prefix    string            `json:"prefix"`
+	Preferred int64             `json:"preferred"`
+	Valid     int64             `json:"valid"`
+	Assigned  map[string]string `json:"assigned"`
+	Since     time.Time         `json:"since"`
+}
+
+// Change holds a prefix that was added to or removed from an interface, or
+// the old and new prefix of a renumbering
+type Change struct {
+	Time      time.Time `json:"time"`
+	Interface string    `json:"interface"`
+	Event     string    `json:"event"`
+	OldPrefix string    `json:"oldPrefix,omitempty"`
+	NewPrefix string    `json:"newPrefix,omitempty"`
+	Rewritten []string  `json:"rewritten,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Status holds the current prefixes and the recent changes
+type Status struct {
+	Enabled   bool      `json:"enabled"`
+	Rewrite   bool      `json:"rewrite"`
+	Prefixes  []Prefix  `json:"prefixes"`
+	Changes   []Change  `json:"changes"`
+	LastCheck time.Time `json:"lastCheck"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// prefixConfig holds the prefixes settings
+type prefixConfig struct {
+	enabled      bool
+	rewrite      bool
+	interval     time.Duration
+	rewritePaths [][]string
+}
+
+var config prefixConfig
+var prefixTable = make(map[string]*Prefix)
+var changeList []Change
+var lastCheck time.Time
+var lastError string
+var loaded bool
+var prefixLocker sync.Mutex
+var reloadChannel = make(chan bool, 1)
+var shutdownChannel = make(chan bool)
+var checkWaiter sync.WaitGroup
+
+// init registers the prefix events table with the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "prefix_events",
+		Owner: serviceName,
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "interface", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "event", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "old_prefix", Type: "text"},
+			{Name: "new_prefix", Type: "text"},
+			{Name: "rewritten", Type: "text"},
+		},
+		TrimPercent: .1,
+	})
+}
+
+// Startup is called to handle service startup
+func Startup() {
+	loadSettings()
+	checkWaiter.Add(1)
+	go checkTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	close(shutdownChannel)
+	checkWaiter.Wait()
+}
+
+// Reload loads the prefixes settings and checks the prefixes right away
+func Reload() {
+	loadSettings()
+	select {
+	case reloadChannel <- true:
+	default:
+	}
+}
+
+// GetStatus returns the current prefixes and the recent changes
+func GetStatus() Status {
+	prefixLocker.Lock()
+	defer prefixLocker.Unlock()
+
+	status := Status{
+		Enabled:   config.enabled,
+		Rewrite:   config.rewrite,
+		Prefixes:  []Prefix{},
+		Changes:   append([]Change{}, changeList...),
+		LastCheck: lastCheck,
+		Error:     lastError,
+	}
+	for _, item := range prefixTable {
+		status.Prefixes = append(status.Prefixes, *item)
+	}
+	sort.Slice(status.Prefixes, func(i, j int) bool {
+		if status.Prefixes[i].Interface != status.Prefixes[j].Interface {
+			return status.Prefixes[i].Interface < status.Prefixes[j].Interface
+		}
+		return status.Prefixes[i].Prefix < status.Prefixes[j].Prefix
+	})
+	return status
+}
+
+// GetPrefixes returns the prefixes currently delegated to an interface, or
+// to every interface when the name is empty
+func GetPrefixes(name string) []*net.IPNet {
+	var list []*net.IPNet
+
+	prefixLocker.Lock()
+	defer prefixLocker.Unlock()
+
+	for _, item := range prefixTable {
+		if name != "" && item.Interface != name {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(item.Prefix); err == nil {
+			list = append(list, network)
+		}
+	}
+	return list
+}
+
+// loadSettings loads the prefixes settings
+func loadSettings() {
+	fresh := prefixConfig{
+		enabled:      true,
+		rewrite:      true,
+		interval:     defaultIntervalSeconds * time.Second,
+		rewritePaths: defaultRewritePaths,
+	}
+
+	prefixJSON, err := settings.GetCurrentSettings([]string{"prefixes"})
+	if prefixJSON != nil && err == nil {
+		item, ok := prefixJSON.(map[string]interface{})
+		if ok {
+			if value, ok := item["enabled"].(bool); ok {
+				fresh.enabled = value
+			}
+			if value, ok := item["rewrite"].(bool); ok {
+				fresh.rewrite = value
+			}
+			if value, ok := item["intervalSeconds"].(float64); ok && value > 0 {
+				fresh.interval = time.Duration(value) * time.Second
+			}
+			if list, ok := item["rewritePaths"].([]interface{}); ok {
+				fresh.rewritePaths = parsePaths(list)
+			}
+		} else {
+			logger.Warn("Invalid prefixes settings: %T\n", prefixJSON)
+		}
+	}
+
+	prefixLocker.Lock()
+	config = fresh
+	prefixLocker.Unlock()
+
+	logger.Info("Loaded prefixes settings enabled:%v rewrite:%v interval:%v paths:%v\n", fresh.enabled, fresh.rewrite, fresh.interval, fresh.rewritePaths)
+}
+
+// parsePaths parses the list of settings paths to rewrite. Each path is a
+// slash separated string like network/interfaces.
+func parsePaths(list []interface{}) [][]string {
+	var paths [][]string
+
+	for _, entry := range list {
+		text, ok := entry.(string)
+		if !ok || strings.Trim(text, "/") == "" {
+			logger.Warn("Invalid prefixes rewrite path %v\n", entry)
+			continue
+		}
+		paths = append(paths, strings.Split(strings.Trim(text, "/"), "/"))
+	}
+
+	return paths
+}
+
+// checkTask checks the prefixes at the configured interval
+func checkTask() {
+	defer checkWaiter.Done()
+
+	for {
+		prefixLocker.Lock()
+		enabled := config.enabled
+		delay := config.interval
+		prefixLocker.Unlock()
+
+		if enabled {
+			checkPrefixes()
+		}
+
+		select {
+		case <-shutdownChannel:
+			return
+		case <-reloadChannel:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// checkPrefixes reads the delegated prefixes and records the changes. The
+// first check after startup only loads the prefixes since we don't know what
+// they were while packetd was not running.
+func checkPrefixes() {
+	now := time.Now()
+	current, err := readPrefixes()
+
+	prefixLocker.Lock()
+	lastCheck = now
+	if err != nil {
+		lastError = err.Error()
+		prefixLocker.Unlock()
+		logger.Warn("%OC|Unable to read the IPv6 prefixes: %v\n", "prefixes_read_failure", 10, err)
+		return
+	}
+	lastError = ""
+
+	previous := prefixTable
+	for key, item := range current {
+		if old, found := previous[key]; found {
+			item.Since = old.Since
+		} else {
+			item.Since = now
+		}
+	}
+	prefixTable = current
+	first := !loaded
+	loaded = true
+	rewrite := config.rewrite
+	paths := config.rewritePaths
+	prefixLocker.Unlock()
+
+	if first {
+		logger.Info("Found %d delegated IPv6 prefixes\n", len(current))
+		return
+	}
+
+	for _, change := range findChanges(previous, current) {
+		change.Time = now
+		if change.Event == EventRenumbered && rewrite {
+			change.Rewritten, err = rewriteSettings(paths, change.OldPrefix, change.NewPrefix)
+			if err != nil {
+				change.Error = err.Error()
+			}
+		}
+		recordChange(change)
+	}
+}
+
+// findChanges compares the old and new prefixes of each interface. An
+// interface that lost one prefix and gained one has been renumbered, and
+// the other prefixes that come and go are logged on their own.
+func findChanges(previous map[string]*Prefix, current map[string]*Prefix) []Change {
+	var list []Change
+	removed := make(map[string][]string)
+	added := make(map[string][]string)
+
+	for key, item := range previous {
+		if _, found := current[key]; !found {
+			removed[item.Interface] = append(removed[item.Interface], item.Prefix)
+		}
+	}
+	for key, item := range current {
+		if _, found := previous[key]; !found {
+			added[item.Interface] = append(added[item.Interface], item.Prefix)
+		}
+	}
+
+	for name, oldList := range removed {
+		newList := added[name]
+		if len(oldList) == 1 && len(newList) == 1 {
+			list = append(list, Change{Interface: name, Event: EventRenumbered, OldPrefix: oldList[0], NewPrefix: newList[0]})
+			delete(added, name)
+			continue
+		}
+		for _, prefix := range oldList {
+			list = append(list, Change{Interface: name, Event: EventRemoved, OldPrefix: prefix})
+		}
+	}
+	for name, newList := range added {
+		for _, prefix := range newList {
+			list = append(list, Change{Interface: name, Event: EventAdded, NewPrefix: prefix})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Interface != list[j].Interface {
+			return list[i].Interface < list[j].Interface
+		}
+		return list[i].OldPrefix+list[i].NewPrefix < list[j].OldPrefix+list[j].NewPrefix
+	})
+	return list
+}
+
+// recordChange adds a change to the status and logs it to the prefix events
+// table and the event bus
+func recordChange(change Change) {
+	prefixLocker.Lock()
+	changeList = append(changeList, change)
+	if len(changeList) > maxChanges {
+		changeList = changeList[len(changeList)-maxChanges:]
+	}
+	prefixLocker.Unlock()
+
+	overseer.AddCounter("prefixes_"+change.Event, 1)
+	logger.Notice("IPv6 prefix %s on %s old:%s new:%s rewritten:%v\n", change.Event, change.Interface, change.OldPrefix, change.NewPrefix, change.Rewritten)
+
+	eventbus.Publish(eventbus.TopicPrefixChange, serviceName, map[string]interface{}{
+		"interface": change.Interface,
+		"event":     change.Event,
+		"oldPrefix": change.OldPrefix,
+		"newPrefix": change.NewPrefix,
+		"rewritten": change.Rewritten,
+		"error":     change.Error,
+	})
+
+	columns := map[string]interface{}{
+		"time_stamp": change.Time,
+		"interface":  change.Interface,
+		"event":      change.Event,
+		"old_prefix": change.OldPrefix,
+		"new_prefix": change.NewPrefix,
+		"rewritten":  strings.Join(change.Rewritten, ","),
+	}
+	reports.LogEvent(reports.CreateEvent("prefix_"+change.Event, "prefix_events", 1, columns, nil))
+}
+
+// readPrefixes returns the delegated prefixes from the netifd interface dump.
+// The dump comes from ubus on OpenWrt, otherwise from the interfaces file.
+func readPrefixes() (map[string]*Prefix, error) {
+	var dump map[string]interface{}
+
+	data, err := exec.Command(ubusCommand[0], ubusCommand[1:]...).Output()
+	if err != nil {
+		var ferr error
+		data, ferr = ioutil.ReadFile(interfacesFile)
+		if ferr != nil {
+			return nil, err
+		}
+	}
+
+	if err = json.Unmarshal(data, &dump); err != nil {
+		return nil, err
+	}
+
+	list, ok := dump["interface"].([]interface{})
+	if !ok {
+		return nil, errors.New("missing interface object in the interface dump")
+	}
+
+	table := make(map[string]*Prefix)
+	for _, raw := range list {
+		item, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := item["interface"].(string)
+		device, _ := item["l3_device"].(string)
+		if device == "" {
+			device, _ = item["device"].(string)
+		}
+
+		prefixList, _ := item["ipv6-prefix"].([]interface{})
+		for _, entry := range prefixList {
+			prefix := parsePrefix(entry)
+			if prefix == nil {
+				continue
+			}
+			prefix.Interface = name
+			prefix.Device = device
+			table[name+"|"+prefix.Prefix] = prefix
+		}
+	}
+
+	return table, nil
+}
+
+// parsePrefix parses an ipv6-prefix object from the interface dump
+func parsePrefix(entry interface{}) *Prefix {
+	item, ok := entry.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	address, _ := item["address"].(string)
+	mask, _ := item["mask"].(float64)
+	_, network, err := net.ParseCIDR(fmt.Sprintf("%s/%d", address, int(mask)))
+	if err != nil || network.IP.To4() != nil {
+		return nil
+	}
+
+	prefix := &Prefix{Prefix: network.String(), Assigned: make(map[string]string)}
+	if value, ok := item["preferred"].(float64); ok {
+		prefix.Preferred = int64(value)
+	}
+	if value, ok := item["valid"].(float64); ok {
+		prefix.Valid = int64(value)
+	}
+
+	assigned, _ := item["assigned"].(map[string]interface{})
+	for lan, raw := range assigned {
+		part, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		address, _ := part["address"].(string)
+		mask, _ := part["mask"].(float64)
+		prefix.Assigned[lan] = fmt.Sprintf("%s/%d", address, int(mask))
+	}
+
+	return prefix
+}
+
+// rewriteSettings moves the addresses inside the old prefix to the new prefix
+// in each of the settings paths. The part of the address after the old prefix
+// is kept so a LAN that used the second /64 of the old prefix uses the second
+// /64 of the new one. It returns the paths that were changed.
+func rewriteSettings(paths [][]string, oldPrefix string, newPrefix string) ([]string, error) {
+	var changed []string
+
+	_, oldNet, err := net.ParseCIDR(oldPrefix)
+	if err != nil {
+		return nil, err
+	}
+	_, newNet, err := net.ParseCIDR(newPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		current, err := settings.GetSettings(path)
+		if err != nil {
+			return changed, fmt.Errorf("unable to read %s: %v", strings.Join(path, "/"), err)
+		}
+
+		fresh, count := rewriteValue(current, oldNet, newNet)
+		if count == 0 {
+			continue
+		}
+
+		if _, err = settings.SetSettings(path, fresh); err != nil {
+			return changed, fmt.Errorf("unable to save %s: %v", strings.Join(path, "/"), err)
+		}
+
+		logger.Notice("Moved %d addresses in %s from %s to %s\n", count, strings.Join(path, "/"), oldPrefix, newPrefix)
+		changed = append(changed, strings.Join(path, "/"))
+	}
+
+	return changed, nil
+}
+
+// rewriteValue walks a settings value and returns a copy with the addresses
+// and networks inside the old prefix moved to the new prefix, along with the
+// number of values that were changed
+func rewriteValue(value interface{}, oldNet *net.IPNet, newNet *net.IPNet) (interface{}, int) {
+	switch item := value.(type) {
+	case map[string]interface{}:
+		total := 0
+		fresh := make(map[string]interface{}, len(item))
+		for key, entry := range item {
+			var count int
+			fresh[key], count = rewriteValue(entry, oldNet, newNet)
+			total += count
+		}
+		return fresh, total
+	case []interface{}:
+		total := 0
+		fresh := make([]interface{}, len(item))
+		for index, entry := range item {
+			var count int
+			fresh[index], count = rewriteValue(entry, oldNet, newNet)
+			total += count
+		}
+		return fresh, total
+	case string:
+		if text, ok := rewriteAddress(item, oldNet, newNet); ok {
+			return text, 1
+		}
+	}
+	return value, 0
+}
+
+// rewriteAddress moves an IPv6 address or network inside the old prefix to
+// the new prefix. It returns false for anything else.
+func rewriteAddress(text string, oldNet *net.IPNet, newNet *net.IPNet) (string, bool) {
+	address := text
+	suffix := ""
+	if index := strings.IndexByte(text, '/'); index >= 0 {
+		address = text[:index]
+		suffix = text[index:]
+	}
+
+	if !strings.Contains(address, ":") {
+		return text, false
+	}
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() != nil || !oldNet.Contains(ip) {
+		return text, false
+	}
+
+	moved := make(net.IP, net.IPv6len)
+	for index := range moved {
+		moved[index] = newNet.IP[index] | (ip[index] &^ oldNet.Mask[index])
+	}
+	return moved.String() + suffix, true
+}
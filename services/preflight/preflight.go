@@ -0,0 +1,202 @@
+// Package preflight checks the things packetd needs from the system when it
+// starts, like the nft binary, the dict kernel module, free nfqueue numbers,
+// and a writable reports database directory. Each check that fails records an
+// error and the action that fixes it, and the results are kept for the health
+// API so a broken install can be diagnosed without reading through the logs.
+package preflight
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// the file that lists the nfqueue numbers bound by a process
+const nfqueueProcFile = "/proc/net/netfilter/nfnetlink_queue"
+
+// Check describes a startup check. Run returns nil when the check passes and
+// Action tells the user how to fix the problem when it doesn't.
+type Check struct {
+	Name   string
+	Run    func() error
+	Action string
+}
+
+// Result holds the result of a startup check
+type Result struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+	Action string `json:"action,omitempty"`
+}
+
+// Status holds the results of the startup checks and the names of the ones that failed
+type Status struct {
+	Healthy bool      `json:"healthy"`
+	Time    time.Time `json:"time"`
+	Failed  []string  `json:"failed"`
+	Checks  []Result  `json:"checks"`
+}
+
+var resultList []Result
+var resultTime time.Time
+var resultMutex sync.Mutex
+
+// Run runs the argumented checks in order, keeps the results for the health
+// API, and returns the number of checks that failed
+func Run(checks []Check) int {
+	var failed []string
+	results := make([]Result, 0, len(checks))
+
+	for _, check := range checks {
+		result := Result{Name: check.Name, Passed: true}
+		if err := check.Run(); err != nil {
+			result.Passed = false
+			result.Error = err.Error()
+			result.Action = check.Action
+			failed = append(failed, check.Name)
+			logger.Debug("Startup check %s failed: %v\n", check.Name, err)
+		}
+		results = append(results, result)
+	}
+
+	resultMutex.Lock()
+	resultList = results
+	resultTime = time.Now()
+	resultMutex.Unlock()
+
+	if len(failed) != 0 {
+		logger.Err("Startup checks failed: %s - see /api/status/health for details\n", strings.Join(failed, ", "))
+	} else {
+		logger.Info("Startup checks passed: %d\n", len(results))
+	}
+
+	return len(failed)
+}
+
+// GetStatus returns the results of the startup checks
+func GetStatus() Status {
+	resultMutex.Lock()
+	defer resultMutex.Unlock()
+
+	status := Status{Healthy: true, Time: resultTime, Failed: []string{}}
+	status.Checks = make([]Result, len(resultList))
+	copy(status.Checks, resultList)
+
+	for _, result := range resultList {
+		if !result.Passed {
+			status.Healthy = false
+			status.Failed = append(status.Failed, result.Name)
+		}
+	}
+
+	return status
+}
+
+// Binary returns a check function that passes if the named binary is in the path
+func Binary(name string) func() error {
+	return func() error {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Errorf("%s not found in PATH", name)
+		}
+		return nil
+	}
+}
+
+// Executable returns a check function that passes if the file is executable
+func Executable(filename string) func() error {
+	return func() error {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Mode()&0111 == 0 {
+			return fmt.Errorf("%s is not executable", filename)
+		}
+		return nil
+	}
+}
+
+// Exists returns a check function that passes if the path exists
+func Exists(path string) func() error {
+	return func() error {
+		_, err := os.Stat(path)
+		return err
+	}
+}
+
+// FileValue returns a check function that passes if the file holds the value,
+// which is how the kernel settings in /proc/sys are checked
+func FileValue(filename string, value string) func() error {
+	return func() error {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if found := strings.TrimSpace(string(data)); found != value {
+			return fmt.Errorf("%s is %s instead of %s", filename, found, value)
+		}
+		return nil
+	}
+}
+
+// Writable returns a check function that passes if a file can be created in the directory
+func Writable(directory string) func() error {
+	return func() error {
+		file, err := ioutil.TempFile(directory, ".packetd-check-")
+		if err != nil {
+			return err
+		}
+		file.Close()
+		os.Remove(file.Name())
+		return nil
+	}
+}
+
+// QueuesFree returns a check function that passes if no process has bound
+// any of the count nfqueue numbers starting at first. The queues are checked
+// before the kernel callbacks bind them, so anything bound is someone else.
+func QueuesFree(first int, count int) func() error {
+	return func() error {
+		file, err := os.Open(nfqueueProcFile)
+		// the file only exists once the nfnetlink_queue module is loaded, and
+		// nothing can have bound a queue before that
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		var busy []string
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			queue, err := strconv.Atoi(fields[0])
+			if err != nil || queue < first || queue >= first+count {
+				continue
+			}
+			busy = append(busy, fmt.Sprintf("%d (port %s)", queue, fields[1]))
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+
+		if len(busy) != 0 {
+			return fmt.Errorf("queues already bound: %s", strings.Join(busy, ", "))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,484 @@
+// Package profiler captures short CPU and heap profiles of packetd on a
+// schedule and when the CPU usage of the process goes over a threshold, so a
+// transient performance problem can be looked at after it is gone. The
+// profiles are written in the pprof format, which go tool pprof -http and
+// speedscope show as flame graphs, and the oldest are removed once the limit
+// from the settings is reached. The profiler is disabled by default and a
+// profile can always be captured on demand.
+package profiler
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the profiler settings are missing
+const defaultDirectory = "/tmp/packetd-profiles"
+const defaultMaxProfiles = 20
+const defaultIntervalSeconds = 3600
+const defaultCPUSeconds = 10
+const defaultCheckSeconds = 10
+const defaultCooldownSeconds = 600
+
+// the file name suffix of the profiles
+const profileSuffix = ".pprof"
+
+// the longest CPU profile we will capture
+const maxCPUSeconds = 120
+
+// The reasons a profile is captured
+const (
+	ReasonSchedule = "schedule"
+	ReasonCPU      = "cpu"
+	ReasonManual   = "manual"
+)
+
+// Profile holds the details of a saved profile
+type Profile struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+	Size   int64     `json:"size"`
+}
+
+// Status holds the profiler settings, the last CPU usage, and the saved profiles
+type Status struct {
+	Enabled         bool      `json:"enabled"`
+	Directory       string    `json:"directory"`
+	IntervalSeconds int       `json:"intervalSeconds"`
+	CPUSeconds      int       `json:"cpuSeconds"`
+	CPUThreshold    float64   `json:"cpuThreshold"`
+	CPUUsage        float64   `json:"cpuUsage"`
+	Capturing       bool      `json:"capturing"`
+	Profiles        []Profile `json:"profiles"`
+}
+
+// profilerConfig holds the profiler settings
+type profilerConfig struct {
+	enabled      bool
+	directory    string
+	maxProfiles  int
+	interval     time.Duration
+	cpuSeconds   int
+	cpuThreshold float64
+	check        time.Duration
+	cooldown     time.Duration
+}
+
+var config = profilerConfig{directory: defaultDirectory, maxProfiles: defaultMaxProfiles, interval: defaultIntervalSeconds * time.Second,
+	cpuSeconds: defaultCPUSeconds, check: defaultCheckSeconds * time.Second, cooldown: defaultCooldownSeconds * time.Second}
+var profilerLocker sync.Mutex
+var capturing bool
+var cpuUsage float64
+var reloadChannel = make(chan bool, 1)
+var shutdownChannel = make(chan bool)
+var profileWaiter sync.WaitGroup
+var validID = regexp.MustCompile(`^(cpu|heap)-[0-9]{8}-[0-9]{6}\.[0-9]{6}-(schedule|cpu|manual)$`)
+
+// Startup is called to handle service startup
+func Startup() {
+	loadSettings()
+	profileWaiter.Add(1)
+	go profileTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	close(shutdownChannel)
+	profileWaiter.Wait()
+}
+
+// Reload loads the profiler settings
+func Reload() {
+	loadSettings()
+	select {
+	case reloadChannel <- true:
+	default:
+	}
+}
+
+// Capture saves a CPU profile of the argumented length followed by a heap
+// profile, using the length from the settings when it is zero. Only one
+// capture can run at a time. It returns the saved profiles.
+func Capture(reason string, seconds int) ([]Profile, error) {
+	profilerLocker.Lock()
+	if capturing {
+		profilerLocker.Unlock()
+		return nil, errors.New("a profile capture is already running")
+	}
+	capturing = true
+	current := config
+	profilerLocker.Unlock()
+
+	defer func() {
+		profilerLocker.Lock()
+		capturing = false
+		profilerLocker.Unlock()
+	}()
+
+	if seconds <= 0 {
+		seconds = current.cpuSeconds
+	}
+	if seconds > maxCPUSeconds {
+		seconds = maxCPUSeconds
+	}
+
+	err := os.MkdirAll(current.directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Capturing %d second profile reason:%s\n", seconds, reason)
+
+	var list []Profile
+	profile, err := captureCPU(current.directory, reason, time.Duration(seconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	list = append(list, *profile)
+
+	profile, err = captureHeap(current.directory, reason)
+	if err != nil {
+		return list, err
+	}
+	list = append(list, *profile)
+
+	overseer.AddCounter("profiles_captured", 1)
+	removeOldProfiles(current)
+	return list, nil
+}
+
+// List returns every saved profile with the most recent first
+func List() []Profile {
+	list := []Profile{}
+
+	profilerLocker.Lock()
+	directory := config.directory
+	profilerLocker.Unlock()
+
+	for _, id := range getProfileIDs(directory) {
+		info, err := os.Stat(filepath.Join(directory, id+profileSuffix))
+		if err != nil {
+			continue
+		}
+		list = append(list, makeProfile(id, info))
+	}
+
+	return list
+}
+
+// GetFilename returns the file that holds the profile with the argumented id
+func GetFilename(id string) (string, error) {
+	if !validID.MatchString(id) {
+		return "", fmt.Errorf("invalid profile id: %s", id)
+	}
+
+	profilerLocker.Lock()
+	directory := config.directory
+	profilerLocker.Unlock()
+
+	filename := filepath.Join(directory, id+profileSuffix)
+	_, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// Clear removes every saved profile and returns the number removed
+func Clear() int {
+	var counter int
+
+	profilerLocker.Lock()
+	directory := config.directory
+	profilerLocker.Unlock()
+
+	for _, id := range getProfileIDs(directory) {
+		if os.Remove(filepath.Join(directory, id+profileSuffix)) == nil {
+			counter++
+		}
+	}
+
+	logger.Info("Removed %d profiles\n", counter)
+	return counter
+}
+
+// GetStatus returns the profiler settings, the last CPU usage, and the saved profiles
+func GetStatus() Status {
+	profilerLocker.Lock()
+	current := config
+	status := Status{
+		Enabled:         current.enabled,
+		Directory:       current.directory,
+		IntervalSeconds: int(current.interval / time.Second),
+		CPUSeconds:      current.cpuSeconds,
+		CPUThreshold:    current.cpuThreshold,
+		CPUUsage:        cpuUsage,
+		Capturing:       capturing,
+	}
+	profilerLocker.Unlock()
+
+	status.Profiles = List()
+	return status
+}
+
+// loadSettings loads the profiler settings
+func loadSettings() {
+	fresh := profilerConfig{directory: defaultDirectory, maxProfiles: defaultMaxProfiles, interval: defaultIntervalSeconds * time.Second,
+		cpuSeconds: defaultCPUSeconds, check: defaultCheckSeconds * time.Second, cooldown: defaultCooldownSeconds * time.Second}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"profiler"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid profiler settings: %T\n", configJSON)
+		} else {
+			if value, ok := item["enabled"].(bool); ok {
+				fresh.enabled = value
+			}
+			if value, ok := item["directory"].(string); ok && value != "" {
+				fresh.directory = value
+			}
+			if value, ok := item["maxProfiles"].(float64); ok && value > 0 {
+				fresh.maxProfiles = int(value)
+			}
+			if value, ok := item["intervalSeconds"].(float64); ok && value >= 0 {
+				fresh.interval = time.Duration(value) * time.Second
+			}
+			if value, ok := item["cpuSeconds"].(float64); ok && value > 0 {
+				fresh.cpuSeconds = int(value)
+			}
+			if value, ok := item["cpuThreshold"].(float64); ok && value >= 0 {
+				fresh.cpuThreshold = value
+			}
+			if value, ok := item["checkSeconds"].(float64); ok && value > 0 {
+				fresh.check = time.Duration(value) * time.Second
+			}
+			if value, ok := item["cooldownSeconds"].(float64); ok && value >= 0 {
+				fresh.cooldown = time.Duration(value) * time.Second
+			}
+		}
+	}
+
+	profilerLocker.Lock()
+	config = fresh
+	profilerLocker.Unlock()
+
+	logger.Info("Loaded profiler settings enabled:%v interval:%v cpuSeconds:%d cpuThreshold:%.1f directory:%s\n", fresh.enabled, fresh.interval, fresh.cpuSeconds, fresh.cpuThreshold, fresh.directory)
+}
+
+// profileTask checks the CPU usage at the configured interval and captures
+// the profiles when the usage goes over the threshold or the schedule is due.
+// A zero interval or threshold disables that trigger, and after a capture
+// the CPU trigger waits for the cooldown so a busy system isn't profiled
+// over and over.
+func profileTask() {
+	defer profileWaiter.Done()
+
+	lastUsage, lastTime := getProcessTime(), time.Now()
+	lastScheduled := time.Now()
+	var lastTriggered time.Time
+
+	for {
+		profilerLocker.Lock()
+		current := config
+		profilerLocker.Unlock()
+
+		select {
+		case <-shutdownChannel:
+			return
+		case <-reloadChannel:
+			continue
+		case <-time.After(current.check):
+		}
+
+		usage, now := getProcessTime(), time.Now()
+		percent := 0.0
+		if elapsed := now.Sub(lastTime); elapsed > 0 {
+			percent = 100.0 * float64(usage-lastUsage) / float64(elapsed) / float64(runtime.NumCPU())
+		}
+		lastUsage, lastTime = usage, now
+
+		profilerLocker.Lock()
+		cpuUsage = percent
+		profilerLocker.Unlock()
+
+		if !current.enabled {
+			continue
+		}
+
+		reason := ""
+		if current.cpuThreshold > 0 && percent >= current.cpuThreshold && now.Sub(lastTriggered) >= current.cooldown {
+			logger.Notice("CPU usage %.1f%% is over the profiler threshold %.1f%%\n", percent, current.cpuThreshold)
+			reason = ReasonCPU
+			lastTriggered = now
+		} else if current.interval > 0 && now.Sub(lastScheduled) >= current.interval {
+			reason = ReasonSchedule
+		}
+		if reason == "" {
+			continue
+		}
+		lastScheduled = now
+
+		_, err := Capture(reason, 0)
+		if err != nil {
+			logger.Warn("Unable to capture the %s profile: %v\n", reason, err)
+		}
+
+		// the capture uses the CPU so it isn't counted for the next check
+		lastUsage, lastTime = getProcessTime(), time.Now()
+	}
+}
+
+// captureCPU writes a CPU profile of the argumented length
+func captureCPU(directory string, reason string, length time.Duration) (*Profile, error) {
+	id := makeProfileID("cpu", reason)
+	file, err := createProfile(directory, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// this fails when a profile is running from /pprof/profile
+	err = pprof.StartCPUProfile(file)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	select {
+	case <-shutdownChannel:
+	case <-time.After(length):
+	}
+	pprof.StopCPUProfile()
+
+	return finishProfile(file, id)
+}
+
+// captureHeap writes a heap profile after a garbage collection so it shows
+// the memory that is in use
+func captureHeap(directory string, reason string) (*Profile, error) {
+	id := makeProfileID("heap", reason)
+	file, err := createProfile(directory, id)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime.GC()
+	err = pprof.Lookup("heap").WriteTo(file, 0)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return finishProfile(file, id)
+}
+
+// createProfile creates the temporary file for a profile which is renamed
+// when it is finished so a partial profile is never listed
+func createProfile(directory string, id string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(directory, "."+id+".tmp"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+// finishProfile closes and renames the temporary file of a profile
+func finishProfile(file *os.File, id string) (*Profile, error) {
+	temporary := file.Name()
+	filename := filepath.Join(filepath.Dir(temporary), id+profileSuffix)
+
+	err := file.Close()
+	if err == nil {
+		err = os.Rename(temporary, filename)
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return nil, err
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := makeProfile(id, info)
+	logger.Info("Saved profile %s size:%d\n", id, profile.Size)
+	return &profile, nil
+}
+
+// makeProfileID returns the id of a new profile, which holds the type, the
+// time, and the reason so nothing else needs to be saved with the profile
+func makeProfileID(kind string, reason string) string {
+	return kind + "-" + time.Now().Format("20060102-150405.000000") + "-" + reason
+}
+
+// makeProfile returns the details of a profile file
+func makeProfile(id string, info os.FileInfo) Profile {
+	return Profile{
+		ID:     id,
+		Type:   id[:strings.Index(id, "-")],
+		Reason: id[strings.LastIndex(id, "-")+1:],
+		Time:   info.ModTime(),
+		Size:   info.Size(),
+	}
+}
+
+// removeOldProfiles removes the oldest profiles of each type over the limit
+func removeOldProfiles(current profilerConfig) {
+	counts := make(map[string]int)
+	for _, id := range getProfileIDs(current.directory) {
+		kind := id[:strings.Index(id, "-")]
+		counts[kind]++
+		if counts[kind] > current.maxProfiles {
+			os.Remove(filepath.Join(current.directory, id+profileSuffix))
+		}
+	}
+}
+
+// getProfileIDs returns the ids of the profiles in the directory with the
+// most recent first, which is the reverse order of the time in the names
+func getProfileIDs(directory string) []string {
+	var list []string
+
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return list
+	}
+
+	for _, info := range infos {
+		id := strings.TrimSuffix(info.Name(), profileSuffix)
+		if info.IsDir() || !validID.MatchString(id) || id+profileSuffix != info.Name() {
+			continue
+		}
+		list = append(list, id)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i][strings.Index(list[i], "-"):] > list[j][strings.Index(list[j], "-"):]
+	})
+	return list
+}
+
+// getProcessTime returns the user and system CPU time used by the process
+func getProcessTime() time.Duration {
+	var usage syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &usage) != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,518 @@
+// Package profiles provides the parental control profiles. A profile is a
+// group of devices, by MAC address, and users with the content categories
+// they can't reach, the schedules during which they are offline, and a quota
+// for the traffic they can use. A profile can also be paused to take the
+// devices offline for a while or until it is unpaused. The profiles are not
+// enforced here. They are turned into policy rules and quotas which the
+// policy engine evaluates before the rules in the policy settings.
+package profiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/inventory"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/policy"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the file that holds the paused profiles so a pause survives a restart
+const pauseFile = "/etc/config/profiles-paused.json"
+
+// the prefix of the policy rules and quotas of the profiles
+const rulePrefix = "profile_"
+
+// the command used to remove the sessions of a paused device
+var conntrackCommand = "/usr/sbin/conntrack"
+
+// ErrNotFound is returned for a profile that doesn't exist
+var ErrNotFound = errors.New("profile not found")
+
+// Quota holds the traffic a profile can use in each period
+type Quota struct {
+	LimitBytes uint64 `json:"limitBytes"`
+	Period     string `json:"period"`
+}
+
+// Profile holds a parental control profile from the settings
+type Profile struct {
+	ID                string   `json:"id"`
+	Name              string   `json:"name"`
+	Enabled           bool     `json:"enabled"`
+	Devices           []string `json:"devices"`
+	Users             []string `json:"users"`
+	BlockedCategories []string `json:"blockedCategories"`
+	BlockedSchedules  []string `json:"blockedSchedules"`
+	Quota             *Quota   `json:"quota,omitempty"`
+}
+
+// ProfileStatus holds a profile along with the pause and the quota usage
+type ProfileStatus struct {
+	Profile
+	Paused        bool       `json:"paused"`
+	PausedUntil   *time.Time `json:"pausedUntil,omitempty"`
+	QuotaUsed     uint64     `json:"quotaUsed"`
+	QuotaExceeded bool       `json:"quotaExceeded"`
+}
+
+var profileList []Profile
+var pauseTable = make(map[string]time.Time)
+var profileLocker sync.Mutex
+var reloadChannel = make(chan bool, 1)
+var shutdownChannel = make(chan bool)
+var pauseWaiter sync.WaitGroup
+
+// Startup is called to handle service startup
+func Startup() {
+	settings.RegisterValidator("profiles", validateProfiles)
+	loadPauses()
+	loadSettings()
+	policy.RegisterSource("profiles", getPolicyRules)
+	policy.Reload()
+
+	pauseWaiter.Add(1)
+	go pauseTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	close(shutdownChannel)
+	pauseWaiter.Wait()
+}
+
+// Reload loads the profiles and rebuilds the policy rules
+func Reload() {
+	loadSettings()
+	policy.Reload()
+}
+
+// GetProfiles returns the profiles with their state sorted by ID
+func GetProfiles() []ProfileStatus {
+	quotas := getQuotaStatus()
+	now := time.Now()
+
+	profileLocker.Lock()
+	defer profileLocker.Unlock()
+
+	list := []ProfileStatus{}
+	for _, profile := range profileList {
+		list = append(list, getProfileStatus(profile, quotas, now))
+	}
+	return list
+}
+
+// GetProfile returns a profile with its state
+func GetProfile(id string) (ProfileStatus, error) {
+	for _, status := range GetProfiles() {
+		if status.ID == id {
+			return status, nil
+		}
+	}
+	return ProfileStatus{}, ErrNotFound
+}
+
+// SetProfile adds a profile or replaces the one with the same ID in the settings
+func SetProfile(profile Profile) error {
+	if err := checkProfile(&profile); err != nil {
+		return err
+	}
+
+	profileLocker.Lock()
+	list := append([]Profile(nil), profileList...)
+	profileLocker.Unlock()
+
+	found := false
+	for index := range list {
+		if list[index].ID == profile.ID {
+			list[index] = profile
+			found = true
+		}
+	}
+	if !found {
+		list = append(list, profile)
+	}
+
+	if err := saveSettings(list); err != nil {
+		return err
+	}
+
+	logger.Info("Saved profile %s\n", profile.ID)
+	return nil
+}
+
+// RemoveProfile removes a profile from the settings
+func RemoveProfile(id string) error {
+	profileLocker.Lock()
+	var list []Profile
+	for _, profile := range profileList {
+		if profile.ID != id {
+			list = append(list, profile)
+		}
+	}
+	found := len(list) != len(profileList)
+	profileLocker.Unlock()
+
+	if !found {
+		return ErrNotFound
+	}
+	if err := saveSettings(list); err != nil {
+		return err
+	}
+
+	profileLocker.Lock()
+	delete(pauseTable, id)
+	profileLocker.Unlock()
+	savePauses()
+
+	logger.Info("Removed profile %s\n", id)
+	return nil
+}
+
+// Pause takes the devices and users of a profile offline for the argumented
+// duration, or until the profile is unpaused if it is zero. The sessions of
+// the devices are removed so they can't keep going.
+func Pause(id string, duration time.Duration) (ProfileStatus, error) {
+	profileLocker.Lock()
+	profile, found := findProfile(id)
+	if !found {
+		profileLocker.Unlock()
+		return ProfileStatus{}, ErrNotFound
+	}
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration).Round(time.Second)
+	}
+	pauseTable[id] = until
+	profileLocker.Unlock()
+
+	savePauses()
+	policy.Reload()
+	flushSessions(profile)
+	signalTask()
+
+	logger.Info("Paused profile %s for %v\n", id, duration)
+	return GetProfile(id)
+}
+
+// Unpause brings the devices and users of a profile back online
+func Unpause(id string) (ProfileStatus, error) {
+	profileLocker.Lock()
+	_, found := findProfile(id)
+	_, paused := pauseTable[id]
+	delete(pauseTable, id)
+	profileLocker.Unlock()
+
+	if !found {
+		return ProfileStatus{}, ErrNotFound
+	}
+
+	if paused {
+		savePauses()
+		policy.Reload()
+		logger.Info("Unpaused profile %s\n", id)
+	}
+	return GetProfile(id)
+}
+
+// loadSettings loads the profiles from the settings
+func loadSettings() {
+	var fresh []Profile
+
+	profileJSON, err := settings.GetCurrentSettings([]string{"profiles"})
+	if profileJSON != nil && err == nil {
+		for _, problem := range parseProfiles(profileJSON, &fresh) {
+			logger.Warn("Ignoring invalid profile %v\n", problem)
+		}
+	}
+
+	profileLocker.Lock()
+	profileList = fresh
+	profileLocker.Unlock()
+
+	logger.Info("Loaded %d profiles\n", len(fresh))
+}
+
+// parseProfiles reads the profiles from the settings. Invalid profiles are
+// skipped and returned as errors.
+func parseProfiles(value interface{}, list *[]Profile) []error {
+	var problems []error
+
+	// the settings are decoded again into the struct since they use the same names
+	data, err := json.Marshal(value)
+	if err != nil {
+		return []error{err}
+	}
+	var raw []json.RawMessage
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return []error{errors.New("profiles must be a list")}
+	}
+
+	ids := make(map[string]bool)
+	for index, item := range raw {
+		profile := Profile{Enabled: true}
+		if err = json.Unmarshal(item, &profile); err != nil {
+			problems = append(problems, fmt.Errorf("%d: %v", index, err))
+			continue
+		}
+		if err = checkProfile(&profile); err != nil {
+			problems = append(problems, fmt.Errorf("%d: %v", index, err))
+			continue
+		}
+		if ids[profile.ID] {
+			problems = append(problems, fmt.Errorf("%d: duplicate id %s", index, profile.ID))
+			continue
+		}
+		ids[profile.ID] = true
+		*list = append(*list, profile)
+	}
+
+	sort.Slice(*list, func(i, j int) bool { return (*list)[i].ID < (*list)[j].ID })
+	return problems
+}
+
+// checkProfile checks a profile and normalizes the MAC addresses
+func checkProfile(profile *Profile) error {
+	if profile.ID == "" {
+		return errors.New("missing id")
+	}
+	for _, char := range profile.ID {
+		if (char < 'a' || char > 'z') && (char < '0' || char > '9') && char != '-' && char != '_' {
+			return fmt.Errorf("invalid id %s", profile.ID)
+		}
+	}
+	if len(profile.Devices) == 0 && len(profile.Users) == 0 {
+		return errors.New("no devices or users")
+	}
+
+	for index, device := range profile.Devices {
+		mac, err := net.ParseMAC(device)
+		if err != nil {
+			return fmt.Errorf("invalid device %s", device)
+		}
+		profile.Devices[index] = mac.String()
+	}
+
+	// the values are joined into in and not_in conditions
+	for _, list := range [][]string{profile.Users, profile.BlockedCategories, profile.BlockedSchedules} {
+		for _, value := range list {
+			if value == "" || strings.Contains(value, ",") {
+				return fmt.Errorf("invalid name %q", value)
+			}
+		}
+	}
+
+	if profile.Quota != nil {
+		if profile.Quota.LimitBytes == 0 {
+			return errors.New("invalid quota limit")
+		}
+		switch profile.Quota.Period {
+		case "":
+			profile.Quota.Period = "daily"
+		case "hourly", "daily", "weekly", "monthly":
+		default:
+			return fmt.Errorf("invalid quota period %s", profile.Quota.Period)
+		}
+	}
+
+	return nil
+}
+
+// validateProfiles checks the profiles in the staged settings
+func validateProfiles(jsonSettings map[string]interface{}) []string {
+	var list []string
+
+	if jsonSettings["profiles"] == nil {
+		return list
+	}
+
+	var profiles []Profile
+	for _, problem := range parseProfiles(jsonSettings["profiles"], &profiles) {
+		list = append(list, "profile "+problem.Error())
+	}
+	return list
+}
+
+// saveSettings writes the profiles to the settings and loads them
+func saveSettings(list []Profile) error {
+	var value []interface{}
+
+	data, err := json.Marshal(list)
+	if err == nil {
+		err = json.Unmarshal(data, &value)
+	}
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		value = []interface{}{}
+	}
+
+	if _, err = settings.SetSettings([]string{"profiles"}, value); err != nil {
+		return err
+	}
+
+	Reload()
+	return nil
+}
+
+// findProfile returns the profile with the ID. The caller must hold the lock.
+func findProfile(id string) (Profile, bool) {
+	for _, profile := range profileList {
+		if profile.ID == id {
+			return profile, true
+		}
+	}
+	return Profile{}, false
+}
+
+// getProfileStatus returns a profile along with the pause and the quota
+// usage. The caller must hold the lock.
+func getProfileStatus(profile Profile, quotas map[string]policy.QuotaStatus, now time.Time) ProfileStatus {
+	status := ProfileStatus{Profile: profile}
+
+	if until, found := pauseTable[profile.ID]; found && (until.IsZero() || until.After(now)) {
+		status.Paused = true
+		if !until.IsZero() {
+			stamp := until
+			status.PausedUntil = &stamp
+		}
+	}
+
+	if quota, found := quotas[rulePrefix+profile.ID]; found {
+		status.QuotaUsed = quota.UsedBytes
+		status.QuotaExceeded = quota.Exceeded
+	}
+
+	return status
+}
+
+// getQuotaStatus returns the quota buckets of the policy by name
+func getQuotaStatus() map[string]policy.QuotaStatus {
+	table := make(map[string]policy.QuotaStatus)
+	for _, quota := range policy.GetStatus().Quotas {
+		table[quota.Name] = quota
+	}
+	return table
+}
+
+// flushSessions removes the conntrack entries of the devices of a profile
+// that are in the inventory. The users can't be found this way so their
+// sessions end when the policy is evaluated for them again.
+func flushSessions(profile Profile) {
+	for _, device := range profile.Devices {
+		mac, err := net.ParseMAC(device)
+		if err != nil {
+			continue
+		}
+		found := inventory.FindDevice(mac)
+		if found == nil || found.IPAddress == "" {
+			continue
+		}
+		output, err := exec.Command(conntrackCommand, "-D", "-s", found.IPAddress).CombinedOutput()
+		if err != nil && !strings.Contains(string(output), "0 flow entries") {
+			logger.Warn("Unable to remove the sessions of %s: %v\n", found.IPAddress, strings.TrimSpace(string(output)))
+		}
+	}
+}
+
+// loadPauses reads the paused profiles from the file
+func loadPauses() {
+	data, err := ioutil.ReadFile(pauseFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Unable to read the paused profiles %s: %v\n", pauseFile, err)
+		}
+		return
+	}
+
+	fresh := make(map[string]time.Time)
+	if err = json.Unmarshal(data, &fresh); err != nil {
+		logger.Warn("Unable to parse the paused profiles %s: %v\n", pauseFile, err)
+		return
+	}
+
+	profileLocker.Lock()
+	pauseTable = fresh
+	profileLocker.Unlock()
+
+	logger.Info("Loaded %d paused profiles from %s\n", len(fresh), pauseFile)
+}
+
+// savePauses writes the paused profiles to the file
+func savePauses() {
+	profileLocker.Lock()
+	data, err := json.Marshal(pauseTable)
+	profileLocker.Unlock()
+
+	if err != nil {
+		logger.Warn("Unable to encode the paused profiles: %v\n", err)
+		return
+	}
+
+	temporary := filepath.Join(filepath.Dir(pauseFile), "."+filepath.Base(pauseFile)+".tmp")
+	err = ioutil.WriteFile(temporary, data, 0600)
+	if err == nil {
+		err = os.Rename(temporary, pauseFile)
+	}
+	if err != nil {
+		logger.Warn("Unable to write the paused profiles %s: %v\n", pauseFile, err)
+		os.Remove(temporary)
+	}
+}
+
+// signalTask wakes the pause task so it waits for the next pause to expire
+func signalTask() {
+	select {
+	case reloadChannel <- true:
+	default:
+	}
+}
+
+// pauseTask unpauses the profiles when the pause expires
+func pauseTask() {
+	defer pauseWaiter.Done()
+
+	for {
+		now := time.Now()
+		delay := time.Hour
+		var expired []string
+
+		profileLocker.Lock()
+		for id, until := range pauseTable {
+			if until.IsZero() {
+				continue
+			}
+			if !until.After(now) {
+				expired = append(expired, id)
+				delete(pauseTable, id)
+			} else if until.Sub(now) < delay {
+				delay = until.Sub(now)
+			}
+		}
+		profileLocker.Unlock()
+
+		if len(expired) != 0 {
+			logger.Info("The pause of profiles %v expired\n", expired)
+			savePauses()
+			policy.Reload()
+		}
+
+		select {
+		case <-shutdownChannel:
+			return
+		case <-reloadChannel:
+		case <-time.After(delay):
+		}
+	}
+}
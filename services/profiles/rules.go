@@ -0,0 +1,96 @@
+package profiles
+
+import (
+	"strings"
+	"time"
+)
+
+// getPolicyRules returns the policy rules and quotas for the enabled
+// profiles. The devices and the users of a profile need their own rules since
+// the conditions of a rule must all match. The pause comes first, then the
+// schedules, the quota, and the categories last since the category isn't
+// known until the session is classified.
+func getPolicyRules() ([]interface{}, []interface{}) {
+	var rules []interface{}
+	var quotas []interface{}
+
+	profileLocker.Lock()
+	defer profileLocker.Unlock()
+
+	now := time.Now()
+	for _, profile := range profileList {
+		if !profile.Enabled {
+			continue
+		}
+
+		quotaName := rulePrefix + profile.ID
+		if profile.Quota != nil {
+			quotas = append(quotas, map[string]interface{}{
+				"name":           quotaName,
+				"limitBytes":     float64(profile.Quota.LimitBytes),
+				"period":         profile.Quota.Period,
+				"exceededAction": map[string]interface{}{"type": "drop"},
+			})
+		}
+
+		until, paused := pauseTable[profile.ID]
+		paused = paused && (until.IsZero() || until.After(now))
+
+		matchers := []struct {
+			name  string
+			field string
+			list  []string
+		}{
+			{"devices", "client_mac", profile.Devices},
+			{"users", "username", profile.Users},
+		}
+
+		for _, matcher := range matchers {
+			if len(matcher.list) == 0 {
+				continue
+			}
+			base := rulePrefix + profile.ID + "_" + matcher.name + "_"
+			client := makeCondition(matcher.field, matcher.list)
+			drop := map[string]interface{}{"type": "drop"}
+
+			if paused {
+				rules = append(rules, makeRule(base+"pause", profile, drop, client))
+			}
+			if len(profile.BlockedSchedules) != 0 {
+				rules = append(rules, makeRule(base+"schedule", profile, drop, client, makeCondition("schedule", profile.BlockedSchedules)))
+			}
+			if profile.Quota != nil {
+				rules = append(rules, makeRule(base+"quota", profile, map[string]interface{}{"type": "quota", "value": quotaName}, client))
+			}
+			if len(profile.BlockedCategories) != 0 {
+				rules = append(rules, makeRule(base+"category", profile, drop, client, makeCondition("application_category", profile.BlockedCategories)))
+			}
+		}
+	}
+
+	return rules, quotas
+}
+
+// makeRule returns a policy rule in the settings format
+func makeRule(id string, profile Profile, action map[string]interface{}, conditions ...map[string]interface{}) map[string]interface{} {
+	var list []interface{}
+	for _, condition := range conditions {
+		list = append(list, condition)
+	}
+
+	return map[string]interface{}{
+		"ruleId":      id,
+		"description": "Profile " + profile.Name,
+		"conditions":  list,
+		"action":      action,
+	}
+}
+
+// makeCondition returns an in condition in the settings format
+func makeCondition(field string, values []string) map[string]interface{} {
+	return map[string]interface{}{
+		"field": field,
+		"op":    "in",
+		"value": strings.Join(values, ","),
+	}
+}
@@ -0,0 +1,302 @@
+// Package qos shapes the traffic of the WAN interfaces. The qos section of the
+// settings has the upload and download bandwidth of each WAN and the classes
+// the bandwidth is shared between. Each class gets an HTB class with a
+// reserved rate and a ceiling as a percent of the bandwidth, and the traffic
+// is put in a class by the priority the rules write to bits 16-23 of the
+// connmark. The upload is shaped on the WAN device and the download on an IFB
+// device the ingress traffic of the WAN is redirected to. After the qdiscs
+// and classes are applied they are read back from the kernel to verify the
+// state, which also gives the byte and drop counters of each class.
+package qos
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the mask of the priority in the connmark
+const priorityMask = 0x00FF0000
+const priorityShift = 16
+
+// Class holds a traffic class. The ID is the priority the rules set in the
+// connmark, and the rates are a percent of the bandwidth of the WAN.
+type Class struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Reserved int    `json:"reservedPercent"`
+	Limit    int    `json:"limitPercent"`
+	Default  bool   `json:"default"`
+}
+
+// WAN holds the bandwidth of a WAN interface in kbps. Zero doesn't shape
+// that direction.
+type WAN struct {
+	Device   string `json:"device"`
+	Upload   int    `json:"uploadKbps"`
+	Download int    `json:"downloadKbps"`
+}
+
+// Config holds the QoS settings
+type Config struct {
+	Enabled bool    `json:"enabled"`
+	WANs    []WAN   `json:"wans"`
+	Classes []Class `json:"classes"`
+}
+
+// the classes used when the settings have none
+var defaultClasses = []Class{
+	{ID: 1, Name: "critical", Priority: 0, Reserved: 20, Limit: 100},
+	{ID: 2, Name: "high", Priority: 1, Reserved: 30, Limit: 100},
+	{ID: 3, Name: "normal", Priority: 2, Reserved: 40, Limit: 100, Default: true},
+	{ID: 4, Name: "low", Priority: 3, Reserved: 10, Limit: 50},
+}
+
+var config Config
+var applied []shaper
+var qosLocker sync.Mutex
+
+// Startup is called to handle service startup
+func Startup() {
+	settings.RegisterValidator("qos", validateSettings)
+	Reload()
+}
+
+// Shutdown is called to handle service shutdown. The shaping is removed
+// since the classes depend on the marks packetd writes.
+func Shutdown() {
+	qosLocker.Lock()
+	defer qosLocker.Unlock()
+
+	removeShapers(applied)
+	applied = nil
+}
+
+// Reload loads the QoS settings and applies them. Nothing is done if the
+// settings didn't change and the state in the kernel still matches them, so
+// the queues aren't flushed on every reload.
+func Reload() {
+	fresh, _ := loadSettings()
+	if reflect.DeepEqual(fresh, GetConfig()) && GetStatus().Verified {
+		logger.Debug("The QoS settings did not change\n")
+		return
+	}
+
+	if _, err := Apply(); err != nil {
+		logger.Warn("Unable to apply the QoS settings: %v\n", err)
+	}
+}
+
+// GetConfig returns the QoS settings that are applied
+func GetConfig() Config {
+	qosLocker.Lock()
+	defer qosLocker.Unlock()
+	return config
+}
+
+// Apply loads the QoS settings, applies them, and returns the verified state
+func Apply() (Status, error) {
+	fresh, problems := loadSettings()
+	for _, problem := range problems {
+		logger.Warn("Ignoring invalid QoS %v\n", problem)
+	}
+
+	qosLocker.Lock()
+	defer qosLocker.Unlock()
+
+	config = fresh
+	shapers := getShapers(fresh)
+
+	// the devices that are no longer shaped are cleaned up
+	keep := make(map[string]bool)
+	for _, item := range shapers {
+		keep[item.device] = true
+	}
+	var stale []shaper
+	for _, item := range applied {
+		if !keep[item.device] {
+			stale = append(stale, item)
+		}
+	}
+	removeShapers(stale)
+	applied = nil
+
+	var err error
+	for _, item := range shapers {
+		if err = item.apply(fresh.Classes); err != nil {
+			break
+		}
+		applied = append(applied, item)
+	}
+
+	logger.Info("Loaded QoS settings enabled:%v wans:%d classes:%d\n", fresh.Enabled, len(fresh.WANs), len(fresh.Classes))
+	status := getStatus()
+	if err == nil && !status.Verified {
+		err = fmt.Errorf("the QoS state does not match the settings")
+	}
+	return status, err
+}
+
+// loadSettings reads the QoS settings
+func loadSettings() (Config, []error) {
+	fresh := Config{Classes: append([]Class(nil), defaultClasses...)}
+
+	qosJSON, err := settings.GetCurrentSettings([]string{"qos"})
+	if qosJSON == nil || err != nil {
+		return fresh, nil
+	}
+
+	item, ok := qosJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid QoS settings: %T\n", qosJSON)
+		return fresh, nil
+	}
+
+	return parseConfig(item)
+}
+
+// parseConfig reads the QoS settings. Invalid values are skipped and returned
+// as errors.
+func parseConfig(item map[string]interface{}) (Config, []error) {
+	var problems []error
+	fresh := Config{}
+
+	fresh.Enabled, _ = item["enabled"].(bool)
+
+	wanSlice, _ := item["wans"].([]interface{})
+	devices := make(map[string]bool)
+	for index, value := range wanSlice {
+		entry, ok := value.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Errorf("wan %d: not an object", index))
+			continue
+		}
+		var wan WAN
+		wan.Device, _ = entry["device"].(string)
+		upload, _ := entry["uploadKbps"].(float64)
+		download, _ := entry["downloadKbps"].(float64)
+		wan.Upload, wan.Download = int(upload), int(download)
+		if wan.Device == "" {
+			problems = append(problems, fmt.Errorf("wan %d: missing device", index))
+			continue
+		}
+		if devices[wan.Device] {
+			problems = append(problems, fmt.Errorf("wan %s: duplicate device", wan.Device))
+			continue
+		}
+		if wan.Upload < 0 || wan.Download < 0 {
+			problems = append(problems, fmt.Errorf("wan %s: invalid bandwidth", wan.Device))
+			continue
+		}
+		devices[wan.Device] = true
+		fresh.WANs = append(fresh.WANs, wan)
+	}
+
+	classSlice, _ := item["classes"].([]interface{})
+	ids := make(map[int]bool)
+	reserved := 0
+	for index, value := range classSlice {
+		entry, ok := value.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Errorf("class %d: not an object", index))
+			continue
+		}
+		class := Class{Limit: 100}
+		id, _ := entry["id"].(float64)
+		class.ID = int(id)
+		class.Name, _ = entry["name"].(string)
+		if value, ok := entry["priority"].(float64); ok {
+			class.Priority = int(value)
+		}
+		if value, ok := entry["reservedPercent"].(float64); ok {
+			class.Reserved = int(value)
+		}
+		if value, ok := entry["limitPercent"].(float64); ok {
+			class.Limit = int(value)
+		}
+		class.Default, _ = entry["default"].(bool)
+
+		// the ID is a connmark priority and must fit in the HTB minor numbers
+		if class.ID < 1 || class.ID > priorityMask>>priorityShift {
+			problems = append(problems, fmt.Errorf("class %d: invalid id %d", index, class.ID))
+			continue
+		}
+		if ids[class.ID] {
+			problems = append(problems, fmt.Errorf("class %d: duplicate id %d", index, class.ID))
+			continue
+		}
+		if class.Priority < 0 || class.Priority > 7 {
+			problems = append(problems, fmt.Errorf("class %d: priority must be 0 to 7", index))
+			continue
+		}
+		if class.Reserved < 1 || class.Limit < class.Reserved || class.Limit > 100 {
+			problems = append(problems, fmt.Errorf("class %d: invalid reserved or limit percent", index))
+			continue
+		}
+		if reserved+class.Reserved > 100 {
+			problems = append(problems, fmt.Errorf("class %d: the classes reserve more than 100 percent", index))
+			continue
+		}
+		ids[class.ID] = true
+		reserved += class.Reserved
+		fresh.Classes = append(fresh.Classes, class)
+	}
+
+	if len(fresh.Classes) == 0 {
+		fresh.Classes = append([]Class(nil), defaultClasses...)
+	}
+	sort.Slice(fresh.Classes, func(i, j int) bool { return fresh.Classes[i].ID < fresh.Classes[j].ID })
+
+	// the traffic without a priority goes to the default class, the last
+	// class if none is marked
+	found := false
+	for index := range fresh.Classes {
+		if fresh.Classes[index].Default {
+			if found {
+				problems = append(problems, fmt.Errorf("class id %d: more than one default class", fresh.Classes[index].ID))
+			}
+			fresh.Classes[index].Default = !found
+			found = true
+		}
+	}
+	if !found {
+		fresh.Classes[len(fresh.Classes)-1].Default = true
+	}
+
+	return fresh, problems
+}
+
+// validateSettings checks the QoS settings in the staged settings
+func validateSettings(jsonSettings map[string]interface{}) []string {
+	var list []string
+
+	if jsonSettings["qos"] == nil {
+		return list
+	}
+
+	item, ok := jsonSettings["qos"].(map[string]interface{})
+	if !ok {
+		return []string{"qos must be an object"}
+	}
+
+	_, problems := parseConfig(item)
+	for _, problem := range problems {
+		list = append(list, "qos "+problem.Error())
+	}
+	return list
+}
+
+// getDefaultClass returns the ID of the default class
+func getDefaultClass(classes []Class) int {
+	for _, class := range classes {
+		if class.Default {
+			return class.ID
+		}
+	}
+	return 0
+}
@@ -0,0 +1,401 @@
+package qos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// the commands used to configure the qdiscs
+var tcCommand = "/usr/sbin/tc"
+var ipCommand = "/usr/sbin/ip"
+
+// The directions a WAN is shaped
+const (
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+)
+
+// the HTB minor number of a class is the class ID plus this so it doesn't
+// collide with the root class
+const classOffset = 0x10
+
+// shaper holds an HTB tree on a device. The upload is shaped on the WAN and
+// the download on the IFB device.
+type shaper struct {
+	wan       string
+	device    string
+	direction string
+	rate      int
+}
+
+// ClassStatus holds the state and the counters of a class from the kernel
+type ClassStatus struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Handle     string `json:"handle"`
+	RateKbps   uint64 `json:"rateKbps"`
+	CeilKbps   uint64 `json:"ceilKbps"`
+	Bytes      uint64 `json:"bytes"`
+	Packets    uint64 `json:"packets"`
+	Drops      uint64 `json:"drops"`
+	Overlimits uint64 `json:"overlimits"`
+	Backlog    uint64 `json:"backlog"`
+	Found      bool   `json:"found"`
+}
+
+// ShaperStatus holds the verified state of the shaping of a WAN in one direction
+type ShaperStatus struct {
+	WAN       string        `json:"wan"`
+	Device    string        `json:"device"`
+	Direction string        `json:"direction"`
+	RateKbps  int           `json:"rateKbps"`
+	Verified  bool          `json:"verified"`
+	Problems  []string      `json:"problems,omitempty"`
+	Classes   []ClassStatus `json:"classes"`
+}
+
+// Status holds the verified state of the QoS settings
+type Status struct {
+	Enabled  bool           `json:"enabled"`
+	Verified bool           `json:"verified"`
+	Shapers  []ShaperStatus `json:"shapers"`
+}
+
+// GetStatus reads the qdiscs and classes from the kernel, verifies them
+// against the settings, and returns the counters of each class
+func GetStatus() Status {
+	qosLocker.Lock()
+	defer qosLocker.Unlock()
+	return getStatus()
+}
+
+// getStatus verifies the expected shapers of the current settings
+func getStatus() Status {
+	status := Status{Enabled: config.Enabled, Verified: true, Shapers: []ShaperStatus{}}
+
+	for _, item := range getShapers(config) {
+		result := item.verify(config.Classes)
+		if !result.Verified {
+			status.Verified = false
+		}
+		status.Shapers = append(status.Shapers, result)
+	}
+
+	return status
+}
+
+// getShapers returns the shapers for the settings
+func getShapers(settings Config) []shaper {
+	var list []shaper
+
+	if !settings.Enabled {
+		return list
+	}
+
+	for _, wan := range settings.WANs {
+		if wan.Upload > 0 {
+			list = append(list, shaper{wan: wan.Device, device: wan.Device, direction: DirectionUpload, rate: wan.Upload})
+		}
+		if wan.Download > 0 {
+			list = append(list, shaper{wan: wan.Device, device: getIfbName(wan.Device), direction: DirectionDownload, rate: wan.Download})
+		}
+	}
+	return list
+}
+
+// getIfbName returns the name of the IFB device for the download of a WAN,
+// which has to fit in the 15 characters of an interface name
+func getIfbName(device string) string {
+	name := "ifb-" + device
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// apply replaces the HTB tree on the device with one for the classes. The
+// ingress of the WAN is redirected to the IFB device for the download, with
+// the connmark copied to the packet mark so the fw filters can classify it.
+func (item shaper) apply(classes []Class) error {
+	if item.direction == DirectionDownload {
+		runCommand(ipCommand, "link", "add", "name", item.device, "type", "ifb")
+		if err := runCommand(ipCommand, "link", "set", item.device, "up"); err != nil {
+			return err
+		}
+	}
+
+	// the root is deleted first so the classes that were removed are gone
+	runCommand(tcCommand, "qdisc", "del", "dev", item.device, "root")
+
+	var script bytes.Buffer
+	fmt.Fprintf(&script, "qdisc add dev %s root handle 1: htb default %x\n", item.device, getDefaultClass(classes)+classOffset)
+	fmt.Fprintf(&script, "class add dev %s parent 1: classid 1:1 htb rate %dkbit ceil %dkbit\n", item.device, item.rate, item.rate)
+	for _, class := range classes {
+		minor := class.ID + classOffset
+		rate, ceil := getClassRates(item.rate, class)
+		fmt.Fprintf(&script, "class add dev %s parent 1:1 classid 1:%x htb rate %dkbit ceil %dkbit prio %d\n", item.device, minor, rate, ceil, class.Priority)
+		fmt.Fprintf(&script, "qdisc add dev %s parent 1:%x handle %x: fq_codel\n", item.device, minor, minor)
+		fmt.Fprintf(&script, "filter add dev %s parent 1: protocol all prio 1 handle 0x%x/0x%x fw classid 1:%x\n", item.device, class.ID<<priorityShift, priorityMask, minor)
+	}
+	if item.direction == DirectionDownload {
+		fmt.Fprintf(&script, "qdisc replace dev %s handle ffff: ingress\n", item.wan)
+		fmt.Fprintf(&script, "filter replace dev %s parent ffff: protocol all prio 1 u32 match u32 0 0 action connmark action mirred egress redirect dev %s\n", item.wan, item.device)
+	}
+
+	if err := runBatch(script.String()); err != nil {
+		return fmt.Errorf("%s %s: %v", item.wan, item.direction, err)
+	}
+
+	return nil
+}
+
+// remove deletes the HTB tree, and the ingress redirect and the IFB device for the download
+func (item shaper) remove() {
+	if item.direction == DirectionDownload {
+		runCommand(tcCommand, "qdisc", "del", "dev", item.wan, "ingress")
+		runCommand(ipCommand, "link", "del", item.device)
+		return
+	}
+	runCommand(tcCommand, "qdisc", "del", "dev", item.device, "root")
+}
+
+// removeShapers removes the argumented shapers
+func removeShapers(list []shaper) {
+	for _, item := range list {
+		item.remove()
+		logger.Info("Removed QoS %s shaping from %s\n", item.direction, item.wan)
+	}
+}
+
+// verify reads the qdiscs and classes of the device and checks they match
+// the classes and the rate
+func (item shaper) verify(classes []Class) ShaperStatus {
+	result := ShaperStatus{WAN: item.wan, Device: item.device, Direction: item.direction, RateKbps: item.rate, Classes: []ClassStatus{}}
+
+	qdiscs, err := readJSON(tcCommand, "-j", "qdisc", "show", "dev", item.device)
+	if err != nil {
+		result.Problems = append(result.Problems, err.Error())
+	} else if !findQdisc(qdiscs, "htb", "1:") {
+		result.Problems = append(result.Problems, "the root qdisc is not HTB")
+	}
+
+	filters, err := readJSON(tcCommand, "-j", "filter", "show", "dev", item.device, "parent", "1:")
+	if err != nil {
+		result.Problems = append(result.Problems, err.Error())
+	}
+
+	if item.direction == DirectionDownload {
+		ingress, err := readJSON(tcCommand, "-j", "qdisc", "show", "dev", item.wan, "ingress")
+		if err != nil || !findQdisc(ingress, "ingress", "ffff:") {
+			result.Problems = append(result.Problems, fmt.Sprintf("the ingress of %s is not redirected", item.wan))
+		}
+	}
+
+	found, err := readClasses(item.device)
+	if err != nil {
+		result.Problems = append(result.Problems, err.Error())
+	}
+
+	for _, class := range classes {
+		handle := fmt.Sprintf("1:%x", class.ID+classOffset)
+		state, ok := found[handle]
+		if !ok {
+			result.Problems = append(result.Problems, fmt.Sprintf("class %s (%s) is missing", handle, class.Name))
+			state = ClassStatus{Handle: handle}
+		}
+		state.ID, state.Name = class.ID, class.Name
+		if !findLeaf(qdiscs, handle) {
+			result.Problems = append(result.Problems, fmt.Sprintf("class %s (%s) has no fq_codel qdisc", handle, class.Name))
+		}
+		if !findFilter(filters, handle) {
+			result.Problems = append(result.Problems, fmt.Sprintf("class %s (%s) has no filter", handle, class.Name))
+		}
+
+		rate, ceil := getClassRates(item.rate, class)
+		if ok && (!closeEnough(state.RateKbps, rate) || !closeEnough(state.CeilKbps, ceil)) {
+			result.Problems = append(result.Problems, fmt.Sprintf("class %s (%s) has rate %d/%d kbit instead of %d/%d", handle, class.Name, state.RateKbps, state.CeilKbps, rate, ceil))
+		}
+		result.Classes = append(result.Classes, state)
+	}
+
+	result.Verified = len(result.Problems) == 0
+	return result
+}
+
+// getClassRates returns the reserved rate and the ceiling of a class in kbit
+func getClassRates(bandwidth int, class Class) (int, int) {
+	rate := bandwidth * class.Reserved / 100
+	ceil := bandwidth * class.Limit / 100
+	if rate < 1 {
+		rate = 1
+	}
+	if ceil < rate {
+		ceil = rate
+	}
+	return rate, ceil
+}
+
+// closeEnough returns true if the rate the kernel reports is within a percent
+// of the expected rate, since the kernel rounds it
+func closeEnough(actual uint64, expected int) bool {
+	difference := int64(actual) - int64(expected)
+	if difference < 0 {
+		difference = -difference
+	}
+	return difference*100 <= int64(expected)
+}
+
+// findQdisc returns true if the list has a qdisc of the kind with the handle
+func findQdisc(list []map[string]interface{}, kind string, handle string) bool {
+	for _, entry := range list {
+		if entry["kind"] == kind && entry["handle"] == handle {
+			return true
+		}
+	}
+	return false
+}
+
+// findLeaf returns true if the list has the fq_codel qdisc of a class
+func findLeaf(list []map[string]interface{}, parent string) bool {
+	for _, entry := range list {
+		if entry["kind"] == "fq_codel" && entry["parent"] == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// findFilter returns true if the list has a filter that sends traffic to a class
+func findFilter(list []map[string]interface{}, class string) bool {
+	for _, entry := range list {
+		options, _ := entry["options"].(map[string]interface{})
+		if options != nil && (options["flowid"] == class || options["classid"] == class) {
+			return true
+		}
+	}
+	return false
+}
+
+// readClasses returns the HTB classes of a device by handle. The classes
+// are read from the text output since tc has no JSON output for them.
+//
+//	class htb 1:11 parent 1:1 prio 0 rate 2Mbit ceil 10Mbit burst 1600b cburst 1600b
+//	 Sent 1024 bytes 12 pkt (dropped 0, overlimits 0 requeues 0)
+//	 backlog 0b 0p requeues 0
+func readClasses(device string) (map[string]ClassStatus, error) {
+	table := make(map[string]ClassStatus)
+
+	output, err := exec.Command(tcCommand, "-s", "class", "show", "dev", device).CombinedOutput()
+	if err != nil {
+		return table, fmt.Errorf("%s: %s", tcCommand, strings.TrimSpace(string(output)))
+	}
+
+	var current *ClassStatus
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ", ",", " ").Replace(line))
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "class" {
+			if current != nil {
+				table[current.Handle] = *current
+			}
+			current = nil
+			if len(fields) < 3 || fields[1] != "htb" {
+				continue
+			}
+			current = &ClassStatus{Handle: fields[2], Found: true}
+		}
+		if current == nil {
+			continue
+		}
+		for index := 0; index+1 < len(fields); index++ {
+			name, value := fields[index], fields[index+1]
+			switch {
+			case fields[0] == "class" && name == "rate":
+				current.RateKbps = parseRate(value)
+			case fields[0] == "class" && name == "ceil":
+				current.CeilKbps = parseRate(value)
+			case fields[0] == "Sent" && name == "Sent":
+				current.Bytes, _ = strconv.ParseUint(value, 10, 64)
+			case fields[0] == "Sent" && value == "pkt":
+				current.Packets, _ = strconv.ParseUint(name, 10, 64)
+			case fields[0] == "Sent" && name == "dropped":
+				current.Drops, _ = strconv.ParseUint(value, 10, 64)
+			case fields[0] == "Sent" && name == "overlimits":
+				current.Overlimits, _ = strconv.ParseUint(value, 10, 64)
+			case fields[0] == "backlog" && name == "backlog":
+				current.Backlog, _ = strconv.ParseUint(strings.TrimSuffix(value, "b"), 10, 64)
+			}
+		}
+	}
+	if current != nil {
+		table[current.Handle] = *current
+	}
+
+	return table, nil
+}
+
+// parseRate returns a tc rate like 10Mbit in kbit
+func parseRate(text string) uint64 {
+	multiplier := 0.001
+	for _, unit := range []struct {
+		suffix string
+		value  float64
+	}{{"Gbit", 1000000}, {"Mbit", 1000}, {"Kbit", 1}, {"bit", 0.001}} {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSuffix(text, unit.suffix)
+			multiplier = unit.value
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0
+	}
+	return uint64(value*multiplier + 0.5)
+}
+
+// readJSON runs a tc show command and returns the JSON output
+func readJSON(name string, args ...string) ([]map[string]interface{}, error) {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, strings.TrimSpace(string(output)))
+	}
+
+	var list []map[string]interface{}
+	if err = json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("invalid %s output: %v", name, err)
+	}
+	return list, nil
+}
+
+// runBatch runs tc commands from a script
+func runBatch(script string) error {
+	command := exec.Command(tcCommand, "-force", "-batch", "-")
+	command.Stdin = strings.NewReader(script)
+	output, err := command.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", tcCommand, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runCommand runs a command and returns the output as the error if it fails
+func runCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			return fmt.Errorf("%s: %s", name, text)
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
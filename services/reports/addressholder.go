@@ -0,0 +1,144 @@
+package reports
+
+import (
+	"database/sql"
+	"time"
+)
+
+// The holder of an address at a point in time is found from the lease
+// history the dhcp plugin logs to the dhcp_leases table. The last grant of
+// the address before the time is the lease that covered it, unless it was
+// released or had expired by then. Addresses that are not leased, and the
+// users of a device, are found from the sessions of the address around the
+// time instead.
+
+// AddressLease holds the DHCP lease of an address
+type AddressLease struct {
+	MacAddress  string     `json:"macAddress"`
+	Hostname    string     `json:"hostname,omitempty"`
+	VendorClass string     `json:"vendorClass,omitempty"`
+	Interface   string     `json:"interface,omitempty"`
+	Granted     time.Time  `json:"granted"`
+	Expires     time.Time  `json:"expires"`
+	Released    *time.Time `json:"released,omitempty"`
+	Active      bool       `json:"active"`
+}
+
+// AddressSessions holds the hostname and username of the sessions an address
+// had around a point in time
+type AddressSessions struct {
+	Hostname  string    `json:"hostname,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Sessions  int64     `json:"sessions"`
+}
+
+// AddressHolder holds what is known about who held an address at a point in time
+type AddressHolder struct {
+	Address  string            `json:"address"`
+	Time     time.Time         `json:"time"`
+	Lease    *AddressLease     `json:"lease"`
+	Sessions []AddressSessions `json:"sessions"`
+}
+
+// the number of hostname and username pairs returned from the sessions
+const addressSessionLimit = 10
+
+// GetAddressHolder returns the lease that covered the address at the
+// argumented time, or the last one before it, and the hostnames and usernames
+// of the sessions of the address within the window around the time
+func GetAddressHolder(address string, at time.Time, window time.Duration) (*AddressHolder, error) {
+	holder := &AddressHolder{Address: address, Time: at, Sessions: []AddressSessions{}}
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	lease, err := getAddressLease(address, at)
+	if err != nil {
+		return nil, err
+	}
+	holder.Lease = lease
+
+	sessions, err := getAddressSessions(address, at, window)
+	if err != nil {
+		return nil, err
+	}
+	holder.Sessions = sessions
+
+	return holder, nil
+}
+
+// getAddressLease returns the last lease of the address granted before the
+// argumented time or nil if there is none. The caller must hold the dbLock.
+func getAddressLease(address string, at time.Time) (*AddressLease, error) {
+	var granted, leaseTime sql.NullInt64
+	var mac, hostname, vendorClass, device sql.NullString
+
+	row := db.QueryRow("SELECT time_stamp, mac_address, hostname, vendor_class, lease_time, interface_name FROM dhcp_leases "+
+		"WHERE address = ? AND event_type = 'grant' AND time_stamp <= ? ORDER BY time_stamp DESC LIMIT 1", address, prepareEventValues(at))
+	err := row.Scan(&granted, &mac, &hostname, &vendorClass, &leaseTime, &device)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &AddressLease{
+		MacAddress:  mac.String,
+		Hostname:    hostname.String,
+		VendorClass: vendorClass.String,
+		Interface:   device.String,
+		Granted:     time.Unix(0, granted.Int64*1e6),
+	}
+	lease.Expires = lease.Granted.Add(time.Duration(leaseTime.Int64) * time.Second)
+
+	// the client may have given the address back before the time
+	var released sql.NullInt64
+	err = db.QueryRow("SELECT min(time_stamp) FROM dhcp_leases WHERE address = ? AND mac_address = ? "+
+		"AND event_type IN ('release', 'decline') AND time_stamp >= ? AND time_stamp <= ?",
+		address, mac.String, granted.Int64, prepareEventValues(at)).Scan(&released)
+	if err != nil {
+		return nil, err
+	}
+	if released.Valid {
+		value := time.Unix(0, released.Int64*1e6)
+		lease.Released = &value
+	}
+
+	lease.Active = lease.Released == nil && !lease.Expires.Before(at)
+	return lease, nil
+}
+
+// getAddressSessions returns the hostnames and usernames of the sessions the
+// address had as the local address within the window around the argumented
+// time, with the most frequent first. The caller must hold the dbLock.
+func getAddressSessions(address string, at time.Time, window time.Duration) ([]AddressSessions, error) {
+	start := prepareEventValues(at.Add(-window))
+	end := prepareEventValues(at.Add(window))
+
+	rows, err := db.Query("SELECT hostname, username, min(time_stamp), max(coalesce(end_time, time_stamp)), count(*) FROM sessions "+
+		"WHERE local_address = ? AND time_stamp <= ? AND coalesce(end_time, time_stamp) >= ? "+
+		"GROUP BY hostname, username ORDER BY count(*) DESC LIMIT ?", address, end, start, addressSessionLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []AddressSessions{}
+	for rows.Next() {
+		var hostname, username sql.NullString
+		var first, last int64
+		var entry AddressSessions
+		if err = rows.Scan(&hostname, &username, &first, &last, &entry.Sessions); err != nil {
+			return nil, err
+		}
+		entry.Hostname = hostname.String
+		entry.Username = username.String
+		entry.FirstSeen = time.Unix(0, first*1e6)
+		entry.LastSeen = time.Unix(0, last*1e6)
+		list = append(list, entry)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,61 @@
+package reports
+
+import (
+	"encoding/json"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// the reports sink writes the alerts from the event bus to the alerts table
+var alertSubscription *eventbus.Subscription
+
+// init registers the alerts table with the schema registry
+func init() {
+	RegisterTable(TableSchema{
+		Name:  "alerts",
+		Owner: "reports",
+		Columns: []Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "source", Type: "text"},
+			{Name: "message", Type: "text"},
+			{Name: "details", Type: "text"},
+		},
+		TrimPercent: .1,
+	})
+}
+
+// startAlertSink subscribes to the alerts on the event bus
+func startAlertSink() {
+	alertSubscription = eventbus.Subscribe("reports", 0, eventbus.TopicAlert)
+	go alertSink(alertSubscription)
+}
+
+// stopAlertSink removes the alert subscription which stops the sink
+func stopAlertSink() {
+	if alertSubscription != nil {
+		eventbus.Unsubscribe(alertSubscription)
+		alertSubscription = nil
+	}
+}
+
+// alertSink logs each alert until the subscription is closed
+func alertSink(sub *eventbus.Subscription) {
+	for event := range sub.Events() {
+		message, _ := event.Data["message"].(string)
+
+		details, err := json.Marshal(event.Data)
+		if err != nil {
+			logger.Warn("Unable to encode alert details: %v\n", err)
+		}
+
+		columns := map[string]interface{}{
+			"time_stamp": event.Time,
+			"source":     event.Source,
+			"message":    message,
+			"details":    string(details),
+		}
+
+		LogEvent(CreateEvent("alert", "alerts", 1, columns, nil))
+	}
+}
@@ -0,0 +1,71 @@
+package reports
+
+import (
+	"strings"
+	"time"
+)
+
+// HourlyTraffic holds a row of the hourly traffic rollup
+type HourlyTraffic struct {
+	Time     time.Time
+	Kind     string
+	Name     string
+	Bytes    int64
+	Sessions int64
+}
+
+// GetHourlyTraffic returns the rows of the hourly traffic rollup for the
+// argumented hours
+func GetHourlyTraffic(hours []time.Time) ([]HourlyTraffic, error) {
+	var list []HourlyTraffic
+	if len(hours) == 0 {
+		return list, nil
+	}
+
+	var values []interface{}
+	for _, hour := range hours {
+		values = append(values, prepareEventValues(hour))
+	}
+
+	sqlStr := "SELECT time_stamp, kind, name, bytes, sessions FROM traffic_hourly " +
+		"WHERE time_stamp IN (?" + strings.Repeat(",?", len(hours)-1) + ")"
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item HourlyTraffic
+		var msec int64
+		if err = rows.Scan(&msec, &item.Kind, &item.Name, &item.Bytes, &item.Sessions); err != nil {
+			return nil, err
+		}
+		item.Time = time.Unix(0, msec*1e6)
+		list = append(list, item)
+	}
+
+	return list, rows.Err()
+}
+
+// GetAnomalyEvents returns the anomaly events since the argumented time with
+// the most recent first
+func GetAnomalyEvents(startTime time.Time, limit int) ([]map[string]interface{}, error) {
+	sqlStr := "SELECT time_stamp, kind, name, metric, value, expected, deviation, score FROM anomaly_events " +
+		"WHERE time_stamp >= ? ORDER BY time_stamp DESC, abs(score) DESC"
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, prepareEventValues(startTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, limit)
+}
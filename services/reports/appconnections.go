@@ -0,0 +1,58 @@
+package reports
+
+import (
+	"strings"
+	"time"
+)
+
+// AppConnectionFilter holds the conditions for an application connection
+// query. The application matches the application id or name, and empty
+// strings match everything.
+type AppConnectionFilter struct {
+	StartTime   time.Time
+	EndTime     time.Time
+	Application string
+	MacAddress  string
+	Server      string
+	Limit       int
+}
+
+// GetAppConnections returns the distinct device, application and server
+// combinations seen in the time range with the first and last time each was
+// seen and the session and byte totals, the most recently seen first. The
+// table has a row per day for each combination so the rows are added up.
+func GetAppConnections(filter AppConnectionFilter) ([]map[string]interface{}, error) {
+	conditions := []string{"time_stamp >= ?", "time_stamp < ?"}
+	values := []interface{}{prepareEventValues(GetUsagePeriodStart("daily", filter.StartTime)), prepareEventValues(filter.EndTime)}
+
+	if filter.Application != "" {
+		conditions = append(conditions, "(application_id = ? OR application_name = ?)")
+		values = append(values, filter.Application, filter.Application)
+	}
+	if filter.MacAddress != "" {
+		conditions = append(conditions, "mac_address = ?")
+		values = append(values, strings.ToLower(filter.MacAddress))
+	}
+	if filter.Server != "" {
+		conditions = append(conditions, "server_address = ?")
+		values = append(values, filter.Server)
+	}
+
+	sqlStr := "SELECT mac_address, max(address) AS address, max(hostname) AS hostname, " +
+		"application_id, max(application_name) AS application_name, server_address, " +
+		"min(first_seen) AS first_seen, max(last_seen) AS last_seen, " +
+		"sum(sessions) AS sessions, sum(client_bytes) AS client_bytes, sum(server_bytes) AS server_bytes " +
+		"FROM app_connections WHERE " + strings.Join(conditions, " AND ") + " " +
+		"GROUP BY mac_address, application_id, server_address ORDER BY last_seen DESC"
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, filter.Limit)
+}
@@ -0,0 +1,515 @@
+package reports
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// The reports database is limited in size and the oldest events are trimmed
+// when it is full. When archiving is enabled the events are exported before
+// they are lost, as gzip compressed CSV files with one file per table per day,
+// to a directory that can be a mounted share or to an S3 compatible bucket.
+// CSV is used rather than Parquet so nothing beyond the standard library is
+// needed to write or read them.
+// The days older than the archive age are exported periodically, and the
+// events the trim is about to delete are exported first if they weren't yet.
+// The catalog keeps the ranges that were exported for each table.
+
+// archiveConfig holds the archive settings
+type archiveConfig struct {
+	enabled     bool
+	ageDays     int
+	interval    time.Duration
+	destination string
+	directory   string
+	prefix      string
+	s3          s3Config
+}
+
+// ArchiveEntry holds a file of events that were archived
+type ArchiveEntry struct {
+	Table      string    `json:"table"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Rows       int       `json:"rows"`
+	Bytes      int       `json:"bytes"`
+	Location   string    `json:"location"`
+	ArchivedAt time.Time `json:"archivedAt"`
+	Reason     string    `json:"reason"`
+}
+
+// ArchiveCatalog holds the archived files and the time each table has been
+// archived up to
+type ArchiveCatalog struct {
+	Watermarks map[string]time.Time `json:"watermarks"`
+	Entries    []ArchiveEntry       `json:"entries"`
+}
+
+// The destinations the archives can be written to
+const (
+	ArchiveDirectory = "directory"
+	ArchiveS3        = "s3"
+)
+
+const defaultArchiveAgeDays = 7
+const defaultArchiveInterval = 3600
+
+var archiveCatalogFile = "/etc/config/reports-archive.json"
+var archive archiveConfig
+var archiveCatalog = ArchiveCatalog{Watermarks: make(map[string]time.Time)}
+var archiveLocker sync.Mutex
+var archiveRunLocker sync.Mutex
+var archiveShutdown = make(chan bool)
+
+// init registers the S3 secret key with the settings secrets
+func init() {
+	settings.RegisterSecret("reports/archive/s3/secretKey", settings.SecretEncrypt)
+}
+
+// loadArchiveConfig loads the archive settings
+func loadArchiveConfig() archiveConfig {
+	fresh := archiveConfig{
+		ageDays:     defaultArchiveAgeDays,
+		interval:    defaultArchiveInterval * time.Second,
+		destination: ArchiveDirectory,
+		s3:          s3Config{region: "us-east-1"},
+	}
+
+	archiveJSON, err := settings.GetCurrentSettings([]string{"reports", "archive"})
+	if archiveJSON == nil || err != nil {
+		return fresh
+	}
+
+	item, ok := archiveJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid reports archive settings: %T\n", archiveJSON)
+		return fresh
+	}
+
+	fresh.enabled, _ = item["enabled"].(bool)
+	if value, ok := item["ageDays"].(float64); ok && value >= 1 {
+		fresh.ageDays = int(value)
+	}
+	if value, ok := item["intervalSeconds"].(float64); ok && value >= 60 {
+		fresh.interval = time.Duration(value) * time.Second
+	}
+	if value, ok := item["destination"].(string); ok {
+		fresh.destination = value
+	}
+	fresh.directory, _ = item["directory"].(string)
+	if value, ok := item["prefix"].(string); ok {
+		fresh.prefix = strings.Trim(value, "/")
+	}
+	if value, ok := item["s3"].(map[string]interface{}); ok {
+		fresh.s3.endpoint, _ = value["endpoint"].(string)
+		fresh.s3.bucket, _ = value["bucket"].(string)
+		fresh.s3.accessKey, _ = value["accessKey"].(string)
+		fresh.s3.secretKey, _ = value["secretKey"].(string)
+		if region, ok := value["region"].(string); ok && region != "" {
+			fresh.s3.region = region
+		}
+	}
+
+	if !fresh.enabled {
+		return fresh
+	}
+
+	switch {
+	case fresh.destination == ArchiveDirectory && fresh.directory == "":
+		logger.Warn("Disabling the reports archive: missing directory\n")
+		fresh.enabled = false
+	case fresh.destination == ArchiveS3 && (fresh.s3.endpoint == "" || fresh.s3.bucket == ""):
+		logger.Warn("Disabling the reports archive: missing S3 endpoint or bucket\n")
+		fresh.enabled = false
+	case fresh.destination != ArchiveDirectory && fresh.destination != ArchiveS3:
+		logger.Warn("Disabling the reports archive: invalid destination %s\n", fresh.destination)
+		fresh.enabled = false
+	}
+
+	return fresh
+}
+
+// startArchive loads the archive settings and the catalog and starts the
+// periodic archive task
+func startArchive() {
+	config := loadArchiveConfig()
+	archiveLocker.Lock()
+	archive = config
+	archiveLocker.Unlock()
+
+	loadArchiveCatalog()
+	go archiveTask()
+}
+
+// stopArchive stops the archive task
+func stopArchive() {
+	archiveShutdown <- true
+	select {
+	case <-archiveShutdown:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown archiveTask\n")
+	}
+}
+
+// archiveTask periodically exports the days older than the archive age. The
+// settings are read each time so they can change without a restart.
+func archiveTask() {
+	for {
+		archiveLocker.Lock()
+		interval := archive.interval
+		archiveLocker.Unlock()
+
+		select {
+		case <-archiveShutdown:
+			archiveShutdown <- true
+			return
+		case <-time.After(interval):
+			config := loadArchiveConfig()
+			archiveLocker.Lock()
+			archive = config
+			archiveLocker.Unlock()
+			if config.enabled {
+				archiveAgedEvents(config)
+			}
+		}
+	}
+}
+
+// archiveAgedEvents exports the events of each table up to the start of the
+// day that is the archive age ago
+func archiveAgedEvents(config archiveConfig) {
+	year, month, day := time.Now().AddDate(0, 0, -config.ageDays).Date()
+	limit := time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+
+	archiveRunLocker.Lock()
+	defer archiveRunLocker.Unlock()
+
+	dbLock.RLock()
+	tables, err := getArchiveTables()
+	dbLock.RUnlock()
+	if err != nil {
+		logger.Warn("Unable to list the tables to archive: %v\n", err)
+		return
+	}
+
+	for _, table := range tables {
+		if err = archiveTable(config, table, limit, "aged"); err != nil {
+			logger.Warn("Unable to archive %s: %v\n", table, err)
+		}
+	}
+}
+
+// archiveBeforeTrim exports the events the trim is about to delete that were
+// not archived yet, and returns the tables that could not be archived so they
+// aren't trimmed. The database is only locked while the events are read so
+// a slow upload doesn't block the event logging.
+func archiveBeforeTrim(cutoffs []trimCutoff) map[string]bool {
+	failed := make(map[string]bool)
+
+	archiveLocker.Lock()
+	config := archive
+	archiveLocker.Unlock()
+
+	if !config.enabled {
+		return failed
+	}
+
+	archiveRunLocker.Lock()
+	defer archiveRunLocker.Unlock()
+
+	for _, cutoff := range cutoffs {
+		if err := archiveTable(config, cutoff.table, cutoff.time, "trim"); err != nil {
+			overseer.AddCounter("reports_archive_failed", 1)
+			logger.Warn("Unable to archive %s before the trim: %v\n", cutoff.table, err)
+			failed[cutoff.table] = true
+		}
+	}
+	return failed
+}
+
+// getArchiveTables returns the tables that have a time_stamp column. The
+// caller must hold the dbLock read lock.
+func getArchiveTables() ([]string, error) {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	var list []string
+	for _, name := range names {
+		columns, err := getTableColumns(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range columns {
+			if column.Name == "time_stamp" {
+				list = append(list, name)
+				break
+			}
+		}
+	}
+	return list, nil
+}
+
+// archiveTable exports the events of a table from its watermark up to the
+// limit, in one file for each day. The watermark is moved after each file is
+// written, so a failure is retried from the same place. The caller must hold
+// the archiveRunLocker so a range isn't exported twice.
+func archiveTable(config archiveConfig, table string, limit time.Time, reason string) error {
+	archiveLocker.Lock()
+	start, ok := archiveCatalog.Watermarks[table]
+	archiveLocker.Unlock()
+
+	if !ok {
+		var first interface{}
+		dbLock.RLock()
+		err := db.QueryRow("SELECT min(time_stamp) FROM " + table).Scan(&first)
+		dbLock.RUnlock()
+		if err != nil {
+			return err
+		}
+		msec, ok := first.(int64)
+		if !ok {
+			return nil
+		}
+		start = time.Unix(0, msec*1e6)
+	}
+
+	for start.Before(limit) {
+		year, month, day := start.Date()
+		end := time.Date(year, month, day+1, 0, 0, 0, 0, start.Location())
+		if end.After(limit) {
+			end = limit
+		}
+
+		entry, err := exportRange(config, table, start, end)
+		if err != nil {
+			return err
+		}
+		entry.Reason = reason
+
+		archiveLocker.Lock()
+		archiveCatalog.Watermarks[table] = end
+		if entry.Rows != 0 {
+			archiveCatalog.Entries = append(archiveCatalog.Entries, entry)
+			logger.Info("Archived %d %s events from %v to %v: %s\n", entry.Rows, table, start, end, entry.Location)
+		}
+		err = saveArchiveCatalog()
+		archiveLocker.Unlock()
+		if err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+// exportRange writes the events of a table in the time range to a compressed
+// CSV file with the column names on the first line. Nothing is written when
+// there are no events.
+func exportRange(config archiveConfig, table string, start time.Time, end time.Time) (ArchiveEntry, error) {
+	entry := ArchiveEntry{Table: table, Start: start, End: end}
+
+	data, err := readRange(table, start, end, &entry.Rows)
+	if err != nil || entry.Rows == 0 {
+		return entry, err
+	}
+
+	key := table + "/" + start.UTC().Format("20060102T150405Z") + "-" + end.UTC().Format("20060102T150405Z") + ".csv.gz"
+	if config.prefix != "" {
+		key = config.prefix + "/" + key
+	}
+
+	switch config.destination {
+	case ArchiveS3:
+		err = s3Put(config.s3, key, "application/gzip", data)
+		entry.Location = "s3://" + config.s3.bucket + "/" + key
+	default:
+		entry.Location = filepath.Join(config.directory, key)
+		err = writeArchiveFile(entry.Location, data)
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Bytes = len(data)
+	entry.ArchivedAt = time.Now()
+	return entry, nil
+}
+
+// readRange returns the compressed CSV of the events of a table in the time
+// range and sets the number of rows
+func readRange(table string, start time.Time, end time.Time, count *int) ([]byte, error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query("SELECT * FROM "+table+" WHERE time_stamp >= ? AND time_stamp < ? ORDER BY time_stamp", prepareEventValues(start), prepareEventValues(end))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	compressor := gzip.NewWriter(&buffer)
+	writer := csv.NewWriter(compressor)
+	writer.Write(columns)
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for index := range values {
+		pointers[index] = &values[index]
+	}
+	record := make([]string, len(columns))
+
+	for rows.Next() {
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for index, value := range values {
+			switch value := value.(type) {
+			case nil:
+				record[index] = ""
+			case []byte:
+				record[index] = string(value)
+			default:
+				record[index] = fmt.Sprintf("%v", value)
+			}
+		}
+		writer.Write(record)
+		*count++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		return nil, err
+	}
+	if err = compressor.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// writeArchiveFile writes an archive file to a temporary file and renames it
+// so a partial file is never left in the archive
+func writeArchiveFile(filename string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	temporary := filename + ".tmp"
+	if err := ioutil.WriteFile(temporary, data, 0644); err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, filename)
+}
+
+// loadArchiveCatalog reads the archive catalog file
+func loadArchiveCatalog() {
+	data, err := ioutil.ReadFile(archiveCatalogFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Unable to read %s: %v\n", archiveCatalogFile, err)
+		}
+		return
+	}
+
+	fresh := ArchiveCatalog{}
+	if err = json.Unmarshal(data, &fresh); err != nil {
+		logger.Warn("Invalid archive catalog %s: %v\n", archiveCatalogFile, err)
+		return
+	}
+	if fresh.Watermarks == nil {
+		fresh.Watermarks = make(map[string]time.Time)
+	}
+
+	archiveLocker.Lock()
+	archiveCatalog = fresh
+	archiveLocker.Unlock()
+}
+
+// saveArchiveCatalog writes the archive catalog file. The caller must hold
+// the archiveLocker.
+func saveArchiveCatalog() error {
+	data, err := json.Marshal(archiveCatalog)
+	if err != nil {
+		return err
+	}
+
+	temporary := archiveCatalogFile + ".tmp"
+	if err = ioutil.WriteFile(temporary, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, archiveCatalogFile)
+}
+
+// GetArchiveCatalog returns the archived files that have events in the time
+// range, for one table or for all of them if the table is empty, sorted by
+// table and time
+func GetArchiveCatalog(table string, startTime time.Time, endTime time.Time) (ArchiveCatalog, error) {
+	if !endTime.After(startTime) {
+		return ArchiveCatalog{}, errors.New("Invalid time range")
+	}
+
+	archiveLocker.Lock()
+	defer archiveLocker.Unlock()
+
+	result := ArchiveCatalog{Watermarks: make(map[string]time.Time), Entries: []ArchiveEntry{}}
+	for name, watermark := range archiveCatalog.Watermarks {
+		if table == "" || name == table {
+			result.Watermarks[name] = watermark
+		}
+	}
+	for _, entry := range archiveCatalog.Entries {
+		if table != "" && entry.Table != table {
+			continue
+		}
+		if entry.End.After(startTime) && entry.Start.Before(endTime) {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+
+	sort.SliceStable(result.Entries, func(i, j int) bool {
+		if result.Entries[i].Table != result.Entries[j].Table {
+			return result.Entries[i].Table < result.Entries[j].Table
+		}
+		return result.Entries[i].Start.Before(result.Entries[j].Start)
+	})
+	return result, nil
+}
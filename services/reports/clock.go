@@ -0,0 +1,24 @@
+package reports
+
+import (
+	"time"
+)
+
+// GetClockEvents returns the periods the clock was not synchronized and the
+// steps of the clock since the argumented time, with the most recent first.
+// An unsynchronized period that has not ended has no end time.
+func GetClockEvents(startTime time.Time, limit int) ([]map[string]interface{}, error) {
+	sqlStr := "SELECT time_stamp, end_time, event, offset_ms, step_ms FROM clock_events " +
+		"WHERE time_stamp >= ? OR end_time IS NULL OR end_time >= ? ORDER BY time_stamp DESC"
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, prepareEventValues(startTime), prepareEventValues(startTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, limit)
+}
@@ -0,0 +1,226 @@
+package reports
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// Some plugins log the same event for a session again on every burst of
+// packets. When deduplication is enabled the INSERT events of a session are
+// held for the window, and the identical events logged in that time are
+// collapsed into the first one. An event that had duplicates is written with
+// the repeat_count column, which is added to the table the first time. The
+// events of the sessions table are never held since the updates that follow
+// them must find the row.
+
+// dedupConfig holds the event deduplication settings
+type dedupConfig struct {
+	enabled     bool
+	window      time.Duration
+	eventNames  map[string]bool
+	eventPrefix []string
+}
+
+// dedupEntry holds an event waiting for its duplicates
+type dedupEntry struct {
+	event   Event
+	count   int
+	expires time.Time
+}
+
+// the default time an event waits for its duplicates
+const defaultDedupWindow = 10
+
+var dedup dedupConfig
+var dedupEvents = make(map[string]*dedupEntry)
+var dedupLocker sync.Mutex
+var dedupShutdown = make(chan bool)
+
+// the tables the repeat_count column was added to
+var dedupTables = make(map[string]bool)
+
+// EventsCollapsed records the number of duplicate events merged into an earlier event
+var EventsCollapsed uint64
+
+// loadDedupConfig loads the event deduplication settings. Without a list
+// of events every INSERT event that has a session is deduplicated.
+func loadDedupConfig() {
+	fresh := dedupConfig{window: defaultDedupWindow * time.Second, eventNames: make(map[string]bool)}
+
+	dedupJSON, err := settings.GetCurrentSettings([]string{"reports", "dedup"})
+	if dedupJSON != nil && err == nil {
+		item, ok := dedupJSON.(map[string]interface{})
+		if ok {
+			fresh.enabled, _ = item["enabled"].(bool)
+			if value, ok := item["windowSeconds"].(float64); ok && value >= 1 {
+				fresh.window = time.Duration(value) * time.Second
+			}
+			for _, value := range getSettingsList(item, "events") {
+				if name, ok := value.(string); ok && name != "" {
+					// a trailing asterisk will match all events starting with the name
+					if strings.HasSuffix(name, "*") {
+						fresh.eventPrefix = append(fresh.eventPrefix, strings.TrimSuffix(name, "*"))
+					} else {
+						fresh.eventNames[name] = true
+					}
+				}
+			}
+		} else {
+			logger.Warn("Invalid reports dedup settings: %T\n", dedupJSON)
+		}
+	}
+
+	if fresh.enabled {
+		logger.Info("Loaded reports event deduplication: window:%v events:%v prefix:%v\n", fresh.window, fresh.eventNames, fresh.eventPrefix)
+	}
+
+	dedupLocker.Lock()
+	dedup = fresh
+	dedupLocker.Unlock()
+}
+
+// startDedup loads the settings and starts the task that writes the events
+// once their window is over
+func startDedup() {
+	loadDedupConfig()
+	go dedupTask()
+}
+
+// stopDedup stops the deduplication task, which queues the held events
+func stopDedup() {
+	dedupShutdown <- true
+	select {
+	case <-dedupShutdown:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown dedupTask\n")
+	}
+}
+
+// dedupTask queues the events once their window is over
+func dedupTask() {
+	for {
+		select {
+		case <-dedupShutdown:
+			releaseEvents(time.Time{})
+			dedupShutdown <- true
+			return
+		case <-time.After(time.Second):
+			releaseEvents(time.Now())
+		}
+	}
+}
+
+// deduplicateEvent returns true if the event is held by the deduplication,
+// either because it waits for its duplicates or because it is the duplicate
+// of an event that is waiting
+func deduplicateEvent(event Event) bool {
+	if event.SQLOp != 1 || event.Table == "sessions" {
+		return false
+	}
+	sessionID, ok := event.Columns["session_id"].(int64)
+	if !ok {
+		return false
+	}
+
+	dedupLocker.Lock()
+	defer dedupLocker.Unlock()
+
+	if !dedup.enabled || !isDedupEvent(event.Name) {
+		return false
+	}
+
+	key := getDedupKey(event, sessionID)
+	if entry, found := dedupEvents[key]; found {
+		entry.count++
+		atomic.AddUint64(&EventsCollapsed, 1)
+		return true
+	}
+
+	dedupEvents[key] = &dedupEntry{event: event, count: 1, expires: time.Now().Add(dedup.window)}
+	return true
+}
+
+// isDedupEvent returns true if the events with the name are deduplicated.
+// The caller must hold the dedupLocker.
+func isDedupEvent(name string) bool {
+	if len(dedup.eventNames) == 0 && len(dedup.eventPrefix) == 0 {
+		return true
+	}
+	if dedup.eventNames[name] {
+		return true
+	}
+	for _, prefix := range dedup.eventPrefix {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getDedupKey returns the string that is the same for the identical events
+// of a session. The time_stamp is left out since it changes every time.
+func getDedupKey(event Event, sessionID int64) string {
+	names := make([]string, 0, len(event.Columns))
+	for name := range event.Columns {
+		if name != "time_stamp" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%s|%s|%d", event.Name, event.Table, sessionID)
+	for _, name := range names {
+		fmt.Fprintf(&builder, "|%s=%v", name, event.Columns[name])
+	}
+	return builder.String()
+}
+
+// releaseEvents queues the held events whose window is over before the
+// argumented time, or all of them if it is zero
+func releaseEvents(now time.Time) {
+	var list []*dedupEntry
+
+	dedupLocker.Lock()
+	for key, entry := range dedupEvents {
+		if now.IsZero() || entry.expires.Before(now) {
+			list = append(list, entry)
+			delete(dedupEvents, key)
+		}
+	}
+	dedupLocker.Unlock()
+
+	for _, entry := range list {
+		event := entry.event
+		if entry.count > 1 {
+			addRepeatColumn(event.Table)
+			columns := make(map[string]interface{}, len(event.Columns)+1)
+			for name, value := range event.Columns {
+				columns[name] = value
+			}
+			columns["repeat_count"] = entry.count
+			event.Columns = columns
+		}
+		queueEvent(event)
+	}
+}
+
+// addRepeatColumn adds the repeat_count column to a table the first time
+// one of its events is collapsed
+func addRepeatColumn(table string) {
+	if dedupTables[table] {
+		return
+	}
+
+	dbLock.Lock()
+	addColumn(table, "repeat_count", "int default 1")
+	dbLock.Unlock()
+	dedupTables[table] = true
+}
@@ -0,0 +1,298 @@
+package reports
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// The reports database lives in RAM so it never touches the flash in the
+// clear. When encryption is enabled we periodically write an encrypted
+// snapshot of the database to persistent storage and restore it at startup,
+// so the history survives a reboot without leaving readable session and DNS
+// history on a device that walks away.
+
+// encryptionConfig holds the database encryption configuration from the settings
+type encryptionConfig struct {
+	enabled      bool
+	key          string
+	keyFile      string
+	snapshotFile string
+	interval     int
+}
+
+const snapshotTempFile = "/tmp/reports.snapshot"
+
+// the key file is kept out of /etc/config so it isn't included in the config
+// backups along with the encrypted snapshot
+const defaultKeyFile = "/etc/packetd/reports.key"
+
+var encryption encryptionConfig
+var encryptionKey []byte
+var snapshotShutdown = make(chan bool)
+
+// loadEncryptionConfig loads the database encryption settings
+func loadEncryptionConfig() {
+	encryption.enabled = false
+	encryption.key = ""
+	encryption.keyFile = defaultKeyFile
+	encryption.snapshotFile = "/etc/config/reports.db.enc"
+	encryption.interval = 3600
+
+	encryptionJSON, err := settings.GetCurrentSettings([]string{"reports", "encryption"})
+	if encryptionJSON == nil || err != nil {
+		return
+	}
+
+	item, ok := encryptionJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid reports encryption settings: %T\n", encryptionJSON)
+		return
+	}
+
+	if value, ok := item["enabled"].(bool); ok {
+		encryption.enabled = value
+	}
+	if value, ok := item["key"].(string); ok {
+		encryption.key = value
+	}
+	if value, ok := item["keyFile"].(string); ok && value != "" {
+		encryption.keyFile = value
+	}
+	if value, ok := item["snapshotFile"].(string); ok && value != "" {
+		encryption.snapshotFile = value
+	}
+	if value, ok := item["snapshotInterval"].(float64); ok && value > 0 {
+		encryption.interval = int(value)
+	}
+}
+
+// loadEncryptionKey returns the 256 bit database key from the settings or the
+// key file. If neither exists a new random key is created in the key file.
+func loadEncryptionKey() ([]byte, error) {
+	if encryption.key != "" {
+		return decodeEncryptionKey(encryption.key)
+	}
+
+	data, err := ioutil.ReadFile(encryption.keyFile)
+	if err == nil {
+		return decodeEncryptionKey(string(data))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	logger.Notice("Creating new reports database key: %s\n", encryption.keyFile)
+	key := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeEncryptionKeyFile([]byte(hex.EncodeToString(key) + "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// writeEncryptionKeyFile writes the key file so only root can read it
+func writeEncryptionKeyFile(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(encryption.keyFile), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(encryption.keyFile, data, 0400)
+}
+
+// decodeEncryptionKey converts a hex encoded key to bytes
+func decodeEncryptionKey(value string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("Invalid key length")
+	}
+	return key, nil
+}
+
+// startEncryption is called before the database is opened to restore the
+// last encrypted snapshot and start the periodic snapshot task
+func startEncryption() {
+	loadEncryptionConfig()
+	if !encryption.enabled {
+		return
+	}
+
+	key, err := loadEncryptionKey()
+	if err != nil {
+		logger.Err("Unable to load reports database key: %s\n", err.Error())
+		return
+	}
+	encryptionKey = key
+
+	err = restoreSnapshot()
+	if err != nil {
+		logger.Warn("Unable to restore reports database snapshot: %s\n", err.Error())
+	}
+
+	go snapshotTask()
+}
+
+// stopEncryption is called before the database is closed to stop the
+// snapshot task and write the final snapshot
+func stopEncryption() {
+	if encryptionKey == nil {
+		return
+	}
+
+	snapshotShutdown <- true
+	select {
+	case <-snapshotShutdown:
+	case <-time.After(10 * time.Second):
+		logger.Err("Failed to properly shutdown snapshotTask\n")
+	}
+
+	err := writeSnapshot()
+	if err != nil {
+		logger.Warn("Unable to write reports database snapshot: %s\n", err.Error())
+	}
+}
+
+// snapshotTask periodically writes an encrypted snapshot of the database
+func snapshotTask() {
+	for {
+		select {
+		case <-snapshotShutdown:
+			snapshotShutdown <- true
+			return
+		case <-time.After(time.Second * time.Duration(encryption.interval)):
+			err := writeSnapshot()
+			if err != nil {
+				logger.Warn("Unable to write reports database snapshot: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// writeSnapshot copies the database to a temporary file in RAM and writes
+// the encrypted copy to the snapshot file
+func writeSnapshot() error {
+	os.Remove(snapshotTempFile)
+	defer os.Remove(snapshotTempFile)
+
+	dbLock.Lock()
+	_, err := db.Exec("VACUUM INTO '" + snapshotTempFile + "'")
+	dbLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := ioutil.ReadFile(snapshotTempFile)
+	if err != nil {
+		return err
+	}
+
+	ciphertext, err := encryptData(plaintext)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename so a power failure can't leave a partial snapshot
+	tempName := encryption.snapshotFile + ".tmp"
+	err = ioutil.WriteFile(tempName, ciphertext, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempName, encryption.snapshotFile)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Wrote encrypted reports snapshot: %s %d bytes\n", encryption.snapshotFile, len(ciphertext))
+	return nil
+}
+
+// restoreSnapshot decrypts the snapshot file into the database file. If the
+// database file already exists the daemon was restarted without a reboot so
+// the existing database is newer than the snapshot and we leave it alone.
+func restoreSnapshot() error {
+	if _, err := os.Stat(dbFilename); err == nil {
+		return nil
+	}
+
+	ciphertext, err := ioutil.ReadFile(encryption.snapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := decryptData(ciphertext)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(dbFilename, plaintext, 0600)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Restored encrypted reports snapshot: %s\n", encryption.snapshotFile)
+	return nil
+}
+
+// encryptData encrypts the argumented data using AES-256-GCM with the nonce prepended to the result
+func encryptData(plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptData decrypts data created by encryptData
+func decryptData(ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("Invalid snapshot length")
+	}
+
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], nil)
+}
@@ -0,0 +1,308 @@
+package reports
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// eventFilter holds the event logging filters from the settings. Events that
+// match any of the filters are dropped in LogEvent before they are queued.
+type eventFilter struct {
+	eventNames   map[string]bool
+	eventPrefix  []string
+	interfaceIDs map[int]bool
+	vlanIDs      map[int]bool
+	zones        map[string]bool
+	networks     []*net.IPNet
+}
+
+// filterInterfaceColumns are the columns checked against the excluded interfaces
+var filterInterfaceColumns = []string{"client_interface_id", "server_interface_id", "interface_id"}
+
+// filterZoneColumns are the columns checked against the excluded zones
+var filterZoneColumns = []string{"client_zone", "server_zone", "zone"}
+
+// filterAddressColumns are the columns checked against the excluded networks
+var filterAddressColumns = []string{"client_address", "server_address", "local_address", "remote_address", "address"}
+
+var filter *eventFilter
+var filterLocker sync.RWMutex
+
+// suppressedSessions holds the IDs of the sessions that must not be logged
+var suppressedSessions sync.Map
+
+// loadEventFilters loads the event logging filters from the settings. VLAN
+// IDs are converted to the interface IDs of the matching VLAN interfaces.
+func loadEventFilters() {
+	fresh := &eventFilter{eventNames: make(map[string]bool), interfaceIDs: make(map[int]bool), vlanIDs: make(map[int]bool), zones: make(map[string]bool)}
+	active := false
+
+	filterJSON, err := settings.GetCurrentSettings([]string{"reports", "filters"})
+	if filterJSON == nil || err != nil {
+		setEventFilter(nil)
+		return
+	}
+
+	item, ok := filterJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid reports filter settings: %T\n", filterJSON)
+		setEventFilter(nil)
+		return
+	}
+
+	for _, value := range getSettingsList(item, "excludeEvents") {
+		if name, ok := value.(string); ok && name != "" {
+			// a trailing asterisk will match all events starting with the name
+			if strings.HasSuffix(name, "*") {
+				fresh.eventPrefix = append(fresh.eventPrefix, strings.TrimSuffix(name, "*"))
+			} else {
+				fresh.eventNames[name] = true
+			}
+			active = true
+		}
+	}
+
+	for _, value := range getSettingsList(item, "excludeInterfaces") {
+		if id, ok := value.(float64); ok {
+			fresh.interfaceIDs[int(id)] = true
+			active = true
+		}
+	}
+
+	// sessions carry the VLAN ID, but other events only have the interface ID
+	vlanList := getSettingsList(item, "excludeVlans")
+	if len(vlanList) != 0 {
+		for _, id := range findVlanInterfaces(vlanList) {
+			fresh.interfaceIDs[id] = true
+			active = true
+		}
+		for _, value := range vlanList {
+			if id, ok := value.(float64); ok && id > 0 {
+				fresh.vlanIDs[int(id)] = true
+				active = true
+			}
+		}
+	}
+
+	for _, value := range getSettingsList(item, "excludeZones") {
+		if name, ok := value.(string); ok && name != "" {
+			fresh.zones[name] = true
+			active = true
+		}
+	}
+
+	for _, value := range getSettingsList(item, "excludeNetworks") {
+		text, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if !strings.Contains(text, "/") {
+			if strings.Contains(text, ":") {
+				text = text + "/128"
+			} else {
+				text = text + "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(text)
+		if err != nil {
+			logger.Warn("Invalid reports filter network %s: %v\n", text, err)
+			continue
+		}
+		fresh.networks = append(fresh.networks, network)
+		active = true
+	}
+
+	if !active {
+		setEventFilter(nil)
+		return
+	}
+
+	logger.Info("Loaded reports event filters: events:%v prefix:%v interfaces:%v vlans:%v zones:%v networks:%v\n", fresh.eventNames, fresh.eventPrefix, fresh.interfaceIDs, fresh.vlanIDs, fresh.zones, fresh.networks)
+	setEventFilter(fresh)
+}
+
+// setEventFilter replaces the active event filter
+func setEventFilter(fresh *eventFilter) {
+	filterLocker.Lock()
+	filter = fresh
+	filterLocker.Unlock()
+}
+
+// isEventFiltered returns true if the event matches any of the event logging filters.
+// UPDATE events usually only have the session_id so they are only checked by name,
+// but dropping the INSERT for a session means any later UPDATE will not match a row.
+func isEventFiltered(event Event) bool {
+	filterLocker.RLock()
+	current := filter
+	filterLocker.RUnlock()
+
+	if current == nil {
+		return false
+	}
+
+	if current.eventNames[event.Name] {
+		return true
+	}
+
+	for _, prefix := range current.eventPrefix {
+		if strings.HasPrefix(event.Name, prefix) {
+			return true
+		}
+	}
+
+	if len(current.interfaceIDs) != 0 {
+		for _, name := range filterInterfaceColumns {
+			if id, ok := getIntegerValue(event.Columns[name]); ok && current.interfaceIDs[id] {
+				return true
+			}
+		}
+	}
+
+	if len(current.vlanIDs) != 0 {
+		if id, ok := getIntegerValue(event.Columns["vlan_id"]); ok && current.vlanIDs[id] {
+			return true
+		}
+	}
+
+	if len(current.zones) != 0 {
+		for _, name := range filterZoneColumns {
+			if zone, ok := event.Columns[name].(string); ok && current.zones[zone] {
+				return true
+			}
+		}
+	}
+
+	if len(current.networks) != 0 {
+		for _, name := range filterAddressColumns {
+			addr := getAddressValue(event.Columns[name])
+			if addr == nil {
+				continue
+			}
+			for _, network := range current.networks {
+				if network.Contains(addr) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// findVlanInterfaces returns the interface IDs of the VLAN interfaces with the argumented VLAN IDs
+func findVlanInterfaces(vlanList []interface{}) []int {
+	var list []int
+
+	networkJSON, err := settings.GetCurrentSettings([]string{"network", "interfaces"})
+	if networkJSON == nil || err != nil {
+		logger.Warn("Unable to read network settings\n")
+		return list
+	}
+
+	networkSlice, ok := networkJSON.([]interface{})
+	if !ok {
+		return list
+	}
+
+	for _, value := range networkSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok || item == nil {
+			continue
+		}
+		// the vlanid may be stored as either a number or a string
+		var vlanid float64
+		switch value := item["vlanid"].(type) {
+		case float64:
+			vlanid = value
+		case string:
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			vlanid = float64(number)
+		default:
+			continue
+		}
+		interfaceID, ok := item["interfaceId"].(float64)
+		if !ok {
+			continue
+		}
+		for _, want := range vlanList {
+			if id, ok := want.(float64); ok && id == vlanid {
+				list = append(list, int(interfaceID))
+			}
+		}
+	}
+
+	return list
+}
+
+// getSettingsList returns the named list from the argumented settings object
+func getSettingsList(item map[string]interface{}, name string) []interface{} {
+	list, ok := item[name].([]interface{})
+	if !ok {
+		return nil
+	}
+	return list
+}
+
+// getIntegerValue converts an event column value to an int
+func getIntegerValue(data interface{}) (int, bool) {
+	switch data.(type) {
+	case int:
+		return data.(int), true
+	case int8:
+		return int(data.(int8)), true
+	case int16:
+		return int(data.(int16)), true
+	case int32:
+		return int(data.(int32)), true
+	case int64:
+		return int(data.(int64)), true
+	case uint8:
+		return int(data.(uint8)), true
+	case uint16:
+		return int(data.(uint16)), true
+	case uint32:
+		return int(data.(uint32)), true
+	}
+	return 0, false
+}
+
+// getAddressValue converts an event column value to an IP address
+func getAddressValue(data interface{}) net.IP {
+	switch data.(type) {
+	case net.IP:
+		return data.(net.IP)
+	case string:
+		return net.ParseIP(data.(string))
+	}
+	return nil
+}
+
+// SuppressSession drops every event for the argumented session ID until
+// UnsuppressSession is called. This is used for the sessions that must
+// never be logged, so only the counters know they happened.
+func SuppressSession(sessionID int64) {
+	suppressedSessions.Store(sessionID, true)
+}
+
+// UnsuppressSession stops dropping the events for the argumented session ID
+func UnsuppressSession(sessionID int64) {
+	suppressedSessions.Delete(sessionID)
+}
+
+// isEventSuppressed returns true if the event belongs to a suppressed session
+func isEventSuppressed(event Event) bool {
+	sessionID, ok := event.Columns["session_id"].(int64)
+	if !ok {
+		return false
+	}
+	_, found := suppressedSessions.Load(sessionID)
+	return found
+}
@@ -0,0 +1,66 @@
+package reports
+
+import (
+	"strings"
+	"time"
+)
+
+// FirewallFilter holds the conditions for a firewall log query. Empty
+// strings and a zero rule ID match everything. The zone and address match
+// either side of the event.
+type FirewallFilter struct {
+	StartTime time.Time
+	EndTime   time.Time
+	Table     string
+	Chain     string
+	RuleID    int
+	Action    string
+	Zone      string
+	Address   string
+	Limit     int
+}
+
+// GetFirewallEvents returns the firewall log events that match the filter
+// with the most recent events first
+func GetFirewallEvents(filter FirewallFilter) ([]map[string]interface{}, error) {
+	conditions := []string{"time_stamp >= ?", "time_stamp < ?"}
+	values := []interface{}{prepareEventValues(filter.StartTime), prepareEventValues(filter.EndTime)}
+
+	if filter.Table != "" {
+		conditions = append(conditions, "table_name = ?")
+		values = append(values, filter.Table)
+	}
+	if filter.Chain != "" {
+		conditions = append(conditions, "chain_name = ?")
+		values = append(values, filter.Chain)
+	}
+	if filter.RuleID != 0 {
+		conditions = append(conditions, "rule_id = ?")
+		values = append(values, filter.RuleID)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		values = append(values, filter.Action)
+	}
+	if filter.Zone != "" {
+		conditions = append(conditions, "(client_zone = ? OR server_zone = ?)")
+		values = append(values, filter.Zone, filter.Zone)
+	}
+	if filter.Address != "" {
+		conditions = append(conditions, "(client_address = ? OR server_address = ?)")
+		values = append(values, filter.Address, filter.Address)
+	}
+
+	sqlStr := "SELECT * FROM firewall_events WHERE " + strings.Join(conditions, " AND ") + " ORDER BY time_stamp DESC"
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, filter.Limit)
+}
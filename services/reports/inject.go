@@ -0,0 +1,42 @@
+//go:build integration
+// +build integration
+
+package reports
+
+import (
+	"math"
+	"time"
+)
+
+// WaitForEvents waits for the event queue to drain so tests can check the
+// database after logging events. It returns false if the timeout expires.
+func WaitForEvents(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if len(eventQueue) == 0 {
+			// give the event logger time to finish writing the last event
+			time.Sleep(100 * time.Millisecond)
+			if len(eventQueue) == 0 {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+// QueryRows runs the argumented query against the reports database and returns all of the rows
+func QueryRows(query string, args ...interface{}) ([]map[string]interface{}, error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, math.MaxInt32)
+}
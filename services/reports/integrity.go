@@ -0,0 +1,302 @@
+package reports
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The database is checked when the service starts, which also reads all of
+// it so the first queries don't wait for the pages to be loaded. When the
+// check finds a problem the indexes are rebuilt first, since that fixes the
+// common damage without losing anything. If that isn't enough the readable
+// content, including what is still in the WAL, is copied to a new database.
+// As the last resort the damaged database is moved aside and a new one is
+// created. The outcome is kept for the health API.
+
+// The results of the database check
+const (
+	IntegrityOK            = "ok"
+	IntegrityRepaired      = "repaired"
+	IntegrityRebuilt       = "rebuilt"
+	IntegrityReinitialized = "reinitialized"
+	IntegrityFailed        = "failed"
+)
+
+// IntegrityStatus holds the result of the database check done at startup
+type IntegrityStatus struct {
+	Time      time.Time `json:"time"`
+	Result    string    `json:"result"`
+	Problems  []string  `json:"problems,omitempty"`
+	Preserved string    `json:"preserved,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// the number of problems the check reports
+const integrityProblemLimit = 10
+
+// the damaged database is kept here when it can't be recovered
+const corruptFilename = dbFilename + ".corrupt"
+
+var integrity IntegrityStatus
+var integrityLocker sync.Mutex
+
+// checkDatabase checks the database that was just opened and recovers it if
+// it is damaged. The database may be closed and opened again.
+func checkDatabase() {
+	status := IntegrityStatus{Time: time.Now(), Result: IntegrityOK}
+	defer func() {
+		integrityLocker.Lock()
+		integrity = status
+		integrityLocker.Unlock()
+	}()
+
+	problems, err := quickCheck(db)
+	if err != nil {
+		status.Result = IntegrityFailed
+		status.Error = err.Error()
+		logger.Err("Unable to check the reports database: %s\n", err.Error())
+		return
+	}
+	if len(problems) == 0 {
+		logger.Info("Checked the reports database: ok\n")
+		return
+	}
+
+	status.Problems = problems
+	logger.Err("The reports database is damaged: %s\n", strings.Join(problems, "; "))
+
+	// damaged indexes are the most common problem and are simply rebuilt
+	if _, err = db.Exec("REINDEX"); err == nil {
+		if problems, err = quickCheck(db); err == nil && len(problems) == 0 {
+			status.Result = IntegrityRepaired
+			logger.Notice("Repaired the reports database by rebuilding the indexes\n")
+			return
+		}
+	}
+
+	err = rebuildDatabase()
+	if err == nil {
+		status.Result = IntegrityRebuilt
+		logger.Notice("Rebuilt the reports database\n")
+		return
+	}
+	logger.Warn("Unable to rebuild the reports database: %s\n", err.Error())
+
+	err = reinitializeDatabase()
+	if err != nil {
+		status.Result = IntegrityFailed
+		status.Error = err.Error()
+		logger.Err("Unable to reinitialize the reports database: %s\n", err.Error())
+		return
+	}
+	status.Result = IntegrityReinitialized
+	status.Preserved = corruptFilename
+	logger.Notice("Reinitialized the reports database, the damaged database was moved to %s\n", corruptFilename)
+}
+
+// quickCheck returns the problems found in the database. A database too
+// damaged to be checked at all returns the error as the problem.
+func quickCheck(conn *sql.DB) ([]string, error) {
+	rows, err := conn.Query(fmt.Sprintf("PRAGMA quick_check(%d)", integrityProblemLimit))
+	if err != nil {
+		if isCorruptError(err) {
+			return []string{err.Error()}, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err = rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		if isCorruptError(err) {
+			return append(problems, err.Error()), nil
+		}
+		return nil, err
+	}
+	return problems, nil
+}
+
+// isCorruptError returns true if the error means the database file is damaged
+func isCorruptError(err error) bool {
+	text := err.Error()
+	return strings.Contains(text, "malformed") || strings.Contains(text, "not a database")
+}
+
+// rebuildDatabase copies what can be read from the database to a new file
+// and replaces the database with it if the copy passes the check. The tables
+// are copied row by row and the indexes are created again in the copy, so
+// damaged indexes are left behind, and a table that can't be read is left
+// empty instead of failing the rebuild.
+func rebuildDatabase() error {
+	rebuilt := dbFilename + ".rebuild"
+	removeDatabaseFiles(rebuilt)
+
+	err := copyDatabase(rebuilt)
+	if err == nil {
+		var check *sql.DB
+		var problems []string
+		check, err = sql.Open(driverName, rebuilt)
+		if err == nil {
+			problems, err = quickCheck(check)
+			check.Close()
+		}
+		if err == nil && len(problems) != 0 {
+			err = fmt.Errorf("the copy is damaged: %s", strings.Join(problems, "; "))
+		}
+	}
+	if err != nil {
+		removeDatabaseFiles(rebuilt)
+		return err
+	}
+
+	db.Close()
+	removeDatabaseFiles(dbFilename)
+	if err = os.Rename(rebuilt, dbFilename); err != nil {
+		return err
+	}
+	return openDatabase()
+}
+
+// copyDatabase creates the tables of the database in the argumented file,
+// copies their rows, and then creates the indexes
+func copyDatabase(filename string) error {
+	type schemaEntry struct {
+		kind string
+		name string
+		sql  string
+	}
+	var entries []schemaEntry
+
+	rows, err := db.Query("SELECT type, name, sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var entry schemaEntry
+		if err = rows.Scan(&entry.kind, &entry.name, &entry.sql); err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	target, err := sql.Open(driverName, filename)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	for _, entry := range entries {
+		if entry.kind != "table" {
+			continue
+		}
+		if _, err = target.Exec(entry.sql); err != nil {
+			return err
+		}
+	}
+
+	// the attached database only exists on one connection
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(context.Background(), "ATTACH DATABASE '"+filename+"' AS rebuild"); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.kind != "table" {
+			continue
+		}
+		_, err = conn.ExecContext(context.Background(), "INSERT INTO rebuild."+entry.name+" SELECT * FROM main."+entry.name)
+		if err != nil {
+			logger.Warn("Unable to copy the %s table, its events are lost: %s\n", entry.name, err.Error())
+		}
+	}
+	if _, err = conn.ExecContext(context.Background(), "DETACH DATABASE rebuild"); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.kind == "table" {
+			continue
+		}
+		if _, err = target.Exec(entry.sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reinitializeDatabase moves the damaged database aside, replacing the one
+// moved aside before, and opens a new empty database
+func reinitializeDatabase() error {
+	db.Close()
+
+	removeDatabaseFiles(corruptFilename)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(dbFilename+suffix, corruptFilename+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return openDatabase()
+}
+
+// openDatabase opens the database for writing
+func openDatabase() error {
+	var err error
+	db, err = sql.Open(driverName, dbFilename+writerOptions)
+	if err != nil {
+		return err
+	}
+	return db.Ping()
+}
+
+// removeDatabaseFiles removes a database and its WAL files
+func removeDatabaseFiles(filename string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(filename + suffix)
+	}
+}
+
+// GetIntegrityStatus returns the result of the database check done at startup
+func GetIntegrityStatus() IntegrityStatus {
+	integrityLocker.Lock()
+	defer integrityLocker.Unlock()
+	return integrity
+}
+
+// CheckIntegrity returns an error if the database check at startup failed or
+// the database had to be reinitialized, so it can be one of the startup
+// checks the health API reports
+func CheckIntegrity() error {
+	status := GetIntegrityStatus()
+
+	switch status.Result {
+	case IntegrityFailed:
+		return fmt.Errorf("the reports database check failed: %s", status.Error)
+	case IntegrityReinitialized:
+		return fmt.Errorf("the reports database was damaged and was reinitialized: %s", strings.Join(status.Problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package reports
+
+import (
+	"strings"
+	"time"
+)
+
+// LoginFilter holds the conditions for a login event query. Empty strings
+// match everything, and Success is only checked when it is not nil.
+type LoginFilter struct {
+	StartTime time.Time
+	EndTime   time.Time
+	Username  string
+	Address   string
+	Method    string
+	Success   *bool
+	Limit     int
+}
+
+// GetLoginEvents returns the admin login attempts that match the filter with
+// the most recent attempts first
+func GetLoginEvents(filter LoginFilter) ([]map[string]interface{}, error) {
+	conditions := []string{"time_stamp >= ?", "time_stamp < ?"}
+	values := []interface{}{prepareEventValues(filter.StartTime), prepareEventValues(filter.EndTime)}
+
+	if filter.Username != "" {
+		conditions = append(conditions, "username = ?")
+		values = append(values, filter.Username)
+	}
+	if filter.Address != "" {
+		conditions = append(conditions, "source_address = ?")
+		values = append(values, filter.Address)
+	}
+	if filter.Method != "" {
+		conditions = append(conditions, "method = ?")
+		values = append(values, filter.Method)
+	}
+	if filter.Success != nil {
+		conditions = append(conditions, "success = ?")
+		values = append(values, *filter.Success)
+	}
+
+	sqlStr := "SELECT * FROM login_events WHERE " + strings.Join(conditions, " AND ") + " ORDER BY time_stamp DESC"
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, filter.Limit)
+}
@@ -0,0 +1,24 @@
+package reports
+
+import (
+	"time"
+)
+
+// GetNeighborEvents returns the neighbor events since the argumented time with
+// the most recent first. The kind limits the events to one kind when it is
+// not empty, like gateway for the gateway impersonations.
+func GetNeighborEvents(startTime time.Time, kind string, limit int) ([]map[string]interface{}, error) {
+	sqlStr := "SELECT time_stamp, kind, address, interface, old_mac, new_mac, evidence, blocked FROM neighbor_events " +
+		"WHERE time_stamp >= ? AND (? = '' OR kind = ?) ORDER BY time_stamp DESC"
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, prepareEventValues(startTime), kind, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, limit)
+}
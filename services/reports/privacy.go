@@ -0,0 +1,201 @@
+package reports
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// privacyConfig holds the anonymization configuration from the settings
+type privacyConfig struct {
+	enabled  bool
+	mode     string
+	rotation int
+	tables   map[string][]string
+}
+
+// defaultPrivacyTables are the columns that identify a client in each table
+var defaultPrivacyTables = map[string][]string{
+	"sessions":        {"client_address", "client_address_new", "local_address", "hostname", "username"},
+	"vpn_stats":       {"client_address"},
+	"dhcp_leases":     {"mac_address", "address", "hostname"},
+	"usage_daily":     {"mac_address", "address", "hostname"},
+	"usage_monthly":   {"mac_address", "address", "hostname"},
+	"app_connections": {"mac_address", "address", "hostname"},
+}
+
+var privacy privacyConfig
+var privacySalt []byte
+var privacySaltTime time.Time
+var privacyMutex sync.Mutex
+
+// loadPrivacyConfig loads the anonymization settings. It is called at startup
+// and when the settings are reloaded, while events are being logged.
+func loadPrivacyConfig() {
+	config := readPrivacyConfig()
+
+	privacyMutex.Lock()
+	privacy = config
+	privacyMutex.Unlock()
+
+	if config.enabled {
+		logger.Info("Reports privacy mode enabled: %s rotation:%d tables:%v\n", config.mode, config.rotation, config.tables)
+	}
+}
+
+// readPrivacyConfig returns the anonymization settings
+func readPrivacyConfig() privacyConfig {
+	config := privacyConfig{mode: "hash", rotation: 86400, tables: defaultPrivacyTables}
+
+	privacyJSON, err := settings.GetCurrentSettings([]string{"reports", "privacy"})
+	if privacyJSON == nil || err != nil {
+		return config
+	}
+
+	item, ok := privacyJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid reports privacy settings: %T\n", privacyJSON)
+		return config
+	}
+
+	if value, ok := item["enabled"].(bool); ok {
+		config.enabled = value
+	}
+	if value, ok := item["mode"].(string); ok && (value == "hash" || value == "truncate") {
+		config.mode = value
+	}
+	if value, ok := item["saltRotation"].(float64); ok && value > 0 {
+		config.rotation = int(value)
+	}
+	if value, ok := item["tables"].(map[string]interface{}); ok {
+		config.tables = make(map[string][]string)
+		for table, list := range value {
+			columns, ok := list.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, column := range columns {
+				if name, ok := column.(string); ok {
+					config.tables[table] = append(config.tables[table], name)
+				}
+			}
+		}
+	}
+
+	return config
+}
+
+// anonymizeEvent returns the event with the client identifying columns for the
+// event table hashed or truncated. The original column maps are not modified.
+func anonymizeEvent(event Event) Event {
+	privacyMutex.Lock()
+	config := privacy
+	privacyMutex.Unlock()
+
+	if !config.enabled {
+		return event
+	}
+
+	columns, found := config.tables[event.Table]
+	if !found {
+		return event
+	}
+
+	event.Columns = anonymizeColumns(event.Columns, columns, config)
+	event.ModifiedColumns = anonymizeColumns(event.ModifiedColumns, columns, config)
+	return event
+}
+
+// anonymizeColumns returns a copy of the argumented map with the named columns anonymized
+func anonymizeColumns(source map[string]interface{}, columns []string, config privacyConfig) map[string]interface{} {
+	if source == nil {
+		return nil
+	}
+
+	target := make(map[string]interface{}, len(source))
+	for k, v := range source {
+		target[k] = v
+	}
+
+	for _, name := range columns {
+		value, found := target[name]
+		if !found || value == nil {
+			continue
+		}
+		target[name] = anonymizeValue(name, value, config)
+	}
+
+	return target
+}
+
+// anonymizeValue hashes or truncates a single value. Truncating keeps the
+// network part of IP addresses and the vendor part of MAC addresses. Values
+// that can't be truncated in a meaningful way like hostnames are always hashed.
+func anonymizeValue(name string, value interface{}, config privacyConfig) interface{} {
+	var text string
+
+	switch value.(type) {
+	case net.IP:
+		text = value.(net.IP).String()
+	case net.HardwareAddr:
+		text = value.(net.HardwareAddr).String()
+	case string:
+		text = value.(string)
+	default:
+		return value
+	}
+
+	if text == "" {
+		return text
+	}
+
+	if config.mode == "truncate" {
+		if ip := net.ParseIP(text); ip != nil {
+			if ip.To4() != nil {
+				return ip.Mask(net.CIDRMask(24, 32)).String()
+			}
+			return ip.Mask(net.CIDRMask(48, 128)).String()
+		}
+		if mac, err := net.ParseMAC(text); err == nil && strings.Contains(name, "mac") {
+			for x := 3; x < len(mac); x++ {
+				mac[x] = 0
+			}
+			return mac.String()
+		}
+	}
+
+	return hashValue(text, config.rotation)
+}
+
+// hashValue returns a keyed hash of the argumented value. The salt is replaced
+// with a new random value at every rotation interval so hashed values can't be
+// linked across intervals, but the same value hashes the same way within an
+// interval so aggregate reports still work.
+func hashValue(text string, rotation int) string {
+	privacyMutex.Lock()
+	if privacySalt == nil || time.Now().Sub(privacySaltTime) > time.Duration(rotation)*time.Second {
+		salt := make([]byte, 32)
+		_, err := io.ReadFull(rand.Reader, salt)
+		if err != nil {
+			logger.Warn("Unable to create privacy salt: %s\n", err.Error())
+		} else {
+			logger.Info("Rotating reports privacy salt\n")
+			privacySalt = salt
+			privacySaltTime = time.Now()
+		}
+	}
+	mac := hmac.New(sha256.New, privacySalt)
+	privacyMutex.Unlock()
+
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
@@ -0,0 +1,119 @@
+package reports
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// QueryStats holds the resources used by a report query. The execution time
+// is the time spent in the database running the query and reading the rows,
+// not the time the query was open waiting for the client to fetch them. The
+// memory used by one query can't be told apart from the rest of the process
+// so the size of the data returned is kept instead, along with the largest
+// single fetch which is what the query held at once.
+type QueryStats struct {
+	ID        uint64          `json:"id"`
+	Scope     string          `json:"scope,omitempty"`
+	Query     json.RawMessage `json:"query"`
+	SQL       string          `json:"sql"`
+	Started   time.Time       `json:"started"`
+	Execution int64           `json:"executionMilliseconds"`
+	Rows      int             `json:"rows"`
+	Fetches   int             `json:"fetches"`
+	Bytes     int             `json:"bytes"`
+	PeakBytes int             `json:"peakBytes"`
+
+	execution time.Duration
+}
+
+// the queries that run longer than this are logged, zero logs none
+const defaultSlowQueryMilliseconds = 1000
+
+// the number of slow queries kept for the API
+const slowQueryHistory = 50
+
+var slowQueryThreshold = defaultSlowQueryMilliseconds * time.Millisecond
+var slowQueries []QueryStats
+var slowQueriesLock sync.Mutex
+
+// loadSlowQueryConfig loads the slow query threshold from the settings
+func loadSlowQueryConfig() {
+	slowQueryThreshold = defaultSlowQueryMilliseconds * time.Millisecond
+
+	value, err := settings.GetCurrentSettings([]string{"reports", "slowQueryMilliseconds"})
+	if value == nil || err != nil {
+		return
+	}
+
+	msec, ok := value.(float64)
+	if !ok || msec < 0 {
+		logger.Warn("Invalid reports slow query settings: %v\n", value)
+		return
+	}
+	slowQueryThreshold = time.Duration(msec) * time.Millisecond
+}
+
+// startQueryStats sets the stats of a query that was just run
+func startQueryStats(query *Query, reportEntryStr string, sqlStr string, started time.Time) {
+	query.stats = QueryStats{
+		ID:        query.ID,
+		Scope:     query.scope,
+		Query:     json.RawMessage(reportEntryStr),
+		SQL:       sqlStr,
+		Started:   started,
+		execution: time.Since(started),
+	}
+}
+
+// addQueryFetch adds the rows read by one GetData call to the stats of a query
+func addQueryFetch(query *Query, rows int, bytes int, elapsed time.Duration) {
+	queriesLock.Lock()
+	defer queriesLock.Unlock()
+
+	query.stats.execution += elapsed
+	query.stats.Rows += rows
+	query.stats.Fetches++
+	query.stats.Bytes += bytes
+	if bytes > query.stats.PeakBytes {
+		query.stats.PeakBytes = bytes
+	}
+}
+
+// finishQueryStats logs the query if it was slow and keeps it for the API.
+// The caller must hold the queriesLock.
+func finishQueryStats(query *Query) {
+	stats := query.stats
+	stats.Execution = int64(stats.execution / time.Millisecond)
+
+	logger.Debug("Query %d: %dms %d rows %d bytes\n", stats.ID, stats.Execution, stats.Rows, stats.Bytes)
+	if slowQueryThreshold == 0 || stats.execution < slowQueryThreshold {
+		return
+	}
+
+	overseer.AddCounter("reports_slow_queries", 1)
+	logger.Warn("Slow report query %d: %dms %d rows %d bytes: %s\n", stats.ID, stats.Execution, stats.Rows, stats.Bytes, string(stats.Query))
+
+	slowQueriesLock.Lock()
+	slowQueries = append(slowQueries, stats)
+	if len(slowQueries) > slowQueryHistory {
+		slowQueries = slowQueries[len(slowQueries)-slowQueryHistory:]
+	}
+	slowQueriesLock.Unlock()
+}
+
+// GetSlowQueries returns the recent slow queries with the most recent first
+func GetSlowQueries() []QueryStats {
+	slowQueriesLock.Lock()
+	defer slowQueriesLock.Unlock()
+
+	list := make([]QueryStats, 0, len(slowQueries))
+	for index := len(slowQueries) - 1; index >= 0; index-- {
+		list = append(list, slowQueries[index])
+	}
+	return list
+}
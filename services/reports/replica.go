@@ -0,0 +1,93 @@
+package reports
+
+import (
+	"database/sql"
+	"os"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The reports can be served by a process separate from packetd that opens
+// the database read only, so the heavy ad-hoc queries run on a busy box don't
+// hold up the event logging. The database is kept in WAL mode where a reader
+// works from a snapshot and never blocks the writer, in this process or the
+// other. The WAL is copied back into the database by the checkpoints, but a
+// checkpoint can't go past the snapshot of a reader that is still running, so
+// the writer forces one when the WAL grows past the limit and after a trim.
+
+// the options the writer and the readers open the database with. The driver
+// sets the journal mode on every connection so the readers must give it too
+// or they would try to take the database out of WAL mode.
+const writerOptions = "?_journal_mode=WAL&_busy_timeout=5000"
+const readerOptions = "?mode=ro&_journal_mode=WAL&_query_only=1&_busy_timeout=5000"
+
+// the WAL size that forces a checkpoint
+const walLimit = 1048576 * 16
+
+// StartupReader opens the reports database read only to serve the queries
+// from a process other than packetd, which creates the database and logs the
+// events. Nothing else in the service is started.
+func StartupReader() error {
+	if _, err := os.Stat(dbFilename); err != nil {
+		return err
+	}
+	loadSlowQueryConfig()
+
+	var err error
+	db, err = sql.Open(driverName, "file:"+dbFilename+readerOptions)
+	if err != nil {
+		return err
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+
+	logger.Info("Opened the reports database read only: %s\n", dbFilename)
+	return nil
+}
+
+// ShutdownReader closes the open queries and the database opened by StartupReader
+func ShutdownReader() {
+	queriesLock.RLock()
+	var list []*Query
+	for _, query := range queries {
+		list = append(list, query)
+	}
+	queriesLock.RUnlock()
+
+	for _, query := range list {
+		cleanupQuery(query)
+	}
+	db.Close()
+}
+
+// getWALSize returns the size of the WAL file of the database
+func getWALSize() int64 {
+	info, err := os.Stat(dbFilename + "-wal")
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// checkpointWAL copies the WAL into the database and truncates it, and
+// returns false if it didn't finish. A reader that is still using an older
+// snapshot stops the checkpoint short, and the rest is copied by the next
+// one. The caller must hold the dbLock.
+func checkpointWAL() bool {
+	var busy, pages, copied int
+
+	err := db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &pages, &copied)
+	if err != nil {
+		logger.Warn("Failed to checkpoint the WAL: %s\n", err.Error())
+		return false
+	}
+
+	if busy != 0 {
+		logger.Debug("WAL checkpoint blocked by a reader, copied %d of %d pages\n", copied, pages)
+		return false
+	}
+	return true
+}
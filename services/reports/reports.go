@@ -18,9 +18,11 @@ import (
 	"time"
 
 	_ "github.com/mattn/go-sqlite3" // blank import required for runtime binding
+	"github.com/untangle/packetd/services/faults"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/settings"
+	"github.com/untangle/packetd/services/supervisor"
 )
 
 // Event stores an arbitrary event
@@ -30,18 +32,29 @@ type Event struct {
 	// Table - the DB table that this event modifies (or nil)
 	Table string `json:"table"`
 	// SQLOp - the SQL operation needed to serialize the event to the DB
-	// 1 - INSERT // 2 - UPDATE
+	// 1 - INSERT // 2 - UPDATE // 3 - UPSERT
 	SQLOp int `json:"sqlOp"`
-	// The columns in the DB this inserts for INSERTS or qualifies if matches for UPDATES
+	// The columns in the DB this inserts for INSERTS or qualifies if matches for UPDATES and UPSERTS
 	Columns map[string]interface{} `json:"columns"`
-	// The columns to modify for UPDATE events
+	// The columns to modify for UPDATE events. For UPSERT events these are inserted
+	// along with the Columns for new rows, and for existing rows numeric values
+	// are added to the current values while all others replace them, except the
+	// KeepFirst values which only replace an empty value.
 	ModifiedColumns map[string]interface{} `json:"modifiedColumns"`
 }
 
+// KeepFirst wraps a modified column of an UPSERT event that keeps the value
+// of the first event for the row, like the time a row was first seen
+type KeepFirst struct {
+	Value interface{} `json:"value"`
+}
+
 // Query holds the results of a database query operation
 type Query struct {
-	ID   uint64
-	Rows *sql.Rows
+	ID    uint64
+	Rows  *sql.Rows
+	scope string
+	stats QueryStats
 }
 
 // QueryCategoriesOptions stores the query options for CATEGORY type reports
@@ -94,6 +107,9 @@ type ReportEntry struct {
 	QueryCategories      QueryCategoriesOptions       `json:"queryCategories"`
 	QueryText            QueryTextOptions             `json:"queryText"`
 	QuerySeries          QuerySeriesOptions           `json:"querySeries"`
+
+	// the subquery used instead of the table for scoped queries
+	scopedTable string
 }
 
 var db *sql.DB
@@ -105,39 +121,104 @@ var eventQueue = make(chan Event, 10000)
 var eventLogCounter = 0
 var cloudQueue = make(chan Event, 1000)
 
+// QueueStatus holds the depth and capacity of the event queues
+type QueueStatus struct {
+	EventDepth    int `json:"eventDepth"`
+	EventCapacity int `json:"eventCapacity"`
+	CloudDepth    int `json:"cloudDepth"`
+	CloudCapacity int `json:"cloudCapacity"`
+}
+
 // EventsLogged records the number of events logged
 var EventsLogged uint64
 
+// EventsFiltered records the number of events dropped by the event logging filters
+var EventsFiltered uint64
+
+// EventsSuppressed records the number of events dropped for sessions that must not be logged
+var EventsSuppressed uint64
+
 // DbFilename is the sqlite db filename
 const dbFilename = "/tmp/reports.db"
 
 // the DB soft size limit
 const dbLimit = 1048576 * 96
 
-// Startup starts the reports service
-func Startup() {
+// the DB hard size limit, over which the tables are trimmed even when their
+// events could not be archived
+const dbEmergencyLimit = 1048576 * 128
+
+// the event logger beats at this interval while waiting for events, and the
+// supervisor allows for a slow database write before it is considered stalled
+const eventHeartbeatInterval = 10 * time.Second
+const eventHeartbeatTimeout = 120 * time.Second
+
+// GetQueueStatus returns the depth and capacity of the event queues
+func GetQueueStatus() QueueStatus {
+	return QueueStatus{
+		EventDepth:    len(eventQueue),
+		EventCapacity: cap(eventQueue),
+		CloudDepth:    len(cloudQueue),
+		CloudCapacity: cap(cloudQueue),
+	}
+}
+
+// GetDatabaseFilename returns the filename of the reports database
+func GetDatabaseFilename() string {
+	return dbFilename
+}
+
+// Startup starts the reports service. An error is returned if the database
+// can't be opened, before anything else is started, so it can be retried.
+func Startup() error {
 	var err error
-	db, err = sql.Open("sqlite3", dbFilename)
 
+	db, err = sql.Open(driverName, dbFilename+writerOptions)
 	if err != nil {
 		logger.Err("Failed to open database: %s\n", err.Error())
+		return err
 	}
 
+	startEncryption()
+	loadPrivacyConfig()
+	loadEventFilters()
+	loadSlowQueryConfig()
+	checkDatabase()
+
 	go func() {
 		createTables()
+		supervisor.Register("reports", eventHeartbeatTimeout)
 		go eventLogger()
 		go dbCleaner()
+		startAlertSink()
+		startArchive()
+		startDedup()
 		if !kernel.FlagNoCloud {
 			go cloudSender()
 		}
 	}()
+
+	return nil
 }
 
 // Shutdown stops the reports service
 func Shutdown() {
+	supervisor.Unregister("reports")
+	stopAlertSink()
+	stopArchive()
+	stopDedup()
+	flushEvents(5 * time.Second)
+	stopEncryption()
 	db.Close()
 }
 
+// Reload reloads the reports settings that can be changed while the events
+// are being logged
+func Reload() {
+	loadPrivacyConfig()
+	loadEventFilters()
+}
+
 func unmarshall(reportEntryStr string, reportEntry *ReportEntry) error {
 	decoder := json.NewDecoder(strings.NewReader(reportEntryStr))
 	decoder.UseNumber()
@@ -151,6 +232,12 @@ func unmarshall(reportEntryStr string, reportEntry *ReportEntry) error {
 
 // CreateQuery submits a database query and returns the results
 func CreateQuery(reportEntryStr string) (*Query, error) {
+	return CreateScopedQuery(reportEntryStr, nil)
+}
+
+// CreateScopedQuery submits a database query that only returns the events in
+// the argumented scope, or every event if the scope is nil
+func CreateScopedQuery(reportEntryStr string, scope *Scope) (*Query, error) {
 	var err error
 	reportEntry := &ReportEntry{}
 
@@ -174,6 +261,15 @@ func CreateQuery(reportEntryStr string) (*Query, error) {
 	// Hold RLock, gets unlocked in CloseQuery/cleanupQuery
 	dbLock.RLock()
 
+	if scope != nil {
+		err = applyScope(reportEntry, scope)
+		if err != nil {
+			logger.Warn("Invalid scoped query for %s: %v\n", scope.Name, err)
+			dbLock.RUnlock()
+			return nil, err
+		}
+	}
+
 	sqlStr, err = makeSQLString(reportEntry)
 	if err != nil {
 		logger.Warn("Failed to make SQL: %v\n", err)
@@ -183,6 +279,7 @@ func CreateQuery(reportEntryStr string) (*Query, error) {
 	values := conditionValues(reportEntry.Conditions)
 
 	logger.Info("SQL: %v %v\n", sqlStr, values)
+	started := time.Now()
 	rows, err = db.Query(sqlStr, values...)
 	if err != nil {
 		logger.Err("db.Query error: %s\n", err)
@@ -195,6 +292,10 @@ func CreateQuery(reportEntryStr string) (*Query, error) {
 	q := new(Query)
 	q.ID = atomic.AddUint64(&queryID, 1)
 	q.Rows = rows
+	if scope != nil {
+		q.scope = scope.Name
+	}
+	startQueryStats(q, reportEntryStr, sqlStr, started)
 
 	queriesLock.Lock()
 	queries[q.ID] = q
@@ -215,6 +316,7 @@ func GetData(queryID uint64) (string, error) {
 		logger.Warn("Query not found: %d\n", queryID)
 		return "", errors.New("Query ID not found")
 	}
+	started := time.Now()
 	result, err := getRows(q.Rows, 1000)
 	if err != nil {
 		return "", err
@@ -223,6 +325,7 @@ func GetData(queryID uint64) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	addQueryFetch(q, len(result), len(jsonData), time.Since(started))
 
 	return string(jsonData), nil
 }
@@ -248,6 +351,29 @@ func CreateEvent(name string, table string, sqlOp int, columns map[string]interf
 
 // LogEvent adds an event to the eventQueue for later logging
 func LogEvent(event Event) error {
+	if isEventFiltered(event) {
+		atomic.AddUint64(&EventsFiltered, 1)
+		return nil
+	}
+
+	if isEventSuppressed(event) {
+		atomic.AddUint64(&EventsSuppressed, 1)
+		return nil
+	}
+
+	// the client columns are anonymized before the event is held by the
+	// deduplication or the queue, or shows up in a warning
+	event = anonymizeEvent(event)
+
+	if deduplicateEvent(event) {
+		return nil
+	}
+
+	return queueEvent(event)
+}
+
+// queueEvent adds an event to the eventQueue
+func queueEvent(event Event) error {
 	select {
 	case eventQueue <- event:
 	default:
@@ -261,8 +387,18 @@ func LogEvent(event Event) error {
 // eventLogger readns from the eventQueue and logs the events to sqlite
 func eventLogger() {
 	var summary string
+	ticker := time.NewTicker(eventHeartbeatInterval)
+	defer ticker.Stop()
+
 	for {
-		event := <-eventQueue
+		var event Event
+		select {
+		case event = <-eventQueue:
+		case <-ticker.C:
+			supervisor.Beat("reports")
+			continue
+		}
+
 		summary = event.Name + "|" + event.Table + "|"
 		if event.SQLOp == 1 {
 			str, err := json.Marshal(event.Columns)
@@ -278,6 +414,14 @@ func eventLogger() {
 				logger.Warn("ERROR: %s\n", err.Error())
 			}
 		}
+		if event.SQLOp == 3 {
+			str, err := json.Marshal(event.ModifiedColumns)
+			if err == nil {
+				summary = summary + "UPSERT: " + string(str)
+			} else {
+				logger.Warn("ERROR: %s\n", err.Error())
+			}
+		}
 		logger.Debug("Log Event: %s %v\n", summary, event.SQLOp)
 		atomic.AddUint64(&EventsLogged, 1)
 
@@ -287,12 +431,32 @@ func eventLogger() {
 			runSQL("PRAGMA shrink_memory;")
 		}
 
+		if err := faults.Inject(faults.ReportsInsert, event.Table); err != nil {
+			logger.Warn("Failed to log event: %s %s\n", err.Error(), summary)
+			continue
+		}
+
 		if event.SQLOp == 1 {
 			logInsertEvent(event)
 		}
 		if event.SQLOp == 2 {
 			logUpdateEvent(event)
 		}
+		if event.SQLOp == 3 {
+			logUpsertEvent(event)
+		}
+	}
+}
+
+// flushEvents waits for the events that are still queued to be written so the
+// events logged by the other services as they shut down are not lost
+func flushEvents(timeout time.Duration) {
+	limit := time.Now().Add(timeout)
+	for len(eventQueue) > 0 && time.Now().Before(limit) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(eventQueue) > 0 {
+		logger.Warn("Dropping %d queued events at shutdown\n", len(eventQueue))
 	}
 }
 
@@ -373,6 +537,8 @@ func prepareEventValues(data interface{}) interface{} {
 	// We want to log these as milliseconds since epoch
 	case time.Time:
 		return data.(time.Time).UnixNano() / 1e6
+	case KeepFirst:
+		return prepareEventValues(data.(KeepFirst).Value)
 	default:
 		return data
 	}
@@ -467,6 +633,86 @@ func logUpdateEvent(event Event) {
 	}
 }
 
+// logUpsertEvent inserts a new row or updates the existing row that matches all
+// of the Columns. The table must have a unique index on the Columns.
+func logUpsertEvent(event Event) {
+	var sqlStr = "INSERT INTO " + event.Table + "("
+	var valueStr = "("
+	var keyStr = ""
+	var setStr = ""
+
+	var first = true
+	var values []interface{}
+	for k, v := range event.Columns {
+		if !first {
+			sqlStr += ","
+			valueStr += ","
+			keyStr += ","
+		}
+		sqlStr += k
+		valueStr += "?"
+		keyStr += k
+		first = false
+		values = append(values, prepareEventValues(v))
+	}
+
+	first = true
+	for k, v := range event.ModifiedColumns {
+		sqlStr += "," + k
+		valueStr += ",?"
+		if !first {
+			setStr += ","
+		}
+		if _, ok := v.(KeepFirst); ok {
+			setStr += " " + k + " = coalesce(" + k + ", excluded." + k + ")"
+		} else if isNumericValue(v) {
+			setStr += " " + k + " = " + k + " + excluded." + k
+		} else {
+			setStr += " " + k + " = excluded." + k
+		}
+		first = false
+		values = append(values, prepareEventValues(v))
+	}
+	sqlStr += ")"
+	valueStr += ")"
+	sqlStr += " VALUES " + valueStr
+	sqlStr += " ON CONFLICT(" + keyStr + ")"
+	if len(event.ModifiedColumns) == 0 {
+		sqlStr += " DO NOTHING"
+	} else {
+		sqlStr += " DO UPDATE SET" + setStr
+	}
+
+	dbLock.Lock()
+	defer dbLock.Unlock()
+
+	logger.Debug("SQL: %s\n", sqlStr)
+	stmt, err := db.Prepare(sqlStr)
+	if err != nil {
+		logger.Warn("Failed to prepare statement: %s %s\n", err.Error(), sqlStr)
+		return
+	}
+	_, err = stmt.Exec(values...)
+	if err != nil {
+		logger.Warn("Failed to exec statement: %s %s\n", err.Error(), sqlStr)
+		return
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logger.Warn("Failed to close statement: %s %s\n", err.Error(), sqlStr)
+	}
+}
+
+// isNumericValue returns true if the argumented value is an integer or float type
+func isNumericValue(data interface{}) bool {
+	switch data.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return true
+	}
+	return false
+}
+
 func getRows(rows *sql.Rows, limit int) ([]map[string]interface{}, error) {
 	if rows == nil {
 		return nil, errors.New("Invalid argument")
@@ -516,10 +762,20 @@ func cleanupQuery(query *Query) {
 	if query.Rows != nil {
 		query.Rows.Close()
 		query.Rows = nil
+		finishQueryStats(query)
 	}
 	logger.Debug("cleanupQuery(%d) finished\n", query.ID)
 }
 
+// addColumn adds a column to an existing table if it does not already exist.
+// The caller must hold the dbLock.
+func addColumn(table string, column string, definition string) {
+	_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		logger.Err("Failed to add column %s.%s: %s\n", table, column, err.Error())
+	}
+}
+
 func createTables() {
 	var err error
 
@@ -539,6 +795,9 @@ func createTables() {
 			server_interface_id int default 0,
 			client_interface_type int1 default 0,
 			server_interface_type int1 default 0,
+			vlan_id int default 0,
+			client_zone text,
+			server_zone text,
 			local_address  text,
 			remote_address text,
 			client_address text,
@@ -575,13 +834,46 @@ func createTables() {
 			certificate_subject_cn text,
 			certificate_subject_o text,
 			ssl_sni text,
+			vpn_protocol text,
 			wan_rule_chain string,
 			wan_rule_id integer,
 			wan_policy_id integer,
 			client_hops integer,
 			server_hops integer,
 			client_dns_hint text,
-			server_dns_hint text)`)
+			server_dns_hint text,
+			end_reason text,
+			duration real,
+			total_bytes int8,
+			total_client_bytes int8,
+			total_server_bytes int8,
+			total_packets int8,
+			total_client_packets int8,
+			total_server_packets int8,
+			client_rtt real,
+			server_rtt real,
+			retransmissions int8,
+			duplicate_acks int8,
+			zero_windows int8)`)
+
+	// add the columns that are missing from sessions tables created by older versions
+	addColumn("sessions", "vlan_id", "int default 0")
+	addColumn("sessions", "client_zone", "text")
+	addColumn("sessions", "server_zone", "text")
+	addColumn("sessions", "end_reason", "text")
+	addColumn("sessions", "server_dga_score", "real")
+	addColumn("sessions", "duration", "real")
+	addColumn("sessions", "total_bytes", "int8")
+	addColumn("sessions", "total_client_bytes", "int8")
+	addColumn("sessions", "total_server_bytes", "int8")
+	addColumn("sessions", "total_packets", "int8")
+	addColumn("sessions", "total_client_packets", "int8")
+	addColumn("sessions", "total_server_packets", "int8")
+	addColumn("sessions", "client_rtt", "real")
+	addColumn("sessions", "server_rtt", "real")
+	addColumn("sessions", "retransmissions", "int8")
+	addColumn("sessions", "duplicate_acks", "int8")
+	addColumn("sessions", "zero_windows", "int8")
 
 	// FIXME add domain (SNI + dns_prediction + cert_prediction)
 	// We need a singular "domain" field that takes all the various domain determination methods into account and chooses the best one
@@ -615,64 +907,23 @@ func createTables() {
 	}
 
 	_, err = db.Exec(
-		`CREATE TABLE IF NOT EXISTS interface_stats (
+		`CREATE TABLE IF NOT EXISTS session_intervals (
+			session_id int8 NOT NULL,
 			time_stamp bigint NOT NULL,
-			interface_id int1,
-			device_name text,
-			latency_1 real,
-			latency_5 real,
-			latency_15 real,
-			latency_variance real,
-			passive_latency_1 real,
-			passive_latency_5 real,
-			passive_latency_15 real,
-			passive_latency_variance real,
-			active_latency_1 real,
-			active_latency_5 real,
-			active_latency_15 real,
-			active_latency_variance real,
-			jitter_1 real,
-			jitter_5 real,
-			jitter_15 real,
-			jitter_variance real,
-			ping_timeout int8,
-			ping_timeout_rate int8,
-			rx_bytes int8,
-			rx_bytes_rate int8,
-			rx_packets int8,
-			rx_packets_rate int8,
-			rx_errs int8,
-			rx_errs_rate int8,
-			rx_drop int8,
-			rx_drop_rate int8,
-			rx_fifo int8,
-			rx_fifo_rate int8,
-			rx_frame int8,
-			rx_frame_rate int8,
-			rx_compressed int8,
-			rx_compressed_rate int8,
-			rx_multicast int8,
-			rx_multicast_rate int8,
-			tx_bytes int8,
-			tx_bytes_rate int8,
-			tx_packets int8,
-			tx_packets_rate int8,
-			tx_errs int8,
-			tx_errs_rate int8,
-			tx_drop int8,
-			tx_drop_rate int8,
-			tx_fifo int8,
-			tx_fifo_rate int8,
-			tx_colls int8,
-			tx_colls_rate int8,
-			tx_carrier int8,
-			tx_carrier_rate int8,
-			tx_compressed,
-			tx_compressed_rate int8)`)
+			interval_seconds int4,
+			bytes int8,
+			client_bytes int8,
+			server_bytes int8,
+			packets int8,
+			client_packets int8,
+			server_packets int8)`)
 
 	if err != nil {
 		logger.Err("Failed to create table: %s\n", err.Error())
 	}
+
+	// the tables the plugins and services register are created last
+	migrateRegisteredTables()
 }
 
 // addDefaultTimestampConditions adds time_stamp > X and time_stamp < Y
@@ -749,6 +1000,7 @@ func mergeConditions(reportEntry *ReportEntry) {
 // the predetermined size
 func dbCleaner() {
 	ch := make(chan bool, 1)
+	pending := false
 
 	for {
 		select {
@@ -756,6 +1008,17 @@ func dbCleaner() {
 		case <-time.After(60 * time.Second):
 		}
 
+		// the database file only shrinks once the trim is checkpointed so
+		// the size isn't checked until then
+		if pending || getWALSize() > walLimit {
+			dbLock.Lock()
+			pending = !checkpointWAL()
+			dbLock.Unlock()
+			if pending {
+				continue
+			}
+		}
+
 		dbFile, err := os.Stat(dbFilename)
 		if err != nil {
 			logger.Warn("Error checking DB file: %v\n", err.Error())
@@ -765,25 +1028,88 @@ func dbCleaner() {
 		size := dbFile.Size()
 		logger.Debug("Current DB Size: %.1fM\n", (float32(size) / float32(1024*1024)))
 		if size > dbLimit {
+			cutoffs := getTrimCutoffs()
+			failed := archiveBeforeTrim(cutoffs)
+			skipped := false
 			dbLock.Lock()
-			trimPercent("sessions", .1)
-			trimPercent("session_stats", .1)
-			trimPercent("interface_stats", .1)
+			for _, cutoff := range cutoffs {
+				// keep the events that could not be archived until the database is over the hard limit
+				if failed[cutoff.table] {
+					if size <= dbEmergencyLimit {
+						logger.Warn("%OC|Not trimming %s until its events are archived\n", "reports_trim_skipped", 10, cutoff.table)
+						skipped = true
+						continue
+					}
+					logger.Err("Trimming %s without archiving, the events will be lost\n", cutoff.table)
+				}
+				trimBefore(cutoff.table, cutoff.time)
+			}
 			runSQL("VACUUM")
+			pending = !checkpointWAL()
 			dbLock.Unlock()
 			logger.Info("Trimmed DB.\n")
-			// re-run and check size with no delay
-			ch <- true
+			// re-run and check size with no delay unless we are waiting to retry the archive
+			if !pending && !skipped {
+				ch <- true
+			}
+		}
+	}
+}
+
+// trimCutoff holds the time a table is trimmed up to
+type trimCutoff struct {
+	table string
+	time  time.Time
+}
+
+// trimTables are the tables that are trimmed by 10 percent when the database
+// is too large. The registered tables are trimmed by their own percent.
+var trimTables = []string{
+	"sessions",
+	"session_stats",
+	"session_intervals",
+}
+
+// getTrimCutoffs returns the time each table is trimmed up to, which drops
+// the oldest part of the time range of the table by the trim percent
+func getTrimCutoffs() []trimCutoff {
+	percents := make(map[string]float32)
+	var names []string
+	for _, table := range trimTables {
+		percents[table] = .1
+		names = append(names, table)
+	}
+	for _, schema := range getTrimTables() {
+		if _, ok := percents[schema.Name]; !ok {
+			names = append(names, schema.Name)
+		}
+		percents[schema.Name] = schema.TrimPercent
+	}
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	var list []trimCutoff
+	for _, table := range names {
+		var cutoff interface{}
+		sqlStr := fmt.Sprintf("SELECT min(time_stamp)+cast((max(time_stamp)-min(time_stamp))*%f as int) FROM %s", percents[table], table)
+		if err := db.QueryRow(sqlStr).Scan(&cutoff); err != nil {
+			logger.Warn("Failed to find the trim time of %s: %s\n", table, err.Error())
+			continue
+		}
+		if msec, ok := cutoff.(int64); ok {
+			list = append(list, trimCutoff{table: table, time: time.Unix(0, msec*1e6)})
 		}
 	}
+	return list
 }
 
-// trimPercent trims the specified table by the specified percent (by time)
-// example: trimPercent("sessions",.1) will drop the oldest 10% of events in sessions by time
-func trimPercent(table string, percent float32) {
-	logger.Debug("Trimming %s by %.1f%% percent...\n", table, percent*100.0)
+// trimBefore deletes the events of the table older than the argumented time.
+// The caller must hold the dbLock.
+func trimBefore(table string, cutoff time.Time) {
+	logger.Debug("Trimming %s before %v...\n", table, cutoff)
 
-	sqlStr := fmt.Sprintf("DELETE FROM %s WHERE time_stamp < (SELECT min(time_stamp)+cast((max(time_stamp)-min(time_stamp))*%f as int) from %s)", table, percent, table)
+	sqlStr := fmt.Sprintf("DELETE FROM %s WHERE time_stamp < %d", table, cutoff.UnixNano()/1e6)
 
 	runSQL(sqlStr)
 }
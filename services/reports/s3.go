@@ -0,0 +1,125 @@
+package reports
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Config holds the bucket the archives are uploaded to. Any storage that
+// implements the S3 API with AWS signature version 4 can be used, and the
+// bucket is always addressed by path so the endpoint doesn't need wildcard DNS.
+type s3Config struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+// the timeout for an upload, which runs after the events are read so the
+// database isn't locked while we wait
+const s3Timeout = 60 * time.Second
+
+// s3Put uploads the data to the key in the bucket
+func s3Put(config s3Config, key string, contentType string, data []byte) error {
+	base, err := url.Parse(strings.TrimSuffix(config.endpoint, "/"))
+	if err != nil || base.Host == "" {
+		return fmt.Errorf("invalid S3 endpoint %q", config.endpoint)
+	}
+
+	path := base.Path + "/" + config.bucket + "/" + key
+	request, err := http.NewRequest(http.MethodPut, base.Scheme+"://"+base.Host+s3EscapePath(path), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	request.Header.Set("X-Amz-Date", time.Now().UTC().Format("20060102T150405Z"))
+	request.Header.Set("Authorization", s3Authorization(config, request.Method, request.Host, s3EscapePath(path), "", request.Header))
+
+	client := &http.Client{Timeout: s3Timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("S3 upload of %s failed: %s %s", key, response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// s3Authorization returns the AWS signature version 4 Authorization header
+// for a request. All of the headers are signed along with the host, and the
+// X-Amz-Date and X-Amz-Content-Sha256 headers must already be set.
+func s3Authorization(config s3Config, method string, host string, path string, query string, header http.Header) string {
+	amzDate := header.Get("X-Amz-Date")
+	date := amzDate[:8]
+
+	values := map[string]string{"host": host}
+	for name := range header {
+		values[strings.ToLower(name)] = strings.TrimSpace(header.Get(name))
+	}
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{method, path, query, canonicalHeaders.String(), signedHeaders, header.Get("X-Amz-Content-Sha256")}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + config.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+config.secretKey), date)
+	key = hmacSHA256(key, config.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return "AWS4-HMAC-SHA256 Credential=" + config.accessKey + "/" + scope + ", SignedHeaders=" + signedHeaders + ", Signature=" + signature
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data with the key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes each segment of a path the way S3 expects, which
+// escapes everything but the unreserved characters
+func s3EscapePath(path string) string {
+	var result strings.Builder
+	for _, char := range []byte(path) {
+		switch {
+		case char >= 'A' && char <= 'Z', char >= 'a' && char <= 'z', char >= '0' && char <= '9':
+			result.WriteByte(char)
+		case char == '-' || char == '_' || char == '.' || char == '~' || char == '/':
+			result.WriteByte(char)
+		default:
+			fmt.Fprintf(&result, "%%%02X", char)
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,342 @@
+package reports
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// Column holds a column of an event table. The type is the SQL declaration
+// of the column, like int8 or text NOT NULL.
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// TableSchema holds an event table that a plugin or service logs events to.
+// The tables are created when the reports service starts, and the columns
+// that are missing from a table created by an older version are added. The
+// unique columns get a unique index so the table can be used by UPSERT
+// events, and the oldest rows are trimmed by the trim percent when the
+// database is too large.
+type TableSchema struct {
+	Name        string   `json:"name"`
+	Owner       string   `json:"owner"`
+	Columns     []Column `json:"columns"`
+	Unique      []string `json:"unique,omitempty"`
+	TrimPercent float32  `json:"trimPercent"`
+	Registered  bool     `json:"registered"`
+}
+
+// the tables and columns must be plain identifiers since they are put in the SQL
+var identifierRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+var schemaTable = make(map[string]TableSchema)
+var schemaLocker sync.Mutex
+var schemaReady bool
+
+// RegisterTable adds an event table to the schema registry. The plugins call
+// it from init so the table exists before the first event, and a table that
+// is registered after the reports service started is created right away.
+func RegisterTable(schema TableSchema) error {
+	if err := validateSchema(schema); err != nil {
+		logger.Err("Invalid table schema %s: %v\n", schema.Name, err)
+		return err
+	}
+
+	schema.Registered = true
+
+	schemaLocker.Lock()
+	if existing, ok := schemaTable[schema.Name]; ok && existing.Owner != schema.Owner {
+		schemaLocker.Unlock()
+		err := fmt.Errorf("table %s is already registered by %s", schema.Name, existing.Owner)
+		logger.Err("Invalid table schema %s: %v\n", schema.Name, err)
+		return err
+	}
+	schemaTable[schema.Name] = schema
+	ready := schemaReady
+	schemaLocker.Unlock()
+
+	if ready {
+		dbLock.Lock()
+		err := migrateTable(schema)
+		dbLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// validateSchema checks the names in a table schema. Every table needs a
+// time_stamp column since the reports and the trimming are by time. SQLite
+// can't add a NOT NULL column without a default to an existing table, so
+// those columns are rejected rather than failing when the table is migrated.
+func validateSchema(schema TableSchema) error {
+	if !identifierRegex.MatchString(schema.Name) {
+		return fmt.Errorf("invalid table name")
+	}
+	if schema.TrimPercent < 0 || schema.TrimPercent >= 1 {
+		return fmt.Errorf("invalid trim percent %v", schema.TrimPercent)
+	}
+
+	columns := make(map[string]bool)
+	for _, column := range schema.Columns {
+		if !identifierRegex.MatchString(column.Name) {
+			return fmt.Errorf("invalid column name %q", column.Name)
+		}
+		if columns[column.Name] {
+			return fmt.Errorf("duplicate column %s", column.Name)
+		}
+		if strings.ContainsAny(column.Type, ";,()") || strings.TrimSpace(column.Type) == "" {
+			return fmt.Errorf("invalid type for column %s", column.Name)
+		}
+		declaration := strings.ToUpper(column.Type)
+		if strings.Contains(declaration, "NOT NULL") && !strings.Contains(declaration, "DEFAULT") {
+			return fmt.Errorf("NOT NULL column %s needs a default", column.Name)
+		}
+		columns[column.Name] = true
+	}
+	if !columns["time_stamp"] {
+		return fmt.Errorf("missing time_stamp column")
+	}
+	for _, name := range schema.Unique {
+		if !columns[name] {
+			return fmt.Errorf("unique column %s is not in the table", name)
+		}
+	}
+	return nil
+}
+
+// migrateRegisteredTables creates or updates the registered tables. The
+// caller must hold the dbLock.
+func migrateRegisteredTables() {
+	schemaLocker.Lock()
+	list := getRegisteredTables()
+	schemaReady = true
+	schemaLocker.Unlock()
+
+	for _, schema := range list {
+		migrateTable(schema)
+	}
+}
+
+// getRegisteredTables returns the registered tables sorted by name. The
+// caller must hold the schemaLocker.
+func getRegisteredTables() []TableSchema {
+	var list []TableSchema
+	for _, schema := range schemaTable {
+		list = append(list, schema)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// migrateTable creates a registered table if it doesn't exist and adds the
+// columns that are missing. Columns can't be removed or changed by SQLite, so
+// a column with a different type is only logged. The caller must hold the
+// dbLock.
+func migrateTable(schema TableSchema) error {
+	var definitions []string
+	for _, column := range schema.Columns {
+		definitions = append(definitions, column.Name+" "+column.Type)
+	}
+
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + schema.Name + " (" + strings.Join(definitions, ", ") + ")")
+	if err != nil {
+		logger.Err("Failed to create table: %s\n", err.Error())
+		return err
+	}
+
+	existing, err := getTableColumns(schema.Name)
+	if err != nil {
+		logger.Err("Failed to read table %s: %s\n", schema.Name, err.Error())
+		return err
+	}
+
+	current := make(map[string]string)
+	for _, column := range existing {
+		current[column.Name] = column.Type
+	}
+	for _, column := range schema.Columns {
+		found, ok := current[column.Name]
+		if !ok {
+			logger.Info("Adding column %s.%s\n", schema.Name, column.Name)
+			addColumn(schema.Name, column.Name, column.Type)
+			continue
+		}
+		// columns created without a type by older versions take anything
+		if found != "" && !strings.EqualFold(found, strings.Fields(column.Type)[0]) {
+			logger.Warn("Column %s.%s is %s instead of %s\n", schema.Name, column.Name, found, column.Type)
+		}
+	}
+
+	// tables created by older versions may have a UNIQUE constraint on the
+	// columns which already gives them a unique index
+	if len(schema.Unique) != 0 && !hasUniqueIndex(schema.Name, schema.Unique) {
+		_, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + schema.Name + "_unique ON " + schema.Name + " (" + strings.Join(schema.Unique, ", ") + ")")
+		if err != nil {
+			logger.Err("Failed to create index: %s\n", err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasUniqueIndex returns true if the table has a unique index on exactly the
+// argumented columns. The caller must hold the dbLock.
+func hasUniqueIndex(table string, columns []string) bool {
+	indexes, err := queryPragma("PRAGMA index_list(" + table + ")")
+	if err != nil {
+		logger.Warn("Failed to read the indexes of %s: %s\n", table, err.Error())
+		return false
+	}
+
+	wanted := append([]string{}, columns...)
+	sort.Strings(wanted)
+
+	for _, index := range indexes {
+		// the rows are seq, name, unique and on newer versions origin and partial
+		if len(index) < 3 || fmt.Sprint(index[2]) != "1" {
+			continue
+		}
+		name := fmt.Sprint(index[1])
+		info, err := queryPragma("PRAGMA index_info(\"" + name + "\")")
+		if err != nil {
+			logger.Warn("Failed to read the index %s: %s\n", name, err.Error())
+			continue
+		}
+
+		// the rows are seqno, cid and name
+		var found []string
+		for _, column := range info {
+			if len(column) >= 3 {
+				found = append(found, fmt.Sprint(column[2]))
+			}
+		}
+		sort.Strings(found)
+		if strings.Join(found, ",") == strings.Join(wanted, ",") {
+			return true
+		}
+	}
+	return false
+}
+
+// queryPragma returns the rows of a pragma query with the values of each row
+// in column order. The text values are returned as strings. The caller must
+// hold the dbLock.
+func queryPragma(query string) ([][]interface{}, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var list [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(names))
+		pointers := make([]interface{}, len(names))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			if data, ok := value.([]byte); ok {
+				values[i] = string(data)
+			}
+		}
+		list = append(list, values)
+	}
+	return list, rows.Err()
+}
+
+// getTableColumns returns the columns of a table in the database. The caller
+// must hold the dbLock.
+func getTableColumns(table string) ([]Column, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Column
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var value interface{}
+		var column Column
+		if err = rows.Scan(&cid, &column.Name, &column.Type, &notNull, &value, &primaryKey); err != nil {
+			return nil, err
+		}
+		list = append(list, column)
+	}
+	return list, rows.Err()
+}
+
+// getTrimTables returns the registered tables that are trimmed
+func getTrimTables() []TableSchema {
+	schemaLocker.Lock()
+	defer schemaLocker.Unlock()
+
+	var list []TableSchema
+	for _, schema := range getRegisteredTables() {
+		if schema.TrimPercent > 0 {
+			list = append(list, schema)
+		}
+	}
+	return list
+}
+
+// GetSchema returns the tables in the reports database with the columns they
+// have. The tables that are not registered are created by the reports service.
+func GetSchema() ([]TableSchema, error) {
+	schemaLocker.Lock()
+	registered := make(map[string]TableSchema)
+	for name, schema := range schemaTable {
+		registered[name] = schema
+	}
+	schemaLocker.Unlock()
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	list := []TableSchema{}
+	for _, name := range names {
+		schema, ok := registered[name]
+		if !ok {
+			schema = TableSchema{Name: name, Owner: "reports"}
+		}
+		schema.Columns, err = getTableColumns(name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, schema)
+	}
+
+	return list, nil
+}
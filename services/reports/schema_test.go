@@ -0,0 +1,32 @@
+package reports
+
+import (
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns []Column
+		unique  []string
+		valid   bool
+	}{
+		{"plain", []Column{{"time_stamp", "bigint"}, {"name", "text"}}, nil, true},
+		{"not null with default", []Column{{"time_stamp", "bigint NOT NULL DEFAULT 0"}, {"name", "text not null default ''"}}, []string{"name"}, true},
+		{"not null without default", []Column{{"time_stamp", "bigint NOT NULL"}}, nil, false},
+		{"lower case not null", []Column{{"time_stamp", "bigint"}, {"name", "text not null"}}, nil, false},
+		{"missing time_stamp", []Column{{"name", "text"}}, nil, false},
+		{"duplicate column", []Column{{"time_stamp", "bigint"}, {"time_stamp", "int8"}}, nil, false},
+		{"invalid column name", []Column{{"time_stamp", "bigint"}, {"Name", "text"}}, nil, false},
+		{"constraint in type", []Column{{"time_stamp", "bigint"}, {"name", "text, UNIQUE (name)"}}, nil, false},
+		{"empty type", []Column{{"time_stamp", ""}}, nil, false},
+		{"unknown unique column", []Column{{"time_stamp", "bigint"}}, []string{"name"}, false},
+	}
+
+	for _, test := range tests {
+		err := validateSchema(TableSchema{Name: "test_events", Columns: test.columns, Unique: test.unique, TrimPercent: .1})
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, expected valid %v", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package reports
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Scope restricts the report queries to the events of some zones, VLANs, and
+// networks, so an API token can be given to a tenant that only sees its own
+// traffic. An event is in the scope when any of its zone, VLAN, or address
+// columns match. The events of tables that only have a session_id are in the
+// scope when their session is, and the tables with none of these columns
+// can't be queried with a scope.
+type Scope struct {
+	Name     string
+	Zones    []string
+	VLANs    []int
+	Networks []*net.IPNet
+}
+
+// the driver of the reports database, which adds the in_networks function
+// used to match the addresses of the scopes
+const driverName = "sqlite3_reports"
+
+// the expressions of a scoped query can only use columns, numbers, and
+// functions, so they can't read other tables with a subquery
+var scopedExpressionRegex = regexp.MustCompile(`^[A-Za-z0-9_ .,*+\-/()<>=!]*$`)
+var subqueryRegex = regexp.MustCompile(`(?i)\bselect\b`)
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("in_networks", inNetworks, true)
+		},
+	})
+}
+
+// inNetworks returns true if the address is in one of the comma separated
+// networks. The address is NULL when the column isn't set.
+func inNetworks(address interface{}, networks string) bool {
+	var addr net.IP
+	switch value := address.(type) {
+	case string:
+		addr = net.ParseIP(value)
+	case []byte:
+		addr = net.ParseIP(string(value))
+	}
+	if addr == nil {
+		return false
+	}
+	for _, text := range strings.Split(networks, ",") {
+		_, network, err := net.ParseCIDR(text)
+		if err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyScope checks the expressions of a scoped report entry and replaces the
+// table with a subquery that only has the events in the scope. The caller
+// must hold the dbLock read lock.
+func applyScope(reportEntry *ReportEntry, scope *Scope) error {
+	if !identifierRegex.MatchString(reportEntry.Table) {
+		return errors.New("Scoped queries must use a single table")
+	}
+
+	expressions := []string{
+		reportEntry.QueryCategories.GroupColumn,
+		reportEntry.QueryCategories.AggregationFunction,
+		reportEntry.QueryCategories.AggregationValue,
+	}
+	expressions = append(expressions, reportEntry.QueryText.Columns...)
+	expressions = append(expressions, reportEntry.QuerySeries.Columns...)
+	for _, condition := range reportEntry.Conditions {
+		expressions = append(expressions, condition.Column)
+	}
+	for _, disambi := range reportEntry.ColumnDisambiguation {
+		expressions = append(expressions, disambi.NewColumnName)
+	}
+	for _, expression := range expressions {
+		if !scopedExpressionRegex.MatchString(expression) || subqueryRegex.MatchString(expression) {
+			return errors.New("Invalid expression in scoped query: " + expression)
+		}
+	}
+
+	columns, err := getTableColumns(reportEntry.Table)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return errors.New("Table not found: " + reportEntry.Table)
+	}
+
+	names := make(map[string]bool)
+	for _, column := range columns {
+		names[column.Name] = true
+	}
+
+	where := getScopeSQL(scope, names)
+	if where == "" && names["session_id"] {
+		sessionColumns, err := getTableColumns("sessions")
+		if err != nil {
+			return err
+		}
+		sessionNames := make(map[string]bool)
+		for _, column := range sessionColumns {
+			sessionNames[column.Name] = true
+		}
+		if sessionWhere := getScopeSQL(scope, sessionNames); sessionWhere != "" {
+			where = "session_id IN (SELECT session_id FROM sessions WHERE " + sessionWhere + ")"
+		}
+	}
+	if where == "" {
+		return errors.New("Table can not be queried with a scope: " + reportEntry.Table)
+	}
+
+	reportEntry.scopedTable = "(SELECT * FROM " + reportEntry.Table + " WHERE " + where + ") AS " + reportEntry.Table
+	return nil
+}
+
+// getScopeSQL returns the condition that matches the events in the scope for
+// a table with the argumented columns, or an empty string if the table has
+// none of the zone, VLAN, or address columns
+func getScopeSQL(scope *Scope, columns map[string]bool) string {
+	var found bool
+	var parts []string
+
+	for _, name := range filterZoneColumns {
+		if !columns[name] {
+			continue
+		}
+		found = true
+		if len(scope.Zones) != 0 {
+			var list []string
+			for _, zone := range scope.Zones {
+				list = append(list, "'"+strings.Replace(zone, "'", "''", -1)+"'")
+			}
+			parts = append(parts, name+" IN ("+strings.Join(list, ",")+")")
+		}
+	}
+
+	var vlans []interface{}
+	for _, id := range scope.VLANs {
+		vlans = append(vlans, float64(id))
+	}
+	if columns["vlan_id"] {
+		found = true
+		if len(scope.VLANs) != 0 {
+			parts = append(parts, "vlan_id IN ("+joinIntegers(scope.VLANs)+")")
+		}
+	}
+
+	// the events other than sessions only have the interface ID of the VLAN
+	if !columns["vlan_id"] && len(vlans) != 0 {
+		interfaces := findVlanInterfaces(vlans)
+		for _, name := range filterInterfaceColumns {
+			if columns[name] && len(interfaces) != 0 {
+				parts = append(parts, name+" IN ("+joinIntegers(interfaces)+")")
+			}
+		}
+	}
+
+	var networks []string
+	for _, network := range scope.Networks {
+		networks = append(networks, network.String())
+	}
+	for _, name := range filterAddressColumns {
+		if !columns[name] {
+			continue
+		}
+		found = true
+		if len(networks) != 0 {
+			parts = append(parts, "in_networks("+name+", '"+strings.Join(networks, ",")+"')")
+		}
+	}
+
+	if !found {
+		return ""
+	}
+	if len(parts) == 0 {
+		return "0"
+	}
+	return "(" + strings.Join(parts, " OR ") + ")"
+}
+
+// joinIntegers returns the integers separated by commas
+func joinIntegers(list []int) string {
+	var text []string
+	for _, value := range list {
+		text = append(text, strconv.Itoa(value))
+	}
+	return strings.Join(text, ",")
+}
+
+// CheckQueryScope returns an error if the query was not created with the
+// argumented scope. Queries without a scope can see the queries of every
+// scope, but a scoped query can only be read with the same scope.
+func CheckQueryScope(queryID uint64, scope *Scope) error {
+	if scope == nil {
+		return nil
+	}
+
+	queriesLock.RLock()
+	q := queries[queryID]
+	queriesLock.RUnlock()
+	if q == nil || q.scope != scope.Name {
+		return errors.New("Query ID not found")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package reports
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGetScopeSQL(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.1.0/24")
+	_, guest, _ := net.ParseCIDR("10.10.0.0/16")
+
+	sessionColumns := map[string]bool{"session_id": true, "client_zone": true, "vlan_id": true, "client_address": true, "server_address": true}
+	alertColumns := map[string]bool{"time_stamp": true, "message": true}
+
+	tests := []struct {
+		name     string
+		scope    Scope
+		columns  map[string]bool
+		expected string
+	}{
+		{"zones", Scope{Zones: []string{"lan", "guest"}}, map[string]bool{"client_zone": true, "zone": true}, "(client_zone IN ('lan','guest') OR zone IN ('lan','guest'))"},
+		{"quoted zone", Scope{Zones: []string{"it's"}}, map[string]bool{"zone": true}, "(zone IN ('it''s'))"},
+		{"vlans", Scope{VLANs: []int{10, 20}}, map[string]bool{"vlan_id": true}, "(vlan_id IN (10,20))"},
+		{"networks", Scope{Networks: []*net.IPNet{lan, guest}}, map[string]bool{"address": true}, "(in_networks(address, '192.168.1.0/24,10.10.0.0/16'))"},
+		{"everything", Scope{Zones: []string{"lan"}, VLANs: []int{10}, Networks: []*net.IPNet{lan}}, sessionColumns, "(client_zone IN ('lan') OR vlan_id IN (10) OR in_networks(client_address, '192.168.1.0/24') OR in_networks(server_address, '192.168.1.0/24'))"},
+		{"nothing matches", Scope{Zones: []string{"lan"}}, map[string]bool{"client_address": true}, "0"},
+		{"no scope columns", Scope{Zones: []string{"lan"}}, alertColumns, ""},
+	}
+
+	for _, test := range tests {
+		where := getScopeSQL(&test.scope, test.columns)
+		if where != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, where, test.expected)
+		}
+	}
+}
+
+func TestInNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  interface{}
+		networks string
+		expected bool
+	}{
+		{"inside", "192.168.1.10", "192.168.1.0/24", true},
+		{"second network", []byte("10.10.1.1"), "192.168.1.0/24,10.10.0.0/16", true},
+		{"outside", "192.168.2.10", "192.168.1.0/24", false},
+		{"ipv6", "2001:db8::1", "2001:db8::/32", true},
+		{"null", nil, "192.168.1.0/24", false},
+		{"not an address", "host", "192.168.1.0/24", false},
+		{"invalid network", "192.168.1.10", "192.168.1.0", false},
+	}
+
+	for _, test := range tests {
+		if inNetworks(test.address, test.networks) != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, !test.expected, test.expected)
+		}
+	}
+}
@@ -50,7 +50,7 @@ func makeTextSQLString(reportEntry *ReportEntry) (string, error) {
 		}
 	}
 	sqlStr += " FROM"
-	sqlStr += " " + escape(reportEntry.Table)
+	sqlStr += " " + getTableSQL(reportEntry)
 	sqlStr += " WHERE"
 	for i, condition := range reportEntry.Conditions {
 		if i != 0 {
@@ -69,7 +69,7 @@ func makeTextSQLString(reportEntry *ReportEntry) (string, error) {
 // makeEventsSQLString makes a SQL string from a EVENTS type ReportEntry
 func makeEventsSQLString(reportEntry *ReportEntry) (string, error) {
 	sqlStr := "SELECT * FROM"
-	sqlStr += " " + escape(reportEntry.Table)
+	sqlStr += " " + getTableSQL(reportEntry)
 	sqlStr += " WHERE"
 	for i, condition := range reportEntry.Conditions {
 		if i != 0 {
@@ -112,7 +112,7 @@ func makeCategoriesSQLString(reportEntry *ReportEntry) (string, error) {
 	sqlStr += " " + reportEntry.QueryCategories.GroupColumn
 	sqlStr += ", " + reportEntry.QueryCategories.AggregationFunction + "(" + reportEntry.QueryCategories.AggregationValue + ")"
 	sqlStr += " as value"
-	sqlStr += " FROM " + escape(reportEntry.Table)
+	sqlStr += " FROM " + getTableSQL(reportEntry)
 	sqlStr += " WHERE"
 	for i, condition := range reportEntry.Conditions {
 		if i != 0 {
@@ -176,7 +176,7 @@ func makeSeriesSQLString(reportEntry *ReportEntry) (string, error) {
 		}
 		qStr += ", " + column
 	}
-	qStr += " FROM " + escape(reportEntry.Table)
+	qStr += " FROM " + getTableSQL(reportEntry)
 	qStr += " WHERE"
 	for i, condition := range reportEntry.Conditions {
 		if i != 0 {
@@ -481,6 +481,15 @@ func getConditionSQL(reportEntry *ReportEntry, condition *ReportCondition) (stri
 	return " " + columnName + " " + opStr + " ?", nil
 }
 
+// getTableSQL returns the table of a report entry, or the subquery that only
+// has the events in the scope for scoped queries
+func getTableSQL(reportEntry *ReportEntry) string {
+	if reportEntry.scopedTable != "" {
+		return reportEntry.scopedTable
+	}
+	return escape(reportEntry.Table)
+}
+
 // getColumnName returns the proper column name providing the name
 // this does a lookup in the disambiguation table and updates the column name if necessary
 // to remove ambiguation of duplicate column names when doing joins
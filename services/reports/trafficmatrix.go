@@ -0,0 +1,56 @@
+package reports
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// GetTrafficMatrix returns the byte totals from the traffic matrix table for
+// each pair of client and server country, ASN, or both, for the argumented
+// time range sorted by total bytes. When the interval is not zero the totals
+// are also split into intervals of that many seconds, which must be a
+// multiple of the hour the table is rolled up by.
+func GetTrafficMatrix(dimension string, startTime time.Time, endTime time.Time, interval int, limit int) ([]map[string]interface{}, error) {
+	var columns string
+
+	switch dimension {
+	case "country":
+		columns = "client_country, server_country"
+	case "asn":
+		columns = "client_asn, server_asn"
+	case "both":
+		columns = "client_country, client_asn, server_country, server_asn"
+	default:
+		return nil, errors.New("Invalid dimension: " + dimension)
+	}
+
+	if interval < 0 || interval%3600 != 0 {
+		return nil, errors.New("Invalid interval: " + strconv.Itoa(interval))
+	}
+
+	groupBy := columns
+	orderBy := "bytes DESC"
+	if interval > 0 {
+		msec := strconv.Itoa(interval * 1000)
+		columns = "(time_stamp / " + msec + ") * " + msec + " AS time_stamp, " + columns
+		groupBy = "1, " + groupBy
+		orderBy = "time_stamp, " + orderBy
+	}
+
+	sqlStr := "SELECT " + columns + ", " +
+		"sum(bytes) AS bytes, sum(client_bytes) AS client_bytes, sum(server_bytes) AS server_bytes " +
+		"FROM traffic_matrix WHERE time_stamp >= ? AND time_stamp < ? " +
+		"GROUP BY " + groupBy + " ORDER BY " + orderBy
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, prepareEventValues(startTime), prepareEventValues(endTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, limit)
+}
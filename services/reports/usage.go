@@ -0,0 +1,70 @@
+package reports
+
+import (
+	"errors"
+	"time"
+)
+
+// init registers the usage tables with the schema registry. They have one row
+// per device per day or month and are updated in place by upsert events.
+func init() {
+	for _, table := range []string{"usage_daily", "usage_monthly"} {
+		RegisterTable(TableSchema{
+			Name:  table,
+			Owner: "reports",
+			Columns: []Column{
+				{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+				{Name: "mac_address", Type: "text NOT NULL DEFAULT ''"},
+				{Name: "address", Type: "text"},
+				{Name: "hostname", Type: "text"},
+				{Name: "bytes", Type: "int8"},
+				{Name: "client_bytes", Type: "int8"},
+				{Name: "server_bytes", Type: "int8"},
+			},
+			Unique:      []string{"time_stamp", "mac_address"},
+			TrimPercent: .1,
+		})
+	}
+}
+
+// GetUsage returns the bandwidth usage for each device from the daily or
+// monthly usage table for the argumented time range, sorted by total bytes
+// so the heaviest users are first in the list.
+func GetUsage(period string, startTime time.Time, endTime time.Time, limit int) ([]map[string]interface{}, error) {
+	var table string
+
+	switch period {
+	case "daily":
+		table = "usage_daily"
+	case "monthly":
+		table = "usage_monthly"
+	default:
+		return nil, errors.New("Invalid period: " + period)
+	}
+
+	sqlStr := "SELECT mac_address, max(address) AS address, max(hostname) AS hostname, " +
+		"sum(bytes) AS bytes, sum(client_bytes) AS client_bytes, sum(server_bytes) AS server_bytes " +
+		"FROM " + table + " WHERE time_stamp >= ? AND time_stamp < ? " +
+		"GROUP BY mac_address ORDER BY bytes DESC"
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, prepareEventValues(startTime), prepareEventValues(endTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, limit)
+}
+
+// GetUsagePeriodStart returns the start of the day or month that contains the argumented time
+func GetUsagePeriodStart(period string, when time.Time) time.Time {
+	year, month, day := when.Date()
+
+	if period == "monthly" {
+		return time.Date(year, month, 1, 0, 0, 0, 0, when.Location())
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, when.Location())
+}
@@ -0,0 +1,23 @@
+package reports
+
+import (
+	"time"
+)
+
+// GetWwanUsage returns the bytes used by a modem in each billing cycle since
+// the argumented time, with the most recent cycle first
+func GetWwanUsage(device string, startTime time.Time, limit int) ([]map[string]interface{}, error) {
+	sqlStr := "SELECT time_stamp, device, rx_bytes, tx_bytes, bytes FROM wwan_usage " +
+		"WHERE device = ? AND time_stamp >= ? ORDER BY time_stamp DESC"
+
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+
+	rows, err := db.Query(sqlStr, device, prepareEventValues(startTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return getRows(rows, limit)
+}
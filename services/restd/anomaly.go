@@ -0,0 +1,41 @@
+package restd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/plugins/anomaly"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// statusAnomalies is the RESTD /api/status/anomalies handler, this will return the anomaly
+// scores of each device and application for the last hour that was checked against the baselines
+func statusAnomalies(c *gin.Context) {
+	logger.Debug("statusAnomalies()\n")
+
+	c.JSON(http.StatusOK, anomaly.GetStatus())
+	return
+}
+
+// statusAnomalyEvents is the RESTD /api/status/anomalyevents handler, this will return the
+// anomalies that were found for the number of hours in the hours query parameter
+func statusAnomalyEvents(c *gin.Context) {
+	logger.Debug("statusAnomalyEvents()\n")
+
+	hours := 24
+	if value, err := strconv.Atoi(c.Query("hours")); err == nil && value > 0 {
+		hours = value
+	}
+
+	result, err := reports.GetAnomalyEvents(time.Now().Add(-time.Duration(hours)*time.Hour), 1000)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
@@ -31,6 +31,17 @@ type CustomJWTPayload struct {
 
 func authRequired(engine *gin.Engine) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// A bearer token is an API token that can only query the reports of its scope
+		if token := getBearerToken(c); token != "" {
+			if checkAPIToken(c, token) {
+				c.Next()
+				return
+			}
+			c.JSON(http.StatusForbidden, gin.H{"error": "Authorization failed"})
+			c.Abort()
+			return
+		}
+
 		// If alread logged in, continue
 		session := sessions.Default(c)
 		user := session.Get("username")
@@ -39,6 +50,12 @@ func authRequired(engine *gin.Engine) gin.HandlerFunc {
 			return
 		}
 
+		// If the connection is on the local unix socket it's authorized
+		if checkAuthSocket(c) {
+			c.Next()
+			return
+		}
+
 		// If the connection is from the local host, check if its authorized
 		if checkAuthLocal(c) {
 			c.Next()
@@ -51,10 +68,14 @@ func authRequired(engine *gin.Engine) gin.HandlerFunc {
 			return
 		}
 
+		// a valid token is sent with every request so only the failures are logged
 		if checkCommandCenterToken(c) {
 			c.Next()
 			return
 		}
+		if c.Query("token") != "" {
+			logLogin(c, "", LoginCommandCenter, false, "invalid token")
+		}
 
 		// Check if JWT token was specified
 		// DISABLED
@@ -211,9 +232,11 @@ func checkHTTPAuth(c *gin.Context) bool {
 		return false
 	}
 	if !validate(pair[0], pair[1]) {
+		logLogin(c, pair[0], LoginBasic, false, "invalid username or password")
 		c.JSON(http.StatusForbidden, gin.H{"error": "Authorization Failed"})
 		return false
 	}
+	logLogin(c, pair[0], LoginBasic, true, "")
 
 	session := sessions.Default(c)
 	session.Set("username", pair[0])
@@ -226,6 +249,23 @@ func checkHTTPAuth(c *gin.Context) bool {
 	return false
 }
 
+// checkAuthSocket returns true if the request came in on the local unix socket
+// which can only be opened by root
+func checkAuthSocket(c *gin.Context) bool {
+	socket, ok := c.Request.Context().Value(socketContextKey).(bool)
+	return ok && socket
+}
+
+// isPrivileged returns true if the request came from root on the local unix
+// socket or from a local process owned by root
+func isPrivileged(c *gin.Context) bool {
+	if checkAuthSocket(c) {
+		return true
+	}
+	privileged, _ := sessions.Default(c).Get("privileged").(bool)
+	return privileged
+}
+
 // checkAuthLocal checks if the local connecting process is authorized
 // returns false if request should continue to next auth technique
 // returns true if the auth is valid and the request should be allowed
@@ -238,6 +278,7 @@ func checkAuthLocal(c *gin.Context) bool {
 		if isLocalProcessRoot(ip, port) {
 			session := sessions.Default(c)
 			session.Set("username", "root")
+			session.Set("privileged", true)
 			err := session.Save()
 			if err == nil {
 				return true
@@ -269,6 +310,7 @@ func authLogin(c *gin.Context) {
 	// This is a POST, with a username/password. Try to login, set an expiration token for 86400 seconds (24 hours)
 	session := sessions.Default(c)
 	if validate(username, password) {
+		logLogin(c, username, LoginPassword, true, "")
 		session.Set("username", username)
 		session.Options(sessions.Options{Path: "/", MaxAge: 86400})
 		err := session.Save()
@@ -278,6 +320,7 @@ func authLogin(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"message": "Successfully authenticated user"})
 		}
 	} else {
+		logLogin(c, username, LoginPassword, false, "invalid username or password")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization failed: Invalid username/password"})
 	}
 }
@@ -407,22 +450,23 @@ func validate(username string, password string) bool {
 // Example: isLocalProcessRoot("127.0.0.1","1234") will return true if the process that
 // has the 127.0.0.1:1234 tcp socket open is uid 0 (root).
 func isLocalProcessRoot(ip string, port string) bool {
-	// ipString is the hex (network order) string of the address
-	// that we should find in /proc/net/tcp[6]
-	var ipString string
-	var procFilename string
 	if ip == "127.0.0.1" {
-		procFilename = "/proc/net/tcp"
-		// 127.0.0.1 in hex (network order)
-		ipString = "0100007F"
+		// 127.0.0.1 in hex (network order), or as an IPv4-mapped address if
+		// the client connected with an IPv6 socket
+		return findLocalProcessRoot("/proc/net/tcp", "0100007F", port) ||
+			findLocalProcessRoot("/proc/net/tcp6", "0000000000000000FFFF00000100007F", port)
 	} else if ip == "::1" {
-		procFilename = "/proc/net/tcp6"
 		// ::1 in hex (network order)
-		ipString = "00000000000000000000000001000000"
-	} else {
-		return false
+		return findLocalProcessRoot("/proc/net/tcp6", "00000000000000000000000001000000", port)
 	}
 
+	return false
+}
+
+// findLocalProcessRoot returns true if the connection from the address and port
+// in the argumented /proc/net file is owned by root. ipString is the hex (network
+// order) string of the address that we should find in the file.
+func findLocalProcessRoot(procFilename string, ipString string, port string) bool {
 	portInt, err := strconv.Atoi(port)
 	if err != nil {
 		logger.Warn("Failed to convert port %s: %v\n", port, err)
@@ -435,7 +479,7 @@ func isLocalProcessRoot(ip string, port string) bool {
 	// to avoid it changing through the read process
 	procNetTCPBytes, err := ioutil.ReadFile(procFilename)
 	if err != nil {
-		logger.Warn("Failed to read /proc/net/tcp: %v\n", err)
+		logger.Warn("Failed to read %s: %v\n", procFilename, err)
 		return false
 	}
 
@@ -0,0 +1,115 @@
+package restd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/blocklist"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// blocklistRequest is the body of the blocklist POST and PUT requests. The
+// TTL is in seconds and zero blocks the address until it is removed.
+type blocklistRequest struct {
+	Address string `json:"address"`
+	Reason  string `json:"reason"`
+	TTL     int64  `json:"ttl"`
+}
+
+// blocklistList is the RESTD /api/control/blocklist GET handler, this will return
+// the block for the address query parameter or every current block
+func blocklistList(c *gin.Context) {
+	logger.Debug("blocklistList()\n")
+
+	address := c.Query("address")
+	if address == "" {
+		c.JSON(http.StatusOK, blocklist.List())
+		return
+	}
+
+	entry, err := blocklist.Get(address)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+	return
+}
+
+// blocklistAdd is the RESTD /api/control/blocklist POST handler, this will block an address
+func blocklistAdd(c *gin.Context) {
+	logger.Debug("blocklistAdd()\n")
+
+	request, ok := readBlocklistRequest(c)
+	if !ok {
+		return
+	}
+
+	entry, err := blocklist.Add(request.Address, request.Reason, request.TTL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+	return
+}
+
+// blocklistUpdate is the RESTD /api/control/blocklist PUT handler, this will change
+// the reason and the expiration of a block
+func blocklistUpdate(c *gin.Context) {
+	logger.Debug("blocklistUpdate()\n")
+
+	request, ok := readBlocklistRequest(c)
+	if !ok {
+		return
+	}
+
+	entry, err := blocklist.Update(request.Address, request.Reason, request.TTL)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+	return
+}
+
+// blocklistRemove is the RESTD /api/control/blocklist DELETE handler, this will remove
+// the block for the address query parameter, or every block from the source query
+// parameter, or every block from the API and alerts when neither is given
+func blocklistRemove(c *gin.Context) {
+	logger.Debug("blocklistRemove()\n")
+
+	count, err := blocklist.Remove(c.Query("address"), c.Query("source"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": count})
+	return
+}
+
+// readBlocklistRequest reads the body of a blocklist request and returns
+// false after sending the error response if it is invalid
+func readBlocklistRequest(c *gin.Context) (blocklistRequest, bool) {
+	var request blocklistRequest
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return request, false
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return request, false
+	}
+
+	if request.Address == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing address"})
+		return request, false
+	}
+	return request, true
+}
@@ -0,0 +1,27 @@
+package restd
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// callbacksList is the RESTD /api/control/callbacks GET handler, this will return the
+// nfqueue, conntrack, and netlogger callback counters by queue, interface, and event type
+func callbacksList(c *gin.Context) {
+	logger.Debug("callbacksList()\n")
+
+	c.JSON(http.StatusOK, kernel.GetStatistics())
+	return
+}
+
+// callbacksReset is the RESTD /api/control/callbacks DELETE handler, this will clear the callback counters
+func callbacksReset(c *gin.Context) {
+	logger.Debug("callbacksReset()\n")
+
+	kernel.ResetStatistics()
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+	return
+}
@@ -0,0 +1,28 @@
+package restd
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/certcache"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// certcacheList is the RESTD /api/control/certcache GET handler, this will return
+// the details of the cached certificates with the most recently used first
+func certcacheList(c *gin.Context) {
+	logger.Debug("certcacheList()\n")
+
+	c.JSON(http.StatusOK, certcache.GetCertificates())
+	return
+}
+
+// certcacheFlush is the RESTD /api/control/certcache DELETE handler, this will remove
+// the certificate for the server:port in the key query parameter or every certificate
+func certcacheFlush(c *gin.Context) {
+	logger.Debug("certcacheFlush()\n")
+
+	count := certcache.FlushCertificates(c.Query("key"))
+	c.JSON(http.StatusOK, gin.H{"flushed": count})
+	return
+}
@@ -0,0 +1,345 @@
+// Package client provides a client for the packetd REST API that talks to
+// restd over the local unix socket. It is used by packetctl so the API can
+// be reached over SSH when the web UI is unavailable.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SocketFile is the unix socket where restd serves the API for local clients
+const SocketFile = "/var/run/packetd.sock"
+
+// the host name doesn't matter since we always dial the unix socket
+const baseURL = "http://packetd"
+
+// Client talks to the packetd API over a unix socket
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the API on the argumented unix socket
+func NewClient(socket string, timeout time.Duration) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+
+	return &Client{httpClient: &http.Client{Transport: transport, Timeout: timeout}}
+}
+
+// Get sends a GET request for the argumented API path and returns the response body
+func (client *Client) Get(path string) ([]byte, error) {
+	return client.request(http.MethodGet, path, nil)
+}
+
+// Post sends a POST request with the argumented body and returns the response body
+func (client *Client) Post(path string, body []byte) ([]byte, error) {
+	return client.request(http.MethodPost, path, body)
+}
+
+// Put sends a PUT request with the argumented body and returns the response body
+func (client *Client) Put(path string, body []byte) ([]byte, error) {
+	return client.request(http.MethodPut, path, body)
+}
+
+// Delete sends a DELETE request for the argumented API path and returns the response body
+func (client *Client) Delete(path string) ([]byte, error) {
+	return client.request(http.MethodDelete, path, nil)
+}
+
+// GetStatus returns one of the /api/status pages
+func (client *Client) GetStatus(name string) ([]byte, error) {
+	return client.Get("/api/status/" + name)
+}
+
+// GetSettings returns the settings at the argumented path
+func (client *Client) GetSettings(segments []string) ([]byte, error) {
+	return client.Get(settingsPath(segments))
+}
+
+// GetSecretSettings returns the settings at the argumented path with the secrets decrypted
+func (client *Client) GetSecretSettings(segments []string) ([]byte, error) {
+	return client.Get(settingsPath(segments) + "?secrets=true")
+}
+
+// SetSettings replaces the settings at the argumented path with the JSON value
+func (client *Client) SetSettings(segments []string, value []byte) ([]byte, error) {
+	if !json.Valid(value) {
+		return nil, fmt.Errorf("invalid JSON value: %s", value)
+	}
+	return client.Post(settingsPath(segments), value)
+}
+
+// RenderTemplate renders and validates a JSON settings template request without applying it
+func (client *Client) RenderTemplate(request []byte) ([]byte, error) {
+	if !json.Valid(request) {
+		return nil, fmt.Errorf("invalid JSON template: %s", request)
+	}
+	return client.Post("/api/templates/render", request)
+}
+
+// ApplyTemplate renders, validates, and commits a JSON settings template request
+func (client *Client) ApplyTemplate(request []byte, confirmSeconds int) ([]byte, error) {
+	if !json.Valid(request) {
+		return nil, fmt.Errorf("invalid JSON template: %s", request)
+	}
+	return client.Post(fmt.Sprintf("/api/templates/apply?confirm=%d", confirmSeconds), request)
+}
+
+// GetLogLevel returns the log level for a logger source
+func (client *Client) GetLogLevel(source string) ([]byte, error) {
+	return client.Get("/api/logger/" + source)
+}
+
+// SetLogLevel sets the log level for a logger source
+func (client *Client) SetLogLevel(source string, level string) ([]byte, error) {
+	return client.Get("/api/logger/" + source + "=" + level)
+}
+
+// StartCapture starts a warehouse capture to the argumented file
+func (client *Client) StartCapture(filename string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"filename": filename})
+	if err != nil {
+		return nil, err
+	}
+	return client.Post("/api/warehouse/capture", body)
+}
+
+// StopCapture stops the current warehouse capture
+func (client *Client) StopCapture() ([]byte, error) {
+	return client.Post("/api/warehouse/close", nil)
+}
+
+// GetCaptureStatus returns the warehouse capture or playback state
+func (client *Client) GetCaptureStatus() ([]byte, error) {
+	return client.Get("/api/warehouse/status")
+}
+
+// GetPlaybackState returns the position of the warehouse playback and the state of the last record played
+func (client *Client) GetPlaybackState() ([]byte, error) {
+	return client.Get("/api/warehouse/playback/state")
+}
+
+// PausePlayback pauses the warehouse playback
+func (client *Client) PausePlayback() ([]byte, error) {
+	return client.Post("/api/warehouse/playback/pause", nil)
+}
+
+// ResumePlayback resumes a paused warehouse playback
+func (client *Client) ResumePlayback() ([]byte, error) {
+	return client.Post("/api/warehouse/playback/resume", nil)
+}
+
+// StepPlayback plays the argumented number of records of a paused warehouse playback
+func (client *Client) StepPlayback(count int) ([]byte, error) {
+	body, err := json.Marshal(map[string]int{"count": count})
+	if err != nil {
+		return nil, err
+	}
+	return client.Post("/api/warehouse/playback/step", body)
+}
+
+// SetPlaybackSpeed changes the speed of the warehouse playback as a percentage of the capture speed
+func (client *Client) SetPlaybackSpeed(speed int) ([]byte, error) {
+	body, err := json.Marshal(map[string]int{"speed": speed})
+	if err != nil {
+		return nil, err
+	}
+	return client.Post("/api/warehouse/playback/speed", body)
+}
+
+// GetDiagnostics returns the goroutine, queue, session table, GC, and lock contention diagnostics
+func (client *Client) GetDiagnostics() ([]byte, error) {
+	return client.Get("/api/debug?format=json")
+}
+
+// GetTrace returns the dispatch trace options and the traced packets
+func (client *Client) GetTrace() ([]byte, error) {
+	return client.Get("/api/debug/trace")
+}
+
+// StartTrace starts a dispatch trace with the argumented JSON options
+func (client *Client) StartTrace(config []byte) ([]byte, error) {
+	if !json.Valid(config) {
+		return nil, fmt.Errorf("invalid JSON trace options: %s", config)
+	}
+	return client.Post("/api/debug/trace", config)
+}
+
+// StopTrace stops the dispatch trace
+func (client *Client) StopTrace() ([]byte, error) {
+	return client.Delete("/api/debug/trace")
+}
+
+// GetFaults returns the faults setting and the injected faults
+func (client *Client) GetFaults() ([]byte, error) {
+	return client.Get("/api/debug/faults")
+}
+
+// SetFault injects the argumented JSON fault
+func (client *Client) SetFault(fault []byte) ([]byte, error) {
+	if !json.Valid(fault) {
+		return nil, fmt.Errorf("invalid JSON fault: %s", fault)
+	}
+	return client.Post("/api/debug/faults", fault)
+}
+
+// ClearFaults removes all of the injected faults
+func (client *Client) ClearFaults() ([]byte, error) {
+	return client.Delete("/api/debug/faults")
+}
+
+// WhatIf evaluates the rules and policy against a JSON session descriptor
+func (client *Client) WhatIf(descriptor []byte) ([]byte, error) {
+	return client.Post("/api/whatif", descriptor)
+}
+
+// GetQueueZones returns the per-zone inspection and queue configuration
+func (client *Client) GetQueueZones() ([]byte, error) {
+	return client.Get("/api/control/zones")
+}
+
+// SetQueueZone enables or disables inspection of a zone. A non-zero queue
+// range sends the packets received in the zone to those queues.
+func (client *Client) SetQueueZone(zone string, enabled bool, queueStart int, queueEnd int) ([]byte, error) {
+	body, err := json.Marshal(map[string]interface{}{"enabled": enabled, "queueStart": queueStart, "queueEnd": queueEnd})
+	if err != nil {
+		return nil, err
+	}
+	return client.Post("/api/control/zones/"+zone, body)
+}
+
+// ClearQueueZone removes the runtime configuration of a zone
+func (client *Client) ClearQueueZone(zone string) ([]byte, error) {
+	return client.Delete("/api/control/zones/" + zone)
+}
+
+// GetTimeouts returns the configured conntrack timeouts and the current conntrack timeout sysctls
+func (client *Client) GetTimeouts() ([]byte, error) {
+	return client.Get("/api/control/timeouts")
+}
+
+// SetTimeout changes the conntrack timeout of a protocol sysctl or an application
+// until restart. The kind is protocol or application.
+func (client *Client) SetTimeout(kind string, name string, seconds int) ([]byte, error) {
+	body, err := json.Marshal(map[string]interface{}{"seconds": seconds})
+	if err != nil {
+		return nil, err
+	}
+	return client.Post("/api/control/timeouts/"+kind+"/"+name, body)
+}
+
+// ClearTimeout removes the runtime conntrack timeout of a protocol sysctl or an application
+func (client *Client) ClearTimeout(kind string, name string) ([]byte, error) {
+	return client.Delete("/api/control/timeouts/" + kind + "/" + name)
+}
+
+// GetCertificates returns the details of the cached certificates
+func (client *Client) GetCertificates() ([]byte, error) {
+	return client.Get("/api/control/certcache")
+}
+
+// FlushCertificates removes the cached certificate for a server:port or every certificate when the key is empty
+func (client *Client) FlushCertificates(key string) ([]byte, error) {
+	if key == "" {
+		return client.Delete("/api/control/certcache")
+	}
+	return client.Delete("/api/control/certcache?key=" + url.QueryEscape(key))
+}
+
+// GetCallbackStats returns the nfqueue, conntrack, and netlogger callback counters
+func (client *Client) GetCallbackStats() ([]byte, error) {
+	return client.Get("/api/control/callbacks")
+}
+
+// ResetCallbackStats clears the callback counters
+func (client *Client) ResetCallbackStats() ([]byte, error) {
+	return client.Delete("/api/control/callbacks")
+}
+
+// GetBlocklist returns every current block or the block for an address when it is not empty
+func (client *Client) GetBlocklist(address string) ([]byte, error) {
+	if address == "" {
+		return client.Get("/api/control/blocklist")
+	}
+	return client.Get("/api/control/blocklist?address=" + url.QueryEscape(address))
+}
+
+// AddBlock blocks an address or network for the TTL in seconds, or until it is removed when the TTL is zero
+func (client *Client) AddBlock(address string, reason string, ttl int64) ([]byte, error) {
+	body, err := json.Marshal(map[string]interface{}{"address": address, "reason": reason, "ttl": ttl})
+	if err != nil {
+		return nil, err
+	}
+	return client.Post("/api/control/blocklist", body)
+}
+
+// UpdateBlock changes the reason and the TTL of a block
+func (client *Client) UpdateBlock(address string, reason string, ttl int64) ([]byte, error) {
+	body, err := json.Marshal(map[string]interface{}{"address": address, "reason": reason, "ttl": ttl})
+	if err != nil {
+		return nil, err
+	}
+	return client.Put("/api/control/blocklist", body)
+}
+
+// RemoveBlock removes the block for an address
+func (client *Client) RemoveBlock(address string) ([]byte, error) {
+	return client.Delete("/api/control/blocklist?address=" + url.QueryEscape(address))
+}
+
+// request sends a request to the API and returns the response body, or an
+// error with the message from the API if the request was not successful
+func (client *Client) request(method string, path string, body []byte) ([]byte, error) {
+	request, err := http.NewRequest(method, baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	result, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var message struct {
+			Error interface{} `json:"error"`
+		}
+		if json.Unmarshal(result, &message) == nil && message.Error != nil {
+			return result, fmt.Errorf("%s: %v", response.Status, message.Error)
+		}
+		return result, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(result)))
+	}
+
+	return result, nil
+}
+
+// settingsPath returns the API path for the argumented settings segments
+func settingsPath(segments []string) string {
+	if len(segments) == 0 {
+		return "/api/settings"
+	}
+	return "/api/settings/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,41 @@
+package restd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/clock"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// statusClock is the RESTD /api/status/clock handler, this will return the
+// NTP synchronization state, the offset and stratum, and the last clock step
+func statusClock(c *gin.Context) {
+	logger.Debug("statusClock()\n")
+
+	c.JSON(http.StatusOK, clock.GetStatus())
+	return
+}
+
+// statusClockEvents is the RESTD /api/status/clockevents handler, this will return the periods
+// the clock was not synchronized and the clock steps for the number of hours in the hours query parameter
+func statusClockEvents(c *gin.Context) {
+	logger.Debug("statusClockEvents()\n")
+
+	hours := 24
+	if value, err := strconv.Atoi(c.Query("hours")); err == nil && value > 0 {
+		hours = value
+	}
+
+	result, err := reports.GetClockEvents(time.Now().Add(-time.Duration(hours)*time.Hour), 1000)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
@@ -0,0 +1,71 @@
+package restd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/plugins/conntimeout"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// conntimeoutStatus is the RESTD /api/control/timeouts GET handler, this will return the
+// configured conntrack timeouts and the current conntrack timeout sysctls
+func conntimeoutStatus(c *gin.Context) {
+	logger.Debug("conntimeoutStatus()\n")
+
+	c.JSON(http.StatusOK, conntimeout.GetStatus())
+	return
+}
+
+// conntimeoutSet is the RESTD /api/control/timeouts/:kind/:name POST handler, this will
+// change the timeout of a protocol sysctl or a classified application until restart
+func conntimeoutSet(c *gin.Context) {
+	var request struct {
+		Seconds int `json:"seconds"`
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch c.Param("kind") {
+	case "protocol":
+		err = conntimeout.SetProtocolTimeout(c.Param("name"), request.Seconds)
+	case "application":
+		err = conntimeout.SetApplicationTimeout(c.Param("name"), request.Seconds)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown timeout type " + c.Param("kind")})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, conntimeout.GetStatus())
+	return
+}
+
+// conntimeoutClear is the RESTD /api/control/timeouts/:kind/:name DELETE handler, this will
+// remove the runtime change for a protocol or application so the settings are used again
+func conntimeoutClear(c *gin.Context) {
+	err := conntimeout.ClearTimeout(c.Param("kind"), c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, conntimeout.GetStatus())
+	return
+}
@@ -0,0 +1,48 @@
+package restd
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/dhcpclient"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// dhcpRelease is the RESTD /api/control/dhcp/:device/release handler, this will release the
+// DHCP leases of the device for the family query parameter or both families
+func dhcpRelease(c *gin.Context) {
+	logger.Debug("dhcpRelease(%s)\n", c.Param("device"))
+
+	handleDhcpAction(c, dhcpclient.Release)
+}
+
+// dhcpRenew is the RESTD /api/control/dhcp/:device/renew handler, this will renew the
+// DHCP leases of the device for the family query parameter or both families
+func dhcpRenew(c *gin.Context) {
+	logger.Debug("dhcpRenew(%s)\n", c.Param("device"))
+
+	handleDhcpAction(c, dhcpclient.Renew)
+}
+
+// handleDhcpAction does the action for each requested family and returns the lease states
+func handleDhcpAction(c *gin.Context, action func(string, string) dhcpclient.Lease) {
+	var families []string
+
+	switch c.Query("family") {
+	case "":
+		families = []string{dhcpclient.FamilyIPv4, dhcpclient.FamilyIPv6}
+	case dhcpclient.FamilyIPv4, dhcpclient.FamilyIPv6:
+		families = []string{c.Query("family")}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "family must be ipv4 or ipv6"})
+		return
+	}
+
+	leases := make([]dhcpclient.Lease, 0, len(families))
+	for _, family := range families {
+		leases = append(leases, action(c.Param("device"), family))
+	}
+
+	c.JSON(http.StatusOK, leases)
+	return
+}
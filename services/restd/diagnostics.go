@@ -0,0 +1,87 @@
+package restd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/plugins/reporter"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// Diagnostics holds the runtime and pipeline state returned by /api/debug for support tooling
+type Diagnostics struct {
+	Time         time.Time                  `json:"time"`
+	Goroutines   overseer.GoroutineStats    `json:"goroutines"`
+	Queues       map[string]QueueDepth      `json:"queues"`
+	SessionTable dispatch.SessionTableStats `json:"sessionTable"`
+	GC           overseer.GCStats           `json:"gc"`
+	Contention   overseer.ContentionStats   `json:"contention"`
+}
+
+// QueueDepth holds the number of items waiting in a pipeline channel
+type QueueDepth struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+// getDiagnostics collects the goroutine states, the depths of the event
+// pipelines, the session table spread, the GC stats, and the lock contention
+func getDiagnostics() Diagnostics {
+	result := Diagnostics{
+		Time:         time.Now(),
+		Goroutines:   overseer.GetGoroutineStats(),
+		Queues:       make(map[string]QueueDepth),
+		SessionTable: dispatch.GetSessionTableStats(),
+		GC:           overseer.GetGCStats(),
+		Contention:   overseer.GetContentionStats(),
+	}
+
+	queues := reports.GetQueueStatus()
+	result.Queues["reports_events"] = QueueDepth{Depth: queues.EventDepth, Capacity: queues.EventCapacity}
+	result.Queues["reports_cloud"] = QueueDepth{Depth: queues.CloudDepth, Capacity: queues.CloudCapacity}
+
+	jobs := reporter.GetQueueStatus()
+	result.Queues["reporter_jobs"] = QueueDepth{Depth: jobs.Depth, Capacity: jobs.Capacity}
+
+	for _, sub := range eventbus.GetStatus().Subscribers {
+		result.Queues["eventbus_"+sub.Name] = QueueDepth{Depth: sub.Queued, Capacity: sub.Capacity}
+	}
+
+	return result
+}
+
+// debugContention is the RESTD /api/debug/contention handler. It turns the
+// sampling for the lock contention summary in /api/debug on or off.
+func debugContention(c *gin.Context) {
+	var data struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if data.Enabled == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "enabled not specified"})
+		return
+	}
+
+	logger.Info("Setting contention profiling enabled:%v\n", *data.Enabled)
+	overseer.SetContentionProfiling(*data.Enabled)
+	c.JSON(http.StatusOK, gin.H{"enabled": *data.Enabled})
+}
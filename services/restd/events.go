@@ -0,0 +1,42 @@
+package restd
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// how often we send a keepalive on an idle event stream
+const eventStreamKeepalive = 30 * time.Second
+
+// eventStream is the RESTD /api/events handler, this will stream the events for the
+// comma separated topics in the query (default all) as server-sent events until the
+// client disconnects
+func eventStream(c *gin.Context) {
+	topics := strings.Split(c.DefaultQuery("topics", "*"), ",")
+
+	logger.Debug("eventStream() %s %v\n", c.ClientIP(), topics)
+
+	sub := eventbus.Subscribe("stream:"+c.ClientIP(), 0, topics...)
+	defer eventbus.Unsubscribe(sub)
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Topic, event)
+			return true
+		case <-time.After(eventStreamKeepalive):
+			c.SSEvent("keepalive", time.Now().Unix())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
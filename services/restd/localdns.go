@@ -0,0 +1,129 @@
+package restd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/localdns"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// dnsRecordRequest is the body of the dnsrecords POST request
+type dnsRecordRequest struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// statusNames is the RESTD /api/status/names handler, this will return every name
+// packetd knows from the static records, the DHCP reservations and leases, and discovery
+func statusNames(c *gin.Context) {
+	logger.Debug("statusNames()\n")
+
+	c.JSON(http.StatusOK, localdns.GetRecords())
+	return
+}
+
+// dnsRecordsList is the RESTD /api/control/dnsrecords GET handler, this will return the static DNS records
+func dnsRecordsList(c *gin.Context) {
+	logger.Debug("dnsRecordsList()\n")
+
+	c.JSON(http.StatusOK, localdns.GetStaticRecords())
+	return
+}
+
+// dnsRecordsAdd is the RESTD /api/control/dnsrecords POST handler, this will add a static DNS record
+func dnsRecordsAdd(c *gin.Context) {
+	logger.Debug("dnsRecordsAdd()\n")
+
+	var request dnsRecordRequest
+	if !readLocalDNSRequest(c, &request) {
+		return
+	}
+
+	if err := localdns.AddStaticRecord(request.Name, request.Address); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+	return
+}
+
+// dnsRecordsRemove is the RESTD /api/control/dnsrecords DELETE handler, this will remove the static
+// DNS records for the name query parameter, or only the one for the address query parameter
+func dnsRecordsRemove(c *gin.Context) {
+	logger.Debug("dnsRecordsRemove()\n")
+
+	err := localdns.RemoveStaticRecord(c.Query("name"), c.Query("address"))
+	if err == localdns.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+	return
+}
+
+// hostnamesList is the RESTD /api/control/hostnames GET handler, this will return the DHCP reservations
+func hostnamesList(c *gin.Context) {
+	logger.Debug("hostnamesList()\n")
+
+	c.JSON(http.StatusOK, localdns.GetReservations())
+	return
+}
+
+// hostnamesSet is the RESTD /api/control/hostnames POST handler, this will add or change
+// the DHCP reservation and hostname of a MAC address
+func hostnamesSet(c *gin.Context) {
+	logger.Debug("hostnamesSet()\n")
+
+	var request localdns.Reservation
+	if !readLocalDNSRequest(c, &request) {
+		return
+	}
+
+	if err := localdns.SetReservation(request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+	return
+}
+
+// hostnamesRemove is the RESTD /api/control/hostnames/:mac DELETE handler, this will
+// remove the DHCP reservation of a MAC address
+func hostnamesRemove(c *gin.Context) {
+	logger.Debug("hostnamesRemove(%s)\n", c.Param("mac"))
+
+	err := localdns.RemoveReservation(c.Param("mac"))
+	if err == localdns.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+	return
+}
+
+// readLocalDNSRequest reads the body of a request and returns false after
+// sending the error response if it is invalid
+func readLocalDNSRequest(c *gin.Context, request interface{}) bool {
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+
+	if err = json.Unmarshal(body, request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package restd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// Every admin login attempt is logged to the login_events table and
+// published on the event bus, so the webhooks and the alert rules can act on
+// them. When one address fails too many times within the window an alert is
+// raised, once for each window.
+
+// The methods used to log in
+const (
+	LoginPassword      = "password"
+	LoginBasic         = "basic"
+	LoginCommandCenter = "command-center"
+)
+
+// the defaults of the failed login alert
+const defaultLoginFailures = 5
+const defaultLoginWindow = 300
+
+// loginFailures holds the failed attempts of an address in the current window
+type loginFailures struct {
+	start     time.Time
+	count     int
+	usernames map[string]bool
+	alerted   bool
+}
+
+var failureTable = make(map[string]*loginFailures)
+var failureLocker sync.Mutex
+
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "login_events",
+		Owner: "restd",
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "username", Type: "text"},
+			{Name: "source_address", Type: "text"},
+			{Name: "method", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "success", Type: "boolean"},
+			{Name: "reason", Type: "text"},
+		},
+		TrimPercent: .1,
+	})
+}
+
+// logLogin logs a login attempt, publishes it, and checks the failures of
+// the address against the alert limit
+func logLogin(c *gin.Context, username string, method string, success bool, reason string) {
+	address := getSourceAddress(c)
+	now := time.Now()
+
+	columns := map[string]interface{}{
+		"time_stamp":     now,
+		"username":       username,
+		"source_address": address,
+		"method":         method,
+		"success":        success,
+		"reason":         reason,
+	}
+	reports.LogEvent(reports.CreateEvent("login", "login_events", 1, columns, nil))
+
+	eventbus.Publish(eventbus.TopicLogin, "restd", map[string]interface{}{
+		"username": username,
+		"address":  address,
+		"method":   method,
+		"success":  success,
+		"reason":   reason,
+	})
+
+	if success {
+		logger.Info("Login %s from %s by %s\n", username, address, method)
+		return
+	}
+	logger.Warn("Failed login %s from %s by %s: %s\n", username, address, method, reason)
+	checkLoginFailures(address, username, now)
+}
+
+// checkLoginFailures counts a failed attempt and raises an alert when the
+// address reaches the limit within the window
+func checkLoginFailures(address string, username string, now time.Time) {
+	limit, window := getLoginAlertConfig()
+	if limit == 0 {
+		return
+	}
+
+	failureLocker.Lock()
+	defer failureLocker.Unlock()
+
+	// the old windows are removed so a scan of addresses doesn't grow the table
+	for key, entry := range failureTable {
+		if now.Sub(entry.start) > window {
+			delete(failureTable, key)
+		}
+	}
+
+	entry := failureTable[address]
+	if entry == nil {
+		entry = &loginFailures{start: now, usernames: make(map[string]bool)}
+		failureTable[address] = entry
+	}
+	entry.count++
+	entry.usernames[username] = true
+
+	if entry.count < limit || entry.alerted {
+		return
+	}
+	entry.alerted = true
+
+	var usernames []string
+	for name := range entry.usernames {
+		usernames = append(usernames, name)
+	}
+	eventbus.PublishAlert("restd", fmt.Sprintf("%d failed logins from %s", entry.count, address), map[string]interface{}{
+		"address":   address,
+		"count":     entry.count,
+		"usernames": usernames,
+		"window":    int(window / time.Second),
+	})
+}
+
+// getLoginAlertConfig returns the number of failures that raises an alert,
+// zero if the alert is disabled, and the window they are counted in
+func getLoginAlertConfig() (int, time.Duration) {
+	limit := defaultLoginFailures
+	window := defaultLoginWindow * time.Second
+
+	alertJSON, err := settings.GetCurrentSettings([]string{"accounts", "loginAlert"})
+	if alertJSON == nil || err != nil {
+		return limit, window
+	}
+
+	item, ok := alertJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid login alert settings: %T\n", alertJSON)
+		return limit, window
+	}
+
+	if enabled, ok := item["enabled"].(bool); ok && !enabled {
+		return 0, window
+	}
+	if value, ok := item["failures"].(float64); ok && value >= 1 {
+		limit = int(value)
+	}
+	if value, ok := item["windowSeconds"].(float64); ok && value >= 1 {
+		window = time.Duration(value) * time.Second
+	}
+	return limit, window
+}
+
+// getSourceAddress returns the address the request came from. The forwarded
+// headers are ignored since anyone can set them.
+func getSourceAddress(c *gin.Context) string {
+	if checkAuthSocket(c) {
+		return "local"
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// reportsLogins is the RESTD /api/reports/logins handler. It returns the admin login attempts
+// for the last day with the most recent first. The optional start and end parameters are
+// milliseconds since the epoch, and username, address, method, and success filter the attempts.
+func reportsLogins(c *gin.Context) {
+	filter := reports.LoginFilter{
+		EndTime:  time.Now(),
+		Username: c.Query("username"),
+		Address:  c.Query("address"),
+		Method:   c.Query("method"),
+	}
+	filter.StartTime = filter.EndTime.Add(-24 * time.Hour)
+
+	if value := c.Query("start"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.StartTime = time.Unix(0, msec*1e6)
+	}
+
+	if value := c.Query("end"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.EndTime = time.Unix(0, msec*1e6)
+	}
+
+	if value := c.Query("success"); value != "" {
+		success, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.Success = &success
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.Limit = limit
+
+	result, err := reports.GetLoginEvents(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
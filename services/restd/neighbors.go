@@ -0,0 +1,57 @@
+package restd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/neighbors"
+	"github.com/untangle/packetd/services/reports"
+)
+
+// statusNeighborWatch is the RESTD /api/status/neighborwatch handler, this will return the MAC
+// address bound to each neighbor address, the gateways, the blocked MAC addresses and the recent events
+func statusNeighborWatch(c *gin.Context) {
+	logger.Debug("statusNeighborWatch()\n")
+
+	c.JSON(http.StatusOK, neighbors.GetStatus())
+	return
+}
+
+// statusNeighborEvents is the RESTD /api/status/neighborevents handler, this will return the
+// neighbor events for the number of hours in the hours query parameter, limited to the kind
+// in the kind query parameter if it is passed
+func statusNeighborEvents(c *gin.Context) {
+	logger.Debug("statusNeighborEvents()\n")
+
+	hours := 24
+	if value, err := strconv.Atoi(c.Query("hours")); err == nil && value > 0 {
+		hours = value
+	}
+
+	result, err := reports.GetNeighborEvents(time.Now().Add(-time.Duration(hours)*time.Hour), c.Query("kind"), 1000)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// neighborsUnblock is the RESTD /api/control/neighbors DELETE handler, this will remove
+// the block for the MAC address in the mac query parameter or every block
+func neighborsUnblock(c *gin.Context) {
+	logger.Debug("neighborsUnblock()\n")
+
+	count, err := neighbors.Unblock(c.Query("mac"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"removed": count})
+	return
+}
@@ -0,0 +1,65 @@
+package restd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/nftqueue"
+)
+
+// nfqueueStatus is the RESTD /api/control/zones GET handler, this will return the
+// per-zone queue configuration and the rules in the nftables zone chain
+func nfqueueStatus(c *gin.Context) {
+	logger.Debug("nfqueueStatus()\n")
+
+	c.JSON(http.StatusOK, nftqueue.GetStatus())
+	return
+}
+
+// nfqueueSetZone is the RESTD /api/control/zones/:zone POST handler, this will enable or
+// disable inspection of a zone and optionally send the zone to its own range of queues
+func nfqueueSetZone(c *gin.Context) {
+	config := nftqueue.ZoneConfig{Enabled: true}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	config.Zone = c.Param("zone")
+	if config.QueueEnd == 0 {
+		config.QueueEnd = config.QueueStart
+	}
+
+	err = nftqueue.SetZone(config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, nftqueue.GetStatus())
+	return
+}
+
+// nfqueueClearZone is the RESTD /api/control/zones/:zone DELETE handler, this will remove
+// the runtime change for a zone so the nfqueue settings are used again
+func nfqueueClearZone(c *gin.Context) {
+	err := nftqueue.ClearZone(c.Param("zone"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, nftqueue.GetStatus())
+	return
+}
@@ -0,0 +1,19 @@
+package restd
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/plugins/portscan"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// portscanUnblock is the RESTD /api/control/portscan DELETE handler, this will remove
+// the block for the scanner in the address query parameter or every block
+func portscanUnblock(c *gin.Context) {
+	logger.Debug("portscanUnblock()\n")
+
+	count := portscan.Unblock(c.Query("address"))
+	c.JSON(http.StatusOK, gin.H{"removed": count})
+	return
+}
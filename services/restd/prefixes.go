@@ -0,0 +1,18 @@
+package restd
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/prefixes"
+)
+
+// statusPrefixes is the RESTD /api/status/prefixes handler, this will return the
+// IPv6 prefixes delegated to the interfaces and the recent prefix changes
+func statusPrefixes(c *gin.Context) {
+	logger.Debug("statusPrefixes()\n")
+
+	c.JSON(http.StatusOK, prefixes.GetStatus())
+	return
+}
@@ -0,0 +1,117 @@
+package restd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/profiles"
+)
+
+// profilesList is the RESTD /api/profiles GET handler, this will return the profiles
+// with the pause and the quota usage of each
+func profilesList(c *gin.Context) {
+	logger.Debug("profilesList()\n")
+
+	c.JSON(http.StatusOK, profiles.GetProfiles())
+	return
+}
+
+// profilesGet is the RESTD /api/profiles/:id GET handler, this will return a profile
+func profilesGet(c *gin.Context) {
+	logger.Debug("profilesGet(%s)\n", c.Param("id"))
+
+	status, err := profiles.GetProfile(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+	return
+}
+
+// profilesSet is the RESTD /api/profiles POST handler, this will add a profile or
+// replace the one with the same id
+func profilesSet(c *gin.Context) {
+	var profile profiles.Profile
+
+	logger.Debug("profilesSet()\n")
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	profile.Enabled = true
+	if err = json.Unmarshal(body, &profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = profiles.SetProfile(profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+	return
+}
+
+// profilesRemove is the RESTD /api/profiles/:id DELETE handler, this will remove a profile
+func profilesRemove(c *gin.Context) {
+	logger.Debug("profilesRemove(%s)\n", c.Param("id"))
+
+	err := profiles.RemoveProfile(c.Param("id"))
+	if err == profiles.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+	return
+}
+
+// profilesPause is the RESTD /api/profiles/:id/pause handler, this will take the devices
+// of a profile offline for the minutes query parameter or until it is unpaused
+func profilesPause(c *gin.Context) {
+	logger.Debug("profilesPause(%s)\n", c.Param("id"))
+
+	var duration time.Duration
+	if minutes := c.Query("minutes"); minutes != "" {
+		value, err := strconv.Atoi(minutes)
+		if err != nil || value < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid minutes"})
+			return
+		}
+		duration = time.Duration(value) * time.Minute
+	}
+
+	status, err := profiles.Pause(c.Param("id"), duration)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+	return
+}
+
+// profilesUnpause is the RESTD /api/profiles/:id/unpause handler, this will bring the
+// devices of a profile back online
+func profilesUnpause(c *gin.Context) {
+	logger.Debug("profilesUnpause(%s)\n", c.Param("id"))
+
+	status, err := profiles.Unpause(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+	return
+}
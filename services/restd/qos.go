@@ -0,0 +1,33 @@
+package restd
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/qos"
+)
+
+// statusQos is the RESTD /api/status/qos handler, this will return the QoS state read back
+// from the kernel, whether it matches the settings, and the byte and drop counters of each class
+func statusQos(c *gin.Context) {
+	logger.Debug("statusQos()\n")
+
+	c.JSON(http.StatusOK, gin.H{"settings": qos.GetConfig(), "status": qos.GetStatus()})
+	return
+}
+
+// qosApply is the RESTD /api/control/qos POST handler, this will apply the QoS settings
+// and return the verified state
+func qosApply(c *gin.Context) {
+	logger.Debug("qosApply()\n")
+
+	status, err := qos.Apply()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "status": status})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+	return
+}
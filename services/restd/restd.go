@@ -2,37 +2,58 @@ package restd
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/plugins/example"
 	"github.com/untangle/packetd/services/certmanager"
 	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/faults"
+	"github.com/untangle/packetd/services/inventory"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/policy"
 	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/restd/client"
 	"github.com/untangle/packetd/services/settings"
 )
 
 var engine *gin.Engine
+var socketListener net.Listener
+var serverList []*http.Server
+var listenerMutex sync.Mutex
 
-// Startup is called to start the rest daemon
-func Startup() {
+// contextKey is used for the values we add to the request context
+type contextKey string
+
+// socketContextKey is set in the context of requests on the local unix socket
+const socketContextKey contextKey = "socket"
+
+// Startup is called to start the rest daemon. An error is returned if we
+// couldn't listen on any address, which usually means the ports are still held
+// by an old instance, so the service manager can try again.
+func Startup() error {
 
 	gin.SetMode(gin.ReleaseMode)
 	gin.DisableConsoleColor()
@@ -43,7 +64,7 @@ func Startup() {
 
 	engine = gin.New()
 	engine.Use(ginlogger())
-	engine.Use(gin.Recovery())
+	engine.Use(recoveryHandler)
 	engine.Use(addHeaders)
 
 	// Allow cross-site for dev - this should be disabled in production
@@ -79,6 +100,27 @@ func Startup() {
 	api.DELETE("/settings", trimSettings)
 	api.DELETE("/settings/*path", trimSettings)
 
+	api.GET("/staging", stagingStatus)
+	api.GET("/staging/settings", getStagedSettings)
+	api.GET("/staging/settings/*path", getStagedSettings)
+	api.POST("/staging/settings", stageSettings)
+	api.POST("/staging/settings/*path", stageSettings)
+	api.DELETE("/staging/settings", discardStagedSettings)
+	api.POST("/staging/validate", validateStagedSettings)
+	api.POST("/staging/commit", commitStagedSettings)
+	api.POST("/staging/confirm", confirmSettings)
+	api.POST("/staging/rollback", rollbackSettings)
+
+	api.GET("/profiles", profilesList)
+	api.GET("/profiles/:id", profilesGet)
+	api.POST("/profiles", profilesSet)
+	api.DELETE("/profiles/:id", profilesRemove)
+	api.POST("/profiles/:id/pause", profilesPause)
+	api.POST("/profiles/:id/unpause", profilesUnpause)
+
+	api.POST("/templates/render", renderTemplate)
+	api.POST("/templates/apply", applyTemplate)
+
 	api.GET("/logging/:logtype", getLogOutput)
 
 	api.GET("/defaults", getDefaultSettings)
@@ -87,22 +129,98 @@ func Startup() {
 	api.POST("/reports/create_query", reportsCreateQuery)
 	api.GET("/reports/get_data/:query_id", reportsGetData)
 	api.POST("/reports/close_query/:query_id", reportsCloseQuery)
+	api.GET("/reports/slow_queries", reportsSlowQueries)
+	api.GET("/reports/usage", reportsUsage)
+	api.GET("/reports/appconnections", reportsAppConnections)
+	api.GET("/reports/trafficmatrix", reportsTrafficMatrix)
+	api.GET("/reports/schema", reportsSchema)
+	api.GET("/reports/archive", reportsArchive)
+	api.GET("/reports/firewall", reportsFirewall)
+	api.GET("/reports/logins", reportsLogins)
+	api.GET("/reports/addressholder", reportsAddressHolder)
 
 	api.POST("/warehouse/capture", warehouseCapture)
 	api.POST("/warehouse/close", warehouseClose)
 	api.POST("/warehouse/playback", warehousePlayback)
+	api.GET("/warehouse/playback/state", warehousePlaybackState)
+	api.POST("/warehouse/playback/pause", warehousePlaybackPause)
+	api.POST("/warehouse/playback/resume", warehousePlaybackResume)
+	api.POST("/warehouse/playback/step", warehousePlaybackStep)
+	api.POST("/warehouse/playback/speed", warehousePlaybackSpeed)
 	api.POST("/warehouse/cleanup", warehouseCleanup)
 	api.GET("/warehouse/status", warehouseStatus)
+	api.POST("/warehouse/sanitize", warehouseSanitize)
+	api.POST("/warehouse/sessions/start", warehouseSessionsStart)
+	api.POST("/warehouse/sessions/stop", warehouseSessionsStop)
+	api.GET("/warehouse/sessions", warehouseSessions)
+	api.GET("/warehouse/sessions/:session_id", warehouseSessionFile)
 	api.POST("/control/traffic", trafficControl)
+	api.GET("/control/harness", harnessStatus)
+	api.POST("/control/harness", harnessConfig)
+	api.DELETE("/control/harness", harnessReset)
+	api.POST("/control/benchmark", benchmarkHandler)
+	api.GET("/control/zones", nfqueueStatus)
+	api.POST("/control/zones/:zone", nfqueueSetZone)
+	api.DELETE("/control/zones/:zone", nfqueueClearZone)
+	api.GET("/control/timeouts", conntimeoutStatus)
+	api.POST("/control/timeouts/:kind/:name", conntimeoutSet)
+	api.DELETE("/control/timeouts/:kind/:name", conntimeoutClear)
+	api.GET("/control/certcache", certcacheList)
+	api.DELETE("/control/certcache", certcacheFlush)
+	api.GET("/control/callbacks", callbacksList)
+	api.DELETE("/control/callbacks", callbacksReset)
+	api.DELETE("/control/portscan", portscanUnblock)
+	api.DELETE("/control/neighbors", neighborsUnblock)
+	api.POST("/control/dhcp/:device/release", dhcpRelease)
+	api.POST("/control/dhcp/:device/renew", dhcpRenew)
+	api.POST("/control/wifi/:device", wifiConfigure)
+	api.POST("/control/wifi/:device/scan", wifiScan)
+	api.DELETE("/control/wifi/:device/station/:mac", wifiKick)
+	api.POST("/control/wwan/:device/apn", wwanApplyAPN)
+	api.POST("/control/wwan/:device/connect", wwanConnect)
+	api.POST("/control/wwan/:device/disconnect", wwanDisconnect)
+	api.GET("/control/blocklist", blocklistList)
+	api.POST("/control/blocklist", blocklistAdd)
+	api.PUT("/control/blocklist", blocklistUpdate)
+	api.DELETE("/control/blocklist", blocklistRemove)
+	api.GET("/control/dnsrecords", dnsRecordsList)
+	api.POST("/control/dnsrecords", dnsRecordsAdd)
+	api.DELETE("/control/dnsrecords", dnsRecordsRemove)
+	api.GET("/control/hostnames", hostnamesList)
+	api.POST("/control/hostnames", hostnamesSet)
+	api.DELETE("/control/hostnames/:mac", hostnamesRemove)
+	api.POST("/control/qos", qosApply)
+
+	api.GET("/support/bundle", supportBundle)
+	api.GET("/support/crash/:name", supportCrash)
+	api.GET("/support/panics", supportPanicList)
+	api.GET("/support/panics/:id", supportPanicGet)
+	api.DELETE("/support/panics", supportPanicClear)
+	api.DELETE("/support/panics/:id", supportPanicRemove)
+	api.GET("/support/profiles", supportProfileList)
+	api.POST("/support/profiles", supportProfileCapture)
+	api.GET("/support/profiles/:id", supportProfileGet)
+	api.DELETE("/support/profiles", supportProfileClear)
 
 	api.GET("/status/sessions", statusSessions)
 	api.GET("/status/system", statusSystem)
+	api.GET("/status/health", statusHealth)
+	api.GET("/status/reportsdb", statusReportsDatabase)
+	api.GET("/status/clock", statusClock)
+	api.GET("/status/clockevents", statusClockEvents)
+	api.GET("/status/prefixes", statusPrefixes)
+	api.GET("/status/anomalies", statusAnomalies)
+	api.GET("/status/anomalyevents", statusAnomalyEvents)
+	api.GET("/status/names", statusNames)
+	api.GET("/status/qos", statusQos)
 	api.GET("/status/hardware", statusHardware)
 	api.GET("/status/upgrade", statusUpgradeAvailable)
 	api.GET("/status/build", statusBuild)
 	api.GET("/status/wantest/:device", statusWANTest)
 	api.GET("/status/uid", statusUID)
 	api.GET("/status/interfaces/:device", statusInterfaces)
+	api.GET("/status/neighbors", statusNeighbors)
+	api.GET("/status/neighbors/:device", statusNeighbors)
 	api.GET("/status/arp/", statusArp)
 	api.GET("/status/arp/:device", statusArp)
 	api.GET("/status/dhcp", statusDHCP)
@@ -112,11 +230,62 @@ func Startup() {
 	api.GET("/status/rules", statusRules)
 	api.GET("/status/routerules", statusRouteRules)
 	api.GET("/status/wwan/:device", statusWwan)
+	api.GET("/status/wwanmodems", statusWwanModems)
+	api.GET("/status/wwansignal/:device", statusWwanSignal)
+	api.GET("/status/wwanusage/:device", statusWwanUsage)
+	api.GET("/status/wwansms/:device", statusWwanMessages)
 	api.GET("/status/wifichannels/:device", statusWifiChannels)
 	api.GET("/status/wifimodelist/:device", statusWifiModelist)
+	api.GET("/status/wifiinterface/:device", statusWifiInterface)
+	api.GET("/status/wifistations/:device", statusWifiStations)
+	api.GET("/status/wifisurvey/:device", statusWifiSurvey)
+	api.GET("/status/wifiscan/:device", statusWifiScan)
+	api.GET("/status/wan", statusWan)
+	api.GET("/status/plugins", statusPlugins)
+	api.GET("/status/reporter", statusReporter)
+	api.GET("/status/tuning", statusTuning)
+	api.GET("/status/zones", statusZones)
+	api.GET("/status/policy", statusPolicy)
+	api.GET("/status/schedules", statusSchedules)
+	api.GET("/status/eventbus", statusEventbus)
+	api.GET("/status/elephant", statusElephant)
+	api.GET("/status/latency", statusLatency)
+	api.GET("/status/mirror", statusMirror)
+	api.GET("/status/midsession", statusMidSession)
+	api.GET("/status/conflicts", statusConflicts)
+	api.GET("/status/supervisor", statusSupervisor)
+	api.GET("/status/profiler", statusProfiler)
+	api.GET("/status/counters", statusCounters)
+	api.GET("/status/hasync", statusHASync)
+	api.GET("/status/patterns", statusPatterns)
+	api.GET("/status/sni", statusSni)
+	api.GET("/status/ratelimit", statusRateLimit)
+	api.GET("/status/portscan", statusPortScan)
+	api.GET("/status/neighborwatch", statusNeighborWatch)
+	api.GET("/status/neighborevents", statusNeighborEvents)
+	api.GET("/status/dscp", statusDSCP)
+	api.GET("/status/cloud", statusCloud)
+	api.GET("/status/msgbus", statusMsgbus)
+	api.GET("/status/rulestats", statusRuleStats)
+	api.GET("/status/blocklist", statusBlocklist)
+	api.GET("/status/tarpit", statusTarpit)
+
+	api.GET("/events", eventStream)
+
+	api.POST("/policy/dryrun", policyDryRun)
+	api.POST("/whatif", whatIfHandler)
+
+	api.GET("/discovery", getDiscovery)
 
 	api.GET("/logger/:source", loggerHandler)
 	api.GET("/debug", debugHandler)
+	api.POST("/debug/contention", debugContention)
+	api.GET("/debug/trace", traceStatus)
+	api.POST("/debug/trace", traceStart)
+	api.DELETE("/debug/trace", traceStop)
+	api.GET("/debug/faults", faultsStatus)
+	api.POST("/debug/faults", faultsSet)
+	api.DELETE("/debug/faults", faultsClear)
 	api.POST("/gc", gcHandler)
 
 	api.POST("/sysupgrade", sysupgradeHandler)
@@ -144,20 +313,172 @@ func Startup() {
 	prof.GET("/mutex", pprofHandler(pprof.Handler("mutex").ServeHTTP))
 	prof.GET("/threadcreate", pprofHandler(pprof.Handler("threadcreate").ServeHTTP))
 
-	// listen and serve on 0.0.0.0:80
-	go engine.Run(":80")
+	// listen and serve on port 80 and 443 for each enabled address family
+	if !startListeners() {
+		return fmt.Errorf("unable to listen on any address")
+	}
 
-	cert, key := certmanager.GetConfiguredCert()
-	go engine.RunTLS(":443", cert, key)
+	// listen on the local unix socket for packetctl
+	startSocket()
 
 	logger.Info("The RestD engine has been started\n")
+	return nil
 }
 
 // Shutdown restd
 func Shutdown() {
+	stopSocket()
+	stopListeners()
 	return
 }
 
+// startListeners starts the HTTP and HTTPS servers on the address families
+// enabled in the settings. We use a separate socket for each family instead
+// of a single wildcard socket so IPv4 keeps working when IPv6 is unavailable,
+// and IPv6 doesn't depend on the bindv6only setting of the kernel. It returns
+// false if none of the servers could be started.
+func startListeners() bool {
+	listenIPv4, listenIPv6 := getListenFamilies()
+	cert, key := certmanager.GetConfiguredCert()
+
+	var addresses []string
+	if listenIPv4 {
+		addresses = append(addresses, "0.0.0.0")
+	}
+	if listenIPv6 {
+		addresses = append(addresses, "::")
+	}
+
+	var started bool
+	for _, address := range addresses {
+		if startListener(address, 80, "", "") {
+			started = true
+		}
+		if startListener(address, 443, cert, key) {
+			started = true
+		}
+	}
+	return started
+}
+
+// startListener starts a server on the argumented address and port, using
+// TLS if a certificate is passed. It returns false if we couldn't listen.
+func startListener(address string, port int, cert string, key string) bool {
+	network := "tcp4"
+	if strings.Contains(address, ":") {
+		network = "tcp6"
+	}
+
+	hostport := net.JoinHostPort(address, strconv.Itoa(port))
+	listener, err := net.Listen(network, hostport)
+	if err != nil {
+		logger.Warn("Unable to listen on %s: %s\n", hostport, err.Error())
+		return false
+	}
+
+	server := &http.Server{Handler: engine}
+	listenerMutex.Lock()
+	serverList = append(serverList, server)
+	listenerMutex.Unlock()
+
+	logger.Info("Listening on %s\n", hostport)
+
+	go func() {
+		var serveErr error
+		if cert != "" {
+			serveErr = server.ServeTLS(listener, cert, key)
+		} else {
+			serveErr = server.Serve(listener)
+		}
+		if serveErr != nil && serveErr != http.ErrServerClosed {
+			logger.Warn("Server on %s stopped: %s\n", hostport, serveErr.Error())
+		}
+	}()
+	return true
+}
+
+// stopListeners closes the HTTP and HTTPS servers
+func stopListeners() {
+	listenerMutex.Lock()
+	defer listenerMutex.Unlock()
+
+	for _, server := range serverList {
+		server.Close()
+	}
+	serverList = nil
+}
+
+// getListenFamilies returns the address families enabled in the restd
+// settings. Both are enabled by default.
+func getListenFamilies() (bool, bool) {
+	listenIPv4 := true
+	listenIPv6 := true
+
+	restdJSON, err := settings.GetCurrentSettings([]string{"system", "restd"})
+	if restdJSON == nil || err != nil {
+		return listenIPv4, listenIPv6
+	}
+
+	item, ok := restdJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid restd settings: %T\n", restdJSON)
+		return listenIPv4, listenIPv6
+	}
+
+	if value, ok := item["listenIPv4"].(bool); ok {
+		listenIPv4 = value
+	}
+	if value, ok := item["listenIPv6"].(bool); ok {
+		listenIPv6 = value
+	}
+
+	if !listenIPv4 && !listenIPv6 {
+		logger.Warn("Both IPv4 and IPv6 are disabled in restd settings, enabling both\n")
+		return true, true
+	}
+
+	return listenIPv4, listenIPv6
+}
+
+// startSocket starts serving the API on the local unix socket. The socket
+// is only accessible by root so requests on it are trusted like requests
+// from a local root process.
+func startSocket() {
+	os.Remove(client.SocketFile)
+
+	listener, err := net.Listen("unix", client.SocketFile)
+	if err != nil {
+		logger.Warn("Unable to listen on %s: %s\n", client.SocketFile, err.Error())
+		return
+	}
+
+	err = os.Chmod(client.SocketFile, 0600)
+	if err != nil {
+		logger.Warn("Unable to set permissions on %s: %s\n", client.SocketFile, err.Error())
+		listener.Close()
+		return
+	}
+
+	socketListener = listener
+	server := &http.Server{
+		Handler: engine,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, socketContextKey, true)
+		},
+	}
+	go server.Serve(listener)
+}
+
+// stopSocket stops serving the API on the local unix socket
+func stopSocket() {
+	if socketListener == nil {
+		return
+	}
+	socketListener.Close()
+	socketListener = nil
+	os.Remove(client.SocketFile)
+}
+
 // GenerateRandomString generates a random string of the specified length
 func GenerateRandomString(n int) string {
 	b := make([]byte, n)
@@ -243,12 +564,95 @@ func loggerHandler(c *gin.Context) {
 	})
 }
 
+// debugHandler is the RESTD /api/debug handler. It returns the counters as an HTML
+// table, or the structured diagnostics when called with format=json.
 func debugHandler(c *gin.Context) {
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, getDiagnostics())
+		return
+	}
+
 	var buffer bytes.Buffer
 	buffer = overseer.GenerateReport()
 	c.Data(http.StatusOK, "text/html; chareset=utf-8", buffer.Bytes())
 }
 
+// traceStatus is the RESTD /api/debug/trace GET handler. It returns the options of the
+// dispatch trace and the decisions recorded for the traced packets.
+func traceStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, dispatch.GetTraceStatus())
+}
+
+// traceStart is the RESTD /api/debug/trace POST handler. It starts tracing the packets of
+// a ctid or of the new sessions that match a filter.
+func traceStart(c *gin.Context) {
+	var config dispatch.TraceConfig
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = dispatch.StartTrace(config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, "Trace started")
+}
+
+// traceStop is the RESTD /api/debug/trace DELETE handler
+func traceStop(c *gin.Context) {
+	dispatch.StopTrace()
+	c.JSON(http.StatusOK, "Trace finished")
+}
+
+// faultsStatus is the RESTD /api/debug/faults GET handler. It returns the faults
+// setting and the faults being injected.
+func faultsStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, faults.GetStatus())
+}
+
+// faultsSet is the RESTD /api/debug/faults POST handler. It injects a delay or errors
+// at a fault point, which is only allowed while faults are enabled in the settings.
+func faultsSet(c *gin.Context) {
+	var fault faults.Fault
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &fault)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = faults.Set(fault)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, "Fault injected")
+}
+
+// faultsClear is the RESTD /api/debug/faults DELETE handler
+func faultsClear(c *gin.Context) {
+	faults.Clear()
+	c.JSON(http.StatusOK, "Faults cleared")
+}
+
 func gcHandler(c *gin.Context) {
 	logger.Info("Calling FreeOSMemory()...\n")
 	debug.FreeOSMemory()
@@ -273,6 +677,12 @@ func reportsGetData(c *gin.Context) {
 		return
 	}
 
+	err = reports.CheckQueryScope(queryID, getReportScope(c))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"error": err.Error()})
+		return
+	}
+
 	str, err := reports.GetData(queryID)
 	if err != nil {
 		//c.JSON(http.StatusInternalServerError, gin.H{"error": err})
@@ -294,7 +704,7 @@ func reportsCreateQuery(c *gin.Context) {
 		return
 	}
 
-	q, err := reports.CreateQuery(string(body))
+	q, err := reports.CreateScopedQuery(string(body), getReportScope(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -316,6 +726,12 @@ func reportsCloseQuery(c *gin.Context) {
 		return
 	}
 
+	err = reports.CheckQueryScope(queryID, getReportScope(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	str, err := reports.CloseQuery(queryID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
@@ -326,6 +742,313 @@ func reportsCloseQuery(c *gin.Context) {
 	return
 }
 
+// reportsSlowQueries is the RESTD /api/reports/slow_queries handler. It returns the recent
+// report queries that ran longer than the slow query threshold, with their definitions and
+// the rows and time they took.
+func reportsSlowQueries(c *gin.Context) {
+	c.JSON(http.StatusOK, reports.GetSlowQueries())
+	return
+}
+
+// reportsUsage is the RESTD /api/reports/usage handler. It returns the bandwidth usage
+// per device for the daily or monthly period, defaulting to the current month.
+// The optional start and end parameters are milliseconds since the epoch.
+func reportsUsage(c *gin.Context) {
+	period := c.DefaultQuery("period", "monthly")
+	endTime := time.Now()
+	startTime := reports.GetUsagePeriodStart(period, endTime)
+
+	if value := c.Query("start"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		startTime = time.Unix(0, msec*1e6)
+	}
+
+	if value := c.Query("end"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		endTime = time.Unix(0, msec*1e6)
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := reports.GetUsage(period, startTime, endTime, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// reportsAppConnections is the RESTD /api/reports/appconnections handler. It returns the distinct
+// device, application and server combinations with the first and last time each was seen and the
+// session and byte totals, defaulting to the current month. The optional start and end parameters
+// are milliseconds since the epoch, and application, mac, and server filter the combinations.
+func reportsAppConnections(c *gin.Context) {
+	filter := reports.AppConnectionFilter{
+		EndTime:     time.Now(),
+		Application: c.Query("application"),
+		MacAddress:  c.Query("mac"),
+		Server:      c.Query("server"),
+	}
+	filter.StartTime = reports.GetUsagePeriodStart("monthly", filter.EndTime)
+
+	if value := c.Query("start"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.StartTime = time.Unix(0, msec*1e6)
+	}
+
+	if value := c.Query("end"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.EndTime = time.Unix(0, msec*1e6)
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.Limit = limit
+
+	result, err := reports.GetAppConnections(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// reportsTrafficMatrix is the RESTD /api/reports/trafficmatrix handler. It returns the bytes
+// passed between each pair of client and server country, ASN, or both, for the last day.
+// The optional start and end parameters are milliseconds since the epoch, and the optional
+// interval splits the totals into periods of that many seconds.
+func reportsTrafficMatrix(c *gin.Context) {
+	dimension := c.DefaultQuery("by", "country")
+	endTime := time.Now()
+	startTime := endTime.Add(-24 * time.Hour)
+
+	if value := c.Query("start"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		startTime = time.Unix(0, msec*1e6)
+	}
+
+	if value := c.Query("end"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		endTime = time.Unix(0, msec*1e6)
+	}
+
+	interval, err := strconv.Atoi(c.DefaultQuery("interval", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := reports.GetTrafficMatrix(dimension, startTime, endTime, interval, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// reportsSchema is the RESTD /api/reports/schema handler. It returns the tables in the
+// reports database with their columns, and the owner of the tables registered by the
+// plugins and services.
+func reportsSchema(c *gin.Context) {
+	result, err := reports.GetSchema()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// reportsArchive is the RESTD /api/reports/archive handler. It returns the archived ranges
+// of the report tables and where they were written. The optional table parameter limits
+// the result to one table and the optional start and end parameters, in milliseconds, to
+// the ranges that overlap them.
+func reportsArchive(c *gin.Context) {
+	startTime := time.Unix(0, 0)
+	endTime := time.Now()
+
+	if value := c.Query("start"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		startTime = time.Unix(0, msec*1e6)
+	}
+
+	if value := c.Query("end"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		endTime = time.Unix(0, msec*1e6)
+	}
+
+	result, err := reports.GetArchiveCatalog(c.Query("table"), startTime, endTime)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// reportsFirewall is the RESTD /api/reports/firewall handler. It returns the firewall log events
+// for the last day with the most recent first. The optional start and end parameters are
+// milliseconds since the epoch, and table, chain, rule, action, zone, and address filter the events.
+func reportsFirewall(c *gin.Context) {
+	filter := reports.FirewallFilter{
+		EndTime: time.Now(),
+		Table:   c.Query("table"),
+		Chain:   c.Query("chain"),
+		Action:  c.Query("action"),
+		Zone:    c.Query("zone"),
+		Address: c.Query("address"),
+	}
+	filter.StartTime = filter.EndTime.Add(-24 * time.Hour)
+
+	if value := c.Query("start"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.StartTime = time.Unix(0, msec*1e6)
+	}
+
+	if value := c.Query("end"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.EndTime = time.Unix(0, msec*1e6)
+	}
+
+	if value := c.Query("rule"); value != "" {
+		ruleID, err := strconv.Atoi(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.RuleID = ruleID
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.Limit = limit
+
+	result, err := reports.GetFirewallEvents(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// addressHolder is the result of the address holder query with the inventory
+// entry of the device that had the lease
+type addressHolder struct {
+	*reports.AddressHolder
+	Device *inventory.Device `json:"device"`
+}
+
+// reportsAddressHolder is the RESTD /api/reports/addressholder handler. It returns the device
+// and users that held the address parameter at the time parameter, which is milliseconds since
+// the epoch and defaults to now. The DHCP lease that covered the time is returned with the
+// inventory entry of its device, and the hostnames and usernames of the sessions of the address
+// within the optional window parameter, in seconds, around the time.
+func reportsAddressHolder(c *gin.Context) {
+	address := net.ParseIP(c.Query("address"))
+	if address == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid address"})
+		return
+	}
+
+	at := time.Now()
+	if value := c.Query("time"); value != "" {
+		msec, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		at = time.Unix(0, msec*1e6)
+	}
+
+	window, err := strconv.Atoi(c.DefaultQuery("window", "300"))
+	if err != nil || window < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid window"})
+		return
+	}
+
+	holder, err := reports.GetAddressHolder(address.String(), at, time.Duration(window)*time.Second)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := addressHolder{AddressHolder: holder}
+	if holder.Lease != nil {
+		if mac, err := net.ParseMAC(holder.Lease.MacAddress); err == nil {
+			result.Device = inventory.FindDevice(mac)
+		}
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
 func warehousePlayback(c *gin.Context) {
 	var data map[string]string
 	var body []byte
@@ -363,16 +1086,106 @@ func warehousePlayback(c *gin.Context) {
 		speedval = 1
 	}
 
+	// the playback can start paused so it can be stepped from the first record
+	pausedstr, found := data["paused"]
+	kernel.SetWarehousePaused(found && pausedstr == "true")
+
 	kernel.SetWarehouseFlag('P')
-	kernel.SetWarehouseFile(filename)
 	kernel.SetWarehouseSpeed(speedval)
 
 	logger.Info("Beginning playback of file:%s speed:%d\n", filename, speedval)
-	dispatch.HandleWarehousePlayback()
+	err = dispatch.HandleWarehousePlayback(filename)
+	if err != nil {
+		kernel.SetWarehouseFlag('I')
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
 	c.JSON(http.StatusOK, "Playback started")
 }
 
+// warehousePlaybackState is the RESTD /api/warehouse/playback/state handler. It returns the
+// position of the playback and the dispatch and plugin state of the last record played.
+func warehousePlaybackState(c *gin.Context) {
+	c.JSON(http.StatusOK, dispatch.GetPlaybackState())
+}
+
+// warehousePlaybackPause is the RESTD /api/warehouse/playback/pause handler
+func warehousePlaybackPause(c *gin.Context) {
+	dispatch.PausePlayback(true)
+	c.JSON(http.StatusOK, "Playback paused")
+}
+
+// warehousePlaybackResume is the RESTD /api/warehouse/playback/resume handler
+func warehousePlaybackResume(c *gin.Context) {
+	dispatch.PausePlayback(false)
+	c.JSON(http.StatusOK, "Playback resumed")
+}
+
+// warehousePlaybackStep is the RESTD /api/warehouse/playback/step handler. It plays the
+// count records of a paused playback, or a single record if the count is not specified.
+func warehousePlaybackStep(c *gin.Context) {
+	var data struct {
+		Count int `json:"count"`
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	data.Count = 1
+	if len(body) != 0 {
+		err = json.Unmarshal(body, &data)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	err = dispatch.StepPlayback(data.Count)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, "Playback stepped")
+}
+
+// warehousePlaybackSpeed is the RESTD /api/warehouse/playback/speed handler. It changes the
+// speed of the running playback.
+func warehousePlaybackSpeed(c *gin.Context) {
+	var data struct {
+		Speed *int `json:"speed"`
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if data.Speed == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "speed not specified"})
+		return
+	}
+
+	err = dispatch.SetPlaybackSpeed(*data.Speed)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, "Playback speed changed")
+}
+
 func warehouseCleanup(c *gin.Context) {
 	dispatch.HandleWarehouseCleanup()
 	c.JSON(http.StatusOK, "Cleanup success\n")
@@ -404,9 +1217,12 @@ func warehouseCapture(c *gin.Context) {
 		return
 	}
 
+	err = dispatch.StartWarehouseCapture(filename)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	kernel.SetWarehouseFlag('C')
-	kernel.SetWarehouseFile(filename)
-	kernel.StartWarehouseCapture()
 
 	logger.Info("Beginning capture to file:%s\n", filename)
 
@@ -414,7 +1230,7 @@ func warehouseCapture(c *gin.Context) {
 }
 
 func warehouseClose(c *gin.Context) {
-	kernel.CloseWarehouseCapture()
+	dispatch.CloseWarehouseCapture()
 	kernel.SetWarehouseFlag('I')
 
 	c.JSON(http.StatusOK, "Capture finished\n")
@@ -439,6 +1255,109 @@ func warehouseStatus(c *gin.Context) {
 	c.JSON(http.StatusOK, status)
 }
 
+// warehouseSanitize is the RESTD /api/warehouse/sanitize handler. It writes a copy of the
+// warehouse or pcap capture filename with the client addresses anonymized and the payloads
+// stripped to the target filename, which defaults to the filename with .sanitized added.
+func warehouseSanitize(c *gin.Context) {
+	var data map[string]string
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename, found := data["filename"]
+	if !found {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "filename not specified"})
+		return
+	}
+
+	target, found := data["target"]
+	if !found {
+		target = filename + ".sanitized"
+	}
+	if target == filename {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target must not be the capture file"})
+		return
+	}
+
+	result, err := dispatch.SanitizeFile(filename, target)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// warehouseSessionsStart is the RESTD /api/warehouse/sessions/start handler. It starts writing
+// each new session that matches the filter to its own capture file.
+func warehouseSessionsStart(c *gin.Context) {
+	var config dispatch.SessionCaptureConfig
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(body) != 0 {
+		err = json.Unmarshal(body, &config)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	err = dispatch.StartSessionCapture(config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, "Session capture started")
+}
+
+// warehouseSessionsStop is the RESTD /api/warehouse/sessions/stop handler. It stops the session
+// capture and finishes the files of the sessions still being captured.
+func warehouseSessionsStop(c *gin.Context) {
+	dispatch.StopSessionCapture()
+	c.JSON(http.StatusOK, "Session capture finished")
+}
+
+// warehouseSessions is the RESTD /api/warehouse/sessions handler. It returns the options of the
+// session capture and the index of the captured sessions.
+func warehouseSessions(c *gin.Context) {
+	c.JSON(http.StatusOK, dispatch.GetSessionCaptureStatus())
+}
+
+// warehouseSessionFile is the RESTD /api/warehouse/sessions/:session_id handler. It returns the
+// capture file of a session.
+func warehouseSessionFile(c *gin.Context) {
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename, err := dispatch.GetSessionCaptureFile(sessionID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+filepath.Base(filename))
+	c.File(filename)
+}
+
 func trafficControl(c *gin.Context) {
 	var data map[string]string
 	var body []byte
@@ -477,6 +1396,112 @@ func trafficControl(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"error": "Invalid or missing traffic control command"})
 }
 
+// benchmarkHandler is the RESTD /api/control/benchmark handler, this will run the
+// benchmark traffic profile through dispatch and return the throughput and plugin latency
+func benchmarkHandler(c *gin.Context) {
+	sessions, err := strconv.Atoi(c.DefaultQuery("sessions", "1000"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	packets, err := strconv.Atoi(c.DefaultQuery("packets", "10"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := dispatch.RunBenchmark(sessions, packets)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// harnessStatus is the RESTD /api/control/harness GET handler, this will return the test harness config and counters
+func harnessStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, example.GetHarnessStatus())
+	return
+}
+
+// harnessConfig is the RESTD /api/control/harness POST handler, this will replace the test harness config
+func harnessConfig(c *gin.Context) {
+	var config example.HarnessConfig
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = example.SetHarnessConfig(config)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, example.GetHarnessStatus())
+	return
+}
+
+// harnessReset is the RESTD /api/control/harness DELETE handler, this will reset the test harness counters
+func harnessReset(c *gin.Context) {
+	example.ResetHarnessCounters()
+	c.JSON(http.StatusOK, example.GetHarnessStatus())
+	return
+}
+
+// policyDryRun is the RESTD /api/policy/dryrun handler, this will evaluate the policy
+// against the session fields in the request and return the decisions and how each
+// rule was evaluated. The time is optional and must be in RFC3339 format, and an
+// optional policy in the request is evaluated instead of the active policy.
+func policyDryRun(c *gin.Context) {
+	var request struct {
+		Fields map[string]string `json:"fields"`
+		Time   string            `json:"time"`
+		Policy interface{}       `json:"policy"`
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	if request.Time != "" {
+		now, err = time.Parse(time.RFC3339, request.Time)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	result, err := policy.DryRun(request.Policy, request.Fields, now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
 func getSettings(c *gin.Context) {
 	var segments []string
 
@@ -488,7 +1513,20 @@ func getSettings(c *gin.Context) {
 		segments = RemoveEmptyStrings(strings.Split(path, "/"))
 	}
 
-	jsonResult, err := settings.GetSettings(segments)
+	var jsonResult interface{}
+	var err error
+
+	// the secrets are only returned to the privileged callers that ask for them
+	if c.Query("secrets") == "true" {
+		if !isPrivileged(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "The secrets scope requires a privileged session"})
+			return
+		}
+		jsonResult, err = settings.GetPrivilegedSettings(segments)
+	} else {
+		jsonResult, err = settings.GetSettings(segments)
+	}
+
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, jsonResult)
 	} else {
@@ -0,0 +1,195 @@
+package restd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// stagingStatus is the RESTD /api/staging handler, this will return the state of the staged settings and any pending commit
+func stagingStatus(c *gin.Context) {
+	logger.Debug("stagingStatus()\n")
+
+	c.JSON(http.StatusOK, settings.GetStagingStatus())
+	return
+}
+
+// getStagedSettings is the RESTD /api/staging/settings GET handler, this will return the staged settings at the path
+func getStagedSettings(c *gin.Context) {
+	jsonResult, err := settings.GetStagedSettings(getPathSegments(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, jsonResult)
+		return
+	}
+
+	c.JSON(http.StatusOK, jsonResult)
+	return
+}
+
+// stageSettings is the RESTD /api/staging/settings POST handler, this will change the staged settings at the path
+func stageSettings(c *gin.Context) {
+	var value interface{}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	jsonResult, err := settings.StageSettings(getPathSegments(c), value)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, jsonResult)
+		return
+	}
+
+	c.JSON(http.StatusOK, jsonResult)
+	return
+}
+
+// discardStagedSettings is the RESTD /api/staging/settings DELETE handler, this will throw away the staged settings
+func discardStagedSettings(c *gin.Context) {
+	err := settings.DiscardStagedSettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+	return
+}
+
+// validateStagedSettings is the RESTD /api/staging/validate handler, this will validate the staged settings
+func validateStagedSettings(c *gin.Context) {
+	result, err := settings.ValidateStagedSettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// commitStagedSettings is the RESTD /api/staging/commit handler, this will validate and apply the
+// staged settings. The confirm query sets the seconds allowed to confirm the commit before it is
+// rolled back, and zero applies the settings without a rollback.
+func commitStagedSettings(c *gin.Context) {
+	confirm, err := strconv.Atoi(c.DefaultQuery("confirm", strconv.Itoa(settings.DefaultConfirmSeconds)))
+	if err != nil || confirm < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid confirm seconds"})
+		return
+	}
+
+	result, err := settings.CommitStagedSettings(confirm)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "validation": result})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "OK", "confirmSeconds": confirm, "validation": result})
+	return
+}
+
+// confirmSettings is the RESTD /api/staging/confirm handler, this will keep the committed settings
+func confirmSettings(c *gin.Context) {
+	err := settings.ConfirmSettings()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "OK"})
+	return
+}
+
+// rollbackSettings is the RESTD /api/staging/rollback handler, this will restore the settings from before the commit
+func rollbackSettings(c *gin.Context) {
+	output, err := settings.RollbackSettings()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "output": output})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "OK", "output": output})
+	return
+}
+
+// templateRequest is the body of a settings template request. The path is
+// where the rendered template goes and is the whole settings when empty.
+type templateRequest struct {
+	Path      string                 `json:"path"`
+	Template  interface{}            `json:"template"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// renderTemplate is the RESTD /api/templates/render handler, this will render and validate a settings
+// template against the current settings without applying it
+func renderTemplate(c *gin.Context) {
+	handleTemplate(c, true)
+}
+
+// applyTemplate is the RESTD /api/templates/apply handler, this will render, validate, and commit a
+// settings template. The confirm query works like it does for /api/staging/commit.
+func applyTemplate(c *gin.Context) {
+	handleTemplate(c, false)
+}
+
+// handleTemplate renders a settings template and validates or applies the result
+func handleTemplate(c *gin.Context, dryRun bool) {
+	var request templateRequest
+
+	confirm, err := strconv.Atoi(c.DefaultQuery("confirm", strconv.Itoa(settings.DefaultConfirmSeconds)))
+	if err != nil || confirm < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid confirm seconds"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Template == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "template not specified"})
+		return
+	}
+
+	logger.Debug("handleTemplate() path:%s dryrun:%v\n", request.Path, dryRun)
+
+	segments := RemoveEmptyStrings(strings.Split(request.Path, "/"))
+	result, err := settings.ApplyTemplate(segments, request.Template, request.Variables, confirm, dryRun)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "template": result})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// getPathSegments returns the settings path segments from the request
+func getPathSegments(c *gin.Context) []string {
+	path := c.Param("path")
+	if path == "" {
+		return nil
+	}
+	return RemoveEmptyStrings(strings.Split(path, "/"))
+}
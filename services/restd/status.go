@@ -2,6 +2,7 @@ package restd
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,9 +15,36 @@ import (
 
 	"github.com/c9s/goprocinfo/linux"
 	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/plugins/dscp"
+	"github.com/untangle/packetd/plugins/portscan"
+	"github.com/untangle/packetd/plugins/ratelimit"
+	"github.com/untangle/packetd/plugins/reporter"
+	"github.com/untangle/packetd/plugins/sni"
 	"github.com/untangle/packetd/plugins/stats"
+	"github.com/untangle/packetd/plugins/wanfailover"
+	"github.com/untangle/packetd/services/blocklist"
+	"github.com/untangle/packetd/services/cloud"
+	"github.com/untangle/packetd/services/discovery"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/hasync"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/msgbus"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/patterns"
+	"github.com/untangle/packetd/services/pluginsdk"
+	"github.com/untangle/packetd/services/policy"
+	"github.com/untangle/packetd/services/preflight"
+	"github.com/untangle/packetd/services/profiler"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/rulestats"
+	"github.com/untangle/packetd/services/schedule"
+	"github.com/untangle/packetd/services/servicemgr"
 	"github.com/untangle/packetd/services/settings"
+	"github.com/untangle/packetd/services/supervisor"
+	"github.com/untangle/packetd/services/tarpit"
+	"github.com/untangle/packetd/services/tuning"
+	"github.com/untangle/packetd/services/zones"
 )
 
 // statusSystem is the RESTD /api/status/system handler
@@ -67,9 +95,29 @@ func statusSystem(c *gin.Context) {
 		stats["tmpfs"] = tmpfs
 	}
 
+	stats["services"] = servicemgr.GetStatus()
+	stats["partialStartup"] = servicemgr.IsPartial()
+
 	c.JSON(http.StatusOK, stats)
 }
 
+// statusHealth is the RESTD /api/status/health handler, this will return the startup checks and the names of the ones that failed
+func statusHealth(c *gin.Context) {
+	logger.Debug("statusHealth()\n")
+
+	c.JSON(http.StatusOK, preflight.GetStatus())
+	return
+}
+
+// statusReportsDatabase is the RESTD /api/status/reportsdb handler, this will return the result of the
+// reports database check done at startup and the damage it found
+func statusReportsDatabase(c *gin.Context) {
+	logger.Debug("statusReportsDatabase()\n")
+
+	c.JSON(http.StatusOK, reports.GetIntegrityStatus())
+	return
+}
+
 // statusHardware is the RESTD /api/status/system handler
 func statusHardware(c *gin.Context) {
 	logger.Debug("statusHardware()\n")
@@ -188,7 +236,21 @@ func statusInterfaces(c *gin.Context) {
 	return
 }
 
-// statusArp is the RESTD /api/status/arp handler, this will return the arp table
+// statusNeighbors is the RESTD /api/status/neighbors handler, this will return
+// the IPv4 ARP table and the IPv6 NDP table
+func statusNeighbors(c *gin.Context) {
+	device := c.Param("device")
+	cmdArgs := []string{"neigh"}
+
+	if len(device) > 0 {
+		cmdArgs = []string{"neigh", "show", "dev", device}
+	}
+
+	runDualStackCommand(c, cmdArgs)
+}
+
+// statusArp is the RESTD /api/status/arp handler, this will return the neighbor
+// table of both families as a single list. New callers should use statusNeighbors.
 func statusArp(c *gin.Context) {
 	device := c.Param("device")
 	cmdArgs := []string{"neigh"}
@@ -209,8 +271,11 @@ func statusArp(c *gin.Context) {
 	return
 }
 
-// statusDHCP is the RESTD /api/status/dhcp handler, this will return DHCP records
+// statusDHCP is the RESTD /api/status/dhcp handler, this will return the DHCP
+// leases, the DHCPv6 leases, and the routers learned from IPv6 router
+// advertisements. If the inet family is passed only the DHCP leases are returned.
 func statusDHCP(c *gin.Context) {
+	query := c.Request.URL.Query()
 
 	result, err := getDHCPInfo()
 	if err != nil {
@@ -218,14 +283,31 @@ func statusDHCP(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	if query["family"] != nil && (query["family"][0] == "inet" || query["family"][0] == "4") {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	result6, err := getDHCPv6Info()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		return
+	}
+
+	routers, err := runIPCommand([]string{"-6", "route", "show", "proto", "ra"})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ipv4": result, "ipv6": result6, "ra": ipCommandJSON(routers)})
 	return
 }
 
-// statusRoute is the RESTD /api/status/route handler, this will return route information
+// statusRoute is the RESTD /api/status/route handler, this will return the IPv4
+// and IPv6 routes, or the routes of one family if the family is passed
 func statusRoute(c *gin.Context) {
 	table := c.Param("table")
-	query := c.Request.URL.Query()
 
 	cmdArgs := []string{"route"}
 
@@ -233,21 +315,7 @@ func statusRoute(c *gin.Context) {
 		cmdArgs = []string{"route", "show", "table", table}
 	}
 
-	//if the ip protocol is passed in, prepend it
-	if query["family"] != nil && len(query["family"][0]) > 0 {
-		cmdArgs = append([]string{"-" + query["family"][0]}, cmdArgs...)
-	}
-
-	result, err := runIPCommand(cmdArgs)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
-		return
-	}
-
-	// note here: the output type is already in JSON, setting the content-type before calling c.String will force the header
-	c.Header("Content-Type", "application/json")
-	c.String(http.StatusOK, string(result))
-	return
+	runDualStackCommand(c, cmdArgs)
 }
 
 // statusRules is the RESTD /api/status/rules handler, this will return ip rule information
@@ -352,6 +420,231 @@ func statusWifiModelist(c *gin.Context) {
 	return
 }
 
+// statusWan is the RESTD /api/status/wan handler, this will return the failover state of each WAN
+func statusWan(c *gin.Context) {
+	logger.Debug("statusWan()\n")
+
+	c.JSON(http.StatusOK, wanfailover.GetWanStates())
+	return
+}
+
+// statusPlugins is the RESTD /api/status/plugins handler, this will return the status and health of each plugin
+func statusPlugins(c *gin.Context) {
+	logger.Debug("statusPlugins()\n")
+
+	c.JSON(http.StatusOK, pluginsdk.GetPluginStatus())
+	return
+}
+
+// statusReporter is the RESTD /api/status/reporter handler, this will return the reporter queue depth and drop counts
+func statusReporter(c *gin.Context) {
+	logger.Debug("statusReporter()\n")
+
+	c.JSON(http.StatusOK, reporter.GetQueueStatus())
+	return
+}
+
+// statusTuning is the RESTD /api/status/tuning handler, this will return the system tuning settings and current values
+func statusTuning(c *gin.Context) {
+	logger.Debug("statusTuning()\n")
+
+	c.JSON(http.StatusOK, tuning.GetStatus())
+	return
+}
+
+// statusZones is the RESTD /api/status/zones handler, this will return the zones and the zone of each interface
+func statusZones(c *gin.Context) {
+	logger.Debug("statusZones()\n")
+
+	c.JSON(http.StatusOK, zones.GetStatus())
+	return
+}
+
+// statusPolicy is the RESTD /api/status/policy handler, this will return the policy rules with the hit counters and the quota usage
+func statusPolicy(c *gin.Context) {
+	logger.Debug("statusPolicy()\n")
+
+	c.JSON(http.StatusOK, policy.GetStatus())
+	return
+}
+
+// statusSchedules is the RESTD /api/status/schedules handler, this will return the schedules and whether each is active
+func statusSchedules(c *gin.Context) {
+	logger.Debug("statusSchedules()\n")
+
+	c.JSON(http.StatusOK, schedule.GetStatus())
+	return
+}
+
+// statusEventbus is the RESTD /api/status/eventbus handler, this will return the published event counts and the subscribers
+func statusEventbus(c *gin.Context) {
+	logger.Debug("statusEventbus()\n")
+
+	c.JSON(http.StatusOK, eventbus.GetStatus())
+	return
+}
+
+// statusElephant is the RESTD /api/status/elephant handler, this will return the elephant flow cutoff settings and the number of released sessions
+func statusElephant(c *gin.Context) {
+	logger.Debug("statusElephant()\n")
+
+	c.JSON(http.StatusOK, dispatch.GetElephantStatus())
+	return
+}
+
+// statusLatency is the RESTD /api/status/latency handler, this will return the TCP handshake round trip times for the servers and interfaces
+func statusLatency(c *gin.Context) {
+	logger.Debug("statusLatency()\n")
+
+	c.JSON(http.StatusOK, dispatch.GetLatencyStatus())
+	return
+}
+
+// statusMirror is the RESTD /api/status/mirror handler, this will return the traffic mirror targets and the mirrored packet counters
+func statusMirror(c *gin.Context) {
+	logger.Debug("statusMirror()\n")
+
+	c.JSON(http.StatusOK, dispatch.GetMirrorStatus())
+	return
+}
+
+// statusMidSession is the RESTD /api/status/midsession handler, this will return the mid-session packet handling counters and the recent mid-session flows
+func statusMidSession(c *gin.Context) {
+	logger.Debug("statusMidSession()\n")
+
+	c.JSON(http.StatusOK, dispatch.GetMidSessionStatus())
+	return
+}
+
+// statusConflicts is the RESTD /api/status/conflicts handler, this will return the counters for reused, mismatched, and merged conntrack ids
+func statusConflicts(c *gin.Context) {
+	logger.Debug("statusConflicts()\n")
+
+	c.JSON(http.StatusOK, dispatch.GetConflictStatus())
+	return
+}
+
+// statusSupervisor is the RESTD /api/status/supervisor handler, this will return the core goroutine heartbeats and the crash files
+func statusSupervisor(c *gin.Context) {
+	logger.Debug("statusSupervisor()\n")
+
+	c.JSON(http.StatusOK, supervisor.GetStatus())
+	return
+}
+
+// statusProfiler is the RESTD /api/status/profiler handler, this will return the profiler settings, the CPU usage, and the saved profiles
+func statusProfiler(c *gin.Context) {
+	logger.Debug("statusProfiler()\n")
+
+	c.JSON(http.StatusOK, profiler.GetStatus())
+	return
+}
+
+// statusCounters is the RESTD /api/status/counters handler, this will return the counters that are saved across restarts and the result of the last save
+func statusCounters(c *gin.Context) {
+	logger.Debug("statusCounters()\n")
+
+	c.JSON(http.StatusOK, overseer.GetPersistStatus())
+	return
+}
+
+// statusHASync is the RESTD /api/status/hasync handler, this will return the HA sync role and the state of the channel to the peer
+func statusHASync(c *gin.Context) {
+	logger.Debug("statusHASync()\n")
+
+	c.JSON(http.StatusOK, hasync.GetStatus())
+	return
+}
+
+// statusPatterns is the RESTD /api/status/patterns handler, this will return the registered payload patterns and the scan counters
+func statusPatterns(c *gin.Context) {
+	logger.Debug("statusPatterns()\n")
+
+	c.JSON(http.StatusOK, patterns.GetStatus())
+	return
+}
+
+// statusSni is the RESTD /api/status/sni handler, this will return the SNI hostname rules and the number of times each rule matched
+func statusSni(c *gin.Context) {
+	logger.Debug("statusSni()\n")
+
+	c.JSON(http.StatusOK, sni.GetFilterStatus())
+	return
+}
+
+// statusRateLimit is the RESTD /api/status/ratelimit handler, this will return the rate limit thresholds and the clients and destinations over them
+func statusRateLimit(c *gin.Context) {
+	logger.Debug("statusRateLimit()\n")
+
+	c.JSON(http.StatusOK, ratelimit.GetStatus())
+	return
+}
+
+// statusPortScan is the RESTD /api/status/portscan handler, this will return the port scan thresholds and the blocked scanners
+func statusPortScan(c *gin.Context) {
+	logger.Debug("statusPortScan()\n")
+
+	c.JSON(http.StatusOK, portscan.GetStatus())
+	return
+}
+
+// statusDSCP is the RESTD /api/status/dscp handler, this will return the DSCP values for the applications
+// and categories along with the number of sessions marked with each value
+func statusDSCP(c *gin.Context) {
+	logger.Debug("statusDSCP()\n")
+
+	c.JSON(http.StatusOK, dscp.GetStatus())
+	return
+}
+
+// statusCloud is the RESTD /api/status/cloud handler, this will return the state of the cloud management connection
+func statusCloud(c *gin.Context) {
+	logger.Debug("statusCloud()\n")
+
+	c.JSON(http.StatusOK, cloud.GetStatus())
+	return
+}
+
+// statusMsgbus is the RESTD /api/status/msgbus handler, this will return the message bus state and the connected clients
+func statusMsgbus(c *gin.Context) {
+	logger.Debug("statusMsgbus()\n")
+
+	c.JSON(http.StatusOK, msgbus.GetStatus())
+	return
+}
+
+// statusRuleStats is the RESTD /api/status/rulestats handler, this will return the hit counters of the named nftables rules
+func statusRuleStats(c *gin.Context) {
+	logger.Debug("statusRuleStats()\n")
+
+	c.JSON(http.StatusOK, rulestats.GetStatus())
+	return
+}
+
+// statusBlocklist is the RESTD /api/status/blocklist handler, this will return the number of blocks from each source and the state of the threat feeds
+func statusBlocklist(c *gin.Context) {
+	logger.Debug("statusBlocklist()\n")
+
+	c.JSON(http.StatusOK, blocklist.GetStatus())
+	return
+}
+
+// statusTarpit is the RESTD /api/status/tarpit handler, this will return the tarpit ports and the connections being held
+func statusTarpit(c *gin.Context) {
+	logger.Debug("statusTarpit()\n")
+
+	c.JSON(http.StatusOK, tarpit.GetStatus())
+	return
+}
+
+// getDiscovery is the RESTD /api/discovery handler, this will return the devices and services found by the discovery service
+func getDiscovery(c *gin.Context) {
+	logger.Debug("getDiscovery()\n")
+
+	c.JSON(http.StatusOK, discovery.GetDiscoveredDevices())
+	return
+}
+
 type interfaceInfo struct {
 	Device           string   `json:"device"`
 	Connected        bool     `json:"connected"`
@@ -385,6 +678,16 @@ type dhcpInfo struct {
 	Hostname        string `json:"hostName"`
 	ClientID        string `json:"clientId"`
 }
+
+type dhcpv6Info struct {
+	LeaseExpiration int64    `json:"leaseExpiration"`
+	Interface       string   `json:"interface"`
+	DUID            string   `json:"duid"`
+	IAID            string   `json:"iaid"`
+	Hostname        string   `json:"hostName"`
+	IPAddrs         []string `json:"ipAddrs"`
+}
+
 type wifiChannelInfo struct {
 	Frequency string `json:"frequency"`
 	Channel   uint   `json:"channel"`
@@ -598,6 +901,59 @@ func getDHCPInfo() ([]dhcpInfo, error) {
 	return returnDHCPInfo, nil
 }
 
+// getDHCPv6Info returns the DHCPv6 leases from the odhcpd lease file as a slice
+// of dhcpv6Infos. The lease lines start with a # and are followed by the hosts
+// entries which we ignore.
+func getDHCPv6Info() ([]dhcpv6Info, error) {
+
+	returnDHCPInfo := []dhcpv6Info{}
+
+	file, err := os.Open("/tmp/hosts/odhcpd")
+	if os.IsNotExist(err) {
+		return returnDHCPInfo, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// # <interface> <duid> <iaid> <hostname> <valid until> <assigned> <length> <address/length>...
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] != "#" {
+			continue
+		}
+
+		// skip the DHCPv4 leases when odhcpd is also the DHCP server
+		if fields[2] == "ipv4" {
+			continue
+		}
+
+		leaseValue, parseErr := strconv.ParseInt(fields[5], 10, 64)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+
+		var dhcpEntry = dhcpv6Info{
+			LeaseExpiration: leaseValue,
+			Interface:       fields[1],
+			DUID:            fields[2],
+			IAID:            fields[3],
+			Hostname:        fields[4],
+			IPAddrs:         fields[8:],
+		}
+
+		returnDHCPInfo = append(returnDHCPInfo, dhcpEntry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return returnDHCPInfo, nil
+}
+
 // getBuildInfo returns the build info as a json map
 func getBuildInfo() (map[string]interface{}, error) {
 	jsonO := make(map[string]interface{})
@@ -743,6 +1099,50 @@ func runIPCommand(cmdArgs []string) ([]byte, error) {
 	return result, nil
 }
 
+// runDualStackCommand runs an iproute2 command and writes the response. If the
+// ip protocol is passed in we only return the result for that family, otherwise
+// we return the IPv4 and IPv6 results as separate fields.
+func runDualStackCommand(c *gin.Context, cmdArgs []string) {
+	query := c.Request.URL.Query()
+
+	if query["family"] != nil && len(query["family"][0]) > 0 {
+		result, err := runIPCommand(append([]string{"-" + query["family"][0]}, cmdArgs...))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+			return
+		}
+
+		// note here: the output type is already in JSON, setting the content-type before calling c.String will force the header
+		c.Header("Content-Type", "application/json")
+		c.String(http.StatusOK, string(result))
+		return
+	}
+
+	result4, err := runIPCommand(append([]string{"-4"}, cmdArgs...))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		return
+	}
+
+	result6, err := runIPCommand(append([]string{"-6"}, cmdArgs...))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ipv4": ipCommandJSON(result4), "ipv6": ipCommandJSON(result6)})
+}
+
+// ipCommandJSON returns the output of an iproute2 command as raw JSON. Some
+// versions print nothing instead of an empty list when there are no results.
+func ipCommandJSON(result []byte) json.RawMessage {
+	result = bytes.TrimSpace(result)
+	if len(result) == 0 {
+		return json.RawMessage("[]")
+	}
+	return json.RawMessage(result)
+}
+
 // runNFTCommand is used to run various commands using nft, the result is a byte array of string content (until the -json flag is available in NFT 0.9)
 func runNFTCommand(cmdArgs []string) ([]byte, error) {
 
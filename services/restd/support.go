@@ -0,0 +1,227 @@
+package restd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/crashreport"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/profiler"
+	"github.com/untangle/packetd/services/servicemgr"
+	"github.com/untangle/packetd/services/supervisor"
+)
+
+// the stack dump written by packetd when it receives SIGQUIT
+const stackDumpFile = "/tmp/packetd.stack"
+
+// supportBundle is the RESTD /api/support/bundle handler, this will return a
+// compressed tar file with the crash files, the panic reports, the last stack
+// dump, and the service and supervisor status for troubleshooting
+func supportBundle(c *gin.Context) {
+	logger.Debug("supportBundle()\n")
+
+	var buffer bytes.Buffer
+	compressor := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(compressor)
+	now := time.Now()
+
+	var problems []error
+	addFile := func(name string, data []byte) {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		if err := archive.WriteHeader(header); err != nil {
+			problems = append(problems, err)
+			return
+		}
+		if _, err := archive.Write(data); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	addJSON := func(name string, value interface{}) {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			problems = append(problems, err)
+			return
+		}
+		addFile(name, data)
+	}
+
+	addJSON("services.json", servicemgr.GetStatus())
+	addJSON("supervisor.json", supervisor.GetStatus())
+	addJSON("profiler.json", profiler.GetStatus())
+
+	if data, err := ioutil.ReadFile(stackDumpFile); err == nil {
+		addFile("packetd.stack", data)
+	}
+
+	for _, crash := range supervisor.GetCrashFiles() {
+		data, err := supervisor.ReadCrashFile(crash.Name)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		addFile("crash/"+crash.Name, data)
+	}
+
+	for _, summary := range crashreport.List() {
+		report, err := crashreport.Get(summary.ID)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		addJSON("panic/"+summary.ID+".json", report)
+	}
+
+	if err := archive.Close(); err != nil {
+		problems = append(problems, err)
+	}
+	if err := compressor.Close(); err != nil {
+		problems = append(problems, err)
+	}
+	if len(problems) != 0 {
+		logger.Warn("Unable to create the support bundle: %v\n", problems)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("%v", problems)})
+		return
+	}
+
+	filename := "packetd-support-" + now.Format("20060102-150405") + ".tar.gz"
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Data(http.StatusOK, "application/gzip", buffer.Bytes())
+	return
+}
+
+// supportCrash is the RESTD /api/support/crash/:name handler, this will return the contents of a crash file
+func supportCrash(c *gin.Context) {
+	logger.Debug("supportCrash()\n")
+
+	data, err := supervisor.ReadCrashFile(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", data)
+	return
+}
+
+// supportPanicList is the RESTD /api/support/panics handler, this will return the saved panic reports with the most recent first
+func supportPanicList(c *gin.Context) {
+	logger.Debug("supportPanicList()\n")
+
+	c.JSON(http.StatusOK, crashreport.List())
+	return
+}
+
+// supportPanicGet is the RESTD /api/support/panics/:id handler, this will return a panic report
+func supportPanicGet(c *gin.Context) {
+	logger.Debug("supportPanicGet()\n")
+
+	report, err := crashreport.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+	return
+}
+
+// supportPanicRemove is the RESTD DELETE /api/support/panics/:id handler, this will remove a panic report
+func supportPanicRemove(c *gin.Context) {
+	logger.Debug("supportPanicRemove()\n")
+
+	err := crashreport.Remove(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"removed": 1})
+	return
+}
+
+// supportPanicClear is the RESTD DELETE /api/support/panics handler, this will remove every panic report
+func supportPanicClear(c *gin.Context) {
+	logger.Debug("supportPanicClear()\n")
+
+	c.JSON(http.StatusOK, gin.H{"removed": crashreport.Clear()})
+	return
+}
+
+// supportProfileList is the RESTD /api/support/profiles handler, this will return the saved profiles with the most recent first
+func supportProfileList(c *gin.Context) {
+	logger.Debug("supportProfileList()\n")
+
+	c.JSON(http.StatusOK, profiler.List())
+	return
+}
+
+// supportProfileCapture is the RESTD POST /api/support/profiles handler, this will capture a CPU
+// profile for the seconds argument or the configured length followed by a heap profile
+func supportProfileCapture(c *gin.Context) {
+	logger.Debug("supportProfileCapture()\n")
+
+	var seconds int
+	if value := c.Query("seconds"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid seconds: " + value})
+			return
+		}
+		seconds = number
+	}
+
+	list, err := profiler.Capture(profiler.ReasonManual, seconds)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+	return
+}
+
+// supportProfileGet is the RESTD /api/support/profiles/:id handler, this will return a profile file
+func supportProfileGet(c *gin.Context) {
+	logger.Debug("supportProfileGet()\n")
+
+	filename, err := profiler.GetFilename(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+filepath.Base(filename))
+	c.File(filename)
+	return
+}
+
+// supportProfileClear is the RESTD DELETE /api/support/profiles handler, this will remove every saved profile
+func supportProfileClear(c *gin.Context) {
+	logger.Debug("supportProfileClear()\n")
+
+	c.JSON(http.StatusOK, gin.H{"removed": profiler.Clear()})
+	return
+}
+
+// recoveryHandler replaces the gin recovery middleware so a panic in a
+// handler is saved as a crash report before the error is returned
+func recoveryHandler(c *gin.Context) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			crashreport.Capture("restd "+c.Request.Method+" "+c.Request.URL.Path, recovered, debug.Stack())
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}()
+
+	c.Next()
+}
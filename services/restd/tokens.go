@@ -0,0 +1,134 @@
+package restd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the API paths a scoped API token can use
+var scopedTokenPaths = []string{
+	"/api/reports/create_query",
+	"/api/reports/get_data/",
+	"/api/reports/close_query/",
+}
+
+// getBearerToken returns the token of the Authorization header
+func getBearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// checkAPIToken checks the token against the API tokens in the settings. The
+// settings only have the SHA-256 hash of each token and the scope of the
+// events it can see. A valid token is only allowed to run report queries, and
+// the scope is stored in the context for the report handlers.
+func checkAPIToken(c *gin.Context, token string) bool {
+	tokensJSON, err := settings.GetCurrentSettings([]string{"accounts", "apiTokens"})
+	if tokensJSON == nil || err != nil {
+		return false
+	}
+
+	tokensSlice, ok := tokensJSON.([]interface{})
+	if !ok {
+		logger.Warn("Invalid API token settings: %T\n", tokensJSON)
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+
+	for _, value := range tokensSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		expected, _ := item["tokenHash"].(string)
+		if len(expected) != len(hash) || subtle.ConstantTimeCompare([]byte(strings.ToLower(expected)), []byte(hash)) != 1 {
+			continue
+		}
+
+		scope := parseScope(item)
+		for _, path := range scopedTokenPaths {
+			if c.Request.URL.Path == path || (strings.HasSuffix(path, "/") && strings.HasPrefix(c.Request.URL.Path, path)) {
+				c.Set("reportScope", scope)
+				return true
+			}
+		}
+		logger.Info("API token %s is not allowed to use %s\n", scope.Name, c.Request.URL.Path)
+		return false
+	}
+
+	logger.Info("Invalid API token\n")
+	return false
+}
+
+// parseScope returns the report scope of an API token. A token with no zones,
+// VLANs, or networks can't see any events.
+func parseScope(item map[string]interface{}) *reports.Scope {
+	scope := &reports.Scope{}
+	scope.Name, _ = item["name"].(string)
+
+	scopeJSON, _ := item["scope"].(map[string]interface{})
+	if scopeJSON == nil {
+		return scope
+	}
+
+	zones, _ := scopeJSON["zones"].([]interface{})
+	for _, value := range zones {
+		if name, ok := value.(string); ok && name != "" {
+			scope.Zones = append(scope.Zones, name)
+		}
+	}
+
+	vlans, _ := scopeJSON["vlans"].([]interface{})
+	for _, value := range vlans {
+		if id, ok := value.(float64); ok && id > 0 {
+			scope.VLANs = append(scope.VLANs, int(id))
+		}
+	}
+
+	networks, _ := scopeJSON["networks"].([]interface{})
+	for _, value := range networks {
+		text, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if !strings.Contains(text, "/") {
+			if strings.Contains(text, ":") {
+				text = text + "/128"
+			} else {
+				text = text + "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(text)
+		if err != nil {
+			logger.Warn("Invalid API token network %s: %v\n", text, err)
+			continue
+		}
+		scope.Networks = append(scope.Networks, network)
+	}
+
+	return scope
+}
+
+// getReportScope returns the report scope of the API token of the request,
+// or nil if the request was not authorized by a scoped API token
+func getReportScope(c *gin.Context) *reports.Scope {
+	value, ok := c.Get("reportScope")
+	if !ok {
+		return nil
+	}
+	scope, _ := value.(*reports.Scope)
+	return scope
+}
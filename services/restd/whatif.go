@@ -0,0 +1,210 @@
+package restd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/plugins/rules"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/policy"
+)
+
+// whatIfRequest describes a hypothetical session. The named fields are
+// converted to the session field names used by the rules and the policy, and
+// anything else can be given directly in the fields map. The policy and rules
+// are optional candidate settings to evaluate instead of the active ones.
+type whatIfRequest struct {
+	Protocol      int               `json:"protocol"`
+	ClientAddress string            `json:"clientAddress"`
+	ClientPort    int               `json:"clientPort"`
+	ServerAddress string            `json:"serverAddress"`
+	ServerPort    int               `json:"serverPort"`
+	ClientZone    string            `json:"clientZone"`
+	ServerZone    string            `json:"serverZone"`
+	Country       string            `json:"country"`
+	Application   string            `json:"application"`
+	Username      string            `json:"username"`
+	Fields        map[string]string `json:"fields"`
+	Time          string            `json:"time"`
+	Policy        interface{}       `json:"policy"`
+	Rules         interface{}       `json:"rules"`
+}
+
+// whatIfResult holds the evaluation of a hypothetical session. The verdict is
+// bypass, drop, or inspect, and the source is what decided a bypass or drop.
+type whatIfResult struct {
+	Fields        map[string]string  `json:"fields"`
+	Verdict       string             `json:"verdict"`
+	Source        string             `json:"source,omitempty"`
+	TrafficBypass bool               `json:"trafficBypass"`
+	ShedLevel     string             `json:"shedLevel"`
+	Rules         rules.DryRunResult `json:"rules"`
+	Policy        policy.Result      `json:"policy"`
+	Tags          map[string]string  `json:"tags"`
+}
+
+// whatIfHandler is the RESTD /api/whatif handler, this will evaluate the rules and the
+// policy against a hypothetical session and return what would match and the verdict
+func whatIfHandler(c *gin.Context) {
+	var request whatIfRequest
+
+	logger.Debug("whatIfHandler()\n")
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	if request.Time != "" {
+		now, err = time.Parse(time.RFC3339, request.Time)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	result := whatIfResult{Verdict: "inspect", Tags: make(map[string]string)}
+
+	result.Fields, err = request.getFields()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result.Rules, err = rules.DryRun(request.Rules, result.Fields, now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rules: " + err.Error()})
+		return
+	}
+
+	result.Policy, err = policy.DryRun(request.Policy, result.Fields, now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "policy: " + err.Error()})
+		return
+	}
+
+	result.TrafficBypass = (kernel.GetBypassFlag() != 0)
+	result.ShedLevel = dispatch.GetShedLevelName(dispatch.GetShedLevel())
+
+	// the rules are called before the policy so the first bypass or drop wins
+	for _, match := range result.Rules.Matches {
+		switch match.Action {
+		case "tag":
+			result.Tags[match.Field] = match.Value
+		case "bypass", "drop":
+			result.setVerdict(match.Action, "rule "+match.RuleID)
+		}
+	}
+
+	for _, decision := range result.Policy.Decisions {
+		switch decision.Action.Type {
+		case policy.ActionTag:
+			result.Tags[decision.Action.Field] = decision.Action.Value
+		case policy.ActionPriority:
+			result.Tags["priority"] = decision.Action.Value
+		case policy.ActionMirror:
+			result.Tags["mirror_target"] = decision.Action.Value
+		case policy.ActionBypass, policy.ActionDrop:
+			result.setVerdict(decision.Action.Type, "policy "+decision.RuleID)
+		}
+		if decision.Quota != "" {
+			result.Tags["quota_bucket"] = decision.Quota
+		}
+	}
+
+	// the traffic bypass flag sends everything around packetd
+	if result.TrafficBypass {
+		result.Verdict = "bypass"
+		result.Source = "traffic bypass flag"
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// setVerdict sets the verdict if a bypass or drop has not already been found
+func (result *whatIfResult) setVerdict(verdict string, source string) {
+	if result.Source != "" {
+		return
+	}
+	result.Verdict = verdict
+	result.Source = source
+}
+
+// getFields returns the session field values for the request
+func (request *whatIfRequest) getFields() (map[string]string, error) {
+	fields := make(map[string]string)
+
+	if request.ClientAddress != "" {
+		addr := net.ParseIP(request.ClientAddress)
+		if addr == nil {
+			return nil, errors.New("invalid client address " + request.ClientAddress)
+		}
+		fields["client_address"] = addr.String()
+		fields["family"] = getAddressFamily(addr)
+	}
+
+	if request.ServerAddress != "" {
+		addr := net.ParseIP(request.ServerAddress)
+		if addr == nil {
+			return nil, errors.New("invalid server address " + request.ServerAddress)
+		}
+		fields["server_address"] = addr.String()
+		fields["family"] = getAddressFamily(addr)
+	}
+
+	if request.Protocol != 0 {
+		fields["protocol"] = strconv.Itoa(request.Protocol)
+	}
+	if request.ClientPort != 0 {
+		fields["client_port"] = strconv.Itoa(request.ClientPort)
+	}
+	if request.ServerPort != 0 {
+		fields["server_port"] = strconv.Itoa(request.ServerPort)
+	}
+
+	namedFields := map[string]string{
+		"client_zone":      request.ClientZone,
+		"server_zone":      request.ServerZone,
+		"server_country":   request.Country,
+		"application_name": request.Application,
+		"username":         request.Username,
+	}
+	for name, value := range namedFields {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+
+	// the fields given directly replace the named fields
+	for name, value := range request.Fields {
+		fields[name] = value
+	}
+
+	return fields, nil
+}
+
+// getAddressFamily returns the session family value for the argumented address
+func getAddressFamily(addr net.IP) string {
+	if addr.To4() != nil {
+		return strconv.Itoa(syscall.AF_INET)
+	}
+	return strconv.Itoa(syscall.AF_INET6)
+}
@@ -0,0 +1,128 @@
+package restd
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/wireless"
+)
+
+// statusWifiInterface is the RESTD /api/status/wifiinterface/:device handler, this will
+// return the frequency, channel width, and transmit power of a wifi interface
+func statusWifiInterface(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("statusWifiInterface(%s)\n", device)
+
+	result, err := wireless.GetInterface(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// statusWifiStations is the RESTD /api/status/wifistations/:device handler, this will
+// return the stations associated to a wifi interface with their signal and rates
+func statusWifiStations(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("statusWifiStations(%s)\n", device)
+
+	result, err := wireless.GetStations(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// statusWifiSurvey is the RESTD /api/status/wifisurvey/:device handler, this will
+// return the noise and the busy time of each channel of a wifi interface
+func statusWifiSurvey(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("statusWifiSurvey(%s)\n", device)
+
+	result, err := wireless.GetSurvey(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// statusWifiScan is the RESTD /api/status/wifiscan/:device handler, this will
+// return the networks found by the last scan of a wifi interface
+func statusWifiScan(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("statusWifiScan(%s)\n", device)
+
+	result, err := wireless.GetScanResults(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// wifiScan is the RESTD /api/control/wifi/:device/scan handler, this will scan
+// on a wifi interface and return the networks found when the scan is done
+func wifiScan(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("wifiScan(%s)\n", device)
+
+	result, err := wireless.Scan(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// wifiConfigure is the RESTD /api/control/wifi/:device handler, this will change the
+// channel or the transmit power of a wifi interface and return the resulting state
+func wifiConfigure(c *gin.Context) {
+	var config wireless.Config
+
+	device := c.Param("device")
+	logger.Debug("wifiConfigure(%s)\n", device)
+
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := wireless.Configure(device, config)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// wifiKick is the RESTD /api/control/wifi/:device/station/:mac DELETE handler, this
+// will disconnect a station from a wifi interface
+func wifiKick(c *gin.Context) {
+	device := c.Param("device")
+	mac := c.Param("mac")
+	logger.Debug("wifiKick(%s, %s)\n", device, mac)
+
+	if err := wireless.KickStation(device, mac); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"kicked": mac})
+	return
+}
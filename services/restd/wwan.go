@@ -0,0 +1,134 @@
+package restd
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/wwan"
+)
+
+// statusWwanModems is the RESTD /api/status/wwanmodems handler, this will return the
+// modems with their last signal sample and the usage of the current billing cycle
+func statusWwanModems(c *gin.Context) {
+	logger.Debug("statusWwanModems()\n")
+
+	c.JSON(http.StatusOK, wwan.GetStatus())
+	return
+}
+
+// statusWwanSignal is the RESTD /api/status/wwansignal/:device handler, this will return
+// the signal history of a modem for the last number of minutes in the minutes query parameter
+func statusWwanSignal(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("statusWwanSignal(%s)\n", device)
+
+	var since time.Time
+	if value, err := strconv.Atoi(c.Query("minutes")); err == nil && value > 0 {
+		since = time.Now().Add(-time.Duration(value) * time.Minute)
+	}
+
+	result, err := wwan.GetSignalHistory(device, since)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// statusWwanUsage is the RESTD /api/status/wwanusage/:device handler, this will return the
+// data used in the current billing cycle and the number of previous cycles in the cycles query parameter
+func statusWwanUsage(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("statusWwanUsage(%s)\n", device)
+
+	cycles := 12
+	if value, err := strconv.Atoi(c.Query("cycles")); err == nil && value >= 0 {
+		cycles = value
+	}
+
+	current, history, err := wwan.GetUsage(device, cycles)
+	if err == wwan.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"current": current, "cycles": history})
+	return
+}
+
+// statusWwanMessages is the RESTD /api/status/wwansms/:device handler, this will return
+// the SMS messages stored on a modem
+func statusWwanMessages(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("statusWwanMessages(%s)\n", device)
+
+	result, err := wwan.GetMessages(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+	return
+}
+
+// wwanApplyAPN is the RESTD /api/control/wwan/:device/apn handler, this will write the
+// APN settings to the network configuration of a modem and reconnect it
+func wwanApplyAPN(c *gin.Context) {
+	var apn wwan.APN
+
+	device := c.Param("device")
+	logger.Debug("wwanApplyAPN(%s)\n", device)
+
+	if err := c.ShouldBindJSON(&apn); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := wwan.ApplyAPN(device, apn); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"applied": apn.APN})
+	return
+}
+
+// wwanConnect is the RESTD /api/control/wwan/:device/connect handler, this will bring up
+// the connection of a modem
+func wwanConnect(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("wwanConnect(%s)\n", device)
+
+	if err := wwan.Connect(device); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"connected": device})
+	return
+}
+
+// wwanDisconnect is the RESTD /api/control/wwan/:device/disconnect handler, this will take
+// down the connection of a modem
+func wwanDisconnect(c *gin.Context) {
+	device := c.Param("device")
+	logger.Debug("wwanDisconnect(%s)\n", device)
+
+	if err := wwan.Disconnect(device); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"disconnected": device})
+	return
+}
@@ -0,0 +1,291 @@
+// Package rulestats collects the hit counters of the named nftables rules so
+// admins can see which firewall and NAT rules match traffic. A rule is named
+// by its comment, and only rules that have a comment and a counter are
+// collected. The counters are read at a regular interval, the increase since
+// the last read is logged to the rule_stats table, and the current totals
+// are available for the status API.
+package rulestats
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the rulestats settings are missing
+const defaultIntervalSeconds = 60
+
+// RuleCounter holds the counters for a named rule. The totals are the values
+// from nftables and the last hit is the last read where they increased.
+type RuleCounter struct {
+	Family  string     `json:"family"`
+	Table   string     `json:"table"`
+	Chain   string     `json:"chain"`
+	Name    string     `json:"name"`
+	Handle  int        `json:"handle"`
+	Packets uint64     `json:"packets"`
+	Bytes   uint64     `json:"bytes"`
+	LastHit *time.Time `json:"lastHit,omitempty"`
+}
+
+// Status holds the current rule counters
+type Status struct {
+	Enabled    bool          `json:"enabled"`
+	Interval   int           `json:"interval"`
+	LastUpdate *time.Time    `json:"lastUpdate,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Rules      []RuleCounter `json:"rules"`
+}
+
+// nftRuleset is the part of the nft JSON output we use
+type nftRuleset struct {
+	Nftables []struct {
+		Rule *struct {
+			Family  string                   `json:"family"`
+			Table   string                   `json:"table"`
+			Chain   string                   `json:"chain"`
+			Handle  int                      `json:"handle"`
+			Comment string                   `json:"comment"`
+			Expr    []map[string]interface{} `json:"expr"`
+		} `json:"rule"`
+	} `json:"nftables"`
+}
+
+var counterTable = make(map[string]*RuleCounter)
+var counterLocker sync.Mutex
+var enabled bool
+var interval = defaultIntervalSeconds
+var lastUpdate time.Time
+var lastError string
+var reloadChannel = make(chan bool, 1)
+var shutdownChannel = make(chan bool)
+var collectWaiter sync.WaitGroup
+
+// init registers the rule stats table with the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "rule_stats",
+		Owner: "rulestats",
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "family", Type: "text"},
+			{Name: "table_name", Type: "text"},
+			{Name: "chain_name", Type: "text"},
+			{Name: "rule_name", Type: "text"},
+			{Name: "packets", Type: "int8"},
+			{Name: "bytes", Type: "int8"},
+		},
+		TrimPercent: .1,
+	})
+}
+
+// Startup is called to handle service startup
+func Startup() {
+	loadSettings()
+	collectWaiter.Add(1)
+	go collectTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	close(shutdownChannel)
+	collectWaiter.Wait()
+}
+
+// Reload loads the rulestats settings
+func Reload() {
+	loadSettings()
+	select {
+	case reloadChannel <- true:
+	default:
+	}
+}
+
+// GetStatus returns the current rule counters sorted by table, chain, and name
+func GetStatus() Status {
+	counterLocker.Lock()
+	defer counterLocker.Unlock()
+
+	status := Status{Enabled: enabled, Interval: interval, Error: lastError, Rules: []RuleCounter{}}
+	if !lastUpdate.IsZero() {
+		stamp := lastUpdate
+		status.LastUpdate = &stamp
+	}
+	for _, item := range counterTable {
+		status.Rules = append(status.Rules, *item)
+	}
+
+	sort.Slice(status.Rules, func(i, j int) bool {
+		a, b := status.Rules[i], status.Rules[j]
+		if a.Family != b.Family {
+			return a.Family < b.Family
+		}
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if a.Chain != b.Chain {
+			return a.Chain < b.Chain
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Handle < b.Handle
+	})
+	return status
+}
+
+// loadSettings loads the collection interval from the settings
+func loadSettings() {
+	freshEnabled := true
+	freshInterval := defaultIntervalSeconds
+
+	configJSON, err := settings.GetCurrentSettings([]string{"rulestats"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			if value, ok := item["enabled"].(bool); ok {
+				freshEnabled = value
+			}
+			if value, ok := item["intervalSeconds"].(float64); ok && value > 0 {
+				freshInterval = int(value)
+			}
+		} else {
+			logger.Warn("Invalid rulestats settings: %T\n", configJSON)
+		}
+	}
+
+	logger.Info("Loaded rulestats settings enabled:%v interval:%d\n", freshEnabled, freshInterval)
+
+	counterLocker.Lock()
+	enabled = freshEnabled
+	interval = freshInterval
+	counterLocker.Unlock()
+}
+
+// collectTask reads the counters at the configured interval
+func collectTask() {
+	defer collectWaiter.Done()
+
+	for {
+		counterLocker.Lock()
+		active := enabled
+		delay := time.Duration(interval) * time.Second
+		counterLocker.Unlock()
+
+		if active {
+			collectCounters()
+		}
+
+		select {
+		case <-shutdownChannel:
+			return
+		case <-reloadChannel:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// collectCounters reads the rule counters from nftables and logs the
+// increase since the last read
+func collectCounters() {
+	output, err := exec.Command("nft", "-j", "list", "ruleset").Output()
+	if err == nil {
+		err = updateCounters(output, time.Now())
+	}
+
+	counterLocker.Lock()
+	defer counterLocker.Unlock()
+
+	if err != nil {
+		logger.Warn("%OC|Unable to read the nftables rule counters: %v\n", "rulestats_failure", 10, err)
+		lastError = err.Error()
+		return
+	}
+	lastError = ""
+}
+
+// updateCounters parses the nft JSON output and updates the counter table.
+// Rules that are no longer in the ruleset are removed. The counters of a rule
+// that was replaced start over, so a total lower than the last one is all new.
+func updateCounters(output []byte, now time.Time) error {
+	var ruleset nftRuleset
+	err := json.Unmarshal(output, &ruleset)
+	if err != nil {
+		return err
+	}
+
+	var events []map[string]interface{}
+	fresh := make(map[string]*RuleCounter)
+
+	counterLocker.Lock()
+	// the first read only sets the baseline since the counters include
+	// everything from before packetd was started
+	firstRead := lastUpdate.IsZero()
+	for _, entry := range ruleset.Nftables {
+		rule := entry.Rule
+		if rule == nil || rule.Comment == "" {
+			continue
+		}
+		packets, bytes, found := getRuleCounter(rule.Expr)
+		if !found {
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s/%s/%d", rule.Family, rule.Table, rule.Chain, rule.Handle)
+		item := &RuleCounter{Family: rule.Family, Table: rule.Table, Chain: rule.Chain, Name: rule.Comment, Handle: rule.Handle, Packets: packets, Bytes: bytes}
+
+		deltaPackets, deltaBytes := packets, bytes
+		if previous, found := counterTable[key]; found {
+			item.LastHit = previous.LastHit
+			if packets >= previous.Packets && bytes >= previous.Bytes {
+				deltaPackets = packets - previous.Packets
+				deltaBytes = bytes - previous.Bytes
+			}
+		}
+
+		if !firstRead && (deltaPackets != 0 || deltaBytes != 0) {
+			stamp := now
+			item.LastHit = &stamp
+			events = append(events, map[string]interface{}{
+				"time_stamp": now,
+				"family":     rule.Family,
+				"table_name": rule.Table,
+				"chain_name": rule.Chain,
+				"rule_name":  rule.Comment,
+				"packets":    deltaPackets,
+				"bytes":      deltaBytes,
+			})
+		}
+		fresh[key] = item
+	}
+
+	counterTable = fresh
+	lastUpdate = now
+	counterLocker.Unlock()
+
+	for _, columns := range events {
+		reports.LogEvent(reports.CreateEvent("rule_stats", "rule_stats", 1, columns, nil))
+	}
+	return nil
+}
+
+// getRuleCounter returns the values of the counter statement in a rule
+func getRuleCounter(list []map[string]interface{}) (uint64, uint64, bool) {
+	for _, expr := range list {
+		counter, ok := expr["counter"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		packets, _ := counter["packets"].(float64)
+		bytes, _ := counter["bytes"].(float64)
+		return uint64(packets), uint64(bytes), true
+	}
+	return 0, 0, false
+}
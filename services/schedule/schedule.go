@@ -0,0 +1,329 @@
+// Package schedule provides named schedules made of weekly time ranges. The
+// schedules are defined in the settings and can be used by the policy engine
+// and the rules plugin for things like blocking streaming after 22:00 on
+// school nights. The ranges are compared against the wall clock time in the
+// timezone of the schedule so they follow daylight saving time changes.
+package schedule
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the number of minutes in a day
+const minutesPerDay = 24 * 60
+
+// TimeRange is a weekly time range. The days are the days the range starts,
+// and a range with an end before the start continues into the next day so
+// 22:00-06:00 on fri covers friday night until saturday morning. A range with
+// the same start and end covers the whole day.
+type TimeRange struct {
+	Days  []string `json:"days"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	days  [7]bool
+	start int
+	end   int
+}
+
+// Schedule is a named list of weekly time ranges
+type Schedule struct {
+	Name     string       `json:"name"`
+	Timezone string       `json:"timezone,omitempty"`
+	Ranges   []*TimeRange `json:"ranges"`
+	location *time.Location
+}
+
+// ScheduleStatus holds a schedule and whether it is currently active
+type ScheduleStatus struct {
+	Schedule *Schedule `json:"schedule"`
+	Active   bool      `json:"active"`
+}
+
+// Status holds the default timezone and the schedules
+type Status struct {
+	Timezone  string           `json:"timezone"`
+	Schedules []ScheduleStatus `json:"schedules"`
+}
+
+// the day names accepted in the settings
+var dayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+	"all":      {time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+}
+
+var scheduleTable = make(map[string]*Schedule)
+var defaultLocation = time.Local
+var scheduleLocker sync.RWMutex
+
+// Startup is called to handle service startup
+func Startup() {
+	Reload()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+}
+
+// Reload loads the default timezone and the schedules from the settings
+func Reload() {
+	location := loadTimezone()
+	table := make(map[string]*Schedule)
+
+	schedulesJSON, err := settings.GetCurrentSettings([]string{"schedules"})
+	if schedulesJSON != nil && err == nil {
+		scheduleSlice, ok := schedulesJSON.([]interface{})
+		if !ok {
+			logger.Warn("Invalid schedule settings: %T\n", schedulesJSON)
+		}
+		for index, value := range scheduleSlice {
+			item, err := parseSchedule(value, location)
+			if err != nil {
+				logger.Warn("Ignoring invalid schedule %d: %v\n", index, err)
+				continue
+			}
+			table[item.Name] = item
+		}
+	}
+
+	scheduleLocker.Lock()
+	scheduleTable = table
+	defaultLocation = location
+	scheduleLocker.Unlock()
+
+	logger.Info("Loaded %d schedules with timezone %s\n", len(table), location.String())
+}
+
+// GetLocation returns the default timezone for schedules and time conditions
+func GetLocation() *time.Location {
+	scheduleLocker.RLock()
+	defer scheduleLocker.RUnlock()
+	return defaultLocation
+}
+
+// IsActive returns true if the named schedule has a range that contains the
+// argumented time. The second return value is false if there is no schedule
+// with the argumented name.
+func IsActive(name string, now time.Time) (bool, bool) {
+	scheduleLocker.RLock()
+	item, found := scheduleTable[name]
+	scheduleLocker.RUnlock()
+
+	if !found {
+		return false, false
+	}
+	return item.contains(now), true
+}
+
+// GetStatus returns the schedules and whether each is currently active
+func GetStatus() Status {
+	now := time.Now()
+
+	scheduleLocker.RLock()
+	defer scheduleLocker.RUnlock()
+
+	status := Status{Timezone: defaultLocation.String(), Schedules: []ScheduleStatus{}}
+	for _, item := range scheduleTable {
+		status.Schedules = append(status.Schedules, ScheduleStatus{Schedule: item, Active: item.contains(now)})
+	}
+
+	sort.Slice(status.Schedules, func(i, j int) bool {
+		return status.Schedules[i].Schedule.Name < status.Schedules[j].Schedule.Name
+	})
+
+	return status
+}
+
+// contains returns true if any of the ranges contains the argumented time.
+// We compare the wall clock time in the schedule timezone, so a range that
+// starts at 22:00 starts at 22:00 local time before and after a DST change.
+func (item *Schedule) contains(now time.Time) bool {
+	local := now.In(item.location)
+	minute := local.Hour()*60 + local.Minute()
+	today := local.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, span := range item.Ranges {
+		if span.start < span.end {
+			if span.days[today] && minute >= span.start && minute < span.end {
+				return true
+			}
+			continue
+		}
+
+		// the range wraps into the next day
+		if span.days[today] && minute >= span.start {
+			return true
+		}
+		if span.days[yesterday] && minute < span.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadTimezone returns the system timezone from the settings or the local
+// timezone if there isn't one or it can't be loaded
+func loadTimezone() *time.Location {
+	zoneJSON, err := settings.GetCurrentSettings([]string{"system", "timeZone"})
+	if zoneJSON == nil || err != nil {
+		return time.Local
+	}
+
+	// the timezone is either a name or an object with the name in the value
+	var name string
+	switch zoneJSON.(type) {
+	case string:
+		name = zoneJSON.(string)
+	case map[string]interface{}:
+		name, _ = zoneJSON.(map[string]interface{})["value"].(string)
+	}
+
+	if name == "" {
+		return time.Local
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		logger.Warn("Unable to load timezone %s: %v\n", name, err)
+		return time.Local
+	}
+
+	return location
+}
+
+// parseSchedule converts a schedule from the settings
+func parseSchedule(value interface{}, location *time.Location) (*Schedule, error) {
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errInvalid("schedule")
+	}
+
+	schedule := &Schedule{Ranges: []*TimeRange{}, location: location}
+	schedule.Name, _ = item["name"].(string)
+	if schedule.Name == "" {
+		return nil, errInvalid("schedule name")
+	}
+
+	schedule.Timezone, _ = item["timezone"].(string)
+	if schedule.Timezone != "" {
+		zone, err := time.LoadLocation(schedule.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		schedule.location = zone
+	}
+
+	rangeSlice, _ := item["ranges"].([]interface{})
+	for _, entry := range rangeSlice {
+		span, err := parseRange(entry)
+		if err != nil {
+			return nil, err
+		}
+		schedule.Ranges = append(schedule.Ranges, span)
+	}
+
+	return schedule, nil
+}
+
+// parseRange converts a time range from the settings. A range without any
+// days applies to every day.
+func parseRange(value interface{}) (*TimeRange, error) {
+	var err error
+
+	item, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errInvalid("range")
+	}
+
+	span := &TimeRange{Days: []string{}}
+	span.Start, _ = item["start"].(string)
+	span.End, _ = item["end"].(string)
+
+	span.start, err = parseClock(span.Start)
+	if err != nil || span.start == minutesPerDay {
+		return nil, errInvalid("range start " + span.Start)
+	}
+	span.end, err = parseClock(span.End)
+	if err != nil {
+		return nil, errInvalid("range end " + span.End)
+	}
+
+	daySlice, _ := item["days"].([]interface{})
+	for _, entry := range daySlice {
+		day, _ := entry.(string)
+		name := strings.ToLower(day)
+		if len(name) > 3 && dayNames[name] == nil {
+			name = name[0:3]
+		}
+		list, found := dayNames[name]
+		if !found {
+			return nil, errInvalid("day " + day)
+		}
+		for _, weekday := range list {
+			span.days[weekday] = true
+		}
+		span.Days = append(span.Days, day)
+	}
+
+	if len(daySlice) == 0 {
+		for index := range span.days {
+			span.days[index] = true
+		}
+	}
+
+	return span, nil
+}
+
+// parseClock converts a time like 22:30 to the number of minutes since midnight.
+// We allow 24:00 so a range can end at midnight.
+func parseClock(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, errInvalid("time " + value)
+	}
+
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, err
+	}
+
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, errInvalid("time " + value)
+	}
+
+	return hour*60 + minute, nil
+}
+
+// scheduleError is returned for invalid schedule settings
+type scheduleError struct {
+	what string
+}
+
+func (e *scheduleError) Error() string {
+	return "invalid " + e.what
+}
+
+// errInvalid returns an error for an invalid part of a schedule
+func errInvalid(what string) error {
+	return &scheduleError{what: what}
+}
@@ -0,0 +1,84 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int
+		valid    bool
+	}{
+		{"00:00", 0, true},
+		{"22:30", 1350, true},
+		{"24:00", minutesPerDay, true},
+		{"24:30", 0, false},
+		{"12:60", 0, false},
+		{"-1:00", 0, false},
+		{"1230", 0, false},
+		{"ab:cd", 0, false},
+	}
+
+	for _, test := range tests {
+		minutes, err := parseClock(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v, expected valid %v", test.value, err, test.valid)
+			continue
+		}
+		if test.valid && minutes != test.expected {
+			t.Errorf("%s: got %d minutes, expected %d", test.value, minutes, test.expected)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone data not available")
+	}
+
+	// the clocks went forward at 02:00 on sunday 2020-03-08 and back at 02:00 on sunday 2020-11-01
+	tests := []struct {
+		name     string
+		ranges   []interface{}
+		time     time.Time
+		expected bool
+	}{
+		{"inside", []interface{}{rangeSettings("08:00", "17:00", "weekdays")}, time.Date(2020, 3, 9, 12, 0, 0, 0, location), true},
+		{"wrong day", []interface{}{rangeSettings("08:00", "17:00", "weekdays")}, time.Date(2020, 3, 7, 12, 0, 0, 0, location), false},
+		{"end is exclusive", []interface{}{rangeSettings("08:00", "17:00")}, time.Date(2020, 3, 9, 17, 0, 0, 0, location), false},
+		{"ends at midnight", []interface{}{rangeSettings("20:00", "24:00")}, time.Date(2020, 3, 9, 23, 59, 0, 0, location), true},
+		{"whole day", []interface{}{rangeSettings("00:00", "00:00", "mon")}, time.Date(2020, 3, 9, 3, 0, 0, 0, location), true},
+		{"wraps into next day", []interface{}{rangeSettings("22:00", "06:00", "friday")}, time.Date(2020, 3, 7, 5, 0, 0, 0, location), true},
+		{"wraps from wrong day", []interface{}{rangeSettings("22:00", "06:00", "friday")}, time.Date(2020, 3, 8, 5, 0, 0, 0, location), false},
+		{"start after spring forward", []interface{}{rangeSettings("22:00", "06:00", "sun")}, time.Date(2020, 3, 8, 22, 0, 0, 0, location), true},
+		{"wall clock after spring forward", []interface{}{rangeSettings("03:00", "04:00", "sun")}, time.Date(2020, 3, 8, 7, 30, 0, 0, time.UTC), true},
+		{"utc hour before spring forward", []interface{}{rangeSettings("03:00", "04:00", "sat")}, time.Date(2020, 3, 7, 7, 30, 0, 0, time.UTC), false},
+		{"wall clock after fall back", []interface{}{rangeSettings("01:00", "02:00", "sun")}, time.Date(2020, 11, 1, 6, 30, 0, 0, time.UTC), true},
+		{"wall clock before fall back", []interface{}{rangeSettings("01:00", "02:00", "sun")}, time.Date(2020, 11, 1, 5, 30, 0, 0, time.UTC), true},
+		{"after fall back", []interface{}{rangeSettings("01:00", "02:00", "sun")}, time.Date(2020, 11, 1, 7, 30, 0, 0, time.UTC), false},
+		{"second range", []interface{}{rangeSettings("08:00", "09:00"), rangeSettings("18:00", "19:00")}, time.Date(2020, 3, 9, 18, 30, 0, 0, location), true},
+	}
+
+	for _, test := range tests {
+		item, err := parseSchedule(map[string]interface{}{"name": test.name, "timezone": "America/New_York", "ranges": test.ranges}, time.UTC)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if item.contains(test.time) != test.expected {
+			t.Errorf("%s: %v active %v, expected %v", test.name, test.time, !test.expected, test.expected)
+		}
+	}
+}
+
+// rangeSettings returns a time range in the settings format
+func rangeSettings(start string, end string, days ...string) map[string]interface{} {
+	var list []interface{}
+	for _, day := range days {
+		list = append(list, day)
+	}
+	return map[string]interface{}{"start": start, "end": end, "days": list}
+}
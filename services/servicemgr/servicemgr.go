@@ -0,0 +1,350 @@
+// Package servicemgr starts and stops the packetd services in dependency
+// order. Each service declares the services it depends on, and is started
+// with a timeout and a number of retries. When a service fails to start the
+// services that depend on it are skipped, and everything else is started so
+// the daemon can still report what went wrong.
+package servicemgr
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/crashreport"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// the default time we wait for a service to start or stop
+const defaultTimeout = 30 * time.Second
+
+// the time we wait between startup attempts
+const retryDelay = 1 * time.Second
+
+// The states a service can be in
+const (
+	StatePending  = "pending"
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateFailed   = "failed"
+	StateTimeout  = "timeout"
+	StateSkipped  = "skipped"
+	StateDisabled = "disabled"
+	StateStopped  = "stopped"
+)
+
+// Service describes a service managed by the service manager. The service
+// is only started once all of the Depends services are running, and is
+// skipped if any of them failed. The After services are only used to order
+// the startup so a failure in one of them doesn't keep this service from
+// starting.
+type Service struct {
+	Name     string
+	Depends  []string
+	After    []string
+	Startup  func() error
+	Shutdown func()
+	Timeout  time.Duration
+	Retries  int
+	Disabled bool
+}
+
+// ServiceStatus holds the startup state of a service
+type ServiceStatus struct {
+	Name      string   `json:"name"`
+	State     string   `json:"state"`
+	Depends   []string `json:"depends,omitempty"`
+	Attempts  int      `json:"attempts"`
+	StartupMs float64  `json:"startupMs"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// serviceEntry holds a registered service and its status
+type serviceEntry struct {
+	service Service
+	status  ServiceStatus
+}
+
+var serviceList []*serviceEntry
+var startOrder []*serviceEntry
+var serviceMutex sync.Mutex
+
+// Register adds a service to the service manager
+func Register(service Service) {
+	if service.Timeout == 0 {
+		service.Timeout = defaultTimeout
+	}
+
+	entry := &serviceEntry{service: service}
+	entry.status = ServiceStatus{Name: service.Name, State: StatePending, Depends: service.Depends}
+	if service.Disabled {
+		entry.status.State = StateDisabled
+	}
+
+	serviceMutex.Lock()
+	serviceList = append(serviceList, entry)
+	serviceMutex.Unlock()
+}
+
+// StartServices starts all of the registered services in dependency order
+// and returns false if any of them did not start
+func StartServices() bool {
+	order, err := getStartOrder()
+	if err != nil {
+		logger.Err("Unable to start services: %s\n", err.Error())
+		return false
+	}
+
+	serviceMutex.Lock()
+	startOrder = order
+	serviceMutex.Unlock()
+
+	result := true
+
+	for _, entry := range order {
+		if entry.getState() == StateDisabled {
+			logger.Info("Service %s is disabled\n", entry.service.Name)
+			continue
+		}
+
+		missing := entry.findFailedDependency()
+		if missing != "" {
+			logger.Err("Skipping service %s because %s is not running\n", entry.service.Name, missing)
+			entry.setStatus(StateSkipped, fmt.Sprintf("dependency %s is not running", missing))
+			result = false
+			continue
+		}
+
+		if !entry.start() {
+			result = false
+		}
+	}
+
+	return result
+}
+
+// StopServices stops the running services in the reverse of the startup order
+func StopServices() {
+	serviceMutex.Lock()
+	order := startOrder
+	serviceMutex.Unlock()
+
+	for i := len(order) - 1; i >= 0; i-- {
+		entry := order[i]
+		if entry.getState() != StateRunning {
+			continue
+		}
+		entry.stop()
+	}
+}
+
+// GetStatus returns the startup state of every service in startup order
+func GetStatus() []ServiceStatus {
+	var list []ServiceStatus
+
+	serviceMutex.Lock()
+	order := startOrder
+	if order == nil {
+		order = serviceList
+	}
+	for _, entry := range order {
+		list = append(list, entry.status)
+	}
+	serviceMutex.Unlock()
+
+	return list
+}
+
+// IsPartial returns true if any enabled service is not running
+func IsPartial() bool {
+	for _, status := range GetStatus() {
+		if status.State != StateRunning && status.State != StateDisabled {
+			return true
+		}
+	}
+	return false
+}
+
+// getStartOrder sorts the services so every service comes after the services
+// it depends on, keeping the registration order where there is a choice
+func getStartOrder() ([]*serviceEntry, error) {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+
+	finder := make(map[string]*serviceEntry)
+	for _, entry := range serviceList {
+		finder[entry.service.Name] = entry
+	}
+
+	var order []*serviceEntry
+	visited := make(map[string]int)
+
+	var visit func(entry *serviceEntry) error
+	visit = func(entry *serviceEntry) error {
+		switch visited[entry.service.Name] {
+		case 1:
+			return fmt.Errorf("dependency loop detected at %s", entry.service.Name)
+		case 2:
+			return nil
+		}
+
+		visited[entry.service.Name] = 1
+		for _, list := range [][]string{entry.service.Depends, entry.service.After} {
+			for _, name := range list {
+				other, found := finder[name]
+				if !found {
+					return fmt.Errorf("service %s depends on unknown service %s", entry.service.Name, name)
+				}
+				err := visit(other)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		visited[entry.service.Name] = 2
+		order = append(order, entry)
+		return nil
+	}
+
+	for _, entry := range serviceList {
+		err := visit(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// findFailedDependency returns the name of the first dependency that is not running
+func (entry *serviceEntry) findFailedDependency() string {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+
+	for _, name := range entry.service.Depends {
+		for _, other := range serviceList {
+			if other.service.Name == name && other.status.State != StateRunning {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// start calls the service startup function until it succeeds or we run out
+// of retries. A startup that times out is not retried since it may still be
+// running, so the service is left in the timeout state.
+func (entry *serviceEntry) start() bool {
+	name := entry.service.Name
+
+	for attempt := 1; attempt <= entry.service.Retries+1; attempt++ {
+		entry.setStatus(StateStarting, "")
+		serviceMutex.Lock()
+		entry.status.Attempts = attempt
+		serviceMutex.Unlock()
+
+		logger.Info("Starting service %s\n", name)
+		started := time.Now()
+		done := make(chan error, 1)
+
+		go func() {
+			done <- callStartup(entry.service.Name, entry.service.Startup)
+		}()
+
+		select {
+		case err := <-done:
+			elapsed := float64(time.Since(started)) / float64(time.Millisecond)
+			serviceMutex.Lock()
+			entry.status.StartupMs = elapsed
+			serviceMutex.Unlock()
+
+			if err == nil {
+				entry.setStatus(StateRunning, "")
+				return true
+			}
+
+			logger.Err("Service %s failed to start (attempt %d of %d): %s\n", name, attempt, entry.service.Retries+1, err.Error())
+			entry.setStatus(StateFailed, err.Error())
+		case <-time.After(entry.service.Timeout):
+			logger.Err("Service %s did not start within %v\n", name, entry.service.Timeout)
+			entry.setStatus(StateTimeout, fmt.Sprintf("startup did not finish within %v", entry.service.Timeout))
+			go entry.waitLateStartup(done)
+			return false
+		}
+
+		if attempt <= entry.service.Retries {
+			time.Sleep(retryDelay)
+		}
+	}
+
+	return false
+}
+
+// waitLateStartup waits for a startup that timed out to finish so we can
+// record that the service did eventually start
+func (entry *serviceEntry) waitLateStartup(done chan error) {
+	err := <-done
+	if err != nil {
+		logger.Err("Service %s failed to start after timeout: %s\n", entry.service.Name, err.Error())
+		entry.setStatus(StateFailed, err.Error())
+		return
+	}
+
+	logger.Warn("Service %s started after timeout\n", entry.service.Name)
+	entry.setStatus(StateRunning, "")
+}
+
+// stop calls the service shutdown function with a timeout
+func (entry *serviceEntry) stop() {
+	if entry.service.Shutdown == nil {
+		entry.setStatus(StateStopped, "")
+		return
+	}
+
+	logger.Info("Stopping service %s\n", entry.service.Name)
+	done := make(chan bool, 1)
+
+	go func() {
+		entry.service.Shutdown()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		entry.setStatus(StateStopped, "")
+	case <-time.After(entry.service.Timeout):
+		logger.Err("Service %s did not stop within %v\n", entry.service.Name, entry.service.Timeout)
+		entry.setStatus(StateTimeout, fmt.Sprintf("shutdown did not finish within %v", entry.service.Timeout))
+	}
+}
+
+// getState returns the current state of the service
+func (entry *serviceEntry) getState() string {
+	serviceMutex.Lock()
+	defer serviceMutex.Unlock()
+	return entry.status.State
+}
+
+// setStatus sets the state and error of the service
+func (entry *serviceEntry) setStatus(state string, message string) {
+	serviceMutex.Lock()
+	entry.status.State = state
+	entry.status.Error = message
+	serviceMutex.Unlock()
+}
+
+// callStartup calls a startup function and turns a panic into an error
+// after saving a crash report
+func callStartup(name string, startup func() error) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			crashreport.Capture("service "+name+" startup", recovered, debug.Stack())
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+
+	if startup == nil {
+		return nil
+	}
+	return startup()
+}
@@ -0,0 +1,116 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The default settings are built from layers so one image can ship the
+// correct defaults for several devices. The base defaults file comes first,
+// then the overlay for the detected board, and then the OEM overlay. Objects
+// in an overlay are merged into the layers below, a null removes the value,
+// and anything else replaces it.
+
+const boardDefaultsDir = "/etc/config/defaults.d/boards"
+const oemDefaultsFile = "/etc/config/defaults.d/oem.json"
+
+// the files that identify the board, the first one found is used
+var boardFiles = []string{
+	"/tmp/sysinfo/untangle_board_name",
+	"/tmp/sysinfo/board_name",
+	"/proc/device-tree/compatible",
+	"/sys/class/dmi/id/product_name",
+}
+
+var boardName string
+var boardOnce sync.Once
+
+// GetBoardName returns the identifier of the board used to select the
+// default settings overlay, or an empty string if it is unknown
+func GetBoardName() string {
+	boardOnce.Do(func() {
+		boardName = detectBoardName()
+		if boardName != "" {
+			logger.Info("Detected board %s\n", boardName)
+		}
+	})
+	return boardName
+}
+
+// detectBoardName reads the board identifier from the system
+func detectBoardName() string {
+	for _, filename := range boardFiles {
+		raw, err := ioutil.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		// the device tree has a list of NUL separated names with the most specific first
+		text := strings.TrimSpace(strings.SplitN(string(raw), "\x00", 2)[0])
+		if name := normalizeBoardName(text); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// normalizeBoardName returns a board identifier that is safe to use in a file name
+func normalizeBoardName(text string) string {
+	return strings.Trim(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, text), "._")
+}
+
+// readDefaultSettings returns the default settings with the board and OEM overlays merged
+func readDefaultSettings() (map[string]interface{}, error) {
+	jsonSettings, err := readSettingsFileJSON(defaultsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var overlays []string
+	if board := GetBoardName(); board != "" {
+		overlays = append(overlays, filepath.Join(boardDefaultsDir, board+".json"))
+	}
+	overlays = append(overlays, oemDefaultsFile)
+
+	for _, filename := range overlays {
+		overlay, err := readSettingsFileJSON(filename)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logger.Warn("Ignoring invalid default settings overlay %s: %v\n", filename, err)
+			}
+			continue
+		}
+		mergeSettings(jsonSettings, overlay)
+	}
+
+	return jsonSettings, nil
+}
+
+// mergeSettings merges the overlay into the settings
+func mergeSettings(jsonSettings map[string]interface{}, overlay map[string]interface{}) {
+	for key, value := range overlay {
+		if value == nil {
+			delete(jsonSettings, key)
+			continue
+		}
+		source, sourceOk := value.(map[string]interface{})
+		target, targetOk := jsonSettings[key].(map[string]interface{})
+		if sourceOk && targetOk {
+			mergeSettings(target, source)
+			continue
+		}
+		jsonSettings[key] = value
+	}
+}
@@ -0,0 +1,44 @@
+package settings
+
+import (
+	"github.com/untangle/packetd/services/logger"
+)
+
+// GetLanDevices returns the device names of the enabled non-WAN interfaces
+// from the network settings. It is used by the services and plugins that
+// listen for traffic from the local devices.
+func GetLanDevices() []string {
+	var list []string
+
+	networkJSON, err := GetCurrentSettings([]string{"network", "interfaces"})
+	if networkJSON == nil || err != nil {
+		logger.Warn("Unable to read network settings\n")
+		return list
+	}
+
+	networkSlice, ok := networkJSON.([]interface{})
+	if !ok {
+		logger.Warn("Unable to locate interfaces\n")
+		return list
+	}
+
+	for _, value := range networkSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok || item == nil {
+			continue
+		}
+		device, ok := item["device"].(string)
+		if !ok || device == "" {
+			continue
+		}
+		if wan, found := item["wan"].(bool); found && wan {
+			continue
+		}
+		if enabled, found := item["enabled"].(bool); found && !enabled {
+			continue
+		}
+		list = append(list, device)
+	}
+
+	return list
+}
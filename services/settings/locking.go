@@ -0,0 +1,161 @@
+package settings
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The settings can be changed by several goroutines and by other processes
+// like settingsd and the provisioning scripts. Every change takes an exclusive
+// lock in this process and an advisory lock on the lock file shared with the
+// other processes, so two changes can't read the same settings and have the
+// second one lose the first. The files are written to a temporary file that
+// is renamed over the old one so they can't be read half written, and a copy
+// of the last saved and current settings that could be parsed is kept to
+// recover from a corrupt file.
+
+const lockFile = "/etc/config/settings.lock"
+
+// the suffix of the copy of the last settings file that could be parsed
+const snapshotSuffix = ".good"
+
+var settingsLocker sync.RWMutex
+
+// settingsLock holds the locks taken for a settings operation
+type settingsLock struct {
+	file      *os.File
+	exclusive bool
+}
+
+// lockSettings takes the settings locks, which are shared for reading and exclusive for changes
+func lockSettings(exclusive bool) *settingsLock {
+	lock := &settingsLock{exclusive: exclusive}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		settingsLocker.Lock()
+		how = syscall.LOCK_EX
+	} else {
+		settingsLocker.RLock()
+	}
+
+	file, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Debug("Unable to open the settings lock file: %v\n", err)
+		return lock
+	}
+
+	err = syscall.Flock(int(file.Fd()), how)
+	if err != nil {
+		logger.Warn("Unable to lock the settings lock file: %v\n", err)
+		file.Close()
+		return lock
+	}
+
+	lock.file = file
+	return lock
+}
+
+// unlock releases the settings locks
+func (lock *settingsLock) unlock() {
+	if lock.file != nil {
+		syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+		lock.file.Close()
+	}
+
+	if lock.exclusive {
+		settingsLocker.Unlock()
+	} else {
+		settingsLocker.RUnlock()
+	}
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory
+// and renames it over the file, so readers see the old or the new contents
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	// sync the directory so the rename survives a power failure
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// isSnapshotFile returns true if we keep a copy of the last good version of the file
+func isSnapshotFile(filename string) bool {
+	return filename == settingsFile || filename == currentFile
+}
+
+// updateSnapshot saves a copy of a settings file that was parsed without
+// problems unless the copy is already newer than the file
+func updateSnapshot(filename string, raw []byte) {
+	snapshot := filename + snapshotSuffix
+
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+	snapshotInfo, err := os.Stat(snapshot)
+	if err == nil && !snapshotInfo.ModTime().Before(fileInfo.ModTime()) {
+		return
+	}
+
+	err = writeFileAtomic(snapshot, raw, 0600)
+	if err != nil {
+		logger.Warn("Unable to save the settings snapshot %s: %v\n", snapshot, err)
+	}
+}
+
+// recoverSnapshot restores a settings file that can't be parsed from the
+// last good copy and returns the contents
+func recoverSnapshot(filename string, problem error) ([]byte, error) {
+	snapshot := filename + snapshotSuffix
+
+	raw, err := ioutil.ReadFile(snapshot)
+	if err != nil {
+		return nil, problem
+	}
+
+	var jsonObject interface{}
+	if json.Unmarshal(raw, &jsonObject) != nil {
+		return nil, problem
+	}
+
+	logger.Err("%OC|The settings file %s is corrupt (%v), restoring %s\n", "settings_corrupt", 0, filename, problem, snapshot)
+	err = writeFileAtomic(filename, raw, 0644)
+	if err != nil {
+		logger.Err("Unable to restore %s: %v\n", filename, err)
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,426 @@
+package settings
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// Some settings like passwords and keys are secrets. A secret is stored
+// encrypted or hashed in the settings file, and the settings API returns it
+// redacted unless the caller asks for the secrets with a privileged scope.
+// A redacted value that is sent back when the settings are saved keeps the
+// stored secret, so secrets are write-only for the unprivileged callers.
+// The services get the current settings with the secrets decrypted, and
+// sync-settings gets them decrypted too since it has to configure the system.
+
+// The ways a secret is stored
+const (
+	// SecretEncrypt stores the secret encrypted so it can be decrypted when it is needed
+	SecretEncrypt = "encrypt"
+	// SecretHash stores a salted PBKDF2 hash of the secret which can only be verified
+	SecretHash = "hash"
+	// SecretRedact stores the value as it is, which is used for values that are already hashes
+	SecretRedact = "redact"
+)
+
+// RedactedValue replaces the secrets in the settings returned without the privileged scope
+const RedactedValue = "********"
+
+// the prefixes of the encrypted and hashed secrets in the settings file
+const encryptedPrefix = "secret:"
+const hashedPrefix = "hash:"
+
+// The hashed secrets use PBKDF2 with SHA-256. The iterations are stored with
+// each hash so the count can be raised without breaking the stored secrets.
+const hashIterations = 100000
+const maxHashIterations = 10000000
+const hashSize = 32
+
+// The key is kept outside of the settings directory so a backup or export of
+// the settings never has the key that decrypts its secrets.
+const secretKeyFile = "/etc/packetd/settings.key"
+
+// secretField is the path of a secret where * matches any object key or list index
+type secretField struct {
+	path []string
+	mode string
+}
+
+// the scopes for reading the settings
+const (
+	scopeRedacted = iota
+	scopeRevealed
+)
+
+var secretList = []secretField{
+	{path: []string{"accounts", "credentials", "*", "passwordHashMD5"}, mode: SecretRedact},
+	{path: []string{"accounts", "credentials", "*", "passwordHashSHA256"}, mode: SecretRedact},
+	{path: []string{"accounts", "credentials", "*", "passwordHashSHA512"}, mode: SecretRedact},
+	{path: []string{"network", "interfaces", "*", "wirelessPassword"}, mode: SecretEncrypt},
+	{path: []string{"network", "interfaces", "*", "pppoePassword"}, mode: SecretEncrypt},
+	{path: []string{"network", "interfaces", "*", "wireguardPrivateKey"}, mode: SecretEncrypt},
+	{path: []string{"reports", "encryption", "key"}, mode: SecretEncrypt},
+	{path: []string{"hasync", "secret"}, mode: SecretEncrypt},
+	{path: []string{"warehouse", "encryption", "key"}, mode: SecretEncrypt},
+	{path: []string{"warehouse", "signing", "privateKey"}, mode: SecretEncrypt},
+}
+var secretMutex sync.RWMutex
+var secretKey []byte
+var secretKeyMutex sync.Mutex
+
+// RegisterSecret adds the path of a secret to the settings. The path uses /
+// between the segments and * for any object key or list index.
+func RegisterSecret(path string, mode string) error {
+	field, err := newSecretField(path, mode)
+	if err != nil {
+		return err
+	}
+
+	secretMutex.Lock()
+	secretList = append(secretList, field)
+	secretMutex.Unlock()
+	return nil
+}
+
+// GetPrivilegedSettings returns the saved settings from the specified path
+// with the secrets decrypted. This must only be used for privileged callers.
+func GetPrivilegedSettings(segments []string) (interface{}, error) {
+	return getSettingsFile(segments, settingsFile, scopeRevealed)
+}
+
+// RedactSettings returns the settings object at the specified path with the secrets redacted
+func RedactSettings(jsonSettings map[string]interface{}, segments []string, value interface{}) interface{} {
+	fields := getSecretFields(jsonSettings)
+	return walkSecrets(value, segments, fields, func(field secretField, secret string) string {
+		return RedactedValue
+	})
+}
+
+// VerifySecret returns true if the clear text matches a stored secret
+func VerifySecret(stored string, clear string) bool {
+	if strings.HasPrefix(stored, hashedPrefix) {
+		parts := strings.Split(strings.TrimPrefix(stored, hashedPrefix), ":")
+		if len(parts) != 3 {
+			return false
+		}
+		iterations, err := strconv.Atoi(parts[0])
+		if err != nil || iterations < 1 || iterations > maxHashIterations {
+			return false
+		}
+		salt, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(hashSecret(salt, iterations, clear)), []byte(stored)) == 1
+	}
+
+	if strings.HasPrefix(stored, encryptedPrefix) {
+		decrypted, err := decryptSecret(stored)
+		if err != nil {
+			return false
+		}
+		stored = decrypted
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(clear)) == 1
+}
+
+// revealSecrets decrypts the encrypted secrets in the settings object at the specified path
+func revealSecrets(jsonSettings map[string]interface{}, segments []string, value interface{}) interface{} {
+	fields := getSecretFields(jsonSettings)
+	return walkSecrets(value, segments, fields, func(field secretField, secret string) string {
+		if !strings.HasPrefix(secret, encryptedPrefix) {
+			return secret
+		}
+		decrypted, err := decryptSecret(secret)
+		if err != nil {
+			logger.Warn("%OC|Unable to decrypt the secret %s: %v\n", "settings_secret_failure", 10, strings.Join(field.path, "/"), err)
+			return secret
+		}
+		return decrypted
+	})
+}
+
+// protectSecrets encrypts or hashes the secrets in the settings that are in
+// clear text, and puts back the stored secrets from the previous settings for
+// the values that were sent redacted
+func protectSecrets(jsonSettings map[string]interface{}, previous map[string]interface{}) error {
+	var problem error
+	fields := getSecretFields(jsonSettings)
+
+	walkSecretPaths(jsonSettings, nil, fields, func(field secretField, path []string, secret string) string {
+		if secret == RedactedValue {
+			stored, _ := getSettingsFromJSON(previous, path)
+			if text, ok := stored.(string); ok {
+				return text
+			}
+			return ""
+		}
+
+		switch field.mode {
+		case SecretEncrypt:
+			if strings.HasPrefix(secret, encryptedPrefix) || secret == "" {
+				return secret
+			}
+			encrypted, err := encryptSecret(secret)
+			if err != nil {
+				problem = err
+				return secret
+			}
+			return encrypted
+		case SecretHash:
+			if strings.HasPrefix(secret, hashedPrefix) || secret == "" {
+				return secret
+			}
+			salt := make([]byte, 16)
+			if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+				problem = err
+				return secret
+			}
+			return hashSecret(salt, hashIterations, secret)
+		}
+		return secret
+	})
+
+	return problem
+}
+
+// walkSecrets replaces the secrets in the object at the specified path with
+// the result of the function and returns the object
+func walkSecrets(value interface{}, segments []string, fields []secretField, function func(field secretField, secret string) string) interface{} {
+	return walkSecretPaths(value, segments, fields, func(field secretField, path []string, secret string) string {
+		return function(field, secret)
+	})
+}
+
+// walkSecretPaths is walkSecrets with the full path of each secret
+func walkSecretPaths(value interface{}, path []string, fields []secretField, function func(field secretField, path []string, secret string) string) interface{} {
+	var candidates []secretField
+	for _, field := range fields {
+		if matchSecretPrefix(field.path, path) {
+			candidates = append(candidates, field)
+		}
+	}
+	if len(candidates) == 0 {
+		return value
+	}
+
+	for _, field := range candidates {
+		if len(field.path) == len(path) {
+			if secret, ok := value.(string); ok {
+				return function(field, path, secret)
+			}
+			return value
+		}
+	}
+
+	switch object := value.(type) {
+	case map[string]interface{}:
+		for key, item := range object {
+			object[key] = walkSecretPaths(item, appendPath(path, key), candidates, function)
+		}
+	case []interface{}:
+		for index, item := range object {
+			object[index] = walkSecretPaths(item, appendPath(path, strconv.Itoa(index)), candidates, function)
+		}
+	}
+	return value
+}
+
+// matchSecretPrefix returns true if the path is the start of the secret path
+func matchSecretPrefix(secret []string, path []string) bool {
+	if len(path) > len(secret) {
+		return false
+	}
+	for index, segment := range path {
+		if secret[index] != "*" && secret[index] != segment {
+			return false
+		}
+	}
+	return true
+}
+
+// getSecretFields returns the registered secrets and the ones listed in the settings
+func getSecretFields(jsonSettings map[string]interface{}) []secretField {
+	secretMutex.RLock()
+	fields := append([]secretField{}, secretList...)
+	secretMutex.RUnlock()
+
+	list, _ := getSettingsFromJSON(jsonSettings, []string{"system", "secrets"})
+	items, _ := list.([]interface{})
+	for _, value := range items {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		path, _ := item["path"].(string)
+		mode, _ := item["mode"].(string)
+		if mode == "" {
+			mode = SecretEncrypt
+		}
+		field, err := newSecretField(path, mode)
+		if err != nil {
+			logger.Warn("%OC|Ignoring invalid secret %s: %v\n", "settings_secret_invalid", 10, path, err)
+			continue
+		}
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// newSecretField returns the secret for a path and mode
+func newSecretField(path string, mode string) (secretField, error) {
+	field := secretField{path: strings.Split(strings.Trim(path, "/"), "/"), mode: mode}
+	if path == "" || field.path[0] == "" {
+		return field, errors.New("missing path")
+	}
+	if mode != SecretEncrypt && mode != SecretHash && mode != SecretRedact {
+		return field, errors.New("invalid mode: " + mode)
+	}
+	return field, nil
+}
+
+// hashSecret returns the stored form of a hashed secret, which has the
+// iterations, the salt, and the PBKDF2 digest
+func hashSecret(salt []byte, iterations int, clear string) string {
+	digest := deriveSecretHash([]byte(clear), salt, iterations)
+	return hashedPrefix + strconv.Itoa(iterations) + ":" + hex.EncodeToString(salt) + ":" + hex.EncodeToString(digest)
+}
+
+// deriveSecretHash returns the PBKDF2 HMAC-SHA256 digest of a secret. The
+// digest is a single block since it is the size of the hash.
+func deriveSecretHash(secret []byte, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, secret)
+	prf.Write(salt)
+	binary.Write(prf, binary.BigEndian, uint32(1))
+	sum := prf.Sum(nil)
+
+	result := make([]byte, len(sum))
+	copy(result, sum)
+	for round := 1; round < iterations; round++ {
+		prf.Reset()
+		prf.Write(sum)
+		sum = prf.Sum(sum[:0])
+		for index := range result {
+			result[index] ^= sum[index]
+		}
+	}
+	return result[:hashSize]
+}
+
+// encryptSecret returns the stored form of an encrypted secret
+func encryptSecret(clear string) (string, error) {
+	block, err := getSecretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, block.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := block.Seal(nonce, nonce, []byte(clear), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret returns the clear text of an encrypted secret
+func decryptSecret(stored string) (string, error) {
+	block, err := getSecretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < block.NonceSize() {
+		return "", errors.New("secret too short")
+	}
+
+	clear, err := block.Open(nil, sealed[:block.NonceSize()], sealed[block.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(clear), nil
+}
+
+// getSecretCipher returns the cipher for the secrets, creating the key the first time
+func getSecretCipher() (cipher.AEAD, error) {
+	secretKeyMutex.Lock()
+	defer secretKeyMutex.Unlock()
+
+	if secretKey == nil {
+		raw, err := ioutil.ReadFile(secretKeyFile)
+		if err == nil {
+			secretKey, err = hex.DecodeString(strings.TrimSpace(string(raw)))
+			if err != nil || len(secretKey) != 32 {
+				secretKey = nil
+				return nil, errors.New("invalid secret key file")
+			}
+		} else if os.IsNotExist(err) {
+			key := make([]byte, 32)
+			if _, err := io.ReadFull(rand.Reader, key); err != nil {
+				return nil, err
+			}
+			err = writeSecretKeyFile([]byte(hex.EncodeToString(key)))
+			if err != nil {
+				return nil, err
+			}
+			logger.Notice("Created the settings secret key %s\n", secretKeyFile)
+			secretKey = key
+		} else {
+			return nil, err
+		}
+	}
+
+	block, err := aes.NewCipher(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeSecretKeyFile writes the secret key file so only root can read it
+func writeSecretKeyFile(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(secretKeyFile), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(secretKeyFile, data, 0400)
+}
+
+// copySettings returns a deep copy of a settings object
+func copySettings(jsonSettings map[string]interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(jsonSettings)
+	if err != nil {
+		return nil, err
+	}
+	return parseSettingsJSON(raw)
+}
+
+// appendPath returns a new path with the segment added
+func appendPath(path []string, segment string) []string {
+	result := make([]string, len(path), len(path)+1)
+	copy(result, path)
+	return append(result, segment)
+}
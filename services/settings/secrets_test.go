@@ -0,0 +1,171 @@
+package settings
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// loadTestSettings returns a settings object from JSON and sets a secret key
+// so the tests don't create the key file
+func loadTestSettings(t *testing.T, text string) map[string]interface{} {
+	secretKeyMutex.Lock()
+	if secretKey == nil {
+		secretKey = []byte("0123456789abcdef0123456789abcdef")
+	}
+	secretKeyMutex.Unlock()
+
+	var jsonSettings map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &jsonSettings); err != nil {
+		t.Fatal(err)
+	}
+	return jsonSettings
+}
+
+// getTestValue returns the string at a path in the settings
+func getTestValue(jsonSettings map[string]interface{}, path string) string {
+	value, _ := getSettingsFromJSON(jsonSettings, strings.Split(path, "/"))
+	text, _ := value.(string)
+	return text
+}
+
+func TestRedactSettings(t *testing.T) {
+	const text = `{
+		"network": {"interfaces": [
+			{"name": "wlan0", "wirelessPassword": "wifi0"},
+			{"name": "wlan1", "wirelessPassword": "wifi1"}
+		]},
+		"vpn": {"tunnels": {
+			"office": {"psk": "office-key", "remote": "192.0.2.1"},
+			"branch": {"psk": "branch-key", "remote": "192.0.2.2"}
+		}},
+		"system": {"secrets": [{"path": "vpn/tunnels/*/psk"}]}
+	}`
+
+	tests := []struct {
+		name     string
+		segments []string
+		path     string
+		expected string
+	}{
+		{"list", nil, "network/interfaces/0/wirelessPassword", RedactedValue},
+		{"second list item", nil, "network/interfaces/1/wirelessPassword", RedactedValue},
+		{"list neighbor", nil, "network/interfaces/1/name", "wlan1"},
+		{"map", nil, "vpn/tunnels/office/psk", RedactedValue},
+		{"second map item", nil, "vpn/tunnels/branch/psk", RedactedValue},
+		{"map neighbor", nil, "vpn/tunnels/branch/remote", "192.0.2.2"},
+		{"sub path", []string{"vpn", "tunnels"}, "vpn/tunnels/office/psk", RedactedValue},
+		{"sub path item", []string{"network", "interfaces", "0"}, "network/interfaces/0/wirelessPassword", RedactedValue},
+	}
+
+	for _, test := range tests {
+		jsonSettings := loadTestSettings(t, text)
+		value, _ := getSettingsFromJSON(jsonSettings, test.segments)
+		RedactSettings(jsonSettings, test.segments, value)
+
+		if found := getTestValue(jsonSettings, test.path); found != test.expected {
+			t.Errorf("%s: %s is %q, expected %q", test.name, test.path, found, test.expected)
+		}
+	}
+}
+
+func TestProtectSecrets(t *testing.T) {
+	previous := loadTestSettings(t, `{"network": {"interfaces": [{"wirelessPassword": "old"}]}}`)
+	if err := protectSecrets(previous, nil); err != nil {
+		t.Fatal(err)
+	}
+	stored := getTestValue(previous, "network/interfaces/0/wirelessPassword")
+
+	encrypted, err := encryptSecret("ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := hashSecret([]byte("salt"), 10, "ready")
+
+	tests := []struct {
+		name   string
+		path   string
+		value  string
+		prefix string
+		same   string
+	}{
+		{"encrypt", "network/interfaces/0/wirelessPassword", "new", encryptedPrefix, ""},
+		{"redacted keeps stored", "network/interfaces/0/wirelessPassword", RedactedValue, "", stored},
+		{"redacted without stored", "network/interfaces/1/wirelessPassword", RedactedValue, "", ""},
+		{"already encrypted", "network/interfaces/0/wirelessPassword", encrypted, "", encrypted},
+		{"empty", "network/interfaces/0/wirelessPassword", "", "", ""},
+		{"settings secret", "custom/token", "clear", encryptedPrefix, ""},
+		{"settings hash", "custom/password", "clear", hashedPrefix, ""},
+		{"already hashed", "custom/password", hashed, "", hashed},
+		{"settings redact", "custom/digest", "abcdef", "", "abcdef"},
+	}
+
+	for _, test := range tests {
+		jsonSettings := loadTestSettings(t, `{
+			"network": {"interfaces": [{"wirelessPassword": ""}, {"wirelessPassword": ""}]},
+			"custom": {"token": "", "password": "", "digest": ""},
+			"system": {"secrets": [
+				{"path": "custom/token"},
+				{"path": "custom/password", "mode": "hash"},
+				{"path": "custom/digest", "mode": "redact"}
+			]}
+		}`)
+		segments := strings.Split(test.path, "/")
+		parent, _ := getSettingsFromJSON(jsonSettings, segments[:len(segments)-1])
+		if object, ok := parent.(map[string]interface{}); ok {
+			object[segments[len(segments)-1]] = test.value
+		}
+
+		if err := protectSecrets(jsonSettings, previous); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		found := getTestValue(jsonSettings, test.path)
+		if test.prefix != "" {
+			if !strings.HasPrefix(found, test.prefix) {
+				t.Errorf("%s: %q does not start with %q", test.name, found, test.prefix)
+			}
+			if !VerifySecret(found, test.value) {
+				t.Errorf("%s: %q does not verify", test.name, found)
+			}
+		} else if found != test.same {
+			t.Errorf("%s: got %q, expected %q", test.name, found, test.same)
+		}
+	}
+}
+
+func TestVerifySecret(t *testing.T) {
+	loadTestSettings(t, `{}`)
+	encrypted, err := encryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := hashSecret([]byte("salt"), 10, "secret")
+
+	tests := []struct {
+		name     string
+		stored   string
+		clear    string
+		expected bool
+	}{
+		{"hash", hashed, "secret", true},
+		{"hash wrong", hashed, "guess", false},
+		{"hash default iterations", hashSecret([]byte("salt"), hashIterations, "secret"), "secret", true},
+		{"hash other iterations", strings.Replace(hashed, "hash:10:", "hash:11:", 1), "secret", false},
+		{"hash missing iterations", hashedPrefix + strings.SplitN(hashed, ":", 3)[2], "secret", false},
+		{"hash too many iterations", "hash:99999999:73616c74:00", "secret", false},
+		{"hash invalid salt", "hash:10:salt:00", "secret", false},
+		{"encrypted", encrypted, "secret", true},
+		{"encrypted wrong", encrypted, "guess", false},
+		{"encrypted invalid", encryptedPrefix + "invalid", "invalid", false},
+		{"clear", "secret", "secret", true},
+		{"clear wrong", "secret", "guess", false},
+	}
+
+	for _, test := range tests {
+		if VerifySecret(test.stored, test.clear) != test.expected {
+			t.Errorf("%s: verified %v, expected %v", test.name, !test.expected, test.expected)
+		}
+	}
+}
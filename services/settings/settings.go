@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -24,11 +23,13 @@ const currentFile = "/etc/config/current.json"
 
 // Startup settings service
 func Startup() {
+	syncStorage()
+	resumePendingCommit()
 }
 
 // Shutdown settings service
 func Shutdown() {
-
+	stopRollbackTimer()
 }
 
 // GetCurrentSettings returns the current settings from the specified path
@@ -38,9 +39,9 @@ func GetCurrentSettings(segments []string) (interface{}, error) {
 	// if it does not exist, just read settings.json
 	// XXX this should be removed at some point in the future
 	if _, err := os.Stat(currentFile); os.IsNotExist(err) {
-		return GetSettingsFile(segments, settingsFile)
+		return getSettingsFile(segments, settingsFile, scopeRevealed)
 	}
-	return GetSettingsFile(segments, currentFile)
+	return getSettingsFile(segments, currentFile, scopeRevealed)
 }
 
 // GetSettings returns the settings from the specified path
@@ -59,26 +60,54 @@ func TrimSettings(segments []string) (interface{}, error) {
 }
 
 // GetDefaultSettings returns the default settings from the specified path
+// with the overlays for the board and the OEM merged
 func GetDefaultSettings(segments []string) (interface{}, error) {
-	return GetSettingsFile(segments, defaultsFile)
+	lock := lockSettings(false)
+	defer lock.unlock()
+
+	jsonSettings, err := readDefaultSettings()
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	jsonObject, err := getSettingsFromJSON(jsonSettings, segments)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	return RedactSettings(jsonSettings, segments, jsonObject), nil
 }
 
 // GetSettingsFile returns the settings from the specified path of the specified filename
+// with the secrets redacted
 func GetSettingsFile(segments []string, filename string) (interface{}, error) {
+	return getSettingsFile(segments, filename, scopeRedacted)
+}
+
+// getSettingsFile returns the settings from the specified path of the specified filename
+// with the secrets redacted or decrypted for the scope
+func getSettingsFile(segments []string, filename string, scope int) (interface{}, error) {
 	var err error
+	var jsonSettings map[string]interface{}
 	var jsonObject interface{}
 
-	jsonObject, err = readSettingsFileJSON(filename)
+	lock := lockSettings(false)
+	defer lock.unlock()
+
+	jsonSettings, err = readSettingsFileJSON(filename)
 	if err != nil {
 		return createJSONErrorObject(err), err
 	}
 
-	jsonObject, err = getSettingsFromJSON(jsonObject, segments)
+	jsonObject, err = getSettingsFromJSON(jsonSettings, segments)
 	if err != nil {
 		return createJSONErrorObject(err), err
 	}
 
-	return jsonObject, nil
+	if scope == scopeRevealed {
+		return revealSecrets(jsonSettings, segments, jsonObject), nil
+	}
+	return RedactSettings(jsonSettings, segments, jsonObject), nil
 }
 
 // SetSettingsFile updates the settings
@@ -88,6 +117,9 @@ func SetSettingsFile(segments []string, value interface{}, filename string) (int
 	var jsonSettings map[string]interface{}
 	var newSettings interface{}
 
+	lock := lockSettings(true)
+	defer lock.unlock()
+
 	jsonSettings, err = readSettingsFileJSON(filename)
 	if err != nil {
 		return createJSONErrorObject(err), err
@@ -112,13 +144,50 @@ func SetSettingsFile(segments []string, value interface{}, filename string) (int
 }
 
 // readSettingsFileJSON reads the settings file and return the corresponding JSON object
+// with the values from the settings storage for the saved and current settings
 func readSettingsFileJSON(filename string) (map[string]interface{}, error) {
+	jsonObject, err := readSettingsFileRaw(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if isStorageFile(filename) {
+		loadStorage(jsonObject)
+	}
+
+	return jsonObject, nil
+}
+
+// readSettingsFileRaw reads the settings file and return the corresponding JSON object
+// A corrupt saved or current settings file is restored from the last good copy.
+func readSettingsFileRaw(filename string) (map[string]interface{}, error) {
 	raw, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+
+	jsonObject, err := parseSettingsJSON(raw)
+	if err != nil && isSnapshotFile(filename) {
+		raw, err = recoverSnapshot(filename, err)
+		if err != nil {
+			return nil, err
+		}
+		jsonObject, err = parseSettingsJSON(raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if isSnapshotFile(filename) {
+		updateSnapshot(filename, raw)
+	}
+	return jsonObject, nil
+}
+
+// parseSettingsJSON returns the settings object from the contents of a settings file
+func parseSettingsJSON(raw []byte) (map[string]interface{}, error) {
 	var jsonObject interface{}
-	err = json.Unmarshal(raw, &jsonObject)
+	err := json.Unmarshal(raw, &jsonObject)
 	if err != nil {
 		return nil, err
 	}
@@ -235,6 +304,9 @@ func TrimSettingsFile(segments []string, filename string) (interface{}, error) {
 		return createJSONErrorObject(err), err
 	}
 
+	lock := lockSettings(true)
+	defer lock.unlock()
+
 	jsonSettings, err = readSettingsFileJSON(filename)
 	if err != nil {
 		return createJSONErrorObject(err), err
@@ -359,6 +431,19 @@ func runSyncSettings(filename string) (string, error) {
 // if sync-settings does not succeed it returns the error and output
 // returns stdout, stderr, and an error
 func syncAndSave(jsonObject map[string]interface{}, filename string) (string, error) {
+	// the secrets are saved encrypted but sync-settings gets them decrypted
+	previous, _ := readSettingsFileRaw(filename)
+	err := protectSecrets(jsonObject, previous)
+	if err != nil {
+		logger.Warn("Failed to protect the secrets: %v\n", err.Error())
+		return "Failed to protect the secrets.", err
+	}
+	revealed, err := copySettings(jsonObject)
+	if err != nil {
+		return "Failed to copy settings.", err
+	}
+	revealSecrets(revealed, nil, revealed)
+
 	tmpfile, err := tempFile("", "settings.json.")
 	if err != nil {
 		logger.Warn("Failed to generate tmpfile: %v\n", err.Error())
@@ -367,7 +452,7 @@ func syncAndSave(jsonObject map[string]interface{}, filename string) (string, er
 	defer tmpfile.Close()
 
 	logger.Info("Writing settings to %v\n", tmpfile.Name())
-	_, syncError := writeSettingsFileJSON(jsonObject, tmpfile)
+	_, syncError := writeSettingsFileJSON(revealed, tmpfile)
 	if syncError != nil {
 		logger.Warn("Failed to write settings file: %v\n", err.Error())
 		return "Failed to write settings.", err
@@ -384,19 +469,19 @@ func syncAndSave(jsonObject map[string]interface{}, filename string) (string, er
 	}
 
 	logger.Info("Copy settings from %v to  %v\n", tmpfile.Name(), filename)
-	outfile, err := os.Create(filename)
-	if err != nil {
-		return output, err
+	data, err := json.MarshalIndent(jsonObject, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(filename, data, 0644)
 	}
-	defer outfile.Close()
-
-	tmpfile.Seek(0, 0) // go back to start of file
-	_, err = io.Copy(outfile, tmpfile)
 	if err != nil {
 		logger.Warn("Failed to copy file: %v\n", err.Error())
 		return output, err
 	}
 
+	if filename == settingsFile {
+		saveStorage(revealed)
+	}
+
 	return output, nil
 }
 
@@ -0,0 +1,471 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// Settings changes can be staged and validated before they are applied. A
+// commit applies the staged settings and keeps a copy of the previous
+// settings, and unless the commit is confirmed before the deadline the
+// previous settings are restored. This keeps a change that breaks remote
+// access from locking out the admin. The pending commit is saved so the
+// rollback still happens if packetd is restarted before the deadline.
+
+const stagedFile = "/etc/config/staged.json"
+const rollbackFile = "/etc/config/rollback.json"
+const pendingFile = "/etc/config/pending.json"
+
+// DefaultConfirmSeconds is the time allowed to confirm a commit before it is rolled back
+const DefaultConfirmSeconds = 300
+
+// ValidatorFunction checks the complete settings object and returns a list of problems
+type ValidatorFunction func(settings map[string]interface{}) []string
+
+// ValidationResult holds the result of validating the staged settings
+type ValidationResult struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors"`
+	Output string   `json:"output,omitempty"`
+}
+
+// StagingStatus holds the state of the staged settings and any pending commit
+type StagingStatus struct {
+	Staged     bool              `json:"staged"`
+	Pending    bool              `json:"pending"`
+	Deadline   *time.Time        `json:"deadline,omitempty"`
+	Validation *ValidationResult `json:"validation,omitempty"`
+}
+
+// pendingCommit is saved to the pending file while a commit waits for confirmation
+type pendingCommit struct {
+	Deadline time.Time `json:"deadline"`
+}
+
+var validatorList = map[string]ValidatorFunction{"network": validateInterfaces}
+var lastValidation *ValidationResult
+var rollbackTimer *time.Timer
+var rollbackDeadline time.Time
+var stagingMutex sync.Mutex
+
+// RegisterValidator adds a function that checks the settings before they are committed
+func RegisterValidator(owner string, function ValidatorFunction) {
+	stagingMutex.Lock()
+	validatorList[owner] = function
+	stagingMutex.Unlock()
+}
+
+// StageSettings updates the staged settings at the specified path. The staged
+// settings start as a copy of the saved settings.
+func StageSettings(segments []string, value interface{}) (interface{}, error) {
+	stagingMutex.Lock()
+	defer stagingMutex.Unlock()
+
+	if _, err := os.Stat(stagedFile); os.IsNotExist(err) {
+		lock := lockSettings(false)
+		raw, err := ioutil.ReadFile(settingsFile)
+		lock.unlock()
+		if err != nil {
+			return createJSONErrorObject(err), err
+		}
+		err = writeFileAtomic(stagedFile, raw, 0600)
+		if err != nil {
+			return createJSONErrorObject(err), err
+		}
+	}
+
+	jsonSettings, err := readSettingsFileJSON(stagedFile)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	previous, err := copySettings(jsonSettings)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	newSettings, err := setSettingsInJSON(jsonSettings, segments, value)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+	jsonSettings, ok := newSettings.(map[string]interface{})
+	if !ok {
+		err = errors.New("Invalid global settings object")
+		return createJSONErrorObject(err), err
+	}
+
+	err = protectSecrets(jsonSettings, previous)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	err = writeSettingsFile(jsonSettings, stagedFile)
+	if err != nil {
+		return createJSONErrorObject(err), err
+	}
+
+	// the last validation no longer applies to the staged settings
+	lastValidation = nil
+
+	return createJSONObject("result", "OK"), nil
+}
+
+// GetStagedSettings returns the staged settings from the specified path
+func GetStagedSettings(segments []string) (interface{}, error) {
+	if _, err := os.Stat(stagedFile); os.IsNotExist(err) {
+		err = errors.New("No settings are staged")
+		return createJSONErrorObject(err), err
+	}
+	return GetSettingsFile(segments, stagedFile)
+}
+
+// DiscardStagedSettings removes the staged settings
+func DiscardStagedSettings() error {
+	stagingMutex.Lock()
+	defer stagingMutex.Unlock()
+
+	lastValidation = nil
+	err := os.Remove(stagedFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ValidateStagedSettings runs the validators and a sync-settings dry run on the staged settings
+func ValidateStagedSettings() (*ValidationResult, error) {
+	stagingMutex.Lock()
+	defer stagingMutex.Unlock()
+
+	jsonSettings, err := readSettingsFileJSON(stagedFile)
+	if err != nil {
+		return nil, err
+	}
+
+	lastValidation = validateSettings(jsonSettings)
+	return lastValidation, nil
+}
+
+// CommitStagedSettings validates and applies the staged settings. When
+// confirmSeconds is not zero the previous settings are restored unless
+// ConfirmSettings is called within that many seconds.
+func CommitStagedSettings(confirmSeconds int) (*ValidationResult, error) {
+	stagingMutex.Lock()
+	defer stagingMutex.Unlock()
+
+	if rollbackTimer != nil {
+		return nil, errors.New("A previous commit has not been confirmed")
+	}
+
+	jsonSettings, err := readSettingsFileJSON(stagedFile)
+	if err != nil {
+		return nil, err
+	}
+
+	result := validateSettings(jsonSettings)
+	lastValidation = result
+	if !result.Valid {
+		return result, errors.New("The staged settings are not valid")
+	}
+
+	lock := lockSettings(true)
+	defer lock.unlock()
+
+	if confirmSeconds > 0 {
+		raw, err := ioutil.ReadFile(settingsFile)
+		if err != nil {
+			return result, err
+		}
+		err = writeFileAtomic(rollbackFile, raw, 0600)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	output, err := syncAndSave(jsonSettings, settingsFile)
+	result.Output = output
+	if err != nil {
+		os.Remove(rollbackFile)
+		return result, err
+	}
+
+	os.Remove(stagedFile)
+	lastValidation = nil
+
+	if confirmSeconds > 0 {
+		deadline := time.Now().Add(time.Duration(confirmSeconds) * time.Second)
+		writePendingCommit(deadline)
+		startRollbackTimer(deadline)
+		logger.Notice("Committed staged settings, confirm before %v or they will be rolled back\n", deadline.Format(time.RFC3339))
+	} else {
+		logger.Notice("Committed staged settings\n")
+	}
+
+	return result, nil
+}
+
+// ConfirmSettings confirms a pending commit so it will not be rolled back
+func ConfirmSettings() error {
+	stagingMutex.Lock()
+	defer stagingMutex.Unlock()
+
+	if rollbackTimer == nil {
+		return errors.New("There is no commit waiting for confirmation")
+	}
+
+	rollbackTimer.Stop()
+	rollbackTimer = nil
+	os.Remove(pendingFile)
+	os.Remove(rollbackFile)
+
+	logger.Notice("Confirmed the committed settings\n")
+	return nil
+}
+
+// RollbackSettings restores the settings from before a pending commit
+func RollbackSettings() (string, error) {
+	stagingMutex.Lock()
+	defer stagingMutex.Unlock()
+
+	if rollbackTimer == nil {
+		return "", errors.New("There is no commit waiting for confirmation")
+	}
+
+	return rollbackPendingCommit()
+}
+
+// GetStagingStatus returns the state of the staged settings and any pending commit
+func GetStagingStatus() StagingStatus {
+	stagingMutex.Lock()
+	defer stagingMutex.Unlock()
+
+	var status StagingStatus
+
+	if _, err := os.Stat(stagedFile); err == nil {
+		status.Staged = true
+	}
+	if rollbackTimer != nil {
+		status.Pending = true
+		deadline := rollbackDeadline
+		status.Deadline = &deadline
+	}
+	status.Validation = lastValidation
+
+	return status
+}
+
+// resumePendingCommit restarts the rollback timer for a commit that was not
+// confirmed before packetd was stopped. If the deadline has passed the
+// settings are rolled back right away.
+func resumePendingCommit() {
+	raw, err := ioutil.ReadFile(pendingFile)
+	if err != nil {
+		return
+	}
+
+	var pending pendingCommit
+	err = json.Unmarshal(raw, &pending)
+	if err != nil {
+		logger.Warn("Invalid pending commit file: %v\n", err)
+		os.Remove(pendingFile)
+		return
+	}
+
+	stagingMutex.Lock()
+	defer stagingMutex.Unlock()
+
+	logger.Notice("Found a commit waiting for confirmation until %v\n", pending.Deadline.Format(time.RFC3339))
+	startRollbackTimer(pending.Deadline)
+}
+
+// stopRollbackTimer stops the rollback timer without removing the pending
+// commit so it is resumed at the next startup
+func stopRollbackTimer() {
+	stagingMutex.Lock()
+	defer stagingMutex.Unlock()
+
+	if rollbackTimer != nil {
+		rollbackTimer.Stop()
+		rollbackTimer = nil
+	}
+}
+
+// startRollbackTimer starts the timer that rolls back the pending commit at
+// the deadline. The caller must hold the staging mutex.
+func startRollbackTimer(deadline time.Time) {
+	var timer *time.Timer
+
+	rollbackDeadline = deadline
+	timer = time.AfterFunc(time.Until(deadline), func() {
+		stagingMutex.Lock()
+		defer stagingMutex.Unlock()
+
+		// the commit was confirmed or rolled back while we waited for the mutex
+		if rollbackTimer != timer {
+			return
+		}
+
+		logger.Warn("The committed settings were not confirmed, rolling back\n")
+		_, err := rollbackPendingCommit()
+		if err != nil {
+			logger.Err("Failed to roll back the settings: %v\n", err)
+		}
+	})
+	rollbackTimer = timer
+}
+
+// rollbackPendingCommit restores the previous settings and clears the
+// pending commit. The caller must hold the staging mutex.
+func rollbackPendingCommit() (string, error) {
+	if rollbackTimer != nil {
+		rollbackTimer.Stop()
+		rollbackTimer = nil
+	}
+
+	jsonSettings, err := readSettingsFileJSON(rollbackFile)
+	if err != nil {
+		os.Remove(pendingFile)
+		return "", err
+	}
+
+	lock := lockSettings(true)
+	defer lock.unlock()
+
+	output, err := syncAndSave(jsonSettings, settingsFile)
+	if err != nil {
+		return output, err
+	}
+
+	os.Remove(pendingFile)
+	os.Remove(rollbackFile)
+
+	logger.Notice("Rolled back to the previous settings\n")
+	return output, nil
+}
+
+// writePendingCommit saves the deadline of a pending commit
+func writePendingCommit(deadline time.Time) {
+	raw, err := json.Marshal(pendingCommit{Deadline: deadline})
+	if err == nil {
+		err = ioutil.WriteFile(pendingFile, raw, 0600)
+	}
+	if err != nil {
+		logger.Warn("Failed to save the pending commit: %v\n", err)
+	}
+}
+
+// validateSettings runs the registered validators and a sync-settings dry run
+// on the settings. The caller must hold the staging mutex.
+func validateSettings(jsonSettings map[string]interface{}) *ValidationResult {
+	result := &ValidationResult{Errors: []string{}}
+
+	var owners []string
+	for owner := range validatorList {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	for _, owner := range owners {
+		for _, problem := range validatorList[owner](jsonSettings) {
+			result.Errors = append(result.Errors, owner+": "+problem)
+		}
+	}
+
+	output, err := simulateSyncSettings(jsonSettings)
+	result.Output = output
+	if err != nil {
+		result.Errors = append(result.Errors, "sync-settings: "+err.Error())
+	}
+
+	result.Valid = (len(result.Errors) == 0)
+	return result
+}
+
+// simulateSyncSettings runs sync-settings in simulate mode on the settings
+// so it can check them without changing the system
+func simulateSyncSettings(jsonSettings map[string]interface{}) (string, error) {
+	tmpfile, err := tempFile("", "staged.json.")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	revealed, err := copySettings(jsonSettings)
+	if err != nil {
+		return "", err
+	}
+	revealSecrets(revealed, nil, revealed)
+
+	_, err = writeSettingsFileJSON(revealed, tmpfile)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command("/usr/bin/sync-settings", "-o", "openwrt", "-s", "-f", tmpfile.Name())
+	outbytes, err := cmd.CombinedOutput()
+	output := strings.TrimSpace(string(outbytes))
+	if err != nil {
+		return output, fmt.Errorf("simulate failed: %v", err)
+	}
+
+	return output, nil
+}
+
+// writeSettingsFile writes the settings object to the specified filename
+func writeSettingsFile(jsonSettings map[string]interface{}, filename string) error {
+	jsonBytes, err := json.MarshalIndent(jsonSettings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, jsonBytes, 0600)
+}
+
+// validateInterfaces checks the interfaces have unique IDs and devices
+func validateInterfaces(jsonSettings map[string]interface{}) []string {
+	var problems []string
+
+	interfaces, err := getSettingsFromJSON(jsonSettings, []string{"network", "interfaces"})
+	if err != nil {
+		return problems
+	}
+
+	interfaceSlice, ok := interfaces.([]interface{})
+	if !ok {
+		return []string{"network interfaces must be a list"}
+	}
+
+	ids := make(map[float64]bool)
+	devices := make(map[string]bool)
+	for index, value := range interfaceSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("interface %d is not an object", index))
+			continue
+		}
+		if id, ok := item["interfaceId"].(float64); ok {
+			if ids[id] {
+				problems = append(problems, fmt.Sprintf("interface %d has duplicate interfaceId %v", index, id))
+			}
+			ids[id] = true
+		}
+		if device, ok := item["device"].(string); ok && device != "" {
+			if devices[device] {
+				problems = append(problems, fmt.Sprintf("interface %d has duplicate device %s", index, device))
+			}
+			devices[device] = true
+		}
+	}
+
+	return problems
+}
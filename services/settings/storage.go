@@ -0,0 +1,112 @@
+package settings
+
+import (
+	"os"
+	"sync"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// Some of the values in the settings are also managed by the platform, like
+// the network and wireless configuration in UCI on OpenWrt. A Storage keeps
+// part of the settings in another place so the two stay consistent. When the
+// settings are read the values from the storage replace the ones from the
+// file, and when the settings are saved the values are written back to the
+// storage. At startup the settings file is updated with any changes made
+// to the storage while packetd wasn't running.
+
+// Storage holds part of the settings outside of the settings file
+type Storage interface {
+	// Name returns the name of the storage for the logs
+	Name() string
+	// Load replaces the values in the settings with the ones in the storage
+	// and returns true if anything changed
+	Load(jsonSettings map[string]interface{}) (bool, error)
+	// Save writes the values from the settings to the storage
+	Save(jsonSettings map[string]interface{}) error
+}
+
+var storageList = []Storage{newUCIStorage()}
+var storageMutex sync.RWMutex
+
+// RegisterStorage adds a storage for part of the settings
+func RegisterStorage(storage Storage) {
+	storageMutex.Lock()
+	storageList = append(storageList, storage)
+	storageMutex.Unlock()
+}
+
+// loadStorage replaces the values in the settings with the ones from every
+// storage and returns true if anything changed
+func loadStorage(jsonSettings map[string]interface{}) bool {
+	var changed bool
+
+	storageMutex.RLock()
+	defer storageMutex.RUnlock()
+
+	for _, storage := range storageList {
+		result, err := storage.Load(jsonSettings)
+		if err != nil {
+			logger.Warn("%OC|Failed to load settings from %s: %v\n", "settings_storage_load_failure", 10, storage.Name(), err)
+			continue
+		}
+		changed = changed || result
+	}
+
+	return changed
+}
+
+// saveStorage writes the values from the settings to every storage
+func saveStorage(jsonSettings map[string]interface{}) {
+	storageMutex.RLock()
+	defer storageMutex.RUnlock()
+
+	for _, storage := range storageList {
+		err := storage.Save(jsonSettings)
+		if err != nil {
+			logger.Warn("Failed to save settings to %s: %v\n", storage.Name(), err)
+		}
+	}
+}
+
+// syncStorage updates the saved and current settings files with the values
+// that were changed in the storage since they were written
+func syncStorage() {
+	lock := lockSettings(true)
+	defer lock.unlock()
+
+	for _, filename := range []string{settingsFile, currentFile} {
+		if _, err := os.Stat(filename); err != nil {
+			continue
+		}
+
+		jsonSettings, err := readSettingsFileRaw(filename)
+		if err != nil {
+			logger.Warn("Failed to read %s: %v\n", filename, err)
+			continue
+		}
+
+		if !loadStorage(jsonSettings) {
+			continue
+		}
+
+		// the values from the storage are in clear text
+		err = protectSecrets(jsonSettings, nil)
+		if err != nil {
+			logger.Warn("Failed to protect the secrets in %s: %v\n", filename, err)
+			continue
+		}
+
+		err = writeSettingsFile(jsonSettings, filename)
+		if err != nil {
+			logger.Warn("Failed to update %s: %v\n", filename, err)
+			continue
+		}
+		logger.Info("Updated %s with the values from the settings storage\n", filename)
+	}
+}
+
+// isStorageFile returns true if the values from the storage apply to the file
+func isStorageFile(filename string) bool {
+	return filename == settingsFile || filename == currentFile
+}
@@ -0,0 +1,209 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A settings template is a settings value where strings can reference
+// variables as ${name}. A string that is only a reference is replaced by the
+// variable value, which keeps numbers, booleans, and objects intact, and a
+// reference inside a longer string is replaced by the text of the value.
+// Object keys can use references too, and $${ is a literal ${. The same
+// template can be pushed to many sites with only the variables changing.
+
+// templatePattern matches an escaped ${ or a variable reference
+var templatePattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+
+// TemplateResult holds the rendered settings and the result of validating them
+type TemplateResult struct {
+	Rendered   interface{}       `json:"rendered"`
+	Validation *ValidationResult `json:"validation,omitempty"`
+	Applied    bool              `json:"applied"`
+	Unused     []string          `json:"unused,omitempty"`
+}
+
+var templateMutex sync.Mutex
+
+// RenderTemplate returns the template with the variable references replaced
+// by the values in the variable map. Every missing variable is listed in the
+// error. The returned list has the variables the template doesn't use.
+func RenderTemplate(template interface{}, variables map[string]interface{}) (interface{}, []string, error) {
+	used := make(map[string]bool)
+	missing := make(map[string]bool)
+
+	rendered, err := renderValue(template, variables, used, missing)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(missing) != 0 {
+		var list []string
+		for name := range missing {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		return nil, nil, fmt.Errorf("Missing template variables: %s", strings.Join(list, ", "))
+	}
+
+	var unused []string
+	for name := range variables {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+
+	return rendered, unused, nil
+}
+
+// ApplyTemplate renders a template, stages the result at the argumented path,
+// and validates the staged settings. Unless this is a dry run the settings are
+// then committed with the argumented confirm seconds like CommitStagedSettings.
+// The staged settings are discarded if they are not committed, so this fails
+// if other changes are already staged.
+func ApplyTemplate(segments []string, template interface{}, variables map[string]interface{}, confirmSeconds int, dryRun bool) (*TemplateResult, error) {
+	templateMutex.Lock()
+	defer templateMutex.Unlock()
+
+	rendered, unused, err := RenderTemplate(template, variables)
+	if err != nil {
+		return nil, err
+	}
+	result := &TemplateResult{Rendered: rendered, Unused: unused}
+
+	if _, err := os.Stat(stagedFile); err == nil {
+		return result, errors.New("Other settings changes are already staged")
+	}
+
+	_, err = StageSettings(segments, rendered)
+	if err != nil {
+		DiscardStagedSettings()
+		return result, err
+	}
+
+	if dryRun {
+		result.Validation, err = ValidateStagedSettings()
+		DiscardStagedSettings()
+		return result, err
+	}
+
+	result.Validation, err = CommitStagedSettings(confirmSeconds)
+	if err != nil {
+		DiscardStagedSettings()
+		return result, err
+	}
+
+	result.Applied = true
+	return result, nil
+}
+
+// renderValue returns a copy of a template value with the references replaced
+func renderValue(value interface{}, variables map[string]interface{}, used map[string]bool, missing map[string]bool) (interface{}, error) {
+	switch item := value.(type) {
+	case string:
+		return renderString(item, variables, used, missing)
+	case []interface{}:
+		list := make([]interface{}, len(item))
+		for index, entry := range item {
+			rendered, err := renderValue(entry, variables, used, missing)
+			if err != nil {
+				return nil, err
+			}
+			list[index] = rendered
+		}
+		return list, nil
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(item))
+		for key, entry := range item {
+			renderedKey, err := renderString(key, variables, used, missing)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := renderedKey.(string)
+			if !ok {
+				name = formatTemplateValue(renderedKey)
+			}
+			if _, found := object[name]; found {
+				return nil, fmt.Errorf("Template key %s is duplicated after rendering", name)
+			}
+			rendered, err := renderValue(entry, variables, used, missing)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = rendered
+		}
+		return object, nil
+	}
+	return value, nil
+}
+
+// renderString replaces the references in a string. A string that is only a
+// reference returns the variable value as it is.
+func renderString(text string, variables map[string]interface{}, used map[string]bool, missing map[string]bool) (interface{}, error) {
+	matches := templatePattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, nil
+	}
+
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(text) && matches[0][2] >= 0 {
+		name := text[matches[0][2]:matches[0][3]]
+		value, found := variables[name]
+		if !found {
+			missing[name] = true
+			return nil, nil
+		}
+		used[name] = true
+		return value, nil
+	}
+
+	var buffer strings.Builder
+	last := 0
+	for _, match := range matches {
+		buffer.WriteString(text[last:match[0]])
+		last = match[1]
+
+		if match[2] < 0 {
+			buffer.WriteString("${")
+			continue
+		}
+
+		name := text[match[2]:match[3]]
+		value, found := variables[name]
+		if !found {
+			missing[name] = true
+			continue
+		}
+		used[name] = true
+
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("Template variable %s is not a simple value and can't be used inside a string", name)
+		}
+		buffer.WriteString(formatTemplateValue(value))
+	}
+	buffer.WriteString(text[last:])
+
+	return buffer.String(), nil
+}
+
+// formatTemplateValue returns the text of a simple variable value
+func formatTemplateValue(value interface{}) string {
+	switch item := value.(type) {
+	case string:
+		return item
+	case nil:
+		return ""
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(raw)
+}
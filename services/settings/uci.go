@@ -0,0 +1,379 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The UCI storage keeps the settings in sync with selected UCI options. The
+// options are listed in the settings:
+//
+//	"storage": {"uci": [
+//		{"path": "system/hostName", "config": "system", "section": "@system[0]", "option": "hostname"},
+//		{"path": "wireless/ssid", "config": "wireless", "section": "default_radio0", "option": "ssid"}
+//	]}
+//
+// The values from UCI are converted to the type of the current value in the
+// settings, and a UCI list becomes a list of strings.
+
+// the UCI command and the directory of the UCI config files
+var uciCommand = "/sbin/uci"
+var uciDirectory = "/etc/config"
+
+// uciMapping connects a settings path to a UCI option
+type uciMapping struct {
+	path    []string
+	config  string
+	section string
+	option  string
+}
+
+// uciValue is the value of a UCI option
+type uciValue struct {
+	found  bool
+	list   bool
+	values []string
+}
+
+// uciStorage is the Storage for the UCI options. The option values are cached
+// until the UCI config file changes since the settings are read very often.
+type uciStorage struct {
+	mutex    sync.Mutex
+	cache    map[string]uciValue
+	modified map[string]time.Time
+}
+
+// newUCIStorage returns the UCI storage
+func newUCIStorage() *uciStorage {
+	return &uciStorage{cache: make(map[string]uciValue), modified: make(map[string]time.Time)}
+}
+
+// Name returns the name of the storage
+func (storage *uciStorage) Name() string {
+	return "uci"
+}
+
+// Load replaces the values in the settings with the UCI options
+func (storage *uciStorage) Load(jsonSettings map[string]interface{}) (bool, error) {
+	mappings, err := getUCIMappings(jsonSettings)
+	if len(mappings) == 0 {
+		return false, err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	var changed bool
+	for _, mapping := range mappings {
+		value, err := storage.getValue(mapping)
+		if err != nil {
+			return changed, err
+		}
+		if !value.found {
+			continue
+		}
+
+		current, _ := getSettingsFromJSON(jsonSettings, mapping.path)
+		fresh, err := value.convert(current)
+		if err != nil {
+			return changed, fmt.Errorf("%s: %v", mapping, err)
+		}
+		if reflect.DeepEqual(current, fresh) {
+			continue
+		}
+
+		_, err = setSettingsInJSON(jsonSettings, mapping.path, fresh)
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+
+	return changed, err
+}
+
+// Save writes the values in the settings to the UCI options that are different
+func (storage *uciStorage) Save(jsonSettings map[string]interface{}) error {
+	mappings, err := getUCIMappings(jsonSettings)
+	if len(mappings) == 0 {
+		return err
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	configs := make(map[string]bool)
+	for _, mapping := range mappings {
+		current, err := getSettingsFromJSON(jsonSettings, mapping.path)
+		if err != nil || current == nil {
+			continue
+		}
+
+		fresh, err := newUCIValue(current)
+		if err != nil {
+			return fmt.Errorf("%s: %v", mapping, err)
+		}
+
+		value, err := storage.getValue(mapping)
+		if err != nil {
+			return err
+		}
+		if value.found && value.equal(fresh) {
+			continue
+		}
+
+		err = storage.setValue(mapping, fresh)
+		if err != nil {
+			return err
+		}
+		configs[mapping.config] = true
+	}
+
+	for config := range configs {
+		_, err := runUCI("commit", config)
+		delete(storage.modified, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getValue returns the value of a UCI option. The caller must hold the storage mutex.
+func (storage *uciStorage) getValue(mapping uciMapping) (uciValue, error) {
+	info, err := os.Stat(filepath.Join(uciDirectory, mapping.config))
+	if err != nil {
+		// options in a missing config file are missing too
+		return uciValue{}, nil
+	}
+
+	// forget the cached options when the file has changed
+	if !info.ModTime().Equal(storage.modified[mapping.config]) {
+		for key := range storage.cache {
+			if strings.HasPrefix(key, mapping.config+".") {
+				delete(storage.cache, key)
+			}
+		}
+		storage.modified[mapping.config] = info.ModTime()
+	}
+
+	key := mapping.String()
+	if value, found := storage.cache[key]; found {
+		return value, nil
+	}
+
+	output, err := runUCI("-q", "show", key)
+	var value uciValue
+	if err == nil {
+		value, err = parseUCIShow(output)
+		if err != nil {
+			return value, fmt.Errorf("%s: %v", key, err)
+		}
+	} else if _, ok := err.(*exec.ExitError); !ok {
+		return value, err
+	}
+
+	storage.cache[key] = value
+	return value, nil
+}
+
+// setValue changes a UCI option. The caller must hold the storage mutex.
+func (storage *uciStorage) setValue(mapping uciMapping, value uciValue) error {
+	key := mapping.String()
+	delete(storage.cache, key)
+
+	if !value.list {
+		_, err := runUCI("set", key+"="+value.values[0])
+		return err
+	}
+
+	runUCI("-q", "delete", key)
+	for _, item := range value.values {
+		_, err := runUCI("add_list", key+"="+item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns the UCI name of the option
+func (mapping uciMapping) String() string {
+	return mapping.config + "." + mapping.section + "." + mapping.option
+}
+
+// equal returns true if the values are the same. A list with a single
+// value can't be told apart from an option in the output of uci show.
+func (value uciValue) equal(other uciValue) bool {
+	if value.list != other.list && (len(value.values) != 1 || len(other.values) != 1) {
+		return false
+	}
+	return reflect.DeepEqual(value.values, other.values)
+}
+
+// convert returns the UCI value as the type of the current settings value
+func (value uciValue) convert(current interface{}) (interface{}, error) {
+	if _, ok := current.([]interface{}); ok || value.list {
+		list := make([]interface{}, 0, len(value.values))
+		for _, item := range value.values {
+			list = append(list, item)
+		}
+		return list, nil
+	}
+
+	text := value.values[0]
+	switch current.(type) {
+	case bool:
+		switch text {
+		case "1", "true", "yes", "on", "enabled":
+			return true, nil
+		case "0", "false", "no", "off", "disabled":
+			return false, nil
+		}
+		return nil, fmt.Errorf("invalid boolean: %s", text)
+	case float64:
+		number, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", text)
+		}
+		return number, nil
+	}
+	return text, nil
+}
+
+// newUCIValue returns the UCI value for a settings value
+func newUCIValue(current interface{}) (uciValue, error) {
+	value := uciValue{found: true}
+
+	switch current.(type) {
+	case string:
+		value.values = []string{current.(string)}
+	case bool:
+		if current.(bool) {
+			value.values = []string{"1"}
+		} else {
+			value.values = []string{"0"}
+		}
+	case float64:
+		value.values = []string{strconv.FormatFloat(current.(float64), 'f', -1, 64)}
+	case []interface{}:
+		value.list = true
+		for _, item := range current.([]interface{}) {
+			text, ok := item.(string)
+			if !ok {
+				return value, fmt.Errorf("invalid list item: %v", item)
+			}
+			value.values = append(value.values, text)
+		}
+	default:
+		return value, fmt.Errorf("unsupported type: %T", current)
+	}
+
+	return value, nil
+}
+
+// getUCIMappings returns the UCI options listed in the settings
+func getUCIMappings(jsonSettings map[string]interface{}) ([]uciMapping, error) {
+	object, err := getSettingsFromJSON(jsonSettings, []string{"storage", "uci"})
+	if err != nil || object == nil {
+		return nil, nil
+	}
+
+	list, ok := object.([]interface{})
+	if !ok {
+		return nil, errors.New("the uci storage must be a list")
+	}
+
+	var mappings []uciMapping
+	for index, value := range list {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			return mappings, fmt.Errorf("uci storage %d is not an object", index)
+		}
+
+		var mapping uciMapping
+		mapping.config, _ = item["config"].(string)
+		mapping.section, _ = item["section"].(string)
+		mapping.option, _ = item["option"].(string)
+		switch path := item["path"].(type) {
+		case string:
+			mapping.path = strings.Split(strings.Trim(path, "/"), "/")
+		case []interface{}:
+			for _, segment := range path {
+				if text, ok := segment.(string); ok {
+					mapping.path = append(mapping.path, text)
+				}
+			}
+		}
+
+		if len(mapping.path) == 0 || mapping.path[0] == "" || mapping.config == "" || mapping.section == "" || mapping.option == "" {
+			return mappings, fmt.Errorf("uci storage %d is incomplete", index)
+		}
+		if strings.ContainsAny(mapping.String(), " '=") {
+			return mappings, fmt.Errorf("uci storage %d has an invalid name", index)
+		}
+		mappings = append(mappings, mapping)
+	}
+
+	return mappings, nil
+}
+
+// parseUCIShow returns the value from the output of uci show for an option,
+// which is a single quoted value for an option and several for a list
+func parseUCIShow(output string) (uciValue, error) {
+	value := uciValue{found: true}
+
+	line := strings.TrimRight(output, "\n")
+	position := strings.Index(line, "=")
+	if position < 0 {
+		return value, fmt.Errorf("invalid output: %s", line)
+	}
+	text := line[position+1:]
+
+	// quotes in a value are written as '\''
+	for text != "" {
+		if text[0] != '\'' {
+			return value, fmt.Errorf("invalid value: %s", line)
+		}
+		var item strings.Builder
+		text = text[1:]
+		for {
+			end := strings.Index(text, "'")
+			if end < 0 {
+				return value, fmt.Errorf("unterminated value: %s", line)
+			}
+			item.WriteString(text[:end])
+			text = text[end+1:]
+			if !strings.HasPrefix(text, "\\''") {
+				break
+			}
+			item.WriteString("'")
+			text = text[3:]
+		}
+		value.values = append(value.values, item.String())
+		text = strings.TrimPrefix(text, " ")
+	}
+
+	if len(value.values) == 0 {
+		return value, fmt.Errorf("missing value: %s", line)
+	}
+
+	// uci show quotes a list as several values
+	value.list = len(value.values) > 1
+	return value, nil
+}
+
+// runUCI runs the UCI command with the argumented arguments
+func runUCI(arguments ...string) (string, error) {
+	output, err := exec.Command(uciCommand, arguments...).Output()
+	return string(output), err
+}
@@ -0,0 +1,122 @@
+package supervisor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the prefix and suffix of the crash file names
+const crashPrefix = "crash-"
+const crashSuffix = ".txt"
+
+// the limit on the size of the goroutine stacks we write to a crash file
+const maxStackBytes = 16 << 20
+
+// CrashFile holds the details of a crash file
+type CrashFile struct {
+	Name string    `json:"name"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+// writeCrashFile writes the stalled heartbeats and the stacks of every
+// goroutine to a new crash file, removes the oldest crash files over the
+// limit, and returns the name of the file
+func writeCrashFile(current supervisorConfig, stalled []string) (string, error) {
+	now := time.Now()
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "packetd crash report\n")
+	fmt.Fprintf(&buffer, "time: %s\n", now.Format(time.RFC3339))
+	fmt.Fprintf(&buffer, "pid: %d\n", os.Getpid())
+	fmt.Fprintf(&buffer, "goroutines: %d\n", runtime.NumGoroutine())
+
+	heartbeatLocker.Lock()
+	for _, name := range stalled {
+		if item := heartbeatTable[name]; item != nil {
+			fmt.Fprintf(&buffer, "stalled: %s last beat %s timeout %v\n", name, item.lastBeat.Format(time.RFC3339), item.timeout)
+		}
+	}
+	heartbeatLocker.Unlock()
+
+	buffer.WriteString("\n")
+	buffer.Write(getStacks())
+
+	err := os.MkdirAll(current.crashDirectory, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(current.crashDirectory, crashPrefix+now.Format("20060102-150405.000")+crashSuffix)
+	err = ioutil.WriteFile(filename, buffer.Bytes(), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	list := GetCrashFiles()
+	for index := current.maxCrashFiles; index < len(list); index++ {
+		os.Remove(filepath.Join(current.crashDirectory, list[index].Name))
+	}
+
+	return filename, nil
+}
+
+// getStacks returns the stacks of every goroutine, growing the buffer until
+// they fit or the limit is reached
+func getStacks() []byte {
+	size := 1 << 20
+	for {
+		buffer := make([]byte, size)
+		length := runtime.Stack(buffer, true)
+		if length < size || size >= maxStackBytes {
+			return buffer[:length]
+		}
+		size *= 2
+	}
+}
+
+// GetCrashFiles returns the crash files ordered by the most recent first
+func GetCrashFiles() []CrashFile {
+	list := []CrashFile{}
+
+	heartbeatLocker.Lock()
+	directory := config.crashDirectory
+	heartbeatLocker.Unlock()
+
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return list
+	}
+
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), crashPrefix) || !strings.HasSuffix(info.Name(), crashSuffix) {
+			continue
+		}
+		list = append(list, CrashFile{Name: info.Name(), Size: info.Size(), Time: info.ModTime()})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.After(list[j].Time)
+	})
+	return list
+}
+
+// ReadCrashFile returns the contents of the named crash file
+func ReadCrashFile(name string) ([]byte, error) {
+	if name != filepath.Base(name) || !strings.HasPrefix(name, crashPrefix) || !strings.HasSuffix(name, crashSuffix) {
+		return nil, fmt.Errorf("invalid crash file name: %s", name)
+	}
+
+	heartbeatLocker.Lock()
+	directory := config.crashDirectory
+	heartbeatLocker.Unlock()
+
+	return ioutil.ReadFile(filepath.Join(directory, name))
+}
@@ -0,0 +1,267 @@
+// Package supervisor watches the heartbeats of the core goroutines so a
+// deadlocked packetd is noticed and restarted instead of silently holding
+// traffic in the queues. The dispatch cleaner, the nfqueue packet handling and
+// the reports writer register a heartbeat with a timeout and beat while they
+// are running. When a heartbeat is overdue the stacks of every goroutine are
+// written to a crash file, and if restarts are enabled in the settings the
+// shutdown flag is set and packetd exits with an error so the init system
+// starts a new one.
+// The crash files are included in the support bundle.
+package supervisor
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the supervisor settings are missing
+const defaultIntervalSeconds = 5
+const defaultCrashDirectory = "/tmp/packetd-crash"
+const defaultMaxCrashFiles = 5
+
+// the time we give the normal shutdown before exiting without it, since the
+// stalled goroutine may be holding a lock the shutdown also needs
+const restartTimeout = 60 * time.Second
+
+// HeartbeatStatus holds a registered heartbeat and the time of the last beat
+type HeartbeatStatus struct {
+	Name           string    `json:"name"`
+	TimeoutSeconds int       `json:"timeoutSeconds"`
+	LastBeat       time.Time `json:"lastBeat"`
+	Stalled        bool      `json:"stalled"`
+}
+
+// Status holds the supervisor settings, the heartbeats, and the crash files
+type Status struct {
+	Enabled          bool              `json:"enabled"`
+	Restart          bool              `json:"restart"`
+	CrashDirectory   string            `json:"crashDirectory"`
+	RestartRequested bool              `json:"restartRequested"`
+	Heartbeats       []HeartbeatStatus `json:"heartbeats"`
+	Crashes          []CrashFile       `json:"crashes"`
+}
+
+// supervisorConfig holds the supervisor settings
+type supervisorConfig struct {
+	enabled        bool
+	restart        bool
+	interval       time.Duration
+	crashDirectory string
+	maxCrashFiles  int
+}
+
+// heartbeat holds the timeout and the last beat of a registered goroutine
+type heartbeat struct {
+	timeout  time.Duration
+	lastBeat time.Time
+	stalled  bool
+}
+
+var heartbeatTable = make(map[string]*heartbeat)
+var heartbeatLocker sync.Mutex
+var config = supervisorConfig{enabled: true, restart: false, interval: defaultIntervalSeconds * time.Second, crashDirectory: defaultCrashDirectory, maxCrashFiles: defaultMaxCrashFiles}
+var restartRequested bool
+var reloadChannel = make(chan bool, 1)
+var shutdownChannel = make(chan bool)
+var watchWaiter sync.WaitGroup
+
+// Startup is called to handle service startup
+func Startup() {
+	loadSettings()
+	watchWaiter.Add(1)
+	go watchTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	close(shutdownChannel)
+	watchWaiter.Wait()
+}
+
+// Reload loads the supervisor settings
+func Reload() {
+	loadSettings()
+	select {
+	case reloadChannel <- true:
+	default:
+	}
+}
+
+// Register adds a heartbeat for the named goroutine, which must call Beat
+// more often than the timeout. The heartbeat starts out fresh so the
+// goroutine has a full timeout before the first beat is due.
+func Register(name string, timeout time.Duration) {
+	heartbeatLocker.Lock()
+	heartbeatTable[name] = &heartbeat{timeout: timeout, lastBeat: time.Now()}
+	heartbeatLocker.Unlock()
+
+	logger.Info("Registered heartbeat %s timeout:%v\n", name, timeout)
+}
+
+// Unregister removes the heartbeat for the named goroutine
+func Unregister(name string) {
+	heartbeatLocker.Lock()
+	delete(heartbeatTable, name)
+	heartbeatLocker.Unlock()
+}
+
+// Beat records a heartbeat for the named goroutine
+func Beat(name string) {
+	heartbeatLocker.Lock()
+	if item := heartbeatTable[name]; item != nil {
+		item.lastBeat = time.Now()
+		if item.stalled {
+			logger.Notice("Heartbeat %s has recovered\n", name)
+			item.stalled = false
+		}
+	}
+	heartbeatLocker.Unlock()
+}
+
+// IsRestartRequested returns true if a stalled heartbeat started the shutdown
+// so packetd should exit with an error and be started again
+func IsRestartRequested() bool {
+	heartbeatLocker.Lock()
+	defer heartbeatLocker.Unlock()
+	return restartRequested
+}
+
+// GetStatus returns the supervisor settings, the heartbeats, and the crash files
+func GetStatus() Status {
+	heartbeatLocker.Lock()
+	current := config
+	status := Status{Enabled: current.enabled, Restart: current.restart, CrashDirectory: current.crashDirectory, RestartRequested: restartRequested, Heartbeats: []HeartbeatStatus{}}
+	for name, item := range heartbeatTable {
+		status.Heartbeats = append(status.Heartbeats, HeartbeatStatus{Name: name, TimeoutSeconds: int(item.timeout / time.Second), LastBeat: item.lastBeat, Stalled: item.stalled})
+	}
+	heartbeatLocker.Unlock()
+
+	sort.Slice(status.Heartbeats, func(i, j int) bool {
+		return status.Heartbeats[i].Name < status.Heartbeats[j].Name
+	})
+
+	status.Crashes = GetCrashFiles()
+	return status
+}
+
+// loadSettings loads the supervisor settings
+func loadSettings() {
+	fresh := supervisorConfig{enabled: true, restart: false, interval: defaultIntervalSeconds * time.Second, crashDirectory: defaultCrashDirectory, maxCrashFiles: defaultMaxCrashFiles}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"supervisor"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if !ok {
+			logger.Warn("Invalid supervisor settings: %T\n", configJSON)
+		} else {
+			if value, ok := item["enabled"].(bool); ok {
+				fresh.enabled = value
+			}
+			if value, ok := item["restart"].(bool); ok {
+				fresh.restart = value
+			}
+			if value, ok := item["intervalSeconds"].(float64); ok && value > 0 {
+				fresh.interval = time.Duration(value) * time.Second
+			}
+			if value, ok := item["crashDirectory"].(string); ok && value != "" {
+				fresh.crashDirectory = value
+			}
+			if value, ok := item["maxCrashFiles"].(float64); ok && value > 0 {
+				fresh.maxCrashFiles = int(value)
+			}
+		}
+	}
+
+	heartbeatLocker.Lock()
+	config = fresh
+	heartbeatLocker.Unlock()
+
+	logger.Info("Loaded supervisor settings enabled:%v restart:%v interval:%v crashDirectory:%s\n", fresh.enabled, fresh.restart, fresh.interval, fresh.crashDirectory)
+}
+
+// watchTask checks the heartbeats at the configured interval
+func watchTask() {
+	defer watchWaiter.Done()
+
+	for {
+		heartbeatLocker.Lock()
+		interval := config.interval
+		heartbeatLocker.Unlock()
+
+		select {
+		case <-shutdownChannel:
+			return
+		case <-reloadChannel:
+		case <-time.After(interval):
+			checkHeartbeats()
+		}
+	}
+}
+
+// checkHeartbeats looks for heartbeats that are overdue. A stalled heartbeat
+// is reported once with a crash file until it beats again, and the first one
+// to stall starts the restart when restarts are enabled.
+func checkHeartbeats() {
+	// nothing is beating once the services are stopping
+	if kernel.GetShutdownFlag() {
+		return
+	}
+
+	var stalled []string
+	now := time.Now()
+
+	heartbeatLocker.Lock()
+	current := config
+	if !current.enabled {
+		heartbeatLocker.Unlock()
+		return
+	}
+	for name, item := range heartbeatTable {
+		if item.stalled || now.Sub(item.lastBeat) <= item.timeout {
+			continue
+		}
+		item.stalled = true
+		logger.Crit("Heartbeat %s has stalled for %v\n", name, now.Sub(item.lastBeat).Truncate(time.Second))
+		stalled = append(stalled, name)
+	}
+	restart := current.restart && len(stalled) != 0 && !restartRequested
+	if restart {
+		restartRequested = true
+	}
+	heartbeatLocker.Unlock()
+
+	if len(stalled) == 0 {
+		return
+	}
+
+	sort.Strings(stalled)
+	filename, err := writeCrashFile(current, stalled)
+	if err != nil {
+		logger.Err("Unable to write the crash file: %v\n", err)
+	} else {
+		logger.Crit("Wrote the goroutine stacks to %s\n", filename)
+	}
+
+	if restart {
+		startRestart()
+	}
+}
+
+// startRestart sets the shutdown flag so packetd removes the netfilter rules
+// and stops the services before it exits. If the shutdown doesn't finish in
+// time we exit anyway since the init system will start a new process.
+func startRestart() {
+	logger.Crit("Restarting packetd after a stalled heartbeat\n")
+	kernel.SetShutdownFlag()
+
+	time.AfterFunc(restartTimeout, func() {
+		logger.Crit("Shutdown did not finish in %v - exiting now\n", restartTimeout)
+		os.Exit(1)
+	})
+}
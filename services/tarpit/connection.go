@@ -0,0 +1,200 @@
+package tarpit
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/untangle/packetd/services/reports"
+)
+
+// the number of bytes from the remote end we keep for the log
+const maxCaptureBytes = 512
+
+// how long a single write can take before we give up on the connection
+const writeTimeout = 10 * time.Second
+
+// init registers the recon events table with the reports schema registry
+func init() {
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "recon_events",
+		Owner: "tarpit",
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "client_address", Type: "text"},
+			{Name: "client_port", Type: "int4"},
+			{Name: "server_address", Type: "text"},
+			{Name: "server_port", Type: "int4"},
+			{Name: "event", Type: "text"},
+			{Name: "duration_ms", Type: "int8"},
+			{Name: "bytes_received", Type: "int8"},
+			{Name: "data", Type: "text"},
+		},
+		TrimPercent: .1,
+	})
+}
+
+// tarpitConnection is a connection held in the tarpit
+type tarpitConnection struct {
+	socket   net.Conn
+	remote   *net.TCPAddr
+	local    *net.TCPAddr
+	banner   string
+	started  time.Time
+	done     chan bool
+	doneOnce sync.Once
+	locker   sync.Mutex
+	received int
+	capture  []byte
+}
+
+// newConnection returns a tarpit connection for an accepted socket
+func newConnection(socket net.Conn, remote *net.TCPAddr, local *net.TCPAddr, banner string) *tarpitConnection {
+	return &tarpitConnection{
+		socket:  socket,
+		remote:  remote,
+		local:   local,
+		banner:  banner,
+		started: time.Now(),
+		done:    make(chan bool),
+	}
+}
+
+// run sends the banner one byte at a time and then a random byte at the
+// keepalive interval until the remote end gives up, the maximum duration
+// passes, or the connection is closed. Everything the remote end sends is
+// counted and the start of it is kept for the log.
+func (conn *tarpitConnection) run(current tarpitConfig) {
+	go conn.readTask()
+
+	limit := time.NewTimer(current.maxDuration)
+	defer limit.Stop()
+
+	data := []byte(conn.banner)
+	delay := current.byteDelay
+
+	for {
+		if len(data) == 0 {
+			data = []byte{byte('a' + rand.Intn(26))}
+			delay = current.keepalive
+		}
+
+		select {
+		case <-conn.done:
+			conn.finish()
+			return
+		case <-limit.C:
+			conn.close()
+			conn.finish()
+			return
+		case <-time.After(delay):
+		}
+
+		conn.socket.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err := conn.socket.Write(data[:1]); err != nil {
+			conn.close()
+			conn.finish()
+			return
+		}
+		data = data[1:]
+	}
+}
+
+// readTask reads what the remote end sends until the connection is closed
+func (conn *tarpitConnection) readTask() {
+	buffer := make([]byte, 4096)
+	for {
+		count, err := conn.socket.Read(buffer)
+		if count > 0 {
+			conn.locker.Lock()
+			conn.received += count
+			if room := maxCaptureBytes - len(conn.capture); room > 0 {
+				if count < room {
+					room = count
+				}
+				conn.capture = append(conn.capture, buffer[:room]...)
+			}
+			conn.locker.Unlock()
+		}
+		if err != nil {
+			conn.close()
+			return
+		}
+	}
+}
+
+// close closes the socket and tells the handler the connection is over
+func (conn *tarpitConnection) close() {
+	conn.doneOnce.Do(func() {
+		conn.socket.Close()
+		close(conn.done)
+	})
+}
+
+// finish logs what the remote end sent when the connection is over
+func (conn *tarpitConnection) finish() {
+	conn.locker.Lock()
+	received := conn.received
+	capture := conn.capture
+	conn.locker.Unlock()
+
+	logEvent(conn.remote, conn.local, "close", time.Since(conn.started), received, capture)
+}
+
+// getStatus returns the details of the connection
+func (conn *tarpitConnection) getStatus() ConnectionStatus {
+	conn.locker.Lock()
+	defer conn.locker.Unlock()
+
+	return ConnectionStatus{
+		ClientAddress: conn.remote.IP.String(),
+		ClientPort:    conn.remote.Port,
+		ServerPort:    conn.local.Port,
+		Started:       conn.started,
+		BytesReceived: conn.received,
+	}
+}
+
+// logEvent logs a tarpit connection to the recon_events table. The close
+// event has the time the connection was held and what the remote end sent.
+func logEvent(remote *net.TCPAddr, local *net.TCPAddr, event string, duration time.Duration, received int, capture []byte) {
+	columns := map[string]interface{}{
+		"time_stamp":     time.Now(),
+		"client_address": remote.IP,
+		"client_port":    remote.Port,
+		"server_address": local.IP,
+		"server_port":    local.Port,
+		"event":          event,
+		"duration_ms":    int64(duration / time.Millisecond),
+		"bytes_received": received,
+		"data":           printable(capture),
+	}
+
+	reports.LogEvent(reports.CreateEvent("tarpit_"+event, "recon_events", 1, columns, nil))
+}
+
+// printable returns the captured data with the characters that can't be
+// printed replaced by escapes so it can be stored and displayed as text
+func printable(data []byte) string {
+	var builder strings.Builder
+	for _, value := range data {
+		switch {
+		case value == '\r':
+			builder.WriteString(`\r`)
+		case value == '\n':
+			builder.WriteString(`\n`)
+		case value == '\\':
+			builder.WriteString(`\\`)
+		case value < 128 && unicode.IsPrint(rune(value)):
+			builder.WriteByte(value)
+		default:
+			builder.WriteString(`\x`)
+			builder.WriteByte("0123456789abcdef"[value>>4])
+			builder.WriteByte("0123456789abcdef"[value&15])
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,392 @@
+// Package tarpit accepts the connections to unused ports on the WAN and holds
+// them open as long as possible. Each connection gets a fake banner sent one
+// byte at a time and then a byte every few seconds, which slows down the
+// scanners and the bots that find it, and everything the remote end sends is
+// logged as a reconnaissance event. Nobody has a reason to connect to these
+// ports, so any connection is an early warning of someone looking for a way
+// in. The ports must be allowed by the firewall on the WAN and connections
+// to the addresses of the other interfaces are closed right away.
+package tarpit
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/eventbus"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/settings"
+	"github.com/untangle/packetd/services/zones"
+)
+
+// the defaults used when the tarpit settings are missing
+const (
+	defaultByteDelay      = 1000 * time.Millisecond
+	defaultKeepalive      = 10 * time.Second
+	defaultMaxDuration    = 600 * time.Second
+	defaultMaxConnections = 64
+	defaultZone           = zones.ZoneWAN
+)
+
+// how long we keep the addresses of the zone interfaces before looking them up again
+const addressCacheTime = 60 * time.Second
+
+// how often the same client address raises an alert
+const alertInterval = time.Hour
+
+// the banners used for the well known ports when the settings don't have one
+var defaultBanners = map[int]string{
+	21:   "220 FTP server ready\r\n",
+	22:   "SSH-2.0-OpenSSH_7.4\r\n",
+	23:   "\r\nlogin: ",
+	25:   "220 mail.localdomain ESMTP Postfix\r\n",
+	110:  "+OK POP3 server ready\r\n",
+	143:  "* OK IMAP4rev1 Service Ready\r\n",
+	3306: "5.7.33-log\x00",
+}
+
+// tarpitConfig holds the tarpit settings
+type tarpitConfig struct {
+	enabled        bool
+	zone           string
+	ports          map[int]string
+	byteDelay      time.Duration
+	keepalive      time.Duration
+	maxDuration    time.Duration
+	maxConnections int
+}
+
+// ConnectionStatus holds the details of a connection held in the tarpit
+type ConnectionStatus struct {
+	ClientAddress string    `json:"clientAddress"`
+	ClientPort    int       `json:"clientPort"`
+	ServerPort    int       `json:"serverPort"`
+	Started       time.Time `json:"started"`
+	BytesReceived int       `json:"bytesReceived"`
+}
+
+// Status holds the tarpit ports, counters, and current connections
+type Status struct {
+	Enabled     bool               `json:"enabled"`
+	Zone        string             `json:"zone"`
+	Ports       []int              `json:"ports"`
+	Accepted    uint64             `json:"accepted"`
+	Rejected    uint64             `json:"rejected"`
+	Connections []ConnectionStatus `json:"connections"`
+	Errors      map[int]string     `json:"errors,omitempty"`
+}
+
+var config = tarpitConfig{zone: defaultZone, ports: make(map[int]string)}
+var listenerTable = make(map[int]net.Listener)
+var listenerErrors = make(map[int]string)
+var connectionTable = make(map[*tarpitConnection]bool)
+var alertTable = make(map[string]time.Time)
+var acceptedCount uint64
+var rejectedCount uint64
+var tarpitLocker sync.Mutex
+var tarpitWaiter sync.WaitGroup
+
+var zoneAddresses map[string]bool
+var zoneAddressTime time.Time
+var zoneAddressLocker sync.Mutex
+
+// Startup is called to handle service startup
+func Startup() {
+	Reload()
+}
+
+// Shutdown is called to handle service shutdown. The listeners and every
+// connection are closed and we wait for the handlers to finish.
+func Shutdown() {
+	tarpitLocker.Lock()
+	config.enabled = false
+	for port, listener := range listenerTable {
+		listener.Close()
+		delete(listenerTable, port)
+	}
+	for conn := range connectionTable {
+		conn.close()
+	}
+	tarpitLocker.Unlock()
+
+	tarpitWaiter.Wait()
+}
+
+// Reload loads the tarpit settings and opens or closes the listeners for the
+// ports that were added or removed
+func Reload() {
+	fresh := loadConfig()
+
+	tarpitLocker.Lock()
+	defer tarpitLocker.Unlock()
+
+	config = fresh
+
+	for port, listener := range listenerTable {
+		if _, found := fresh.ports[port]; fresh.enabled && found {
+			continue
+		}
+		logger.Info("Closing tarpit port %d\n", port)
+		listener.Close()
+		delete(listenerTable, port)
+	}
+
+	listenerErrors = make(map[int]string)
+	if !fresh.enabled {
+		return
+	}
+
+	for port := range fresh.ports {
+		if _, found := listenerTable[port]; found {
+			continue
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			logger.Warn("Unable to open tarpit port %d: %v\n", port, err)
+			listenerErrors[port] = err.Error()
+			continue
+		}
+		logger.Info("Opened tarpit port %d\n", port)
+		listenerTable[port] = listener
+		tarpitWaiter.Add(1)
+		go acceptTask(listener, port)
+	}
+
+	// the interface addresses are looked up again in case the zone changed
+	zoneAddressLocker.Lock()
+	zoneAddressTime = time.Time{}
+	zoneAddressLocker.Unlock()
+}
+
+// loadConfig loads the tarpit settings. The ports can be a list of numbers or
+// objects with a port and a banner.
+func loadConfig() tarpitConfig {
+	fresh := tarpitConfig{
+		zone:           defaultZone,
+		ports:          make(map[int]string),
+		byteDelay:      defaultByteDelay,
+		keepalive:      defaultKeepalive,
+		maxDuration:    defaultMaxDuration,
+		maxConnections: defaultMaxConnections,
+	}
+
+	configJSON, err := settings.GetCurrentSettings([]string{"tarpit"})
+	if configJSON == nil || err != nil {
+		return fresh
+	}
+
+	item, ok := configJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid tarpit settings: %T\n", configJSON)
+		return fresh
+	}
+
+	if value, ok := item["enabled"].(bool); ok {
+		fresh.enabled = value
+	}
+	if value, ok := item["zone"].(string); ok && value != "" {
+		fresh.zone = value
+	}
+	if value, ok := item["byteDelayMillis"].(float64); ok && value > 0 {
+		fresh.byteDelay = time.Duration(value) * time.Millisecond
+	}
+	if value, ok := item["keepaliveSeconds"].(float64); ok && value > 0 {
+		fresh.keepalive = time.Duration(value) * time.Second
+	}
+	if value, ok := item["maxDurationSeconds"].(float64); ok && value > 0 {
+		fresh.maxDuration = time.Duration(value) * time.Second
+	}
+	if value, ok := item["maxConnections"].(float64); ok && value > 0 {
+		fresh.maxConnections = int(value)
+	}
+
+	portSlice, _ := item["ports"].([]interface{})
+	for _, value := range portSlice {
+		var port float64
+		var banner string
+		var hasBanner bool
+
+		switch entry := value.(type) {
+		case float64:
+			port = entry
+		case map[string]interface{}:
+			port, _ = entry["port"].(float64)
+			banner, hasBanner = entry["banner"].(string)
+		}
+
+		if port < 1 || port > 65535 {
+			logger.Warn("Ignoring invalid tarpit port: %v\n", value)
+			continue
+		}
+		if !hasBanner {
+			banner = defaultBanners[int(port)]
+		}
+		fresh.ports[int(port)] = banner
+	}
+
+	logger.Info("Loaded tarpit settings enabled:%v zone:%s ports:%d delay:%v keepalive:%v duration:%v max:%d\n",
+		fresh.enabled, fresh.zone, len(fresh.ports), fresh.byteDelay, fresh.keepalive, fresh.maxDuration, fresh.maxConnections)
+	return fresh
+}
+
+// acceptTask accepts the connections to a tarpit port until the listener is closed
+func acceptTask(listener net.Listener, port int) {
+	defer tarpitWaiter.Done()
+
+	for {
+		socket, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		handleAccept(socket, port)
+	}
+}
+
+// handleAccept starts the handler for a new connection if it was made to an
+// address in the tarpit zone and we are not already holding the maximum
+func handleAccept(socket net.Conn, port int) {
+	local, _ := socket.LocalAddr().(*net.TCPAddr)
+	remote, _ := socket.RemoteAddr().(*net.TCPAddr)
+	if local == nil || remote == nil {
+		socket.Close()
+		return
+	}
+
+	tarpitLocker.Lock()
+	current := config
+	banner := current.ports[port]
+	full := len(connectionTable) >= current.maxConnections
+	tarpitLocker.Unlock()
+
+	if !isZoneAddress(current.zone, local.IP) {
+		logger.Debug("Closing tarpit connection from %v to %v outside zone %s\n", remote, local, current.zone)
+		socket.Close()
+		return
+	}
+
+	if full {
+		overseer.AddCounter("tarpit_rejected", 1)
+		tarpitLocker.Lock()
+		rejectedCount++
+		tarpitLocker.Unlock()
+		logEvent(remote, local, "rejected", 0, 0, nil)
+		socket.Close()
+		return
+	}
+
+	conn := newConnection(socket, remote, local, banner)
+
+	tarpitLocker.Lock()
+	connectionTable[conn] = true
+	acceptedCount++
+	tarpitLocker.Unlock()
+
+	overseer.AddCounter("tarpit_accepted", 1)
+	logger.Info("Tarpit connection from %v to port %d\n", remote, local.Port)
+	logEvent(remote, local, "connect", 0, 0, nil)
+	raiseAlert(remote, local)
+
+	tarpitWaiter.Add(1)
+	go func() {
+		defer tarpitWaiter.Done()
+		conn.run(current)
+
+		tarpitLocker.Lock()
+		delete(connectionTable, conn)
+		tarpitLocker.Unlock()
+	}()
+}
+
+// isZoneAddress returns true if the address belongs to an interface in the zone
+func isZoneAddress(zone string, address net.IP) bool {
+	zoneAddressLocker.Lock()
+	defer zoneAddressLocker.Unlock()
+
+	if time.Since(zoneAddressTime) >= addressCacheTime {
+		zoneAddresses = make(map[string]bool)
+		for _, device := range zones.GetZoneDevices(zone) {
+			face, err := net.InterfaceByName(device)
+			if err != nil {
+				continue
+			}
+			list, err := face.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, item := range list {
+				if network, ok := item.(*net.IPNet); ok {
+					zoneAddresses[network.IP.String()] = true
+				}
+			}
+		}
+		zoneAddressTime = time.Now()
+	}
+
+	// IPv4 connections to a dual stack listener have a mapped local address
+	if address4 := address.To4(); address4 != nil {
+		address = address4
+	}
+	return zoneAddresses[address.String()]
+}
+
+// raiseAlert publishes an alert for a client address we haven't seen recently
+func raiseAlert(remote *net.TCPAddr, local *net.TCPAddr) {
+	now := time.Now()
+	key := remote.IP.String()
+
+	tarpitLocker.Lock()
+	last, found := alertTable[key]
+	if found && now.Sub(last) < alertInterval {
+		tarpitLocker.Unlock()
+		return
+	}
+	alertTable[key] = now
+	for address, stamp := range alertTable {
+		if now.Sub(stamp) >= alertInterval {
+			delete(alertTable, address)
+		}
+	}
+	tarpitLocker.Unlock()
+
+	eventbus.PublishAlert("tarpit", fmt.Sprintf("Connection to unused port %d from %s", local.Port, key), map[string]interface{}{
+		"address": key,
+		"port":    local.Port,
+	})
+}
+
+// GetStatus returns the tarpit ports, counters, and current connections
+func GetStatus() Status {
+	status := Status{Ports: []int{}, Connections: []ConnectionStatus{}}
+
+	tarpitLocker.Lock()
+	status.Enabled = config.enabled
+	status.Zone = config.zone
+	status.Accepted = acceptedCount
+	status.Rejected = rejectedCount
+	for port := range listenerTable {
+		status.Ports = append(status.Ports, port)
+	}
+	if len(listenerErrors) != 0 {
+		status.Errors = make(map[int]string)
+		for port, message := range listenerErrors {
+			status.Errors[port] = message
+		}
+	}
+	for conn := range connectionTable {
+		status.Connections = append(status.Connections, conn.getStatus())
+	}
+	tarpitLocker.Unlock()
+
+	sort.Ints(status.Ports)
+	sort.Slice(status.Connections, func(i, j int) bool {
+		return status.Connections[i].Started.Before(status.Connections[j].Started)
+	})
+	return status
+}
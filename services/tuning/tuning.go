@@ -0,0 +1,260 @@
+// Package tuning applies the runtime tuning settings for packetd. The
+// settings allow GOMAXPROCS, the GC percent, a soft memory limit, and the
+// process nice level to be adjusted for routers with little RAM or CPU.
+package tuning
+
+import (
+	"io/ioutil"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// how often we check the memory usage against the soft memory limit
+const memoryCheckSeconds = 10
+
+// Config holds the tuning configuration from the settings. A zero value
+// for any of the fields means the runtime default is used.
+type Config struct {
+	MaxProcs      int   `json:"maxProcs"`
+	GCPercent     int   `json:"gcPercent"`
+	MemoryLimitMB int64 `json:"memoryLimitMB"`
+	Nice          int   `json:"nice"`
+}
+
+// Status holds the tuning configuration along with the current values
+type Status struct {
+	Config         Config `json:"config"`
+	MaxProcs       int    `json:"maxProcs"`
+	NumCPU         int    `json:"numCPU"`
+	GCPercent      int    `json:"gcPercent"`
+	MemoryLimit    int64  `json:"memoryLimit"`
+	Nice           int    `json:"nice"`
+	HeapAlloc      uint64 `json:"heapAlloc"`
+	HeapSys        uint64 `json:"heapSys"`
+	HeapReleased   uint64 `json:"heapReleased"`
+	FreeOSMemories uint64 `json:"freeOSMemories"`
+}
+
+var config Config
+var appliedGCPercent int
+var defaultMaxProcs int
+var defaultGCPercent int
+var defaultNice int
+var freeOSMemories uint64
+var tuningMutex sync.Mutex
+var shutdownChannel = make(chan bool)
+
+// Startup is called to handle service startup
+func Startup() {
+	defaultMaxProcs = runtime.GOMAXPROCS(0)
+	defaultGCPercent = debug.SetGCPercent(100)
+	debug.SetGCPercent(defaultGCPercent)
+	appliedGCPercent = defaultGCPercent
+
+	nice, err := getNice()
+	if err == nil {
+		defaultNice = nice
+	}
+
+	Reload()
+	go memoryTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	shutdownChannel <- true
+	select {
+	case <-shutdownChannel:
+	case <-time.After(10 * time.Second):
+		logger.Warn("Failed to properly shutdown tuning memoryTask\n")
+	}
+}
+
+// Reload loads the tuning settings and applies them
+func Reload() {
+	applyConfig(loadConfig())
+}
+
+// GetStatus returns the tuning configuration and the current runtime values
+func GetStatus() Status {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	tuningMutex.Lock()
+	defer tuningMutex.Unlock()
+
+	status := Status{
+		Config:         config,
+		MaxProcs:       runtime.GOMAXPROCS(0),
+		NumCPU:         runtime.NumCPU(),
+		GCPercent:      appliedGCPercent,
+		MemoryLimit:    debug.SetMemoryLimit(-1),
+		HeapAlloc:      mem.HeapAlloc,
+		HeapSys:        mem.HeapSys,
+		HeapReleased:   mem.HeapReleased,
+		FreeOSMemories: freeOSMemories,
+	}
+
+	nice, err := getNice()
+	if err == nil {
+		status.Nice = nice
+	}
+
+	return status
+}
+
+// loadConfig loads the tuning configuration from the settings
+func loadConfig() Config {
+	var result Config
+
+	tuningJSON, err := settings.GetCurrentSettings([]string{"system", "tuning"})
+	if tuningJSON == nil || err != nil {
+		return result
+	}
+
+	item, ok := tuningJSON.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid system tuning settings: %T\n", tuningJSON)
+		return result
+	}
+
+	if value, ok := item["maxProcs"].(float64); ok {
+		result.MaxProcs = int(value)
+	}
+	if value, ok := item["gcPercent"].(float64); ok {
+		result.GCPercent = int(value)
+	}
+	if value, ok := item["memoryLimitMB"].(float64); ok {
+		result.MemoryLimitMB = int64(value)
+	}
+	if value, ok := item["nice"].(float64); ok {
+		result.Nice = int(value)
+	}
+
+	return result
+}
+
+// applyConfig applies the tuning configuration to the runtime
+func applyConfig(newConfig Config) {
+	tuningMutex.Lock()
+	defer tuningMutex.Unlock()
+
+	maxProcs := defaultMaxProcs
+	if newConfig.MaxProcs > 0 {
+		maxProcs = newConfig.MaxProcs
+	}
+	runtime.GOMAXPROCS(maxProcs)
+
+	gcPercent := defaultGCPercent
+	if newConfig.GCPercent != 0 {
+		gcPercent = newConfig.GCPercent
+	}
+	debug.SetGCPercent(gcPercent)
+	appliedGCPercent = gcPercent
+
+	var memoryLimit int64 = math.MaxInt64
+	if newConfig.MemoryLimitMB > 0 {
+		memoryLimit = newConfig.MemoryLimitMB * 1024 * 1024
+	}
+	debug.SetMemoryLimit(memoryLimit)
+
+	// clamp to the valid nice range
+	nice := defaultNice
+	if newConfig.Nice != 0 {
+		nice = newConfig.Nice
+	}
+	if nice < -20 {
+		nice = -20
+	}
+	if nice > 19 {
+		nice = 19
+	}
+	err := setNice(nice)
+	if err != nil {
+		logger.Warn("Unable to set nice level %d: %s\n", nice, err.Error())
+	}
+
+	config = newConfig
+	logger.Info("Applied system tuning maxProcs:%d gcPercent:%d memoryLimitMB:%d nice:%d\n", maxProcs, gcPercent, newConfig.MemoryLimitMB, nice)
+}
+
+// memoryTask periodically checks the memory held by the runtime against the
+// soft memory limit and returns the free memory to the OS when it is over
+func memoryTask() {
+	for {
+		select {
+		case <-shutdownChannel:
+			shutdownChannel <- true
+			return
+		case <-time.After(memoryCheckSeconds * time.Second):
+			checkMemory()
+		}
+	}
+}
+
+// checkMemory calls FreeOSMemory if the runtime is holding more memory than the limit
+func checkMemory() {
+	tuningMutex.Lock()
+	limit := config.MemoryLimitMB * 1024 * 1024
+	tuningMutex.Unlock()
+
+	if limit <= 0 {
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	held := mem.Sys - mem.HeapReleased
+	if held <= uint64(limit) {
+		return
+	}
+
+	logger.Info("%OC|Memory held %d kB over limit %d kB. Freeing OS memory\n", "tuning_free_os_memory", 100, held/1024, limit/1024)
+	debug.FreeOSMemory()
+
+	tuningMutex.Lock()
+	freeOSMemories++
+	tuningMutex.Unlock()
+}
+
+// setNice sets the nice level for every thread in the process since the
+// priority on Linux is per thread, and new threads inherit it from the
+// thread that creates them
+func setNice(nice int) error {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getNice returns the nice level of the process
+func getNice() (int, error) {
+	// the raw syscall returns 20 - nice so it is always positive
+	value, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		return 0, err
+	}
+	return 20 - value, nil
+}
@@ -0,0 +1,332 @@
+package wireless
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// This is just enough generic netlink to talk to nl80211. Each request opens
+// its own socket, resolves the nl80211 family, sends one message, and reads
+// the replies until the ack or the end of the dump.
+
+// the netlink and generic netlink values we need from the kernel headers
+const (
+	nlmsgHeaderLen  = 16
+	genlHeaderLen   = 4
+	nlmsgError      = 2
+	nlmsgDone       = 3
+	nlmFlagRequest  = 0x1
+	nlmFlagAck      = 0x4
+	nlmFlagDump     = 0x300
+	nlaTypeMask     = 0x3fff
+	solNetlink      = 270
+	netlinkAddGroup = 1
+
+	genlIDCtrl            = 0x10
+	ctrlCmdGetFamily      = 3
+	ctrlAttrFamilyID      = 1
+	ctrlAttrFamilyName    = 2
+	ctrlAttrMcastGroups   = 7
+	ctrlAttrMcastGrpName  = 1
+	ctrlAttrMcastGrpID    = 2
+	genlCtrlVersion       = 1
+	nl80211FamilyName     = "nl80211"
+	nl80211Version        = 0
+	netlinkReceiveTimeout = 5 * time.Second
+	netlinkBufferSize     = 1 << 16
+)
+
+// nativeEndian is the byte order of the netlink messages, which is the host order
+var nativeEndian binary.ByteOrder
+
+func init() {
+	value := uint16(1)
+	if *(*byte)(unsafe.Pointer(&value)) == 1 {
+		nativeEndian = binary.LittleEndian
+	} else {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// attribute is a netlink attribute to encode in a request
+type attribute struct {
+	kind uint16
+	data []byte
+}
+
+// attributes holds the decoded attributes of a message by type
+type attributes map[uint16][]byte
+
+// conn is a generic netlink socket
+type conn struct {
+	fd       int
+	sequence uint32
+	family   uint16
+	groups   map[string]uint32
+}
+
+// dial opens a generic netlink socket and resolves the nl80211 family
+func dial() (*conn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	c := &conn{fd: fd, sequence: uint32(time.Now().Unix())}
+	if err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		c.close()
+		return nil, os.NewSyscallError("bind", err)
+	}
+	c.setTimeout(netlinkReceiveTimeout)
+
+	replies, err := c.execute(genlIDCtrl, genlCtrlVersion, ctrlCmdGetFamily, 0, []attribute{stringAttribute(ctrlAttrFamilyName, nl80211FamilyName)})
+	if err != nil {
+		c.close()
+		return nil, fmt.Errorf("nl80211 not available: %v", err)
+	}
+	if len(replies) == 0 || len(replies[0][ctrlAttrFamilyID]) < 2 {
+		c.close()
+		return nil, errors.New("nl80211 not available: no family id")
+	}
+
+	c.family = nativeEndian.Uint16(replies[0][ctrlAttrFamilyID])
+	c.groups = make(map[string]uint32)
+	for _, group := range parseNestedList(replies[0][ctrlAttrMcastGroups]) {
+		if name, id := group[ctrlAttrMcastGrpName], group[ctrlAttrMcastGrpID]; len(id) >= 4 {
+			c.groups[parseString(name)] = nativeEndian.Uint32(id)
+		}
+	}
+
+	return c, nil
+}
+
+// close closes the socket
+func (c *conn) close() {
+	syscall.Close(c.fd)
+}
+
+// setTimeout sets the time a receive waits for a message
+func (c *conn) setTimeout(timeout time.Duration) {
+	tv := syscall.NsecToTimeval(timeout.Nanoseconds())
+	syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+}
+
+// join subscribes the socket to a nl80211 multicast group
+func (c *conn) join(group string) error {
+	id, found := c.groups[group]
+	if !found {
+		return fmt.Errorf("nl80211 multicast group %s not found", group)
+	}
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(c.fd, solNetlink, netlinkAddGroup, int(id)))
+}
+
+// request sends a nl80211 command and returns the attributes of the replies
+func (c *conn) request(cmd uint8, dump bool, attrs []attribute) ([]attributes, error) {
+	var flags uint16
+	if dump {
+		flags = nlmFlagDump
+	}
+	return c.execute(c.family, nl80211Version, cmd, flags, attrs)
+}
+
+// execute sends a generic netlink message and reads the replies until the
+// ack, the error, or the end of the dump
+func (c *conn) execute(family uint16, version uint8, cmd uint8, flags uint16, attrs []attribute) ([]attributes, error) {
+	var replies []attributes
+
+	c.sequence++
+	payload := encodeAttributes(attrs)
+	message := make([]byte, nlmsgHeaderLen+genlHeaderLen, nlmsgHeaderLen+genlHeaderLen+len(payload))
+	nativeEndian.PutUint32(message[0:4], uint32(nlmsgHeaderLen+genlHeaderLen+len(payload)))
+	nativeEndian.PutUint16(message[4:6], family)
+	nativeEndian.PutUint16(message[6:8], flags|nlmFlagRequest|nlmFlagAck)
+	nativeEndian.PutUint32(message[8:12], c.sequence)
+	message[16] = cmd
+	message[17] = version
+	message = append(message, payload...)
+
+	if err := syscall.Sendto(c.fd, message, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	buffer := make([]byte, netlinkBufferSize)
+	for {
+		count, _, err := syscall.Recvfrom(c.fd, buffer, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+
+		for data := buffer[:count]; len(data) >= nlmsgHeaderLen; {
+			length := int(nativeEndian.Uint32(data[0:4]))
+			if length < nlmsgHeaderLen || length > len(data) {
+				return nil, errors.New("netlink message truncated")
+			}
+			kind := nativeEndian.Uint16(data[4:6])
+			sequence := nativeEndian.Uint32(data[8:12])
+			body := data[nlmsgHeaderLen:length]
+			data = data[align(length):]
+
+			// skip anything that isn't for this request like multicast events
+			if sequence != c.sequence {
+				continue
+			}
+
+			switch kind {
+			case nlmsgError:
+				if len(body) < 4 {
+					return nil, errors.New("netlink error truncated")
+				}
+				if code := int32(nativeEndian.Uint32(body[0:4])); code != 0 {
+					return nil, syscall.Errno(-code)
+				}
+				return replies, nil
+			case nlmsgDone:
+				return replies, nil
+			default:
+				if len(body) >= genlHeaderLen {
+					replies = append(replies, parseAttributes(body[genlHeaderLen:]))
+				}
+			}
+		}
+	}
+}
+
+// receiveEvent waits for a multicast message with one of the commands and
+// returns the command and its attributes
+func (c *conn) receiveEvent(commands ...uint8) (uint8, attributes, error) {
+	buffer := make([]byte, netlinkBufferSize)
+	for {
+		count, _, err := syscall.Recvfrom(c.fd, buffer, 0)
+		if err != nil {
+			return 0, nil, os.NewSyscallError("recvfrom", err)
+		}
+
+		for data := buffer[:count]; len(data) >= nlmsgHeaderLen+genlHeaderLen; {
+			length := int(nativeEndian.Uint32(data[0:4]))
+			if length < nlmsgHeaderLen+genlHeaderLen || length > len(data) {
+				break
+			}
+			kind := nativeEndian.Uint16(data[4:6])
+			cmd := data[nlmsgHeaderLen]
+			body := data[nlmsgHeaderLen+genlHeaderLen : length]
+			data = data[align(length):]
+
+			if kind != c.family {
+				continue
+			}
+			for _, want := range commands {
+				if cmd == want {
+					return cmd, parseAttributes(body), nil
+				}
+			}
+		}
+	}
+}
+
+// align rounds a length up to the netlink alignment
+func align(length int) int {
+	return (length + 3) &^ 3
+}
+
+// encodeAttributes encodes a list of attributes
+func encodeAttributes(attrs []attribute) []byte {
+	var data []byte
+	for _, attr := range attrs {
+		header := make([]byte, 4)
+		nativeEndian.PutUint16(header[0:2], uint16(4+len(attr.data)))
+		nativeEndian.PutUint16(header[2:4], attr.kind)
+		data = append(data, header...)
+		data = append(data, attr.data...)
+		data = append(data, make([]byte, align(len(attr.data))-len(attr.data))...)
+	}
+	return data
+}
+
+// parseAttributes decodes the attributes of a message or a nested attribute
+func parseAttributes(data []byte) attributes {
+	attrs := make(attributes)
+	for len(data) >= 4 {
+		length := int(nativeEndian.Uint16(data[0:2]))
+		kind := nativeEndian.Uint16(data[2:4]) & nlaTypeMask
+		if length < 4 || length > len(data) {
+			break
+		}
+		attrs[kind] = data[4:length]
+		if align(length) > len(data) {
+			break
+		}
+		data = data[align(length):]
+	}
+	return attrs
+}
+
+// parseNestedList decodes a nested attribute that holds a list of nested attributes
+func parseNestedList(data []byte) []attributes {
+	var list []attributes
+	for len(data) >= 4 {
+		length := int(nativeEndian.Uint16(data[0:2]))
+		if length < 4 || length > len(data) {
+			break
+		}
+		list = append(list, parseAttributes(data[4:length]))
+		if align(length) > len(data) {
+			break
+		}
+		data = data[align(length):]
+	}
+	return list
+}
+
+// parseString decodes a null terminated string attribute
+func parseString(data []byte) string {
+	for index, value := range data {
+		if value == 0 {
+			return string(data[:index])
+		}
+	}
+	return string(data)
+}
+
+// stringAttribute returns a null terminated string attribute
+func stringAttribute(kind uint16, value string) attribute {
+	return attribute{kind: kind, data: append([]byte(value), 0)}
+}
+
+// uint32Attribute returns a u32 attribute
+func uint32Attribute(kind uint16, value uint32) attribute {
+	data := make([]byte, 4)
+	nativeEndian.PutUint32(data, value)
+	return attribute{kind: kind, data: data}
+}
+
+// get returns a u8, u16, u32, or u64 attribute as a uint64, or zero if it is missing
+func (attrs attributes) get(kind uint16) uint64 {
+	data := attrs[kind]
+	switch len(data) {
+	case 1:
+		return uint64(data[0])
+	case 2:
+		return uint64(nativeEndian.Uint16(data))
+	case 4:
+		return uint64(nativeEndian.Uint32(data))
+	case 8:
+		return nativeEndian.Uint64(data)
+	}
+	return 0
+}
+
+// has returns true if the attribute is present, which is how flags are sent
+func (attrs attributes) has(kind uint16) bool {
+	_, found := attrs[kind]
+	return found
+}
+
+// nested returns a nested attribute decoded
+func (attrs attributes) nested(kind uint16) attributes {
+	return parseAttributes(attrs[kind])
+}
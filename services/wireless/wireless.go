@@ -0,0 +1,535 @@
+// Package wireless manages the wifi interfaces through nl80211. It lists the
+// stations associated to an access point with their signal and rates, kicks
+// a station, reads the channel survey, runs a scan, and changes the channel
+// and the transmit power at runtime. Everything comes back from the kernel as
+// structured data so nothing depends on the output format of iw or iwinfo.
+// The runtime changes last until the wireless configuration is applied again.
+package wireless
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// the nl80211 commands
+const (
+	cmdGetInterface   = 5
+	cmdSetWiphy       = 2
+	cmdGetStation     = 17
+	cmdDelStation     = 20
+	cmdGetScan        = 32
+	cmdTriggerScan    = 33
+	cmdNewScanResults = 34
+	cmdScanAborted    = 35
+	cmdGetSurvey      = 50
+)
+
+// the nl80211 attributes
+const (
+	attrWiphy              = 1
+	attrIfindex            = 3
+	attrIfname             = 4
+	attrIftype             = 5
+	attrMac                = 6
+	attrStaInfo            = 21
+	attrWiphyFreq          = 38
+	attrWiphyChannelType   = 39
+	attrBss                = 47
+	attrSsid               = 52
+	attrSurveyInfo         = 84
+	attrWiphyTxPowerSet    = 97
+	attrWiphyTxPowerLevel  = 98
+	attrScanFlags          = 158
+	attrChannelWidth       = 159
+	attrCenterFreq1        = 160
+	staInfoInactiveTime    = 1
+	staInfoRxBytes         = 2
+	staInfoTxBytes         = 3
+	staInfoSignal          = 7
+	staInfoTxBitrate       = 8
+	staInfoRxPackets       = 9
+	staInfoTxPackets       = 10
+	staInfoTxRetries       = 11
+	staInfoTxFailed        = 12
+	staInfoSignalAvg       = 13
+	staInfoRxBitrate       = 14
+	staInfoConnectedTime   = 16
+	staInfoRxBytes64       = 23
+	staInfoTxBytes64       = 24
+	rateInfoBitrate        = 1
+	rateInfoMcs            = 2
+	rateInfoBitrate32      = 5
+	rateInfoVhtMcs         = 6
+	surveyInfoFrequency    = 1
+	surveyInfoNoise        = 2
+	surveyInfoInUse        = 3
+	surveyInfoTime         = 4
+	surveyInfoTimeBusy     = 5
+	surveyInfoTimeRx       = 7
+	surveyInfoTimeTx       = 8
+	bssBssid               = 1
+	bssFrequency           = 2
+	bssBeaconInterval      = 4
+	bssInformationElements = 6
+	bssSignalMbm           = 7
+	bssStatus              = 9
+	bssSeenMsAgo           = 10
+	iftypeAP               = 3
+	scanFlagAP             = 1 << 2
+	txPowerAutomatic       = 0
+	txPowerFixed           = 2
+)
+
+// the time we wait for a scan to finish
+const scanTimeout = 15 * time.Second
+
+// the interface types by nl80211 number
+var iftypeNames = map[uint64]string{1: "adhoc", 2: "station", 3: "ap", 4: "ap_vlan", 5: "wds", 6: "monitor", 7: "mesh", 8: "p2p_client", 9: "p2p_go"}
+
+// the channel widths by nl80211 number
+var widthNames = map[uint64]string{0: "20_noht", 1: "20", 2: "40", 3: "80", 4: "80+80", 5: "160", 6: "5", 7: "10"}
+
+// the channel types for a channel change
+var channelTypes = map[string]uint32{"NOHT": 0, "HT20": 1, "HT40-": 2, "HT40+": 3}
+
+// Interface holds the state of a wifi interface
+type Interface struct {
+	Device          string  `json:"device"`
+	Wiphy           uint32  `json:"wiphy"`
+	Type            string  `json:"type"`
+	MAC             string  `json:"mac"`
+	SSID            string  `json:"ssid,omitempty"`
+	Frequency       uint32  `json:"frequency,omitempty"`
+	Channel         int     `json:"channel,omitempty"`
+	Width           string  `json:"width,omitempty"`
+	CenterFrequency uint32  `json:"centerFrequency,omitempty"`
+	TxPower         float64 `json:"txPower,omitempty"`
+}
+
+// Station holds a station associated to an interface
+type Station struct {
+	MAC              string  `json:"mac"`
+	Signal           int     `json:"signal"`
+	SignalAverage    int     `json:"signalAverage"`
+	TxBitrate        float64 `json:"txBitrate"`
+	RxBitrate        float64 `json:"rxBitrate"`
+	TxMCS            int     `json:"txMcs"`
+	RxMCS            int     `json:"rxMcs"`
+	InactiveMs       uint64  `json:"inactiveMs"`
+	ConnectedSeconds uint64  `json:"connectedSeconds"`
+	RxBytes          uint64  `json:"rxBytes"`
+	TxBytes          uint64  `json:"txBytes"`
+	RxPackets        uint64  `json:"rxPackets"`
+	TxPackets        uint64  `json:"txPackets"`
+	TxRetries        uint64  `json:"txRetries"`
+	TxFailed         uint64  `json:"txFailed"`
+}
+
+// Survey holds the channel survey for a frequency
+type Survey struct {
+	Frequency  uint32 `json:"frequency"`
+	Channel    int    `json:"channel"`
+	InUse      bool   `json:"inUse"`
+	Noise      int    `json:"noise"`
+	ActiveMs   uint64 `json:"activeMs"`
+	BusyMs     uint64 `json:"busyMs"`
+	ReceiveMs  uint64 `json:"receiveMs"`
+	TransmitMs uint64 `json:"transmitMs"`
+}
+
+// BSS holds a network found by a scan
+type BSS struct {
+	BSSID          string  `json:"bssid"`
+	SSID           string  `json:"ssid"`
+	Frequency      uint32  `json:"frequency"`
+	Channel        int     `json:"channel"`
+	Signal         float64 `json:"signal"`
+	BeaconInterval uint64  `json:"beaconInterval"`
+	SeenMsAgo      uint64  `json:"seenMsAgo"`
+	Associated     bool    `json:"associated"`
+}
+
+// Config holds a runtime change to an interface. The channel is used when
+// the frequency is zero, and the channel type is one of NOHT, HT20, HT40-,
+// or HT40+ with HT20 the default. A nil transmit power leaves it alone.
+type Config struct {
+	Channel     int      `json:"channel"`
+	Frequency   uint32   `json:"frequency"`
+	ChannelType string   `json:"channelType"`
+	TxPower     *float64 `json:"txPower"`
+	TxPowerAuto bool     `json:"txPowerAuto"`
+}
+
+// GetInterface returns the state of a wifi interface
+func GetInterface(device string) (Interface, error) {
+	var result Interface
+
+	index, err := getIndex(device)
+	if err != nil {
+		return result, err
+	}
+
+	c, err := dial()
+	if err != nil {
+		return result, err
+	}
+	defer c.close()
+
+	replies, err := c.request(cmdGetInterface, false, []attribute{uint32Attribute(attrIfindex, index)})
+	if err != nil {
+		return result, err
+	}
+	if len(replies) == 0 {
+		return result, fmt.Errorf("%s is not a wifi interface", device)
+	}
+
+	attrs := replies[0]
+	result.Device = parseString(attrs[attrIfname])
+	result.Wiphy = uint32(attrs.get(attrWiphy))
+	result.Type = iftypeNames[attrs.get(attrIftype)]
+	result.MAC = net.HardwareAddr(attrs[attrMac]).String()
+	result.SSID = string(attrs[attrSsid])
+	result.Frequency = uint32(attrs.get(attrWiphyFreq))
+	result.Channel = FrequencyToChannel(result.Frequency)
+	if attrs.has(attrChannelWidth) {
+		result.Width = widthNames[attrs.get(attrChannelWidth)]
+	}
+	result.CenterFrequency = uint32(attrs.get(attrCenterFreq1))
+	result.TxPower = float64(int32(attrs.get(attrWiphyTxPowerLevel))) / 100
+	return result, nil
+}
+
+// GetStations returns the stations associated to an interface
+func GetStations(device string) ([]Station, error) {
+	index, err := getIndex(device)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	replies, err := c.request(cmdGetStation, true, []attribute{uint32Attribute(attrIfindex, index)})
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Station{}
+	for _, attrs := range replies {
+		info := attrs.nested(attrStaInfo)
+		station := Station{
+			MAC:              net.HardwareAddr(attrs[attrMac]).String(),
+			Signal:           int(int8(info.get(staInfoSignal))),
+			SignalAverage:    int(int8(info.get(staInfoSignalAvg))),
+			InactiveMs:       info.get(staInfoInactiveTime),
+			ConnectedSeconds: info.get(staInfoConnectedTime),
+			RxBytes:          info.get(staInfoRxBytes),
+			TxBytes:          info.get(staInfoTxBytes),
+			RxPackets:        info.get(staInfoRxPackets),
+			TxPackets:        info.get(staInfoTxPackets),
+			TxRetries:        info.get(staInfoTxRetries),
+			TxFailed:         info.get(staInfoTxFailed),
+		}
+		// the 32 bit counters wrap so use the 64 bit ones when we have them
+		if info.has(staInfoRxBytes64) {
+			station.RxBytes = info.get(staInfoRxBytes64)
+		}
+		if info.has(staInfoTxBytes64) {
+			station.TxBytes = info.get(staInfoTxBytes64)
+		}
+		station.TxBitrate, station.TxMCS = parseRate(info.nested(staInfoTxBitrate))
+		station.RxBitrate, station.RxMCS = parseRate(info.nested(staInfoRxBitrate))
+		list = append(list, station)
+	}
+
+	return list, nil
+}
+
+// KickStation disconnects a station from an interface
+func KickStation(device string, mac string) error {
+	index, err := getIndex(device)
+	if err != nil {
+		return err
+	}
+
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	_, err = c.request(cmdDelStation, false, []attribute{uint32Attribute(attrIfindex, index), {kind: attrMac, data: hwaddr}})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Kicked wifi station %s from %s\n", hwaddr, device)
+	return nil
+}
+
+// GetSurvey returns the channel survey of an interface
+func GetSurvey(device string) ([]Survey, error) {
+	index, err := getIndex(device)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	replies, err := c.request(cmdGetSurvey, true, []attribute{uint32Attribute(attrIfindex, index)})
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Survey{}
+	for _, attrs := range replies {
+		info := attrs.nested(attrSurveyInfo)
+		if !info.has(surveyInfoFrequency) {
+			continue
+		}
+		survey := Survey{
+			Frequency:  uint32(info.get(surveyInfoFrequency)),
+			InUse:      info.has(surveyInfoInUse),
+			Noise:      int(int8(info.get(surveyInfoNoise))),
+			ActiveMs:   info.get(surveyInfoTime),
+			BusyMs:     info.get(surveyInfoTimeBusy),
+			ReceiveMs:  info.get(surveyInfoTimeRx),
+			TransmitMs: info.get(surveyInfoTimeTx),
+		}
+		survey.Channel = FrequencyToChannel(survey.Frequency)
+		list = append(list, survey)
+	}
+
+	return list, nil
+}
+
+// Scan runs a scan on an interface, waits for it to finish, and returns the
+// networks found. An access point has to be told it is scanning as one.
+func Scan(device string) ([]BSS, error) {
+	state, err := GetInterface(device)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := getIndex(device)
+	if err != nil {
+		return nil, err
+	}
+
+	// the scan results are announced on the scan group, which we join
+	// before starting the scan so we can't miss them
+	events, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer events.close()
+	if err = events.join("scan"); err != nil {
+		return nil, err
+	}
+
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	attrs := []attribute{uint32Attribute(attrIfindex, index)}
+	if state.Type == iftypeNames[iftypeAP] {
+		attrs = append(attrs, uint32Attribute(attrScanFlags, scanFlagAP))
+	}
+	if _, err = c.request(cmdTriggerScan, false, attrs); err != nil {
+		return nil, err
+	}
+
+	events.setTimeout(scanTimeout)
+	for {
+		cmd, event, err := events.receiveEvent(cmdNewScanResults, cmdScanAborted)
+		if err != nil {
+			return nil, fmt.Errorf("scan did not finish: %v", err)
+		}
+		if uint32(event.get(attrIfindex)) != index {
+			continue
+		}
+		if cmd == cmdScanAborted {
+			return nil, errors.New("scan aborted")
+		}
+		break
+	}
+
+	return GetScanResults(device)
+}
+
+// GetScanResults returns the networks found by the last scan on an interface
+func GetScanResults(device string) ([]BSS, error) {
+	index, err := getIndex(device)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	replies, err := c.request(cmdGetScan, true, []attribute{uint32Attribute(attrIfindex, index)})
+	if err != nil {
+		return nil, err
+	}
+
+	list := []BSS{}
+	for _, attrs := range replies {
+		info := attrs.nested(attrBss)
+		if !info.has(bssBssid) {
+			continue
+		}
+		bss := BSS{
+			BSSID:          net.HardwareAddr(info[bssBssid]).String(),
+			SSID:           parseSSID(info[bssInformationElements]),
+			Frequency:      uint32(info.get(bssFrequency)),
+			Signal:         float64(int32(info.get(bssSignalMbm))) / 100,
+			BeaconInterval: info.get(bssBeaconInterval),
+			SeenMsAgo:      info.get(bssSeenMsAgo),
+			Associated:     info.has(bssStatus),
+		}
+		bss.Channel = FrequencyToChannel(bss.Frequency)
+		list = append(list, bss)
+	}
+
+	return list, nil
+}
+
+// Configure changes the channel and the transmit power of an interface and
+// returns the state of the interface after the change
+func Configure(device string, config Config) (Interface, error) {
+	index, err := getIndex(device)
+	if err != nil {
+		return Interface{}, err
+	}
+
+	frequency := config.Frequency
+	if frequency == 0 && config.Channel != 0 {
+		if frequency = ChannelToFrequency(config.Channel); frequency == 0 {
+			return Interface{}, fmt.Errorf("invalid channel %d", config.Channel)
+		}
+	}
+
+	var attrs []attribute
+	if frequency != 0 {
+		channelType, found := channelTypes[strings.ToUpper(config.ChannelType)]
+		if config.ChannelType == "" {
+			channelType, found = channelTypes["HT20"], true
+		}
+		if !found {
+			return Interface{}, fmt.Errorf("invalid channel type %s", config.ChannelType)
+		}
+		attrs = append(attrs, uint32Attribute(attrWiphyFreq, frequency), uint32Attribute(attrWiphyChannelType, channelType))
+	}
+	if config.TxPowerAuto {
+		attrs = append(attrs, uint32Attribute(attrWiphyTxPowerSet, txPowerAutomatic))
+	} else if config.TxPower != nil {
+		attrs = append(attrs, uint32Attribute(attrWiphyTxPowerSet, txPowerFixed), uint32Attribute(attrWiphyTxPowerLevel, uint32(*config.TxPower*100)))
+	}
+	if len(attrs) == 0 {
+		return Interface{}, errors.New("nothing to change")
+	}
+
+	c, err := dial()
+	if err != nil {
+		return Interface{}, err
+	}
+	defer c.close()
+
+	if _, err = c.request(cmdSetWiphy, false, append([]attribute{uint32Attribute(attrIfindex, index)}, attrs...)); err != nil {
+		return Interface{}, err
+	}
+
+	logger.Info("Changed wifi interface %s frequency:%d txpower:%v auto:%v\n", device, frequency, config.TxPower, config.TxPowerAuto)
+	return GetInterface(device)
+}
+
+// ChannelToFrequency returns the frequency in MHz of a 2.4 or 5 GHz channel or zero if it is not valid
+func ChannelToFrequency(channel int) uint32 {
+	switch {
+	case channel == 14:
+		return 2484
+	case channel >= 1 && channel <= 13:
+		return uint32(2407 + channel*5)
+	case channel >= 32 && channel <= 177:
+		return uint32(5000 + channel*5)
+	}
+	return 0
+}
+
+// FrequencyToChannel returns the channel of a frequency in MHz or zero if it is not known
+func FrequencyToChannel(frequency uint32) int {
+	switch {
+	case frequency == 2484:
+		return 14
+	case frequency >= 2412 && frequency <= 2472:
+		return int(frequency-2407) / 5
+	case frequency >= 5160 && frequency <= 5885:
+		return int(frequency-5000) / 5
+	case frequency >= 5955 && frequency <= 7115:
+		return int(frequency-5950) / 5
+	}
+	return 0
+}
+
+// getIndex returns the interface index of a device
+func getIndex(device string) (uint32, error) {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(iface.Index), nil
+}
+
+// parseRate returns the bitrate in Mbit/s and the MCS index of a rate info, with -1 for no MCS
+func parseRate(info attributes) (float64, int) {
+	rate := info.get(rateInfoBitrate32)
+	if rate == 0 {
+		rate = info.get(rateInfoBitrate)
+	}
+
+	mcs := -1
+	if info.has(rateInfoMcs) {
+		mcs = int(info.get(rateInfoMcs))
+	} else if info.has(rateInfoVhtMcs) {
+		mcs = int(info.get(rateInfoVhtMcs))
+	}
+
+	return float64(rate) / 10, mcs
+}
+
+// parseSSID returns the SSID from the information elements of a beacon
+func parseSSID(data []byte) string {
+	for len(data) >= 2 {
+		id, length := data[0], int(data[1])
+		if len(data) < 2+length {
+			break
+		}
+		if id == 0 {
+			return string(data[2 : 2+length])
+		}
+		data = data[2+length:]
+	}
+	return ""
+}
@@ -0,0 +1,235 @@
+package wwan
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// the commands used to talk to the modems and the network configuration
+var uqmiCommand = "/sbin/uqmi"
+var uciCommand = "/sbin/uci"
+var ifupCommand = "/sbin/ifup"
+var ifdownCommand = "/sbin/ifdown"
+
+// the time we give a modem command before giving up
+const commandTimeout = 15 * time.Second
+
+// the APN authentication and PDP types netifd understands
+var apnAuthTypes = map[string]bool{"": true, "none": true, "pap": true, "chap": true, "both": true}
+var apnPDPTypes = map[string]bool{"": true, "ipv4": true, "ipv6": true, "ipv4v6": true}
+
+// APN holds the access point settings of a modem connection
+type APN struct {
+	APN      string `json:"apn"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+	PDPType  string `json:"pdpType"`
+}
+
+// Message holds an SMS message stored on a modem
+type Message struct {
+	ID        int    `json:"id"`
+	Sender    string `json:"sender"`
+	Timestamp string `json:"timestamp"`
+	Text      string `json:"text"`
+}
+
+// ModemStatus holds a modem, its last signal sample, and the usage of the current billing cycle
+type ModemStatus struct {
+	Modem
+	Signal *SignalSample `json:"signal,omitempty"`
+	Usage  Usage         `json:"usage"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// GetStatus returns the status of each modem sorted by device
+func GetStatus() []ModemStatus {
+	list := []ModemStatus{}
+
+	for _, modem := range GetModems() {
+		modemLocker.Lock()
+		state, found := modemTable[modem.Device]
+		if found {
+			status := ModemStatus{Modem: modem, Usage: state.usage, Error: state.lastError}
+			if count := len(state.history); count != 0 {
+				sample := state.history[count-1]
+				status.Signal = &sample
+			}
+			list = append(list, status)
+		}
+		modemLocker.Unlock()
+	}
+
+	return list
+}
+
+// ApplyAPN writes the APN settings to the network configuration of a modem
+// and restarts the connection so they are used. Without an APN the one saved
+// in the modem settings is applied.
+func ApplyAPN(device string, apn APN) error {
+	modem, err := findModem(device)
+	if err != nil {
+		return err
+	}
+
+	if apn.APN == "" {
+		apn = modem.apn
+	}
+
+	if apn.APN == "" {
+		return fmt.Errorf("missing apn")
+	}
+	if !apnAuthTypes[apn.Auth] {
+		return fmt.Errorf("invalid auth type %s", apn.Auth)
+	}
+	if !apnPDPTypes[apn.PDPType] {
+		return fmt.Errorf("invalid pdp type %s", apn.PDPType)
+	}
+
+	options := []struct {
+		name  string
+		value string
+	}{
+		{"apn", apn.APN},
+		{"username", apn.Username},
+		{"password", apn.Password},
+		{"auth", apn.Auth},
+		{"pdptype", apn.PDPType},
+	}
+
+	for _, option := range options {
+		key := "network." + modem.Network + "." + option.name
+		if option.value == "" {
+			// deleting an option that isn't there fails so the error is ignored
+			runCommand(uciCommand, "-q", "delete", key)
+			continue
+		}
+		if _, err = runCommand(uciCommand, "set", key+"="+option.value); err != nil {
+			runCommand(uciCommand, "revert", "network")
+			return err
+		}
+	}
+
+	if _, err = runCommand(uciCommand, "commit", "network"); err != nil {
+		return err
+	}
+
+	logger.Info("Applied APN %s to %s\n", apn.APN, modem.Network)
+	return Connect(device)
+}
+
+// Connect brings up the connection of a modem
+func Connect(device string) error {
+	modem, err := findModem(device)
+	if err != nil {
+		return err
+	}
+
+	if _, err = runCommand(ifupCommand, modem.Network); err != nil {
+		return err
+	}
+
+	logger.Info("Connecting wwan interface %s\n", modem.Network)
+	return nil
+}
+
+// Disconnect takes down the connection of a modem
+func Disconnect(device string) error {
+	modem, err := findModem(device)
+	if err != nil {
+		return err
+	}
+
+	if _, err = runCommand(ifdownCommand, modem.Network); err != nil {
+		return err
+	}
+
+	logger.Info("Disconnected wwan interface %s\n", modem.Network)
+	return nil
+}
+
+// GetMessages returns the SMS messages stored on a modem
+func GetMessages(device string) ([]Message, error) {
+	modem, err := findModem(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	output, err := runCommand(uqmiCommand, "-s", "-d", modem.ControlDevice, "--list-messages")
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(output, &ids); err != nil {
+		return nil, fmt.Errorf("invalid message list: %v", err)
+	}
+
+	list := []Message{}
+	for _, id := range ids {
+		message := Message{ID: id}
+		output, err = runCommand(uqmiCommand, "-s", "-d", modem.ControlDevice, "--get-message", fmt.Sprintf("%d", id))
+		if err != nil {
+			logger.Warn("Unable to read message %d from %s: %v\n", id, device, err)
+			continue
+		}
+		if err = json.Unmarshal(output, &message); err != nil {
+			logger.Warn("Invalid message %d from %s: %v\n", id, device, err)
+			continue
+		}
+		list = append(list, message)
+	}
+
+	return list, nil
+}
+
+// readSignal returns the signal of a modem. The radio type is a string and
+// everything else is a number.
+func readSignal(modem Modem, now time.Time) (SignalSample, error) {
+	sample := SignalSample{Time: now, Values: make(map[string]float64)}
+
+	output, err := runCommand(uqmiCommand, "-s", "-d", modem.ControlDevice, "--get-signal-info")
+	if err != nil {
+		return sample, err
+	}
+
+	var info map[string]interface{}
+	if err = json.Unmarshal(output, &info); err != nil {
+		return sample, fmt.Errorf("invalid signal info: %v", err)
+	}
+
+	for name, value := range info {
+		switch item := value.(type) {
+		case string:
+			if name == "type" {
+				sample.Type = item
+			}
+		case float64:
+			sample.Values[name] = item
+		}
+	}
+
+	return sample, nil
+}
+
+// runCommand runs a command with the timeout and returns the output, or the
+// output as the error if the command fails
+func runCommand(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		if text := strings.TrimSpace(string(output)); text != "" {
+			return nil, fmt.Errorf("%s: %s", name, text)
+		}
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return output, nil
+}
@@ -0,0 +1,399 @@
+// Package wwan manages the LTE modems. Each modem in the settings is polled
+// at a regular interval for the signal, which is kept as a time series, and
+// for the byte counters of its network device, which are added to the
+// wwan_usage table for the billing cycle so the data plan can be watched. The
+// modems are also controlled from here: the APN is applied to the network
+// configuration, the connection is brought up and down through netifd, and
+// the SMS messages the carrier sends are read from the modem.
+package wwan
+
+import (
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/reports"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// the defaults used when the wwan settings are missing
+const (
+	defaultIntervalSeconds = 60
+	defaultHistorySize     = 1440
+	defaultControlDevice   = "/dev/cdc-wdm0"
+	defaultBillingDay      = 1
+)
+
+// ErrNotFound is returned for a device that isn't a modem in the settings
+var ErrNotFound = errors.New("modem not found")
+
+// Modem holds the settings of a modem. The device is the network device of
+// the modem, the control device is the QMI device used to talk to it, and the
+// network is the netifd interface that brings up the connection. The APN
+// saved with the modem is used when one is applied without an APN, and is
+// never returned in the status since it has the password.
+type Modem struct {
+	Device        string `json:"device"`
+	ControlDevice string `json:"controlDevice"`
+	Network       string `json:"network"`
+	BillingDay    int    `json:"billingDay"`
+	apn           APN
+}
+
+// SignalSample holds the signal of a modem at a point in time. The values
+// depend on the radio type, like rssi for all of them and rsrp, rsrq, and snr
+// for LTE.
+type SignalSample struct {
+	Time   time.Time          `json:"time"`
+	Type   string             `json:"type"`
+	Values map[string]float64 `json:"values"`
+}
+
+// Usage holds the bytes used by a modem since the start of the billing cycle
+type Usage struct {
+	Device     string    `json:"device"`
+	CycleStart time.Time `json:"cycleStart"`
+	CycleEnd   time.Time `json:"cycleEnd"`
+	RxBytes    uint64    `json:"rxBytes"`
+	TxBytes    uint64    `json:"txBytes"`
+	Bytes      uint64    `json:"bytes"`
+}
+
+// modemState holds the signal history and the last byte counters of a modem
+type modemState struct {
+	modem     Modem
+	history   []SignalSample
+	lastError string
+	rxBytes   uint64
+	txBytes   uint64
+	counted   bool
+	usage     Usage
+}
+
+var modemTable = make(map[string]*modemState)
+var modemLocker sync.Mutex
+var interval = defaultIntervalSeconds
+var historySize = defaultHistorySize
+var reloadChannel = make(chan bool, 1)
+var shutdownChannel = make(chan bool)
+var pollWaiter sync.WaitGroup
+
+// init registers the APN password in the modem settings with the settings
+// secrets and the usage table with the reports schema registry. The usage
+// table has one row per modem per billing cycle and is updated in place.
+func init() {
+	settings.RegisterSecret("wwan/modems/*/apn/password", settings.SecretEncrypt)
+
+	reports.RegisterTable(reports.TableSchema{
+		Name:  "wwan_usage",
+		Owner: "wwan",
+		Columns: []reports.Column{
+			{Name: "time_stamp", Type: "bigint NOT NULL DEFAULT 0"},
+			{Name: "device", Type: "text NOT NULL DEFAULT ''"},
+			{Name: "rx_bytes", Type: "int8"},
+			{Name: "tx_bytes", Type: "int8"},
+			{Name: "bytes", Type: "int8"},
+		},
+		Unique:      []string{"time_stamp", "device"},
+		TrimPercent: .1,
+	})
+}
+
+// Startup is called to handle service startup
+func Startup() {
+	loadSettings()
+	pollWaiter.Add(1)
+	go pollTask()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+	close(shutdownChannel)
+	pollWaiter.Wait()
+}
+
+// Reload loads the wwan settings
+func Reload() {
+	loadSettings()
+	select {
+	case reloadChannel <- true:
+	default:
+	}
+}
+
+// GetModems returns the modems in the settings sorted by device
+func GetModems() []Modem {
+	modemLocker.Lock()
+	defer modemLocker.Unlock()
+
+	list := []Modem{}
+	for _, state := range modemTable {
+		list = append(list, state.modem)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	return list
+}
+
+// GetSignalHistory returns the signal samples of a modem since the argumented time
+func GetSignalHistory(device string, since time.Time) ([]SignalSample, error) {
+	modemLocker.Lock()
+	defer modemLocker.Unlock()
+
+	state, found := modemTable[device]
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	list := []SignalSample{}
+	for _, sample := range state.history {
+		if !sample.Time.Before(since) {
+			list = append(list, sample)
+		}
+	}
+	return list, nil
+}
+
+// GetUsage returns the bytes used by a modem in the current billing cycle
+// and the previous cycles from the reports database
+func GetUsage(device string, cycles int) (Usage, []map[string]interface{}, error) {
+	modemLocker.Lock()
+	state, found := modemTable[device]
+	var current Usage
+	var billingDay int
+	if found {
+		current = state.usage
+		billingDay = state.modem.BillingDay
+	}
+	modemLocker.Unlock()
+
+	if !found {
+		return Usage{}, nil, ErrNotFound
+	}
+
+	now := time.Now()
+	if current.CycleStart.IsZero() {
+		current = Usage{Device: device, CycleStart: getCycleStart(billingDay, now)}
+		current.CycleEnd = current.CycleStart.AddDate(0, 1, 0)
+	}
+
+	start := getCycleStart(billingDay, now).AddDate(0, -cycles, 0)
+	previous, err := reports.GetWwanUsage(device, start, cycles+1)
+	return current, previous, err
+}
+
+// findModem returns the settings of a modem
+func findModem(device string) (Modem, error) {
+	modemLocker.Lock()
+	defer modemLocker.Unlock()
+
+	state, found := modemTable[device]
+	if !found {
+		return Modem{}, ErrNotFound
+	}
+	return state.modem, nil
+}
+
+// loadSettings loads the modems and the polling settings. The history and
+// the counters of the modems that are still in the settings are kept.
+func loadSettings() {
+	freshInterval := defaultIntervalSeconds
+	freshHistory := defaultHistorySize
+	var modems []Modem
+
+	configJSON, err := settings.GetCurrentSettings([]string{"wwan"})
+	if configJSON != nil && err == nil {
+		item, ok := configJSON.(map[string]interface{})
+		if ok {
+			if value, ok := item["intervalSeconds"].(float64); ok && value > 0 {
+				freshInterval = int(value)
+			}
+			if value, ok := item["historySize"].(float64); ok && value > 0 {
+				freshHistory = int(value)
+			}
+			list, _ := item["modems"].([]interface{})
+			for _, entry := range list {
+				if modem, ok := parseModem(entry); ok {
+					modems = append(modems, modem)
+				}
+			}
+		} else {
+			logger.Warn("Invalid wwan settings: %T\n", configJSON)
+		}
+	}
+
+	modemLocker.Lock()
+	fresh := make(map[string]*modemState)
+	for _, modem := range modems {
+		state, found := modemTable[modem.Device]
+		if !found || state.modem.BillingDay != modem.BillingDay {
+			state = &modemState{}
+		}
+		state.modem = modem
+		if len(state.history) > freshHistory {
+			state.history = state.history[len(state.history)-freshHistory:]
+		}
+		fresh[modem.Device] = state
+	}
+	modemTable = fresh
+	interval = freshInterval
+	historySize = freshHistory
+	modemLocker.Unlock()
+
+	logger.Info("Loaded wwan settings modems:%d interval:%d history:%d\n", len(modems), freshInterval, freshHistory)
+}
+
+// parseModem returns the modem from an entry in the settings
+func parseModem(entry interface{}) (Modem, bool) {
+	item, ok := entry.(map[string]interface{})
+	if !ok {
+		logger.Warn("Invalid wwan modem: %T\n", entry)
+		return Modem{}, false
+	}
+
+	modem := Modem{ControlDevice: defaultControlDevice, BillingDay: defaultBillingDay}
+	modem.Device, _ = item["device"].(string)
+	if modem.Device == "" {
+		logger.Warn("Ignoring wwan modem without a device\n")
+		return Modem{}, false
+	}
+	modem.Network = modem.Device
+	if value, ok := item["controlDevice"].(string); ok && value != "" {
+		modem.ControlDevice = value
+	}
+	if value, ok := item["network"].(string); ok && value != "" {
+		modem.Network = value
+	}
+	if value, ok := item["apn"].(map[string]interface{}); ok {
+		modem.apn.APN, _ = value["apn"].(string)
+		modem.apn.Username, _ = value["username"].(string)
+		modem.apn.Password, _ = value["password"].(string)
+		modem.apn.Auth, _ = value["auth"].(string)
+		modem.apn.PDPType, _ = value["pdpType"].(string)
+	}
+	// a billing day past the 28th would skip February
+	if value, ok := item["billingDay"].(float64); ok && value >= 1 && value <= 28 {
+		modem.BillingDay = int(value)
+	}
+	return modem, true
+}
+
+// pollTask polls the modems at the configured interval
+func pollTask() {
+	defer pollWaiter.Done()
+
+	for {
+		modemLocker.Lock()
+		delay := time.Duration(interval) * time.Second
+		modemLocker.Unlock()
+
+		for _, modem := range GetModems() {
+			pollModem(modem, time.Now())
+		}
+
+		select {
+		case <-shutdownChannel:
+			return
+		case <-reloadChannel:
+		case <-time.After(delay):
+		}
+	}
+}
+
+// pollModem reads the signal and the byte counters of a modem
+func pollModem(modem Modem, now time.Time) {
+	sample, signalErr := readSignal(modem, now)
+	rxBytes, txBytes, countErr := readCounters(modem.Device)
+
+	modemLocker.Lock()
+	state, found := modemTable[modem.Device]
+	if !found {
+		modemLocker.Unlock()
+		return
+	}
+
+	state.lastError = ""
+	if signalErr != nil {
+		state.lastError = signalErr.Error()
+	} else {
+		state.history = append(state.history, sample)
+		if len(state.history) > historySize {
+			state.history = state.history[len(state.history)-historySize:]
+		}
+	}
+
+	var rxDelta, txDelta uint64
+	if countErr == nil {
+		// the first read only sets the baseline, and the counters start over
+		// when the device is created again so a lower value is all new
+		if state.counted {
+			rxDelta, txDelta = rxBytes, txBytes
+			if rxBytes >= state.rxBytes {
+				rxDelta = rxBytes - state.rxBytes
+			}
+			if txBytes >= state.txBytes {
+				txDelta = txBytes - state.txBytes
+			}
+		}
+		state.rxBytes, state.txBytes, state.counted = rxBytes, txBytes, true
+	}
+
+	cycleStart := getCycleStart(modem.BillingDay, now)
+	if !state.usage.CycleStart.Equal(cycleStart) {
+		state.usage = Usage{Device: modem.Device, CycleStart: cycleStart, CycleEnd: cycleStart.AddDate(0, 1, 0)}
+	}
+	state.usage.RxBytes += rxDelta
+	state.usage.TxBytes += txDelta
+	state.usage.Bytes += rxDelta + txDelta
+	modemLocker.Unlock()
+
+	if signalErr != nil {
+		logger.Warn("%OC|Unable to read the signal of %s: %v\n", "wwan_signal_failure", 10, modem.Device, signalErr)
+	}
+
+	if rxDelta == 0 && txDelta == 0 {
+		return
+	}
+
+	columns := map[string]interface{}{
+		"time_stamp": cycleStart,
+		"device":     modem.Device,
+	}
+	modifiedColumns := map[string]interface{}{
+		"rx_bytes": rxDelta,
+		"tx_bytes": txDelta,
+		"bytes":    rxDelta + txDelta,
+	}
+	reports.LogEvent(reports.CreateEvent("wwan_usage", "wwan_usage", 3, columns, modifiedColumns))
+}
+
+// readCounters returns the received and transmitted bytes of a network device
+func readCounters(device string) (uint64, uint64, error) {
+	var counters [2]uint64
+
+	for index, name := range []string{"rx_bytes", "tx_bytes"} {
+		data, err := ioutil.ReadFile("/sys/class/net/" + device + "/statistics/" + name)
+		if err != nil {
+			return 0, 0, err
+		}
+		counters[index], err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return counters[0], counters[1], nil
+}
+
+// getCycleStart returns the start of the billing cycle that contains the argumented time
+func getCycleStart(billingDay int, when time.Time) time.Time {
+	year, month, day := when.Date()
+	if day < billingDay {
+		month--
+	}
+	return time.Date(year, month, billingDay, 0, 0, 0, 0, when.Location())
+}
@@ -0,0 +1,433 @@
+// Package zones maps interfaces to logical zones. The interface IDs found in
+// the packet marks are mapped to zone names like LAN, WAN, GUEST, and VPN so
+// sessions and report events can be grouped by zone instead of by interface
+// number. Zones can also match on VLAN IDs and on the bridge an interface is
+// a member of, so tagged guest networks can be told apart.
+package zones
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// The default zone names
+const (
+	ZoneLAN   = "LAN"
+	ZoneWAN   = "WAN"
+	ZoneGuest = "GUEST"
+	ZoneVPN   = "VPN"
+)
+
+// how long we keep the details of an input interface before looking them up again
+const deviceCacheTime = 60 * time.Second
+
+// InterfaceZone holds the zone of an interface from the network settings
+type InterfaceZone struct {
+	InterfaceID int    `json:"interfaceId"`
+	Device      string `json:"device"`
+	Name        string `json:"name"`
+	Zone        string `json:"zone"`
+}
+
+// Zone holds a logical zone from the settings
+type Zone struct {
+	Name         string   `json:"name"`
+	Vlans        []int    `json:"vlans,omitempty"`
+	Interfaces   []string `json:"interfaces,omitempty"`
+	InterfaceIDs []int    `json:"interfaceIds,omitempty"`
+}
+
+// Status holds the zone settings and the resulting interface mapping
+type Status struct {
+	Zones      []Zone          `json:"zones"`
+	Interfaces []InterfaceZone `json:"interfaces"`
+}
+
+// zoneEntry holds a zone with lookup maps for the VLAN IDs and devices
+type zoneEntry struct {
+	config     Zone
+	vlans      map[uint16]bool
+	interfaces map[string]bool
+}
+
+// zoneDevice holds the details we need about an input interface
+type zoneDevice struct {
+	name    string
+	master  string
+	vlanID  uint16
+	expires time.Time
+}
+
+var zoneList []*zoneEntry
+var interfaceTable map[int]InterfaceZone
+var zoneLocker sync.RWMutex
+
+var deviceTable = make(map[uint32]*zoneDevice)
+var deviceLocker sync.Mutex
+
+// Startup is called to handle service startup
+func Startup() {
+	settings.RegisterValidator("zones", validateZones)
+	Reload()
+}
+
+// Shutdown is called to handle service shutdown
+func Shutdown() {
+}
+
+// Reload loads the zones and the interfaces from the network settings
+func Reload() {
+	freshZones := loadZones()
+	freshInterfaces := loadInterfaces(freshZones)
+
+	zoneLocker.Lock()
+	zoneList = freshZones
+	interfaceTable = freshInterfaces
+	zoneLocker.Unlock()
+
+	deviceLocker.Lock()
+	deviceTable = make(map[uint32]*zoneDevice)
+	deviceLocker.Unlock()
+
+	logger.Info("Loaded %d zones for %d interfaces\n", len(freshZones), len(freshInterfaces))
+}
+
+// validateZones checks the zones in the staged settings have unique names and valid VLAN IDs
+func validateZones(jsonSettings map[string]interface{}) []string {
+	var problems []string
+
+	network, _ := jsonSettings["network"].(map[string]interface{})
+	if network == nil || network["zones"] == nil {
+		return problems
+	}
+
+	zoneSlice, ok := network["zones"].([]interface{})
+	if !ok {
+		return []string{"zones must be a list"}
+	}
+
+	names := make(map[string]bool)
+	for index, value := range zoneSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("zone %d is not an object", index))
+			continue
+		}
+		name, _ := item["name"].(string)
+		if name == "" {
+			problems = append(problems, fmt.Sprintf("zone %d has no name", index))
+		} else if names[name] {
+			problems = append(problems, fmt.Sprintf("zone %d has duplicate name %s", index, name))
+		}
+		names[name] = true
+
+		for _, vlan := range getSettingsList(item, "vlans") {
+			if id, ok := vlan.(float64); !ok || id < 1 || id > 4094 {
+				problems = append(problems, fmt.Sprintf("zone %s has invalid VLAN %v", name, vlan))
+			}
+		}
+	}
+
+	return problems
+}
+
+// GetStatus returns the zones and the zone of each interface
+func GetStatus() Status {
+	status := Status{Zones: []Zone{}, Interfaces: []InterfaceZone{}}
+
+	zoneLocker.RLock()
+	defer zoneLocker.RUnlock()
+
+	for _, zone := range zoneList {
+		status.Zones = append(status.Zones, zone.config)
+	}
+	for _, item := range interfaceTable {
+		status.Interfaces = append(status.Interfaces, item)
+	}
+
+	sort.Slice(status.Interfaces, func(i, j int) bool {
+		return status.Interfaces[i].InterfaceID < status.Interfaces[j].InterfaceID
+	})
+
+	return status
+}
+
+// GetInterfaceZone returns the zone of the argumented interface ID or an
+// empty string if the interface is not known
+func GetInterfaceZone(interfaceID int) string {
+	zoneLocker.RLock()
+	defer zoneLocker.RUnlock()
+
+	return interfaceTable[interfaceID].Zone
+}
+
+// GetZoneDevices returns the devices of the interfaces in the argumented zone
+// along with the devices listed in the zone settings. Zones that only match on
+// VLAN IDs have no devices.
+func GetZoneDevices(zone string) []string {
+	zoneLocker.RLock()
+	defer zoneLocker.RUnlock()
+
+	found := make(map[string]bool)
+	for _, item := range interfaceTable {
+		if item.Zone == zone && item.Device != "" {
+			found[item.Device] = true
+		}
+	}
+	for _, entry := range zoneList {
+		if entry.config.Name != zone {
+			continue
+		}
+		for _, device := range entry.config.Interfaces {
+			found[device] = true
+		}
+	}
+
+	var list []string
+	for device := range found {
+		list = append(list, device)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// FindPacketZone returns the VLAN ID and zone of a packet received on the
+// argumented interface index. The VLAN ID comes from the 802.1Q tag when the
+// kernel gives it to us, otherwise from the VLAN interface the packet was
+// received on. The zone is empty if no zone matches the VLAN or the device.
+func FindPacketZone(index uint32, vlanid uint16) (uint16, string) {
+	device := findDevice(index)
+	if vlanid == 0 && device != nil {
+		vlanid = device.vlanID
+	}
+
+	zoneLocker.RLock()
+	defer zoneLocker.RUnlock()
+
+	// a VLAN match is more specific than an interface match so we check those first
+	if vlanid != 0 {
+		for _, zone := range zoneList {
+			if zone.vlans[vlanid] {
+				return vlanid, zone.config.Name
+			}
+		}
+	}
+
+	if device != nil {
+		for _, zone := range zoneList {
+			if zone.interfaces[device.name] || (device.master != "" && zone.interfaces[device.master]) {
+				return vlanid, zone.config.Name
+			}
+		}
+	}
+
+	return vlanid, ""
+}
+
+// loadZones loads the zones from the network settings
+func loadZones() []*zoneEntry {
+	var list []*zoneEntry
+
+	zonesJSON, err := settings.GetCurrentSettings([]string{"network", "zones"})
+	if zonesJSON == nil || err != nil {
+		return list
+	}
+
+	zoneSlice, ok := zonesJSON.([]interface{})
+	if !ok {
+		logger.Warn("Invalid zone settings: %T\n", zonesJSON)
+		return list
+	}
+
+	for _, value := range zoneSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok || item == nil {
+			logger.Warn("Invalid zone in settings: %T\n", value)
+			continue
+		}
+		name, ok := item["name"].(string)
+		if !ok || name == "" {
+			continue
+		}
+
+		zone := &zoneEntry{config: Zone{Name: name}, vlans: make(map[uint16]bool), interfaces: make(map[string]bool)}
+		for _, vlan := range getSettingsList(item, "vlans") {
+			if id, ok := vlan.(float64); ok && id > 0 && id < 4095 {
+				zone.vlans[uint16(id)] = true
+				zone.config.Vlans = append(zone.config.Vlans, int(id))
+			}
+		}
+		for _, device := range getSettingsList(item, "interfaces") {
+			if text, ok := device.(string); ok && text != "" {
+				zone.interfaces[text] = true
+				zone.config.Interfaces = append(zone.config.Interfaces, text)
+			}
+		}
+		for _, id := range getSettingsList(item, "interfaceIds") {
+			if number, ok := id.(float64); ok {
+				zone.config.InterfaceIDs = append(zone.config.InterfaceIDs, int(number))
+			}
+		}
+		list = append(list, zone)
+	}
+
+	return list
+}
+
+// loadInterfaces loads the interfaces from the network settings and finds the
+// zone of each one. An interface can name its zone directly, or be listed by
+// ID or device in a zone, otherwise we pick a default zone based on its type.
+func loadInterfaces(list []*zoneEntry) map[int]InterfaceZone {
+	table := make(map[int]InterfaceZone)
+
+	networkJSON, err := settings.GetCurrentSettings([]string{"network", "interfaces"})
+	if networkJSON == nil || err != nil {
+		logger.Warn("Unable to read network settings\n")
+		return table
+	}
+
+	networkSlice, ok := networkJSON.([]interface{})
+	if !ok {
+		logger.Warn("Unable to locate interfaces\n")
+		return table
+	}
+
+	for _, value := range networkSlice {
+		item, ok := value.(map[string]interface{})
+		if !ok || item == nil {
+			continue
+		}
+		interfaceID, ok := item["interfaceId"].(float64)
+		if !ok {
+			continue
+		}
+
+		entry := InterfaceZone{InterfaceID: int(interfaceID)}
+		entry.Device, _ = item["device"].(string)
+		entry.Name, _ = item["name"].(string)
+		entry.Zone, _ = item["zone"].(string)
+
+		if entry.Zone == "" {
+			entry.Zone = findConfiguredZone(list, entry)
+		}
+		if entry.Zone == "" {
+			entry.Zone = getDefaultZone(item)
+		}
+
+		table[entry.InterfaceID] = entry
+	}
+
+	return table
+}
+
+// findConfiguredZone returns the first zone that lists the interface ID or device
+func findConfiguredZone(list []*zoneEntry, entry InterfaceZone) string {
+	for _, zone := range list {
+		for _, id := range zone.config.InterfaceIDs {
+			if id == entry.InterfaceID {
+				return zone.config.Name
+			}
+		}
+		if entry.Device != "" && zone.interfaces[entry.Device] {
+			return zone.config.Name
+		}
+	}
+	return ""
+}
+
+// getDefaultZone returns the zone for an interface that isn't assigned one in the settings
+func getDefaultZone(item map[string]interface{}) string {
+	if wan, ok := item["wan"].(bool); ok && wan {
+		return ZoneWAN
+	}
+
+	switch item["type"] {
+	case "OPENVPN", "WIREGUARD", "IPSEC":
+		return ZoneVPN
+	}
+
+	return ZoneLAN
+}
+
+// findDevice returns the details for the argumented interface index
+func findDevice(index uint32) *zoneDevice {
+	if index == 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	deviceLocker.Lock()
+	device, found := deviceTable[index]
+	deviceLocker.Unlock()
+
+	if found && now.Before(device.expires) {
+		return device
+	}
+
+	face, err := net.InterfaceByIndex(int(index))
+	if err != nil {
+		logger.Debug("Unable to find interface %d: %s\n", index, err.Error())
+		return nil
+	}
+
+	device = &zoneDevice{name: face.Name, expires: now.Add(deviceCacheTime)}
+	device.vlanID = findDeviceVlan(face.Name)
+
+	// a bridge port has a master link that points to the bridge
+	master, err := os.Readlink("/sys/class/net/" + face.Name + "/master")
+	if err == nil {
+		device.master = filepath.Base(master)
+	}
+
+	deviceLocker.Lock()
+	deviceTable[index] = device
+	deviceLocker.Unlock()
+
+	return device
+}
+
+// findDeviceVlan returns the VLAN ID of a VLAN interface or zero for other interfaces
+func findDeviceVlan(name string) uint16 {
+	file, err := os.Open("/proc/net/vlan/config")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	// eth0.10        | 10  | eth0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "|")
+		if len(fields) != 3 || strings.TrimSpace(fields[0]) != name {
+			continue
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(fields[1]), 10, 16)
+		if err != nil {
+			return 0
+		}
+		return uint16(value)
+	}
+
+	return 0
+}
+
+// getSettingsList returns the named list from the argumented settings object
+func getSettingsList(item map[string]interface{}, name string) []interface{} {
+	list, ok := item[name].([]interface{})
+	if !ok {
+		return nil
+	}
+	return list
+}